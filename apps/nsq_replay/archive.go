@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// archive is a file written by nsq_to_file
+type archive struct {
+	path  string
+	topic string
+	// the <DATETIME> in its name, zero if unknown, and the end of the period
+	// it covers
+	start time.Time
+	end   time.Time
+}
+
+// the strftime directives nsq_to_file supports (see its strftime.go), as a
+// time layout, a regexp and the period they count
+var directives = map[byte]struct {
+	layout string
+	re     string
+	period time.Duration
+}{
+	'B': {"January", `[A-Za-z]+`, 0},
+	'b': {"Jan", `[A-Za-z]{3}`, 0},
+	'm': {"01", `\d{2}`, 31 * 24 * time.Hour},
+	'A': {"Monday", `[A-Za-z]+`, 0},
+	'a': {"Mon", `[A-Za-z]{3}`, 0},
+	'd': {"02", `\d{2}`, 24 * time.Hour},
+	'H': {"15", `\d{2}`, time.Hour},
+	'I': {"03", `\d{2}`, time.Hour},
+	'M': {"04", `\d{2}`, time.Minute},
+	'S': {"05", `\d{2}`, time.Second},
+	'Y': {"2006", `\d{4}`, 366 * 24 * time.Hour},
+	'y': {"06", `\d{2}`, 366 * 24 * time.Hour},
+	'p': {"PM", `[AP]M`, 0},
+	'Z': {"MST", `[A-Z]+`, 0},
+	'z': {"-0700", `[+-]\d{4}`, 0},
+}
+
+// archiveNamer parses the topic and <DATETIME> out of archive names
+type archiveNamer struct {
+	re     *regexp.Regexp
+	layout string
+	period time.Duration
+}
+
+func newArchiveNamer(filenameFormat string, datetimeFormat string) (*archiveNamer, error) {
+	n := &archiveNamer{}
+	var datetimeRe string
+	for i := 0; i < len(datetimeFormat); i++ {
+		c := datetimeFormat[i]
+		if c == '%' && i+1 < len(datetimeFormat) {
+			i++
+			if datetimeFormat[i] == '%' {
+				n.layout += "%"
+				datetimeRe += "%"
+				continue
+			}
+			d, ok := directives[datetimeFormat[i]]
+			if !ok {
+				return nil, fmt.Errorf("unsupported --datetime-format directive %%%c", datetimeFormat[i])
+			}
+			n.layout += d.layout
+			datetimeRe += d.re
+			if d.period > 0 && (n.period == 0 || d.period < n.period) {
+				n.period = d.period
+			}
+			continue
+		}
+		n.layout += string(c)
+		datetimeRe += regexp.QuoteMeta(string(c))
+	}
+
+	replacer := strings.NewReplacer(
+		regexp.QuoteMeta("<TOPIC>"), `(?P<topic>[\.a-zA-Z0-9_-]+?(?:#ephemeral)?)`,
+		regexp.QuoteMeta("<HOST>"), `[^/]*?`,
+		regexp.QuoteMeta("<PID>"), `\d+`,
+		regexp.QuoteMeta("<REV>"), `(?:-\d+)?`,
+		regexp.QuoteMeta("<DATETIME>"), `(?P<datetime>`+datetimeRe+`)`,
+	)
+	pattern := replacer.Replace(regexp.QuoteMeta(filenameFormat))
+	// {{.field}} partitions
+	pattern = regexp.MustCompile(`\\\{\\\{[^/]*?\\\}\\\}`).ReplaceAllString(pattern, `[^/]*?`)
+	re, err := regexp.Compile(`(?:^|/)` + pattern + `(?:\.gz|\.zst|\.sz)?$`)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --filename-format - %s", err)
+	}
+	n.re = re
+	return n, nil
+}
+
+// parse fills in the topic and period of a, when its name matches
+func (n *archiveNamer) parse(a *archive) {
+	m := n.re.FindStringSubmatch(filepath.ToSlash(a.path))
+	if m == nil {
+		return
+	}
+	for i, name := range n.re.SubexpNames() {
+		switch name {
+		case "topic":
+			a.topic = m[i]
+		case "datetime":
+			// nsq_to_file formats the local time
+			t, err := time.ParseInLocation(n.layout, m[i], time.Local)
+			if err == nil && n.period > 0 {
+				a.start = t
+				a.end = t.Add(n.period)
+			}
+		}
+	}
+}
+
+// findArchives returns the archives in paths, walking directories, in the
+// order they were written
+func findArchives(paths []string, namer *archiveNamer) ([]*archive, error) {
+	var archives []*archive
+	for _, p := range paths {
+		err := filepath.Walk(p, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			// skip nsq_to_file's in-progress .tmp files
+			if path != p && strings.HasPrefix(info.Name(), ".") {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.IsDir() {
+				return nil
+			}
+			a := &archive{path: path}
+			namer.parse(a)
+			archives = append(archives, a)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(archives, func(i, j int) bool {
+		if !archives[i].start.Equal(archives[j].start) {
+			return archives[i].start.Before(archives[j].start)
+		}
+		return archives[i].path < archives[j].path
+	})
+	return archives, nil
+}
+
+// openArchive returns a reader of the messages in a, decompressing it by its
+// extension
+func openArchive(a *archive) (io.ReadCloser, error) {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(f)
+	var r io.Reader
+	switch filepath.Ext(a.path) {
+	case ".gz":
+		r, err = gzip.NewReader(br)
+	case ".zst":
+		var dec *zstd.Decoder
+		dec, err = zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err == nil {
+			r = dec.IOReadCloser()
+		}
+	case ".sz":
+		r = snappy.NewReader(br)
+	case ".parquet":
+		err = fmt.Errorf("parquet archives are not supported")
+	default:
+		r = br
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &archiveReader{r, f}, nil
+}
+
+type archiveReader struct {
+	io.Reader
+	f *os.File
+}
+
+// Close closes the decompressor, if it needs closing, and the file
+func (r *archiveReader) Close() error {
+	if c, ok := r.Reader.(io.Closer); ok {
+		c.Close()
+	}
+	return r.f.Close()
+}
@@ -0,0 +1,442 @@
+// This is an NSQ client that republishes the messages in archives written
+// by nsq_to_file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/nsqio/nsq/internal/app"
+	"github.com/nsqio/nsq/internal/protocol"
+	"github.com/nsqio/nsq/internal/version"
+)
+
+var (
+	showVersion = flag.Bool("version", false, "print version string")
+
+	topic     = flag.String("topic", "", "NSQ topic to publish to (defaults to the <TOPIC> in each archive's name)")
+	rate      = flag.Int64("rate", 0, "throttle messages to n/second, 0 to disable")
+	batchSize = flag.Int("batch-size", 100, "publish up to this many messages at a time")
+
+	startTime = flag.String("start", "", "only replay messages from this time on (RFC3339)")
+	endTime   = flag.String("end", "", "only replay messages from before this time (RFC3339)")
+
+	timestampField         = flag.String("timestamp-field", "", "JSON field (a.b.c for nested fields) holding each message's time, as epoch seconds, milliseconds, microseconds or nanoseconds or RFC3339, to select messages by --start/--end rather than their archives' <DATETIME>")
+	originalTimestampField = flag.String("original-timestamp-field", "", "add a field with the original time of each message (the --timestamp-field or its archive's <DATETIME>, RFC3339) to JSON bodies, NSQ messages have no headers")
+
+	datetimeFormat = flag.String("datetime-format", "%Y-%m-%d_%H", "strftime compatible format of <DATETIME> in --filename-format, as given to nsq_to_file")
+	filenameFormat = flag.String("filename-format", "<TOPIC>.<HOST><REV>.<DATETIME>.log", "filename format of the archives, as given to nsq_to_file")
+
+	maxBackoffDuration = flag.Duration("max-backoff-duration", 2*time.Minute, "when nsqd is unavailable or refuses messages, retry with exponential backoff up to this long between attempts (0 exits instead)")
+
+	destNsqdTCPAddrs = app.StringArray{}
+)
+
+func init() {
+	flag.Var(&destNsqdTCPAddrs, "nsqd-tcp-address", "destination nsqd TCP address (may be given multiple times, batches are published to each in turn)")
+}
+
+func main() {
+	cfg := nsq.NewConfig()
+	flag.Var(&nsq.ConfigFlag{cfg}, "producer-opt", "option to passthrough to nsq.Producer (may be given multiple times, http://godoc.org/github.com/nsqio/go-nsq#Config)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <archive file or directory>...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("nsq_replay v%s\n", version.Binary)
+		return
+	}
+
+	if flag.NArg() == 0 {
+		log.Fatal("archive files or directories required")
+	}
+	if *topic != "" && !protocol.IsValidTopicName(*topic) {
+		log.Fatal("--topic is invalid")
+	}
+	if len(destNsqdTCPAddrs) == 0 {
+		log.Fatal("--nsqd-tcp-address required")
+	}
+	if *batchSize < 1 {
+		log.Fatal("--batch-size must be positive")
+	}
+
+	r := &replayer{
+		batchSize: *batchSize,
+		stopChan:  make(chan int),
+	}
+	var err error
+	if *startTime != "" {
+		r.start, err = time.Parse(time.RFC3339, *startTime)
+		if err != nil {
+			log.Fatalf("invalid --start - %s", err)
+		}
+	}
+	if *endTime != "" {
+		r.end, err = time.Parse(time.RFC3339, *endTime)
+		if err != nil {
+			log.Fatalf("invalid --end - %s", err)
+		}
+	}
+	if *timestampField != "" {
+		r.timestampPath = strings.Split(*timestampField, ".")
+	}
+	r.originalField = *originalTimestampField
+	if *rate > 0 {
+		r.interval = time.Second / time.Duration(*rate)
+		// spread a second's messages over a few batches
+		if n := int((*rate + 9) / 10); n < r.batchSize {
+			r.batchSize = n
+		}
+	}
+
+	namer, err := newArchiveNamer(*filenameFormat, *datetimeFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	archives, err := findArchives(flag.Args(), namer)
+	if err != nil {
+		log.Fatalf("failed to find archives - %s", err)
+	}
+
+	cfg.UserAgent = fmt.Sprintf("nsq_replay/%s go-nsq/%s", version.Binary, nsq.VERSION)
+	var producers []*nsq.Producer
+	for _, addr := range destNsqdTCPAddrs {
+		producer, err := nsq.NewProducer(addr, cfg)
+		if err != nil {
+			log.Fatalf("failed to create nsq.Producer - %s", err)
+		}
+		producers = append(producers, producer)
+		r.producers = append(r.producers, producer)
+	}
+
+	termChan := make(chan os.Signal, 1)
+	signal.Notify(termChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-termChan
+		log.Printf("stopping, unpublished messages are not replayed")
+		r.stop()
+	}()
+
+	failed := false
+	for _, a := range archives {
+		if !r.selectArchive(a) {
+			continue
+		}
+		topicName := *topic
+		if topicName == "" {
+			topicName = a.topic
+		}
+		if topicName == "" {
+			log.Printf("ERROR: skipping %s, no <TOPIC> in its name, use --topic", a.path)
+			failed = true
+			continue
+		}
+
+		published, skipped, err := r.replay(a, topicName)
+		if err == errStopped {
+			break
+		}
+		if err != nil {
+			log.Printf("ERROR: failed to replay %s - %s", a.path, err)
+			failed = true
+			r.batch = r.batch[:0]
+		}
+		log.Printf("replayed %d messages from %s to topic %s (%d skipped)", published, a.path, topicName, skipped)
+	}
+
+	for _, producer := range producers {
+		producer.Stop()
+	}
+	if failed || r.stopped() {
+		os.Exit(1)
+	}
+}
+
+var errStopped = fmt.Errorf("stopped")
+
+// publisher is the part of nsq.Producer the replayer uses
+type publisher interface {
+	Publish(topic string, body []byte) error
+	MultiPublish(topic string, body [][]byte) error
+	String() string
+}
+
+type replayer struct {
+	producers []publisher
+	next      int
+	batchSize int
+	batch     [][]byte
+
+	// throttling, the time the next message may be published
+	interval time.Duration
+	due      time.Time
+
+	start         time.Time
+	end           time.Time
+	timestampPath []string
+	originalField string
+
+	stopChan chan int
+}
+
+func (r *replayer) stop() {
+	close(r.stopChan)
+}
+
+func (r *replayer) stopped() bool {
+	select {
+	case <-r.stopChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// selectArchive is whether a may hold messages in the time window, by the
+// <DATETIME> in its name unless messages are selected by --timestamp-field
+func (r *replayer) selectArchive(a *archive) bool {
+	if (r.start.IsZero() && r.end.IsZero()) || r.timestampPath != nil {
+		return true
+	}
+	if a.start.IsZero() {
+		log.Printf("skipping %s, no <DATETIME> in its name to select it by --start/--end", a.path)
+		return false
+	}
+	if (!r.end.IsZero() && !a.start.Before(r.end)) || (!r.start.IsZero() && !a.end.After(r.start)) {
+		log.Printf("skipping %s, outside --start/--end", a.path)
+		return false
+	}
+	return true
+}
+
+// replay publishes the messages in a to topicName
+func (r *replayer) replay(a *archive, topicName string) (int, int, error) {
+	f, err := openArchive(a)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	var published, skipped int
+	br := bufio.NewReader(f)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("WARNING: skipping the truncated last message of %s", a.path)
+				skipped++
+			}
+			break
+		}
+		if err != nil {
+			return published, skipped, err
+		}
+		body, ok := r.transform(line[:len(line)-1], a)
+		if !ok {
+			skipped++
+			continue
+		}
+
+		r.batch = append(r.batch, body)
+		if len(r.batch) == r.batchSize {
+			err = r.flush(topicName)
+			if err != nil {
+				return published, skipped, err
+			}
+			published += r.batchSize
+		}
+	}
+	n := len(r.batch)
+	err = r.flush(topicName)
+	if err != nil {
+		return published, skipped, err
+	}
+	return published + n, skipped, nil
+}
+
+// transform returns body as it is to be published, and whether it's in the
+// time window
+func (r *replayer) transform(body []byte, a *archive) ([]byte, bool) {
+	if len(body) == 0 {
+		return nil, false
+	}
+	if r.timestampPath == nil && r.originalField == "" {
+		return body, true
+	}
+
+	var js map[string]interface{}
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+		d := json.NewDecoder(bytes.NewReader(body))
+		d.UseNumber()
+		if d.Decode(&js) != nil {
+			js = nil
+		}
+	}
+
+	t := a.start
+	if r.timestampPath != nil {
+		t = time.Time{}
+		if v, ok := getJSONPath(js, r.timestampPath); ok {
+			t, _ = parseTimestamp(v)
+		}
+		if !r.start.IsZero() || !r.end.IsZero() {
+			if t.IsZero() || t.Before(r.start) || (!r.end.IsZero() && !t.Before(r.end)) {
+				return nil, false
+			}
+		}
+	}
+
+	if r.originalField == "" || js == nil || t.IsZero() {
+		return body, true
+	}
+	js[r.originalField] = t.Format(time.RFC3339Nano)
+	out, err := json.Marshal(js)
+	if err != nil {
+		return body, true
+	}
+	return out, true
+}
+
+// flush publishes the batch, throttled, to the next producer, retrying with
+// exponential backoff on each in turn while nsqd is unavailable or applying
+// backpressure
+func (r *replayer) flush(topicName string) error {
+	if len(r.batch) == 0 {
+		return nil
+	}
+	if r.interval > 0 {
+		now := time.Now()
+		// allow up to a second of messages to catch up
+		if r.due.IsZero() {
+			r.due = now
+		} else if r.due.Before(now.Add(-time.Second)) {
+			r.due = now.Add(-time.Second)
+		}
+		r.due = r.due.Add(time.Duration(len(r.batch)) * r.interval)
+		if wait := r.due.Sub(now); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+
+	backoff := 100 * time.Millisecond
+	for {
+		if r.stopped() {
+			return errStopped
+		}
+		producer := r.producers[r.next%len(r.producers)]
+		r.next++
+
+		var err error
+		if len(r.batch) == 1 {
+			err = producer.Publish(topicName, r.batch[0])
+		} else {
+			err = producer.MultiPublish(topicName, r.batch)
+		}
+		if err == nil {
+			r.batch = r.batch[:0]
+			return nil
+		}
+		if *maxBackoffDuration <= 0 || !isRetryable(err) {
+			return err
+		}
+		if backoff > *maxBackoffDuration {
+			backoff = *maxBackoffDuration
+		}
+		log.Printf("backing off for %s - failed to publish to %s - %s", backoff, producer, err)
+		select {
+		case <-time.After(backoff):
+		case <-r.stopChan:
+		}
+		backoff *= 2
+	}
+}
+
+// isRetryable returns false for errors that will recur, like invalid
+// messages
+func isRetryable(err error) bool {
+	switch err := err.(type) {
+	case nsq.ErrProtocol:
+		for _, code := range []string{"E_INVALID", "E_BAD_", "E_UNAUTHORIZED", "E_AUTH_"} {
+			if strings.HasPrefix(err.Reason, code) {
+				return false
+			}
+		}
+	}
+	return err != nsq.ErrStopped
+}
+
+// getJSONPath returns the value at path in js, which may be nested as a.b.c
+func getJSONPath(js map[string]interface{}, path []string) (interface{}, bool) {
+	var v interface{} = js
+	for _, name := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		v, ok = m[name]
+		if !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// parseTimestamp parses a --timestamp-field value, telling epoch seconds,
+// milliseconds, microseconds and nanoseconds apart by their magnitude
+func parseTimestamp(v interface{}) (time.Time, error) {
+	var s string
+	switch v := v.(type) {
+	case json.Number:
+		s = v.String()
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err == nil {
+			return t, nil
+		}
+		s = v
+	default:
+		return time.Time{}, fmt.Errorf("invalid timestamp %v", v)
+	}
+
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		switch abs := math.Abs(float64(n)); {
+		case abs < 1e11:
+			return time.Unix(n, 0), nil
+		case abs < 1e14:
+			return time.Unix(0, n*int64(time.Millisecond)), nil
+		case abs < 1e17:
+			return time.Unix(0, n*int64(time.Microsecond)), nil
+		}
+		return time.Unix(0, n), nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+	}
+	switch abs := math.Abs(f); {
+	case abs < 1e11:
+		f *= 1e9
+	case abs < 1e14:
+		f *= 1e6
+	case abs < 1e17:
+		f *= 1e3
+	}
+	return time.Unix(0, int64(f)), nil
+}
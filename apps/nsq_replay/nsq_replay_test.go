@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type testPublisher struct {
+	bodies [][]byte
+}
+
+func (p *testPublisher) Publish(topic string, body []byte) error {
+	return p.MultiPublish(topic, [][]byte{body})
+}
+
+func (p *testPublisher) MultiPublish(topic string, body [][]byte) error {
+	for _, b := range body {
+		p.bodies = append(p.bodies, append([]byte{}, b...))
+	}
+	return nil
+}
+
+func (p *testPublisher) String() string {
+	return "test"
+}
+
+func newTestReplayer(batchSize int) (*replayer, *testPublisher) {
+	p := &testPublisher{}
+	return &replayer{
+		producers: []publisher{p},
+		batchSize: batchSize,
+		stopChan:  make(chan int),
+	}, p
+}
+
+func mustParseTime(t *testing.T, s string) time.Time {
+	tm, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tm
+}
+
+func TestSelectArchive(t *testing.T) {
+	hour := &archive{
+		path:  "test.host.2019-01-02_10.log",
+		start: mustParseTime(t, "2019-01-02T10:00:00Z"),
+		end:   mustParseTime(t, "2019-01-02T11:00:00Z"),
+	}
+	tests := []struct {
+		name  string
+		start string
+		end   string
+		want  bool
+	}{
+		{"no window", "", "", true},
+		{"start at the archive's end", "2019-01-02T11:00:00Z", "", false},
+		{"start within", "2019-01-02T10:59:59Z", "", true},
+		{"end at the archive's start", "", "2019-01-02T10:00:00Z", false},
+		{"end within", "", "2019-01-02T10:00:01Z", true},
+		{"window around", "2019-01-02T09:00:00Z", "2019-01-02T12:00:00Z", true},
+		{"window before", "2019-01-02T08:00:00Z", "2019-01-02T09:00:00Z", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := newTestReplayer(1)
+			if tt.start != "" {
+				r.start = mustParseTime(t, tt.start)
+			}
+			if tt.end != "" {
+				r.end = mustParseTime(t, tt.end)
+			}
+			if got := r.selectArchive(hour); got != tt.want {
+				t.Errorf("selectArchive() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// archives without a <DATETIME> can only be selected by --timestamp-field
+	r, _ := newTestReplayer(1)
+	r.start = mustParseTime(t, "2019-01-02T10:00:00Z")
+	if r.selectArchive(&archive{path: "test.log"}) {
+		t.Errorf("selectArchive() = true for an archive without <DATETIME>")
+	}
+	r.timestampPath = []string{"ts"}
+	if !r.selectArchive(&archive{path: "test.log"}) {
+		t.Errorf("selectArchive() = false with --timestamp-field")
+	}
+}
+
+func TestTransformWindow(t *testing.T) {
+	r, _ := newTestReplayer(1)
+	r.start = mustParseTime(t, "2019-01-02T10:00:00Z")
+	r.end = mustParseTime(t, "2019-01-02T11:00:00Z")
+	r.timestampPath = []string{"meta", "ts"}
+
+	tests := []struct {
+		body string
+		want bool
+	}{
+		{`{"meta":{"ts":"2019-01-02T10:00:00Z"}}`, true},
+		{`{"meta":{"ts":"2019-01-02T10:59:59.999Z"}}`, true},
+		{`{"meta":{"ts":"2019-01-02T11:00:00Z"}}`, false},
+		{`{"meta":{"ts":"2019-01-02T09:59:59Z"}}`, false},
+		{`{"meta":{"ts":1546423200}}`, true},           // seconds, 10:00
+		{`{"meta":{"ts":1546423199999}}`, false},       // milliseconds, 09:59:59.999
+		{`{"meta":{"ts":1546426799999999}}`, true},     // microseconds, 10:59:59.999999
+		{`{"meta":{"ts":1546426800000000000}}`, false}, // nanoseconds, 11:00
+		{`{"meta":{}}`, false},
+		{`not json`, false},
+		{``, false},
+	}
+	for _, tt := range tests {
+		_, ok := r.transform([]byte(tt.body), &archive{})
+		if ok != tt.want {
+			t.Errorf("transform(%s) = %v, want %v", tt.body, ok, tt.want)
+		}
+	}
+
+	r.originalField = "original_ts"
+	out, ok := r.transform([]byte(`{"meta":{"ts":1546423200}}`), &archive{})
+	if !ok {
+		t.Fatal("transform() = false")
+	}
+	var js map[string]interface{}
+	json.Unmarshal(out, &js)
+	ts, _ := js["original_ts"].(string)
+	if tm, err := time.Parse(time.RFC3339Nano, ts); err != nil || !tm.Equal(r.start) {
+		t.Errorf("original_ts = %v", js["original_ts"])
+	}
+}
+
+func TestReplayArchives(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsq_replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := []byte("a\nb\n\nc\ntruncated")
+	var gz, zst bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(data)
+	gw.Close()
+	zw, _ := zstd.NewWriter(&zst)
+	zw.Write(data)
+	zw.Close()
+
+	for name, content := range map[string][]byte{
+		"test.log":     data,
+		"test.log.gz":  gz.Bytes(),
+		"test.log.zst": zst.Bytes(),
+	} {
+		path := filepath.Join(dir, name)
+		err := ioutil.WriteFile(path, content, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, p := newTestReplayer(2)
+		published, skipped, err := r.replay(&archive{path: path}, "test")
+		if err != nil {
+			t.Fatalf("%s: replay() failed - %s", name, err)
+		}
+		// the empty and the truncated last message are skipped
+		if published != 3 || skipped != 2 {
+			t.Errorf("%s: replay() = %d published, %d skipped", name, published, skipped)
+		}
+		if want := [][]byte{[]byte("a"), []byte("b"), []byte("c")}; !reflect.DeepEqual(p.bodies, want) {
+			t.Errorf("%s: published %q", name, p.bodies)
+		}
+	}
+}
+
+func TestFlushRate(t *testing.T) {
+	// 100 messages/second in batches of 10
+	r, p := newTestReplayer(10)
+	r.interval = 10 * time.Millisecond
+
+	start := time.Now()
+	for i := 0; i < 50; i++ {
+		r.batch = append(r.batch, []byte("test"))
+		if len(r.batch) == r.batchSize {
+			err := r.flush("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// each batch waits for its share of the rate
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond || elapsed > 1500*time.Millisecond {
+		t.Errorf("published 50 messages at 100/s in %s", elapsed)
+	}
+	if len(p.bodies) != 50 {
+		t.Errorf("published %d messages", len(p.bodies))
+	}
+
+	// after a pause, at most a second of messages catch up
+	r.due = time.Now().Add(-time.Minute)
+	r.batch = append(r.batch, make([][]byte, 100)...)
+	start = time.Now()
+	err := r.flush("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("a second of messages after a pause waited %s", elapsed)
+	}
+	r.batch = append(r.batch, make([][]byte, 10)...)
+	start = time.Now()
+	err = r.flush("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("messages past the catch up second waited %s", elapsed)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nsqio/nsq/internal/clusterinfo"
+)
+
+// report is a poll of a channel's stats, as output by --output=jsonl
+type report struct {
+	Timestamp time.Time `json:"timestamp"`
+	Topic     string    `json:"topic"`
+	Channel   string    `json:"channel"`
+
+	IngressRate int64 `json:"ingress_rate"`
+	EgressRate  int64 `json:"egress_rate"`
+
+	Depth         int64 `json:"depth"`
+	MemoryDepth   int64 `json:"memory_depth"`
+	BackendDepth  int64 `json:"backend_depth"`
+	InFlightCount int64 `json:"in_flight_count"`
+	DeferredCount int64 `json:"deferred_count"`
+	RequeueCount  int64 `json:"requeue_count"`
+	TimeoutCount  int64 `json:"timeout_count"`
+	MessageCount  int64 `json:"message_count"`
+	ClientCount   int   `json:"client_count"`
+	Paused        bool  `json:"paused"`
+}
+
+func newReport(topic string, channel string, c *clusterinfo.ChannelStats, o *clusterinfo.ChannelStats, interval time.Duration) *report {
+	r := &report{
+		Timestamp:     time.Now(),
+		Topic:         topic,
+		Channel:       channel,
+		Depth:         c.Depth,
+		MemoryDepth:   c.MemoryDepth,
+		BackendDepth:  c.BackendDepth,
+		InFlightCount: c.InFlightCount,
+		DeferredCount: c.DeferredCount,
+		RequeueCount:  c.RequeueCount,
+		TimeoutCount:  c.TimeoutCount,
+		MessageCount:  c.MessageCount,
+		ClientCount:   c.ClientCount,
+		Paused:        c.Paused,
+	}
+	if o != nil {
+		r.IngressRate = int64(float64(c.MessageCount-o.MessageCount) / interval.Seconds())
+		r.EgressRate = int64(float64(c.MessageCount-o.MessageCount-(c.Depth-o.Depth)) / interval.Seconds())
+	}
+	return r
+}
+
+// exporter serves the latest report in the Prometheus text format
+type exporter struct {
+	sync.RWMutex
+	report *report
+	up     bool
+}
+
+func (e *exporter) update(r *report, up bool) {
+	e.Lock()
+	if r != nil {
+		e.report = r
+	}
+	e.up = up
+	e.Unlock()
+}
+
+func (e *exporter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/metrics" {
+		http.NotFound(w, req)
+		return
+	}
+
+	e.RLock()
+	r := e.report
+	up := e.up
+	e.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetric(w, "nsq_stat_up", "gauge", "Whether the last poll of nsqd stats succeeded.", "", boolValue(up))
+	if r == nil {
+		return
+	}
+
+	labels := fmt.Sprintf(`{topic="%s",channel="%s"}`, escapeLabel(r.Topic), escapeLabel(r.Channel))
+	for _, m := range []struct {
+		name  string
+		typ   string
+		help  string
+		value int64
+	}{
+		{"nsq_channel_ingress_rate", "gauge", "Messages per second published to the channel.", r.IngressRate},
+		{"nsq_channel_egress_rate", "gauge", "Messages per second consumed from the channel.", r.EgressRate},
+		{"nsq_channel_depth", "gauge", "Messages queued in memory and on disk.", r.Depth},
+		{"nsq_channel_memory_depth", "gauge", "Messages queued in memory.", r.MemoryDepth},
+		{"nsq_channel_backend_depth", "gauge", "Messages queued on disk.", r.BackendDepth},
+		{"nsq_channel_in_flight", "gauge", "Messages sent to clients and not yet FINed.", r.InFlightCount},
+		{"nsq_channel_deferred", "gauge", "Messages deferred by clients.", r.DeferredCount},
+		{"nsq_channel_requeue_total", "counter", "Messages requeued by clients.", r.RequeueCount},
+		{"nsq_channel_timeout_total", "counter", "Messages that timed out in flight.", r.TimeoutCount},
+		{"nsq_channel_messages_total", "counter", "Messages received by the channel.", r.MessageCount},
+		{"nsq_channel_clients", "gauge", "Connected clients.", int64(r.ClientCount)},
+		{"nsq_channel_paused", "gauge", "Whether the channel is paused.", boolValue(r.Paused)},
+	} {
+		writeMetric(w, m.name, m.typ, m.help, labels, m.value)
+	}
+}
+
+func writeMetric(w io.Writer, name string, typ string, help string, labels string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s%s %d\n", name, help, name, typ, name, labels, value)
+}
+
+func boolValue(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
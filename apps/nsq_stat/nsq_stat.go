@@ -4,10 +4,12 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
@@ -28,6 +30,8 @@ var (
 	interval           = flag.Duration("interval", 2*time.Second, "duration of time between polling/printing output")
 	httpConnectTimeout = flag.Duration("http-client-connect-timeout", 2*time.Second, "timeout for HTTP connect")
 	httpRequestTimeout = flag.Duration("http-client-request-timeout", 5*time.Second, "timeout for HTTP request")
+	output             = flag.String("output", "columns", "output format (columns, jsonl or none)")
+	httpAddress        = flag.String("http-address", "", "<addr>:<port> to serve the latest stats at /metrics in the Prometheus text format")
 	countNum           = numValue{}
 	nsqdHTTPAddrs      = app.StringArray{}
 	lookupdHTTPAddrs   = app.StringArray{}
@@ -57,33 +61,31 @@ func init() {
 }
 
 func statLoop(interval time.Duration, connectTimeout time.Duration, requestTimeout time.Duration,
-	topic string, channel string, nsqdTCPAddrs []string, lookupdHTTPAddrs []string) {
+	topic string, channel string, nsqdTCPAddrs []string, lookupdHTTPAddrs []string, e *exporter) {
 	ci := clusterinfo.New(nil, http_api.NewClient(nil, connectTimeout, requestTimeout))
+	enc := json.NewEncoder(os.Stdout)
 	var o *clusterinfo.ChannelStats
 	for i := 0; !countNum.isSet || countNum.value >= i; i++ {
-		var producers clusterinfo.Producers
-		var err error
-
-		if len(lookupdHTTPAddrs) != 0 {
-			producers, err = ci.GetLookupdTopicProducers(topic, lookupdHTTPAddrs)
-		} else {
-			producers, err = ci.GetNSQDTopicProducers(topic, nsqdHTTPAddrs)
-		}
-		if err != nil {
-			log.Fatalf("ERROR: failed to get topic producers - %s", err)
-		}
-
-		_, channelStats, err := ci.GetNSQDStats(producers, topic, channel, false)
+		c, err := getChannelStats(ci, topic, channel, nsqdTCPAddrs, lookupdHTTPAddrs)
 		if err != nil {
-			log.Fatalf("ERROR: failed to get nsqd stats - %s", err)
+			if e == nil {
+				log.Fatalf("ERROR: %s", err)
+			}
+			// keep exporting, stats are stale until the next successful poll
+			log.Printf("ERROR: %s", err)
+			e.update(nil, false)
+			o = nil
+			i--
+			time.Sleep(interval)
+			continue
 		}
 
-		c, ok := channelStats[channel]
-		if !ok {
-			log.Fatalf("ERROR: failed to find channel(%s) in stats metadata for topic(%s)", channel, topic)
+		r := newReport(topic, channel, c, o, interval)
+		if e != nil {
+			e.update(r, true)
 		}
 
-		if i%25 == 0 {
+		if *output == "columns" && i%25 == 0 {
 			fmt.Printf("%s+%s+%s\n",
 				"------rate------",
 				"----------------depth----------------",
@@ -100,19 +102,24 @@ func statLoop(interval time.Duration, connectTimeout time.Duration, requestTimeo
 			continue
 		}
 
-		// TODO: paused
-		fmt.Printf("%7d %7d | %7d %7d %7d %5d %5d | %7d %7d %12d %7d\n",
-			int64(float64(c.MessageCount-o.MessageCount)/interval.Seconds()),
-			int64(float64(c.MessageCount-o.MessageCount-(c.Depth-o.Depth))/interval.Seconds()),
-			c.Depth,
-			c.MemoryDepth,
-			c.BackendDepth,
-			c.InFlightCount,
-			c.DeferredCount,
-			c.RequeueCount,
-			c.TimeoutCount,
-			c.MessageCount,
-			c.ClientCount)
+		switch *output {
+		case "columns":
+			// TODO: paused
+			fmt.Printf("%7d %7d | %7d %7d %7d %5d %5d | %7d %7d %12d %7d\n",
+				r.IngressRate,
+				r.EgressRate,
+				r.Depth,
+				r.MemoryDepth,
+				r.BackendDepth,
+				r.InFlightCount,
+				r.DeferredCount,
+				r.RequeueCount,
+				r.TimeoutCount,
+				r.MessageCount,
+				r.ClientCount)
+		case "jsonl":
+			enc.Encode(r)
+		}
 
 		o = c
 		time.Sleep(interval)
@@ -120,6 +127,32 @@ func statLoop(interval time.Duration, connectTimeout time.Duration, requestTimeo
 	os.Exit(0)
 }
 
+func getChannelStats(ci *clusterinfo.ClusterInfo, topic string, channel string,
+	nsqdHTTPAddrs []string, lookupdHTTPAddrs []string) (*clusterinfo.ChannelStats, error) {
+	var producers clusterinfo.Producers
+	var err error
+
+	if len(lookupdHTTPAddrs) != 0 {
+		producers, err = ci.GetLookupdTopicProducers(topic, lookupdHTTPAddrs)
+	} else {
+		producers, err = ci.GetNSQDTopicProducers(topic, nsqdHTTPAddrs)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get topic producers - %s", err)
+	}
+
+	_, channelStats, err := ci.GetNSQDStats(producers, topic, channel, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get nsqd stats - %s", err)
+	}
+
+	c, ok := channelStats[channel]
+	if !ok {
+		return nil, fmt.Errorf("failed to find channel(%s) in stats metadata for topic(%s)", channel, topic)
+	}
+	return c, nil
+}
+
 func checkAddrs(addrs []string) error {
 	for _, a := range addrs {
 		if strings.HasPrefix(a, "http") {
@@ -175,10 +208,28 @@ func main() {
 		log.Fatalf("--lookupd-http-address error - %s", err)
 	}
 
+	switch *output {
+	case "columns", "jsonl", "none":
+	default:
+		log.Fatalf("--output must be one of columns, jsonl or none")
+	}
+	if *output == "none" && *httpAddress == "" {
+		log.Fatal("--output=none requires --http-address")
+	}
+
 	termChan := make(chan os.Signal, 1)
 	signal.Notify(termChan, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
 
-	go statLoop(intvl, connectTimeout, requestTimeout, *topic, *channel, nsqdHTTPAddrs, lookupdHTTPAddrs)
+	var e *exporter
+	if *httpAddress != "" {
+		e = &exporter{}
+		go func() {
+			err := http.ListenAndServe(*httpAddress, e)
+			log.Fatalf("ERROR: failed to serve --http-address - %s", err)
+		}()
+	}
+
+	go statLoop(intvl, connectTimeout, requestTimeout, *topic, *channel, nsqdHTTPAddrs, lookupdHTTPAddrs, e)
 
 	<-termChan
 }
@@ -1,17 +1,23 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"math/rand"
 	"os"
 	"os/signal"
+	"regexp"
+	"sync"
 	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/nsqio/go-nsq"
 	"github.com/nsqio/nsq/internal/app"
+	"github.com/nsqio/nsq/internal/clusterinfo"
+	"github.com/nsqio/nsq/internal/http_api"
 	"github.com/nsqio/nsq/internal/version"
 )
 
@@ -22,6 +28,11 @@ var (
 	maxInFlight   = flag.Int("max-in-flight", 200, "max number of messages to allow in flight")
 	totalMessages = flag.Int("n", 0, "total messages to show (will wait if starved)")
 	printTopic    = flag.Bool("print-topic", false, "print topic name where message was received")
+	outputFormat  = flag.String("output-format", "text", "text (message bodies) or json (an object per line with the id, attempts, timestamp, topic, nsqd_address and body, or body_base64 if not UTF-8, of each message)")
+
+	followNewTopics = flag.Bool("follow-new-topics", false, "tail topics matching --topic-pattern as they appear in --lookupd-http-address")
+	topicPattern    = flag.String("topic-pattern", "", "regular expression of topics to tail with --follow-new-topics (default all)")
+	topicRefresh    = flag.Duration("topic-refresh", time.Minute, "how frequently to look for new topics with --follow-new-topics")
 
 	nsqdTCPAddrs     = app.StringArray{}
 	lookupdHTTPAddrs = app.StringArray{}
@@ -34,15 +45,59 @@ func init() {
 	flag.Var(&topics, "topic", "NSQ topic (may be given multiple times)")
 }
 
+// stdoutLock keeps output of concurrent consumers from interleaving
+var stdoutLock sync.Mutex
+
 type TailHandler struct {
 	topicName     string
 	totalMessages int
 	messagesShown int
 }
 
+type jsonMessage struct {
+	ID          string  `json:"id"`
+	Attempts    uint16  `json:"attempts"`
+	Timestamp   string  `json:"timestamp"`
+	Topic       string  `json:"topic"`
+	NSQDAddress string  `json:"nsqd_address"`
+	Body        *string `json:"body,omitempty"`
+	BodyBase64  []byte  `json:"body_base64,omitempty"`
+}
+
 func (th *TailHandler) HandleMessage(m *nsq.Message) error {
+	stdoutLock.Lock()
+	defer stdoutLock.Unlock()
+
 	th.messagesShown++
 
+	if *outputFormat == "json" {
+		jm := jsonMessage{
+			ID:          string(m.ID[:]),
+			Attempts:    m.Attempts,
+			Timestamp:   time.Unix(0, m.Timestamp).UTC().Format(time.RFC3339Nano),
+			Topic:       th.topicName,
+			NSQDAddress: m.NSQDAddress,
+		}
+		if utf8.Valid(m.Body) {
+			body := string(m.Body)
+			jm.Body = &body
+		} else {
+			jm.BodyBase64 = m.Body
+		}
+		line, err := json.Marshal(jm)
+		if err != nil {
+			log.Fatalf("ERROR: failed to encode message - %s", err)
+		}
+		_, err = os.Stdout.Write(append(line, '\n'))
+		if err != nil {
+			log.Fatalf("ERROR: failed to write to os.Stdout - %s", err)
+		}
+		if th.totalMessages > 0 && th.messagesShown >= th.totalMessages {
+			os.Exit(0)
+		}
+		return nil
+	}
+
 	if *printTopic {
 		_, err := os.Stdout.WriteString(th.topicName)
 		if err != nil {
@@ -90,8 +145,28 @@ func main() {
 	if len(nsqdTCPAddrs) > 0 && len(lookupdHTTPAddrs) > 0 {
 		log.Fatal("use --nsqd-tcp-address or --lookupd-http-address not both")
 	}
-	if len(topics) == 0 {
-		log.Fatal("--topic required")
+	if len(topics) == 0 && !*followNewTopics {
+		log.Fatal("--topic or --follow-new-topics required")
+	}
+	if *followNewTopics && len(lookupdHTTPAddrs) == 0 {
+		log.Fatal("--follow-new-topics requires --lookupd-http-address")
+	}
+	if *topicPattern != "" && !*followNewTopics {
+		log.Fatal("--topic-pattern requires --follow-new-topics")
+	}
+	var pattern *regexp.Regexp
+	if *topicPattern != "" {
+		var err error
+		pattern, err = regexp.Compile(*topicPattern)
+		if err != nil {
+			log.Fatalf("--topic-pattern is invalid - %s", err)
+		}
+	}
+	if *outputFormat != "text" && *outputFormat != "json" {
+		log.Fatal("--output-format must be text or json")
+	}
+	if *followNewTopics && *topicRefresh <= 0 {
+		log.Fatal("--topic-refresh should be positive")
 	}
 
 	sigChan := make(chan os.Signal, 1)
@@ -105,16 +180,23 @@ func main() {
 	cfg.UserAgent = fmt.Sprintf("nsq_tail/%s go-nsq/%s", version.Binary, nsq.VERSION)
 	cfg.MaxInFlight = *maxInFlight
 
-	consumers := []*nsq.Consumer{}
-	for i := 0; i < len(topics); i += 1 {
-		log.Printf("Adding consumer for topic: %s\n", topics[i])
+	var consumersLock sync.Mutex
+	consumers := make(map[string]*nsq.Consumer)
+	addConsumer := func(topic string) {
+		consumersLock.Lock()
+		defer consumersLock.Unlock()
+		if _, ok := consumers[topic]; ok {
+			return
+		}
+
+		log.Printf("Adding consumer for topic: %s\n", topic)
 
-		consumer, err := nsq.NewConsumer(topics[i], *channel, cfg)
+		consumer, err := nsq.NewConsumer(topic, *channel, cfg)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		consumer.AddHandler(&TailHandler{topicName: topics[i], totalMessages: *totalMessages})
+		consumer.AddHandler(&TailHandler{topicName: topic, totalMessages: *totalMessages})
 
 		err = consumer.ConnectToNSQDs(nsqdTCPAddrs)
 		if err != nil {
@@ -126,11 +208,34 @@ func main() {
 			log.Fatal(err)
 		}
 
-		consumers = append(consumers, consumer)
+		consumers[topic] = consumer
+	}
+
+	for _, topic := range topics {
+		addConsumer(topic)
+	}
+
+	if *followNewTopics {
+		ci := clusterinfo.New(nil, http_api.NewClient(nil, 2*time.Second, 5*time.Second))
+		go func() {
+			for {
+				newTopics, err := ci.GetLookupdTopics(lookupdHTTPAddrs)
+				if err != nil {
+					log.Printf("ERROR: could not retrieve topic list: %s", err)
+				}
+				for _, topic := range newTopics {
+					if pattern == nil || pattern.MatchString(topic) {
+						addConsumer(topic)
+					}
+				}
+				time.Sleep(*topicRefresh)
+			}
+		}()
 	}
 
 	<-sigChan
 
+	consumersLock.Lock()
 	for _, consumer := range consumers {
 		consumer.Stop()
 	}
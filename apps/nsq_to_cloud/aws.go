@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// awsClient makes requests to an AWS service, signed with AWS Signature
+// Version 4
+type awsClient struct {
+	client   *http.Client
+	service  string
+	region   string
+	endpoint string
+
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// newAWSClient returns a client for service, the region defaulting to
+// AWS_REGION and the credentials to AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+// and AWS_SESSION_TOKEN
+func newAWSClient(client *http.Client, service string, t *Target, region string) (*awsClient, error) {
+	c := &awsClient{
+		client:       client,
+		service:      service,
+		region:       t.Region,
+		endpoint:     t.Endpoint,
+		accessKey:    t.AccessKeyID,
+		secretKey:    t.SecretAccessKey,
+		sessionToken: t.SessionToken,
+	}
+	if c.region == "" {
+		c.region = region
+	}
+	if c.region == "" {
+		c.region = os.Getenv("AWS_REGION")
+	}
+	if c.region == "" {
+		c.region = "us-east-1"
+	}
+	if c.endpoint == "" {
+		c.endpoint = fmt.Sprintf("https://%s.%s.amazonaws.com", service, c.region)
+	}
+	if c.accessKey == "" {
+		c.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		c.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		c.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, fmt.Errorf("missing credentials for %s", service)
+	}
+	u, err := url.Parse(c.endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q", c.endpoint)
+	}
+	return c, nil
+}
+
+// awsError is the body of an error response from a JSON protocol service
+type awsError struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+// doJSON makes a request to a JSON protocol API, decoding the response into
+// resp
+func (c *awsClient) doJSON(target string, contentType string, req interface{}, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	header.Set("X-Amz-Target", target)
+	respBody, status, err := c.do(header, body)
+	if err != nil {
+		return err
+	}
+	if status/100 != 2 {
+		var e awsError
+		json.Unmarshal(respBody, &e)
+		if e.Type == "" {
+			return fmt.Errorf("%s got response code %d: %s", target, status, bytes.TrimSpace(respBody))
+		}
+		// the type may be prefixed by a namespace
+		return fmt.Errorf("%s failed: %s: %s", target, e.Type[strings.LastIndex(e.Type, "#")+1:], e.Message)
+	}
+	return json.Unmarshal(respBody, resp)
+}
+
+// doQuery makes a request to a query protocol API, returning the XML
+// response
+func (c *awsClient) doQuery(params url.Values) ([]byte, error) {
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	respBody, status, err := c.do(header, []byte(canonicalQuery(params)))
+	if err != nil {
+		return nil, err
+	}
+	if status/100 != 2 {
+		return nil, fmt.Errorf("%s got response code %d: %s", params.Get("Action"), status, bytes.TrimSpace(respBody))
+	}
+	return respBody, nil
+}
+
+func (c *awsClient) do(header http.Header, body []byte) ([]byte, int, error) {
+	req, err := http.NewRequest("POST", c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+	req.Header = header
+	c.sign(req, body, time.Now().UTC())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	return respBody, resp.StatusCode, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req
+//
+// see https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+func (c *awsClient) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	var names []string
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		sha256Hex(body),
+	}, "\n")
+
+	scope := date + "/" + c.region + "/" + c.service + "/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, c.service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+	// net/http sends req.Host, not the header
+	req.Header.Del("Host")
+}
+
+// canonicalQuery encodes params sorted by key, with %20 rather than + for
+// spaces as SigV4 requires
+func canonicalQuery(params url.Values) string {
+	var keys []string
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		for _, v := range params[k] {
+			pairs = append(pairs, uriEncode(k)+"="+uriEncode(v))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent-encodes everything but RFC 3986 unreserved characters
+func uriEncode(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
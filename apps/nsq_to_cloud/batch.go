@@ -0,0 +1,73 @@
+package main
+
+import (
+	"time"
+)
+
+// Batcher groups entries into batches of up to size entries and maxBytes,
+// sending partial batches timeout after their first entry
+type Batcher struct {
+	size     int
+	maxBytes int
+	timeout  time.Duration
+
+	inChan  chan *entry
+	outChan chan []*entry
+}
+
+func NewBatcher(size int, maxBytes int, timeout time.Duration) *Batcher {
+	return &Batcher{
+		size:     size,
+		maxBytes: maxBytes,
+		timeout:  timeout,
+		inChan:   make(chan *entry),
+		outChan:  make(chan []*entry),
+	}
+}
+
+func (b *Batcher) Add(e *entry) {
+	b.inChan <- e
+}
+
+func (b *Batcher) router() {
+	var pending []*entry
+	var pendingBytes int
+	timer := time.NewTimer(b.timeout)
+	timer.Stop()
+	flush := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		b.outChan <- pending
+		pending = nil
+		pendingBytes = 0
+	}
+	for {
+		select {
+		case e := <-b.inChan:
+			// an entry too big for any batch is sent alone, for the service
+			// to reject
+			size := e.size()
+			if len(pending) > 0 && pendingBytes+size > b.maxBytes {
+				flush()
+			}
+			if len(pending) == 0 {
+				timer.Reset(b.timeout)
+			}
+			pending = append(pending, e)
+			pendingBytes += size
+			if len(pending) >= b.size {
+				flush()
+			}
+		case <-timer.C:
+			if len(pending) > 0 {
+				b.outChan <- pending
+				pending = nil
+				pendingBytes = 0
+			}
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nsqio/nsq/internal/protocol"
+)
+
+// Target consumes a topic and forwards its messages to a queue, topic or
+// stream of a cloud messaging service. A --config file is a list of them:
+//
+//	region = "us-east-1"
+//
+//	[[target]]
+//	topic = "events"
+//	type = "sqs"
+//	queue_url = "https://sqs.us-east-1.amazonaws.com/123456789012/events"
+//	[target.attributes]
+//	event_type = "{{.type}}"
+//	nsq_id = "{{@id}}"
+//
+// type is one of sqs, sns, kinesis or pubsub. channel defaults to --channel,
+// batch_size to the most the service accepts in one request and
+// batch_timeout to --batch-timeout. Attribute, key and group ID values are
+// templates, {{.field}} being replaced by the field's value (a.b.c for nested
+// fields) in JSON messages and {{@id}}, {{@timestamp}}, {{@attempts}} and
+// {{@topic}} by the NSQ message's.
+type Target struct {
+	Topic   string `toml:"topic"`
+	Channel string `toml:"channel"`
+	Type    string `toml:"type"`
+
+	// AWS services, the region, endpoint and credentials defaulting to the
+	// top level region, the service's regional endpoint and AWS_ACCESS_KEY_ID,
+	// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+	Region          string `toml:"region"`
+	Endpoint        string `toml:"endpoint"`
+	AccessKeyID     string `toml:"access_key_id"`
+	SecretAccessKey string `toml:"secret_access_key"`
+	SessionToken    string `toml:"session_token"`
+
+	// sqs
+	QueueURL string `toml:"queue_url"`
+	// sns
+	TopicARN string `toml:"topic_arn"`
+	// sqs and sns FIFO queues and topics, deduplicated by NSQ message ID
+	MessageGroupID string `toml:"message_group_id"`
+
+	// kinesis, the partition key defaulting to the NSQ message ID
+	Stream       string `toml:"stream"`
+	PartitionKey string `toml:"partition_key"`
+
+	// pubsub, authenticated with the service account key in credentials_file
+	// (defaulting to GOOGLE_APPLICATION_CREDENTIALS) or else the GCE metadata
+	// server. endpoint, or PUBSUB_EMULATOR_HOST, may point at an emulator.
+	Project         string `toml:"project"`
+	PubSubTopic     string `toml:"pubsub_topic"`
+	OrderingKey     string `toml:"ordering_key"`
+	CredentialsFile string `toml:"credentials_file"`
+
+	Attributes map[string]string `toml:"attributes"`
+
+	BatchSize    int      `toml:"batch_size"`
+	BatchTimeout duration `toml:"batch_timeout"`
+}
+
+// String identifies the target in logs
+func (t *Target) String() string {
+	var dest string
+	switch t.Type {
+	case "sqs":
+		dest = t.QueueURL
+	case "sns":
+		dest = t.TopicARN
+	case "kinesis":
+		dest = t.Stream
+	case "pubsub":
+		dest = "projects/" + t.Project + "/topics/" + t.PubSubTopic
+	}
+	return fmt.Sprintf("%s/%s -> %s %s", t.Topic, t.Channel, t.Type, dest)
+}
+
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+type Config struct {
+	Region  string   `toml:"region"`
+	Targets []Target `toml:"target"`
+}
+
+// loadConfig reads a --config file, filling in defaults
+func loadConfig(path string, defaultChannel string, defaultBatchTimeout time.Duration) (*Config, error) {
+	var cfg Config
+	md, err := toml.DecodeFile(path, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("unknown option %q", undecoded[0].String())
+	}
+	if len(cfg.Targets) == 0 {
+		return nil, fmt.Errorf("no [[target]] in %s", path)
+	}
+
+	consumers := make(map[string]int)
+	for i := range cfg.Targets {
+		t := &cfg.Targets[i]
+		if t.Channel == "" {
+			t.Channel = defaultChannel
+		}
+		if t.BatchTimeout.Duration == 0 {
+			t.BatchTimeout.Duration = defaultBatchTimeout
+		}
+
+		if !protocol.IsValidTopicName(t.Topic) {
+			return nil, fmt.Errorf("target %d: topic %q is invalid", i+1, t.Topic)
+		}
+		if !protocol.IsValidChannelName(t.Channel) {
+			return nil, fmt.Errorf("target %d: channel %q is invalid", i+1, t.Channel)
+		}
+		// targets on one channel would each get only some of its messages
+		key := t.Topic + "/" + t.Channel
+		if j, ok := consumers[key]; ok {
+			return nil, fmt.Errorf("target %d: targets %d and %d both consume %s, give them different channels", i+1, j, i+1, key)
+		}
+		consumers[key] = i + 1
+
+		limits, ok := sinkLimits[t.Type]
+		if !ok {
+			return nil, fmt.Errorf("target %d: type %q should be sqs, sns, kinesis or pubsub", i+1, t.Type)
+		}
+		var required map[string]string
+		switch t.Type {
+		case "sqs":
+			required = map[string]string{"queue_url": t.QueueURL}
+		case "sns":
+			required = map[string]string{"topic_arn": t.TopicARN}
+		case "kinesis":
+			required = map[string]string{"stream": t.Stream}
+		case "pubsub":
+			required = map[string]string{"project": t.Project, "pubsub_topic": t.PubSubTopic}
+		}
+		for name, v := range required {
+			if v == "" {
+				return nil, fmt.Errorf("target %d: %s is required for %s", i+1, name, t.Type)
+			}
+		}
+		if t.MessageGroupID != "" && t.Type != "sqs" && t.Type != "sns" {
+			return nil, fmt.Errorf("target %d: message_group_id is only supported by sqs and sns", i+1)
+		}
+		if t.PartitionKey != "" && t.Type != "kinesis" {
+			return nil, fmt.Errorf("target %d: partition_key is only supported by kinesis", i+1)
+		}
+		if t.OrderingKey != "" && t.Type != "pubsub" {
+			return nil, fmt.Errorf("target %d: ordering_key is only supported by pubsub", i+1)
+		}
+		if len(t.Attributes) > limits.maxAttributes {
+			if limits.maxAttributes == 0 {
+				return nil, fmt.Errorf("target %d: %s doesn't support attributes", i+1, t.Type)
+			}
+			return nil, fmt.Errorf("target %d: %s supports at most %d attributes", i+1, t.Type, limits.maxAttributes)
+		}
+		for name := range t.Attributes {
+			if name == "" {
+				return nil, fmt.Errorf("target %d: attribute names must not be empty", i+1)
+			}
+		}
+
+		if t.BatchSize == 0 {
+			t.BatchSize = limits.maxBatchSize
+		}
+		if t.BatchSize < 1 || t.BatchSize > limits.maxBatchSize {
+			return nil, fmt.Errorf("target %d: batch_size should be between 1 and %d for %s", i+1, limits.maxBatchSize, t.Type)
+		}
+		if t.BatchTimeout.Duration < 0 {
+			return nil, fmt.Errorf("target %d: batch_timeout should be positive", i+1)
+		}
+	}
+	return &cfg, nil
+}
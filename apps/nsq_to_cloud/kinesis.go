@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// kinesisSink puts messages on a Kinesis data stream with PutRecords
+type kinesisSink struct {
+	aws    *awsClient
+	stream string
+}
+
+func newKinesisSink(t *Target, client *http.Client, region string) (*kinesisSink, error) {
+	aws, err := newAWSClient(client, "kinesis", t, region)
+	if err != nil {
+		return nil, err
+	}
+	return &kinesisSink{
+		aws:    aws,
+		stream: t.Stream,
+	}, nil
+}
+
+type kinesisRecord struct {
+	// base64 encoded by encoding/json
+	Data         []byte `json:"Data"`
+	PartitionKey string `json:"PartitionKey"`
+}
+
+func (s *kinesisSink) Send(entries []*entry) []error {
+	req := struct {
+		StreamName string          `json:"StreamName"`
+		Records    []kinesisRecord `json:"Records"`
+	}{StreamName: s.stream}
+	for _, e := range entries {
+		req.Records = append(req.Records, kinesisRecord{
+			Data:         e.msg.Body,
+			PartitionKey: e.key,
+		})
+	}
+
+	// records are in the order they were put
+	var resp struct {
+		FailedRecordCount int `json:"FailedRecordCount"`
+		Records           []struct {
+			ErrorCode    string `json:"ErrorCode"`
+			ErrorMessage string `json:"ErrorMessage"`
+		} `json:"Records"`
+	}
+	err := s.aws.doJSON("Kinesis_20131202.PutRecords", "application/x-amz-json-1.1", req, &resp)
+	if err != nil {
+		return failAll(len(entries), err)
+	}
+	if resp.FailedRecordCount == 0 {
+		return nil
+	}
+	if len(resp.Records) != len(entries) {
+		return failAll(len(entries), fmt.Errorf("PutRecords returned %d records for %d", len(resp.Records), len(entries)))
+	}
+	errs := make([]error, len(entries))
+	for i, r := range resp.Records {
+		if r.ErrorCode != "" {
+			errs[i] = fmt.Errorf("%s: %s", r.ErrorCode, r.ErrorMessage)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,177 @@
+// This is an NSQ client that reads topics and forwards their messages to
+// AWS SQS, SNS and Kinesis and Google Cloud Pub/Sub
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/bitly/timer_metrics"
+	"github.com/nsqio/go-nsq"
+	"github.com/nsqio/nsq/internal/app"
+	"github.com/nsqio/nsq/internal/http_api"
+	"github.com/nsqio/nsq/internal/version"
+)
+
+var (
+	showVersion = flag.Bool("version", false, "print version string")
+
+	config      = flag.String("config", "", "TOML file of [[target]]s to forward topics to (see README.md)")
+	channel     = flag.String("channel", "nsq_to_cloud", "nsq channel of targets that don't set one")
+	maxInFlight = flag.Int("max-in-flight", 200, "max number of messages to allow in flight (per target)")
+
+	numPublishers      = flag.Int("n", 4, "number of concurrent batches to send (per target)")
+	batchTimeout       = flag.Duration("batch-timeout", time.Second, "max time to wait for a batch to fill before sending it, for targets that don't set batch_timeout")
+	httpConnectTimeout = flag.Duration("http-client-connect-timeout", 2*time.Second, "timeout for HTTP connect")
+	httpRequestTimeout = flag.Duration("http-client-request-timeout", 20*time.Second, "timeout for HTTP request")
+	statusEvery        = flag.Int("status-every", 250, "the # of batches between logging status (per target), 0 disables")
+
+	nsqdTCPAddrs     = app.StringArray{}
+	lookupdHTTPAddrs = app.StringArray{}
+)
+
+func init() {
+	flag.Var(&nsqdTCPAddrs, "nsqd-tcp-address", "nsqd TCP address (may be given multiple times)")
+	flag.Var(&lookupdHTTPAddrs, "lookupd-http-address", "lookupd HTTP address (may be given multiple times)")
+}
+
+// ForwardHandler batches a target's messages and sends them to its sink
+type ForwardHandler struct {
+	target       *Target
+	sink         Sink
+	mapping      *mapping
+	batcher      *Batcher
+	timermetrics *timer_metrics.TimerMetrics
+}
+
+func (fh *ForwardHandler) HandleMessage(m *nsq.Message) error {
+	// FINed or REQed once the batch is sent
+	m.DisableAutoResponse()
+	fh.batcher.Add(fh.mapping.entry(m))
+	return nil
+}
+
+// forwardBatches sends batches from the batcher, FINing the messages that
+// were accepted and REQing the rest
+func (fh *ForwardHandler) forwardBatches() {
+	for entries := range fh.batcher.outChan {
+		startTime := time.Now()
+		errs := fh.sink.Send(entries)
+		var failed int
+		var firstErr error
+		for i, e := range entries {
+			if errs != nil && errs[i] != nil {
+				if firstErr == nil {
+					firstErr = errs[i]
+				}
+				failed++
+				e.msg.Requeue(-1)
+			} else {
+				e.msg.Finish()
+			}
+		}
+		if failed > 0 {
+			log.Printf("ERROR: [%s] failed to forward %d of %d messages - %s", fh.target, failed, len(entries), firstErr)
+			continue
+		}
+		fh.timermetrics.Status(startTime)
+	}
+}
+
+func main() {
+	cfg := nsq.NewConfig()
+
+	flag.Var(&nsq.ConfigFlag{cfg}, "consumer-opt", "option to passthrough to nsq.Consumer (may be given multiple times, http://godoc.org/github.com/nsqio/go-nsq#Config)")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("nsq_to_cloud v%s\n", version.Binary)
+		return
+	}
+
+	if *config == "" {
+		log.Fatal("--config is required")
+	}
+	if len(nsqdTCPAddrs) == 0 && len(lookupdHTTPAddrs) == 0 {
+		log.Fatal("--nsqd-tcp-address or --lookupd-http-address required")
+	}
+	if len(nsqdTCPAddrs) > 0 && len(lookupdHTTPAddrs) > 0 {
+		log.Fatal("use --nsqd-tcp-address or --lookupd-http-address not both")
+	}
+	if *numPublishers < 1 {
+		log.Fatal("-n must be at least 1")
+	}
+	if *batchTimeout <= 0 {
+		log.Fatal("--batch-timeout should be positive")
+	}
+
+	targetCfg, err := loadConfig(*config, *channel, *batchTimeout)
+	if err != nil {
+		log.Fatalf("failed to load --config %s - %s", *config, err)
+	}
+
+	httpclient := &http.Client{Transport: http_api.NewDeadlineTransport(*httpConnectTimeout, *httpRequestTimeout), Timeout: *httpRequestTimeout}
+
+	termChan := make(chan os.Signal, 1)
+	signal.Notify(termChan, syscall.SIGINT, syscall.SIGTERM)
+
+	cfg.UserAgent = fmt.Sprintf("nsq_to_cloud/%s go-nsq/%s", version.Binary, nsq.VERSION)
+	cfg.MaxInFlight = *maxInFlight
+
+	var consumers []*nsq.Consumer
+	for i := range targetCfg.Targets {
+		t := &targetCfg.Targets[i]
+
+		sink, err := newSink(t, httpclient, targetCfg.Region)
+		if err != nil {
+			log.Fatalf("target %d: %s", i+1, err)
+		}
+		mapping, err := newMapping(t)
+		if err != nil {
+			log.Fatalf("target %d: %s", i+1, err)
+		}
+
+		consumer, err := nsq.NewConsumer(t.Topic, t.Channel, cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		handler := &ForwardHandler{
+			target:       t,
+			sink:         sink,
+			mapping:      mapping,
+			batcher:      NewBatcher(t.BatchSize, sinkLimits[t.Type].maxBatchBytes, t.BatchTimeout.Duration),
+			timermetrics: timer_metrics.NewTimerMetrics(*statusEvery, fmt.Sprintf("[%s]:", t)),
+		}
+		go handler.batcher.router()
+		for j := 0; j < *numPublishers; j++ {
+			go handler.forwardBatches()
+		}
+		consumer.AddConcurrentHandlers(handler, *numPublishers)
+
+		err = consumer.ConnectToNSQDs(nsqdTCPAddrs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = consumer.ConnectToNSQLookupds(lookupdHTTPAddrs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		consumers = append(consumers, consumer)
+	}
+
+	<-termChan
+	for _, consumer := range consumers {
+		consumer.Stop()
+	}
+	for _, consumer := range consumers {
+		<-consumer.StopChan
+	}
+}
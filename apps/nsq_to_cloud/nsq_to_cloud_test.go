@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+// the example from https://docs.aws.amazon.com/general/latest/gr/sigv4-create-canonical-request.html
+func TestAWSSign(t *testing.T) {
+	c := &awsClient{
+		service:   "iam",
+		region:    "us-east-1",
+		accessKey: "AKIDEXAMPLE",
+		secretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	req, _ := http.NewRequest("GET", "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	c.sign(req, nil, time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, " +
+		"SignedHeaders=content-type;host;x-amz-date, " +
+		"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("Authorization = %q, want %q", got, want)
+	}
+}
+
+func TestMappingEntry(t *testing.T) {
+	m, err := newMapping(&Target{
+		Topic: "events",
+		Type:  "kinesis",
+		Attributes: map[string]string{
+			"type":    "{{.type}}",
+			"user":    "user-{{ .user.id }}",
+			"topic":   "{{@topic}}",
+			"missing": "{{.missing}}",
+			"static":  "v1",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := nsq.NewMessage(nsq.MessageID{'0', '1', '2', '3', '4', '5', '6', '7', '8', '9', 'a', 'b', 'c', 'd', 'e', 'f'},
+		[]byte(`{"type":"click","user":{"id":42}}`))
+	e := m.entry(msg)
+	wantAttributes := map[string]string{
+		"type":   "click",
+		"user":   "user-42",
+		"topic":  "events",
+		"static": "v1",
+	}
+	if !reflect.DeepEqual(e.attributes, wantAttributes) {
+		t.Errorf("attributes = %v, want %v", e.attributes, wantAttributes)
+	}
+	// kinesis partition keys default to the message ID
+	if e.key != "0123456789abcdef" {
+		t.Errorf("key = %q, want the message ID", e.key)
+	}
+
+	_, err = newMapping(&Target{Type: "sqs", MessageGroupID: "{{@unknown}}"})
+	if err == nil {
+		t.Error("expected an error for an unknown template")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsq_to_cloud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{"valid", `
+[[target]]
+topic = "events"
+type = "sqs"
+queue_url = "https://sqs.us-east-1.amazonaws.com/123456789012/events"
+[target.attributes]
+type = "{{.type}}"
+
+[[target]]
+topic = "events"
+channel = "pubsub"
+type = "pubsub"
+project = "p"
+pubsub_topic = "events"
+batch_timeout = "100ms"
+`, ""},
+		{"unknown type", "[[target]]\ntopic = \"events\"\ntype = \"eventbridge\"\n", "type \"eventbridge\""},
+		{"missing destination", "[[target]]\ntopic = \"events\"\ntype = \"kinesis\"\n", "stream is required"},
+		{"batch too big", "[[target]]\ntopic = \"events\"\ntype = \"sns\"\ntopic_arn = \"arn\"\nbatch_size = 11\n", "batch_size"},
+		{"kinesis attributes", "[[target]]\ntopic = \"events\"\ntype = \"kinesis\"\nstream = \"s\"\n[target.attributes]\na = \"b\"\n", "doesn't support attributes"},
+		{"shared channel", "[[target]]\ntopic = \"events\"\ntype = \"kinesis\"\nstream = \"s\"\n[[target]]\ntopic = \"events\"\ntype = \"kinesis\"\nstream = \"t\"\n", "different channels"},
+		{"unknown option", "[[target]]\ntopic = \"events\"\ntype = \"kinesis\"\nstream = \"s\"\nshards = 2\n", "unknown option"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, "config.toml")
+		ioutil.WriteFile(path, []byte(tt.config), 0644)
+		cfg, err := loadConfig(path, "nsq_to_cloud", time.Second)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if cfg.Targets[0].Channel != "nsq_to_cloud" || cfg.Targets[0].BatchSize != 10 || cfg.Targets[0].BatchTimeout.Duration != time.Second {
+			t.Errorf("%s: defaults not filled in: %+v", tt.name, cfg.Targets[0])
+		}
+		if cfg.Targets[1].BatchSize != 1000 || cfg.Targets[1].BatchTimeout.Duration != 100*time.Millisecond {
+			t.Errorf("%s: got %+v", tt.name, cfg.Targets[1])
+		}
+	}
+}
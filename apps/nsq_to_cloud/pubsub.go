@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pubsubScope       = "https://www.googleapis.com/auth/pubsub"
+	metadataTokenURL  = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	jwtBearerGrant    = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	defaultGoogleAuth = "https://oauth2.googleapis.com/token"
+)
+
+// pubsubSink publishes messages to a Google Cloud Pub/Sub topic
+type pubsubSink struct {
+	client *http.Client
+	url    string
+	// nil for emulators, which don't authenticate
+	tokens *tokenSource
+}
+
+func newPubSubSink(t *Target, client *http.Client) (*pubsubSink, error) {
+	s := &pubsubSink{client: client}
+
+	endpoint := t.Endpoint
+	if endpoint == "" {
+		if host := os.Getenv("PUBSUB_EMULATOR_HOST"); host != "" {
+			endpoint = "http://" + host
+		}
+	}
+	credentialsFile := t.CredentialsFile
+	if credentialsFile == "" {
+		credentialsFile = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if endpoint == "" || credentialsFile != "" {
+		var err error
+		s.tokens, err = newTokenSource(client, credentialsFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if endpoint == "" {
+		endpoint = "https://pubsub.googleapis.com"
+	}
+	s.url = fmt.Sprintf("%s/v1/projects/%s/topics/%s:publish", strings.TrimSuffix(endpoint, "/"),
+		url.PathEscape(t.Project), url.PathEscape(t.PubSubTopic))
+	return s, nil
+}
+
+type pubsubMessage struct {
+	// base64 encoded by encoding/json
+	Data        []byte            `json:"data"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	OrderingKey string            `json:"orderingKey,omitempty"`
+}
+
+// Send publishes entries, which succeed or fail together
+func (s *pubsubSink) Send(entries []*entry) []error {
+	req := struct {
+		Messages []pubsubMessage `json:"messages"`
+	}{}
+	for _, e := range entries {
+		req.Messages = append(req.Messages, pubsubMessage{
+			Data:        e.msg.Body,
+			Attributes:  e.attributes,
+			OrderingKey: e.key,
+		})
+	}
+	err := s.publish(req)
+	if err != nil {
+		return failAll(len(entries), err)
+	}
+	return nil
+}
+
+func (s *pubsubSink) publish(req interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if s.tokens != nil {
+		token, err := s.tokens.Token()
+		if err != nil {
+			return err
+		}
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Error struct {
+				Status  string `json:"status"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.Unmarshal(respBody, &e)
+		if e.Error.Status == "" {
+			return fmt.Errorf("publish got response code %d: %s", resp.StatusCode, bytes.TrimSpace(respBody))
+		}
+		return fmt.Errorf("publish failed: %s: %s", e.Error.Status, e.Error.Message)
+	}
+	return nil
+}
+
+// tokenSource fetches and caches OAuth2 access tokens for a service account,
+// from its key or the GCE metadata server
+type tokenSource struct {
+	client *http.Client
+
+	// service account key, nil to use the metadata server
+	email    string
+	key      *rsa.PrivateKey
+	tokenURL string
+
+	sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func newTokenSource(client *http.Client, credentialsFile string) (*tokenSource, error) {
+	ts := &tokenSource{client: client}
+	if credentialsFile == "" {
+		return ts, nil
+	}
+
+	data, err := ioutil.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	var creds struct {
+		Type        string `json:"type"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	err = json.Unmarshal(data, &creds)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credentials %s - %s", credentialsFile, err)
+	}
+	if creds.Type != "service_account" {
+		return nil, fmt.Errorf("credentials %s are %q, only service_account keys are supported", credentialsFile, creds.Type)
+	}
+
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("invalid private_key in %s", credentialsFile)
+	}
+	var key *rsa.PrivateKey
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err == nil {
+		var ok bool
+		key, ok = parsed.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("private_key in %s is not an RSA key", credentialsFile)
+		}
+	} else {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid private_key in %s - %s", credentialsFile, err)
+		}
+	}
+
+	ts.email = creds.ClientEmail
+	ts.key = key
+	ts.tokenURL = creds.TokenURI
+	if ts.tokenURL == "" {
+		ts.tokenURL = defaultGoogleAuth
+	}
+	return ts, nil
+}
+
+// Token returns an access token, fetching a new one a minute before the
+// last expires
+func (ts *tokenSource) Token() (string, error) {
+	ts.Lock()
+	defer ts.Unlock()
+	if ts.token != "" && time.Now().Before(ts.expiry.Add(-time.Minute)) {
+		return ts.token, nil
+	}
+
+	var req *http.Request
+	var err error
+	if ts.key == nil {
+		req, err = http.NewRequest("GET", metadataTokenURL, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+	} else {
+		assertion, err := ts.assertion(time.Now())
+		if err != nil {
+			return "", err
+		}
+		form := url.Values{}
+		form.Set("grant_type", jwtBearerGrant)
+		form.Set("assertion", assertion)
+		req, err = http.NewRequest("POST", ts.tokenURL, strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch access token - %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch access token - %s", err)
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("failed to fetch access token - got response code %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	err = json.Unmarshal(body, &token)
+	if err != nil || token.AccessToken == "" {
+		return "", errors.New("failed to fetch access token - invalid response")
+	}
+
+	ts.token = token.AccessToken
+	ts.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return ts.token, nil
+}
+
+// assertion returns a JWT signed by the service account key, exchanged for an
+// access token
+//
+// see https://developers.google.com/identity/protocols/oauth2/service-account#authorizingrequests
+func (ts *tokenSource) assertion(now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   ts.email,
+		"scope": pubsubScope,
+		"aud":   ts.tokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	h := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, ts.key, crypto.SHA256, h[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/nsqio/go-nsq"
+)
+
+// Sink publishes batches of messages to a cloud messaging service
+type Sink interface {
+	// Send publishes entries in one request, returning the error for each
+	// entry that failed or nil when all succeeded
+	Send(entries []*entry) []error
+}
+
+// limits are what a service accepts in one request
+type limits struct {
+	maxBatchSize  int
+	maxBatchBytes int
+	maxAttributes int
+}
+
+var sinkLimits = map[string]limits{
+	"sqs":     {maxBatchSize: 10, maxBatchBytes: 256 * 1024, maxAttributes: 10},
+	"sns":     {maxBatchSize: 10, maxBatchBytes: 256 * 1024, maxAttributes: 10},
+	"kinesis": {maxBatchSize: 500, maxBatchBytes: 5 * 1024 * 1024, maxAttributes: 0},
+	// data is base64 encoded in the 10MB request
+	"pubsub": {maxBatchSize: 1000, maxBatchBytes: 7 * 1024 * 1024, maxAttributes: 100},
+}
+
+func newSink(t *Target, client *http.Client, region string) (Sink, error) {
+	switch t.Type {
+	case "sqs":
+		return newSQSSink(t, client, region)
+	case "sns":
+		return newSNSSink(t, client, region)
+	case "kinesis":
+		return newKinesisSink(t, client, region)
+	case "pubsub":
+		return newPubSubSink(t, client)
+	}
+	return nil, fmt.Errorf("unknown type %q", t.Type)
+}
+
+// entry is a message with its rendered attributes and keys
+type entry struct {
+	msg        *nsq.Message
+	attributes map[string]string
+	// the partition key, ordering key or message group ID
+	key string
+}
+
+// size counts what the services count towards their request size limits
+func (e *entry) size() int {
+	n := len(e.msg.Body) + len(e.key)
+	for name, v := range e.attributes {
+		n += len(name) + len(v)
+	}
+	return n
+}
+
+// failAll returns err for each of n entries
+func failAll(n int, err error) []error {
+	errs := make([]error, n)
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
+
+// templateField matches the {{.field}} and {{@metadata}} templates in
+// attributes and keys
+var templateField = regexp.MustCompile(`{{\s*(\.[^{}\s]+|@[a-z]+)\s*}}`)
+
+// mapping renders a target's attributes and key for each message
+type mapping struct {
+	topic      string
+	attributes map[string]string
+	key        string
+	// JSON fields used by the templates
+	fields []string
+}
+
+func newMapping(t *Target) (*mapping, error) {
+	m := &mapping{
+		topic:      t.Topic,
+		attributes: t.Attributes,
+	}
+	switch t.Type {
+	case "sqs", "sns":
+		m.key = t.MessageGroupID
+	case "kinesis":
+		m.key = t.PartitionKey
+		if m.key == "" {
+			m.key = "{{@id}}"
+		}
+	case "pubsub":
+		m.key = t.OrderingKey
+	}
+
+	templates := []string{m.key}
+	for _, v := range m.attributes {
+		templates = append(templates, v)
+	}
+	seen := make(map[string]bool)
+	for _, t := range templates {
+		for _, match := range templateField.FindAllStringSubmatch(t, -1) {
+			name := match[1]
+			switch {
+			case name[0] == '.':
+				if !seen[name[1:]] {
+					seen[name[1:]] = true
+					m.fields = append(m.fields, name[1:])
+				}
+			case name != "@id" && name != "@timestamp" && name != "@attempts" && name != "@topic":
+				return nil, fmt.Errorf("unknown template %s", match[0])
+			}
+		}
+	}
+	return m, nil
+}
+
+// entry renders the attributes and key for msg. Attributes that render
+// empty are left out.
+func (m *mapping) entry(msg *nsq.Message) *entry {
+	values := messageFields(msg.Body, m.fields)
+	render := func(t string) string {
+		if !strings.Contains(t, "{{") {
+			return t
+		}
+		return templateField.ReplaceAllStringFunc(t, func(s string) string {
+			name := templateField.FindStringSubmatch(s)[1]
+			switch name {
+			case "@id":
+				return string(msg.ID[:])
+			case "@timestamp":
+				return strconv.FormatInt(msg.Timestamp, 10)
+			case "@attempts":
+				return strconv.Itoa(int(msg.Attempts))
+			case "@topic":
+				return m.topic
+			}
+			return values[name[1:]]
+		})
+	}
+
+	e := &entry{
+		msg: msg,
+		key: render(m.key),
+	}
+	if len(m.attributes) > 0 {
+		e.attributes = make(map[string]string, len(m.attributes))
+		for name, t := range m.attributes {
+			if v := render(t); v != "" {
+				e.attributes[name] = v
+			}
+		}
+	}
+	return e
+}
+
+// messageFields returns the values of fields (which may be nested, as
+// a.b.c) in a JSON message body. Missing fields, or all of them when the
+// body isn't a JSON object, are empty.
+func messageFields(body []byte, fields []string) map[string]string {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	var msg map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	d.Decode(&msg)
+
+	values := make(map[string]string, len(fields))
+	for _, field := range fields {
+		var v interface{} = msg
+		for _, name := range strings.Split(field, ".") {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				v = nil
+				break
+			}
+			v = m[name]
+		}
+		switch v := v.(type) {
+		case nil:
+		case string:
+			values[field] = v
+		case json.Number:
+			values[field] = v.String()
+		default:
+			b, _ := json.Marshal(v)
+			values[field] = string(b)
+		}
+	}
+	return values
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// snsSink publishes messages to an SNS topic with PublishBatch
+type snsSink struct {
+	aws      *awsClient
+	topicARN string
+	fifo     bool
+}
+
+func newSNSSink(t *Target, client *http.Client, region string) (*snsSink, error) {
+	aws, err := newAWSClient(client, "sns", t, region)
+	if err != nil {
+		return nil, err
+	}
+	return &snsSink{
+		aws:      aws,
+		topicARN: t.TopicARN,
+		fifo:     t.MessageGroupID != "",
+	}, nil
+}
+
+func (s *snsSink) Send(entries []*entry) []error {
+	params := url.Values{}
+	params.Set("Action", "PublishBatch")
+	params.Set("Version", "2010-03-31")
+	params.Set("TopicArn", s.topicARN)
+	for i, e := range entries {
+		prefix := fmt.Sprintf("PublishBatchRequestEntries.member.%d.", i+1)
+		params.Set(prefix+"Id", strconv.Itoa(i))
+		params.Set(prefix+"Message", string(e.msg.Body))
+
+		var names []string
+		for name := range e.attributes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for j, name := range names {
+			attrPrefix := fmt.Sprintf("%sMessageAttributes.entry.%d.", prefix, j+1)
+			params.Set(attrPrefix+"Name", name)
+			params.Set(attrPrefix+"Value.DataType", "String")
+			params.Set(attrPrefix+"Value.StringValue", e.attributes[name])
+		}
+
+		if s.fifo {
+			params.Set(prefix+"MessageGroupId", e.key)
+			params.Set(prefix+"MessageDeduplicationId", string(e.msg.ID[:]))
+		}
+	}
+
+	body, err := s.aws.doQuery(params)
+	if err != nil {
+		return failAll(len(entries), err)
+	}
+	var resp struct {
+		Failed []batchResultError `xml:"PublishBatchResult>Failed>member"`
+	}
+	err = xml.Unmarshal(body, &resp)
+	if err != nil {
+		return failAll(len(entries), fmt.Errorf("invalid PublishBatch response - %s", err))
+	}
+	return batchResultErrors(entries, resp.Failed)
+}
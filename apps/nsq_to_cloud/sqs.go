@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// sqsSink sends messages to an SQS queue with SendMessageBatch
+type sqsSink struct {
+	aws      *awsClient
+	queueURL string
+	fifo     bool
+}
+
+func newSQSSink(t *Target, client *http.Client, region string) (*sqsSink, error) {
+	aws, err := newAWSClient(client, "sqs", t, region)
+	if err != nil {
+		return nil, err
+	}
+	return &sqsSink{
+		aws:      aws,
+		queueURL: t.QueueURL,
+		fifo:     t.MessageGroupID != "",
+	}, nil
+}
+
+type sqsAttribute struct {
+	DataType    string `json:"DataType"`
+	StringValue string `json:"StringValue"`
+}
+
+type sqsEntry struct {
+	ID                     string                  `json:"Id"`
+	MessageBody            string                  `json:"MessageBody"`
+	MessageAttributes      map[string]sqsAttribute `json:"MessageAttributes,omitempty"`
+	MessageGroupID         string                  `json:"MessageGroupId,omitempty"`
+	MessageDeduplicationID string                  `json:"MessageDeduplicationId,omitempty"`
+}
+
+// batchResultError is an entry that failed in an SQS or SNS batch
+type batchResultError struct {
+	ID          string `json:"Id" xml:"Id"`
+	Code        string `json:"Code" xml:"Code"`
+	Message     string `json:"Message" xml:"Message"`
+	SenderFault bool   `json:"SenderFault" xml:"SenderFault"`
+}
+
+func (s *sqsSink) Send(entries []*entry) []error {
+	req := struct {
+		QueueURL string     `json:"QueueUrl"`
+		Entries  []sqsEntry `json:"Entries"`
+	}{QueueURL: s.queueURL}
+	for i, e := range entries {
+		se := sqsEntry{
+			ID:          strconv.Itoa(i),
+			MessageBody: string(e.msg.Body),
+		}
+		if len(e.attributes) > 0 {
+			se.MessageAttributes = make(map[string]sqsAttribute, len(e.attributes))
+			for name, v := range e.attributes {
+				se.MessageAttributes[name] = sqsAttribute{"String", v}
+			}
+		}
+		if s.fifo {
+			se.MessageGroupID = e.key
+			se.MessageDeduplicationID = string(e.msg.ID[:])
+		}
+		req.Entries = append(req.Entries, se)
+	}
+
+	var resp struct {
+		Failed []batchResultError `json:"Failed"`
+	}
+	err := s.aws.doJSON("AmazonSQS.SendMessageBatch", "application/x-amz-json-1.0", req, &resp)
+	if err != nil {
+		return failAll(len(entries), err)
+	}
+	return batchResultErrors(entries, resp.Failed)
+}
+
+// batchResultErrors maps the failed entries of an SQS or SNS batch, whose
+// IDs are their indexes, to errors
+func batchResultErrors(entries []*entry, failed []batchResultError) []error {
+	if len(failed) == 0 {
+		return nil
+	}
+	errs := make([]error, len(entries))
+	for _, f := range failed {
+		i, err := strconv.Atoi(f.ID)
+		if err != nil || i < 0 || i >= len(entries) {
+			continue
+		}
+		errs[i] = fmt.Errorf("%s: %s", f.Code, f.Message)
+	}
+	return errs
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const azureAPIVersion = "2020-10-02"
+
+// azureStore speaks the Azure Blob Storage REST API, authorized by a SAS
+// token from AZURE_STORAGE_SAS_TOKEN
+type azureStore struct {
+	client    *http.Client
+	account   string
+	container string
+	endpoint  *url.URL
+	sasToken  string
+	partSize  int64
+}
+
+func newAzureStore(u *url.URL, client *http.Client, partSize int64) (*azureStore, error) {
+	// azure://<account>/<container>/<prefix>
+	container := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)[0]
+	if u.Host == "" || container == "" {
+		return nil, errors.New("missing account or container")
+	}
+
+	s := &azureStore{
+		client:    client,
+		account:   u.Host,
+		container: container,
+		sasToken:  strings.TrimPrefix(os.Getenv("AZURE_STORAGE_SAS_TOKEN"), "?"),
+		partSize:  partSize,
+	}
+	if s.sasToken == "" {
+		return nil, errors.New("missing credentials for azure:// (AZURE_STORAGE_SAS_TOKEN)")
+	}
+
+	endpoint := u.Query().Get("endpoint")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", s.account)
+	}
+	var err error
+	s.endpoint, err = url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if s.endpoint.Scheme == "" || s.endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q", endpoint)
+	}
+
+	return s, nil
+}
+
+func (s *azureStore) String() string {
+	return fmt.Sprintf("azure://%s/%s", s.account, s.container)
+}
+
+func (s *azureStore) Put(key string, r io.ReaderAt, size int64) error {
+	if size <= s.partSize {
+		body := make([]byte, size)
+		_, err := r.ReadAt(body, 0)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		return s.do("PUT", key, nil, http.Header{"X-Ms-Blob-Type": []string{"BlockBlob"}}, body)
+	}
+
+	// uncommitted blocks are garbage collected by the service, so there is
+	// nothing to abort on failure
+	var blockList struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string `xml:"Latest"`
+	}
+	buf := make([]byte, s.partSize)
+	for offset, n := int64(0), 0; offset < size; offset, n = offset+s.partSize, n+1 {
+		body := buf
+		if size-offset < s.partSize {
+			body = buf[:size-offset]
+		}
+		_, err := r.ReadAt(body, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		// block ids must all be the same length
+		blockID := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", n)))
+		params := url.Values{
+			"comp":    []string{"block"},
+			"blockid": []string{blockID},
+		}
+		err = s.do("PUT", key, params, nil, body)
+		if err != nil {
+			return fmt.Errorf("block %d: %s", n, err)
+		}
+		blockList.Latest = append(blockList.Latest, blockID)
+	}
+
+	body, _ := xml.Marshal(blockList)
+	return s.do("PUT", key, url.Values{"comp": []string{"blocklist"}}, nil, body)
+}
+
+func (s *azureStore) do(method string, key string, params url.Values, header http.Header, body []byte) error {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.container + "/" + key
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = s.sasToken
+	if len(params) > 0 {
+		u.RawQuery = params.Encode() + "&" + s.sasToken
+	}
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(len(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("X-Ms-Version", azureAPIVersion)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s got response code %d: %s", method, u.Path, resp.StatusCode, bytes.TrimSpace(respBody))
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressor is implemented by the writers of each --compression codec.
+//
+// Close ends the current stream; Reset starts a new one, which is
+// concatenated to the previous one in the output file.
+type compressor interface {
+	io.Writer
+	Close() error
+	Reset(w io.Writer)
+}
+
+// compressionExt is the filename extension for each --compression codec
+var compressionExt = map[string]string{
+	"gzip":   ".gz",
+	"zstd":   ".zst",
+	"snappy": ".sz",
+}
+
+func newCompressor(w io.Writer, opts *Options) (compressor, error) {
+	switch opts.Compression {
+	case "gzip":
+		level := opts.CompressionLevel
+		if level == 0 {
+			level = opts.GZIPLevel
+		}
+		if level < gzip.BestSpeed || level > gzip.BestCompression {
+			return nil, fmt.Errorf("invalid --compression-level value (%d), should be 1-9 for gzip", level)
+		}
+		return gzip.NewWriterLevel(w, level)
+	case "zstd":
+		level := zstd.SpeedDefault
+		if opts.CompressionLevel != 0 {
+			if opts.CompressionLevel < 1 || opts.CompressionLevel > 19 {
+				return nil, fmt.Errorf("invalid --compression-level value (%d), should be 1-19 for zstd", opts.CompressionLevel)
+			}
+			level = zstd.EncoderLevelFromZstd(opts.CompressionLevel)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(level))
+	case "snappy":
+		if opts.CompressionLevel != 0 {
+			return nil, fmt.Errorf("--compression-level is not supported for snappy")
+		}
+		return snappy.NewBufferedWriter(w), nil
+	}
+	return nil, fmt.Errorf("invalid --compression value (%s), should be gzip, zstd or snappy", opts.Compression)
+}
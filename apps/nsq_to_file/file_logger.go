@@ -1,13 +1,17 @@
 package main
 
 import (
-	"compress/gzip"
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,20 +19,39 @@ import (
 	"github.com/nsqio/nsq/internal/lg"
 )
 
+// partitionField matches the {{.field}} templates in --filename-format
+var partitionField = regexp.MustCompile(`{{\s*\.([^{}\s]+)\s*}}`)
+
 type FileLogger struct {
 	logf     lg.AppLogFunc
 	opts     *Options
 	topic    string
 	consumer *nsq.Consumer
+	uploader *uploader
 
-	out            *os.File
-	writer         io.Writer
-	gzipWriter     *gzip.Writer
 	logChan        chan *nsq.Message
 	filenameFormat string
+	partitioned    bool
+	// for --output-format=parquet
+	parquetColumns []*parquetColumn
+	// open files, by filename format with partition fields filled in
+	files map[string]*outputFile
 
 	termChan chan bool
 	hupChan  chan bool
+}
+
+// outputFile is a file being written for one partition
+type outputFile struct {
+	*FileLogger
+	filenameFormat string
+
+	out        *os.File
+	writer     io.Writer
+	compressor compressor
+	parquet    *parquetWriter
+	// where out is moved when finished, if not already there
+	dst string
 
 	// for rotation
 	filename string
@@ -37,12 +60,20 @@ type FileLogger struct {
 	rev      uint
 }
 
-func NewFileLogger(logf lg.AppLogFunc, opts *Options, topic string, cfg *nsq.Config) (*FileLogger, error) {
+func NewFileLogger(logf lg.AppLogFunc, opts *Options, topic string, cfg *nsq.Config, u *uploader) (*FileLogger, error) {
 	computedFilenameFormat, err := computeFilenameFormat(opts, topic)
 	if err != nil {
 		return nil, err
 	}
 
+	var parquetColumns []*parquetColumn
+	if opts.OutputFormat == "parquet" {
+		parquetColumns, err = parseParquetColumns(opts.ParquetColumns)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	consumer, err := nsq.NewConsumer(topic, opts.Channel, cfg)
 	if err != nil {
 		return nil, err
@@ -53,8 +84,12 @@ func NewFileLogger(logf lg.AppLogFunc, opts *Options, topic string, cfg *nsq.Con
 		opts:           opts,
 		topic:          topic,
 		consumer:       consumer,
+		uploader:       u,
 		logChan:        make(chan *nsq.Message, 1),
 		filenameFormat: computedFilenameFormat,
+		partitioned:    partitionField.MatchString(computedFilenameFormat),
+		parquetColumns: parquetColumns,
+		files:          make(map[string]*outputFile),
 		termChan:       make(chan bool),
 		hupChan:        make(chan bool),
 	}
@@ -101,28 +136,45 @@ func (f *FileLogger) router() {
 			sync = true
 			closeFile = true
 		case <-ticker.C:
-			if f.needsRotation() {
-				if f.opts.SkipEmptyFiles {
-					closeFile = true
+			if !f.partitioned {
+				f.file(f.filenameFormat)
+			}
+			for key, file := range f.files {
+				if !file.needsRotation() {
+					continue
+				}
+				// don't open empty files for partitions that may never
+				// see another message
+				if f.opts.SkipEmptyFiles || f.partitioned {
+					file.Close()
+					delete(f.files, key)
 				} else {
-					f.updateFile()
+					file.updateFile()
 				}
 			}
 			sync = true
 		case m := <-f.logChan:
-			if f.needsRotation() {
-				f.updateFile()
+			file := f.file(f.partition(m.Body))
+			if file.needsRotation() {
+				file.updateFile()
 				sync = true
 			}
-			_, err := f.Write(m.Body)
-			if err != nil {
-				f.logf(lg.FATAL, "[%s/%s] writing message to disk: %s", f.topic, f.opts.Channel, err)
-				os.Exit(1)
-			}
-			_, err = f.Write([]byte("\n"))
-			if err != nil {
-				f.logf(lg.FATAL, "[%s/%s] writing newline to disk: %s", f.topic, f.opts.Channel, err)
-				os.Exit(1)
+			if file.parquet != nil {
+				err := file.parquet.WriteRow(m.Body)
+				if err != nil {
+					f.logf(lg.WARN, "[%s/%s] skipping message %s, not a JSON object: %s", f.topic, f.opts.Channel, m.ID, err)
+				}
+			} else {
+				_, err := file.Write(m.Body)
+				if err != nil {
+					f.logf(lg.FATAL, "[%s/%s] writing message to disk: %s", f.topic, f.opts.Channel, err)
+					os.Exit(1)
+				}
+				_, err = file.Write([]byte("\n"))
+				if err != nil {
+					f.logf(lg.FATAL, "[%s/%s] writing newline to disk: %s", f.topic, f.opts.Channel, err)
+					os.Exit(1)
+				}
 			}
 			output[pos] = m
 			pos++
@@ -150,7 +202,10 @@ func (f *FileLogger) router() {
 		}
 
 		if closeFile {
-			f.Close()
+			for key, file := range f.files {
+				file.Close()
+				delete(f.files, key)
+			}
 			closeFile = false
 		}
 
@@ -160,15 +215,95 @@ func (f *FileLogger) router() {
 	}
 }
 
-func (f *FileLogger) Close() {
+// Sync syncs all open files
+func (f *FileLogger) Sync() error {
+	for _, file := range f.files {
+		if file.out == nil {
+			continue
+		}
+		err := file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// file returns the outputFile for filenameFormat, creating it if necessary
+func (f *FileLogger) file(filenameFormat string) *outputFile {
+	file, ok := f.files[filenameFormat]
+	if !ok {
+		file = &outputFile{
+			FileLogger:     f,
+			filenameFormat: filenameFormat,
+		}
+		f.files[filenameFormat] = file
+	}
+	return file
+}
+
+// partition fills in the {{.field}} templates of --filename-format with the
+// values of those fields in the JSON message body
+func (f *FileLogger) partition(body []byte) string {
+	if !f.partitioned {
+		return f.filenameFormat
+	}
+
+	var fields map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	d.Decode(&fields)
+
+	return partitionField.ReplaceAllStringFunc(f.filenameFormat, func(s string) string {
+		var v interface{} = fields
+		for _, name := range strings.Split(partitionField.FindStringSubmatch(s)[1], ".") {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				v = nil
+				break
+			}
+			v = m[name]
+		}
+		return partitionValue(v)
+	})
+}
+
+// partitionValue formats a field value for use in a path, "_" when missing
+// or not a scalar
+func partitionValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case json.Number:
+		s = v.String()
+	case bool:
+		s = strconv.FormatBool(v)
+	}
+	// keep values from escaping their directory or adding <TOKENS>
+	s = strings.NewReplacer("/", "_", "\\", "_", "\x00", "_", "<", "_", ">", "_").Replace(s)
+	if s == "" || s == "." || s == ".." {
+		s = "_"
+	}
+	return s
+}
+
+func (f *outputFile) Close() {
 	if f.out == nil {
 		return
 	}
 
-	if f.gzipWriter != nil {
-		err := f.gzipWriter.Close()
+	if f.parquet != nil {
+		err := f.parquet.Close()
 		if err != nil {
-			f.logf(lg.FATAL, "[%s/%s] failed to close GZIP writer: %s", f.topic, f.opts.Channel, err)
+			f.logf(lg.FATAL, "[%s/%s] failed to write parquet footer: %s", f.topic, f.opts.Channel, err)
+			os.Exit(1)
+		}
+		f.parquet = nil
+	} else if f.compressor != nil {
+		err := f.compressor.Close()
+		if err != nil {
+			f.logf(lg.FATAL, "[%s/%s] failed to close %s writer: %s", f.topic, f.opts.Channel, f.opts.Compression, err)
 			os.Exit(1)
 		}
 	}
@@ -183,31 +318,42 @@ func (f *FileLogger) Close() {
 		os.Exit(1)
 	}
 
-	// Move file from work dir to output dir if necessary, taking care not
-	// to overwrite existing files
-	if f.opts.WorkDir != f.opts.OutputDir {
-		src := f.out.Name()
-		dst := filepath.Join(f.opts.OutputDir, strings.TrimPrefix(src, f.opts.WorkDir))
+	finished := f.out.Name()
+	f.out = nil
+	if finished != f.dst {
+		finished = f.moveToOutput(finished)
+	}
 
-		// Optimistic rename
-		f.logf(lg.INFO, "[%s/%s] moving finished file %s to %s", f.topic, f.opts.Channel, src, dst)
-		err := exclusiveRename(src, dst)
-		if err == nil {
-			return
-		} else if !os.IsExist(err) {
-			f.logf(lg.FATAL, "[%s/%s] unable to move file from %s to %s: %s", f.topic, f.opts.Channel, src, dst, err)
-			os.Exit(1)
-		}
+	f.uploader.notify()
+	if f.opts.ExecOnRotate != "" {
+		f.execOnRotate(finished)
+	}
+}
+
+// moveToOutput moves a finished file from the work dir (or from its temporary
+// name) to the output dir, taking care not to overwrite existing files, and
+// returns its new path
+func (f *outputFile) moveToOutput(src string) string {
+	dst := f.dst
+
+	// Optimistic rename
+	f.logf(lg.INFO, "[%s/%s] moving finished file %s to %s", f.topic, f.opts.Channel, src, dst)
+	err := exclusiveRename(src, dst)
+	if err != nil && !os.IsExist(err) {
+		f.logf(lg.FATAL, "[%s/%s] unable to move file from %s to %s: %s", f.topic, f.opts.Channel, src, dst, err)
+		os.Exit(1)
+	}
 
+	dstDir, _ := filepath.Split(dst)
+	if err != nil {
 		// Optimistic rename failed, so we need to generate a new
 		// destination file name by bumping the revision number.
 		_, filenameTmpl := filepath.Split(f.filename)
-		dstDir, _ := filepath.Split(dst)
 		dstTmpl := filepath.Join(dstDir, filenameTmpl)
 
 		for i := f.rev + 1; ; i++ {
 			f.logf(lg.WARN, "[%s/%s] destination file already exists: %s", f.topic, f.opts.Channel, dst)
-			dst := strings.Replace(dstTmpl, "<REV>", fmt.Sprintf("-%06d", i), -1)
+			dst = strings.Replace(dstTmpl, "<REV>", fmt.Sprintf("-%06d", i), -1)
 			err := exclusiveRename(src, dst)
 			if err != nil {
 				if os.IsExist(err) {
@@ -221,40 +367,67 @@ func (f *FileLogger) Close() {
 		}
 	}
 
-	f.out = nil
+	// make the rename durable before anything downstream acts on it
+	err = syncDir(dstDir)
+	if err != nil {
+		f.logf(lg.ERROR, "[%s/%s] failed to fsync %s: %s", f.topic, f.opts.Channel, dstDir, err)
+	}
+	return dst
 }
 
-func (f *FileLogger) Write(p []byte) (int, error) {
+// execOnRotate runs --exec-on-rotate with the path of a finished file
+func (f *outputFile) execOnRotate(path string) {
+	args := strings.Fields(f.opts.ExecOnRotate)
+	cmd := exec.Command(args[0], append(args[1:], path)...)
+	cmd.Env = append(os.Environ(), "NSQ_TOPIC="+f.topic, "NSQ_CHANNEL="+f.opts.Channel)
+
+	start := time.Now()
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		f.logf(lg.ERROR, "[%s/%s] --exec-on-rotate failed for %s: %s: %s",
+			f.topic, f.opts.Channel, path, err, bytes.TrimSpace(output))
+		return
+	}
+	f.logf(lg.INFO, "[%s/%s] --exec-on-rotate succeeded for %s in %s", f.topic, f.opts.Channel, path, time.Since(start))
+}
+
+func (f *outputFile) Write(p []byte) (int, error) {
 	n, err := f.writer.Write(p)
 	f.filesize += int64(n)
 	return n, err
 }
 
-func (f *FileLogger) Sync() error {
+func (f *outputFile) Sync() error {
 	var err error
-	if f.gzipWriter != nil {
-		// finish current gzip stream and start a new one (concatenated)
-		// gzip stream trailer has checksum, and can indicate which messages were ACKed
-		err = f.gzipWriter.Close()
+	if f.parquet != nil {
+		// a row group per sync; the footer is only written on Close
+		err = f.parquet.Flush()
 		if err != nil {
 			return err
 		}
 		err = f.out.Sync()
-		f.gzipWriter, _ = gzip.NewWriterLevel(f.out, f.opts.GZIPLevel)
-		f.writer = f.gzipWriter
+	} else if f.compressor != nil {
+		// finish current compressed stream and start a new one (concatenated)
+		// gzip and zstd stream trailers have checksums, and can indicate which messages were ACKed
+		err = f.compressor.Close()
+		if err != nil {
+			return err
+		}
+		err = f.out.Sync()
+		f.compressor.Reset(f.out)
 	} else {
 		err = f.out.Sync()
 	}
 	return err
 }
 
-func (f *FileLogger) currentFilename() string {
+func (f *outputFile) currentFilename() string {
 	t := time.Now()
 	datetime := strftime(f.opts.DatetimeFormat, t)
 	return strings.Replace(f.filenameFormat, "<DATETIME>", datetime, -1)
 }
 
-func (f *FileLogger) needsRotation() bool {
+func (f *outputFile) needsRotation() bool {
 	if f.out == nil {
 		return true
 	}
@@ -281,7 +454,7 @@ func (f *FileLogger) needsRotation() bool {
 	return false
 }
 
-func (f *FileLogger) updateFile() {
+func (f *outputFile) updateFile() {
 	f.Close() // uses current f.filename and f.rev to resolve rename dst conflict
 
 	filename := f.currentFilename()
@@ -300,33 +473,41 @@ func (f *FileLogger) updateFile() {
 		os.Exit(1)
 	}
 
+	// files opened exclusively are finished when closed, and so are written
+	// under a temporary name unless already in a working directory
+	exclusive := f.opts.Compression != "" || f.opts.OutputFormat == "parquet" || f.opts.RotateInterval > 0
+
 	var fi os.FileInfo
 	for ; ; f.rev++ {
 		absFilename := strings.Replace(fullPath, "<REV>", fmt.Sprintf("-%06d", f.rev), -1)
+		f.dst = filepath.Join(f.opts.OutputDir, strings.TrimPrefix(absFilename, f.opts.WorkDir))
+		if exclusive && f.opts.WorkDir == f.opts.OutputDir {
+			dir, name := filepath.Split(absFilename)
+			absFilename = filepath.Join(dir, "."+name+".tmp")
+		}
 
-		// If we're using a working directory for in-progress files,
-		// proactively check for duplicate file names in the output dir to
-		// prevent conflicts on rename in the normal case
-		if f.opts.WorkDir != f.opts.OutputDir {
-			outputFileName := filepath.Join(f.opts.OutputDir, strings.TrimPrefix(absFilename, f.opts.WorkDir))
-			err := makeDirFromPath(f.logf, outputFileName)
+		// If we're writing in-progress files elsewhere, proactively check
+		// for duplicate file names in the output dir to prevent conflicts
+		// on rename in the normal case
+		if absFilename != f.dst {
+			err := makeDirFromPath(f.logf, f.dst)
 			if err != nil {
 				f.logf(lg.FATAL, "[%s/%s] unable to create dir: %s", f.topic, f.opts.Channel, err)
 				os.Exit(1)
 			}
 
-			_, err = os.Stat(outputFileName)
+			_, err = os.Stat(f.dst)
 			if err == nil {
-				f.logf(lg.WARN, "[%s/%s] output file already exists: %s", f.topic, f.opts.Channel, outputFileName)
+				f.logf(lg.WARN, "[%s/%s] output file already exists: %s", f.topic, f.opts.Channel, f.dst)
 				continue // next rev
 			} else if !os.IsNotExist(err) {
-				f.logf(lg.FATAL, "[%s/%s] unable to stat output file %s: %s", f.topic, f.opts.Channel, outputFileName, err)
+				f.logf(lg.FATAL, "[%s/%s] unable to stat output file %s: %s", f.topic, f.opts.Channel, f.dst, err)
 				os.Exit(1)
 			}
 		}
 
 		openFlag := os.O_WRONLY | os.O_CREATE
-		if f.opts.GZIP || f.opts.RotateInterval > 0 {
+		if exclusive {
 			openFlag |= os.O_EXCL
 		} else {
 			openFlag |= os.O_APPEND
@@ -358,10 +539,28 @@ func (f *FileLogger) updateFile() {
 		break // good file
 	}
 
-	if f.opts.GZIP {
-		f.gzipWriter, _ = gzip.NewWriterLevel(f.out, f.opts.GZIPLevel)
-		f.writer = f.gzipWriter
-	} else {
+	// messages are FINed once synced, so the new file must survive a crash
+	dir, _ := filepath.Split(f.out.Name())
+	err = syncDir(dir)
+	if err != nil {
+		f.logf(lg.FATAL, "[%s/%s] failed to fsync %s: %s", f.topic, f.opts.Channel, dir, err)
+		os.Exit(1)
+	}
+
+	switch {
+	case f.opts.OutputFormat == "parquet":
+		// options were validated in main
+		f.writer = f.out
+		f.parquet, err = newParquetWriter(f, f.parquetColumns, f.opts)
+		if err != nil {
+			f.logf(lg.FATAL, "[%s/%s] failed to write parquet header: %s", f.topic, f.opts.Channel, err)
+			os.Exit(1)
+		}
+	case f.opts.Compression != "":
+		// options were validated in main
+		f.compressor, _ = newCompressor(f.out, f.opts)
+		f.writer = f.compressor
+	default:
 		f.writer = f.out
 	}
 }
@@ -402,9 +601,9 @@ func computeFilenameFormat(opts *Options, topic string) (string, error) {
 	}
 
 	cff := opts.FilenameFormat
-	if opts.GZIP || opts.RotateSize > 0 || opts.RotateInterval > 0 || opts.WorkDir != opts.OutputDir {
+	if opts.Compression != "" || opts.OutputFormat == "parquet" || opts.RotateSize > 0 || opts.RotateInterval > 0 || opts.WorkDir != opts.OutputDir {
 		if strings.Index(cff, "<REV>") == -1 {
-			return "", errors.New("missing <REV> in --filename-format when gzip, rotation, or work dir enabled")
+			return "", errors.New("missing <REV> in --filename-format when compression, parquet output, rotation, or work dir enabled")
 		}
 	} else {
 		// remove <REV> as we don't need it
@@ -413,8 +612,14 @@ func computeFilenameFormat(opts *Options, topic string) (string, error) {
 	cff = strings.Replace(cff, "<TOPIC>", topic, -1)
 	cff = strings.Replace(cff, "<HOST>", identifier, -1)
 	cff = strings.Replace(cff, "<PID>", fmt.Sprintf("%d", os.Getpid()), -1)
-	if opts.GZIP && !strings.HasSuffix(cff, ".gz") {
-		cff = cff + ".gz"
+	ext := compressionExt[opts.Compression]
+	if opts.OutputFormat == "parquet" {
+		// compression is internal to parquet files
+		ext = ".parquet"
+		cff = strings.TrimSuffix(cff, ".log")
+	}
+	if ext != "" && !strings.HasSuffix(cff, ext) {
+		cff = cff + ext
 	}
 
 	return cff, nil
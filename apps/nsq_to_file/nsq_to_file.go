@@ -5,6 +5,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
@@ -41,10 +42,13 @@ func flagSet() *flag.FlagSet {
 	fs.String("output-dir", "/tmp", "directory to write output files to")
 	fs.String("work-dir", "", "directory for in-progress files before moving to output-dir")
 	fs.String("datetime-format", "%Y-%m-%d_%H", "strftime compatible format for <DATETIME> in filename format")
-	fs.String("filename-format", "<TOPIC>.<HOST><REV>.<DATETIME>.log", "output filename format (<TOPIC>, <HOST>, <PID>, <DATETIME>, <REV> are replaced. <REV> is increased when file already exists)")
+	fs.String("filename-format", "<TOPIC>.<HOST><REV>.<DATETIME>.log", "output filename format (<TOPIC>, <HOST>, <PID>, <DATETIME>, <REV> are replaced. <REV> is increased when file already exists. {{.field}} and {{.nested.field}} are replaced by values from JSON message bodies, _ when missing)")
 	fs.String("host-identifier", "", "value to output in log filename in place of hostname. <SHORT_HOST> and <HOSTNAME> are valid replacement tokens")
-	fs.Int("gzip-level", 6, "gzip compression level (1-9, 1=BestSpeed, 9=BestCompression)")
-	fs.Bool("gzip", false, "gzip output files.")
+	fs.Int("gzip-level", 6, "(deprecated) use --compression-level")
+	fs.Bool("gzip", false, "(deprecated) use --compression=gzip")
+	fs.String("compression", "", "compress output files: gzip, zstd or snappy")
+	fs.Int("compression-level", 0, "compression level (gzip 1-9, zstd 1-19 mapped to the nearest zstd encoder speed, defaults to 6 and 3 respectively)")
+	fs.String("output-format", "lines", "output file format: lines (one message per line) or parquet (rows of --parquet-column fields from JSON messages, compressed with --compression)")
 	fs.Bool("skip-empty-files", false, "skip writing empty files")
 	fs.Duration("topic-refresh", time.Minute, "how frequently the topic list should be refreshed")
 	fs.String("topic-pattern", "", "only log topics matching the following pattern")
@@ -53,6 +57,11 @@ func flagSet() *flag.FlagSet {
 	fs.Duration("rotate-interval", 0, "rotate the file every duration")
 	fs.Duration("sync-interval", 30*time.Second, "sync file to disk every duration")
 
+	fs.String("exec-on-rotate", "", "command to run with the path of each finished file appended (NSQ_TOPIC and NSQ_CHANNEL are set in its environment)")
+	fs.String("output-url", "", "upload finished files to s3://bucket/prefix, gs://bucket/prefix or azure://account/container/prefix (requires --work-dir, --output-dir holds files pending upload)")
+	fs.Int64("upload-part-size", 16*1024*1024, "upload files bigger than `upload-part-size` bytes in parts (min 5MiB)")
+	fs.Duration("upload-retry-interval", 10*time.Second, "how often to retry uploading files left in --output-dir")
+
 	fs.Duration("http-client-connect-timeout", 2*time.Second, "timeout for HTTP connect")
 	fs.Duration("http-client-request-timeout", 5*time.Second, "timeout for HTTP request")
 
@@ -60,9 +69,11 @@ func flagSet() *flag.FlagSet {
 	lookupdHTTPAddrs := app.StringArray{}
 	topics := app.StringArray{}
 	consumerOpts := app.StringArray{}
+	parquetColumns := app.StringArray{}
 	fs.Var(&nsqdTCPAddrs, "nsqd-tcp-address", "nsqd TCP address (may be given multiple times)")
 	fs.Var(&lookupdHTTPAddrs, "lookupd-http-address", "lookupd HTTP address (may be given multiple times)")
 	fs.Var(&topics, "topic", "nsq topic (may be given multiple times)")
+	fs.Var(&parquetColumns, "parquet-column", "parquet column as name:type[:json.path], type is string, int32, int64, double, boolean or timestamp (epoch milliseconds or RFC3339), the path defaults to name (may be given multiple times)")
 	fs.Var(&consumerOpts, "consumer-opt", "option to passthrough to nsq.Consumer (may be given multiple times, http://godoc.org/github.com/nsqio/go-nsq#Config)")
 
 	return fs
@@ -116,6 +127,28 @@ func main() {
 		log.Fatalf("invalid --gzip-level value (%d), should be 1-9", opts.GZIPLevel)
 	}
 
+	if opts.GZIP && opts.Compression == "" {
+		opts.Compression = "gzip"
+	}
+	if opts.Compression != "" {
+		if _, err := newCompressor(ioutil.Discard, opts); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	switch opts.OutputFormat {
+	case "lines":
+		if len(opts.ParquetColumns) != 0 {
+			log.Fatal("--parquet-column requires --output-format=parquet")
+		}
+	case "parquet":
+		if _, err := parseParquetColumns(opts.ParquetColumns); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("invalid --output-format value (%s), should be lines or parquet", opts.OutputFormat)
+	}
+
 	if len(opts.Topics) == 0 && len(opts.TopicPattern) == 0 {
 		log.Fatal("--topic or --topic-pattern required")
 	}
@@ -128,6 +161,22 @@ func main() {
 		opts.WorkDir = opts.OutputDir
 	}
 
+	if opts.OutputURL != "" && opts.ExecOnRotate != "" {
+		log.Fatal("use --output-url or --exec-on-rotate not both")
+	}
+
+	if opts.OutputURL != "" {
+		if opts.WorkDir == opts.OutputDir {
+			log.Fatal("--work-dir must differ from --output-dir when --output-url is specified")
+		}
+		if opts.UploadPartSize < 5*1024*1024 {
+			log.Fatal("--upload-part-size must be at least 5MiB")
+		}
+		if opts.UploadRetryInterval <= 0 {
+			log.Fatal("--upload-retry-interval should be positive")
+		}
+	}
+
 	cfg := nsq.NewConfig()
 	cfgFlag := nsq.ConfigFlag{cfg}
 	for _, opt := range opts.ConsumerOpts {
@@ -141,6 +190,19 @@ func main() {
 	signal.Notify(hupChan, syscall.SIGHUP)
 	signal.Notify(termChan, syscall.SIGINT, syscall.SIGTERM)
 
-	discoverer := newTopicDiscoverer(logf, opts, cfg, hupChan, termChan)
+	var u *uploader
+	if opts.OutputURL != "" {
+		u, err = newUploader(logf, opts)
+		if err != nil {
+			log.Fatalf("invalid --output-url: %s", err)
+		}
+		go u.run()
+	}
+
+	discoverer := newTopicDiscoverer(logf, opts, cfg, u, hupChan, termChan)
 	discoverer.run()
+
+	if u != nil {
+		u.stop()
+	}
 }
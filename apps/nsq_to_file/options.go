@@ -22,12 +22,24 @@ type Options struct {
 	DatetimeFormat string        `flag:"datetime-format"`
 	FilenameFormat string        `flag:"filename-format"`
 	HostIdentifier string        `flag:"host-identifier"`
-	GZIPLevel      int           `flag:"gzip-level"`
-	GZIP           bool          `flag:"gzip"`
+	GZIPLevel      int           `flag:"gzip-level"` // deprecated, use --compression-level
+	GZIP           bool          `flag:"gzip"`       // deprecated, use --compression=gzip
 	SkipEmptyFiles bool          `flag:"skip-empty-files"`
 	RotateSize     int64         `flag:"rotate-size"`
 	RotateInterval time.Duration `flag:"rotate-interval"`
 	SyncInterval   time.Duration `flag:"sync-interval"`
+
+	Compression      string `flag:"compression"`
+	CompressionLevel int    `flag:"compression-level"`
+
+	OutputFormat   string   `flag:"output-format"`
+	ParquetColumns []string `flag:"parquet-column"`
+
+	ExecOnRotate string `flag:"exec-on-rotate"`
+
+	OutputURL           string        `flag:"output-url"`
+	UploadPartSize      int64         `flag:"upload-part-size"`
+	UploadRetryInterval time.Duration `flag:"upload-retry-interval"`
 }
 
 func NewOptions() *Options {
@@ -39,9 +51,12 @@ func NewOptions() *Options {
 		OutputDir:                "/tmp",
 		DatetimeFormat:           "%Y-%m-%d_%H",
 		FilenameFormat:           "<TOPIC>.<HOST><REV>.<DATETIME>.log",
+		OutputFormat:             "lines",
 		GZIPLevel:                6,
 		TopicRefreshInterval:     time.Minute,
 		SyncInterval:             30 * time.Second,
+		UploadPartSize:           16 * 1024 * 1024,
+		UploadRetryInterval:      10 * time.Second,
 		HTTPClientConnectTimeout: 2 * time.Second,
 		HTTPClientRequestTimeout: 5 * time.Second,
 	}
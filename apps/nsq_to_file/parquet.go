@@ -0,0 +1,548 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/nsqio/nsq/internal/version"
+)
+
+// parquet physical types, converted types, codecs and encodings, as numbered
+// in parquet.thrift
+const (
+	parquetBoolean   = 0
+	parquetInt32     = 1
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+
+	parquetUncompressed = 0
+	parquetSnappy       = 1
+	parquetGZIP         = 2
+	parquetZSTD         = 6
+
+	parquetPlain = 0
+	parquetRLE   = 3
+)
+
+// parquetCodecs maps --compression to the codec of data pages
+var parquetCodecs = map[string]int32{
+	"":       parquetUncompressed,
+	"snappy": parquetSnappy,
+	"gzip":   parquetGZIP,
+	"zstd":   parquetZSTD,
+}
+
+// parquetColumn is an OPTIONAL column filled from a JSON message field
+type parquetColumn struct {
+	name      string
+	path      []string
+	kind      string
+	ptype     int32
+	converted int32 // -1 for none
+
+	// buffered for the current row group
+	defs   []byte // definition levels, 0 for null
+	values bytes.Buffer
+	bools  []bool
+}
+
+// parseParquetColumns parses --parquet-column values, name:type[:json.path]
+func parseParquetColumns(specs []string) ([]*parquetColumn, error) {
+	if len(specs) == 0 {
+		return nil, errors.New("--parquet-column is required for --output-format=parquet")
+	}
+	var columns []*parquetColumn
+	names := make(map[string]bool)
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, ":", 3)
+		if len(parts) < 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid --parquet-column %q, should be name:type[:json.path]", spec)
+		}
+		if names[parts[0]] {
+			return nil, fmt.Errorf("duplicate --parquet-column %q", parts[0])
+		}
+		names[parts[0]] = true
+
+		c := &parquetColumn{
+			name:      parts[0],
+			path:      strings.Split(parts[0], "."),
+			kind:      parts[1],
+			converted: -1,
+		}
+		if len(parts) == 3 && parts[2] != "" {
+			c.path = strings.Split(parts[2], ".")
+		}
+		switch c.kind {
+		case "string":
+			c.ptype, c.converted = parquetByteArray, parquetUTF8
+		case "int32":
+			c.ptype = parquetInt32
+		case "int64":
+			c.ptype = parquetInt64
+		case "double":
+			c.ptype = parquetDouble
+		case "boolean":
+			c.ptype = parquetBoolean
+		case "timestamp":
+			c.ptype, c.converted = parquetInt64, parquetTimestampMillis
+		default:
+			return nil, fmt.Errorf("invalid --parquet-column %q, type should be string, int32, int64, double, boolean or timestamp", spec)
+		}
+		columns = append(columns, c)
+	}
+	return columns, nil
+}
+
+// append adds v (as decoded with UseNumber) to the column, as null if it's
+// missing or can't be converted
+func (c *parquetColumn) append(v interface{}) {
+	ok := v != nil
+	if ok {
+		switch c.kind {
+		case "string":
+			var s string
+			switch v := v.(type) {
+			case string:
+				s = v
+			case json.Number:
+				s = v.String()
+			default:
+				b, _ := json.Marshal(v)
+				s = string(b)
+			}
+			binary.Write(&c.values, binary.LittleEndian, uint32(len(s)))
+			c.values.WriteString(s)
+		case "int32":
+			var i int64
+			i, ok = parquetInt(v)
+			if ok && (i < math.MinInt32 || i > math.MaxInt32) {
+				ok = false
+			}
+			if ok {
+				binary.Write(&c.values, binary.LittleEndian, int32(i))
+			}
+		case "int64":
+			var i int64
+			i, ok = parquetInt(v)
+			if ok {
+				binary.Write(&c.values, binary.LittleEndian, i)
+			}
+		case "double":
+			var f float64
+			switch v := v.(type) {
+			case json.Number:
+				f, ok = parquetFloat(v.String())
+			case string:
+				f, ok = parquetFloat(v)
+			default:
+				ok = false
+			}
+			if ok {
+				binary.Write(&c.values, binary.LittleEndian, math.Float64bits(f))
+			}
+		case "boolean":
+			var b bool
+			switch v := v.(type) {
+			case bool:
+				b = v
+			case string:
+				var err error
+				b, err = strconv.ParseBool(v)
+				ok = err == nil
+			default:
+				ok = false
+			}
+			if ok {
+				c.bools = append(c.bools, b)
+			}
+		case "timestamp":
+			// epoch milliseconds, or an RFC3339 string
+			var ms int64
+			if s, isString := v.(string); isString {
+				t, err := time.Parse(time.RFC3339Nano, s)
+				ms, ok = t.UnixNano()/int64(time.Millisecond), err == nil
+			} else {
+				ms, ok = parquetInt(v)
+			}
+			if ok {
+				binary.Write(&c.values, binary.LittleEndian, ms)
+			}
+		}
+	}
+	if ok {
+		c.defs = append(c.defs, 1)
+	} else {
+		c.defs = append(c.defs, 0)
+	}
+}
+
+func parquetInt(v interface{}) (int64, bool) {
+	var s string
+	switch v := v.(type) {
+	case json.Number:
+		s = v.String()
+	case string:
+		s = v
+	default:
+		return 0, false
+	}
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		f, ok := parquetFloat(s)
+		if !ok || f < math.MinInt64 || f >= math.MaxInt64 {
+			return 0, false
+		}
+		return int64(f), true
+	}
+	return i, true
+}
+
+func parquetFloat(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	return f, err == nil
+}
+
+// parquetWriter writes JSON messages as rows of a parquet file, one row group
+// per Flush. The file is only readable once closed.
+type parquetWriter struct {
+	w          io.Writer
+	offset     int64
+	codec      int32
+	compressor compressor
+	columns    []*parquetColumn
+
+	rows      int
+	numRows   int64
+	rowGroups []*thriftWriter
+}
+
+func newParquetWriter(w io.Writer, columns []*parquetColumn, opts *Options) (*parquetWriter, error) {
+	p := &parquetWriter{
+		w:     w,
+		codec: parquetCodecs[opts.Compression],
+	}
+	if opts.Compression != "" && opts.Compression != "snappy" {
+		// data pages are compressed with the same codec used for line
+		// output, except snappy which uses the block format
+		var err error
+		p.compressor, err = newCompressor(ioutil.Discard, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, c := range columns {
+		p.columns = append(p.columns, &parquetColumn{
+			name:      c.name,
+			path:      c.path,
+			kind:      c.kind,
+			ptype:     c.ptype,
+			converted: c.converted,
+		})
+	}
+	return p, p.write([]byte("PAR1"))
+}
+
+func (p *parquetWriter) write(b []byte) error {
+	n, err := p.w.Write(b)
+	p.offset += int64(n)
+	return err
+}
+
+// WriteRow appends the JSON message body as a row
+func (p *parquetWriter) WriteRow(body []byte) error {
+	var fields map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	err := d.Decode(&fields)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range p.columns {
+		var v interface{} = fields
+		for _, name := range c.path {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				v = nil
+				break
+			}
+			v = m[name]
+		}
+		c.append(v)
+	}
+	p.rows++
+	return nil
+}
+
+// Flush writes the buffered rows as a row group
+func (p *parquetWriter) Flush() error {
+	if p.rows == 0 {
+		return nil
+	}
+
+	rg := &thriftWriter{}
+	rg.listHeader(1, thriftStruct, len(p.columns))
+	var totalSize int64
+	for _, c := range p.columns {
+		meta, size, err := p.writeColumnChunk(c)
+		if err != nil {
+			return err
+		}
+		totalSize += size
+		rg.structBegin()
+		rg.fieldI64(2, meta.offset)
+		rg.fieldStructBegin(3)
+		rg.buf = append(rg.buf, meta.buf...)
+		rg.structEnd()
+		rg.structEnd()
+
+		c.defs = c.defs[:0]
+		c.values.Reset()
+		c.bools = c.bools[:0]
+	}
+	rg.fieldI64(2, totalSize)
+	rg.fieldI64(3, int64(p.rows))
+
+	p.rowGroups = append(p.rowGroups, rg)
+	p.numRows += int64(p.rows)
+	p.rows = 0
+	return nil
+}
+
+type columnChunkMeta struct {
+	offset int64
+	// ColumnMetaData fields, without the struct stop
+	buf []byte
+}
+
+// writeColumnChunk writes c as a single data page, returning its metadata and
+// uncompressed size
+func (p *parquetWriter) writeColumnChunk(c *parquetColumn) (*columnChunkMeta, int64, error) {
+	var page bytes.Buffer
+
+	// definition levels, RLE with a bit width of 1
+	var levels []byte
+	for i := 0; i < len(c.defs); {
+		j := i
+		for j < len(c.defs) && c.defs[j] == c.defs[i] {
+			j++
+		}
+		levels = appendUvarint(levels, uint64(j-i)<<1)
+		levels = append(levels, c.defs[i])
+		i = j
+	}
+	binary.Write(&page, binary.LittleEndian, uint32(len(levels)))
+	page.Write(levels)
+
+	if c.ptype == parquetBoolean {
+		packed := make([]byte, (len(c.bools)+7)/8)
+		for i, b := range c.bools {
+			if b {
+				packed[i/8] |= 1 << uint(i%8)
+			}
+		}
+		page.Write(packed)
+	} else {
+		page.Write(c.values.Bytes())
+	}
+
+	body, err := p.compress(page.Bytes())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	hdr := &thriftWriter{}
+	hdr.fieldI32(1, 0) // DATA_PAGE
+	hdr.fieldI32(2, int32(page.Len()))
+	hdr.fieldI32(3, int32(len(body)))
+	hdr.fieldStructBegin(5)
+	hdr.fieldI32(1, int32(len(c.defs)))
+	hdr.fieldI32(2, parquetPlain)
+	hdr.fieldI32(3, parquetRLE)
+	hdr.fieldI32(4, parquetRLE)
+	hdr.structEnd()
+	hdr.structEnd()
+
+	offset := p.offset
+	err = p.write(hdr.buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = p.write(body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	uncompressed := int64(len(hdr.buf) + page.Len())
+	meta := &thriftWriter{}
+	meta.fieldI32(1, c.ptype)
+	meta.listHeader(2, thriftI32, 2)
+	meta.i32(parquetPlain)
+	meta.i32(parquetRLE)
+	meta.listHeader(3, thriftBinary, 1)
+	meta.binary([]byte(c.name))
+	meta.fieldI32(4, p.codec)
+	meta.fieldI64(5, int64(len(c.defs)))
+	meta.fieldI64(6, uncompressed)
+	meta.fieldI64(7, int64(len(hdr.buf)+len(body)))
+	meta.fieldI64(9, offset)
+	return &columnChunkMeta{offset, meta.buf}, uncompressed, nil
+}
+
+func (p *parquetWriter) compress(b []byte) ([]byte, error) {
+	if p.codec == parquetSnappy {
+		return snappy.Encode(nil, b), nil
+	}
+	if p.compressor == nil {
+		return b, nil
+	}
+	var buf bytes.Buffer
+	p.compressor.Reset(&buf)
+	p.compressor.Write(b)
+	err := p.compressor.Close()
+	return buf.Bytes(), err
+}
+
+// Close flushes buffered rows and writes the footer
+func (p *parquetWriter) Close() error {
+	err := p.Flush()
+	if err != nil {
+		return err
+	}
+
+	meta := &thriftWriter{}
+	meta.fieldI32(1, 1)
+	meta.listHeader(2, thriftStruct, len(p.columns)+1)
+	meta.structBegin()
+	meta.fieldBinary(4, []byte("schema"))
+	meta.fieldI32(5, int32(len(p.columns)))
+	meta.structEnd()
+	for _, c := range p.columns {
+		meta.structBegin()
+		meta.fieldI32(1, c.ptype)
+		meta.fieldI32(3, 1) // OPTIONAL
+		meta.fieldBinary(4, []byte(c.name))
+		if c.converted >= 0 {
+			meta.fieldI32(6, c.converted)
+		}
+		meta.structEnd()
+	}
+	meta.fieldI64(3, p.numRows)
+	meta.listHeader(4, thriftStruct, len(p.rowGroups))
+	for _, rg := range p.rowGroups {
+		meta.structBegin()
+		meta.buf = append(meta.buf, rg.buf...)
+		meta.structEnd()
+	}
+	meta.fieldBinary(6, []byte("nsq_to_file version "+version.Binary))
+	meta.structEnd()
+
+	err = p.write(meta.buf)
+	if err != nil {
+		return err
+	}
+	var footer [8]byte
+	binary.LittleEndian.PutUint32(footer[:], uint32(len(meta.buf)))
+	copy(footer[4:], "PAR1")
+	return p.write(footer[:])
+}
+
+// thrift compact protocol types
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes structs with the thrift compact protocol. Fields must
+// be written in increasing id order.
+type thriftWriter struct {
+	buf    []byte
+	lastID int16
+	stack  []int16
+}
+
+func (t *thriftWriter) fieldHeader(id int16, typ byte) {
+	if delta := id - t.lastID; delta > 0 && delta <= 15 {
+		t.buf = append(t.buf, byte(delta)<<4|typ)
+	} else {
+		t.buf = append(t.buf, typ)
+		t.buf = appendUvarint(t.buf, uint64(uint16(id<<1^id>>15)))
+	}
+	t.lastID = id
+}
+
+func (t *thriftWriter) i32(v int32) {
+	t.buf = appendUvarint(t.buf, uint64(uint32(v<<1^v>>31)))
+}
+
+func (t *thriftWriter) binary(b []byte) {
+	t.buf = appendUvarint(t.buf, uint64(len(b)))
+	t.buf = append(t.buf, b...)
+}
+
+func (t *thriftWriter) fieldI32(id int16, v int32) {
+	t.fieldHeader(id, thriftI32)
+	t.i32(v)
+}
+
+func (t *thriftWriter) fieldI64(id int16, v int64) {
+	t.fieldHeader(id, thriftI64)
+	t.buf = appendUvarint(t.buf, uint64(v<<1^v>>63))
+}
+
+func (t *thriftWriter) fieldBinary(id int16, b []byte) {
+	t.fieldHeader(id, thriftBinary)
+	t.binary(b)
+}
+
+func (t *thriftWriter) listHeader(id int16, elemType byte, n int) {
+	t.fieldHeader(id, thriftList)
+	if n < 15 {
+		t.buf = append(t.buf, byte(n)<<4|elemType)
+	} else {
+		t.buf = append(t.buf, 0xf0|elemType)
+		t.buf = appendUvarint(t.buf, uint64(n))
+	}
+}
+
+// structBegin starts a struct that is a list element
+func (t *thriftWriter) structBegin() {
+	t.stack = append(t.stack, t.lastID)
+	t.lastID = 0
+}
+
+func (t *thriftWriter) fieldStructBegin(id int16) {
+	t.fieldHeader(id, thriftStruct)
+	t.structBegin()
+}
+
+func (t *thriftWriter) structEnd() {
+	t.buf = append(t.buf, 0)
+	if n := len(t.stack); n > 0 {
+		t.lastID = t.stack[n-1]
+		t.stack = t.stack[:n-1]
+	}
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(b, tmp[:n]...)
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3Store speaks the S3 REST API, signed with AWS Signature Version 4
+//
+// Google Cloud Storage is reached through its S3 compatible XML API using
+// HMAC keys
+type s3Store struct {
+	client   *http.Client
+	scheme   string
+	bucket   string
+	region   string
+	endpoint *url.URL
+	// path style addressing (https://endpoint/bucket/key) is used for custom
+	// endpoints, otherwise virtual hosted style (https://bucket.endpoint/key)
+	pathStyle bool
+	partSize  int64
+
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+func newS3Store(u *url.URL, client *http.Client, partSize int64) (*s3Store, error) {
+	if u.Host == "" {
+		return nil, errors.New("missing bucket")
+	}
+
+	s := &s3Store{
+		client:   client,
+		scheme:   u.Scheme,
+		bucket:   u.Host,
+		region:   u.Query().Get("region"),
+		partSize: partSize,
+	}
+
+	endpoint := u.Query().Get("endpoint")
+	switch u.Scheme {
+	case "s3":
+		s.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		s.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		s.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		if s.region == "" {
+			s.region = os.Getenv("AWS_REGION")
+		}
+		if s.region == "" {
+			s.region = "us-east-1"
+		}
+		if endpoint == "" {
+			endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s.region)
+		} else {
+			s.pathStyle = true
+		}
+	case "gs":
+		s.accessKey = os.Getenv("GCS_ACCESS_KEY_ID")
+		s.secretKey = os.Getenv("GCS_SECRET_ACCESS_KEY")
+		if s.region == "" {
+			s.region = "auto"
+		}
+		if endpoint == "" {
+			endpoint = "https://storage.googleapis.com"
+		} else {
+			s.pathStyle = true
+		}
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("missing credentials for %s://", u.Scheme)
+	}
+
+	var err error
+	s.endpoint, err = url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if s.endpoint.Scheme == "" || s.endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q", endpoint)
+	}
+
+	return s, nil
+}
+
+func (s *s3Store) String() string {
+	return fmt.Sprintf("%s://%s", s.scheme, s.bucket)
+}
+
+func (s *s3Store) Put(key string, r io.ReaderAt, size int64) error {
+	if size <= s.partSize {
+		body := make([]byte, size)
+		_, err := r.ReadAt(body, 0)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		_, err = s.do("PUT", key, nil, body)
+		return err
+	}
+	return s.putMultipart(key, r, size)
+}
+
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+func (s *s3Store) putMultipart(key string, r io.ReaderAt, size int64) error {
+	resp, err := s.do("POST", key, url.Values{"uploads": []string{""}}, nil)
+	if err != nil {
+		return err
+	}
+	var initiate struct {
+		UploadId string
+	}
+	err = xml.Unmarshal(resp.body, &initiate)
+	if err != nil {
+		return fmt.Errorf("invalid InitiateMultipartUpload response: %s", err)
+	}
+
+	parts, err := s.putParts(key, initiate.UploadId, r, size)
+	if err == nil {
+		var complete struct {
+			XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+			Parts   []s3CompletedPart `xml:"Part"`
+		}
+		complete.Parts = parts
+		body, _ := xml.Marshal(complete)
+		_, err = s.do("POST", key, url.Values{"uploadId": []string{initiate.UploadId}}, body)
+	}
+	if err != nil {
+		// don't leave the parts uploaded so far lying around (and billed)
+		s.do("DELETE", key, url.Values{"uploadId": []string{initiate.UploadId}}, nil)
+		return err
+	}
+	return nil
+}
+
+func (s *s3Store) putParts(key string, uploadID string, r io.ReaderAt, size int64) ([]s3CompletedPart, error) {
+	var parts []s3CompletedPart
+	buf := make([]byte, s.partSize)
+	for offset, n := int64(0), 1; offset < size; offset, n = offset+s.partSize, n+1 {
+		body := buf
+		if size-offset < s.partSize {
+			body = buf[:size-offset]
+		}
+		_, err := r.ReadAt(body, offset)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		params := url.Values{
+			"partNumber": []string{strconv.Itoa(n)},
+			"uploadId":   []string{uploadID},
+		}
+		resp, err := s.do("PUT", key, params, body)
+		if err != nil {
+			return nil, fmt.Errorf("part %d: %s", n, err)
+		}
+		parts = append(parts, s3CompletedPart{n, resp.header.Get("ETag")})
+	}
+	return parts, nil
+}
+
+type s3Response struct {
+	header http.Header
+	body   []byte
+}
+
+func (s *s3Store) do(method string, key string, params url.Values, body []byte) (*s3Response, error) {
+	u := *s.endpoint
+	objectPath := "/" + key
+	if s.pathStyle {
+		objectPath = "/" + s.bucket + objectPath
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + objectPath
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(params)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	s.sign(req, body, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s %s got response code %d: %s", method, u.Path, resp.StatusCode, bytes.TrimSpace(respBody))
+	}
+	return &s3Response{resp.Header, respBody}, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req
+//
+// see https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+func (s *s3Store) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	var names []string
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+	// net/http sends req.Host, not the header
+	req.Header.Del("Host")
+}
+
+// canonicalQuery encodes params sorted by key, with %20 rather than + for
+// spaces as SigV4 requires
+func canonicalQuery(params url.Values) string {
+	var keys []string
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		for _, v := range params[k] {
+			pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent-encodes everything but RFC 3986 unreserved characters
+// (and '/' unless encodeSlash)
+func uriEncode(s string, encodeSlash bool) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			buf.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,19 @@
+// +build !windows
+
+package main
+
+import (
+	"os"
+)
+
+// syncDir fsyncs the directory dir so that file creations and renames within
+// it are durable
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	f.Close()
+	return err
+}
@@ -0,0 +1,8 @@
+// +build windows
+
+package main
+
+// syncDir is a no-op on Windows, where directories cannot be fsynced
+func syncDir(dir string) error {
+	return nil
+}
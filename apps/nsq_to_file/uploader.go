@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nsqio/nsq/internal/http_api"
+	"github.com/nsqio/nsq/internal/lg"
+)
+
+// objectStore is a bucket (or container) of an object storage service
+type objectStore interface {
+	// Put stores size bytes of r as the object key, in parts if necessary
+	Put(key string, r io.ReaderAt, size int64) error
+	String() string
+}
+
+// uploader moves finished files from --output-dir to --output-url
+//
+// files that fail to upload (ie. during an outage) are left in --output-dir
+// and retried, as are files left there by a previous run
+type uploader struct {
+	logf     lg.AppLogFunc
+	dir      string
+	prefix   string
+	store    objectStore
+	interval time.Duration
+
+	notifyChan chan struct{}
+	exitChan   chan struct{}
+	doneChan   chan struct{}
+}
+
+func newUploader(logf lg.AppLogFunc, opts *Options) (*uploader, error) {
+	u, err := url.Parse(opts.OutputURL)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{
+		Transport: http_api.NewDeadlineTransport(opts.HTTPClientConnectTimeout, opts.HTTPClientRequestTimeout),
+	}
+
+	var store objectStore
+	switch u.Scheme {
+	case "s3", "gs":
+		store, err = newS3Store(u, client, opts.UploadPartSize)
+	case "azure":
+		store, err = newAzureStore(u, client, opts.UploadPartSize)
+	default:
+		err = fmt.Errorf("unsupported scheme %q (s3, gs or azure)", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := strings.TrimPrefix(u.Path, "/")
+	if u.Scheme == "azure" {
+		// azure://<account>/<container>/<prefix>
+		prefix = strings.TrimPrefix(strings.TrimPrefix(prefix, store.(*azureStore).container), "/")
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	return &uploader{
+		logf:       logf,
+		dir:        opts.OutputDir,
+		prefix:     prefix,
+		store:      store,
+		interval:   opts.UploadRetryInterval,
+		notifyChan: make(chan struct{}, 1),
+		exitChan:   make(chan struct{}),
+		doneChan:   make(chan struct{}),
+	}, nil
+}
+
+// notify wakes the uploader after a file was moved to --output-dir
+func (u *uploader) notify() {
+	if u == nil {
+		return
+	}
+	select {
+	case u.notifyChan <- struct{}{}:
+	default:
+	}
+}
+
+func (u *uploader) run() {
+	ticker := time.NewTicker(u.interval)
+	defer ticker.Stop()
+	defer close(u.doneChan)
+
+	for {
+		u.uploadAll()
+		select {
+		case <-u.notifyChan:
+		case <-ticker.C:
+		case <-u.exitChan:
+			// one last attempt for the files closed on exit
+			u.uploadAll()
+			return
+		}
+	}
+}
+
+func (u *uploader) stop() {
+	close(u.exitChan)
+	<-u.doneChan
+}
+
+// uploadAll uploads every file in --output-dir, stopping at the first failure
+func (u *uploader) uploadAll() {
+	var pending int
+	var failed error
+	filepath.Walk(u.dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			u.logf(lg.ERROR, "unable to read %s: %s", p, err)
+			return nil
+		}
+		if strings.HasPrefix(fi.Name(), ".") && p != u.dir {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		if failed != nil {
+			pending++
+			return nil
+		}
+		failed = u.upload(p, fi.Size())
+		if failed != nil {
+			pending++
+		}
+		return nil
+	})
+	if failed != nil {
+		u.logf(lg.WARN, "upload to %s failed, %d file(s) spilled in %s, retrying in %s: %s",
+			u.store, pending, u.dir, u.interval, failed)
+	}
+}
+
+func (u *uploader) upload(p string, size int64) error {
+	rel, err := filepath.Rel(u.dir, p)
+	if err != nil {
+		return err
+	}
+	key := u.prefix + path.Clean(filepath.ToSlash(rel))
+
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	start := time.Now()
+	err = u.store.Put(key, f, size)
+	if err != nil {
+		return fmt.Errorf("%s: %s", p, err)
+	}
+	u.logf(lg.INFO, "uploaded %s to %s/%s (%d bytes in %s)", p, u.store, key, size, time.Since(start))
+
+	err = os.Remove(p)
+	if err != nil {
+		u.logf(lg.ERROR, "unable to remove uploaded file %s: %s", p, err)
+	}
+	return nil
+}
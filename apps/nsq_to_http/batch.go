@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+// batch is a set of messages sent in one POST request, all with the same
+// template field values
+type batch struct {
+	values   map[string]string
+	messages []*nsq.Message
+}
+
+// body encodes the batch as NDJSON or, for format "json", as a JSON array
+// with messages that aren't valid JSON encoded as strings
+func (b *batch) body(format string) []byte {
+	var buf bytes.Buffer
+	if format == "json" {
+		buf.WriteByte('[')
+	}
+	for i, m := range b.messages {
+		switch {
+		case format != "json":
+			buf.Write(m.Body)
+			buf.WriteByte('\n')
+			continue
+		case i > 0:
+			buf.WriteByte(',')
+		}
+		if json.Valid(m.Body) {
+			buf.Write(m.Body)
+		} else {
+			s, _ := json.Marshal(string(m.Body))
+			buf.Write(s)
+		}
+	}
+	if format == "json" {
+		buf.WriteByte(']')
+	}
+	return buf.Bytes()
+}
+
+type batchMessage struct {
+	*nsq.Message
+	values map[string]string
+}
+
+// Batcher groups messages by their template field values into batches of up
+// to size, sending partial batches every timeout
+type Batcher struct {
+	size    int
+	timeout time.Duration
+	fields  []string
+
+	inChan  chan batchMessage
+	outChan chan *batch
+}
+
+func NewBatcher(size int, timeout time.Duration, fields []string) *Batcher {
+	return &Batcher{
+		size:    size,
+		timeout: timeout,
+		fields:  fields,
+		inChan:  make(chan batchMessage),
+		outChan: make(chan *batch),
+	}
+}
+
+func (b *Batcher) Add(m *nsq.Message, values map[string]string) {
+	b.inChan <- batchMessage{m, values}
+}
+
+func (b *Batcher) key(values map[string]string) string {
+	k := make([]string, len(b.fields))
+	for i, field := range b.fields {
+		k[i] = values[field]
+	}
+	return strings.Join(k, "\x00")
+}
+
+func (b *Batcher) router() {
+	pending := make(map[string]*batch)
+	ticker := time.NewTicker(b.timeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case m := <-b.inChan:
+			key := b.key(m.values)
+			p, ok := pending[key]
+			if !ok {
+				p = &batch{values: m.values}
+				pending[key] = p
+			}
+			p.messages = append(p.messages, m.Message)
+			if len(p.messages) >= b.size {
+				b.outChan <- p
+				delete(pending, key)
+			}
+		case <-ticker.C:
+			for key, p := range pending {
+				b.outChan <- p
+				delete(pending, key)
+			}
+		}
+	}
+}
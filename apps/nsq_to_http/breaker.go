@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+var errCircuitOpen = errors.New("circuit open")
+
+// Breaker stops requests to an address after consecutive failures (errors,
+// or requests slower than maxLatency) until cooldown has passed, then lets a
+// single trial request through to decide whether to close again
+type Breaker struct {
+	sync.Mutex
+	addr       string
+	failures   int
+	maxLatency time.Duration
+	cooldown   time.Duration
+
+	consecutive int
+	openUntil   time.Time
+	trial       bool
+}
+
+// NewBreaker returns a Breaker for addr, or nil (which always allows
+// requests) if failures is 0
+func NewBreaker(addr string, failures int, maxLatency time.Duration, cooldown time.Duration) *Breaker {
+	if failures == 0 {
+		return nil
+	}
+	return &Breaker{
+		addr:       addr,
+		failures:   failures,
+		maxLatency: maxLatency,
+		cooldown:   cooldown,
+	}
+}
+
+// Allow reports whether a request may be sent, and must be followed by
+// Record if it is
+func (b *Breaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.consecutive < b.failures {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.trial {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// Record records the result of a request allowed by Allow
+func (b *Breaker) Record(err error, latency time.Duration) {
+	if b == nil {
+		return
+	}
+	if err == nil && b.maxLatency > 0 && latency > b.maxLatency {
+		err = errors.New("too slow (" + latency.String() + ")")
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	wasOpen := b.consecutive >= b.failures
+	b.trial = false
+	if err == nil {
+		if wasOpen {
+			log.Printf("INFO: [%s] circuit closed", b.addr)
+		}
+		b.consecutive = 0
+		return
+	}
+	b.consecutive++
+	if b.consecutive >= b.failures {
+		if !wasOpen {
+			log.Printf("WARNING: [%s] circuit open for %s after %d consecutive failures - %s",
+				b.addr, b.cooldown, b.consecutive, err)
+		}
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
@@ -15,19 +15,19 @@ func init() {
 	userAgent = fmt.Sprintf("nsq_to_http v%s", version.Binary)
 }
 
-func HTTPGet(endpoint string) (*http.Response, error) {
+func HTTPGet(endpoint string, values map[string]string) (*http.Response, error) {
 	req, err := http.NewRequest("GET", endpoint, nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("User-Agent", userAgent)
 	for key, val := range validCustomHeaders {
-		req.Header.Set(key, val)
+		req.Header.Set(key, renderHeader(val, values))
 	}
 	return httpclient.Do(req)
 }
 
-func HTTPPost(endpoint string, body *bytes.Buffer) (*http.Response, error) {
+func HTTPPost(endpoint string, body *bytes.Buffer, values map[string]string) (*http.Response, error) {
 	req, err := http.NewRequest("POST", endpoint, body)
 	if err != nil {
 		return nil, err
@@ -35,7 +35,7 @@ func HTTPPost(endpoint string, body *bytes.Buffer) (*http.Response, error) {
 	req.Header.Set("User-Agent", userAgent)
 	req.Header.Set("Content-Type", *contentType)
 	for key, val := range validCustomHeaders {
-		req.Header.Set(key, val)
+		req.Header.Set(key, renderHeader(val, values))
 	}
 	return httpclient.Do(req)
 }
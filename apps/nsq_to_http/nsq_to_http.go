@@ -47,7 +47,13 @@ var (
 	httpConnectTimeout = flag.Duration("http-client-connect-timeout", 2*time.Second, "timeout for HTTP connect")
 	httpRequestTimeout = flag.Duration("http-client-request-timeout", 20*time.Second, "timeout for HTTP request")
 	statusEvery        = flag.Int("status-every", 250, "the # of requests between logging status (per handler), 0 disables")
-	contentType        = flag.String("content-type", "application/octet-stream", "the Content-Type used for POST requests")
+	breakerFailures    = flag.Int("breaker-failures", 0, "stop sending to an address after this many consecutive failures, failing over to other addresses in round-robin and hostpool modes (0 disables)")
+	breakerLatency     = flag.Duration("breaker-latency", 0, "count requests slower than this as failures for --breaker-failures (0 disables)")
+	breakerCooldown    = flag.Duration("breaker-cooldown", 10*time.Second, "how long to stop sending to an address before trying it again")
+	contentType        = flag.String("content-type", "application/octet-stream", "the Content-Type used for POST requests (defaults to application/x-ndjson or application/json with --batch-size)")
+	batchSize          = flag.Int("batch-size", 1, "max number of messages to send in each POST request (1 disables batching)")
+	batchTimeout       = flag.Duration("batch-timeout", time.Second, "max time to wait for a batch to fill before sending it")
+	batchFormat        = flag.String("batch-format", "ndjson", "body of batched POST requests: ndjson (one message per line) or json (an array, messages that aren't JSON are sent as strings)")
 
 	getAddrs           = app.StringArray{}
 	postAddrs          = app.StringArray{}
@@ -58,15 +64,17 @@ var (
 )
 
 func init() {
-	flag.Var(&postAddrs, "post", "HTTP address to make a POST request to.  data will be in the body (may be given multiple times)")
-	flag.Var(&customHeaders, "header", "Custom header for HTTP requests (may be given multiple times)")
-	flag.Var(&getAddrs, "get", "HTTP address to make a GET request to. '%s' will be printf replaced with data (may be given multiple times)")
+	flag.Var(&postAddrs, "post", "HTTP address to make a POST request to.  data will be in the body. {{.field}} is replaced by the field's value in JSON messages (may be given multiple times)")
+	flag.Var(&customHeaders, "header", "Custom header for HTTP requests. {{.field}} in the value is replaced by the field's value in JSON messages (may be given multiple times)")
+	flag.Var(&getAddrs, "get", "HTTP address to make a GET request to. '%s' will be printf replaced with data. {{.field}} is replaced by the field's value in JSON messages (may be given multiple times)")
 	flag.Var(&nsqdTCPAddrs, "nsqd-tcp-address", "nsqd TCP address (may be given multiple times)")
 	flag.Var(&lookupdHTTPAddrs, "lookupd-http-address", "lookupd HTTP address (may be given multiple times)")
 }
 
 type Publisher interface {
-	Publish(string, []byte) error
+	// Publish sends msg to the addr template, rendered with the message's
+	// template field values
+	Publish(addr string, msg []byte, values map[string]string) error
 }
 
 type PublishHandler struct {
@@ -77,9 +85,13 @@ type PublishHandler struct {
 	addresses app.StringArray
 	mode      int
 	hostPool  hostpool.HostPool
+	// used in address and header templates
+	fields  []string
+	batcher *Batcher
 
 	perAddressStatus map[string]*timer_metrics.TimerMetrics
 	timermetrics     *timer_metrics.TimerMetrics
+	breakers         map[string]*Breaker
 }
 
 func (ph *PublishHandler) HandleMessage(m *nsq.Message) error {
@@ -87,12 +99,41 @@ func (ph *PublishHandler) HandleMessage(m *nsq.Message) error {
 		return nil
 	}
 
+	values := messageFields(m.Body, ph.fields)
+	if ph.batcher != nil {
+		// FINed or REQed once the batch is sent
+		m.DisableAutoResponse()
+		ph.batcher.Add(m, values)
+		return nil
+	}
+	return ph.publish(m.Body, values)
+}
+
+// publishBatches sends batches from the batcher, FINing their messages on
+// success and REQing them on failure
+func (ph *PublishHandler) publishBatches() {
+	for b := range ph.batcher.outChan {
+		err := ph.publish(b.body(*batchFormat), b.values)
+		if err != nil {
+			log.Printf("ERROR: failed to publish batch of %d messages - %s", len(b.messages), err)
+		}
+		for _, m := range b.messages {
+			if err != nil {
+				m.Requeue(-1)
+			} else {
+				m.Finish()
+			}
+		}
+	}
+}
+
+func (ph *PublishHandler) publish(body []byte, values map[string]string) error {
 	startTime := time.Now()
 	switch ph.mode {
 	case ModeAll:
 		for _, addr := range ph.addresses {
 			st := time.Now()
-			err := ph.Publish(addr, m.Body)
+			err := ph.publishTo(addr, body, values)
 			if err != nil {
 				return err
 			}
@@ -100,33 +141,67 @@ func (ph *PublishHandler) HandleMessage(m *nsq.Message) error {
 		}
 	case ModeRoundRobin:
 		counter := atomic.AddUint64(&ph.counter, 1)
-		idx := counter % uint64(len(ph.addresses))
-		addr := ph.addresses[idx]
-		err := ph.Publish(addr, m.Body)
+		var err error
+		for i := 0; i < ph.attempts(); i++ {
+			idx := (counter + uint64(i)) % uint64(len(ph.addresses))
+			addr := ph.addresses[idx]
+			st := time.Now()
+			err = ph.publishTo(addr, body, values)
+			if err == nil {
+				ph.perAddressStatus[addr].Status(st)
+				break
+			}
+		}
 		if err != nil {
 			return err
 		}
-		ph.perAddressStatus[addr].Status(startTime)
 	case ModeHostPool:
-		hostPoolResponse := ph.hostPool.Get()
-		addr := hostPoolResponse.Host()
-		err := ph.Publish(addr, m.Body)
-		hostPoolResponse.Mark(err)
+		var err error
+		for i := 0; i < ph.attempts(); i++ {
+			hostPoolResponse := ph.hostPool.Get()
+			addr := hostPoolResponse.Host()
+			st := time.Now()
+			err = ph.publishTo(addr, body, values)
+			hostPoolResponse.Mark(err)
+			if err == nil {
+				ph.perAddressStatus[addr].Status(st)
+				break
+			}
+		}
 		if err != nil {
 			return err
 		}
-		ph.perAddressStatus[addr].Status(startTime)
 	}
 	ph.timermetrics.Status(startTime)
 
 	return nil
 }
 
+// attempts is the number of addresses to try for each message, more than one
+// only with circuit breakers to route around unhealthy addresses
+func (ph *PublishHandler) attempts() int {
+	if *breakerFailures > 0 {
+		return len(ph.addresses)
+	}
+	return 1
+}
+
+func (ph *PublishHandler) publishTo(addr string, body []byte, values map[string]string) error {
+	b := ph.breakers[addr]
+	if !b.Allow() {
+		return fmt.Errorf("%s: %s", addr, errCircuitOpen)
+	}
+	start := time.Now()
+	err := ph.Publish(addr, body, values)
+	b.Record(err, time.Since(start))
+	return err
+}
+
 type PostPublisher struct{}
 
-func (p *PostPublisher) Publish(addr string, msg []byte) error {
+func (p *PostPublisher) Publish(addr string, msg []byte, values map[string]string) error {
 	buf := bytes.NewBuffer(msg)
-	resp, err := HTTPPost(addr, buf)
+	resp, err := HTTPPost(renderAddr(addr, values), buf, values)
 	if err != nil {
 		return err
 	}
@@ -141,9 +216,9 @@ func (p *PostPublisher) Publish(addr string, msg []byte) error {
 
 type GetPublisher struct{}
 
-func (p *GetPublisher) Publish(addr string, msg []byte) error {
-	endpoint := fmt.Sprintf(addr, url.QueryEscape(string(msg)))
-	resp, err := HTTPGet(endpoint)
+func (p *GetPublisher) Publish(addr string, msg []byte, values map[string]string) error {
+	endpoint := renderAddr(fmt.Sprintf(addr, url.QueryEscape(string(msg))), values)
+	resp, err := HTTPGet(endpoint, values)
 	if err != nil {
 		return err
 	}
@@ -236,6 +311,37 @@ func main() {
 		log.Fatal("ERROR: --sample must be between 0.0 and 1.0")
 	}
 
+	if *breakerFailures < 0 {
+		log.Fatal("--breaker-failures must not be negative")
+	}
+	if *breakerFailures > 0 && *breakerCooldown <= 0 {
+		log.Fatal("--breaker-cooldown should be positive")
+	}
+
+	if *batchSize < 1 {
+		log.Fatal("--batch-size must be at least 1")
+	}
+	if *batchSize > 1 {
+		if len(postAddrs) == 0 {
+			log.Fatal("--batch-size requires --post")
+		}
+		if *batchTimeout <= 0 {
+			log.Fatal("--batch-timeout should be positive")
+		}
+		switch *batchFormat {
+		case "ndjson":
+			if !hasArg("content-type") {
+				*contentType = "application/x-ndjson"
+			}
+		case "json":
+			if !hasArg("content-type") {
+				*contentType = "application/json"
+			}
+		default:
+			log.Fatal("--batch-format should be ndjson or json")
+		}
+	}
+
 	termChan := make(chan os.Signal, 1)
 	signal.Notify(termChan, syscall.SIGINT, syscall.SIGTERM)
 
@@ -266,6 +372,17 @@ func main() {
 		}
 	}
 
+	templates := append([]string{}, addresses...)
+	for _, val := range validCustomHeaders {
+		templates = append(templates, val)
+	}
+	fields := templateFields(templates)
+
+	breakers := make(map[string]*Breaker)
+	for _, a := range addresses {
+		breakers[a] = NewBreaker(a, *breakerFailures, *breakerLatency, *breakerCooldown)
+	}
+
 	hostPool := hostpool.New(addresses)
 	if *mode == "epsilon-greedy" {
 		hostPool = hostpool.NewEpsilonGreedy(addresses, 0, &hostpool.LinearEpsilonValueCalculator{})
@@ -278,6 +395,15 @@ func main() {
 		hostPool:         hostPool,
 		perAddressStatus: perAddressStatus,
 		timermetrics:     timer_metrics.NewTimerMetrics(*statusEvery, "[aggregate]:"),
+		fields:           fields,
+		breakers:         breakers,
+	}
+	if *batchSize > 1 {
+		handler.batcher = NewBatcher(*batchSize, *batchTimeout, fields)
+		go handler.batcher.router()
+		for i := 0; i < *numPublishers; i++ {
+			go handler.publishBatches()
+		}
 	}
 	consumer.AddConcurrentHandlers(handler, *numPublishers)
 
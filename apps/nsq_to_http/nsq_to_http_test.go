@@ -4,8 +4,12 @@
 package main
 
 import (
+	"errors"
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
 )
 
 func TestParseCustomHeaders(t *testing.T) {
@@ -56,3 +60,78 @@ func TestParseCustomHeaders(t *testing.T) {
 		})
 	}
 }
+
+func TestTemplates(t *testing.T) {
+	fields := templateFields([]string{"http://host/{{.tenant}}/pub?k={{ .key.id }}", "{{.tenant}}"})
+	if !reflect.DeepEqual(fields, []string{"tenant", "key.id"}) {
+		t.Fatalf("templateFields() = %v", fields)
+	}
+
+	values := messageFields([]byte(`{"tenant":"a b/c","key":{"id":12345678901234567890}}`), fields)
+	want := map[string]string{"tenant": "a b/c", "key.id": "12345678901234567890"}
+	if !reflect.DeepEqual(values, want) {
+		t.Fatalf("messageFields() = %v, want %v", values, want)
+	}
+	if got := renderAddr("http://host/{{.tenant}}/pub?k={{ .key.id }}", values); got != "http://host/a%20b%2Fc/pub?k=12345678901234567890" {
+		t.Errorf("renderAddr() = %q", got)
+	}
+	if got := renderHeader("Bearer {{.tenant}}", values); got != "Bearer a b/c" {
+		t.Errorf("renderHeader() = %q", got)
+	}
+
+	values = messageFields([]byte(`not json`), fields)
+	if got := renderAddr("http://host/{{.tenant}}/pub", values); got != "http://host//pub" {
+		t.Errorf("renderAddr() with missing fields = %q", got)
+	}
+}
+
+func TestBatchBody(t *testing.T) {
+	b := &batch{}
+	for _, body := range []string{`{"a":1}`, `text`, `[2]`} {
+		b.messages = append(b.messages, &nsq.Message{Body: []byte(body)})
+	}
+	if got := string(b.body("ndjson")); got != "{\"a\":1}\ntext\n[2]\n" {
+		t.Errorf("ndjson body = %q", got)
+	}
+	if got := string(b.body("json")); got != `[{"a":1},"text",[2]]` {
+		t.Errorf("json body = %q", got)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	var b *Breaker
+	if !b.Allow() {
+		t.Fatal("disabled breaker should allow requests")
+	}
+
+	b = NewBreaker("addr", 2, 50*time.Millisecond, 50*time.Millisecond)
+	failed := errors.New("failed")
+	b.Allow()
+	b.Record(failed, 0)
+	if !b.Allow() {
+		t.Fatal("breaker opened before 2 failures")
+	}
+	b.Record(nil, time.Second) // too slow
+	if b.Allow() {
+		t.Fatal("breaker should be open")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("breaker should allow a trial request after cooldown")
+	}
+	if b.Allow() {
+		t.Fatal("breaker should allow only one trial request")
+	}
+	b.Record(failed, 0)
+	if b.Allow() {
+		t.Fatal("breaker should reopen after a failed trial")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	b.Allow()
+	b.Record(nil, 0)
+	if !b.Allow() || !b.Allow() {
+		t.Fatal("breaker should close after a successful trial")
+	}
+}
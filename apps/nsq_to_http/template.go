@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// templateField matches the {{.field}} templates in addresses and headers
+var templateField = regexp.MustCompile(`{{\s*\.([^{}\s]+)\s*}}`)
+
+// templateFields returns the fields used by templates, in order of appearance
+func templateFields(templates []string) []string {
+	var fields []string
+	seen := make(map[string]bool)
+	for _, t := range templates {
+		for _, match := range templateField.FindAllStringSubmatch(t, -1) {
+			if !seen[match[1]] {
+				seen[match[1]] = true
+				fields = append(fields, match[1])
+			}
+		}
+	}
+	return fields
+}
+
+// messageFields returns the values of fields (which may be nested, as
+// a.b.c) in a JSON message body. Missing fields, or all of them when the
+// body isn't a JSON object, are empty.
+func messageFields(body []byte, fields []string) map[string]string {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	var msg map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	d.Decode(&msg)
+
+	values := make(map[string]string, len(fields))
+	for _, field := range fields {
+		var v interface{} = msg
+		for _, name := range strings.Split(field, ".") {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				v = nil
+				break
+			}
+			v = m[name]
+		}
+		switch v := v.(type) {
+		case nil:
+		case string:
+			values[field] = v
+		case json.Number:
+			values[field] = v.String()
+		default:
+			b, _ := json.Marshal(v)
+			values[field] = string(b)
+		}
+	}
+	return values
+}
+
+// renderAddr fills in the fields of an address template, escaped for use in
+// a URL path or query
+func renderAddr(addr string, values map[string]string) string {
+	if values == nil {
+		return addr
+	}
+	return templateField.ReplaceAllStringFunc(addr, func(s string) string {
+		return url.PathEscape(values[templateField.FindStringSubmatch(s)[1]])
+	})
+}
+
+// renderHeader fills in the fields of a header value template
+func renderHeader(val string, values map[string]string) string {
+	if values == nil {
+		return val
+	}
+	return templateField.ReplaceAllStringFunc(val, func(s string) string {
+		v := values[templateField.FindStringSubmatch(s)[1]]
+		return strings.NewReplacer("\r", " ", "\n", " ").Replace(v)
+	})
+}
@@ -0,0 +1,673 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/nsqio/nsq/internal/http_api"
+)
+
+// With --forward-hops messages are republished with the hops they were
+// published with (see nsqd --record-hops), which go-nsq can neither read nor
+// publish: they're consumed in the v3 envelope (IDENTIFY msg_envelope 3) and
+// published with their hops prefixed to their bodies (IDENTIFY hops). nsqd then
+// records their whole path, and drops those forwarded back to a cluster they
+// already transited.
+
+const (
+	msgEnvelopeV3 = 3
+
+	// set in the producer length of the v3 envelope when an event timestamp
+	// or hops follow the producer
+	eventTimeFlag = 1 << 15
+	hopsFlag      = 1 << 14
+)
+
+var (
+	heartbeatBytes = []byte("_heartbeat_")
+	closeWaitBytes = []byte("CLOSE_WAIT")
+)
+
+// appendHops returns body prefixed with hops, as published with IDENTIFY hops: a
+// 2-byte (uint16) length and the hops
+func appendHops(hops string, body []byte) []byte {
+	b := make([]byte, 2, 2+len(hops)+len(body))
+	binary.BigEndian.PutUint16(b, uint16(len(hops)))
+	b = append(b, hops...)
+	return append(b, body...)
+}
+
+// decodeMessageV3 decodes a message in the v3 envelope, returning its hops
+func decodeMessageV3(b []byte) (*nsq.Message, string, error) {
+	// timestamp, attempts, id, checksum and producer length
+	if len(b) < 8+2+nsq.MsgIDLength+4+2 {
+		return nil, "", errors.New("not enough data to decode valid message")
+	}
+	var id nsq.MessageID
+	copy(id[:], b[10:10+nsq.MsgIDLength])
+	msg := nsq.NewMessage(id, nil)
+	msg.Timestamp = int64(binary.BigEndian.Uint64(b[:8]))
+	msg.Attempts = binary.BigEndian.Uint16(b[8:10])
+
+	pos := 10 + nsq.MsgIDLength + 4
+	producerFlags := binary.BigEndian.Uint16(b[pos : pos+2])
+	pos += 2 + int(producerFlags&^(eventTimeFlag|hopsFlag))
+	if producerFlags&eventTimeFlag != 0 {
+		pos += 8
+	}
+	if len(b) < pos {
+		return nil, "", errors.New("not enough data to decode message producer")
+	}
+	var hops string
+	if producerFlags&hopsFlag != 0 {
+		if len(b) < pos+2 {
+			return nil, "", errors.New("not enough data to decode message hops")
+		}
+		hopsLen := int(binary.BigEndian.Uint16(b[pos : pos+2]))
+		if len(b) < pos+2+hopsLen {
+			return nil, "", errors.New("not enough data to decode message hops")
+		}
+		hops = string(b[pos+2 : pos+2+hopsLen])
+		pos += 2 + hopsLen
+	}
+	msg.Body = b[pos:]
+	return msg, hops, nil
+}
+
+// hopsConn is a connection to nsqd, which IDENTIFY'd with features go-nsq
+// doesn't negotiate
+type hopsConn struct {
+	net.Conn
+	addr string
+	cfg  *nsq.Config
+	r    *bufio.Reader
+
+	writeMtx sync.Mutex
+	w        *bufio.Writer
+}
+
+type identifyResponse struct {
+	MsgEnvelope  int32 `json:"msg_envelope"`
+	Hops         bool  `json:"hops"`
+	AuthRequired bool  `json:"auth_required"`
+}
+
+// dialHops connects to nsqd at addr and IDENTIFYs with the features
+func dialHops(addr string, cfg *nsq.Config, features map[string]interface{}) (*hopsConn, *identifyResponse, error) {
+	conn, err := net.DialTimeout("tcp", addr, cfg.DialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	c := &hopsConn{
+		Conn: conn,
+		addr: addr,
+		cfg:  cfg,
+		r:    bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+	}
+
+	ci := map[string]interface{}{
+		"client_id":           cfg.ClientID,
+		"hostname":            cfg.Hostname,
+		"user_agent":          cfg.UserAgent,
+		"feature_negotiation": true,
+	}
+	if cfg.HeartbeatInterval == -1 {
+		ci["heartbeat_interval"] = -1
+	} else {
+		ci["heartbeat_interval"] = int64(cfg.HeartbeatInterval / time.Millisecond)
+	}
+	if cfg.MsgTimeout > 0 {
+		ci["msg_timeout"] = int64(cfg.MsgTimeout / time.Millisecond)
+	}
+	for k, v := range features {
+		ci[k] = v
+	}
+	cmd, err := nsq.Identify(ci)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	c.writeMtx.Lock()
+	c.w.Write(nsq.MagicV2)
+	c.writeMtx.Unlock()
+	data, err := c.command(cmd)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("IDENTIFY failed - %s", err)
+	}
+	resp := &identifyResponse{}
+	err = json.Unmarshal(data, resp)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("IDENTIFY failed - %s", err)
+	}
+	if resp.AuthRequired {
+		conn.Close()
+		return nil, nil, errors.New("nsqd requires AUTH, which --forward-hops doesn't support")
+	}
+	return c, resp, nil
+}
+
+// command writes cmd and returns its response, for commands sent before the
+// connection's read loop is started
+func (c *hopsConn) command(cmd *nsq.Command) ([]byte, error) {
+	err := c.write(cmd)
+	if err != nil {
+		return nil, err
+	}
+	frameType, data, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	if frameType == nsq.FrameTypeError {
+		return nil, nsq.ErrProtocol{Reason: string(data)}
+	}
+	return data, nil
+}
+
+func (c *hopsConn) write(cmd *nsq.Command) error {
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+
+	c.SetWriteDeadline(time.Now().Add(c.cfg.WriteTimeout))
+	_, err := cmd.WriteTo(c.w)
+	if err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+func (c *hopsConn) read() (int32, []byte, error) {
+	c.SetReadDeadline(time.Now().Add(c.cfg.ReadTimeout))
+	return nsq.ReadUnpackedResponse(c.r)
+}
+
+// hopsProducer publishes to nsqd like nsq.Producer, the bodies it's given
+// starting with their hops (see appendHops)
+type hopsProducer struct {
+	addr string
+	cfg  *nsq.Config
+
+	mtx  sync.Mutex
+	conn *producerConn
+}
+
+// producerConn is a connection of a hopsProducer and its publishes awaiting a
+// response, in order
+type producerConn struct {
+	*hopsConn
+	pending []*hopsTransaction
+}
+
+type hopsTransaction struct {
+	*nsq.ProducerTransaction
+	doneChan chan *nsq.ProducerTransaction
+}
+
+func (t *hopsTransaction) finish() {
+	if t.doneChan != nil {
+		t.doneChan <- t.ProducerTransaction
+	}
+}
+
+func newHopsProducer(addr string, cfg *nsq.Config) *hopsProducer {
+	return &hopsProducer{
+		addr: addr,
+		cfg:  cfg,
+	}
+}
+
+func (p *hopsProducer) String() string {
+	return p.addr
+}
+
+// PublishAsync publishes body, which starts with its hops, to topic, sending
+// the result to doneChan like nsq.Producer
+func (p *hopsProducer) PublishAsync(topic string, body []byte, doneChan chan *nsq.ProducerTransaction,
+	args ...interface{}) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.conn == nil {
+		conn, resp, err := dialHops(p.addr, p.cfg, map[string]interface{}{"hops": true})
+		if err != nil {
+			return err
+		}
+		if !resp.Hops {
+			conn.Close()
+			return fmt.Errorf("nsqd %s doesn't support hops, --forward-hops requires nsqd --record-hops", p.addr)
+		}
+		p.conn = &producerConn{hopsConn: conn}
+		go p.readLoop(p.conn)
+	}
+
+	err := p.conn.write(nsq.Publish(topic, body))
+	if err != nil {
+		// the read loop fails the pending publishes
+		p.conn.Close()
+		p.conn = nil
+		return err
+	}
+	p.conn.pending = append(p.conn.pending, &hopsTransaction{
+		ProducerTransaction: &nsq.ProducerTransaction{Args: args},
+		doneChan:            doneChan,
+	})
+	return nil
+}
+
+// readLoop completes the publishes of conn as their responses arrive, and
+// fails those left when it's closed
+func (p *hopsProducer) readLoop(conn *producerConn) {
+	var err error
+	for {
+		var frameType int32
+		var data []byte
+		frameType, data, err = conn.read()
+		if err != nil {
+			break
+		}
+		if frameType == nsq.FrameTypeResponse && bytes.Equal(data, heartbeatBytes) {
+			err = conn.write(nsq.Nop())
+			if err != nil {
+				break
+			}
+			continue
+		}
+
+		p.mtx.Lock()
+		if len(conn.pending) == 0 {
+			p.mtx.Unlock()
+			err = fmt.Errorf("unexpected response %q", data)
+			break
+		}
+		t := conn.pending[0]
+		conn.pending = conn.pending[1:]
+		p.mtx.Unlock()
+
+		if frameType == nsq.FrameTypeError {
+			t.Error = nsq.ErrProtocol{Reason: string(data)}
+		}
+		t.finish()
+	}
+
+	conn.Close()
+	p.mtx.Lock()
+	if p.conn == conn {
+		p.conn = nil
+	}
+	pending := conn.pending
+	conn.pending = nil
+	p.mtx.Unlock()
+
+	if len(pending) > 0 {
+		log.Printf("ERROR: (%s) connection closed with %d publishes pending - %s", p.addr, len(pending), err)
+	}
+	for _, t := range pending {
+		t.Error = nsq.ErrNotConnected
+		t.finish()
+	}
+}
+
+// hopsHandler handles messages consumed by a hopsConsumer
+type hopsHandler interface {
+	HandleMessageHops(m *nsq.Message, hops string) error
+}
+
+type hopsMessage struct {
+	msg  *nsq.Message
+	hops string
+}
+
+// hopsConsumer consumes a topic and channel like nsq.Consumer, passing the
+// hops of each message to its handler
+type hopsConsumer struct {
+	topic   string
+	channel string
+	cfg     *nsq.Config
+
+	incomingMessages chan hopsMessage
+
+	mtx          sync.Mutex
+	conns        map[string]*consumerConn
+	nsqdAddrs    []string
+	lookupdAddrs []string
+	stopping     bool
+
+	wg       sync.WaitGroup
+	exitChan chan int
+	StopChan chan int
+}
+
+// consumerConn is a connection of a hopsConsumer, and the MessageDelegate of
+// the messages it receives
+type consumerConn struct {
+	*hopsConn
+	inFlight int64
+	closing  int32
+}
+
+func newHopsConsumer(topic string, channel string, cfg *nsq.Config) *hopsConsumer {
+	return &hopsConsumer{
+		topic:            topic,
+		channel:          channel,
+		cfg:              cfg,
+		incomingMessages: make(chan hopsMessage),
+		conns:            make(map[string]*consumerConn),
+		exitChan:         make(chan int),
+		StopChan:         make(chan int),
+	}
+}
+
+// AddConcurrentHandlers handles messages with concurrency goroutines, FINing
+// them when handler returns nil, REQing them when it returns an error, unless
+// it disabled the auto response
+func (c *hopsConsumer) AddConcurrentHandlers(handler hopsHandler, concurrency int) {
+	for i := 0; i < concurrency; i++ {
+		go c.handlerLoop(handler)
+	}
+}
+
+func (c *hopsConsumer) handlerLoop(handler hopsHandler) {
+	for m := range c.incomingMessages {
+		if c.cfg.MaxAttempts > 0 && m.msg.Attempts > c.cfg.MaxAttempts {
+			log.Printf("WARNING: msg %s attempted %d times, giving up", m.msg.ID, m.msg.Attempts)
+			m.msg.Finish()
+			continue
+		}
+		err := handler.HandleMessageHops(m.msg, m.hops)
+		if m.msg.IsAutoResponseDisabled() {
+			continue
+		}
+		if err != nil {
+			m.msg.Requeue(-1)
+		} else {
+			m.msg.Finish()
+		}
+	}
+}
+
+// ConnectToNSQDs connects to each of addresses, reconnecting when they close
+func (c *hopsConsumer) ConnectToNSQDs(addresses []string) error {
+	for _, addr := range addresses {
+		c.mtx.Lock()
+		c.nsqdAddrs = append(c.nsqdAddrs, addr)
+		c.mtx.Unlock()
+
+		err := c.connect(addr)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConnectToNSQLookupds connects to the nsqd producing the topic according to
+// nsqlookupd at addresses, polling them for new ones
+func (c *hopsConsumer) ConnectToNSQLookupds(addresses []string) error {
+	if len(addresses) == 0 {
+		return nil
+	}
+	c.mtx.Lock()
+	c.lookupdAddrs = append(c.lookupdAddrs, addresses...)
+	c.mtx.Unlock()
+
+	c.wg.Add(1)
+	go c.lookupdLoop()
+	return nil
+}
+
+func (c *hopsConsumer) lookupdLoop() {
+	defer c.wg.Done()
+
+	client := http_api.NewClient(nil, c.cfg.DialTimeout, c.cfg.ReadTimeout)
+	ticker := time.NewTicker(c.cfg.LookupdPollInterval)
+	defer ticker.Stop()
+	for {
+		c.queryLookupds(client)
+		select {
+		case <-ticker.C:
+		case <-c.exitChan:
+			return
+		}
+	}
+}
+
+// queryLookupds connects to the nsqd producing the topic that it isn't
+// connected to yet
+func (c *hopsConsumer) queryLookupds(client *http_api.Client) {
+	c.mtx.Lock()
+	lookupdAddrs := c.lookupdAddrs
+	c.mtx.Unlock()
+
+	for _, lookupdAddr := range lookupdAddrs {
+		var resp struct {
+			Producers []struct {
+				BroadcastAddress string `json:"broadcast_address"`
+				TCPPort          int    `json:"tcp_port"`
+			} `json:"producers"`
+		}
+		endpoint := fmt.Sprintf("http://%s/lookup?topic=%s", lookupdAddr, url.QueryEscape(c.topic))
+		err := client.GETV1(endpoint, &resp)
+		if err != nil {
+			log.Printf("ERROR: error querying nsqlookupd (%s) - %s", endpoint, err)
+			continue
+		}
+		for _, p := range resp.Producers {
+			addr := net.JoinHostPort(p.BroadcastAddress, strconv.Itoa(p.TCPPort))
+			c.mtx.Lock()
+			_, ok := c.conns[addr]
+			c.mtx.Unlock()
+			if ok {
+				continue
+			}
+			err := c.connect(addr)
+			if err != nil {
+				log.Printf("ERROR: (%s) error connecting to nsqd - %s", addr, err)
+			}
+		}
+	}
+}
+
+// connect connects and subscribes to nsqd at addr
+func (c *hopsConsumer) connect(addr string) error {
+	hc, resp, err := dialHops(addr, c.cfg, map[string]interface{}{"msg_envelope": msgEnvelopeV3})
+	if err != nil {
+		return err
+	}
+	if resp.MsgEnvelope != msgEnvelopeV3 {
+		hc.Close()
+		return fmt.Errorf("nsqd %s doesn't support msg_envelope %d, required by --forward-hops", addr, msgEnvelopeV3)
+	}
+	_, err = hc.command(nsq.Subscribe(c.topic, c.channel))
+	if err != nil {
+		hc.Close()
+		return fmt.Errorf("SUB failed - %s", err)
+	}
+
+	conn := &consumerConn{hopsConn: hc}
+	c.mtx.Lock()
+	if c.stopping {
+		c.mtx.Unlock()
+		conn.Close()
+		return nil
+	}
+	c.conns[addr] = conn
+	c.wg.Add(1)
+	c.mtx.Unlock()
+
+	log.Printf("INFO: (%s) connected to nsqd", addr)
+	go c.readLoop(conn)
+	c.updateRDY()
+	return nil
+}
+
+// updateRDY spreads MaxInFlight over the connections
+func (c *hopsConsumer) updateRDY() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.stopping || len(c.conns) == 0 {
+		return
+	}
+	count := c.cfg.MaxInFlight / len(c.conns)
+	if count < 1 {
+		count = 1
+	}
+	for _, conn := range c.conns {
+		err := conn.write(nsq.Ready(count))
+		if err != nil {
+			log.Printf("ERROR: (%s) error sending RDY %d - %s", conn.addr, count, err)
+		}
+	}
+}
+
+func (c *hopsConsumer) readLoop(conn *consumerConn) {
+	defer c.wg.Done()
+
+	for {
+		frameType, data, err := conn.read()
+		if err != nil {
+			if atomic.LoadInt32(&conn.closing) == 0 {
+				log.Printf("ERROR: (%s) IO error - %s", conn.addr, err)
+			}
+			break
+		}
+
+		switch frameType {
+		case nsq.FrameTypeResponse:
+			switch {
+			case bytes.Equal(data, heartbeatBytes):
+				err = conn.write(nsq.Nop())
+			case bytes.Equal(data, closeWaitBytes):
+				atomic.StoreInt32(&conn.closing, 1)
+				if atomic.LoadInt64(&conn.inFlight) == 0 {
+					conn.Close()
+				}
+			}
+		case nsq.FrameTypeError:
+			log.Printf("ERROR: (%s) protocol error - %s", conn.addr, data)
+		case nsq.FrameTypeMessage:
+			var msg *nsq.Message
+			var hops string
+			msg, hops, err = decodeMessageV3(data)
+			if err != nil {
+				break
+			}
+			msg.NSQDAddress = conn.addr
+			msg.Delegate = conn
+			atomic.AddInt64(&conn.inFlight, 1)
+			c.incomingMessages <- hopsMessage{msg, hops}
+		}
+		if err != nil {
+			log.Printf("ERROR: (%s) %s", conn.addr, err)
+			break
+		}
+	}
+	conn.Close()
+
+	c.mtx.Lock()
+	if c.conns[conn.addr] == conn {
+		delete(c.conns, conn.addr)
+	}
+	var reconnect bool
+	for _, addr := range c.nsqdAddrs {
+		reconnect = reconnect || (addr == conn.addr && !c.stopping)
+	}
+	if reconnect {
+		c.wg.Add(1)
+	}
+	c.mtx.Unlock()
+
+	if reconnect {
+		go c.reconnect(conn.addr)
+	}
+	c.updateRDY()
+}
+
+// reconnect connects to the nsqd at addr given to ConnectToNSQDs again, once
+// it's available
+func (c *hopsConsumer) reconnect(addr string) {
+	defer c.wg.Done()
+
+	for {
+		select {
+		case <-time.After(c.cfg.LookupdPollInterval):
+		case <-c.exitChan:
+			return
+		}
+		err := c.connect(addr)
+		if err == nil {
+			return
+		}
+		log.Printf("ERROR: (%s) error connecting to nsqd - %s", addr, err)
+	}
+}
+
+// Stop closes the connections once their messages in flight have been
+// responded to, closing StopChan once they are
+func (c *hopsConsumer) Stop() {
+	c.mtx.Lock()
+	if c.stopping {
+		c.mtx.Unlock()
+		return
+	}
+	c.stopping = true
+	close(c.exitChan)
+	for _, conn := range c.conns {
+		err := conn.write(nsq.StartClose())
+		if err != nil {
+			conn.Close()
+		}
+	}
+	c.mtx.Unlock()
+
+	go func() {
+		c.wg.Wait()
+		close(c.StopChan)
+	}()
+}
+
+func (c *consumerConn) respond(cmd *nsq.Command) {
+	err := c.write(cmd)
+	if err != nil {
+		log.Printf("ERROR: (%s) error sending %s - %s", c.addr, cmd, err)
+	}
+	if atomic.AddInt64(&c.inFlight, -1) == 0 && atomic.LoadInt32(&c.closing) == 1 {
+		c.Close()
+	}
+}
+
+func (c *consumerConn) OnFinish(m *nsq.Message) {
+	c.respond(nsq.Finish(m.ID))
+}
+
+func (c *consumerConn) OnRequeue(m *nsq.Message, delay time.Duration, backoff bool) {
+	if delay == -1 {
+		delay = c.cfg.DefaultRequeueDelay * time.Duration(m.Attempts)
+		if delay > c.cfg.MaxRequeueDelay {
+			delay = c.cfg.MaxRequeueDelay
+		}
+	}
+	c.respond(nsq.Requeue(m.ID, delay))
+}
+
+func (c *consumerConn) OnTouch(m *nsq.Message) {
+	err := c.write(nsq.Touch(m.ID))
+	if err != nil {
+		log.Printf("ERROR: (%s) error sending TOUCH - %s", c.addr, err)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/nsqio/nsq/internal/test"
+	"github.com/nsqio/nsq/nsqd"
+)
+
+func TestDecodeMessageV3(t *testing.T) {
+	var id nsqd.MessageID
+	copy(id[:], "0123456789abcdef")
+
+	tests := []struct {
+		name           string
+		producer       string
+		eventTimestamp int64
+		hops           string
+	}{
+		{"plain", "", 0, ""},
+		{"producer", "127.0.0.1:1234", 0, ""},
+		{"hops", "127.0.0.1:1234", 0, "10.0.0.1:5678@a/10.0.0.2:4150"},
+		{"event timestamp and hops", "127.0.0.1:1234", 1546423200000000000, "p@a/h:4150,q@b/i:4150"},
+	}
+	for _, tt := range tests {
+		m := nsqd.NewMessage(id, []byte("body"))
+		m.Producer = tt.producer
+		m.EventTimestamp = tt.eventTimestamp
+		m.Hops = tt.hops
+		m.Attempts = 3
+		var buf bytes.Buffer
+		_, err := m.WriteToV3(&buf)
+		test.Nil(t, err)
+
+		msg, hops, err := decodeMessageV3(buf.Bytes())
+		if err != nil {
+			t.Fatalf("%s: decodeMessageV3() failed - %s", tt.name, err)
+		}
+		if msg.ID != nsq.MessageID(id) || msg.Attempts != 3 || msg.Timestamp != m.Timestamp ||
+			string(msg.Body) != "body" || hops != tt.hops {
+			t.Errorf("%s: decodeMessageV3() = %+v, %q", tt.name, msg, hops)
+		}
+
+		// truncated before the body
+		_, _, err = decodeMessageV3(buf.Bytes()[:buf.Len()-len("body")-1])
+		if err == nil {
+			t.Errorf("%s: decodeMessageV3() of a truncated message didn't fail", tt.name)
+		}
+	}
+
+	_, _, err := decodeMessageV3(make([]byte, 31))
+	test.NotNil(t, err)
+}
+
+func TestAppendHops(t *testing.T) {
+	test.Equal(t, []byte("\x00\x00body"), appendHops("", []byte("body")))
+	test.Equal(t, []byte("\x00\x03a,bbody"), appendHops("a,b", []byte("body")))
+}
+
+func startNSQD(t *testing.T, clusterName string) (*nsqd.NSQD, *nsqd.Options) {
+	opts := nsqd.NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.TCPAddress = "127.0.0.1:0"
+	opts.HTTPAddress = "127.0.0.1:0"
+	opts.HTTPSAddress = "127.0.0.1:0"
+	opts.BroadcastAddress = "127.0.0.1"
+	opts.RecordHops = true
+	opts.ClusterName = clusterName
+	tmpDir, err := ioutil.TempDir("", "nsq-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.DataPath = tmpDir
+	n, err := nsqd.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		err := n.Main()
+		if err != nil {
+			panic(err)
+		}
+	}()
+	return n, opts
+}
+
+// startForwarder runs nsq_to_nsq --forward-hops from topic on src to dst
+func startForwarder(t *testing.T, src string, dst string, topic string) *hopsConsumer {
+	cfg := nsq.NewConfig()
+	ph := newPublishHandler([]string{dst}, map[string]producer{dst: newHopsProducer(dst, cfg)}, ModeRoundRobin, "")
+	go ph.responder()
+	th := &TopicHandler{
+		filter:      &MessageFilter{},
+		targets:     []routeTarget{{publishHandler: ph, destinationTopic: topic}},
+		forwardHops: true,
+	}
+	c := newHopsConsumer(topic, "nsq_to_nsq", cfg)
+	c.AddConcurrentHandlers(th, 1)
+	err := c.ConnectToNSQDs([]string{src})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+type hopsRecorder chan string
+
+func (r hopsRecorder) HandleMessageHops(m *nsq.Message, hops string) error {
+	r <- hops
+	return nil
+}
+
+func publish(t *testing.T, addr string, topic string, body string) {
+	p, err := nsq.NewProducer(addr, nsq.NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+	err = p.Publish(topic, []byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func topicStats(n *nsqd.NSQD, topic string) nsqd.TopicStats {
+	stats := n.GetStats(topic, "", false)
+	if len(stats) == 0 {
+		return nsqd.TopicStats{}
+	}
+	return stats[0]
+}
+
+func TestForwardHops(t *testing.T) {
+	a, aOpts := startNSQD(t, "a")
+	defer os.RemoveAll(aOpts.DataPath)
+	defer a.Exit()
+	b, bOpts := startNSQD(t, "b")
+	defer os.RemoveAll(bOpts.DataPath)
+	defer b.Exit()
+	aAddr := a.RealTCPAddr().String()
+	bAddr := b.RealTCPAddr().String()
+
+	forwarder := startForwarder(t, aAddr, bAddr, "test")
+	defer forwarder.Stop()
+
+	recorder := make(hopsRecorder, 1)
+	c := newHopsConsumer("test", "ch", nsq.NewConfig())
+	c.AddConcurrentHandlers(recorder, 1)
+	err := c.ConnectToNSQDs([]string{bAddr})
+	test.Nil(t, err)
+	defer c.Stop()
+
+	publish(t, aAddr, "test", "provenance")
+
+	// the message keeps the hop of its publish to a after its republish to b
+	select {
+	case hops := <-recorder:
+		h := strings.Split(hops, ",")
+		if len(h) != 2 || !strings.HasSuffix(h[0], "@a/"+aAddr) || !strings.HasSuffix(h[1], "@b/"+bAddr) {
+			t.Errorf("hops = %q, want the publisher to a then nsq_to_nsq to b", hops)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the message on b")
+	}
+}
+
+func TestForwardHopsLoop(t *testing.T) {
+	a, aOpts := startNSQD(t, "a")
+	defer os.RemoveAll(aOpts.DataPath)
+	defer a.Exit()
+	b, bOpts := startNSQD(t, "b")
+	defer os.RemoveAll(bOpts.DataPath)
+	defer b.Exit()
+	aAddr := a.RealTCPAddr().String()
+	bAddr := b.RealTCPAddr().String()
+
+	// nsq_to_nsq both ways between the clusters
+	aToB := startForwarder(t, aAddr, bAddr, "test")
+	defer aToB.Stop()
+	bToA := startForwarder(t, bAddr, aAddr, "test")
+	defer bToA.Stop()
+
+	publish(t, aAddr, "test", "loop")
+
+	// a drops the message forwarded back to it
+	deadline := time.Now().Add(5 * time.Second)
+	for topicStats(a, "test").LoopDropCount == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for a to drop the message")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	test.Equal(t, uint64(1), topicStats(a, "test").MessageCount)
+	test.Equal(t, uint64(1), topicStats(a, "test").LoopDropCount)
+	test.Equal(t, uint64(1), topicStats(b, "test").MessageCount)
+}
+
+func TestCheckRouteLoopsLookupd(t *testing.T) {
+	lookupd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/nodes" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"producers":[{"broadcast_address":"10.0.0.1","tcp_port":4150}]}`))
+	}))
+	defer lookupd.Close()
+
+	nodes, err := lookupdNodes([]string{strings.TrimPrefix(lookupd.URL, "http://")})
+	test.Nil(t, err)
+	test.Equal(t, []string{"10.0.0.1:4150"}, nodes)
+
+	routes := []Route{{
+		Topic:                       "test",
+		Channel:                     "nsq_to_nsq",
+		DestinationTopics:           []string{"test"},
+		DestinationNSQDTCPAddresses: []string{"10.0.0.1:4150"},
+	}}
+	test.NotNil(t, checkRouteLoops(routes, nodes))
+	test.Nil(t, checkRouteLoops(routes, []string{"10.0.0.2:4150"}))
+}
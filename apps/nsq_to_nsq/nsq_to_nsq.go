@@ -4,14 +4,18 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"math/rand"
 	"os"
 	"os/signal"
+	"regexp"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -44,8 +48,21 @@ var (
 	whitelistJSONFields = app.StringArray{}
 	topics              = app.StringArray{}
 
+	forwardHops = flag.Bool("forward-hops", false, "republish messages with the hops they were published with, so that nsqd records their whole path and drops those forwarded back to a cluster they already transited (requires nsqd --record-hops)")
+
+	routesFile = flag.String("routes", "", "path to a TOML file of [[route]] tables, each with a topic, channel, destination_topics and destination_nsqd_tcp_addresses, instead of --topic")
+
 	requireJSONField = flag.String("require-json-field", "", "for JSON messages: only pass messages that contain this field")
 	requireJSONValue = flag.String("require-json-value", "", "for JSON messages: only pass messages in which the required field has this value")
+
+	matchRegex   = flag.String("match-regex", "", "only pass messages matching this regular expression")
+	excludeRegex = flag.String("exclude-regex", "", "drop messages matching this regular expression")
+	sample       = flag.Float64("sample", 1.0, "fraction of messages to pass (float b/w 0 -> 1)")
+
+	matchJSON        = app.StringArray{}
+	dropJSONFields   = app.StringArray{}
+	renameJSONFields = app.StringArray{}
+	topicMap         = app.StringArray{}
 )
 
 func init() {
@@ -54,6 +71,10 @@ func init() {
 	flag.Var(&lookupdHTTPAddrs, "lookupd-http-address", "lookupd HTTP address (may be given multiple times)")
 	flag.Var(&topics, "topic", "nsq topic (may be given multiple times)")
 	flag.Var(&whitelistJSONFields, "whitelist-json-field", "for JSON messages: pass this field (may be given multiple times)")
+	flag.Var(&matchJSON, "match-json", "for JSON messages: only pass messages in which field (or nested.field) has value, as field=value (may be given multiple times, all must match)")
+	flag.Var(&dropJSONFields, "drop-json-field", "for JSON messages: remove this field (or nested.field) (may be given multiple times)")
+	flag.Var(&renameJSONFields, "rename-json-field", "for JSON messages: move field (or nested.field) to another, as old=new (may be given multiple times)")
+	flag.Var(&topicMap, "topic-map", "publish messages consumed from a topic to another, as source=destination, instead of --destination-topic (may be given multiple times)")
 }
 
 type PublishHandler struct {
@@ -61,26 +82,78 @@ type PublishHandler struct {
 	counter uint64
 
 	addresses app.StringArray
-	producers map[string]*nsq.Producer
+	producers map[string]producer
 	mode      int
 	hostPool  hostpool.HostPool
 	respChan  chan *nsq.ProducerTransaction
 
+	perAddressStatus map[string]*timer_metrics.TimerMetrics
+	timermetrics     *timer_metrics.TimerMetrics
+}
+
+// producer publishes asynchronously, nsq.Producer or hopsProducer with
+// --forward-hops
+type producer interface {
+	PublishAsync(topic string, body []byte, doneChan chan *nsq.ProducerTransaction, args ...interface{}) error
+}
+
+// consumer is nsq.Consumer or hopsConsumer with --forward-hops
+type consumer interface {
+	ConnectToNSQDs(addresses []string) error
+	ConnectToNSQLookupds(addresses []string) error
+	Stop()
+}
+
+// MessageFilter applies the filtering and transformation flags
+type MessageFilter struct {
+	matches  []jsonMatch
+	include  *regexp.Regexp
+	exclude  *regexp.Regexp
+	drops    [][]string
+	renames  []jsonRename
+	needJSON bool
+
 	requireJSONValueParsed   bool
 	requireJSONValueIsNumber bool
 	requireJSONNumber        float64
-
-	perAddressStatus map[string]*timer_metrics.TimerMetrics
-	timermetrics     *timer_metrics.TimerMetrics
 }
 
+// TopicHandler publishes the messages of a consumer to each of its targets
 type TopicHandler struct {
+	filter      *MessageFilter
+	targets     []routeTarget
+	forwardHops bool
+}
+
+type routeTarget struct {
 	publishHandler   *PublishHandler
 	destinationTopic string
 }
 
+// delivery tracks a message published to several targets, FINing it once all
+// have succeeded or REQing it if any failed
+type delivery struct {
+	msg     *nsq.Message
+	pending int32
+	failed  int32
+}
+
+func (d *delivery) done(success bool) {
+	if !success {
+		atomic.StoreInt32(&d.failed, 1)
+	}
+	if atomic.AddInt32(&d.pending, -1) > 0 {
+		return
+	}
+	if atomic.LoadInt32(&d.failed) == 0 {
+		d.msg.Finish()
+	} else {
+		d.msg.Requeue(-1)
+	}
+}
+
 func (ph *PublishHandler) responder() {
-	var msg *nsq.Message
+	var d *delivery
 	var startTime time.Time
 	var address string
 	var hostPoolResponse hostpool.HostPoolResponse
@@ -88,12 +161,12 @@ func (ph *PublishHandler) responder() {
 	for t := range ph.respChan {
 		switch ph.mode {
 		case ModeRoundRobin:
-			msg = t.Args[0].(*nsq.Message)
+			d = t.Args[0].(*delivery)
 			startTime = t.Args[1].(time.Time)
 			hostPoolResponse = nil
 			address = t.Args[2].(string)
 		case ModeHostPool:
-			msg = t.Args[0].(*nsq.Message)
+			d = t.Args[0].(*delivery)
 			startTime = t.Args[1].(time.Time)
 			hostPoolResponse = t.Args[2].(hostpool.HostPoolResponse)
 			address = hostPoolResponse.Host()
@@ -109,31 +182,27 @@ func (ph *PublishHandler) responder() {
 			}
 		}
 
-		if success {
-			msg.Finish()
-		} else {
-			msg.Requeue(-1)
-		}
+		d.done(success)
 
 		ph.perAddressStatus[address].Status(startTime)
 		ph.timermetrics.Status(startTime)
 	}
 }
 
-func (ph *PublishHandler) shouldPassMessage(js map[string]interface{}) (bool, bool) {
+func (f *MessageFilter) shouldPassMessage(js map[string]interface{}) (bool, bool) {
 	pass := true
 	backoff := false
 
 	if *requireJSONField == "" {
-		return pass, backoff
+		return f.matchesJSON(js), backoff
 	}
 
-	if *requireJSONValue != "" && !ph.requireJSONValueParsed {
+	if *requireJSONValue != "" && !f.requireJSONValueParsed {
 		// cache conversion in case needed while filtering json
 		var err error
-		ph.requireJSONNumber, err = strconv.ParseFloat(*requireJSONValue, 64)
-		ph.requireJSONValueIsNumber = (err == nil)
-		ph.requireJSONValueParsed = true
+		f.requireJSONNumber, err = strconv.ParseFloat(*requireJSONValue, 64)
+		f.requireJSONValueIsNumber = (err == nil)
+		f.requireJSONValueParsed = true
 	}
 
 	v, ok := js[*requireJSONField]
@@ -150,9 +219,11 @@ func (ph *PublishHandler) shouldPassMessage(js map[string]interface{}) (bool, bo
 			if s != *requireJSONValue {
 				pass = false
 			}
-		} else if ph.requireJSONValueIsNumber {
-			f, ok := v.(float64)
-			if !ok || f != ph.requireJSONNumber {
+		} else if f.requireJSONValueIsNumber {
+			n, ok := v.(json.Number)
+			if !ok {
+				pass = false
+			} else if v, err := n.Float64(); err != nil || v != f.requireJSONNumber {
 				pass = false
 			}
 		} else {
@@ -162,34 +233,44 @@ func (ph *PublishHandler) shouldPassMessage(js map[string]interface{}) (bool, bo
 		}
 	}
 
-	return pass, backoff
+	return pass && f.matchesJSON(js), backoff
+}
+
+// matchesJSON reports whether js matches all --match-json values
+func (f *MessageFilter) matchesJSON(js map[string]interface{}) bool {
+	for _, m := range f.matches {
+		if v, ok := getJSONPath(js, m.path); !ok || jsonString(v) != m.value {
+			return false
+		}
+	}
+	return true
 }
 
-func filterMessage(js map[string]interface{}, rawMsg []byte) ([]byte, error) {
-	if len(whitelistJSONFields) == 0 {
+func (f *MessageFilter) filterMessage(js map[string]interface{}, rawMsg []byte) ([]byte, error) {
+	if len(whitelistJSONFields) == 0 && len(f.drops) == 0 && len(f.renames) == 0 {
 		// no change
 		return rawMsg, nil
 	}
 
-	newMsg := make(map[string]interface{}, len(whitelistJSONFields))
-
-	for _, key := range whitelistJSONFields {
-		value, ok := js[key]
-		if ok {
-			// avoid printing int as float (go 1.0)
-			switch tvalue := value.(type) {
-			case float64:
-				ivalue := int64(tvalue)
-				if float64(ivalue) == tvalue {
-					newMsg[key] = ivalue
-				} else {
-					newMsg[key] = tvalue
-				}
-			default:
+	newMsg := js
+	if len(whitelistJSONFields) > 0 {
+		newMsg = make(map[string]interface{}, len(whitelistJSONFields))
+		for _, key := range whitelistJSONFields {
+			value, ok := js[key]
+			if ok {
+				// numbers are decoded as json.Number, and so printed unchanged
 				newMsg[key] = value
 			}
 		}
 	}
+	for _, path := range f.drops {
+		deleteJSONPath(newMsg, path)
+	}
+	for _, r := range f.renames {
+		if v, ok := deleteJSONPath(newMsg, r.from); ok {
+			setJSONPath(newMsg, r.to, v)
+		}
+	}
 
 	newRawMsg, err := json.Marshal(newMsg)
 	if err != nil {
@@ -199,36 +280,79 @@ func filterMessage(js map[string]interface{}, rawMsg []byte) ([]byte, error) {
 }
 
 func (t *TopicHandler) HandleMessage(m *nsq.Message) error {
-	return t.publishHandler.HandleMessage(m, t.destinationTopic)
+	return t.HandleMessageHops(m, "")
 }
 
-func (ph *PublishHandler) HandleMessage(m *nsq.Message, destinationTopic string) error {
+// HandleMessageHops publishes m, which was published with hops, with
+// --forward-hops
+func (t *TopicHandler) HandleMessageHops(m *nsq.Message, hops string) error {
+	msgBody, pass, err := t.filter.Filter(m)
+	if err != nil || !pass {
+		return err
+	}
+	if t.forwardHops {
+		msgBody = appendHops(hops, msgBody)
+	}
+
+	d := &delivery{msg: m, pending: int32(len(t.targets))}
+	m.DisableAutoResponse()
+	for _, target := range t.targets {
+		err := target.publishHandler.Publish(d, msgBody, target.destinationTopic)
+		if err != nil {
+			log.Printf("ERROR: failed to publish to %s - %s", target.destinationTopic, err)
+			d.done(false)
+		}
+	}
+	return nil
+}
+
+// Filter returns the body to publish for m, or false if it should be dropped
+func (f *MessageFilter) Filter(m *nsq.Message) ([]byte, bool, error) {
 	var err error
 	msgBody := m.Body
 
-	if *requireJSONField != "" || len(whitelistJSONFields) > 0 {
+	if *sample < 1.0 && rand.Float64() > *sample {
+		return nil, false, nil
+	}
+	if f.include != nil && !f.include.Match(msgBody) {
+		return nil, false, nil
+	}
+	if f.exclude != nil && f.exclude.Match(msgBody) {
+		return nil, false, nil
+	}
+
+	if f.needJSON {
 		var js map[string]interface{}
-		err = json.Unmarshal(msgBody, &js)
+		d := json.NewDecoder(bytes.NewReader(msgBody))
+		d.UseNumber()
+		err = d.Decode(&js)
 		if err != nil {
 			log.Printf("ERROR: Unable to decode json: %s", msgBody)
-			return nil
+			return nil, false, nil
 		}
 
-		if pass, backoff := ph.shouldPassMessage(js); !pass {
+		if pass, backoff := f.shouldPassMessage(js); !pass {
 			if backoff {
-				return errors.New("backoff")
+				return nil, false, errors.New("backoff")
 			}
-			return nil
+			return nil, false, nil
 		}
 
-		msgBody, err = filterMessage(js, msgBody)
+		msgBody, err = f.filterMessage(js, msgBody)
 
 		if err != nil {
 			log.Printf("ERROR: filterMessage() failed: %s", err)
-			return err
+			return nil, false, err
 		}
 	}
 
+	return msgBody, true, nil
+}
+
+// Publish publishes msgBody to destinationTopic asynchronously, the responder
+// calls d.done with the result
+func (ph *PublishHandler) Publish(d *delivery, msgBody []byte, destinationTopic string) error {
+	var err error
 	startTime := time.Now()
 
 	switch ph.mode {
@@ -237,21 +361,44 @@ func (ph *PublishHandler) HandleMessage(m *nsq.Message, destinationTopic string)
 		idx := counter % uint64(len(ph.addresses))
 		addr := ph.addresses[idx]
 		p := ph.producers[addr]
-		err = p.PublishAsync(destinationTopic, msgBody, ph.respChan, m, startTime, addr)
+		err = p.PublishAsync(destinationTopic, msgBody, ph.respChan, d, startTime, addr)
 	case ModeHostPool:
 		hostPoolResponse := ph.hostPool.Get()
 		p := ph.producers[hostPoolResponse.Host()]
-		err = p.PublishAsync(destinationTopic, msgBody, ph.respChan, m, startTime, hostPoolResponse)
+		err = p.PublishAsync(destinationTopic, msgBody, ph.respChan, d, startTime, hostPoolResponse)
 		if err != nil {
 			hostPoolResponse.Mark(err)
 		}
 	}
+	return err
+}
 
-	if err != nil {
-		return err
+func newPublishHandler(addresses []string, producers map[string]producer, selectedMode int, statusPrefix string) *PublishHandler {
+	perAddressStatus := make(map[string]*timer_metrics.TimerMetrics)
+	if len(addresses) == 1 {
+		// disable since there is only one address
+		perAddressStatus[addresses[0]] = timer_metrics.NewTimerMetrics(0, "")
+	} else {
+		for _, a := range addresses {
+			perAddressStatus[a] = timer_metrics.NewTimerMetrics(*statusEvery,
+				fmt.Sprintf("[%s]:", a))
+		}
+	}
+
+	hostPool := hostpool.New(addresses)
+	if *mode == "epsilon-greedy" {
+		hostPool = hostpool.NewEpsilonGreedy(addresses, 0, &hostpool.LinearEpsilonValueCalculator{})
+	}
+
+	return &PublishHandler{
+		addresses:        addresses,
+		producers:        producers,
+		mode:             selectedMode,
+		hostPool:         hostPool,
+		respChan:         make(chan *nsq.ProducerTransaction, len(addresses)),
+		perAddressStatus: perAddressStatus,
+		timermetrics:     timer_metrics.NewTimerMetrics(*statusEvery, statusPrefix),
 	}
-	m.DisableAutoResponse()
-	return nil
 }
 
 func hasArg(s string) bool {
@@ -280,8 +427,14 @@ func main() {
 		return
 	}
 
-	if len(topics) == 0 || *channel == "" {
-		log.Fatal("--topic and --channel are required")
+	if (len(topics) == 0 && *routesFile == "") || *channel == "" {
+		log.Fatal("--topic (or --routes) and --channel are required")
+	}
+	if len(topics) > 0 && *routesFile != "" {
+		log.Fatal("use --topic or --routes not both")
+	}
+	if *routesFile != "" && (*destTopic != "" || len(topicMap) > 0) {
+		log.Fatal("--destination-topic and --topic-map can't be used with --routes, set destination_topics")
 	}
 
 	for _, topic := range topics {
@@ -305,10 +458,55 @@ func main() {
 		log.Fatal("use --nsqd-tcp-address or --lookupd-http-address not both")
 	}
 
-	if len(destNsqdTCPAddrs) == 0 {
+	if len(destNsqdTCPAddrs) == 0 && *routesFile == "" {
 		log.Fatal("--destination-nsqd-tcp-address required")
 	}
 
+	if *forwardHops {
+		for _, cfg := range []*nsq.Config{cCfg, pCfg} {
+			if cfg.TlsV1 || cfg.Deflate || cfg.Snappy || cfg.AuthSecret != "" {
+				log.Fatal("--forward-hops doesn't support the tls_v1, deflate, snappy and auth_secret options")
+			}
+		}
+	}
+
+	if *sample > 1.0 || *sample < 0.0 {
+		log.Fatal("--sample must be between 0.0 and 1.0")
+	}
+
+	var include, exclude *regexp.Regexp
+	if *matchRegex != "" {
+		var err error
+		include, err = regexp.Compile(*matchRegex)
+		if err != nil {
+			log.Fatalf("--match-regex is invalid - %s", err)
+		}
+	}
+	if *excludeRegex != "" {
+		var err error
+		exclude, err = regexp.Compile(*excludeRegex)
+		if err != nil {
+			log.Fatalf("--exclude-regex is invalid - %s", err)
+		}
+	}
+
+	matches, err := parseJSONMatches(matchJSON)
+	if err != nil {
+		log.Fatal(err)
+	}
+	renames, err := parseJSONRenames(renameJSONFields)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var drops [][]string
+	for _, field := range dropJSONFields {
+		drops = append(drops, strings.Split(field, "."))
+	}
+	destinations, err := parseTopicMap(topicMap)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	switch *mode {
 	case "round-robin":
 		selectedMode = ModeRoundRobin
@@ -325,62 +523,137 @@ func main() {
 	cCfg.MaxInFlight = *maxInFlight
 	pCfg.UserAgent = defaultUA
 
-	producers := make(map[string]*nsq.Producer)
-	for _, addr := range destNsqdTCPAddrs {
-		producer, err := nsq.NewProducer(addr, pCfg)
+	var routes []Route
+	if *routesFile != "" {
+		routes, err = loadRoutes(*routesFile, *channel, destNsqdTCPAddrs)
 		if err != nil {
-			log.Fatalf("failed creating producer %s", err)
+			log.Fatalf("failed to load --routes - %s", err)
+		}
+	} else {
+		for _, topic := range topics {
+			publishTopic := topic
+			if *destTopic != "" {
+				publishTopic = *destTopic
+			}
+			if dst, ok := destinations[topic]; ok {
+				publishTopic = dst
+			}
+			routes = append(routes, Route{
+				Topic:                       topic,
+				Channel:                     *channel,
+				DestinationTopics:           []string{publishTopic},
+				DestinationNSQDTCPAddresses: destNsqdTCPAddrs,
+			})
 		}
-		producers[addr] = producer
 	}
 
-	perAddressStatus := make(map[string]*timer_metrics.TimerMetrics)
-	if len(destNsqdTCPAddrs) == 1 {
-		// disable since there is only one address
-		perAddressStatus[destNsqdTCPAddrs[0]] = timer_metrics.NewTimerMetrics(0, "")
-	} else {
-		for _, a := range destNsqdTCPAddrs {
-			perAddressStatus[a] = timer_metrics.NewTimerMetrics(*statusEvery,
-				fmt.Sprintf("[%s]:", a))
+	sourceAddrs := nsqdTCPAddrs
+	if len(lookupdHTTPAddrs) > 0 {
+		sourceAddrs, err = lookupdNodes(lookupdHTTPAddrs)
+		if err != nil {
+			log.Printf("WARNING: can't check --routes for loops - %s", err)
 		}
 	}
+	err = checkRouteLoops(routes, sourceAddrs)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	hostPool := hostpool.New(destNsqdTCPAddrs)
-	if *mode == "epsilon-greedy" {
-		hostPool = hostpool.NewEpsilonGreedy(destNsqdTCPAddrs, 0, &hostpool.LinearEpsilonValueCalculator{})
+	needJSON := *requireJSONField != "" || len(whitelistJSONFields) > 0 ||
+		len(matches) > 0 || len(drops) > 0 || len(renames) > 0
+	filter := &MessageFilter{
+		matches:  matches,
+		include:  include,
+		exclude:  exclude,
+		drops:    drops,
+		renames:  renames,
+		needJSON: needJSON,
 	}
 
-	var consumerList []*nsq.Consumer
+	// a PublishHandler per set of destination nsqd, sharing producers
+	clusters := make(map[string]bool)
+	for _, r := range routes {
+		clusters[strings.Join(r.DestinationNSQDTCPAddresses, ",")] = true
+	}
+	producers := make(map[string]producer)
+	publishers := make(map[string]*PublishHandler)
+	for _, r := range routes {
+		key := strings.Join(r.DestinationNSQDTCPAddresses, ",")
+		if _, ok := publishers[key]; ok {
+			continue
+		}
+		for _, addr := range r.DestinationNSQDTCPAddresses {
+			if _, ok := producers[addr]; ok {
+				continue
+			}
+			if *forwardHops {
+				producers[addr] = newHopsProducer(addr, pCfg)
+				continue
+			}
+			producer, err := nsq.NewProducer(addr, pCfg)
+			if err != nil {
+				log.Fatalf("failed creating producer %s", err)
+			}
+			producers[addr] = producer
+		}
+		statusPrefix := "[aggregate]:"
+		if len(clusters) > 1 {
+			statusPrefix = fmt.Sprintf("[aggregate %s]:", key)
+		}
+		publishers[key] = newPublishHandler(r.DestinationNSQDTCPAddresses, producers, selectedMode, statusPrefix)
+	}
 
-	publisher := &PublishHandler{
-		addresses:        destNsqdTCPAddrs,
-		producers:        producers,
-		mode:             selectedMode,
-		hostPool:         hostPool,
-		respChan:         make(chan *nsq.ProducerTransaction, len(destNsqdTCPAddrs)),
-		perAddressStatus: perAddressStatus,
-		timermetrics:     timer_metrics.NewTimerMetrics(*statusEvery, "[aggregate]:"),
+	// a consumer per topic and channel, publishing to the targets of all
+	// its routes
+	var topicHandlers []*TopicHandler
+	var topicChannels [][2]string
+	for _, r := range routes {
+		var th *TopicHandler
+		for i, tc := range topicChannels {
+			if tc == [2]string{r.Topic, r.Channel} {
+				th = topicHandlers[i]
+			}
+		}
+		if th == nil {
+			th = &TopicHandler{filter: filter, forwardHops: *forwardHops}
+			topicHandlers = append(topicHandlers, th)
+			topicChannels = append(topicChannels, [2]string{r.Topic, r.Channel})
+		}
+		for _, topic := range r.DestinationTopics {
+			th.targets = append(th.targets, routeTarget{
+				publishHandler:   publishers[strings.Join(r.DestinationNSQDTCPAddresses, ",")],
+				destinationTopic: topic,
+			})
+		}
 	}
 
-	for _, topic := range topics {
-		consumer, err := nsq.NewConsumer(topic, *channel, cCfg)
-		consumerList = append(consumerList, consumer)
-		if err != nil {
-			log.Fatal(err)
+	var consumerList []consumer
+	var stopChans []chan int
+	for i, th := range topicHandlers {
+		concurrency := 0
+		for _, target := range th.targets {
+			concurrency += len(target.publishHandler.addresses)
 		}
 
-		publishTopic := topic
-		if *destTopic != "" {
-			publishTopic = *destTopic
+		if *forwardHops {
+			c := newHopsConsumer(topicChannels[i][0], topicChannels[i][1], cCfg)
+			c.AddConcurrentHandlers(th, concurrency)
+			consumerList = append(consumerList, c)
+			stopChans = append(stopChans, c.StopChan)
+			continue
 		}
-		topicHandler := &TopicHandler{
-			publishHandler:   publisher,
-			destinationTopic: publishTopic,
+		c, err := nsq.NewConsumer(topicChannels[i][0], topicChannels[i][1], cCfg)
+		if err != nil {
+			log.Fatal(err)
 		}
-		consumer.AddConcurrentHandlers(topicHandler, len(destNsqdTCPAddrs))
+		c.AddConcurrentHandlers(th, concurrency)
+		consumerList = append(consumerList, c)
+		stopChans = append(stopChans, c.StopChan)
 	}
-	for i := 0; i < len(destNsqdTCPAddrs); i++ {
-		go publisher.responder()
+	for _, ph := range publishers {
+		for i := 0; i < len(ph.addresses); i++ {
+			go ph.responder()
+		}
 	}
 
 	for _, consumer := range consumerList {
@@ -402,7 +675,7 @@ func main() {
 	for _, consumer := range consumerList {
 		consumer.Stop()
 	}
-	for _, consumer := range consumerList {
-		<-consumer.StopChan
+	for _, stopChan := range stopChans {
+		<-stopChan
 	}
 }
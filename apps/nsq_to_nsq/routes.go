@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nsqio/nsq/internal/http_api"
+	"github.com/nsqio/nsq/internal/protocol"
+)
+
+// Route consumes a topic and publishes its messages to topics on a set of
+// destination nsqd. A --routes file is a list of them:
+//
+//	[[route]]
+//	topic = "events"
+//	destination_topics = ["events", "events_archive"]
+//	destination_nsqd_tcp_addresses = ["10.0.0.1:4150", "10.0.0.2:4150"]
+//
+// channel defaults to --channel, destination_topics to topic and
+// destination_nsqd_tcp_addresses to --destination-nsqd-tcp-address. Routes
+// with the same topic and channel share a consumer, and each message is only
+// FINed once published to all of their destinations.
+type Route struct {
+	Topic                       string   `toml:"topic"`
+	Channel                     string   `toml:"channel"`
+	DestinationTopics           []string `toml:"destination_topics"`
+	DestinationNSQDTCPAddresses []string `toml:"destination_nsqd_tcp_addresses"`
+}
+
+// loadRoutes reads a --routes file, filling in defaults
+func loadRoutes(path string, defaultChannel string, defaultAddrs []string) ([]Route, error) {
+	var cfg struct {
+		Routes []Route `toml:"route"`
+	}
+	md, err := toml.DecodeFile(path, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("unknown route option %q", undecoded[0].String())
+	}
+	if len(cfg.Routes) == 0 {
+		return nil, fmt.Errorf("no [[route]] in %s", path)
+	}
+
+	for i := range cfg.Routes {
+		r := &cfg.Routes[i]
+		if r.Channel == "" {
+			r.Channel = defaultChannel
+		}
+		if len(r.DestinationTopics) == 0 {
+			r.DestinationTopics = []string{r.Topic}
+		}
+		if len(r.DestinationNSQDTCPAddresses) == 0 {
+			r.DestinationNSQDTCPAddresses = defaultAddrs
+		}
+
+		if !protocol.IsValidTopicName(r.Topic) {
+			return nil, fmt.Errorf("route %d: topic %q is invalid", i+1, r.Topic)
+		}
+		if !protocol.IsValidChannelName(r.Channel) {
+			return nil, fmt.Errorf("route %d: channel %q is invalid", i+1, r.Channel)
+		}
+		for _, topic := range r.DestinationTopics {
+			if !protocol.IsValidTopicName(topic) {
+				return nil, fmt.Errorf("route %d: destination topic %q is invalid", i+1, topic)
+			}
+		}
+		if len(r.DestinationNSQDTCPAddresses) == 0 {
+			return nil, fmt.Errorf("route %d: destination_nsqd_tcp_addresses or --destination-nsqd-tcp-address required", i+1)
+		}
+	}
+	return cfg.Routes, nil
+}
+
+// checkRouteLoops returns an error if a route publishes a topic back to itself
+// on one of the nsqd it is consumed from (given, or registered with
+// nsqlookupd), which would forward its messages in a loop. Loops through other
+// clusters (e.g. nsq_to_nsq both ways between two) aren't caught here, nsqd
+// drops the messages that come back to a cluster when they're forwarded with
+// --forward-hops to nsqd with --record-hops and --cluster-name.
+func checkRouteLoops(routes []Route, sourceAddrs []string) error {
+	for i, r := range routes {
+		for _, topic := range r.DestinationTopics {
+			if topic != r.Topic {
+				continue
+			}
+			for _, addr := range r.DestinationNSQDTCPAddresses {
+				for _, sourceAddr := range sourceAddrs {
+					if addr == sourceAddr {
+						return fmt.Errorf("route %d: publishes topic %q back to %s it is consumed from", i+1, topic, addr)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// lookupdNodes returns the TCP addresses of the nsqd registered with the
+// nsqlookupd at addrs
+func lookupdNodes(addrs []string) ([]string, error) {
+	client := http_api.NewClient(nil, time.Second, 5*time.Second)
+	var nodes []string
+	for _, addr := range addrs {
+		var resp struct {
+			Producers []struct {
+				BroadcastAddress string `json:"broadcast_address"`
+				TCPPort          int    `json:"tcp_port"`
+			} `json:"producers"`
+		}
+		err := client.GETV1(fmt.Sprintf("http://%s/nodes", addr), &resp)
+		if err != nil {
+			return nodes, err
+		}
+		for _, p := range resp.Producers {
+			nodes = append(nodes, net.JoinHostPort(p.BroadcastAddress, strconv.Itoa(p.TCPPort)))
+		}
+	}
+	return nodes, nil
+}
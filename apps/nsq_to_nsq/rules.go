@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/nsqio/nsq/internal/protocol"
+)
+
+// jsonMatch passes messages in which the field at path has value
+type jsonMatch struct {
+	path  []string
+	value string
+}
+
+// jsonRename moves the field at from to to
+type jsonRename struct {
+	from []string
+	to   []string
+}
+
+// splitPair splits "a=b" into a and b, which must not be empty
+func splitPair(flagName string, s string) (string, string, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid --%s value %q, should be a=b", flagName, s)
+	}
+	return parts[0], parts[1], nil
+}
+
+func parseJSONMatches(strs []string) ([]jsonMatch, error) {
+	var matches []jsonMatch
+	for _, s := range strs {
+		// the value may be empty, to match empty strings
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid --match-json value %q, should be field=value", s)
+		}
+		matches = append(matches, jsonMatch{strings.Split(parts[0], "."), parts[1]})
+	}
+	return matches, nil
+}
+
+func parseJSONRenames(strs []string) ([]jsonRename, error) {
+	var renames []jsonRename
+	for _, s := range strs {
+		from, to, err := splitPair("rename-json-field", s)
+		if err != nil {
+			return nil, err
+		}
+		renames = append(renames, jsonRename{strings.Split(from, "."), strings.Split(to, ".")})
+	}
+	return renames, nil
+}
+
+func parseTopicMap(strs []string) (map[string]string, error) {
+	topicMap := make(map[string]string)
+	for _, s := range strs {
+		src, dst, err := splitPair("topic-map", s)
+		if err != nil {
+			return nil, err
+		}
+		if !protocol.IsValidTopicName(src) || !protocol.IsValidTopicName(dst) {
+			return nil, fmt.Errorf("invalid --topic-map value %q, topic names are invalid", s)
+		}
+		topicMap[src] = dst
+	}
+	return topicMap, nil
+}
+
+// getJSONPath returns the value at path in js, which may be nested as a.b.c
+func getJSONPath(js map[string]interface{}, path []string) (interface{}, bool) {
+	var v interface{} = js
+	for _, name := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		v, ok = m[name]
+		if !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// deleteJSONPath removes the value at path in js, returning it
+func deleteJSONPath(js map[string]interface{}, path []string) (interface{}, bool) {
+	parent, ok := getJSONPath(js, path[:len(path)-1])
+	if !ok {
+		return nil, false
+	}
+	m, ok := parent.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	v, ok := m[path[len(path)-1]]
+	delete(m, path[len(path)-1])
+	return v, ok
+}
+
+// setJSONPath sets the value at path in js, replacing anything in the way
+// with objects
+func setJSONPath(js map[string]interface{}, path []string, v interface{}) {
+	m := js
+	for _, name := range path[:len(path)-1] {
+		next, ok := m[name].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			m[name] = next
+		}
+		m = next
+	}
+	m[path[len(path)-1]] = v
+}
+
+// jsonString returns v, decoded with UseNumber, as it's compared to
+// --match-json values: strings are unquoted, anything else is JSON
+func jsonString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
@@ -8,7 +8,6 @@ import (
 	"sync"
 	"syscall"
 
-	"github.com/BurntSushi/toml"
 	"github.com/judwhite/go-svc/svc"
 	"github.com/mreiferson/go-options"
 	"github.com/nsqio/nsq/internal/app"
@@ -20,8 +19,9 @@ import (
 func nsqadminFlagSet(opts *nsqadmin.Options) *flag.FlagSet {
 	flagSet := flag.NewFlagSet("nsqadmin", flag.ExitOnError)
 
-	flagSet.String("config", "", "path to config file")
+	flagSet.String("config", "", "path to config file (or NSQADMIN_CONFIG), options may also be set with NSQADMIN_<FLAG_NAME> environment variables (precedence: flags > environment > config file)")
 	flagSet.Bool("version", false, "print version string")
+	flagSet.Bool("check-config", false, "validate the configuration, print the resolved options and exit (non-zero on problems)")
 
 	logLevel := opts.LogLevel
 	flagSet.Var(&logLevel, "log-level", "set log verbosity: debug, info, warn, error, or fatal")
@@ -29,9 +29,10 @@ func nsqadminFlagSet(opts *nsqadmin.Options) *flag.FlagSet {
 	flagSet.Bool("verbose", false, "[deprecated] has no effect, use --log-level")
 
 	flagSet.String("http-address", opts.HTTPAddress, "<addr>:<port> to listen on for HTTP clients")
+	flagSet.String("bind-family", opts.BindFamily, "network to bind listeners with: tcp (dual-stack), tcp4 or tcp6 (an unspecified listen host, e.g. 0.0.0.0, then stands for all the addresses of the family)")
 	flagSet.String("base-path", opts.BasePath, "URL base path")
 
-	flagSet.String("graphite-url", opts.GraphiteURL, "graphite HTTP address")
+	flagSet.String("graphite-url", opts.GraphiteURL, "graphite HTTP address (may be @/path/to/file, env:NAME or vault:<path>#<key>)")
 	flagSet.Bool("proxy-graphite", false, "proxy HTTP requests to graphite")
 
 	flagSet.String("statsd-counter-format", opts.StatsdCounterFormat, "The counter stats key formatting applied by the implementation of statsd. If no formatting is desired, set this to an empty string.")
@@ -39,7 +40,11 @@ func nsqadminFlagSet(opts *nsqadmin.Options) *flag.FlagSet {
 	flagSet.String("statsd-prefix", opts.StatsdPrefix, "prefix used for keys sent to statsd (%s for host replacement, must match nsqd)")
 	flagSet.Duration("statsd-interval", opts.StatsdInterval, "time interval nsqd is configured to push to statsd (must match nsqd)")
 
-	flagSet.String("notification-http-endpoint", "", "HTTP endpoint (fully qualified) to which POST notifications of admin actions will be sent")
+	flagSet.String("notification-http-endpoint", "", "HTTP endpoint (fully qualified) to which POST notifications of admin actions will be sent (may be @/path/to/file, env:NAME or vault:<path>#<key>)")
+	flagSet.String("notification-http-template", "", "Go text/template of the body POSTed to --notification-http-endpoint, executed with the admin action (default: the action as JSON)")
+	flagSet.String("notification-http-content-type", "", "Content-Type of the body rendered from --notification-http-template (default application/json)")
+	flagSet.String("notification-slack-webhook-url", "", "Slack incoming webhook URL to which admin actions will be posted (may be @/path/to/file, env:NAME or vault:<path>#<key>)")
+	flagSet.String("notification-pagerduty-routing-key", "", "PagerDuty Events API v2 routing key with which info events will be triggered for admin actions (may be @/path/to/file, env:NAME or vault:<path>#<key>)")
 
 	flagSet.Duration("http-client-connect-timeout", opts.HTTPClientConnectTimeout, "timeout for HTTP connect")
 	flagSet.Duration("http-client-request-timeout", opts.HTTPClientRequestTimeout, "timeout for HTTP request")
@@ -49,6 +54,10 @@ func nsqadminFlagSet(opts *nsqadmin.Options) *flag.FlagSet {
 	flagSet.String("http-client-tls-cert", "", "path to certificate file for the HTTP client")
 	flagSet.String("http-client-tls-key", "", "path to key file for the HTTP client")
 
+	flagSet.Int("cluster-info-max-concurrency", opts.ClusterInfoMaxConcurrency, "maximum number of nsqd/nsqlookupd queried at once when building a page")
+	flagSet.Duration("cluster-info-cache-ttl", opts.ClusterInfoCacheTTL, "duration to cache nsqd/nsqlookupd responses for (0 to disable)")
+	flagSet.Duration("topology-refresh-interval", opts.TopologyRefreshInterval, "refresh the topics and nodes in the background this often, instead of querying nsqlookupd/nsqd on each page load (0 to disable)")
+
 	flagSet.String("allow-config-from-cidr", opts.AllowConfigFromCIDR, "A CIDR from which to allow HTTP requests to the /config endpoint")
 	flagSet.String("acl-http-header", opts.AclHttpHeader, "HTTP header to check for authenticated admin users")
 
@@ -95,14 +104,37 @@ func (p *program) Start() error {
 
 	var cfg map[string]interface{}
 	configFile := flagSet.Lookup("config").Value.String()
+	if configFile == "" {
+		configFile = os.Getenv("NSQADMIN_CONFIG")
+	}
 	if configFile != "" {
-		_, err := toml.DecodeFile(configFile, &cfg)
+		c, err := app.LoadConfig(configFile)
 		if err != nil {
 			logFatal("failed to load config file %s - %s", configFile, err)
 		}
+		cfg = c
+	}
+
+	cfg, err := app.EnvConfig("NSQADMIN_", opts, cfg)
+	if err != nil {
+		logFatal("failed to load environment - %s", err)
 	}
 
 	options.Resolve(opts, flagSet, cfg)
+	err = app.ResolveSecrets(opts)
+	if err != nil {
+		logFatal("%s", err)
+	}
+
+	if flagSet.Lookup("check-config").Value.(flag.Getter).Get().(bool) {
+		app.PrintOptions(os.Stdout, opts)
+		err := nsqadmin.ValidateOptions(opts)
+		if err != nil {
+			logFatal("invalid configuration - %s", err)
+		}
+		os.Exit(0)
+	}
+
 	nsqadmin, err := nsqadmin.New(opts)
 	if err != nil {
 		logFatal("failed to instantiate nsqadmin - %s", err)
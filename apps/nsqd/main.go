@@ -7,25 +7,36 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
-	"syscall"
 	"time"
 
-	"github.com/BurntSushi/toml"
 	"github.com/judwhite/go-svc/svc"
 	"github.com/mreiferson/go-options"
+	"github.com/nsqio/nsq/internal/app"
 	"github.com/nsqio/nsq/internal/lg"
 	"github.com/nsqio/nsq/internal/version"
 	"github.com/nsqio/nsq/nsqd"
 )
 
 type program struct {
-	once sync.Once
-	nsqd *nsqd.NSQD
+	once    sync.Once
+	nsqd    *nsqd.NSQD
+	opts    *nsqd.Options
+	flagSet *flag.FlagSet
+
+	// set when running as a Windows service
+	logger lg.Logger
 }
 
 func main() {
-	prg := &program{}
-	if err := svc.Run(prg, syscall.SIGINT, syscall.SIGTERM); err != nil {
+	opts := nsqd.NewOptions()
+	flagSet := nsqdFlagSet(opts)
+	flagSet.Parse(os.Args[1:])
+
+	prg := &program{
+		opts:    opts,
+		flagSet: flagSet,
+	}
+	if err := runService(prg); err != nil {
 		logFatal("%s", err)
 	}
 }
@@ -39,10 +50,8 @@ func (p *program) Init(env svc.Environment) error {
 }
 
 func (p *program) Start() error {
-	opts := nsqd.NewOptions()
-
-	flagSet := nsqdFlagSet(opts)
-	flagSet.Parse(os.Args[1:])
+	opts := p.opts
+	flagSet := p.flagSet
 
 	rand.Seed(time.Now().UTC().UnixNano())
 
@@ -53,15 +62,40 @@ func (p *program) Start() error {
 
 	var cfg config
 	configFile := flagSet.Lookup("config").Value.String()
+	if configFile == "" {
+		configFile = os.Getenv("NSQD_CONFIG")
+	}
 	if configFile != "" {
-		_, err := toml.DecodeFile(configFile, &cfg)
+		c, err := app.LoadConfig(configFile)
 		if err != nil {
 			logFatal("failed to load config file %s - %s", configFile, err)
 		}
+		cfg = c
+	}
+	cfg, err := app.EnvConfig("NSQD_", opts, cfg)
+	if err != nil {
+		logFatal("failed to load environment - %s", err)
 	}
 	cfg.Validate()
 
 	options.Resolve(opts, flagSet, cfg)
+	err = app.ResolveSecrets(opts)
+	if err != nil {
+		logFatal("%s", err)
+	}
+	if p.logger != nil {
+		opts.Logger = p.logger
+	}
+
+	if flagSet.Lookup("check-config").Value.(flag.Getter).Get().(bool) {
+		app.PrintOptions(os.Stdout, opts)
+		err := nsqd.ValidateOptions(opts)
+		if err != nil {
+			logFatal("invalid configuration - %s", err)
+		}
+		os.Exit(0)
+	}
+
 	nsqd, err := nsqd.New(opts)
 	if err != nil {
 		logFatal("failed to instantiate nsqd - %s", err)
@@ -2,11 +2,13 @@ package main
 
 import (
 	"crypto/tls"
+	"io/ioutil"
 	"os"
 	"testing"
 
 	"github.com/BurntSushi/toml"
 	"github.com/mreiferson/go-options"
+	"github.com/nsqio/nsq/internal/app"
 	"github.com/nsqio/nsq/internal/test"
 	"github.com/nsqio/nsq/nsqd"
 )
@@ -27,9 +29,36 @@ func TestConfigFlagParsing(t *testing.T) {
 	cfg.Validate()
 
 	options.Resolve(opts, flagSet, cfg)
-	nsqd.New(opts)
+	opts.DataPath, err = ioutil.TempDir("", "nsq-test-")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(opts.DataPath)
+	n, err := nsqd.New(opts)
+	if err == nil {
+		defer n.Exit()
+	}
 
 	if opts.TLSMinVersion != tls.VersionTLS10 {
 		t.Errorf("min %#v not expected %#v", opts.TLSMinVersion, tls.VersionTLS10)
 	}
 }
+
+func TestProfilingEndpointSecret(t *testing.T) {
+	os.Setenv("NSQD_TEST_PROFILING_ENDPOINT", "http://127.0.0.1:4040")
+	defer os.Unsetenv("NSQD_TEST_PROFILING_ENDPOINT")
+
+	opts := nsqd.NewOptions()
+	flagSet := nsqdFlagSet(opts)
+	flagSet.Parse([]string{"--profiling-endpoint=env:NSQD_TEST_PROFILING_ENDPOINT"})
+
+	options.Resolve(opts, flagSet, nil)
+	err := app.ResolveSecrets(opts)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if opts.ProfilingEndpoint != "http://127.0.0.1:4040" {
+		t.Errorf("profiling endpoint %q not expected %q", opts.ProfilingEndpoint, "http://127.0.0.1:4040")
+	}
+}
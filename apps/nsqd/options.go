@@ -98,7 +98,11 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 
 	// basic options
 	flagSet.Bool("version", false, "print version string")
-	flagSet.String("config", "", "path to config file")
+	flagSet.Bool("check-config", false, "validate the configuration, print the resolved options and exit (non-zero on problems)")
+	flagSet.String("config", "", "path to config file (or NSQD_CONFIG), options may also be set with NSQD_<FLAG_NAME> environment variables (precedence: flags > environment > config file)")
+
+	flagSet.String("service-name", "nsqd", "name of the Windows service (and Windows Event Log source) when run as a service")
+	flagSet.String("service-description", "", "description to set on the Windows service when run as a service")
 
 	logLevel := opts.LogLevel
 	flagSet.Var(&logLevel, "log-level", "set log verbosity: debug, info, warn, error, or fatal")
@@ -112,22 +116,52 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.String("http-address", opts.HTTPAddress, "<addr>:<port> to listen on for HTTP clients")
 	flagSet.String("tcp-address", opts.TCPAddress, "<addr>:<port> to listen on for TCP clients")
 	authHTTPAddresses := app.StringArray{}
-	flagSet.Var(&authHTTPAddresses, "auth-http-address", "<addr>:<port> to query auth server (may be given multiple times)")
+	flagSet.Var(&authHTTPAddresses, "auth-http-address", "<addr>:<port> to query auth server (may be given multiple times) (may be @/path/to/file, env:NAME or vault:<path>#<key>)")
+	flagSet.String("auth-file", opts.AuthFile, "path to a JSON file of identities and their authorizations, instead of an auth server (reloaded when changed)")
+	flagSet.String("auth-plugin-address", opts.AuthPluginAddress, "<addr>:<port> or unix:<path> of a gRPC auth plugin (see internal/auth/plugin.proto), instead of an auth server (may be @/path/to/file, env:NAME or vault:<path>#<key>)")
+	flagSet.String("namespace-config", opts.NamespaceConfig, "path to a TOML file of per-namespace quotas, identities and topic defaults (for topics named <namespace>/<topic>)")
 	flagSet.String("broadcast-address", opts.BroadcastAddress, "address that will be registered with lookupd (defaults to the OS hostname)")
+	flagSet.String("broadcast-tcp-address", opts.BroadcastTCPAddress, "<addr>:<port> of the TCP listener registered with lookupd, e.g. when ports are mapped (defaults to --broadcast-address and the listener's port)")
+	flagSet.String("broadcast-http-address", opts.BroadcastHTTPAddress, "<addr>:<port> of the HTTP listener registered with lookupd (defaults to --broadcast-address and the listener's port)")
+	flagSet.String("broadcast-https-address", opts.BroadcastHTTPSAddress, "<addr>:<port> of the HTTPS listener registered with lookupd (defaults to --broadcast-address and the listener's port)")
+	flagSet.String("bind-family", opts.BindFamily, "network to bind listeners with: tcp (dual-stack), tcp4 or tcp6 (an unspecified listen host, e.g. 0.0.0.0, then stands for all the addresses of the family)")
 	lookupdTCPAddrs := app.StringArray{}
 	flagSet.Var(&lookupdTCPAddrs, "lookupd-tcp-address", "lookupd TCP address (may be given multiple times)")
 	flagSet.Duration("http-client-connect-timeout", opts.HTTPClientConnectTimeout, "timeout for HTTP connect")
 	flagSet.Duration("http-client-request-timeout", opts.HTTPClientRequestTimeout, "timeout for HTTP request")
+	flagSet.Duration("tcp-keepalive", opts.TCPKeepAlive, "period between TCP keep-alive probes of client and nsqlookupd connections (0 is the Go default, negative disables them)")
+	flagSet.Duration("tcp-user-timeout", opts.TCPUserTimeout, "close client and nsqlookupd connections whose sent data is unacknowledged for this long (TCP_USER_TIMEOUT, Linux only, 0 is the OS default)")
+	flagSet.Bool("tcp-nodelay", opts.TCPNoDelay, "disable Nagle's algorithm on client and nsqlookupd connections")
+	flagSet.Duration("lookupd-read-timeout", opts.LookupdReadTimeout, "timeout for reading a response from nsqlookupd")
+	flagSet.Duration("lookupd-write-timeout", opts.LookupdWriteTimeout, "timeout for writing a command to nsqlookupd")
+	httpAllowOrigins := app.StringArray{}
+	flagSet.Var(&httpAllowOrigins, "http-allow-origins", "origin allowed to make cross-origin HTTP API requests, '*' or 'https://*.example.com' wildcards supported (may be given multiple times or comma separated)")
+	flagSet.Float64("http-rate-limit", opts.HTTPRateLimit, "max HTTP API requests per second across all endpoints but /ping and /health (default 0, i.e., unlimited)")
+	flagSet.Float64("http-rate-limit-pub", opts.HTTPRateLimitPub, "max HTTP API requests per second to /pub and /mpub (default 0, i.e., unlimited)")
+	flagSet.Float64("http-rate-limit-stats", opts.HTTPRateLimitStats, "max HTTP API requests per second to /stats and /info (default 0, i.e., unlimited)")
+	flagSet.Float64("http-rate-limit-admin", opts.HTTPRateLimitAdmin, "max HTTP API requests per second to topic, channel, config and /debug endpoints (default 0, i.e., unlimited)")
+	flagSet.Bool("loadgen", opts.LoadgenEnabled, "enable POST /debug/loadgen, which publishes synthesized messages from within nsqd for capacity testing")
 
 	// diskqueue options
-	flagSet.String("data-path", opts.DataPath, "path to store disk-backed messages")
+	dataPaths := app.StringArray{}
+	flagSet.Var(&dataPaths, "data-path", "path to store disk-backed messages (may be given multiple times to spread topics across disks, metadata is stored in the first)")
+	flagSet.String("data-path-placement", opts.DataPathPlacement, "how new topics are placed across multiple --data-path: round-robin or free-space")
+	flagSet.String("backup-dir", opts.BackupDir, "directory on the nsqd host that POST /backup?dir=<relative path> writes snapshots under (default: disabled, snapshots are only streamed as tar archives)")
+	flagSet.String("restore-from", opts.RestoreFrom, "import a snapshot created by POST /backup (a directory or tar file) into an empty --data-path at startup")
+	flagSet.Bool("recover", opts.Recover, "at startup, repair diskqueue files and metadata in --data-path (e.g. after a crash or partial copy) and log what was fixed")
+	flagSet.Bool("strict-startup", opts.StrictStartup, "at every startup, cross-check the metadata with the diskqueue files in --data-path and refuse to start on problems (checked, and repaired, only after a crash otherwise)")
 	flagSet.Int64("mem-queue-size", opts.MemQueueSize, "number of messages to keep in memory (per topic/channel)")
+	flagSet.Int64("ephemeral-buffer-size", opts.EphemeralBufferSize, "number of messages #ephemeral channels keep in memory before dropping new ones (default 0, i.e., --mem-queue-size, may be overridden per topic)")
+	flagSet.Int64("channel-staging-size", opts.ChannelStagingSize, "number of new messages a channel with a backlog on disk keeps in memory, the rest are written to disk after the backlog (default 0, i.e., --mem-queue-size)")
 	flagSet.Int64("max-bytes-per-file", opts.MaxBytesPerFile, "number of bytes per diskqueue file before rolling")
 	flagSet.Int64("sync-every", opts.SyncEvery, "number of messages per diskqueue fsync")
 	flagSet.Duration("sync-timeout", opts.SyncTimeout, "duration of time per diskqueue fsync")
+	flagSet.Duration("sync-group-commit", opts.SyncGroupCommit, "batch the fsyncs of durable topics' writes across topics, waiting up to this duration for more writes (0 fsyncs after each write)")
+	flagSet.String("disk-compression", opts.DiskCompression, "codec diskqueue files are compressed with once full: none or zstd (may be overridden per topic)")
+	flagSet.Int("backend-msg-envelope", opts.BackendMsgEnvelope, "envelope of the messages written to diskqueues: 1, which older nsqd read, or 2, which keeps their producer address (messages with a routing key, event timestamp or hops are always written in 2, which older nsqd can't read: nsqd can't be downgraded while its diskqueues hold such messages)")
 
-	flagSet.Int("queue-scan-worker-pool-max", opts.QueueScanWorkerPoolMax, "max concurrency for checking in-flight and deferred message timeouts")
-	flagSet.Int("queue-scan-selection-count", opts.QueueScanSelectionCount, "number of channels to check per cycle (every 100ms) for in-flight and deferred timeouts")
+	flagSet.Int("queue-scan-worker-pool-max", opts.QueueScanWorkerPoolMax, "max concurrency for processing expired in-flight and deferred message timeouts (workers are added as more channels have timeouts expiring at once)")
+	flagSet.Int("queue-scan-selection-count", 0, "[deprecated] has no effect, in-flight and deferred timeouts are kept in a timing wheel")
 
 	// msg and command options
 	flagSet.Duration("msg-timeout", opts.MsgTimeout, "default duration to wait before auto-requeing a message")
@@ -135,26 +169,67 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.Int64("max-msg-size", opts.MaxMsgSize, "maximum size of a single message in bytes")
 	flagSet.Duration("max-req-timeout", opts.MaxReqTimeout, "maximum requeuing timeout for a message")
 	flagSet.Int64("max-body-size", opts.MaxBodySize, "maximum size of a single command body")
+	flagSet.String("msg-id-generator", opts.MsgIDGenerator, "how message IDs are generated: snowflake (from the time, --node-id and a sequence), random (a millisecond timestamp and 32 random bits, sortable and unique without distinct --node-id) or producer (supplied by producers, at the start of message bodies with IDENTIFY msg_ids or in the id param of /pub)")
+	flagSet.String("msg-id-pattern", opts.MsgIDPattern, "regular expression that message IDs supplied by producers must match in full, beyond being 16 printable ASCII characters without spaces")
+	flagSet.Bool("record-hops", opts.RecordHops, "record in messages the address of the client that published them and of this nsqd, after the hops supplied by republishers like nsq_to_nsq --forward-hops (with IDENTIFY hops or the hops param of /pub), delivered in msg envelope 3")
+	flagSet.String("cluster-name", opts.ClusterName, "name of the cluster of this nsqd, recorded in hops (cluster/nsqd) with --record-hops: messages already published to any nsqd of the cluster are dropped (e.g. when nsq_to_nsq --forward-hops forwards in a loop), without it only those already published to this nsqd")
+	flagSet.Int("async-pub-buffer-size", opts.AsyncPubBufferSize, "maximum number of messages published with /pub?async=true (or /pub/stream?async=true) waiting to be put in their topics, further async publishes are refused (0 refuses all)")
+	flagSet.Int("max-name-length", opts.MaxNameLength, "maximum length of topic and channel names created by clients (0 is the protocol maximum of 64)")
+	flagSet.String("topic-name-pattern", opts.TopicNamePattern, "regular expression that names of topics created by clients must match in full (excluding any #ephemeral suffix)")
+	flagSet.String("channel-name-pattern", opts.ChannelNamePattern, "regular expression that names of channels created by clients must match in full (excluding any #ephemeral suffix)")
+	reservedNamePrefixes := app.StringArray{}
+	flagSet.Var(&reservedNamePrefixes, "reserved-name-prefix", "prefix of topic and channel names that clients may not create (may be given multiple times)")
+	minClientVersions := app.StringArray{}
+	flagSet.Var(&minClientVersions, "min-client-version", "refuse clients whose IDENTIFY user_agent names this library below this version, e.g. go-nsq/1.1.0 (may be given multiple times)")
+	flagSet.Duration("topic-idle-timeout", opts.TopicIdleTimeout, "delete topics that have had no channels, messages or publishes for this long, deregistering them from nsqlookupd (0 never, may be overridden per topic)")
+	flagSet.Duration("topic-warmup", opts.TopicWarmup, "hold the messages published to a new topic this long, so that every channel created meanwhile gets them rather than only the first (0 never)")
+	flagSet.Duration("retention", opts.Retention, "keep a copy on disk of the messages topics deliver to their channels this long, for POST /channel/seek to move channels back to reprocess them (0 never)")
+	flagSet.Int64("channel-alarm-depth", opts.ChannelAlarmDepth, "raise an alarm when a channel's depth reaches this (0 never, may be overridden per channel)")
+	flagSet.Duration("channel-alarm-age", opts.ChannelAlarmAge, "raise an alarm when a channel's oldest queued message is this old (0 never, may be overridden per channel)")
+	flagSet.String("channel-alarm-webhook", opts.ChannelAlarmWebhook, "URL to POST channel alarms (and their clearing) to as JSON (may be @/path/to/file, env:NAME or vault:<path>#<key>)")
+	flagSet.String("channel-alarm-topic", opts.ChannelAlarmTopic, "topic to publish channel alarms (and their clearing) to as JSON")
+	flagSet.Int("quarantine-timeouts", opts.QuarantineTimeouts, "move a message that times out this many times to the channel's <channel>#quarantine channel instead of redelivering it (0 never, may be overridden per channel)")
+	flagSet.Int64("audit-log-max-bytes", opts.AuditLogMaxBytes, "size at which the audit log of a channel (see audit_log) is rotated")
+	flagSet.Int("audit-log-max-files", opts.AuditLogMaxFiles, "number of rotated audit log files kept per channel")
+	flagSet.Int("publisher-stats-top-n", opts.PublisherStatsTopN, "count messages published to each topic by publisher (auth identity, TLS certificate common name or remote host), showing the top N in /stats (0 disables)")
+	flagSet.Int64("health-min-free-bytes", opts.HealthMinFreeBytes, "/health fails when a data path has fewer bytes free (0 disables the threshold)")
+	flagSet.Int("heartbeat-miss-limit", opts.HeartbeatMissLimit, "number of heartbeat intervals a client may send nothing for (not even a response to a heartbeat) before it is disconnected and its in-flight messages requeued")
+	flagSet.Duration("heartbeat-grace-period", opts.HeartbeatGracePeriod, "time allowed on top of --heartbeat-miss-limit heartbeat intervals before a client is disconnected")
 
 	// client overridable configuration options
 	flagSet.Duration("max-heartbeat-interval", opts.MaxHeartbeatInterval, "maximum client configurable duration of time between client heartbeats")
 	flagSet.Int64("max-rdy-count", opts.MaxRdyCount, "maximum RDY count for a client")
 	flagSet.Int64("max-output-buffer-size", opts.MaxOutputBufferSize, "maximum client configurable size (in bytes) for a client output buffer")
+	flagSet.Int64("min-output-buffer-size", opts.MinOutputBufferSize, "minimum client configurable size (in bytes) for a client output buffer")
+	flagSet.Int64("output-buffer-size", opts.OutputBufferSize, "default size (in bytes) of a client output buffer")
 	flagSet.Duration("max-output-buffer-timeout", opts.MaxOutputBufferTimeout, "maximum client configurable duration of time between flushing to a client")
 	flagSet.Duration("min-output-buffer-timeout", opts.MinOutputBufferTimeout, "minimum client configurable duration of time between flushing to a client")
 	flagSet.Duration("output-buffer-timeout", opts.OutputBufferTimeout, "default duration of time between flushing data to clients")
+	flagSet.Bool("adaptive-output-flush", opts.AdaptiveOutputFlush, "flush to clients as soon as their channel has no more messages queued instead of waiting for the output buffer timeout (clients may opt in with IDENTIFY adaptive_flush)")
 	flagSet.Int("max-channel-consumers", opts.MaxChannelConsumers, "maximum channel consumer connection count per nsqd instance (default 0, i.e., unlimited)")
+	flagSet.Duration("rdy-hint-interval", opts.RdyHintInterval, "how often clients that opt in (with IDENTIFY rdy_hints) are sent the max RDY count suggested for their channel, when it changes (0 disables)")
+	flagSet.Int64("publish-credit-window", opts.PublishCreditWindow, "maximum number of messages producers that opt in to flow control (with IDENTIFY publish_credits) may publish before nsqd grants them more credits, which it withholds while the topic is under pressure (0 disables)")
 
 	// statsd integration options
-	flagSet.String("statsd-address", opts.StatsdAddress, "UDP <addr>:<port> of a statsd daemon for pushing stats")
+	flagSet.String("statsd-address", opts.StatsdAddress, "<addr>:<port> of a statsd daemon for pushing stats")
 	flagSet.Duration("statsd-interval", opts.StatsdInterval, "duration between pushing to statsd")
 	flagSet.Bool("statsd-mem-stats", opts.StatsdMemStats, "toggle sending memory and GC stats to statsd")
 	flagSet.String("statsd-prefix", opts.StatsdPrefix, "prefix used for keys sent to statsd (%s for host replacement)")
 	flagSet.Int("statsd-udp-packet-size", opts.StatsdUDPPacketSize, "the size in bytes of statsd UDP packets")
+	flagSet.String("statsd-protocol", opts.StatsdProtocol, "protocol to push stats to statsd over: udp, tcp or tls (tcp and tls keep stats that fail to send to retry)")
+	flagSet.String("statsd-tls-root-ca-file", opts.StatsdTLSRootCAFile, "path to a certificate file of the CA to verify statsd with over tls (default the system roots)")
+	flagSet.Int("statsd-buffer-size", opts.StatsdBufferSize, "max bytes of stats kept to retry when they fail to send over tcp or tls, dropping the oldest beyond that (see statsd.dropped_count)")
+
+	flagSet.String("profiling-endpoint", opts.ProfilingEndpoint, "HTTP address of a pyroscope server (or one with its ingest API) to upload CPU and heap profiles to continuously, labeled with the node and the topics and channels (may be @/path/to/file, env:NAME or vault:<path>#<key>)")
+	flagSet.Duration("profiling-interval", opts.ProfilingInterval, "duration of the CPU profiles uploaded to --profiling-endpoint, and how often heap profiles are")
 
 	// End to end percentile flags
 	e2eProcessingLatencyPercentiles := app.FloatArray{}
 	flagSet.Var(&e2eProcessingLatencyPercentiles, "e2e-processing-latency-percentile", "message processing time percentiles (as float (0, 1.0]) to track (can be specified multiple times or comma separated '1.0,0.99,0.95', default none)")
+	processingLatencyPercentiles := app.FloatArray{}
+	flagSet.Var(&processingLatencyPercentiles, "processing-latency-percentile", "percentiles (as float (0, 1.0]) of the time from delivering messages to a client to their FIN to track per channel and client, over --e2e-processing-latency-window-time (can be specified multiple times or comma separated '0.5,0.95,0.99', default none)")
+	eventLagPercentiles := app.FloatArray{}
+	flagSet.Var(&eventLagPercentiles, "event-lag-percentile", "percentiles (as float (0, 1.0]) of the time from the event timestamps supplied by producers to the FIN of messages to track per channel, over --e2e-processing-latency-window-time (can be specified multiple times or comma separated '0.5,0.95,0.99', default none)")
 	flagSet.Duration("e2e-processing-latency-window-time", opts.E2EProcessingLatencyWindowTime, "calculate end to end latency quantiles for this duration of time (ie: 60s would only show quantile calculations from the past 60 seconds)")
 
 	// TLS config
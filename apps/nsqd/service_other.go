@@ -0,0 +1,13 @@
+// +build !windows
+
+package main
+
+import (
+	"syscall"
+
+	"github.com/judwhite/go-svc/svc"
+)
+
+func runService(p *program) error {
+	return svc.Run(p, syscall.SIGINT, syscall.SIGTERM)
+}
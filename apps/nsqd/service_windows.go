@@ -0,0 +1,138 @@
+// +build windows
+
+package main
+
+import (
+	"strings"
+	"syscall"
+
+	"github.com/judwhite/go-svc/svc"
+	"github.com/nsqio/nsq/nsqd"
+	wsvc "golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// runService runs p as a Windows service when not started from an interactive
+// session. Unlike go-svc, this logs to the Windows Event Log and handles the pause
+// and continue service controls by pausing and resuming all topics.
+func runService(p *program) error {
+	interactive, err := wsvc.IsAnInteractiveSession()
+	if err != nil {
+		return err
+	}
+	if interactive {
+		return svc.Run(p, syscall.SIGINT, syscall.SIGTERM)
+	}
+
+	name := p.flagSet.Lookup("service-name").Value.String()
+	ws := &windowsService{p: p, name: name}
+
+	// registering the event source requires administrator rights and fails when it
+	// already exists, so failure to install it is not fatal
+	eventlog.InstallAsEventCreate(name, eventlog.Error|eventlog.Warning|eventlog.Info)
+	elog, err := eventlog.Open(name)
+	if err == nil {
+		defer elog.Close()
+		p.logger = &eventLogger{elog}
+	}
+
+	if err := p.Init(ws); err != nil {
+		return err
+	}
+
+	if desc := p.flagSet.Lookup("service-description").Value.String(); desc != "" {
+		err := setServiceDescription(name, desc)
+		if err != nil && elog != nil {
+			elog.Warning(1, "failed to set service description - "+err.Error())
+		}
+	}
+
+	return wsvc.Run(name, ws)
+}
+
+type windowsService struct {
+	p    *program
+	name string
+}
+
+func (ws *windowsService) IsWindowsService() bool {
+	return true
+}
+
+// Execute is invoked by Windows
+func (ws *windowsService) Execute(args []string, r <-chan wsvc.ChangeRequest, changes chan<- wsvc.Status) (bool, uint32) {
+	const cmdsAccepted = wsvc.AcceptStop | wsvc.AcceptShutdown | wsvc.AcceptPauseAndContinue
+	changes <- wsvc.Status{State: wsvc.StartPending}
+
+	if err := ws.p.Start(); err != nil {
+		return true, 1
+	}
+
+	changes <- wsvc.Status{State: wsvc.Running, Accepts: cmdsAccepted}
+
+	var paused []*nsqd.Topic
+	for c := range r {
+		switch c.Cmd {
+		case wsvc.Interrogate:
+			changes <- c.CurrentStatus
+		case wsvc.Pause:
+			changes <- wsvc.Status{State: wsvc.PausePending}
+			paused = append(paused, ws.p.nsqd.PauseTopics()...)
+			changes <- wsvc.Status{State: wsvc.Paused, Accepts: cmdsAccepted}
+		case wsvc.Continue:
+			changes <- wsvc.Status{State: wsvc.ContinuePending}
+			ws.p.nsqd.UnPauseTopics(paused)
+			paused = nil
+			changes <- wsvc.Status{State: wsvc.Running, Accepts: cmdsAccepted}
+		case wsvc.Stop, wsvc.Shutdown:
+			changes <- wsvc.Status{State: wsvc.StopPending}
+			// resume before exiting so that the pause isn't persisted in metadata
+			ws.p.nsqd.UnPauseTopics(paused)
+			if err := ws.p.Stop(); err != nil {
+				return true, 2
+			}
+			return false, 0
+		}
+	}
+
+	return false, 0
+}
+
+func setServiceDescription(name string, desc string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	cfg, err := s.Config()
+	if err != nil {
+		return err
+	}
+	if cfg.Description == desc {
+		return nil
+	}
+	cfg.Description = desc
+	return s.UpdateConfig(cfg)
+}
+
+// eventLogger writes nsqd's log lines to the Windows Event Log with a type
+// according to their level
+type eventLogger struct {
+	elog *eventlog.Log
+}
+
+func (l *eventLogger) Output(maxdepth int, s string) error {
+	switch {
+	case strings.HasPrefix(s, "FATAL:"), strings.HasPrefix(s, "ERROR:"):
+		return l.elog.Error(1, s)
+	case strings.HasPrefix(s, "WARNING:"):
+		return l.elog.Warning(1, s)
+	}
+	return l.elog.Info(1, s)
+}
@@ -8,9 +8,9 @@ import (
 	"sync"
 	"syscall"
 
-	"github.com/BurntSushi/toml"
 	"github.com/judwhite/go-svc/svc"
 	"github.com/mreiferson/go-options"
+	"github.com/nsqio/nsq/internal/app"
 	"github.com/nsqio/nsq/internal/lg"
 	"github.com/nsqio/nsq/internal/version"
 	"github.com/nsqio/nsq/nsqlookupd"
@@ -19,8 +19,9 @@ import (
 func nsqlookupdFlagSet(opts *nsqlookupd.Options) *flag.FlagSet {
 	flagSet := flag.NewFlagSet("nsqlookupd", flag.ExitOnError)
 
-	flagSet.String("config", "", "path to config file")
+	flagSet.String("config", "", "path to config file (or NSQLOOKUPD_CONFIG), options may also be set with NSQLOOKUPD_<FLAG_NAME> environment variables (precedence: flags > environment > config file)")
 	flagSet.Bool("version", false, "print version string")
+	flagSet.Bool("check-config", false, "validate the configuration, print the resolved options and exit (non-zero on problems)")
 
 	logLevel := opts.LogLevel
 	flagSet.Var(&logLevel, "log-level", "set log verbosity: debug, info, warn, error, or fatal")
@@ -30,9 +31,24 @@ func nsqlookupdFlagSet(opts *nsqlookupd.Options) *flag.FlagSet {
 	flagSet.String("tcp-address", opts.TCPAddress, "<addr>:<port> to listen on for TCP clients")
 	flagSet.String("http-address", opts.HTTPAddress, "<addr>:<port> to listen on for HTTP clients")
 	flagSet.String("broadcast-address", opts.BroadcastAddress, "address of this lookupd node, (default to the OS hostname)")
+	flagSet.String("bind-family", opts.BindFamily, "network to bind listeners with: tcp (dual-stack), tcp4 or tcp6 (an unspecified listen host, e.g. 0.0.0.0, then stands for all the addresses of the family)")
+	httpAllowOrigins := app.StringArray{}
+	flagSet.Var(&httpAllowOrigins, "http-allow-origins", "origin allowed to make cross-origin HTTP API requests, '*' or 'https://*.example.com' wildcards supported (may be given multiple times or comma separated)")
+
+	flagSet.Float64("http-rate-limit", opts.HTTPRateLimit, "max HTTP API requests per second across all endpoints but /ping (default 0, i.e., unlimited)")
+	flagSet.Float64("http-rate-limit-query", opts.HTTPRateLimitQuery, "max HTTP API requests per second to /lookup, /topics, /channels, /nodes and /debug (default 0, i.e., unlimited)")
+	flagSet.Float64("http-rate-limit-admin", opts.HTTPRateLimitAdmin, "max HTTP API requests per second to topic, channel and /debug/pprof endpoints (default 0, i.e., unlimited)")
 
 	flagSet.Duration("inactive-producer-timeout", opts.InactiveProducerTimeout, "duration of time a producer will remain in the active list since its last ping")
 	flagSet.Duration("tombstone-lifetime", opts.TombstoneLifetime, "duration of time a producer will remain tombstoned if registration remains")
+	flagSet.Duration("empty-registration-lifetime", opts.EmptyRegistrationLifetime, "duration of time a topic or channel remains registered after its last producer unregistered it (0 forever)")
+	flagSet.String("declarations-file", opts.DeclarationsFile, "path to the file the channels declared with /channel/declare persist in (default in memory only)")
+
+	flagSet.Duration("tcp-keepalive", opts.TCPKeepAlive, "period between TCP keep-alive probes of nsqd connections (0 is the Go default, negative disables them)")
+	flagSet.Duration("tcp-user-timeout", opts.TCPUserTimeout, "close nsqd connections whose sent data is unacknowledged for this long (TCP_USER_TIMEOUT, Linux only, 0 is the OS default)")
+	flagSet.Bool("tcp-nodelay", opts.TCPNoDelay, "disable Nagle's algorithm on nsqd connections")
+	flagSet.Duration("tcp-read-timeout", opts.TCPReadTimeout, "close nsqd connections that send nothing for this long, unregistering their producers (must exceed the 15s nsqd ping interval, 0 never)")
+	flagSet.Duration("tcp-write-timeout", opts.TCPWriteTimeout, "timeout for writing a response to nsqd (0 never)")
 
 	return flagSet
 }
@@ -70,14 +86,37 @@ func (p *program) Start() error {
 
 	var cfg map[string]interface{}
 	configFile := flagSet.Lookup("config").Value.String()
+	if configFile == "" {
+		configFile = os.Getenv("NSQLOOKUPD_CONFIG")
+	}
 	if configFile != "" {
-		_, err := toml.DecodeFile(configFile, &cfg)
+		c, err := app.LoadConfig(configFile)
 		if err != nil {
 			logFatal("failed to load config file %s - %s", configFile, err)
 		}
+		cfg = c
+	}
+
+	cfg, err := app.EnvConfig("NSQLOOKUPD_", opts, cfg)
+	if err != nil {
+		logFatal("failed to load environment - %s", err)
 	}
 
 	options.Resolve(opts, flagSet, cfg)
+	err = app.ResolveSecrets(opts)
+	if err != nil {
+		logFatal("%s", err)
+	}
+
+	if flagSet.Lookup("check-config").Value.(flag.Getter).Get().(bool) {
+		app.PrintOptions(os.Stdout, opts)
+		err := nsqlookupd.ValidateOptions(opts)
+		if err != nil {
+			logFatal("invalid configuration - %s", err)
+		}
+		os.Exit(0)
+	}
+
 	nsqlookupd, err := nsqlookupd.New(opts)
 	if err != nil {
 		logFatal("failed to instantiate nsqlookupd", err)
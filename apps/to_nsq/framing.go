@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// messageReader reads messages from stdin. A nil message with a nil error
+// is empty and skipped.
+type messageReader interface {
+	ReadMessage() ([]byte, error)
+}
+
+// delimitedReader reads messages separated by delim
+type delimitedReader struct {
+	r     *bufio.Reader
+	delim byte
+}
+
+func (d *delimitedReader) ReadMessage() ([]byte, error) {
+	line, err := d.r.ReadBytes(d.delim)
+	if len(line) > 0 && line[len(line)-1] == d.delim {
+		// trim the delimiter
+		line = line[:len(line)-1]
+	}
+	if len(line) == 0 {
+		return nil, err
+	}
+	// the last message may not be followed by a delimiter
+	if err == io.EOF {
+		err = nil
+	}
+	return line, err
+}
+
+// lengthPrefixedReader reads messages each prefixed by its size as a 4 byte
+// big-endian integer, as in the nsqd protocol
+type lengthPrefixedReader struct {
+	r *bufio.Reader
+}
+
+func (l *lengthPrefixedReader) ReadMessage() ([]byte, error) {
+	var size [4]byte
+	_, err := io.ReadFull(l.r, size[:])
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("truncated message size")
+		}
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n == 0 {
+		return nil, nil
+	}
+	body := make([]byte, n)
+	_, err = io.ReadFull(l.r, body)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return nil, fmt.Errorf("truncated message, expected %d bytes", n)
+	}
+	return body, err
+}
+
+// jsonArrayReader reads each element of a sequence of JSON arrays as a
+// message, compacted
+type jsonArrayReader struct {
+	d       *json.Decoder
+	inArray bool
+}
+
+func (j *jsonArrayReader) ReadMessage() ([]byte, error) {
+	for !j.inArray || !j.d.More() {
+		tok, err := j.d.Token()
+		if err != nil {
+			if err == io.EOF && j.inArray {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if j.inArray {
+			// the closing ], More() returned false
+			j.inArray = false
+			continue
+		}
+		if tok != json.Delim('[') {
+			return nil, fmt.Errorf("expected a JSON array, got %v", tok)
+		}
+		j.inArray = true
+	}
+
+	var raw json.RawMessage
+	err := j.d.Decode(&raw)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = json.Compact(&buf, raw)
+	return buf.Bytes(), err
+}
@@ -5,12 +5,14 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -23,6 +25,9 @@ import (
 var (
 	topic     = flag.String("topic", "", "NSQ topic to publish to")
 	delimiter = flag.String("delimiter", "\n", "character to split input from stdin")
+	framing   = flag.String("framing", "delimiter", "how to split input from stdin into messages: delimiter (--delimiter), length (each prefixed by its size as a 4 byte big-endian integer) or json-array (the elements of JSON arrays)")
+
+	maxBackoffDuration = flag.Duration("max-backoff-duration", 2*time.Minute, "when nsqd is unavailable or refuses messages (E_PUB_FAILED, E_DISK_QUOTA_EXCEEDED), block and retry with exponential backoff up to this long between attempts (0 exits instead)")
 
 	destNsqdTCPAddrs = app.StringArray{}
 )
@@ -46,6 +51,19 @@ func main() {
 		log.Fatal("--delimiter must be a single byte")
 	}
 
+	var mr messageReader
+	r := bufio.NewReader(os.Stdin)
+	switch *framing {
+	case "delimiter":
+		mr = &delimitedReader{r: r, delim: (*delimiter)[0]}
+	case "length":
+		mr = &lengthPrefixedReader{r: r}
+	case "json-array":
+		mr = &jsonArrayReader{d: json.NewDecoder(r)}
+	default:
+		log.Fatal("--framing must be delimiter, length or json-array")
+	}
+
 	stopChan := make(chan bool)
 	termChan := make(chan os.Signal, 1)
 	signal.Notify(termChan, syscall.SIGINT, syscall.SIGTERM)
@@ -88,8 +106,6 @@ func main() {
 		}
 	}()
 
-	r := bufio.NewReader(os.Stdin)
-	delim := (*delimiter)[0]
 	go func() {
 		for {
 			var err error
@@ -98,10 +114,10 @@ func main() {
 				if currentBalance <= 0 {
 					time.Sleep(interval)
 				}
-				err = readAndPublish(r, delim, producers)
+				err = readAndPublish(mr, producers)
 				atomic.AddInt64(&balance, -1)
 			} else {
-				err = readAndPublish(r, delim, producers)
+				err = readAndPublish(mr, producers)
 			}
 			if err != nil {
 				if err != io.EOF {
@@ -123,22 +139,17 @@ func main() {
 	}
 }
 
-// readAndPublish reads to the delim from r and publishes the bytes
+// readAndPublish reads a message from mr and publishes it
 // to the map of producers.
-func readAndPublish(r *bufio.Reader, delim byte, producers map[string]*nsq.Producer) error {
-	line, readErr := r.ReadBytes(delim)
+func readAndPublish(mr messageReader, producers map[string]*nsq.Producer) error {
+	msg, readErr := mr.ReadMessage()
 
-	if len(line) > 0 {
-		// trim the delimiter
-		line = line[:len(line)-1]
-	}
-
-	if len(line) == 0 {
+	if len(msg) == 0 {
 		return readErr
 	}
 
 	for _, producer := range producers {
-		err := producer.Publish(*topic, line)
+		err := publish(producer, msg)
 		if err != nil {
 			return err
 		}
@@ -146,3 +157,35 @@ func readAndPublish(r *bufio.Reader, delim byte, producers map[string]*nsq.Produ
 
 	return readErr
 }
+
+// publish publishes msg, retrying with exponential backoff while nsqd is
+// unavailable or applying backpressure
+func publish(producer *nsq.Producer, msg []byte) error {
+	backoff := 100 * time.Millisecond
+	for {
+		err := producer.Publish(*topic, msg)
+		if err == nil || *maxBackoffDuration <= 0 || !isRetryable(err) {
+			return err
+		}
+		if backoff > *maxBackoffDuration {
+			backoff = *maxBackoffDuration
+		}
+		log.Printf("backing off for %s - failed to publish to %s - %s", backoff, producer, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// isRetryable returns false for errors that will recur, like invalid
+// messages
+func isRetryable(err error) bool {
+	switch err := err.(type) {
+	case nsq.ErrProtocol:
+		for _, code := range []string{"E_INVALID", "E_BAD_", "E_UNAUTHORIZED", "E_AUTH_"} {
+			if strings.HasPrefix(err.Reason, code) {
+				return false
+			}
+		}
+	}
+	return err != nsq.ErrStopped
+}
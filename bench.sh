@@ -26,23 +26,19 @@ echo "# creating topic/channel"
 curl --silent 'http://127.0.0.1:4151/create_topic?topic=sub_bench' >/dev/null 2>&1
 curl --silent 'http://127.0.0.1:4151/create_channel?topic=sub_bench&channel=ch' >/dev/null 2>&1
 
-echo "# compiling bench_reader/bench_writer"
-pushd bench >/dev/null
-for app in bench_reader bench_writer; do
-    pushd $app >/dev/null
-    go build
-    popd >/dev/null
-done
+echo "# compiling nsq_bench"
+pushd bench/nsq_bench >/dev/null
+go build
 popd >/dev/null
 
 echo -n "PUB: "
-bench/bench_writer/bench_writer --size=$messageSize --batch-size=$batchSize 2>&1
+bench/nsq_bench/nsq_bench --mode=pub --size=$messageSize --batch-size=$batchSize 2>&1
 
 curl -s -o cpu.pprof http://127.0.0.1:4151/debug/pprof/profile &
 pprof_pid=$!
 
 echo -n "SUB: "
-bench/bench_reader/bench_reader --size=$messageSize --channel=ch 2>&1
+bench/nsq_bench/nsq_bench --mode=sub --channel=ch 2>&1
 
 echo "waiting for pprof..."
 wait $pprof_pid
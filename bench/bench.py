@@ -86,9 +86,7 @@ def _bootstrap(addr):
                 GOPATH=/home/ubuntu/go PATH=$PATH:/usr/local/go/bin gpm install',
             'cd go/src/github.com/nsqio/nsq/apps/nsqd && \
                 GOPATH=/home/ubuntu/go /usr/local/go/bin/go build',
-            'cd go/src/github.com/nsqio/nsq/bench/bench_writer && \
-                GOPATH=/home/ubuntu/go /usr/local/go/bin/go build',
-            'cd go/src/github.com/nsqio/nsq/bench/bench_reader && \
+            'cd go/src/github.com/nsqio/nsq/bench/nsq_bench && \
                 GOPATH=/home/ubuntu/go /usr/local/go/bin/go build',
             'sudo -S mkdir -p /mnt/nsq',
             'sudo -S chmod 777 /mnt/nsq']:
@@ -174,7 +172,7 @@ def run():
                 ssh_client = ssh_connect_with_retries(addr)
                 for cmd in [
                         'GOMAXPROCS=2 \
-                            ./go/src/github.com/nsqio/nsq/bench/bench_writer/bench_writer \
+                            ./go/src/github.com/nsqio/nsq/bench/nsq_bench/nsq_bench --mode=pub \
                             --topic=%s --nsqd-tcp-address=%s:4150 --deadline=\'%s\' --size=%d' % (
                             topic, nsqd_tcp_addr, deadline.strftime('%Y-%m-%d %H:%M:%S'),
                             tornado.options.options.msg_size)]:
@@ -195,22 +193,22 @@ def run():
                     ssh_client = ssh_connect_with_retries(addr)
                     for cmd in [
                             'GOMAXPROCS=8 \
-                                ./go/src/github.com/nsqio/nsq/bench/bench_reader/bench_reader \
-                                --topic=%s --nsqd-tcp-address=%s:4150 --deadline=\'%s\' --size=%d \
+                                ./go/src/github.com/nsqio/nsq/bench/nsq_bench/nsq_bench --mode=sub \
+                                --topic=%s --nsqd-tcp-address=%s:4150 --deadline=\'%s\' \
                                 --rdy=%d' % (
                                 topic, nsqd_tcp_addr, deadline.strftime('%Y-%m-%d %H:%M:%S'),
-                                tornado.options.options.msg_size, tornado.options.options.rdy)]:
+                                tornado.options.options.rdy)]:
                         worker_chans.append((ssh_client, ssh_cmd_async(ssh_client, cmd)))
                 except Exception:
                     logging.exception('failed')
 
     stats = {
-        'bench_reader': {
+        'sub': {
             'durations': [],
             'mbytes': [],
             'ops': []
         },
-        'bench_writer': {
+        'pub': {
             'durations': [],
             'mbytes': [],
             'ops': []
@@ -296,7 +294,7 @@ if __name__ == '__main__':
     tornado.options.define('msg_size', type=int, default=200,
                            help='size of message')
     tornado.options.define('rdy', type=int, default=10000,
-                           help='RDY count to use for bench_reader')
+                           help='RDY count to use for nsq_bench --mode=sub')
     tornado.options.define('mode', type=str, default='pubsub',
                            help='the benchmark mode (pub, pubsub)')
     tornado.options.define('commit', type=str, default='master',
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+const (
+	// values are counted within 1/subBucketHalf (~0.1%) of their value
+	subBucketBits  = 11
+	subBucketCount = 1 << subBucketBits
+	subBucketHalf  = subBucketCount / 2
+	// latencies over an hour are counted as an hour
+	maxTrackable = int64(time.Hour)
+)
+
+var histogramSize = bucketIndex(maxTrackable) + 1
+
+// Histogram is a High Dynamic Range histogram of durations: values under
+// subBucketCount are counted exactly, and larger ones in log-linear buckets
+// whose width is ~0.1% of their values, so quantiles keep 3 significant
+// digits at any magnitude in constant space
+//
+// see http://hdrhistogram.org
+type Histogram struct {
+	counts []int64
+	total  int64
+	sum    float64
+	min    int64
+	max    int64
+}
+
+func NewHistogram() *Histogram {
+	return &Histogram{
+		counts: make([]int64, histogramSize),
+		min:    math.MaxInt64,
+	}
+}
+
+// bucketIndex returns the index of the slot counting v
+func bucketIndex(v int64) int {
+	if v < subBucketCount {
+		return int(v)
+	}
+	// v is in [subBucketHalf<<k, subBucketCount<<k), counted in slots of
+	// width 1<<k
+	k := bits.Len64(uint64(v)) - subBucketBits
+	return subBucketCount + (k-1)*subBucketHalf + int(v>>uint(k)) - subBucketHalf
+}
+
+// highestEquivalentValue returns the largest value counted in slot i
+func highestEquivalentValue(i int) int64 {
+	if i < subBucketCount {
+		return int64(i)
+	}
+	k := (i-subBucketCount)/subBucketHalf + 1
+	sub := int64((i-subBucketCount)%subBucketHalf + subBucketHalf)
+	return (sub+1)<<uint(k) - 1
+}
+
+func (h *Histogram) Record(d time.Duration) {
+	v := int64(d)
+	if v < 0 {
+		v = 0
+	}
+	if v > maxTrackable {
+		v = maxTrackable
+	}
+	h.counts[bucketIndex(v)]++
+	h.total++
+	h.sum += float64(v)
+	if v < h.min {
+		h.min = v
+	}
+	if v > h.max {
+		h.max = v
+	}
+}
+
+func (h *Histogram) Merge(o *Histogram) {
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	h.total += o.total
+	h.sum += o.sum
+	if o.min < h.min {
+		h.min = o.min
+	}
+	if o.max > h.max {
+		h.max = o.max
+	}
+}
+
+func (h *Histogram) Count() int64 {
+	return h.total
+}
+
+// Quantile returns the value at quantile q (0 -> 1), accurate to the width
+// of its slot
+func (h *Histogram) Quantile(q float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	target := int64(math.Ceil(q * float64(h.total)))
+	if target < 1 {
+		target = 1
+	}
+	var seen int64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= target {
+			v := highestEquivalentValue(i)
+			if v > h.max {
+				v = h.max
+			}
+			return time.Duration(v)
+		}
+	}
+	return time.Duration(h.max)
+}
+
+func (h *Histogram) Mean() time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	return time.Duration(h.sum / float64(h.total))
+}
+
+func (h *Histogram) Min() time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	return time.Duration(h.min)
+}
+
+func (h *Histogram) Max() time.Duration {
+	return time.Duration(h.max)
+}
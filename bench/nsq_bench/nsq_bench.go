@@ -0,0 +1,378 @@
+// This is a load generator for nsqd that publishes and/or consumes a topic
+// at a target rate or as fast as possible, measuring throughput and
+// publish and end to end latency.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	mode       = flag.String("mode", "pubsub", "pub (publish only), sub (consume only) or pubsub (both, measuring end to end latency)")
+	tcpAddress = flag.String("nsqd-tcp-address", "127.0.0.1:4150", "<addr>:<port> to connect to nsqd")
+	topic      = flag.String("topic", "sub_bench", "topic to publish/receive messages on")
+	channel    = flag.String("channel", "ch", "channel to receive messages on")
+
+	runfor = flag.Duration("runfor", 10*time.Second, "duration of time to run")
+	rate   = flag.Float64("rate", 0, "messages/second to publish (across all publishers), 0 publishes as fast as possible")
+	ramp   = flag.String("ramp", "", "publish rate profile instead of --runfor and --rate, a comma separated list of stages, <duration>:<rate> for a constant rate or <duration>:<start rate>-<end rate> to ramp linearly (e.g. \"30s:0-5000,2m:5000\")")
+
+	size             = flag.Int("size", 200, "size of messages (the mean for normal and exponential distributions)")
+	sizeDistribution = flag.String("size-distribution", "fixed", "distribution of message sizes: fixed, uniform (between --size-min and --size-max), normal or exponential")
+	sizeMin          = flag.Int("size-min", 0, "min size of messages (defaults to 1, or 8 in pubsub mode for message timestamps)")
+	sizeMax          = flag.Int("size-max", 0, "max size of messages (defaults to --size for fixed and 4 x --size for other distributions)")
+	sizeStddev       = flag.Float64("size-stddev", 0, "standard deviation of normally distributed message sizes (defaults to --size / 4)")
+
+	batchSize   = flag.Int("batch-size", 200, "max number of messages per MPUB (throttled publishers send the messages that are due, up to this many)")
+	publishers  = flag.Int("publishers", runtime.GOMAXPROCS(0), "number of publisher connections")
+	subscribers = flag.Int("subscribers", runtime.GOMAXPROCS(0), "number of subscriber connections")
+	rdy         = flag.Int("rdy", 2500, "RDY count to use")
+
+	deadline     = flag.String("deadline", "", "deadline to start the benchmark run")
+	drainTimeout = flag.Duration("drain-timeout", 10*time.Second, "in pubsub mode, max time to wait for published messages to be received after publishing ends")
+	outputJSON   = flag.String("output-json", "", "write results as JSON to this file (- for stdout)")
+)
+
+var publishedCount, receivedCount int64
+
+func main() {
+	flag.Parse()
+
+	log.SetPrefix("[nsq_bench] ")
+
+	pub := *mode == "pub" || *mode == "pubsub"
+	sub := *mode == "sub" || *mode == "pubsub"
+	if !pub && !sub {
+		log.Fatal("--mode should be pub, sub or pubsub")
+	}
+	// end to end latency is measured from timestamps in messages
+	timestamps := *mode == "pubsub"
+
+	p := profile{{duration: *runfor, startRate: *rate, endRate: *rate, unthrottled: *rate == 0}}
+	if *ramp != "" {
+		if !pub {
+			log.Fatal("--ramp requires --mode=pub or pubsub")
+		}
+		var err error
+		p, err = parseRamp(*ramp)
+		if err != nil {
+			log.Fatalf("invalid --ramp - %s", err)
+		}
+	}
+	if p.duration() <= 0 {
+		log.Fatal("--runfor should be positive")
+	}
+	if *rate < 0 {
+		log.Fatal("--rate should not be negative")
+	}
+
+	minSize := 1
+	if timestamps {
+		minSize = 8
+	}
+	if *sizeMin == 0 {
+		*sizeMin = minSize
+	}
+	if *sizeMin < minSize {
+		log.Fatalf("--size-min should be at least %d in %s mode", minSize, *mode)
+	}
+	sz, err := newSizer(*sizeDistribution, *size, *sizeMin, *sizeMax, *sizeStddev)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *batchSize < 1 || *publishers < 1 || *subscribers < 1 || *rdy < 1 {
+		log.Fatal("--batch-size, --publishers, --subscribers and --rdy should be positive")
+	}
+
+	var subWorkers []*subWorker
+	if sub {
+		for i := 0; i < *subscribers; i++ {
+			w := &subWorker{
+				addr:       *tcpAddress,
+				topic:      *topic,
+				channel:    *channel,
+				rdy:        *rdy,
+				profile:    p,
+				timestamps: timestamps,
+			}
+			w.connect()
+			subWorkers = append(subWorkers, w)
+		}
+	}
+	var pubWorkers []*pubWorker
+	if pub {
+		for i := 0; i < *publishers; i++ {
+			w := &pubWorker{
+				id:         i,
+				addr:       *tcpAddress,
+				topic:      *topic,
+				batchSize:  *batchSize,
+				workers:    *publishers,
+				profile:    p,
+				sizer:      sz.clone(),
+				timestamps: timestamps,
+			}
+			w.connect()
+			pubWorkers = append(pubWorkers, w)
+		}
+	}
+
+	if *deadline != "" {
+		t, err := time.Parse("2006-01-02 15:04:05", *deadline)
+		if err != nil {
+			log.Fatal(err)
+		}
+		d := t.Sub(time.Now())
+		log.Printf("sleeping until %s (%s)", t, d)
+		time.Sleep(d)
+	}
+
+	start := time.Now()
+	var subWG sync.WaitGroup
+	for _, w := range subWorkers {
+		subWG.Add(1)
+		go func(w *subWorker) {
+			w.run(start)
+			subWG.Done()
+		}(w)
+	}
+
+	var pubWG sync.WaitGroup
+	for _, w := range pubWorkers {
+		pubWG.Add(1)
+		go func(w *pubWorker) {
+			w.run(start)
+			pubWG.Done()
+		}(w)
+	}
+	pubWG.Wait()
+	pubEnd := time.Now()
+
+	if sub {
+		if pub {
+			// wait for the messages still in flight
+			for time.Since(pubEnd) < *drainTimeout &&
+				atomic.LoadInt64(&receivedCount) < atomic.LoadInt64(&publishedCount) {
+				time.Sleep(10 * time.Millisecond)
+			}
+		} else {
+			time.Sleep(time.Until(start.Add(p.duration())))
+		}
+		for _, w := range subWorkers {
+			w.stop()
+		}
+		subWG.Wait()
+	}
+
+	r := &result{
+		Mode:        *mode,
+		Topic:       *topic,
+		Start:       start,
+		Ramp:        *ramp,
+		BatchSize:   *batchSize,
+		Publishers:  len(pubWorkers),
+		Subscribers: len(subWorkers),
+		Size: sizeResult{
+			Distribution: *sizeDistribution,
+			Size:         sz.size,
+			Min:          sz.min,
+			Max:          sz.max,
+		},
+	}
+	if sub {
+		r.Channel = *channel
+	}
+	if *ramp == "" {
+		r.Rate = *rate
+	}
+	var pubStats, subStats []*stats
+	for _, w := range pubWorkers {
+		pubStats = append(pubStats, w.stats)
+	}
+	subEnd := start
+	for _, w := range subWorkers {
+		subStats = append(subStats, w.stats)
+		if w.last.After(subEnd) {
+			subEnd = w.last
+		}
+	}
+	if pub {
+		r.Pub = newRoleResult(pubStats, -1, pubEnd.Sub(start))
+	}
+	if sub {
+		r.Sub = newRoleResult(subStats, -1, subEnd.Sub(start))
+	}
+	if len(p) > 1 {
+		for i, s := range p {
+			sr := stageResult{
+				DurationSeconds: s.duration.Seconds(),
+				StartRate:       s.startRate,
+				EndRate:         s.endRate,
+			}
+			if pub {
+				sr.Pub = newRoleResult(pubStats, i, s.duration)
+			}
+			if sub {
+				sr.Sub = newRoleResult(subStats, i, s.duration)
+			}
+			r.Stages = append(r.Stages, sr)
+		}
+	}
+
+	r.log()
+	if *outputJSON != "" {
+		err := r.writeJSON(*outputJSON)
+		if err != nil {
+			log.Fatalf("failed to write --output-json - %s", err)
+		}
+	}
+}
+
+type result struct {
+	Mode        string        `json:"mode"`
+	Topic       string        `json:"topic"`
+	Channel     string        `json:"channel,omitempty"`
+	Start       time.Time     `json:"start"`
+	Rate        float64       `json:"rate,omitempty"`
+	Ramp        string        `json:"ramp,omitempty"`
+	Size        sizeResult    `json:"size"`
+	BatchSize   int           `json:"batch_size"`
+	Publishers  int           `json:"publishers"`
+	Subscribers int           `json:"subscribers"`
+	Pub         *roleResult   `json:"pub,omitempty"`
+	Sub         *roleResult   `json:"sub,omitempty"`
+	Stages      []stageResult `json:"stages,omitempty"`
+}
+
+type sizeResult struct {
+	Distribution string `json:"distribution"`
+	Size         int    `json:"size"`
+	Min          int    `json:"min"`
+	Max          int    `json:"max"`
+}
+
+type stageResult struct {
+	DurationSeconds float64     `json:"duration_seconds"`
+	StartRate       float64     `json:"start_rate"`
+	EndRate         float64     `json:"end_rate"`
+	Pub             *roleResult `json:"pub,omitempty"`
+	Sub             *roleResult `json:"sub,omitempty"`
+}
+
+type roleResult struct {
+	DurationSeconds float64        `json:"duration_seconds"`
+	Messages        int64          `json:"messages"`
+	Bytes           int64          `json:"bytes"`
+	OpsPerSecond    float64        `json:"ops_per_second"`
+	MBPerSecond     float64        `json:"mb_per_second"`
+	Latency         *latencyResult `json:"latency,omitempty"`
+}
+
+// latencyResult is in microseconds
+type latencyResult struct {
+	Min   float64 `json:"min_us"`
+	Mean  float64 `json:"mean_us"`
+	P50   float64 `json:"p50_us"`
+	P90   float64 `json:"p90_us"`
+	P99   float64 `json:"p99_us"`
+	P999  float64 `json:"p99.9_us"`
+	P9999 float64 `json:"p99.99_us"`
+	Max   float64 `json:"max_us"`
+}
+
+// newRoleResult sums the workers' stats for stage, or all stages if -1
+func newRoleResult(workers []*stats, stage int, d time.Duration) *roleResult {
+	r := &roleResult{DurationSeconds: d.Seconds()}
+	h := NewHistogram()
+	for _, s := range workers {
+		for i := range s.messages {
+			if stage >= 0 && i != stage {
+				continue
+			}
+			r.Messages += s.messages[i]
+			r.Bytes += s.bytes[i]
+			if s.latency[i] != nil {
+				h.Merge(s.latency[i])
+			}
+		}
+	}
+	if d > 0 {
+		r.OpsPerSecond = float64(r.Messages) / d.Seconds()
+		r.MBPerSecond = float64(r.Bytes) / d.Seconds() / 1024 / 1024
+	}
+	if h.Count() > 0 {
+		us := func(d time.Duration) float64 {
+			return float64(d) / float64(time.Microsecond)
+		}
+		r.Latency = &latencyResult{
+			Min:   us(h.Min()),
+			Mean:  us(h.Mean()),
+			P50:   us(h.Quantile(0.5)),
+			P90:   us(h.Quantile(0.9)),
+			P99:   us(h.Quantile(0.99)),
+			P999:  us(h.Quantile(0.999)),
+			P9999: us(h.Quantile(0.9999)),
+			Max:   us(h.Max()),
+		}
+	}
+	return r
+}
+
+func (r *roleResult) log(prefix string) {
+	l := log.New(os.Stderr, prefix, log.LstdFlags)
+	var usPerOp float64
+	if r.Messages > 0 {
+		usPerOp = r.DurationSeconds * 1e6 / float64(r.Messages)
+	}
+	l.Printf("duration: %s - %.03fmb/s - %.03fops/s - %.03fus/op",
+		time.Duration(r.DurationSeconds*float64(time.Second)), r.MBPerSecond, r.OpsPerSecond, usPerOp)
+	if r.Latency != nil {
+		l.Printf("latency: min=%.0fus mean=%.0fus p50=%.0fus p90=%.0fus p99=%.0fus p99.9=%.0fus p99.99=%.0fus max=%.0fus",
+			r.Latency.Min, r.Latency.Mean, r.Latency.P50, r.Latency.P90, r.Latency.P99,
+			r.Latency.P999, r.Latency.P9999, r.Latency.Max)
+	}
+}
+
+func (r *result) log() {
+	for i, s := range r.Stages {
+		rates := fmt.Sprintf("%g/s", s.StartRate)
+		if s.EndRate != s.StartRate {
+			rates = fmt.Sprintf("%g-%g/s", s.StartRate, s.EndRate)
+		}
+		if s.Pub != nil {
+			s.Pub.log(fmt.Sprintf("[pub stage %d %s] ", i+1, rates))
+		}
+		if s.Sub != nil {
+			s.Sub.log(fmt.Sprintf("[sub stage %d %s] ", i+1, rates))
+		}
+	}
+	if r.Pub != nil {
+		r.Pub.log("[pub] ")
+	}
+	if r.Sub != nil {
+		r.Sub.log("[sub] ")
+	}
+}
+
+func (r *result) writeJSON(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stage publishes for duration at a rate (messages/second, across all
+// publishers) ramping linearly from startRate to endRate, or as fast as
+// possible when unthrottled
+type stage struct {
+	duration    time.Duration
+	startRate   float64
+	endRate     float64
+	unthrottled bool
+}
+
+// profile is a sequence of stages
+type profile []stage
+
+// parseRamp parses a --ramp, a comma separated list of <duration>:<rate> for
+// a constant rate or <duration>:<start rate>-<end rate> to ramp linearly,
+// e.g. "30s:0-5000,2m:5000". A rate of 0 pauses publishing.
+func parseRamp(s string) (profile, error) {
+	var p profile
+	for _, part := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(part), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid stage %q, should be <duration>:<rate> or <duration>:<start rate>-<end rate>", part)
+		}
+		d, err := time.ParseDuration(parts[0])
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid stage %q duration", part)
+		}
+		rates := strings.SplitN(parts[1], "-", 2)
+		if len(rates) == 1 {
+			rates = append(rates, rates[0])
+		}
+		var st = stage{duration: d}
+		st.startRate, err = strconv.ParseFloat(rates[0], 64)
+		if err != nil || st.startRate < 0 {
+			return nil, fmt.Errorf("invalid stage %q start rate", part)
+		}
+		st.endRate, err = strconv.ParseFloat(rates[1], 64)
+		if err != nil || st.endRate < 0 {
+			return nil, fmt.Errorf("invalid stage %q end rate", part)
+		}
+		p = append(p, st)
+	}
+	return p, nil
+}
+
+func (p profile) duration() time.Duration {
+	var d time.Duration
+	for _, s := range p {
+		d += s.duration
+	}
+	return d
+}
+
+// stageAt returns the index of the stage at elapsed, and how far into it
+func (p profile) stageAt(elapsed time.Duration) (int, time.Duration) {
+	for i, s := range p {
+		if elapsed < s.duration {
+			return i, elapsed
+		}
+		elapsed -= s.duration
+	}
+	return len(p) - 1, p[len(p)-1].duration
+}
+
+// timeOf returns when the n'th message (from 0) is due, the time at which
+// n messages have been published at the profile's rates, or false if that's
+// after the profile ends. Unthrottled stages are skipped.
+func (p profile) timeOf(n float64) (time.Duration, bool) {
+	var elapsed time.Duration
+	for _, s := range p {
+		if s.unthrottled {
+			elapsed += s.duration
+			continue
+		}
+		d := s.duration.Seconds()
+		count := (s.startRate + s.endRate) / 2 * d
+		if n >= count {
+			n -= count
+			elapsed += s.duration
+			continue
+		}
+		// solve startRate*x + (endRate-startRate)/d * x^2/2 = n for x
+		var x float64
+		accel := (s.endRate - s.startRate) / d
+		if accel == 0 {
+			x = n / s.startRate
+		} else {
+			x = (-s.startRate + math.Sqrt(s.startRate*s.startRate+2*accel*n)) / accel
+		}
+		return elapsed + time.Duration(x*float64(time.Second)), true
+	}
+	return 0, false
+}
+
+// sizer draws message sizes from a distribution
+type sizer struct {
+	distribution string
+	size         int
+	min          int
+	max          int
+	stddev       float64
+	rand         *rand.Rand
+}
+
+func newSizer(distribution string, size int, min int, max int, stddev float64) (*sizer, error) {
+	switch distribution {
+	case "fixed", "uniform", "normal", "exponential":
+	default:
+		return nil, fmt.Errorf("--size-distribution should be fixed, uniform, normal or exponential")
+	}
+	if max == 0 {
+		max = size
+		if distribution != "fixed" {
+			max = size * 4
+		}
+	}
+	if size < 0 || min < 0 || min > max || (distribution != "uniform" && (size < min || size > max)) {
+		return nil, fmt.Errorf("--size should be between --size-min and --size-max")
+	}
+	if distribution == "normal" && stddev <= 0 {
+		stddev = float64(size) / 4
+	}
+	return &sizer{
+		distribution: distribution,
+		size:         size,
+		min:          min,
+		max:          max,
+		stddev:       stddev,
+		rand:         rand.New(rand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+// clone returns a sizer with its own source, for use by another goroutine
+func (s *sizer) clone() *sizer {
+	c := *s
+	c.rand = rand.New(rand.NewSource(s.rand.Int63()))
+	return &c
+}
+
+func (s *sizer) next() int {
+	var v float64
+	switch s.distribution {
+	case "fixed":
+		return s.size
+	case "uniform":
+		return s.min + s.rand.Intn(s.max-s.min+1)
+	case "normal":
+		v = s.rand.NormFloat64()*s.stddev + float64(s.size)
+	case "exponential":
+		v = s.rand.ExpFloat64() * float64(s.size)
+	}
+	n := int(math.Round(v))
+	if n < s.min {
+		n = s.min
+	}
+	if n > s.max {
+		n = s.max
+	}
+	return n
+}
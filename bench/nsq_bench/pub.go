@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+// stats are what a worker measured in each stage
+type stats struct {
+	messages []int64
+	bytes    []int64
+	latency  []*Histogram
+}
+
+func newStats(stages int) *stats {
+	return &stats{
+		messages: make([]int64, stages),
+		bytes:    make([]int64, stages),
+		latency:  make([]*Histogram, stages),
+	}
+}
+
+func (s *stats) record(stage int, size int, latency time.Duration) {
+	s.messages[stage]++
+	s.bytes[stage] += int64(size)
+	if s.latency[stage] == nil {
+		s.latency[stage] = NewHistogram()
+	}
+	s.latency[stage].Record(latency)
+}
+
+// pubWorker publishes to topic following the profile, its share of the
+// rate being 1/workers. When throttled, each message is scheduled for an
+// intended time and its latency measured from then, rather than from when
+// it was actually sent, so that stalls in nsqd aren't hidden by the
+// publisher falling behind (coordinated omission).
+//
+// With timestamps the intended time is written to the first 8 bytes of
+// each message, for subWorker to measure end to end latency.
+type pubWorker struct {
+	id         int
+	addr       string
+	topic      string
+	batchSize  int
+	workers    int
+	profile    profile
+	sizer      *sizer
+	timestamps bool
+
+	rw      *bufio.ReadWriter
+	payload []byte
+	stats   *stats
+}
+
+func (w *pubWorker) connect() {
+	conn, err := net.DialTimeout("tcp", w.addr, time.Second)
+	if err != nil {
+		log.Fatalf("failed to connect to %s - %s", w.addr, err)
+	}
+	conn.Write(nsq.MagicV2)
+	w.rw = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	w.payload = make([]byte, w.sizer.max*w.batchSize)
+	w.stats = newStats(len(w.profile))
+}
+
+func (w *pubWorker) run(start time.Time) {
+	end := start.Add(w.profile.duration())
+	batch := make([][]byte, 0, w.batchSize)
+	intended := make([]time.Time, 0, w.batchSize)
+	// this worker's messages are every workers'th of the schedule
+	var seq float64
+	next := func() (time.Time, bool) {
+		d, ok := w.profile.timeOf(seq*float64(w.workers) + float64(w.id))
+		return start.Add(d), ok
+	}
+	due, scheduled := next()
+	for {
+		now := time.Now()
+		if !now.Before(end) {
+			return
+		}
+		stage, _ := w.profile.stageAt(now.Sub(start))
+		batch = batch[:0]
+		intended = intended[:0]
+		if w.profile[stage].unthrottled {
+			for len(batch) < w.batchSize {
+				batch = append(batch, w.message(len(batch), now))
+				intended = append(intended, now)
+			}
+		} else {
+			// every message that is due, however far behind schedule
+			for len(batch) < w.batchSize && scheduled && !due.After(now) {
+				batch = append(batch, w.message(len(batch), due))
+				intended = append(intended, due)
+				seq++
+				due, scheduled = next()
+			}
+			if len(batch) == 0 {
+				wait := end
+				if scheduled && due.Before(end) {
+					wait = due
+				}
+				time.Sleep(time.Until(wait))
+				continue
+			}
+		}
+
+		w.publish(batch)
+		done := time.Now()
+		atomic.AddInt64(&publishedCount, int64(len(batch)))
+		for i, body := range batch {
+			stage, _ := w.profile.stageAt(intended[i].Sub(start))
+			w.stats.record(stage, len(body), done.Sub(intended[i]))
+		}
+	}
+}
+
+// message returns the i'th message of a batch, reusing the payload buffer
+func (w *pubWorker) message(i int, intended time.Time) []byte {
+	offset := i * w.sizer.max
+	body := w.payload[offset : offset+w.sizer.next()]
+	if w.timestamps {
+		binary.BigEndian.PutUint64(body, uint64(intended.UnixNano()))
+	}
+	return body
+}
+
+func (w *pubWorker) publish(batch [][]byte) {
+	var cmd *nsq.Command
+	if len(batch) == 1 {
+		cmd = nsq.Publish(w.topic, batch[0])
+	} else {
+		var err error
+		cmd, err = nsq.MultiPublish(w.topic, batch)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	_, err := cmd.WriteTo(w.rw)
+	if err == nil {
+		err = w.rw.Flush()
+	}
+	if err != nil {
+		log.Fatalf("failed to publish - %s", err)
+	}
+	for {
+		resp, err := nsq.ReadResponse(w.rw)
+		if err != nil {
+			log.Fatalf("failed to publish - %s", err)
+		}
+		frameType, data, err := nsq.UnpackResponse(resp)
+		if err != nil {
+			log.Fatalf("failed to publish - %s", err)
+		}
+		if frameType == nsq.FrameTypeError {
+			log.Fatalf("failed to publish - %s", data)
+		}
+		if string(data) != "_heartbeat_" {
+			return
+		}
+		nsq.Nop().WriteTo(w.rw)
+		w.rw.Flush()
+	}
+}
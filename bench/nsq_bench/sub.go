@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+// subWorker consumes topic/channel until stopped. With timestamps, the end
+// to end latency of each message is measured from the intended time
+// pubWorker wrote to it.
+type subWorker struct {
+	addr       string
+	topic      string
+	channel    string
+	rdy        int
+	profile    profile
+	timestamps bool
+
+	conn  net.Conn
+	rw    *bufio.ReadWriter
+	stats *stats
+	// when the last message was received
+	last time.Time
+}
+
+func (w *subWorker) connect() {
+	conn, err := net.DialTimeout("tcp", w.addr, time.Second)
+	if err != nil {
+		log.Fatalf("failed to connect to %s - %s", w.addr, err)
+	}
+	conn.Write(nsq.MagicV2)
+	w.conn = conn
+	w.rw = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	w.stats = newStats(len(w.profile))
+
+	cmd, _ := nsq.Identify(map[string]interface{}{"client_id": "nsq_bench"})
+	cmd.WriteTo(w.rw)
+	nsq.Subscribe(w.topic, w.channel).WriteTo(w.rw)
+	w.rw.Flush()
+	// the IDENTIFY and SUB responses
+	for i := 0; i < 2; i++ {
+		w.readFrame()
+	}
+}
+
+// stop closes the connection, ending run
+func (w *subWorker) stop() {
+	w.conn.Close()
+}
+
+func (w *subWorker) run(start time.Time) {
+	nsq.Ready(w.rdy).WriteTo(w.rw)
+	w.rw.Flush()
+	for {
+		// flush FINs before waiting for more messages
+		if w.rw.Reader.Buffered() == 0 {
+			err := w.rw.Flush()
+			if err != nil {
+				break
+			}
+		}
+		frameType, data, err := w.readFrame()
+		if err != nil {
+			if strings.Contains(err.Error(), "use of closed network connection") {
+				break
+			}
+			log.Fatalf("failed to read from %s - %s", w.addr, err)
+		}
+		if frameType == nsq.FrameTypeResponse && string(data) == "_heartbeat_" {
+			nsq.Nop().WriteTo(w.rw)
+			continue
+		}
+		if frameType != nsq.FrameTypeMessage {
+			continue
+		}
+		received := time.Now()
+		msg, err := nsq.DecodeMessage(data)
+		if err != nil {
+			log.Fatalf("failed to decode message - %s", err)
+		}
+		nsq.Finish(msg.ID).WriteTo(w.rw)
+		w.last = received
+		atomic.AddInt64(&receivedCount, 1)
+
+		if w.timestamps && len(msg.Body) >= 8 {
+			intended := time.Unix(0, int64(binary.BigEndian.Uint64(msg.Body)))
+			stage, _ := w.profile.stageAt(intended.Sub(start))
+			w.stats.record(stage, len(msg.Body), received.Sub(intended))
+		} else {
+			stage, _ := w.profile.stageAt(received.Sub(start))
+			w.stats.messages[stage]++
+			w.stats.bytes[stage] += int64(len(msg.Body))
+		}
+	}
+}
+
+func (w *subWorker) readFrame() (int32, []byte, error) {
+	resp, err := nsq.ReadResponse(w.rw)
+	if err != nil {
+		return 0, nil, err
+	}
+	frameType, data, err := nsq.UnpackResponse(resp)
+	if err != nil {
+		return 0, nil, err
+	}
+	if frameType == nsq.FrameTypeError {
+		log.Fatalf("error from %s - %s", w.addr, data)
+	}
+	return frameType, data, nil
+}
@@ -1,5 +1,7 @@
 module github.com/nsqio/nsq
 
+go 1.24
+
 require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/bitly/go-hostpool v0.0.0-20171023180738-a3a6125de932
@@ -10,10 +12,10 @@ require (
 	github.com/golang/snappy v0.0.0-20180518054509-2e65f85255db
 	github.com/judwhite/go-svc v1.0.0
 	github.com/julienschmidt/httprouter v1.2.0
+	github.com/klauspost/compress v1.18.0
 	github.com/mreiferson/go-options v0.0.0-20190302015348-0c63f026bcd6
-	github.com/nsqio/go-diskqueue v0.0.0-20180306152900-74cfbc9de839
 	github.com/nsqio/go-nsq v1.0.7
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/testify v1.2.2 // indirect
-	golang.org/x/sys v0.0.0-20181221143128-b4a75ba826a6 // indirect
+	golang.org/x/sys v0.0.0-20181221143128-b4a75ba826a6
 )
@@ -0,0 +1,84 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+)
+
+const maxIncludeDepth = 8
+
+// LoadConfig decodes the TOML config file at path.
+//
+// The file may contain an `include` option, either a single pattern or a list of
+// patterns, naming other config files to merge over its own values. Patterns are
+// globs (or directories, meaning all *.toml files within), relative to the directory
+// of the including file. Matches are merged in lexical order so that, for example,
+// `include = "conf.d/*.toml"` lets 99-host.toml override 00-base.toml.
+func LoadConfig(path string) (map[string]interface{}, error) {
+	return loadConfig(path, 0)
+}
+
+func loadConfig(path string, depth int) (map[string]interface{}, error) {
+	if depth > maxIncludeDepth {
+		return nil, fmt.Errorf("%s - includes nested more than %d deep (cycle?)", path, maxIncludeDepth)
+	}
+
+	var cfg map[string]interface{}
+	_, err := toml.DecodeFile(path, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		cfg = make(map[string]interface{})
+	}
+
+	include, ok := cfg["include"]
+	if !ok {
+		return cfg, nil
+	}
+	delete(cfg, "include")
+
+	var patterns []string
+	switch v := include.(type) {
+	case string:
+		patterns = []string{v}
+	case []interface{}:
+		for _, p := range v {
+			s, ok := p.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s - include must be a string or list of strings", path)
+			}
+			patterns = append(patterns, s)
+		}
+	default:
+		return nil, fmt.Errorf("%s - include must be a string or list of strings", path)
+	}
+
+	dir := filepath.Dir(path)
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		if fi, err := os.Stat(pattern); err == nil && fi.IsDir() {
+			pattern = filepath.Join(pattern, "*.toml")
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s - invalid include %q - %s", path, pattern, err)
+		}
+		for _, match := range matches {
+			included, err := loadConfig(match, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			for k, v := range included {
+				cfg[k] = v
+			}
+		}
+	}
+
+	return cfg, nil
+}
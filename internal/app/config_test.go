@@ -0,0 +1,41 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestLoadConfigInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsq-test-config")
+	test.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	os.Mkdir(filepath.Join(dir, "conf.d"), 0755)
+	files := map[string]string{
+		"nsqd.cfg":            "mem_queue_size = 1\ndata_path = \"/data\"\ninclude = \"conf.d\"\n",
+		"conf.d/00-base.toml": "mem_queue_size = 2\nsync_every = 10\n",
+		"conf.d/99-host.toml": "mem_queue_size = 3\n",
+	}
+	for name, data := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644)
+		test.Nil(t, err)
+	}
+
+	cfg, err := LoadConfig(filepath.Join(dir, "nsqd.cfg"))
+	test.Nil(t, err)
+	test.Equal(t, int64(3), cfg["mem_queue_size"])
+	test.Equal(t, int64(10), cfg["sync_every"])
+	test.Equal(t, "/data", cfg["data_path"])
+	_, ok := cfg["include"]
+	test.Equal(t, false, ok)
+
+	// an include cycle is an error
+	err = ioutil.WriteFile(filepath.Join(dir, "conf.d/50-loop.toml"), []byte("include = \"../nsqd.cfg\"\n"), 0644)
+	test.Nil(t, err)
+	_, err = LoadConfig(filepath.Join(dir, "nsqd.cfg"))
+	test.NotNil(t, err)
+}
@@ -0,0 +1,61 @@
+package app
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// EnvName returns the environment variable for a flag, e.g. NSQD_MEM_QUEUE_SIZE for
+// prefix "NSQD_" and flag "mem-queue-size"
+func EnvName(prefix string, flagName string) string {
+	return prefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// EnvConfig overlays environment variables onto cfg (which may be nil) for every
+// field of the options struct opts that has a `flag` tag.
+//
+// Because options.Resolve prefers explicitly set flags over cfg, overlaying the
+// environment onto the config file values results in the documented precedence of
+// flags > environment > config file. List values may be comma separated.
+//
+// Values for fields whose type implements flag.Value (e.g. lg.LogLevel) are parsed
+// with Set, as they would be on the command line.
+func EnvConfig(prefix string, opts interface{}, cfg map[string]interface{}) (map[string]interface{}, error) {
+	if cfg == nil {
+		cfg = make(map[string]interface{})
+	}
+
+	val := reflect.ValueOf(opts).Elem()
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		flagName := field.Tag.Get("flag")
+		if flagName == "" {
+			continue
+		}
+		cfgName := field.Tag.Get("cfg")
+		if cfgName == "" {
+			cfgName = strings.Replace(flagName, "-", "_", -1)
+		}
+		envName := EnvName(prefix, flagName)
+		v, ok := os.LookupEnv(envName)
+		if !ok {
+			continue
+		}
+		ptr := reflect.New(field.Type)
+		if fv, ok := ptr.Interface().(flag.Value); ok {
+			err := fv.Set(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q for %s - %s", v, envName, err)
+			}
+			cfg[cfgName] = ptr.Elem().Interface()
+			continue
+		}
+		cfg[cfgName] = v
+	}
+
+	return cfg, nil
+}
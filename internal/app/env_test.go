@@ -0,0 +1,37 @@
+package app
+
+import (
+	"os"
+	"testing"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestEnvConfig(t *testing.T) {
+	opts := &struct {
+		MemQueueSize     int64    `flag:"mem-queue-size"`
+		LookupdAddresses []string `flag:"lookupd-tcp-address" cfg:"nsqlookupd_tcp_addresses"`
+		DataPath         string   `flag:"data-path"`
+		Unexposed        int
+	}{}
+
+	os.Setenv("TEST_MEM_QUEUE_SIZE", "100")
+	os.Setenv("TEST_LOOKUPD_TCP_ADDRESS", "127.0.0.1:4160,127.0.0.2:4160")
+	defer os.Unsetenv("TEST_MEM_QUEUE_SIZE")
+	defer os.Unsetenv("TEST_LOOKUPD_TCP_ADDRESS")
+
+	cfg, err := EnvConfig("TEST_", opts, map[string]interface{}{
+		"mem_queue_size": 10,
+		"data_path":      "/data",
+	})
+	test.Nil(t, err)
+
+	test.Equal(t, "100", cfg["mem_queue_size"])
+	test.Equal(t, "127.0.0.1:4160,127.0.0.2:4160", cfg["nsqlookupd_tcp_addresses"])
+	test.Equal(t, "/data", cfg["data_path"])
+	test.Equal(t, 3, len(cfg))
+
+	cfg, err = EnvConfig("NONE_", opts, nil)
+	test.Nil(t, err)
+	test.Equal(t, 0, len(cfg))
+}
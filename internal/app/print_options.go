@@ -0,0 +1,60 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// PrintOptions writes the resolved values of all fields of the options struct opts
+// that have a `flag` tag to w, as config file (TOML) key/value pairs. The values of
+// fields tagged `secret:"true"` are redacted.
+func PrintOptions(w io.Writer, opts interface{}) {
+	val := reflect.ValueOf(opts).Elem()
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		flagName := field.Tag.Get("flag")
+		if flagName == "" {
+			continue
+		}
+		cfgName := field.Tag.Get("cfg")
+		if cfgName == "" {
+			cfgName = strings.Replace(flagName, "-", "_", -1)
+		}
+		if field.Tag.Get("secret") == "true" && !val.Field(i).IsZero() {
+			fmt.Fprintf(w, "%s = \"<redacted>\"\n", cfgName)
+			continue
+		}
+		fmt.Fprintf(w, "%s = %s\n", cfgName, formatOption(val.Field(i)))
+	}
+}
+
+func formatOption(v reflect.Value) string {
+	switch x := v.Interface().(type) {
+	case string:
+		return fmt.Sprintf("%q", x)
+	case time.Duration:
+		return fmt.Sprintf("%q", x.String())
+	case []string:
+		quoted := make([]string, len(x))
+		for i, s := range x {
+			quoted[i] = fmt.Sprintf("%q", s)
+		}
+		return "[" + strings.Join(quoted, ", ") + "]"
+	case []float64:
+		strs := make([]string, len(x))
+		for i, f := range x {
+			strs[i] = fmt.Sprintf("%v", f)
+		}
+		return "[" + strings.Join(strs, ", ") + "]"
+	}
+	if v.CanAddr() {
+		if s, ok := v.Addr().Interface().(fmt.Stringer); ok {
+			return fmt.Sprintf("%q", strings.ToLower(s.String()))
+		}
+	}
+	return fmt.Sprintf("%v", v.Interface())
+}
@@ -0,0 +1,151 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SecretProvider fetches the secret identified by ref (the part of an option
+// value following "<scheme>:")
+type SecretProvider func(ref string) (string, error)
+
+var secretProviders = struct {
+	sync.RWMutex
+	m map[string]SecretProvider
+}{m: map[string]SecretProvider{
+	"env":   envSecret,
+	"vault": vaultSecret,
+}}
+
+// RegisterSecretProvider makes provider available for option values of the form
+// "<scheme>:<ref>" (e.g. to add a KMS backend)
+func RegisterSecretProvider(scheme string, provider SecretProvider) {
+	secretProviders.Lock()
+	secretProviders.m[scheme] = provider
+	secretProviders.Unlock()
+}
+
+// ResolveSecrets replaces the values of string and []string fields of the options
+// struct opts that are tagged `secret:"true"` with the secret they reference:
+//
+//     @/path/to/file           contents of the file (trailing newline removed)
+//     env:NAME                 value of the environment variable NAME
+//     vault:secret/path#key    key of the Vault secret at path (via $VAULT_ADDR and $VAULT_TOKEN)
+//
+// Any other value is used as is.
+func ResolveSecrets(opts interface{}) error {
+	val := reflect.ValueOf(opts).Elem()
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.Tag.Get("secret") != "true" {
+			continue
+		}
+		switch v := val.Field(i).Interface().(type) {
+		case string:
+			s, err := resolveSecret(v)
+			if err != nil {
+				return fmt.Errorf("failed to resolve --%s - %s", field.Tag.Get("flag"), err)
+			}
+			val.Field(i).SetString(s)
+		case []string:
+			resolved := make([]string, len(v))
+			for j, e := range v {
+				s, err := resolveSecret(e)
+				if err != nil {
+					return fmt.Errorf("failed to resolve --%s - %s", field.Tag.Get("flag"), err)
+				}
+				resolved[j] = s
+			}
+			val.Field(i).Set(reflect.ValueOf(resolved))
+		}
+	}
+	return nil
+}
+
+func resolveSecret(v string) (string, error) {
+	if strings.HasPrefix(v, "@") {
+		data, err := ioutil.ReadFile(v[1:])
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	i := strings.Index(v, ":")
+	if i == -1 {
+		return v, nil
+	}
+	secretProviders.RLock()
+	provider, ok := secretProviders.m[v[:i]]
+	secretProviders.RUnlock()
+	if !ok {
+		return v, nil
+	}
+	return provider(v[i+1:])
+}
+
+func envSecret(name string) (string, error) {
+	s, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s not set", name)
+	}
+	return s, nil
+}
+
+func vaultSecret(ref string) (string, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", errors.New("VAULT_ADDR not set")
+	}
+	parts := strings.SplitN(ref, "#", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid vault reference %q (expected <path>#<key>)", ref)
+	}
+	path, key := parts[0], parts[1]
+
+	req, err := http.NewRequest("GET", strings.TrimRight(addr, "/")+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("vault returned %s", resp.Status)
+	}
+
+	// KV version 2 nests the secret's data under data.data
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	err = json.Unmarshal(body, &secret)
+	if err != nil {
+		return "", err
+	}
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	s, ok := data[key].(string)
+	if !ok {
+		return "", fmt.Errorf("key %q not found in vault secret %s", key, path)
+	}
+	return s, nil
+}
@@ -0,0 +1,65 @@
+package app
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestResolveSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsq-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "secret")
+	test.Nil(t, ioutil.WriteFile(path, []byte("from-file\n"), 0600))
+
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" || r.URL.Path != "/v1/secret/data/nsq" {
+			w.WriteHeader(403)
+			return
+		}
+		fmt.Fprint(w, `{"data":{"data":{"endpoint":"from-vault"}}}`)
+	}))
+	defer vault.Close()
+
+	os.Setenv("TEST_SECRET", "from-env")
+	os.Setenv("VAULT_ADDR", vault.URL)
+	os.Setenv("VAULT_TOKEN", "token")
+	defer os.Unsetenv("TEST_SECRET")
+	defer os.Unsetenv("VAULT_ADDR")
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	opts := &struct {
+		File    string   `flag:"file" secret:"true"`
+		Env     string   `flag:"env" secret:"true"`
+		Vault   string   `flag:"vault" secret:"true"`
+		List    []string `flag:"list" secret:"true"`
+		Literal string   `flag:"literal" secret:"true"`
+		Public  string   `flag:"public"`
+	}{
+		File:    "@" + path,
+		Env:     "env:TEST_SECRET",
+		Vault:   "vault:secret/data/nsq#endpoint",
+		List:    []string{"env:TEST_SECRET", "plain"},
+		Literal: "http://127.0.0.1:8080",
+		Public:  "env:TEST_SECRET",
+	}
+	test.Nil(t, ResolveSecrets(opts))
+	test.Equal(t, "from-file", opts.File)
+	test.Equal(t, "from-env", opts.Env)
+	test.Equal(t, "from-vault", opts.Vault)
+	test.Equal(t, []string{"from-env", "plain"}, opts.List)
+	test.Equal(t, "http://127.0.0.1:8080", opts.Literal)
+	test.Equal(t, "env:TEST_SECRET", opts.Public)
+
+	opts.Vault = "vault:secret/data/other#endpoint"
+	test.NotNil(t, ResolveSecrets(opts))
+	opts.Vault = "env:TEST_MISSING_SECRET"
+	test.NotNil(t, ResolveSecrets(opts))
+}
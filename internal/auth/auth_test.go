@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestFileProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsq-auth")
+	test.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "auth.json")
+
+	err = ioutil.WriteFile(path, []byte(`{
+		"ttl": 60,
+		"identities": [
+			{"secret": "abc", "identity": "billing", "authorizations": [
+				{"topic": "^billing", "channels": [".*"], "permissions": ["publish"]}
+			], "quotas": {"max_topics": 2, "max_publish_rate": 10.5}},
+			{"common_name": "reporting.example.com", "identity": "reporting", "authorizations": [
+				{"topic": ".*", "channels": ["^reports$"], "permissions": ["subscribe"]}
+			]}
+		]
+	}`), 0600)
+	test.Nil(t, err)
+
+	p, err := NewFileProvider(path)
+	test.Nil(t, err)
+
+	state, err := p.Authorize(&Request{Secret: "abc"})
+	test.Nil(t, err)
+	test.Equal(t, "billing", state.Identity)
+	test.Equal(t, 60, state.TTL)
+	test.Equal(t, false, state.IsExpired())
+	test.Equal(t, true, state.IsAllowed("billing_events", ""))
+	test.Equal(t, false, state.IsAllowed("billing_events", "ch"))
+	test.Equal(t, Quotas{MaxTopics: 2, MaxPublishRate: 10.5}, state.Quotas)
+
+	state, err = p.Authorize(&Request{TLS: true, CommonName: "reporting.example.com"})
+	test.Nil(t, err)
+	test.Equal(t, "reporting", state.Identity)
+	test.Equal(t, true, state.IsAllowed("events", "reports"))
+
+	state, err = p.Authorize(&Request{Secret: "abcd"})
+	test.Nil(t, err)
+	test.Equal(t, 0, len(state.Authorizations))
+
+	// changes are reloaded, and bad ones ignored
+	err = ioutil.WriteFile(path, []byte(`{"ttl": 60, "identities": [{"secret": "def"}]}`), 0600)
+	test.Nil(t, err)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	state, err = p.Authorize(&Request{Secret: "abc"})
+	test.Nil(t, err)
+	test.Equal(t, "", state.Identity)
+	state, err = p.Authorize(&Request{Secret: "def"})
+	test.Nil(t, err)
+	test.Equal(t, 0, len(state.Authorizations))
+
+	err = ioutil.WriteFile(path, []byte(`{"ttl": 60, "identities": [{"identity": "nobody"}]}`), 0600)
+	test.Nil(t, err)
+	os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second))
+	state, err = p.Authorize(&Request{Secret: "def"})
+	test.Nil(t, err)
+	test.Equal(t, 0, len(state.Authorizations))
+
+	_, err = NewFileProvider(path)
+	test.NotNil(t, err)
+}
+
+func TestPluginProvider(t *testing.T) {
+	var status string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		test.Equal(t, 2, r.ProtoMajor)
+		test.Equal(t, pluginMethod, r.URL.Path)
+		test.Equal(t, "application/grpc", r.Header.Get("Content-Type"))
+
+		body, _ := ioutil.ReadAll(r.Body)
+		test.Equal(t, int(binary.BigEndian.Uint32(body[1:5])), len(body)-5)
+		var req Request
+		err := decodeFields(body[5:], func(field uint64, wireType uint64, v uint64, data []byte) {
+			switch field {
+			case 1:
+				req.RemoteIP = string(data)
+			case 2:
+				req.TLS = v == 1
+			case 3:
+				req.CommonName = string(data)
+			case 4:
+				req.Secret = string(data)
+			}
+		})
+		test.Nil(t, err)
+		test.Equal(t, Request{RemoteIP: "127.0.0.1", TLS: true, CommonName: "cn", Secret: "abc"}, req)
+
+		w.Header().Set("Content-Type", "application/grpc")
+		if status != "0" {
+			w.Header().Set("Grpc-Status", status)
+			w.Header().Set("Grpc-Message", "no%20way")
+			return
+		}
+		var a []byte
+		a = appendString(a, 1, ".*")
+		a = appendString(a, 2, "^ch$")
+		a = appendString(a, 3, "subscribe")
+		a = appendString(a, 3, "publish")
+		var msg []byte
+		msg = append(msg, 1<<3|wireVarint, 30)
+		msg = appendString(msg, 2, "someone")
+		msg = appendString(msg, 4, string(a))
+		var q []byte
+		q = append(q, 1<<3|wireVarint, 5)
+		q = append(q, 2<<3|wireFixed64)
+		q = binary.LittleEndian.AppendUint64(q, math.Float64bits(2.5))
+		msg = appendString(msg, 5, string(q))
+		// an unknown field is ignored
+		msg = appendString(msg, 9, "future")
+		resp := make([]byte, 5, 5+len(msg))
+		binary.BigEndian.PutUint32(resp[1:5], uint32(len(msg)))
+		w.Write(append(resp, msg...))
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	}))
+	srv.Config.Protocols = &http.Protocols{}
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	defer srv.Close()
+
+	p, err := NewPluginProvider(strings.TrimPrefix(srv.URL, "http://"), time.Second, time.Second)
+	test.Nil(t, err)
+	req := &Request{RemoteIP: "127.0.0.1", TLS: true, CommonName: "cn", Secret: "abc"}
+
+	status = "0"
+	state, err := p.Authorize(req)
+	test.Nil(t, err)
+	test.Equal(t, 30, state.TTL)
+	test.Equal(t, "someone", state.Identity)
+	test.Equal(t, 1, len(state.Authorizations))
+	test.Equal(t, []string{"subscribe", "publish"}, state.Authorizations[0].Permissions)
+	test.Equal(t, Quotas{MaxTopics: 5, MaxPublishRate: 2.5}, state.Quotas)
+	test.Equal(t, true, state.IsAllowed("topic", "ch"))
+	test.Equal(t, false, state.IsAllowed("topic", "ch2"))
+
+	status = "7"
+	_, err = p.Authorize(req)
+	test.NotNil(t, err)
+	test.Equal(t, true, strings.Contains(err.Error(), `7 "no way"`))
+}
@@ -1,15 +1,8 @@
 package auth
 
 import (
-	"errors"
-	"fmt"
-	"log"
-	"math/rand"
-	"net/url"
 	"regexp"
 	"time"
-
-	"github.com/nsqio/nsq/internal/http_api"
 )
 
 type Authorization struct {
@@ -18,11 +11,22 @@ type Authorization struct {
 	Permissions []string `json:"permissions"`
 }
 
+// Quotas limit what an identity may do across all of its connections to an
+// nsqd (0 is unlimited)
+type Quotas struct {
+	// topics it may create
+	MaxTopics int `json:"max_topics"`
+	// messages per second it may publish
+	MaxPublishRate float64 `json:"max_publish_rate"`
+	MaxConnections int     `json:"max_connections"`
+}
+
 type State struct {
 	TTL            int             `json:"ttl"`
 	Authorizations []Authorization `json:"authorizations"`
 	Identity       string          `json:"identity"`
 	IdentityURL    string          `json:"identity_url"`
+	Quotas         Quotas          `json:"quotas"`
 	Expires        time.Time
 }
 
@@ -76,68 +80,3 @@ func (a *State) IsExpired() bool {
 	}
 	return false
 }
-
-func QueryAnyAuthd(authd []string, remoteIP string, tlsEnabled bool, commonName string, authSecret string,
-	connectTimeout time.Duration, requestTimeout time.Duration) (*State, error) {
-	start := rand.Int()
-	n := len(authd)
-	for i := 0; i < n; i++ {
-		a := authd[(i+start)%n]
-		authState, err := QueryAuthd(a, remoteIP, tlsEnabled, commonName, authSecret, connectTimeout, requestTimeout)
-		if err != nil {
-			log.Printf("Error: failed auth against %s %s", a, err)
-			continue
-		}
-		return authState, nil
-	}
-	return nil, errors.New("Unable to access auth server")
-}
-
-func QueryAuthd(authd string, remoteIP string, tlsEnabled bool, commonName string, authSecret string,
-	connectTimeout time.Duration, requestTimeout time.Duration) (*State, error) {
-	v := url.Values{}
-	v.Set("remote_ip", remoteIP)
-	if tlsEnabled {
-		v.Set("tls", "true")
-	} else {
-		v.Set("tls", "false")
-	}
-	v.Set("secret", authSecret)
-	v.Set("common_name", commonName)
-
-	endpoint := fmt.Sprintf("http://%s/auth?%s", authd, v.Encode())
-
-	var authState State
-	client := http_api.NewClient(nil, connectTimeout, requestTimeout)
-	if err := client.GETV1(endpoint, &authState); err != nil {
-		return nil, err
-	}
-
-	// validation on response
-	for _, auth := range authState.Authorizations {
-		for _, p := range auth.Permissions {
-			switch p {
-			case "subscribe", "publish":
-			default:
-				return nil, fmt.Errorf("unknown permission %s", p)
-			}
-		}
-
-		if _, err := regexp.Compile(auth.Topic); err != nil {
-			return nil, fmt.Errorf("unable to compile topic %q %s", auth.Topic, err)
-		}
-
-		for _, channel := range auth.Channels {
-			if _, err := regexp.Compile(channel); err != nil {
-				return nil, fmt.Errorf("unable to compile channel %q %s", channel, err)
-			}
-		}
-	}
-
-	if authState.TTL <= 0 {
-		return nil, fmt.Errorf("invalid TTL %d (must be >0)", authState.TTL)
-	}
-
-	authState.Expires = time.Now().Add(time.Duration(authState.TTL) * time.Second)
-	return &authState, nil
-}
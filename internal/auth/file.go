@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileIdentity is an identity in an auth file, matched by its secret, the
+// common name of its TLS client certificate, or both
+type FileIdentity struct {
+	Secret         string          `json:"secret"`
+	CommonName     string          `json:"common_name"`
+	Identity       string          `json:"identity"`
+	IdentityURL    string          `json:"identity_url"`
+	Authorizations []Authorization `json:"authorizations"`
+	Quotas         Quotas          `json:"quotas"`
+}
+
+type fileConfig struct {
+	TTL        int            `json:"ttl"`
+	Identities []FileIdentity `json:"identities"`
+}
+
+// FileProvider authorizes clients from a JSON file, e.g.
+//
+//	{
+//	    "ttl": 3600,
+//	    "identities": [
+//	        {
+//	            "secret": "...",
+//	            "identity": "billing",
+//	            "authorizations": [
+//	                {"topic": "^billing\\.", "channels": [".*"], "permissions": ["subscribe", "publish"]}
+//	            ],
+//	            "quotas": {"max_topics": 10, "max_publish_rate": 1000, "max_connections": 20}
+//	        }
+//	    ]
+//	}
+//
+// The file is reloaded when it changes, taking effect for clients as their
+// authorizations expire after ttl seconds. Clients that match no identity
+// have no authorizations.
+type FileProvider struct {
+	path string
+
+	sync.Mutex
+	modTime time.Time
+	config  *fileConfig
+}
+
+func NewFileProvider(path string) (*FileProvider, error) {
+	p := &FileProvider{path: path}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	p.config, err = loadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p.modTime = fi.ModTime()
+	return p, nil
+}
+
+func loadFile(path string) (*fileConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config fileConfig
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s - %s", path, err)
+	}
+	if config.TTL <= 0 {
+		return nil, fmt.Errorf("invalid ttl %d in %s (must be >0)", config.TTL, path)
+	}
+	for i, identity := range config.Identities {
+		if identity.Secret == "" && identity.CommonName == "" {
+			return nil, fmt.Errorf("identity %d (%s) in %s has neither a secret nor a common_name",
+				i, identity.Identity, path)
+		}
+		state := State{TTL: config.TTL, Authorizations: identity.Authorizations, Quotas: identity.Quotas}
+		if err := state.validate(); err != nil {
+			return nil, fmt.Errorf("identity %d (%s) in %s - %s", i, identity.Identity, path, err)
+		}
+	}
+	return &config, nil
+}
+
+// reload loads the file again if it has changed since it was last loaded,
+// keeping the last good config if it can't be
+func (p *FileProvider) reload() *fileConfig {
+	p.Lock()
+	defer p.Unlock()
+	fi, err := os.Stat(p.path)
+	if err != nil {
+		log.Printf("Error: failed to stat auth file %s - %s", p.path, err)
+		return p.config
+	}
+	if fi.ModTime().Equal(p.modTime) {
+		return p.config
+	}
+	config, err := loadFile(p.path)
+	if err != nil {
+		log.Printf("Error: failed to reload auth file - %s", err)
+		return p.config
+	}
+	p.config = config
+	p.modTime = fi.ModTime()
+	return p.config
+}
+
+func (p *FileProvider) Authorize(req *Request) (*State, error) {
+	config := p.reload()
+	for _, identity := range config.Identities {
+		if identity.Secret != "" &&
+			subtle.ConstantTimeCompare([]byte(identity.Secret), []byte(req.Secret)) != 1 {
+			continue
+		}
+		if identity.CommonName != "" && identity.CommonName != req.CommonName {
+			continue
+		}
+		state := &State{
+			TTL:            config.TTL,
+			Authorizations: identity.Authorizations,
+			Identity:       identity.Identity,
+			IdentityURL:    identity.IdentityURL,
+			Quotas:         identity.Quotas,
+		}
+		if err := state.validate(); err != nil {
+			return nil, err
+		}
+		return state, nil
+	}
+	return &State{
+		TTL:     config.TTL,
+		Expires: time.Now().Add(time.Duration(config.TTL) * time.Second),
+	}, nil
+}
+
+func (p *FileProvider) String() string {
+	return "file(" + p.path + ")"
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nsqio/nsq/internal/http_api"
+)
+
+// HTTPProvider queries any of a set of auth servers, nsqd's original
+// --auth-http-address protocol
+type HTTPProvider struct {
+	Addresses      []string
+	ConnectTimeout time.Duration
+	RequestTimeout time.Duration
+}
+
+func (p *HTTPProvider) Authorize(req *Request) (*State, error) {
+	return QueryAnyAuthd(p.Addresses, req.RemoteIP, req.TLS, req.CommonName, req.Secret,
+		p.ConnectTimeout, p.RequestTimeout)
+}
+
+func (p *HTTPProvider) String() string {
+	return "http(" + strings.Join(p.Addresses, ",") + ")"
+}
+
+func QueryAnyAuthd(authd []string, remoteIP string, tlsEnabled bool, commonName string, authSecret string,
+	connectTimeout time.Duration, requestTimeout time.Duration) (*State, error) {
+	start := rand.Int()
+	n := len(authd)
+	for i := 0; i < n; i++ {
+		a := authd[(i+start)%n]
+		authState, err := QueryAuthd(a, remoteIP, tlsEnabled, commonName, authSecret, connectTimeout, requestTimeout)
+		if err != nil {
+			log.Printf("Error: failed auth against %s %s", a, err)
+			continue
+		}
+		return authState, nil
+	}
+	return nil, errors.New("Unable to access auth server")
+}
+
+func QueryAuthd(authd string, remoteIP string, tlsEnabled bool, commonName string, authSecret string,
+	connectTimeout time.Duration, requestTimeout time.Duration) (*State, error) {
+	v := url.Values{}
+	v.Set("remote_ip", remoteIP)
+	if tlsEnabled {
+		v.Set("tls", "true")
+	} else {
+		v.Set("tls", "false")
+	}
+	v.Set("secret", authSecret)
+	v.Set("common_name", commonName)
+
+	endpoint := fmt.Sprintf("http://%s/auth?%s", authd, v.Encode())
+
+	var authState State
+	client := http_api.NewClient(nil, connectTimeout, requestTimeout)
+	if err := client.GETV1(endpoint, &authState); err != nil {
+		return nil, err
+	}
+
+	// validation on response
+	if err := authState.validate(); err != nil {
+		return nil, err
+	}
+	return &authState, nil
+}
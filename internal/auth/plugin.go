@@ -0,0 +1,280 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// pluginMethod is the path of the Authorize method in plugin.proto
+const pluginMethod = "/nsq.auth.v1.Authorizer/Authorize"
+
+// PluginProvider authorizes clients with an external gRPC service that
+// implements plugin.proto, listening on a TCP <addr>:<port> or a
+// unix:<path> socket.
+//
+// Only what nsqd needs of gRPC (unary calls over cleartext HTTP/2 without
+// compression) is implemented here, rather than taking on its dependencies.
+type PluginProvider struct {
+	address        string
+	endpoint       string
+	requestTimeout time.Duration
+	client         *http.Client
+}
+
+func NewPluginProvider(address string, connectTimeout time.Duration, requestTimeout time.Duration) (*PluginProvider, error) {
+	host := address
+	var unixPath string
+	if strings.HasPrefix(address, "unix:") {
+		unixPath = strings.TrimPrefix(strings.TrimPrefix(address, "unix:"), "//")
+		if unixPath == "" {
+			return nil, fmt.Errorf("invalid plugin address %s", address)
+		}
+		host = "localhost"
+	} else if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("invalid plugin address %s - %s", address, err)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	transport := &http.Transport{
+		Protocols: &protocols,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if unixPath != "" {
+				return dialer.DialContext(ctx, "unix", unixPath)
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+		IdleConnTimeout: 90 * time.Second,
+	}
+	return &PluginProvider{
+		address:        address,
+		endpoint:       "http://" + host + pluginMethod,
+		requestTimeout: requestTimeout,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   requestTimeout,
+		},
+	}, nil
+}
+
+func (p *PluginProvider) Authorize(req *Request) (*State, error) {
+	msg := encodeAuthorizeRequest(req)
+	// a gRPC message is prefixed with whether it's compressed and its length
+	body := make([]byte, 5+len(msg))
+	binary.BigEndian.PutUint32(body[1:5], uint32(len(msg)))
+	copy(body[5:], msg)
+
+	httpReq, err := http.NewRequest("POST", p.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/grpc")
+	httpReq.Header.Set("TE", "trailers")
+	if p.requestTimeout > 0 {
+		httpReq.Header.Set("Grpc-Timeout", fmt.Sprintf("%dm", p.requestTimeout/time.Millisecond))
+	}
+
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("got response %s calling %s", resp.Status, pluginMethod)
+	}
+
+	// the status is in the trailers, or the headers when there's no message
+	status := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+		message = resp.Header.Get("Grpc-Message")
+	}
+	if status != "0" {
+		message, _ = url.PathUnescape(message)
+		return nil, fmt.Errorf("got status %s %q calling %s", status, message, pluginMethod)
+	}
+
+	if len(data) < 5 {
+		return nil, errors.New("invalid response message")
+	}
+	if data[0] != 0 {
+		return nil, errors.New("compressed response messages are not supported")
+	}
+	n := binary.BigEndian.Uint32(data[1:5])
+	if uint32(len(data)-5) < n {
+		return nil, errors.New("truncated response message")
+	}
+	state, err := decodeAuthorizeResponse(data[5 : 5+n])
+	if err != nil {
+		return nil, err
+	}
+
+	if err := state.validate(); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (p *PluginProvider) String() string {
+	return "plugin(" + p.address + ")"
+}
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendString(b []byte, field uint64, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = appendVarint(b, field<<3|wireBytes)
+	b = appendVarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendBool(b []byte, field uint64, v bool) []byte {
+	if !v {
+		return b
+	}
+	b = appendVarint(b, field<<3|wireVarint)
+	return append(b, 1)
+}
+
+// decodeFields calls fn with each field of a protobuf message, with v set
+// for varints and fixed width fields and data for length delimited fields
+func decodeFields(b []byte, fn func(field uint64, wireType uint64, v uint64, data []byte)) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("invalid protobuf field")
+		}
+		b = b[n:]
+		field, wireType := tag>>3, tag&7
+		var v uint64
+		var data []byte
+		switch wireType {
+		case wireVarint:
+			v, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errors.New("invalid protobuf varint")
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return errors.New("invalid protobuf fixed64")
+			}
+			v = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return errors.New("invalid protobuf length")
+			}
+			data = b[n : n+int(l)]
+			b = b[n+int(l):]
+		case wireFixed32:
+			if len(b) < 4 {
+				return errors.New("invalid protobuf fixed32")
+			}
+			v = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", wireType)
+		}
+		fn(field, wireType, v, data)
+	}
+	return nil
+}
+
+func encodeAuthorizeRequest(req *Request) []byte {
+	var b []byte
+	b = appendString(b, 1, req.RemoteIP)
+	b = appendBool(b, 2, req.TLS)
+	b = appendString(b, 3, req.CommonName)
+	b = appendString(b, 4, req.Secret)
+	return b
+}
+
+func decodeAuthorizeResponse(b []byte) (*State, error) {
+	var state State
+	var authErr error
+	err := decodeFields(b, func(field uint64, wireType uint64, v uint64, data []byte) {
+		switch {
+		case field == 1 && wireType == wireVarint:
+			state.TTL = int(int32(v))
+		case field == 2 && wireType == wireBytes:
+			state.Identity = string(data)
+		case field == 3 && wireType == wireBytes:
+			state.IdentityURL = string(data)
+		case field == 4 && wireType == wireBytes:
+			var a Authorization
+			err := decodeFields(data, func(field uint64, wireType uint64, v uint64, data []byte) {
+				if wireType != wireBytes {
+					return
+				}
+				switch field {
+				case 1:
+					a.Topic = string(data)
+				case 2:
+					a.Channels = append(a.Channels, string(data))
+				case 3:
+					a.Permissions = append(a.Permissions, string(data))
+				}
+			})
+			if err != nil {
+				authErr = err
+			}
+			state.Authorizations = append(state.Authorizations, a)
+		case field == 5 && wireType == wireBytes:
+			err := decodeFields(data, func(field uint64, wireType uint64, v uint64, data []byte) {
+				switch {
+				case field == 1 && wireType == wireVarint:
+					state.Quotas.MaxTopics = int(int32(v))
+				case field == 2 && wireType == wireFixed64:
+					state.Quotas.MaxPublishRate = math.Float64frombits(v)
+				case field == 3 && wireType == wireVarint:
+					state.Quotas.MaxConnections = int(int32(v))
+				}
+			})
+			if err != nil {
+				authErr = err
+			}
+		}
+	})
+	if err == nil {
+		err = authErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode response - %s", err)
+	}
+	return &state, nil
+}
@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// Request is what nsqd knows about a client when it sends AUTH
+type Request struct {
+	RemoteIP   string
+	TLS        bool
+	CommonName string
+	Secret     string
+}
+
+// Provider authorizes clients, returning the topics and channels they may
+// publish and subscribe to. An error fails the client's AUTH; a State
+// without Authorizations denies it.
+type Provider interface {
+	Authorize(req *Request) (*State, error)
+	String() string
+}
+
+// validate checks the permissions and patterns of a State returned by a
+// Provider, and sets when it expires from its TTL
+func (a *State) validate() error {
+	for _, auth := range a.Authorizations {
+		for _, p := range auth.Permissions {
+			switch p {
+			case "subscribe", "publish":
+			default:
+				return fmt.Errorf("unknown permission %s", p)
+			}
+		}
+
+		if _, err := regexp.Compile(auth.Topic); err != nil {
+			return fmt.Errorf("unable to compile topic %q %s", auth.Topic, err)
+		}
+
+		for _, channel := range auth.Channels {
+			if _, err := regexp.Compile(channel); err != nil {
+				return fmt.Errorf("unable to compile channel %q %s", channel, err)
+			}
+		}
+	}
+
+	if a.Quotas.MaxTopics < 0 || a.Quotas.MaxPublishRate < 0 || a.Quotas.MaxConnections < 0 {
+		return fmt.Errorf("invalid quotas %+v (must be >=0)", a.Quotas)
+	}
+
+	if a.TTL <= 0 {
+		return fmt.Errorf("invalid TTL %d (must be >0)", a.TTL)
+	}
+
+	a.Expires = time.Now().Add(time.Duration(a.TTL) * time.Second)
+	return nil
+}
@@ -1,6 +1,7 @@
 package clusterinfo
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/url"
@@ -8,6 +9,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/blang/semver"
 	"github.com/nsqio/nsq/internal/http_api"
@@ -34,16 +36,116 @@ func (l ErrList) Errors() []error {
 	return l
 }
 
+// NodeErr is the error from querying a single node, so that a PartialErr
+// reports which nodes failed
+type NodeErr struct {
+	Node string
+	Err  error
+}
+
+func (e NodeErr) Error() string {
+	return fmt.Sprintf("%s: %s", e.Node, e.Err)
+}
+
+// DefaultMaxConcurrency is the default number of nodes queried at once
+const DefaultMaxConcurrency = 16
+
+type cacheEntry struct {
+	body    []byte
+	expires time.Time
+}
+
 type ClusterInfo struct {
 	log    lg.AppLogFunc
 	client *http_api.Client
+
+	maxConcurrency int
+	cacheTTL       time.Duration
+
+	cacheLock sync.Mutex
+	cache     map[string]cacheEntry
 }
 
 func New(log lg.AppLogFunc, client *http_api.Client) *ClusterInfo {
 	return &ClusterInfo{
-		log:    log,
-		client: client,
+		log:            log,
+		client:         client,
+		maxConcurrency: DefaultMaxConcurrency,
+		cache:          make(map[string]cacheEntry),
+	}
+}
+
+// SetMaxConcurrency bounds the number of nodes queried at once (n <= 0 means
+// DefaultMaxConcurrency); it must be called before the ClusterInfo is used
+func (c *ClusterInfo) SetMaxConcurrency(n int) {
+	if n <= 0 {
+		n = DefaultMaxConcurrency
+	}
+	c.maxConcurrency = n
+}
+
+// SetCacheTTL enables caching of successful GET responses for ttl (0
+// disables it); it must be called before the ClusterInfo is used
+func (c *ClusterInfo) SetCacheTTL(ttl time.Duration) {
+	c.cacheTTL = ttl
+}
+
+// forEach calls f(i) for i in [0, n) with at most maxConcurrency calls in
+// flight and returns once all of them have
+func (c *ClusterInfo) forEach(n int, f func(i int)) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, c.maxConcurrency)
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			f(i)
+		}(i)
 	}
+	wg.Wait()
+}
+
+// getV1 is GETV1 served from the response cache when enabled
+func (c *ClusterInfo) getV1(endpoint string, v interface{}) error {
+	if c.cacheTTL <= 0 {
+		return c.client.GETV1(endpoint, v)
+	}
+
+	now := time.Now()
+	c.cacheLock.Lock()
+	e, ok := c.cache[endpoint]
+	c.cacheLock.Unlock()
+	if !ok || now.After(e.expires) {
+		body, err := c.client.GETV1Body(endpoint)
+		if err != nil {
+			return err
+		}
+		e = cacheEntry{body: body, expires: now.Add(c.cacheTTL)}
+
+		c.cacheLock.Lock()
+		for k, old := range c.cache {
+			if now.After(old.expires) {
+				delete(c.cache, k)
+			}
+		}
+		c.cache[endpoint] = e
+		c.cacheLock.Unlock()
+	} else {
+		c.logf("CI: cached %s", endpoint)
+	}
+	return json.Unmarshal(e.body, v)
+}
+
+// purgeCache drops all cached responses so that the effect of an action is
+// visible immediately
+func (c *ClusterInfo) purgeCache() {
+	c.cacheLock.Lock()
+	c.cache = make(map[string]cacheEntry)
+	c.cacheLock.Unlock()
 }
 
 func (c *ClusterInfo) logf(f string, args ...interface{}) {
@@ -58,7 +160,7 @@ func (c *ClusterInfo) GetVersion(addr string) (semver.Version, error) {
 	var resp struct {
 		Version string `json:"version"`
 	}
-	err := c.client.GETV1(endpoint, &resp)
+	err := c.getV1(endpoint, &resp)
 	if err != nil {
 		return semver.Version{}, err
 	}
@@ -73,36 +175,31 @@ func (c *ClusterInfo) GetVersion(addr string) (semver.Version, error) {
 func (c *ClusterInfo) GetLookupdTopics(lookupdHTTPAddrs []string) ([]string, error) {
 	var topics []string
 	var lock sync.Mutex
-	var wg sync.WaitGroup
 	var errs []error
 
 	type respType struct {
 		Topics []string `json:"topics"`
 	}
 
-	for _, addr := range lookupdHTTPAddrs {
-		wg.Add(1)
-		go func(addr string) {
-			defer wg.Done()
-
-			endpoint := fmt.Sprintf("http://%s/topics", addr)
-			c.logf("CI: querying nsqlookupd %s", endpoint)
+	c.forEach(len(lookupdHTTPAddrs), func(i int) {
+		addr := lookupdHTTPAddrs[i]
 
-			var resp respType
-			err := c.client.GETV1(endpoint, &resp)
-			if err != nil {
-				lock.Lock()
-				errs = append(errs, err)
-				lock.Unlock()
-				return
-			}
+		endpoint := fmt.Sprintf("http://%s/topics", addr)
+		c.logf("CI: querying nsqlookupd %s", endpoint)
 
+		var resp respType
+		err := c.getV1(endpoint, &resp)
+		if err != nil {
 			lock.Lock()
-			defer lock.Unlock()
-			topics = append(topics, resp.Topics...)
-		}(addr)
-	}
-	wg.Wait()
+			errs = append(errs, NodeErr{addr, err})
+			lock.Unlock()
+			return
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		topics = append(topics, resp.Topics...)
+	})
 
 	if len(errs) == len(lookupdHTTPAddrs) {
 		return nil, fmt.Errorf("Failed to query any nsqlookupd: %s", ErrList(errs))
@@ -122,36 +219,31 @@ func (c *ClusterInfo) GetLookupdTopics(lookupdHTTPAddrs []string) ([]string, err
 func (c *ClusterInfo) GetLookupdTopicChannels(topic string, lookupdHTTPAddrs []string) ([]string, error) {
 	var channels []string
 	var lock sync.Mutex
-	var wg sync.WaitGroup
 	var errs []error
 
 	type respType struct {
 		Channels []string `json:"channels"`
 	}
 
-	for _, addr := range lookupdHTTPAddrs {
-		wg.Add(1)
-		go func(addr string) {
-			defer wg.Done()
-
-			endpoint := fmt.Sprintf("http://%s/channels?topic=%s", addr, url.QueryEscape(topic))
-			c.logf("CI: querying nsqlookupd %s", endpoint)
+	c.forEach(len(lookupdHTTPAddrs), func(i int) {
+		addr := lookupdHTTPAddrs[i]
 
-			var resp respType
-			err := c.client.GETV1(endpoint, &resp)
-			if err != nil {
-				lock.Lock()
-				errs = append(errs, err)
-				lock.Unlock()
-				return
-			}
+		endpoint := fmt.Sprintf("http://%s/channels?topic=%s", addr, url.QueryEscape(topic))
+		c.logf("CI: querying nsqlookupd %s", endpoint)
 
+		var resp respType
+		err := c.getV1(endpoint, &resp)
+		if err != nil {
 			lock.Lock()
-			defer lock.Unlock()
-			channels = append(channels, resp.Channels...)
-		}(addr)
-	}
-	wg.Wait()
+			errs = append(errs, NodeErr{addr, err})
+			lock.Unlock()
+			return
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		channels = append(channels, resp.Channels...)
+	})
 
 	if len(errs) == len(lookupdHTTPAddrs) {
 		return nil, fmt.Errorf("Failed to query any nsqlookupd: %s", ErrList(errs))
@@ -170,7 +262,6 @@ func (c *ClusterInfo) GetLookupdTopicChannels(topic string, lookupdHTTPAddrs []s
 func (c *ClusterInfo) GetLookupdProducers(lookupdHTTPAddrs []string) (Producers, error) {
 	var producers []*Producer
 	var lock sync.Mutex
-	var wg sync.WaitGroup
 	var errs []error
 
 	producersByAddr := make(map[string]*Producer)
@@ -180,43 +271,39 @@ func (c *ClusterInfo) GetLookupdProducers(lookupdHTTPAddrs []string) (Producers,
 		Producers []*Producer `json:"producers"`
 	}
 
-	for _, addr := range lookupdHTTPAddrs {
-		wg.Add(1)
-		go func(addr string) {
-			defer wg.Done()
-
-			endpoint := fmt.Sprintf("http://%s/nodes", addr)
-			c.logf("CI: querying nsqlookupd %s", endpoint)
+	c.forEach(len(lookupdHTTPAddrs), func(i int) {
+		addr := lookupdHTTPAddrs[i]
 
-			var resp respType
-			err := c.client.GETV1(endpoint, &resp)
-			if err != nil {
-				lock.Lock()
-				errs = append(errs, err)
-				lock.Unlock()
-				return
-			}
+		endpoint := fmt.Sprintf("http://%s/nodes", addr)
+		c.logf("CI: querying nsqlookupd %s", endpoint)
 
+		var resp respType
+		err := c.getV1(endpoint, &resp)
+		if err != nil {
 			lock.Lock()
-			defer lock.Unlock()
-			for _, producer := range resp.Producers {
-				key := producer.TCPAddress()
-				p, ok := producersByAddr[key]
-				if !ok {
-					producersByAddr[key] = producer
-					producers = append(producers, producer)
-					if maxVersion.LT(producer.VersionObj) {
-						maxVersion = producer.VersionObj
-					}
-					sort.Sort(producer.Topics)
-					p = producer
+			errs = append(errs, NodeErr{addr, err})
+			lock.Unlock()
+			return
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		for _, producer := range resp.Producers {
+			key := producer.TCPAddress()
+			p, ok := producersByAddr[key]
+			if !ok {
+				producersByAddr[key] = producer
+				producers = append(producers, producer)
+				if maxVersion.LT(producer.VersionObj) {
+					maxVersion = producer.VersionObj
 				}
-				p.RemoteAddresses = append(p.RemoteAddresses,
-					fmt.Sprintf("%s/%s", addr, producer.Address()))
+				sort.Sort(producer.Topics)
+				p = producer
 			}
-		}(addr)
-	}
-	wg.Wait()
+			p.RemoteAddresses = append(p.RemoteAddresses,
+				fmt.Sprintf("%s/%s", addr, producer.Address()))
+		}
+	})
 
 	if len(errs) == len(lookupdHTTPAddrs) {
 		return nil, fmt.Errorf("Failed to query any nsqlookupd: %s", ErrList(errs))
@@ -240,44 +327,39 @@ func (c *ClusterInfo) GetLookupdProducers(lookupdHTTPAddrs []string) (Producers,
 func (c *ClusterInfo) GetLookupdTopicProducers(topic string, lookupdHTTPAddrs []string) (Producers, error) {
 	var producers Producers
 	var lock sync.Mutex
-	var wg sync.WaitGroup
 	var errs []error
 
 	type respType struct {
 		Producers Producers `json:"producers"`
 	}
 
-	for _, addr := range lookupdHTTPAddrs {
-		wg.Add(1)
-		go func(addr string) {
-			defer wg.Done()
-
-			endpoint := fmt.Sprintf("http://%s/lookup?topic=%s", addr, url.QueryEscape(topic))
-			c.logf("CI: querying nsqlookupd %s", endpoint)
+	c.forEach(len(lookupdHTTPAddrs), func(i int) {
+		addr := lookupdHTTPAddrs[i]
 
-			var resp respType
-			err := c.client.GETV1(endpoint, &resp)
-			if err != nil {
-				lock.Lock()
-				errs = append(errs, err)
-				lock.Unlock()
-				return
-			}
+		endpoint := fmt.Sprintf("http://%s/lookup?topic=%s", addr, url.QueryEscape(topic))
+		c.logf("CI: querying nsqlookupd %s", endpoint)
 
+		var resp respType
+		err := c.getV1(endpoint, &resp)
+		if err != nil {
 			lock.Lock()
-			defer lock.Unlock()
-			for _, p := range resp.Producers {
-				for _, pp := range producers {
-					if p.HTTPAddress() == pp.HTTPAddress() {
-						goto skip
-					}
+			errs = append(errs, NodeErr{addr, err})
+			lock.Unlock()
+			return
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		for _, p := range resp.Producers {
+			for _, pp := range producers {
+				if p.HTTPAddress() == pp.HTTPAddress() {
+					goto skip
 				}
-				producers = append(producers, p)
-			skip:
 			}
-		}(addr)
-	}
-	wg.Wait()
+			producers = append(producers, p)
+		skip:
+		}
+	})
 
 	if len(errs) == len(lookupdHTTPAddrs) {
 		return nil, fmt.Errorf("Failed to query any nsqlookupd: %s", ErrList(errs))
@@ -292,7 +374,6 @@ func (c *ClusterInfo) GetLookupdTopicProducers(topic string, lookupdHTTPAddrs []
 func (c *ClusterInfo) GetNSQDTopics(nsqdHTTPAddrs []string) ([]string, error) {
 	var topics []string
 	var lock sync.Mutex
-	var wg sync.WaitGroup
 	var errs []error
 
 	type respType struct {
@@ -301,31 +382,27 @@ func (c *ClusterInfo) GetNSQDTopics(nsqdHTTPAddrs []string) ([]string, error) {
 		} `json:"topics"`
 	}
 
-	for _, addr := range nsqdHTTPAddrs {
-		wg.Add(1)
-		go func(addr string) {
-			defer wg.Done()
-
-			endpoint := fmt.Sprintf("http://%s/stats?format=json", addr)
-			c.logf("CI: querying nsqd %s", endpoint)
+	c.forEach(len(nsqdHTTPAddrs), func(i int) {
+		addr := nsqdHTTPAddrs[i]
 
-			var resp respType
-			err := c.client.GETV1(endpoint, &resp)
-			if err != nil {
-				lock.Lock()
-				errs = append(errs, err)
-				lock.Unlock()
-				return
-			}
+		endpoint := fmt.Sprintf("http://%s/stats?format=json", addr)
+		c.logf("CI: querying nsqd %s", endpoint)
 
+		var resp respType
+		err := c.getV1(endpoint, &resp)
+		if err != nil {
 			lock.Lock()
-			defer lock.Unlock()
-			for _, topic := range resp.Topics {
-				topics = stringy.Add(topics, topic.Name)
-			}
-		}(addr)
-	}
-	wg.Wait()
+			errs = append(errs, NodeErr{addr, err})
+			lock.Unlock()
+			return
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		for _, topic := range resp.Topics {
+			topics = stringy.Add(topics, topic.Name)
+		}
+	})
 
 	if len(errs) == len(nsqdHTTPAddrs) {
 		return nil, fmt.Errorf("Failed to query any nsqd: %s", ErrList(errs))
@@ -343,7 +420,6 @@ func (c *ClusterInfo) GetNSQDTopics(nsqdHTTPAddrs []string) ([]string, error) {
 func (c *ClusterInfo) GetNSQDProducers(nsqdHTTPAddrs []string) (Producers, error) {
 	var producers Producers
 	var lock sync.Mutex
-	var wg sync.WaitGroup
 	var errs []error
 
 	type infoRespType struct {
@@ -352,6 +428,10 @@ func (c *ClusterInfo) GetNSQDProducers(nsqdHTTPAddrs []string) (Producers, error
 		Hostname         string `json:"hostname"`
 		HTTPPort         int    `json:"http_port"`
 		TCPPort          int    `json:"tcp_port"`
+
+		BroadcastTCPAddress   string `json:"broadcast_tcp_address"`
+		BroadcastHTTPAddress  string `json:"broadcast_http_address"`
+		BroadcastHTTPSAddress string `json:"broadcast_https_address"`
 	}
 
 	type statsRespType struct {
@@ -360,59 +440,59 @@ func (c *ClusterInfo) GetNSQDProducers(nsqdHTTPAddrs []string) (Producers, error
 		} `json:"topics"`
 	}
 
-	for _, addr := range nsqdHTTPAddrs {
-		wg.Add(1)
-		go func(addr string) {
-			defer wg.Done()
+	c.forEach(len(nsqdHTTPAddrs), func(i int) {
+		addr := nsqdHTTPAddrs[i]
 
-			endpoint := fmt.Sprintf("http://%s/info", addr)
-			c.logf("CI: querying nsqd %s", endpoint)
+		endpoint := fmt.Sprintf("http://%s/info", addr)
+		c.logf("CI: querying nsqd %s", endpoint)
 
-			var infoResp infoRespType
-			err := c.client.GETV1(endpoint, &infoResp)
-			if err != nil {
-				lock.Lock()
-				errs = append(errs, err)
-				lock.Unlock()
-				return
-			}
+		var infoResp infoRespType
+		err := c.getV1(endpoint, &infoResp)
+		if err != nil {
+			lock.Lock()
+			errs = append(errs, NodeErr{addr, err})
+			lock.Unlock()
+			return
+		}
 
-			endpoint = fmt.Sprintf("http://%s/stats?format=json&include_clients=false", addr)
-			c.logf("CI: querying nsqd %s", endpoint)
+		endpoint = fmt.Sprintf("http://%s/stats?format=json&include_clients=false", addr)
+		c.logf("CI: querying nsqd %s", endpoint)
 
-			var statsResp statsRespType
-			err = c.client.GETV1(endpoint, &statsResp)
-			if err != nil {
-				lock.Lock()
-				errs = append(errs, err)
-				lock.Unlock()
-				return
-			}
+		var statsResp statsRespType
+		err = c.getV1(endpoint, &statsResp)
+		if err != nil {
+			lock.Lock()
+			errs = append(errs, NodeErr{addr, err})
+			lock.Unlock()
+			return
+		}
 
-			var producerTopics ProducerTopics
-			for _, t := range statsResp.Topics {
-				producerTopics = append(producerTopics, ProducerTopic{Topic: t.Name})
-			}
+		var producerTopics ProducerTopics
+		for _, t := range statsResp.Topics {
+			producerTopics = append(producerTopics, ProducerTopic{Topic: t.Name})
+		}
 
-			version, err := semver.Parse(infoResp.Version)
-			if err != nil {
-				version, _ = semver.Parse("0.0.0")
-			}
+		version, err := semver.Parse(infoResp.Version)
+		if err != nil {
+			version, _ = semver.Parse("0.0.0")
+		}
 
-			lock.Lock()
-			defer lock.Unlock()
-			producers = append(producers, &Producer{
-				Version:          infoResp.Version,
-				VersionObj:       version,
-				BroadcastAddress: infoResp.BroadcastAddress,
-				Hostname:         infoResp.Hostname,
-				HTTPPort:         infoResp.HTTPPort,
-				TCPPort:          infoResp.TCPPort,
-				Topics:           producerTopics,
-			})
-		}(addr)
-	}
-	wg.Wait()
+		lock.Lock()
+		defer lock.Unlock()
+		producers = append(producers, &Producer{
+			Version:          infoResp.Version,
+			VersionObj:       version,
+			BroadcastAddress: infoResp.BroadcastAddress,
+			Hostname:         infoResp.Hostname,
+			HTTPPort:         infoResp.HTTPPort,
+			TCPPort:          infoResp.TCPPort,
+			Topics:           producerTopics,
+
+			BroadcastTCPAddress:   infoResp.BroadcastTCPAddress,
+			BroadcastHTTPAddress:  infoResp.BroadcastHTTPAddress,
+			BroadcastHTTPSAddress: infoResp.BroadcastHTTPSAddress,
+		})
+	})
 
 	if len(errs) == len(nsqdHTTPAddrs) {
 		return nil, fmt.Errorf("Failed to query any nsqd: %s", ErrList(errs))
@@ -428,7 +508,6 @@ func (c *ClusterInfo) GetNSQDProducers(nsqdHTTPAddrs []string) (Producers, error
 func (c *ClusterInfo) GetNSQDTopicProducers(topic string, nsqdHTTPAddrs []string) (Producers, error) {
 	var producers Producers
 	var lock sync.Mutex
-	var wg sync.WaitGroup
 	var errs []error
 
 	type infoRespType struct {
@@ -437,6 +516,10 @@ func (c *ClusterInfo) GetNSQDTopicProducers(topic string, nsqdHTTPAddrs []string
 		Hostname         string `json:"hostname"`
 		HTTPPort         int    `json:"http_port"`
 		TCPPort          int    `json:"tcp_port"`
+
+		BroadcastTCPAddress   string `json:"broadcast_tcp_address"`
+		BroadcastHTTPAddress  string `json:"broadcast_http_address"`
+		BroadcastHTTPSAddress string `json:"broadcast_https_address"`
 	}
 
 	type statsRespType struct {
@@ -445,78 +528,78 @@ func (c *ClusterInfo) GetNSQDTopicProducers(topic string, nsqdHTTPAddrs []string
 		} `json:"topics"`
 	}
 
-	for _, addr := range nsqdHTTPAddrs {
-		wg.Add(1)
-		go func(addr string) {
-			defer wg.Done()
-
-			endpoint := fmt.Sprintf("http://%s/stats?format=json&topic=%s&include_clients=false",
-				addr, url.QueryEscape(topic))
-			c.logf("CI: querying nsqd %s", endpoint)
+	c.forEach(len(nsqdHTTPAddrs), func(i int) {
+		addr := nsqdHTTPAddrs[i]
 
-			var statsResp statsRespType
-			err := c.client.GETV1(endpoint, &statsResp)
-			if err != nil {
-				lock.Lock()
-				errs = append(errs, err)
-				lock.Unlock()
-				return
-			}
-
-			var producerTopics ProducerTopics
-			for _, t := range statsResp.Topics {
-				producerTopics = append(producerTopics, ProducerTopic{Topic: t.Name})
-			}
-
-			for _, t := range statsResp.Topics {
-				if t.Name == topic {
-					endpoint := fmt.Sprintf("http://%s/info", addr)
-					c.logf("CI: querying nsqd %s", endpoint)
-
-					var infoResp infoRespType
-					err := c.client.GETV1(endpoint, &infoResp)
-					if err != nil {
-						lock.Lock()
-						errs = append(errs, err)
-						lock.Unlock()
-						return
-					}
+		endpoint := fmt.Sprintf("http://%s/stats?format=json&topic=%s&include_clients=false",
+			addr, url.QueryEscape(topic))
+		c.logf("CI: querying nsqd %s", endpoint)
 
-					version, err := semver.Parse(infoResp.Version)
-					if err != nil {
-						version, _ = semver.Parse("0.0.0")
-					}
+		var statsResp statsRespType
+		err := c.getV1(endpoint, &statsResp)
+		if err != nil {
+			lock.Lock()
+			errs = append(errs, NodeErr{addr, err})
+			lock.Unlock()
+			return
+		}
 
-					// if BroadcastAddress/HTTPPort are missing, use the values from `addr` for
-					// backwards compatibility
+		var producerTopics ProducerTopics
+		for _, t := range statsResp.Topics {
+			producerTopics = append(producerTopics, ProducerTopic{Topic: t.Name})
+		}
 
-					if infoResp.BroadcastAddress == "" {
-						var p string
-						infoResp.BroadcastAddress, p, _ = net.SplitHostPort(addr)
-						infoResp.HTTPPort, _ = strconv.Atoi(p)
-					}
-					if infoResp.Hostname == "" {
-						infoResp.Hostname, _, _ = net.SplitHostPort(addr)
-					}
+		for _, t := range statsResp.Topics {
+			if t.Name == topic {
+				endpoint := fmt.Sprintf("http://%s/info", addr)
+				c.logf("CI: querying nsqd %s", endpoint)
 
+				var infoResp infoRespType
+				err := c.getV1(endpoint, &infoResp)
+				if err != nil {
 					lock.Lock()
-					producers = append(producers, &Producer{
-						Version:          infoResp.Version,
-						VersionObj:       version,
-						BroadcastAddress: infoResp.BroadcastAddress,
-						Hostname:         infoResp.Hostname,
-						HTTPPort:         infoResp.HTTPPort,
-						TCPPort:          infoResp.TCPPort,
-						Topics:           producerTopics,
-					})
+					errs = append(errs, NodeErr{addr, err})
 					lock.Unlock()
-
 					return
 				}
+
+				version, err := semver.Parse(infoResp.Version)
+				if err != nil {
+					version, _ = semver.Parse("0.0.0")
+				}
+
+				// if BroadcastAddress/HTTPPort are missing, use the values from `addr` for
+				// backwards compatibility
+
+				if infoResp.BroadcastAddress == "" {
+					var p string
+					infoResp.BroadcastAddress, p, _ = net.SplitHostPort(addr)
+					infoResp.HTTPPort, _ = strconv.Atoi(p)
+				}
+				if infoResp.Hostname == "" {
+					infoResp.Hostname, _, _ = net.SplitHostPort(addr)
+				}
+
+				lock.Lock()
+				producers = append(producers, &Producer{
+					Version:          infoResp.Version,
+					VersionObj:       version,
+					BroadcastAddress: infoResp.BroadcastAddress,
+					Hostname:         infoResp.Hostname,
+					HTTPPort:         infoResp.HTTPPort,
+					TCPPort:          infoResp.TCPPort,
+					Topics:           producerTopics,
+
+					BroadcastTCPAddress:   infoResp.BroadcastTCPAddress,
+					BroadcastHTTPAddress:  infoResp.BroadcastHTTPAddress,
+					BroadcastHTTPSAddress: infoResp.BroadcastHTTPSAddress,
+				})
+				lock.Unlock()
+
+				return
 			}
-		}(addr)
-	}
-	wg.Wait()
+		}
+	})
 
 	if len(errs) == len(nsqdHTTPAddrs) {
 		return nil, fmt.Errorf("Failed to query any nsqd: %s", ErrList(errs))
@@ -537,7 +620,6 @@ func (c *ClusterInfo) GetNSQDStats(producers Producers,
 	selectedTopic string, selectedChannel string,
 	includeClients bool) ([]*TopicStats, map[string]*ChannelStats, error) {
 	var lock sync.Mutex
-	var wg sync.WaitGroup
 	var topicStatsList TopicStatsList
 	var errs []error
 
@@ -547,73 +629,69 @@ func (c *ClusterInfo) GetNSQDStats(producers Producers,
 		Topics []*TopicStats `json:"topics"`
 	}
 
-	for _, p := range producers {
-		wg.Add(1)
-		go func(p *Producer) {
-			defer wg.Done()
+	c.forEach(len(producers), func(i int) {
+		p := producers[i]
 
-			addr := p.HTTPAddress()
+		addr := p.HTTPAddress()
 
-			endpoint := fmt.Sprintf("http://%s/stats?format=json", addr)
-			if selectedTopic != "" {
-				endpoint += "&topic=" + url.QueryEscape(selectedTopic)
-				if selectedChannel != "" {
-					endpoint += "&channel=" + url.QueryEscape(selectedChannel)
-				}
+		endpoint := fmt.Sprintf("http://%s/stats?format=json", addr)
+		if selectedTopic != "" {
+			endpoint += "&topic=" + url.QueryEscape(selectedTopic)
+			if selectedChannel != "" {
+				endpoint += "&channel=" + url.QueryEscape(selectedChannel)
 			}
-			if !includeClients {
-				endpoint += "&include_clients=false"
-			}
-
-			c.logf("CI: querying nsqd %s", endpoint)
+		}
+		if !includeClients {
+			endpoint += "&include_clients=false"
+		}
 
-			var resp respType
-			err := c.client.GETV1(endpoint, &resp)
-			if err != nil {
-				lock.Lock()
-				errs = append(errs, err)
-				lock.Unlock()
-				return
-			}
+		c.logf("CI: querying nsqd %s", endpoint)
 
+		var resp respType
+		err := c.getV1(endpoint, &resp)
+		if err != nil {
 			lock.Lock()
-			defer lock.Unlock()
-			for _, topic := range resp.Topics {
-				topic.Node = addr
-				topic.Hostname = p.Hostname
-				topic.MemoryDepth = topic.Depth - topic.BackendDepth
-				if selectedTopic != "" && topic.TopicName != selectedTopic {
-					continue
+			errs = append(errs, NodeErr{addr, err})
+			lock.Unlock()
+			return
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		for _, topic := range resp.Topics {
+			topic.Node = addr
+			topic.Hostname = p.Hostname
+			topic.MemoryDepth = topic.Depth - topic.BackendDepth
+			if selectedTopic != "" && topic.TopicName != selectedTopic {
+				continue
+			}
+			topicStatsList = append(topicStatsList, topic)
+
+			for _, channel := range topic.Channels {
+				channel.Node = addr
+				channel.Hostname = p.Hostname
+				channel.TopicName = topic.TopicName
+				channel.MemoryDepth = channel.Depth - channel.BackendDepth
+				key := channel.ChannelName
+				if selectedTopic == "" {
+					key = fmt.Sprintf("%s:%s", topic.TopicName, channel.ChannelName)
 				}
-				topicStatsList = append(topicStatsList, topic)
-
-				for _, channel := range topic.Channels {
-					channel.Node = addr
-					channel.Hostname = p.Hostname
-					channel.TopicName = topic.TopicName
-					channel.MemoryDepth = channel.Depth - channel.BackendDepth
-					key := channel.ChannelName
-					if selectedTopic == "" {
-						key = fmt.Sprintf("%s:%s", topic.TopicName, channel.ChannelName)
-					}
-					channelStats, ok := channelStatsMap[key]
-					if !ok {
-						channelStats = &ChannelStats{
-							Node:        addr,
-							TopicName:   topic.TopicName,
-							ChannelName: channel.ChannelName,
-						}
-						channelStatsMap[key] = channelStats
-					}
-					for _, c := range channel.Clients {
-						c.Node = addr
+				channelStats, ok := channelStatsMap[key]
+				if !ok {
+					channelStats = &ChannelStats{
+						Node:        addr,
+						TopicName:   topic.TopicName,
+						ChannelName: channel.ChannelName,
 					}
-					channelStats.Add(channel)
+					channelStatsMap[key] = channelStats
+				}
+				for _, c := range channel.Clients {
+					c.Node = addr
 				}
+				channelStats.Add(channel)
 			}
-		}(p)
-	}
-	wg.Wait()
+		}
+	})
 
 	if len(errs) == len(producers) {
 		return nil, nil, fmt.Errorf("Failed to query any nsqd: %s", ErrList(errs))
@@ -627,14 +705,112 @@ func (c *ClusterInfo) GetNSQDStats(producers Producers,
 	return topicStatsList, channelStatsMap, nil
 }
 
+// GetNSQDHealth queries each of the given Producers and returns a per-node
+// summary of reachability, version, depth, disk usage and (when numLookupd is
+// non-zero) nsqlookupd registration
+//
+// unreachable nodes are reported in the result rather than as an error
+func (c *ClusterInfo) GetNSQDHealth(producers Producers, numLookupd int) *ClusterHealth {
+	type respType struct {
+		Health    string `json:"health"`
+		StartTime int64  `json:"start_time"`
+		Topics    []struct {
+			Depth        int64 `json:"depth"`
+			BackendDepth int64 `json:"backend_depth"`
+			DiskBytes    int64 `json:"disk_bytes"`
+			Channels     []struct {
+				Depth        int64 `json:"depth"`
+				BackendDepth int64 `json:"backend_depth"`
+				DiskBytes    int64 `json:"disk_bytes"`
+			} `json:"channels"`
+		} `json:"topics"`
+	}
+
+	nodes := make([]*NodeHealth, len(producers))
+	c.forEach(len(producers), func(i int) {
+		p := producers[i]
+		addr := p.HTTPAddress()
+		n := &NodeHealth{
+			Node:              addr,
+			Hostname:          p.Hostname,
+			BroadcastAddress:  p.BroadcastAddress,
+			TCPPort:           p.TCPPort,
+			HTTPPort:          p.HTTPPort,
+			Version:           p.Version,
+			RemoteAddresses:   p.RemoteAddresses,
+			LookupdRegistered: len(p.RemoteAddresses),
+			Inconsistent:      numLookupd > 0 && p.IsInconsistent(numLookupd),
+		}
+		nodes[i] = n
+
+		endpoint := fmt.Sprintf("http://%s/stats?format=json&include_clients=false", addr)
+		c.logf("CI: querying nsqd %s", endpoint)
+
+		var resp respType
+		err := c.getV1(endpoint, &resp)
+		if err != nil {
+			n.Error = err.Error()
+			return
+		}
+
+		n.Reachable = true
+		n.Health = resp.Health
+		n.StartTime = resp.StartTime
+		n.TopicCount = len(resp.Topics)
+		for _, t := range resp.Topics {
+			n.ChannelCount += len(t.Channels)
+			n.Depth += t.Depth
+			n.BackendDepth += t.BackendDepth
+			n.DiskBytes += t.DiskBytes
+			for _, ch := range t.Channels {
+				n.Depth += ch.Depth
+				n.BackendDepth += ch.BackendDepth
+				n.DiskBytes += ch.DiskBytes
+			}
+		}
+		n.MemoryDepth = n.Depth - n.BackendDepth
+	})
+
+	h := &ClusterHealth{
+		Nodes:    nodes,
+		Versions: make(map[string]int),
+	}
+	maxVersion, _ := semver.Parse("0.0.0")
+	for _, p := range producers {
+		if maxVersion.LT(p.VersionObj) {
+			maxVersion = p.VersionObj
+		}
+	}
+	for i, n := range nodes {
+		if n.Version != "" {
+			h.Versions[n.Version]++
+		}
+		n.OutOfDate = producers[i].VersionObj.LT(maxVersion)
+		if n.Reachable {
+			h.Reachable++
+		} else {
+			h.Unreachable++
+		}
+		if n.Inconsistent {
+			h.Inconsistent++
+		}
+		h.Depth += n.Depth
+		h.DiskBytes += n.DiskBytes
+	}
+	h.VersionSkew = len(h.Versions) > 1
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Hostname+nodes[i].Node < nodes[j].Hostname+nodes[j].Node
+	})
+	return h
+}
+
 // TombstoneNodeForTopic tombstones the given node for the given topic on all the given nsqlookupd
 // and deletes the topic from the node
 func (c *ClusterInfo) TombstoneNodeForTopic(topic string, node string, lookupdHTTPAddrs []string) error {
 	var errs []error
 
 	// tombstone the topic on all the lookupds
-	qs := fmt.Sprintf("topic=%s&node=%s", url.QueryEscape(topic), url.QueryEscape(node))
-	err := c.nsqlookupdPOST(lookupdHTTPAddrs, "topic/tombstone", qs)
+	err := c.TombstoneTopicProducer(topic, node, lookupdHTTPAddrs)
 	if err != nil {
 		pe, ok := err.(PartialErr)
 		if !ok {
@@ -653,7 +829,7 @@ func (c *ClusterInfo) TombstoneNodeForTopic(topic string, node string, lookupdHT
 	}
 
 	// delete the topic on the producer
-	qs = fmt.Sprintf("topic=%s", url.QueryEscape(topic))
+	qs := fmt.Sprintf("topic=%s", url.QueryEscape(topic))
 	err = c.producersPOST(producers, "topic/delete", qs)
 	if err != nil {
 		pe, ok := err.(PartialErr)
@@ -669,6 +845,27 @@ func (c *ClusterInfo) TombstoneNodeForTopic(topic string, node string, lookupdHT
 	return nil
 }
 
+// TombstoneTopicProducer tombstones the given node for the given topic on all the given
+// nsqlookupd without deleting the topic from the node
+func (c *ClusterInfo) TombstoneTopicProducer(topic string, node string, lookupdHTTPAddrs []string) error {
+	qs := fmt.Sprintf("topic=%s&node=%s", url.QueryEscape(topic), url.QueryEscape(node))
+	return c.nsqlookupdPOST(lookupdHTTPAddrs, "topic/tombstone", qs)
+}
+
+// MigrateTopic starts migrating the given topic from the given nsqd to the target nsqd
+// (both <host>:<http_port>), see nsqd's /topic/migrate
+func (c *ClusterInfo) MigrateTopic(topic string, node string, target string) error {
+	defer c.purgeCache()
+	endpoint := fmt.Sprintf("http://%s/topic/migrate?topic=%s&target=%s",
+		node, url.QueryEscape(topic), url.QueryEscape(target))
+	c.logf("CI: querying nsqd %s", endpoint)
+	err := c.client.POSTV1(endpoint)
+	if err != nil {
+		return NodeErr{node, err}
+	}
+	return nil
+}
+
 func (c *ClusterInfo) CreateTopicChannel(topicName string, channelName string, lookupdHTTPAddrs []string) error {
 	var errs []error
 
@@ -721,6 +918,13 @@ func (c *ClusterInfo) CreateTopicChannel(topicName string, channelName string, l
 	return nil
 }
 
+// DeclareChannel declares a channel on all the nsqlookupd, so that every nsqd
+// creates it along with the topic
+func (c *ClusterInfo) DeclareChannel(topicName string, channelName string, lookupdHTTPAddrs []string) error {
+	qs := fmt.Sprintf("topic=%s&channel=%s", url.QueryEscape(topicName), url.QueryEscape(channelName))
+	return c.nsqlookupdPOST(lookupdHTTPAddrs, "channel/declare", qs)
+}
+
 func (c *ClusterInfo) DeleteTopic(topicName string, lookupdHTTPAddrs []string, nsqdHTTPAddrs []string) error {
 	var errs []error
 
@@ -874,15 +1078,20 @@ func (c *ClusterInfo) GetTopicProducers(topicName string, lookupdHTTPAddrs []str
 }
 
 func (c *ClusterInfo) nsqlookupdPOST(addrs []string, uri string, qs string) error {
+	var lock sync.Mutex
 	var errs []error
-	for _, addr := range addrs {
+	defer c.purgeCache()
+	c.forEach(len(addrs), func(i int) {
+		addr := addrs[i]
 		endpoint := fmt.Sprintf("http://%s/%s?%s", addr, uri, qs)
 		c.logf("CI: querying nsqlookupd %s", endpoint)
 		err := c.client.POSTV1(endpoint)
 		if err != nil {
-			errs = append(errs, err)
+			lock.Lock()
+			errs = append(errs, NodeErr{addr, err})
+			lock.Unlock()
 		}
-	}
+	})
 	if len(errs) > 0 {
 		return ErrList(errs)
 	}
@@ -890,15 +1099,20 @@ func (c *ClusterInfo) nsqlookupdPOST(addrs []string, uri string, qs string) erro
 }
 
 func (c *ClusterInfo) producersPOST(pl Producers, uri string, qs string) error {
+	var lock sync.Mutex
 	var errs []error
-	for _, p := range pl {
-		endpoint := fmt.Sprintf("http://%s/%s?%s", p.HTTPAddress(), uri, qs)
+	defer c.purgeCache()
+	c.forEach(len(pl), func(i int) {
+		addr := pl[i].HTTPAddress()
+		endpoint := fmt.Sprintf("http://%s/%s?%s", addr, uri, qs)
 		c.logf("CI: querying nsqd %s", endpoint)
 		err := c.client.POSTV1(endpoint)
 		if err != nil {
-			errs = append(errs, err)
+			lock.Lock()
+			errs = append(errs, NodeErr{addr, err})
+			lock.Unlock()
 		}
-	}
+	})
 	if len(errs) > 0 {
 		return ErrList(errs)
 	}
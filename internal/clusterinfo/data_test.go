@@ -0,0 +1,75 @@
+package clusterinfo
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/http_api"
+)
+
+func TestGetLookupdTopicsBoundedPartial(t *testing.T) {
+	var inFlight, maxInFlight, requests int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			m := atomic.LoadInt32(&maxInFlight)
+			if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		fmt.Fprintf(w, `{"topics":["%s"]}`, req.Host)
+	})
+
+	var addrs []string
+	for i := 0; i < 8; i++ {
+		s := httptest.NewServer(handler)
+		defer s.Close()
+		addrs = append(addrs, strings.TrimPrefix(s.URL, "http://"))
+	}
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "boom", 500)
+	}))
+	defer bad.Close()
+	badAddr := strings.TrimPrefix(bad.URL, "http://")
+	addrs = append(addrs, badAddr)
+
+	ci := New(nil, http_api.NewClient(nil, time.Second, time.Second))
+	ci.SetMaxConcurrency(2)
+	ci.SetCacheTTL(time.Minute)
+
+	topics, err := ci.GetLookupdTopics(addrs)
+	if len(topics) != 8 {
+		t.Fatalf("expected 8 topics, got %v", topics)
+	}
+	pe, ok := err.(PartialErr)
+	if !ok || len(pe.Errors()) != 1 {
+		t.Fatalf("expected a single partial error, got %v", err)
+	}
+	if ne, ok := pe.Errors()[0].(NodeErr); !ok || ne.Node != badAddr {
+		t.Fatalf("expected error for %s, got %v", badAddr, pe.Errors()[0])
+	}
+	if m := atomic.LoadInt32(&maxInFlight); m > 2 {
+		t.Fatalf("expected at most 2 requests in flight, got %d", m)
+	}
+
+	// served from the cache
+	ci.GetLookupdTopics(addrs)
+	if n := atomic.LoadInt32(&requests); n != 8 {
+		t.Fatalf("expected 8 requests, got %d", n)
+	}
+
+	// actions invalidate the cache
+	ci.nsqlookupdPOST(addrs[:1], "topic/create", "topic=test")
+	ci.GetLookupdTopics(addrs)
+	if n := atomic.LoadInt32(&requests); n != 17 {
+		t.Fatalf("expected 17 requests, got %d", n)
+	}
+}
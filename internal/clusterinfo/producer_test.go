@@ -45,3 +45,20 @@ func TestIPv6Addresses(t *testing.T) {
 		t.Errorf("Incorrect IPv6 TCPAddress: %s", p.TCPAddress())
 	}
 }
+
+func TestBroadcastListenerAddresses(t *testing.T) {
+	p := &Producer{
+		BroadcastAddress:     "192.168.1.17",
+		TCPPort:              14150,
+		HTTPPort:             14151,
+		BroadcastTCPAddress:  "external.host:14150",
+		BroadcastHTTPAddress: "external.host:14151",
+	}
+
+	if p.HTTPAddress() != "external.host:14151" {
+		t.Errorf("Incorrect HTTPAddress: %s", p.HTTPAddress())
+	}
+	if p.TCPAddress() != "external.host:14150" {
+		t.Errorf("Incorrect TCPAddress: %s", p.TCPAddress())
+	}
+}
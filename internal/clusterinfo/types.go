@@ -33,6 +33,11 @@ type Producer struct {
 	VersionObj       semver.Version `json:"-"`
 	Topics           ProducerTopics `json:"topics"`
 	OutOfDate        bool           `json:"out_of_date"`
+
+	// <addr>:<port> of each listener, when the nsqd advertises them
+	BroadcastTCPAddress   string `json:"broadcast_tcp_address,omitempty"`
+	BroadcastHTTPAddress  string `json:"broadcast_http_address,omitempty"`
+	BroadcastHTTPSAddress string `json:"broadcast_https_address,omitempty"`
 }
 
 // UnmarshalJSON implements json.Unmarshaler and postprocesses of ProducerTopics and VersionObj
@@ -46,6 +51,10 @@ func (p *Producer) UnmarshalJSON(b []byte) error {
 		Version          string   `json:"version"`
 		Topics           []string `json:"topics"`
 		Tombstoned       []bool   `json:"tombstones"`
+
+		BroadcastTCPAddress   string `json:"broadcast_tcp_address"`
+		BroadcastHTTPAddress  string `json:"broadcast_http_address"`
+		BroadcastHTTPSAddress string `json:"broadcast_https_address"`
 	}
 	if err := json.Unmarshal(b, &r); err != nil {
 		return err
@@ -57,6 +66,10 @@ func (p *Producer) UnmarshalJSON(b []byte) error {
 		TCPPort:          r.TCPPort,
 		HTTPPort:         r.HTTPPort,
 		Version:          r.Version,
+
+		BroadcastTCPAddress:   r.BroadcastTCPAddress,
+		BroadcastHTTPAddress:  r.BroadcastHTTPAddress,
+		BroadcastHTTPSAddress: r.BroadcastHTTPSAddress,
 	}
 	for i, t := range r.Topics {
 		p.Topics = append(p.Topics, ProducerTopic{Topic: t, Tombstoned: r.Tombstoned[i]})
@@ -77,10 +90,16 @@ func (p *Producer) Address() string {
 }
 
 func (p *Producer) HTTPAddress() string {
+	if p.BroadcastHTTPAddress != "" {
+		return p.BroadcastHTTPAddress
+	}
 	return net.JoinHostPort(p.BroadcastAddress, strconv.Itoa(p.HTTPPort))
 }
 
 func (p *Producer) TCPAddress() string {
+	if p.BroadcastTCPAddress != "" {
+		return p.BroadcastTCPAddress
+	}
 	return net.JoinHostPort(p.BroadcastAddress, strconv.Itoa(p.TCPPort))
 }
 
@@ -98,6 +117,7 @@ type TopicStats struct {
 	Depth        int64           `json:"depth"`
 	MemoryDepth  int64           `json:"memory_depth"`
 	BackendDepth int64           `json:"backend_depth"`
+	DiskBytes    int64           `json:"disk_bytes"`
 	MessageCount int64           `json:"message_count"`
 	NodeStats    []*TopicStats   `json:"nodes"`
 	Channels     []*ChannelStats `json:"channels"`
@@ -111,6 +131,7 @@ func (t *TopicStats) Add(a *TopicStats) {
 	t.Depth += a.Depth
 	t.MemoryDepth += a.MemoryDepth
 	t.BackendDepth += a.BackendDepth
+	t.DiskBytes += a.DiskBytes
 	t.MessageCount += a.MessageCount
 	if a.Paused {
 		t.Paused = a.Paused
@@ -146,6 +167,7 @@ type ChannelStats struct {
 	Depth         int64           `json:"depth"`
 	MemoryDepth   int64           `json:"memory_depth"`
 	BackendDepth  int64           `json:"backend_depth"`
+	DiskBytes     int64           `json:"disk_bytes"`
 	InFlightCount int64           `json:"in_flight_count"`
 	DeferredCount int64           `json:"deferred_count"`
 	RequeueCount  int64           `json:"requeue_count"`
@@ -165,6 +187,7 @@ func (c *ChannelStats) Add(a *ChannelStats) {
 	c.Depth += a.Depth
 	c.MemoryDepth += a.MemoryDepth
 	c.BackendDepth += a.BackendDepth
+	c.DiskBytes += a.DiskBytes
 	c.InFlightCount += a.InFlightCount
 	c.DeferredCount += a.DeferredCount
 	c.RequeueCount += a.RequeueCount
@@ -304,3 +327,102 @@ type ProducersByHost struct {
 func (c ProducersByHost) Less(i, j int) bool {
 	return c.Producers[i].Hostname < c.Producers[j].Hostname
 }
+
+// NodeHealth summarizes the health of a single nsqd
+type NodeHealth struct {
+	Node              string   `json:"node"`
+	Hostname          string   `json:"hostname"`
+	BroadcastAddress  string   `json:"broadcast_address"`
+	TCPPort           int      `json:"tcp_port"`
+	HTTPPort          int      `json:"http_port"`
+	Version           string   `json:"version"`
+	OutOfDate         bool     `json:"out_of_date"`
+	Reachable         bool     `json:"reachable"`
+	Error             string   `json:"error,omitempty"`
+	Health            string   `json:"health"`
+	StartTime         int64    `json:"start_time"`
+	TopicCount        int      `json:"topic_count"`
+	ChannelCount      int      `json:"channel_count"`
+	Depth             int64    `json:"depth"`
+	MemoryDepth       int64    `json:"memory_depth"`
+	BackendDepth      int64    `json:"backend_depth"`
+	DiskBytes         int64    `json:"disk_bytes"`
+	RemoteAddresses   []string `json:"remote_addresses"`
+	LookupdRegistered int      `json:"lookupd_registered"`
+	Inconsistent      bool     `json:"inconsistent"`
+}
+
+// ClusterHealth summarizes the health of every nsqd in a cluster
+type ClusterHealth struct {
+	Nodes        []*NodeHealth  `json:"nodes"`
+	Versions     map[string]int `json:"versions"`
+	VersionSkew  bool           `json:"version_skew"`
+	Reachable    int            `json:"reachable"`
+	Unreachable  int            `json:"unreachable"`
+	Inconsistent int            `json:"inconsistent"`
+	Depth        int64          `json:"depth"`
+	DiskBytes    int64          `json:"disk_bytes"`
+}
+
+// TopicTotals are the queued, in-flight and published messages of a topic on
+// a node, or summed across nodes (with the per-node breakdown in NodeTotals)
+type TopicTotals struct {
+	TopicName     string  `json:"topic_name"`
+	Node          string  `json:"node,omitempty"`
+	Hostname      string  `json:"hostname,omitempty"`
+	Depth         int64   `json:"depth"`
+	ChannelDepth  int64   `json:"channel_depth"`
+	InFlightCount int64   `json:"in_flight_count"`
+	MessageCount  int64   `json:"message_count"`
+	MessageRate   float64 `json:"message_rate"`
+	Paused        bool    `json:"paused"`
+
+	NodeTotals []*TopicTotals `json:"nodes,omitempty"`
+}
+
+func (t *TopicTotals) add(a *TopicTotals) {
+	t.Depth += a.Depth
+	t.ChannelDepth += a.ChannelDepth
+	t.InFlightCount += a.InFlightCount
+	t.MessageCount += a.MessageCount
+	t.MessageRate += a.MessageRate
+	if a.Paused {
+		t.Paused = true
+	}
+	t.NodeTotals = append(t.NodeTotals, a)
+}
+
+// NewTopicTotals sums the per-node topic stats returned by GetNSQDStats by
+// topic, sorted by topic name. rate returns the messages per second published
+// to a topic on a node given its message count.
+func NewTopicTotals(topicStats []*TopicStats, rate func(node string, topicName string, messageCount int64) float64) []*TopicTotals {
+	var totals []*TopicTotals
+	byTopic := make(map[string]*TopicTotals)
+	for _, ts := range topicStats {
+		n := &TopicTotals{
+			TopicName:    ts.TopicName,
+			Node:         ts.Node,
+			Hostname:     ts.Hostname,
+			Depth:        ts.Depth,
+			MessageCount: ts.MessageCount,
+			MessageRate:  rate(ts.Node, ts.TopicName, ts.MessageCount),
+			Paused:       ts.Paused,
+		}
+		for _, c := range ts.Channels {
+			n.ChannelDepth += c.Depth
+			n.InFlightCount += c.InFlightCount
+		}
+
+		t, ok := byTopic[ts.TopicName]
+		if !ok {
+			t = &TopicTotals{TopicName: ts.TopicName}
+			byTopic[ts.TopicName] = t
+			totals = append(totals, t)
+		}
+		t.add(n)
+	}
+	sort.Slice(totals, func(i, j int) bool {
+		return totals[i].TopicName < totals[j].TopicName
+	})
+	return totals
+}
@@ -0,0 +1,325 @@
+package diskqueue
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// codecs data files can be compressed with, see SetCompression
+const (
+	CompressionNone = "none"
+	CompressionZstd = "zstd"
+)
+
+// ValidCompression returns whether name is a supported codec
+func ValidCompression(name string) bool {
+	return name == CompressionNone || name == CompressionZstd
+}
+
+// A compressed data file starts with compressedMagic and a codec byte, followed
+// by blocks of a 4 byte size, a 4 byte compressed size and the compressed data.
+// The magic's first byte makes it an invalid message size, so it can't be
+// mistaken for the start of an uncompressed file.
+var compressedMagic = []byte{0xff, 'D', 'Q', 'Z'}
+
+const (
+	codecZstd = byte(1)
+
+	compressedHeaderLen = 5
+	blockHeaderLen      = 8
+
+	// compressionBlockSize is how many bytes of a data file are compressed
+	// together, reading from a position decompresses at most one block in vain
+	compressionBlockSize = 256 * 1024
+)
+
+var errExiting = errors.New("exiting")
+
+type compressResult struct {
+	fileNum int64
+	tmpFn   string // empty if the file was already compressed
+	err     error
+}
+
+// compressFile writes a compressed copy of the full data file fileNum next to
+// it, for ioLoop to rename over it if it's still needed. The positions of the
+// queue are offsets in the uncompressed data so they don't change.
+func (d *diskQueue) compressFile(fileNum int64, resultChan chan compressResult) {
+	fn := d.fileName(fileNum)
+	tmpFn := fn + ".compress.tmp"
+	err := func() error {
+		in, err := os.Open(fn)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		header := make([]byte, compressedHeaderLen)
+		n, err := io.ReadFull(in, header)
+		if err == nil && bytes.Equal(header[:len(compressedMagic)], compressedMagic) {
+			tmpFn = ""
+			return nil
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		_, err = in.Seek(0, 0)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			// nothing to compress
+			tmpFn = ""
+			return nil
+		}
+
+		out, err := os.OpenFile(tmpFn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		w := bufio.NewWriter(out)
+		err = compressData(bufio.NewReader(in), w, d.exitChan)
+		if err == nil {
+			err = w.Flush()
+		}
+		if err == nil {
+			err = out.Sync()
+		}
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}()
+	if err != nil && tmpFn != "" {
+		os.Remove(tmpFn)
+	}
+	resultChan <- compressResult{fileNum, tmpFn, err}
+}
+
+// compressData writes the data read from r to w in compressed blocks (a zstd
+// frame each), giving up if exitChan is closed
+func compressData(r io.Reader, w io.Writer, exitChan chan int) error {
+	_, err := w.Write(append(append([]byte{}, compressedMagic...), codecZstd))
+	if err != nil {
+		return err
+	}
+	block := make([]byte, compressionBlockSize)
+	var compressed bytes.Buffer
+	enc, err := zstd.NewWriter(&compressed, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return err
+	}
+	header := make([]byte, blockHeaderLen)
+	for {
+		select {
+		case <-exitChan:
+			return errExiting
+		default:
+		}
+
+		n, err := io.ReadFull(r, block)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		compressed.Reset()
+		enc.Reset(&compressed)
+		_, err = enc.Write(block[:n])
+		if err == nil {
+			err = enc.Close()
+		}
+		if err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint32(header[:4], uint32(n))
+		binary.BigEndian.PutUint32(header[4:], uint32(compressed.Len()))
+		_, err = w.Write(header)
+		if err == nil {
+			_, err = w.Write(compressed.Bytes())
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// compressed renames the compressed copy of a data file over it if it hasn't
+// been read (or discarded) since
+func (d *diskQueue) compressed(res compressResult) {
+	if res.err != nil {
+		// the file may have been read (and removed) meanwhile
+		if res.err != errExiting && !os.IsNotExist(res.err) {
+			d.logf(ERROR, "DISKQUEUE(%s) failed to compress %s - %s",
+				d.name, d.fileName(res.fileNum), res.err)
+		}
+		return
+	}
+	if res.tmpFn == "" {
+		return
+	}
+	fn := d.fileName(res.fileNum)
+	if res.fileNum < d.readFileNum || res.fileNum >= d.writeFileNum {
+		os.Remove(res.tmpFn)
+		return
+	}
+	// a reader of the file keeps reading the uncompressed one
+	err := os.Rename(res.tmpFn, fn)
+	if err != nil {
+		d.logf(ERROR, "DISKQUEUE(%s) failed to rename %s - %s", d.name, res.tmpFn, err)
+		os.Remove(res.tmpFn)
+		return
+	}
+	d.updateDiskBytes()
+	d.logf(INFO, "DISKQUEUE(%s): compressed %s", d.name, fn)
+}
+
+// newDataReader returns a reader of the data file f (compressed or not) from
+// pos, an offset in its uncompressed data. f is expected to be at its start.
+func newDataReader(f *os.File, pos int64) (*bufio.Reader, error) {
+	header := make([]byte, compressedHeaderLen)
+	_, err := io.ReadFull(f, header)
+	if err == nil && bytes.Equal(header[:len(compressedMagic)], compressedMagic) {
+		br := &blockReader{r: bufio.NewReader(f), codec: header[len(compressedMagic)]}
+		if br.codec != codecZstd {
+			return nil, fmt.Errorf("unknown compression codec %d", br.codec)
+		}
+		err = br.skip(pos)
+		if err != nil {
+			return nil, err
+		}
+		return bufio.NewReader(br), nil
+	}
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	_, err = f.Seek(pos, 0)
+	if err != nil {
+		return nil, err
+	}
+	return bufio.NewReader(f), nil
+}
+
+// dataSize returns the size of the uncompressed data of the data file fn, and
+// whether it is compressed
+func dataSize(fn string) (int64, bool, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+
+	header := make([]byte, compressedHeaderLen)
+	_, err = io.ReadFull(f, header)
+	if err != nil || !bytes.Equal(header[:len(compressedMagic)], compressedMagic) {
+		fi, err := f.Stat()
+		if err != nil {
+			return 0, false, err
+		}
+		return fi.Size(), false, nil
+	}
+
+	r := bufio.NewReader(f)
+	var size int64
+	blockHeader := make([]byte, blockHeaderLen)
+	for {
+		_, err := io.ReadFull(r, blockHeader)
+		if err == io.EOF {
+			return size, true, nil
+		}
+		if err != nil {
+			return 0, true, err
+		}
+		size += int64(binary.BigEndian.Uint32(blockHeader[:4]))
+		_, err = r.Discard(int(binary.BigEndian.Uint32(blockHeader[4:])))
+		if err != nil {
+			return 0, true, err
+		}
+	}
+}
+
+// blockReader reads the uncompressed data of a compressed data file
+type blockReader struct {
+	r      *bufio.Reader
+	codec  byte
+	header [blockHeaderLen]byte
+	dec    *zstd.Decoder
+	buf    []byte
+	block  []byte // the unread data of the current block
+}
+
+func (b *blockReader) Read(p []byte) (int, error) {
+	for len(b.block) == 0 {
+		_, err := b.readBlock(0)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, b.block)
+	b.block = b.block[n:]
+	return n, nil
+}
+
+// skip moves past the first n bytes of the uncompressed data, only
+// decompressing the block they end in
+func (b *blockReader) skip(n int64) error {
+	for n > 0 {
+		size, err := b.readBlock(n)
+		if err != nil {
+			return err
+		}
+		if n < size {
+			return nil
+		}
+		n -= size
+	}
+	return nil
+}
+
+// readBlock reads the next block, skipping its first n bytes (and not
+// decompressing it at all if it's no longer than that), and returns its
+// uncompressed size
+func (b *blockReader) readBlock(n int64) (int64, error) {
+	_, err := io.ReadFull(b.r, b.header[:])
+	if err != nil {
+		return 0, err
+	}
+	size := int64(binary.BigEndian.Uint32(b.header[:4]))
+	compressedSize := int(binary.BigEndian.Uint32(b.header[4:]))
+	if n >= size {
+		_, err = b.r.Discard(compressedSize)
+		return size, err
+	}
+
+	compressed := make([]byte, compressedSize)
+	_, err = io.ReadFull(b.r, compressed)
+	if err != nil {
+		return 0, err
+	}
+	if b.dec == nil {
+		b.dec, err = zstd.NewReader(bytes.NewReader(compressed), zstd.WithDecoderConcurrency(1))
+	} else {
+		err = b.dec.Reset(bytes.NewReader(compressed))
+	}
+	if err != nil {
+		return 0, err
+	}
+	if int64(cap(b.buf)) < size {
+		b.buf = make([]byte, size)
+	}
+	b.buf = b.buf[:size]
+	_, err = io.ReadFull(b.dec, b.buf)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decompress block - %s", err)
+	}
+	b.block = b.buf[n:]
+	return size, nil
+}
@@ -0,0 +1,1096 @@
+package diskqueue
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nsqio/nsq/internal/faults"
+)
+
+// logging stuff copied from github.com/nsqio/nsq/internal/lg
+
+type LogLevel int
+
+const (
+	DEBUG = LogLevel(1)
+	INFO  = LogLevel(2)
+	WARN  = LogLevel(3)
+	ERROR = LogLevel(4)
+	FATAL = LogLevel(5)
+)
+
+type AppLogFunc func(lvl LogLevel, f string, args ...interface{})
+
+func (l LogLevel) String() string {
+	switch l {
+	case 1:
+		return "DEBUG"
+	case 2:
+		return "INFO"
+	case 3:
+		return "WARNING"
+	case 4:
+		return "ERROR"
+	case 5:
+		return "FATAL"
+	}
+	panic("invalid LogLevel")
+}
+
+type Interface interface {
+	Put([]byte) error
+	PutSync([]byte) error
+	SetSyncPolicy(SyncPolicy)
+	SetCompression(string)
+	SetLazyRead(time.Duration)
+	ReadAhead()
+	ReadChan() chan []byte // this is expected to be an *unbuffered* channel
+	Close() error
+	Delete() error
+	Depth() int64
+	DiskBytes() int64
+	Discard(int64) (int64, error)
+	DiscardOldestFile() (int64, error)
+	Snapshot(dir string) error
+	Empty() error
+}
+
+// SyncPolicy controls when a queue fsyncs
+type SyncPolicy struct {
+	Every   int64         // number of writes per fsync
+	Timeout time.Duration // duration of time per fsync
+
+	// if set, the fsyncs of synchronous writes (PutSync) are batched with those
+	// of other queues instead of happening after each write
+	Group *GroupCommitter
+}
+
+type syncWrite struct {
+	data         []byte
+	responseChan chan error
+}
+
+// diskQueue implements a filesystem backed FIFO queue
+type diskQueue struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+
+	// run-time state (also persisted to disk)
+	readPos      int64
+	writePos     int64
+	readFileNum  int64
+	writeFileNum int64
+	depth        int64
+
+	// bytes used by the data files that have not been fully read
+	diskBytes int64
+
+	sync.RWMutex
+
+	// instantiation time metadata
+	name            string
+	dataPath        string
+	maxBytesPerFile int64 // currently this cannot change once created
+	minMsgSize      int32
+	maxMsgSize      int32
+	syncEvery       int64         // number of writes per fsync
+	syncTimeout     time.Duration // duration of time per fsync
+	exitFlag        int32
+	needSync        bool
+	compression     string
+	lazyRead        time.Duration // how long a message read ahead is kept, 0 if eager
+
+	// keeps track of the position where we have read
+	// (but not yet sent over readChan)
+	nextReadPos     int64
+	nextReadFileNum int64
+
+	readFile  *os.File
+	writeFile *os.File
+	reader    *bufio.Reader
+	writeBuf  bytes.Buffer
+
+	// exposed via ReadChan()
+	readChan chan []byte
+
+	// internal channels
+	writeChan         chan []byte
+	writeSyncChan     chan syncWrite
+	writeResponseChan chan error
+	commitChan        chan int
+	syncPolicyChan    chan SyncPolicy
+	compressionChan   chan string
+	lazyReadChan      chan time.Duration
+	readAheadChan     chan int
+	discardChan       chan int64 // number of messages, or -1 for the oldest file
+	discardedChan     chan int64
+	snapshotChan      chan string
+	snapshotErrChan   chan error
+	emptyChan         chan int
+	emptyResponseChan chan error
+	exitChan          chan int
+	exitSyncChan      chan int
+
+	// synchronous writes waiting for a group commit (owned by ioLoop)
+	pendingSyncs []chan error
+
+	logf AppLogFunc
+}
+
+// New instantiates an instance of diskQueue, retrieving metadata
+// from the filesystem and starting the read ahead goroutine
+func New(name string, dataPath string, maxBytesPerFile int64,
+	minMsgSize int32, maxMsgSize int32,
+	syncEvery int64, syncTimeout time.Duration, logf AppLogFunc) Interface {
+	d := diskQueue{
+		name:              name,
+		dataPath:          dataPath,
+		maxBytesPerFile:   maxBytesPerFile,
+		minMsgSize:        minMsgSize,
+		maxMsgSize:        maxMsgSize,
+		readChan:          make(chan []byte),
+		writeChan:         make(chan []byte),
+		writeSyncChan:     make(chan syncWrite),
+		commitChan:        make(chan int),
+		syncPolicyChan:    make(chan SyncPolicy),
+		compressionChan:   make(chan string),
+		lazyReadChan:      make(chan time.Duration),
+		readAheadChan:     make(chan int, 1),
+		discardChan:       make(chan int64),
+		discardedChan:     make(chan int64),
+		snapshotChan:      make(chan string),
+		snapshotErrChan:   make(chan error),
+		writeResponseChan: make(chan error),
+		emptyChan:         make(chan int),
+		emptyResponseChan: make(chan error),
+		exitChan:          make(chan int),
+		exitSyncChan:      make(chan int),
+		syncEvery:         syncEvery,
+		syncTimeout:       syncTimeout,
+		compression:       CompressionNone,
+		logf:              logf,
+	}
+
+	// no need to lock here, nothing else could possibly be touching this instance
+	err := d.retrieveMetaData()
+	if err != nil && !os.IsNotExist(err) {
+		d.logf(ERROR, "DISKQUEUE(%s) failed to retrieveMetaData - %s", d.name, err)
+	}
+	d.updateDiskBytes()
+
+	go d.ioLoop()
+	return &d
+}
+
+// Depth returns the depth of the queue
+func (d *diskQueue) Depth() int64 {
+	return atomic.LoadInt64(&d.depth)
+}
+
+// DiskBytes returns the number of bytes used by the queue's data files
+func (d *diskQueue) DiskBytes() int64 {
+	return atomic.LoadInt64(&d.diskBytes)
+}
+
+// Discard destructively drops up to count of the oldest messages in the queue,
+// returning the number of messages discarded
+func (d *diskQueue) Discard(count int64) (int64, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return 0, errors.New("exiting")
+	}
+
+	d.discardChan <- count
+	return <-d.discardedChan, nil
+}
+
+// DiscardOldestFile destructively drops the unread data in the oldest data file,
+// returning the number of messages discarded. The file currently being written to
+// is never discarded.
+func (d *diskQueue) DiscardOldestFile() (int64, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return 0, errors.New("exiting")
+	}
+
+	d.discardChan <- -1
+	return <-d.discardedChan, nil
+}
+
+// Snapshot writes a consistent copy of the queue's unread data files and metadata
+// to dir, blocking writes while the file currently being written to is copied.
+//
+// Full data files are hard linked into dir when possible.
+func (d *diskQueue) Snapshot(dir string) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	d.snapshotChan <- dir
+	return <-d.snapshotErrChan
+}
+
+// ReadChan returns the []byte channel for reading data
+func (d *diskQueue) ReadChan() chan []byte {
+	return d.readChan
+}
+
+// Put writes a []byte to the queue
+func (d *diskQueue) Put(data []byte) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	d.writeChan <- data
+	return <-d.writeResponseChan
+}
+
+// PutSync writes a []byte to the queue and returns only once it (and the queue's
+// metadata) has been fsynced
+func (d *diskQueue) PutSync(data []byte) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	responseChan := make(chan error, 1)
+	d.writeSyncChan <- syncWrite{data, responseChan}
+	return <-responseChan
+}
+
+// SetSyncPolicy changes when the queue fsyncs
+func (d *diskQueue) SetSyncPolicy(p SyncPolicy) {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return
+	}
+
+	d.syncPolicyChan <- p
+}
+
+// SetCompression sets the codec (CompressionNone or CompressionZstd) the queue's
+// data files are compressed with once full, in the background. Already
+// compressed files stay readable whatever the codec.
+func (d *diskQueue) SetCompression(name string) {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return
+	}
+
+	d.compressionChan <- name
+}
+
+// SetLazyRead makes the queue read its next message from disk only once
+// ReadAhead is called, and drop it (releasing its read buffers) if it isn't
+// received from ReadChan within timeout. A timeout of 0 reads ahead eagerly, as
+// soon as there is a message.
+func (d *diskQueue) SetLazyRead(timeout time.Duration) {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return
+	}
+
+	d.lazyReadChan <- timeout
+}
+
+// ReadAhead tells a lazy queue (see SetLazyRead) that a reader is about to
+// receive from ReadChan, it never blocks
+func (d *diskQueue) ReadAhead() {
+	select {
+	case d.readAheadChan <- 1:
+	default:
+	}
+}
+
+// releaseRead drops the message read ahead and closes the read file, the next
+// read starts again from the read position
+func (d *diskQueue) releaseRead() {
+	if d.readFile != nil {
+		d.readFile.Close()
+		d.readFile = nil
+	}
+	d.reader = nil
+	d.nextReadFileNum = d.readFileNum
+	d.nextReadPos = d.readPos
+}
+
+// commit fsyncs the queue on behalf of the synchronous writes waiting for a group commit
+func (d *diskQueue) commit() {
+	select {
+	case d.commitChan <- 1:
+	case <-d.exitChan:
+	}
+}
+
+func (d *diskQueue) commitPending() {
+	if len(d.pendingSyncs) == 0 {
+		return
+	}
+	err := d.sync()
+	if err != nil {
+		d.logf(ERROR, "DISKQUEUE(%s) failed to sync - %s", d.name, err)
+	}
+	for _, responseChan := range d.pendingSyncs {
+		responseChan <- err
+	}
+	d.pendingSyncs = d.pendingSyncs[:0]
+}
+
+// Close cleans up the queue and persists metadata
+func (d *diskQueue) Close() error {
+	err := d.exit(false)
+	if err != nil {
+		return err
+	}
+	return d.sync()
+}
+
+func (d *diskQueue) Delete() error {
+	return d.exit(true)
+}
+
+func (d *diskQueue) exit(deleted bool) error {
+	d.Lock()
+	defer d.Unlock()
+
+	d.exitFlag = 1
+
+	if deleted {
+		d.logf(INFO, "DISKQUEUE(%s): deleting", d.name)
+	} else {
+		d.logf(INFO, "DISKQUEUE(%s): closing", d.name)
+	}
+
+	close(d.exitChan)
+	// ensure that ioLoop has exited
+	<-d.exitSyncChan
+
+	if d.readFile != nil {
+		d.readFile.Close()
+		d.readFile = nil
+	}
+
+	if d.writeFile != nil {
+		d.writeFile.Close()
+		d.writeFile = nil
+	}
+
+	return nil
+}
+
+// Empty destructively clears out any pending data in the queue
+// by fast forwarding read positions and removing intermediate files
+func (d *diskQueue) Empty() error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	d.logf(INFO, "DISKQUEUE(%s): emptying", d.name)
+
+	d.emptyChan <- 1
+	return <-d.emptyResponseChan
+}
+
+func (d *diskQueue) deleteAllFiles() error {
+	err := d.skipToNextRWFile()
+
+	innerErr := os.Remove(d.metaDataFileName())
+	if innerErr != nil && !os.IsNotExist(innerErr) {
+		d.logf(ERROR, "DISKQUEUE(%s) failed to remove metadata file - %s", d.name, innerErr)
+		return innerErr
+	}
+
+	return err
+}
+
+func (d *diskQueue) skipToNextRWFile() error {
+	var err error
+
+	if d.readFile != nil {
+		d.readFile.Close()
+		d.readFile = nil
+	}
+
+	if d.writeFile != nil {
+		d.writeFile.Close()
+		d.writeFile = nil
+	}
+
+	for i := d.readFileNum; i <= d.writeFileNum; i++ {
+		fn := d.fileName(i)
+		innerErr := os.Remove(fn)
+		if innerErr != nil && !os.IsNotExist(innerErr) {
+			d.logf(ERROR, "DISKQUEUE(%s) failed to remove data file - %s", d.name, innerErr)
+			err = innerErr
+		}
+	}
+
+	d.writeFileNum++
+	d.writePos = 0
+	d.readFileNum = d.writeFileNum
+	d.readPos = 0
+	d.nextReadFileNum = d.writeFileNum
+	d.nextReadPos = 0
+	atomic.StoreInt64(&d.depth, 0)
+	atomic.StoreInt64(&d.diskBytes, 0)
+
+	return err
+}
+
+// discard moves the read position past up to count messages, or if count is -1
+// past the remaining messages of the current read file (removing it)
+func (d *diskQueue) discard(count int64) int64 {
+	var discarded int64
+	fileNum := d.readFileNum
+	for {
+		if count == -1 {
+			if d.readFileNum != fileNum || d.readFileNum == d.writeFileNum {
+				break
+			}
+		} else if discarded == count || (d.readFileNum == d.writeFileNum && d.readPos >= d.writePos) {
+			break
+		}
+		if d.nextReadPos == d.readPos {
+			_, err := d.readOne()
+			if err != nil {
+				d.logf(ERROR, "DISKQUEUE(%s) reading at %d of %s - %s",
+					d.name, d.readPos, d.fileName(d.readFileNum), err)
+				d.handleReadError()
+				break
+			}
+		}
+		d.moveForward()
+		discarded++
+	}
+	return discarded
+}
+
+func (d *diskQueue) snapshot(dir string) error {
+	// flush and persist metadata so that the copy is consistent
+	err := d.sync()
+	if err != nil {
+		return err
+	}
+
+	for i := d.readFileNum; i <= d.writeFileNum; i++ {
+		fn := d.fileName(i)
+		dst := path.Join(dir, path.Base(fn))
+		if i < d.writeFileNum {
+			// full data files are never modified again
+			err = os.Link(fn, dst)
+			if err != nil {
+				err = copyFile(fn, dst, -1)
+			}
+		} else if d.writePos > 0 {
+			err = copyFile(fn, dst, d.writePos)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	fn := d.metaDataFileName()
+	return copyFile(fn, path.Join(dir, path.Base(fn)), -1)
+}
+
+// Restore copies the files of the queue name from a snapshot in srcDir (see
+// Snapshot) to dataPath, after checking that the snapshot is complete
+func Restore(name string, srcDir string, dataPath string) error {
+	src := &diskQueue{name: name, dataPath: srcDir}
+	err := src.retrieveMetaData()
+	if err != nil {
+		return fmt.Errorf("failed to read metadata of %s - %s", name, err)
+	}
+
+	files := []string{src.metaDataFileName()}
+	for i := src.readFileNum; i <= src.writeFileNum; i++ {
+		var minSize int64
+		if i == src.readFileNum {
+			minSize = src.readPos
+		}
+		if i == src.writeFileNum {
+			minSize = src.writePos
+			if minSize == 0 {
+				break
+			}
+		}
+		fn := src.fileName(i)
+		size, _, err := dataSize(fn)
+		if err != nil {
+			return err
+		}
+		if size < minSize {
+			return fmt.Errorf("%s is truncated (%d < %d bytes)", fn, size, minSize)
+		}
+		files = append(files, fn)
+	}
+
+	for _, fn := range files {
+		err := copyFile(fn, path.Join(dataPath, path.Base(fn)), -1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies the first n bytes of src (all if n < 0) to dst
+func copyFile(src string, dst string, n int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if n < 0 {
+		_, err = io.Copy(out, in)
+	} else {
+		_, err = io.CopyN(out, in, n)
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// updateDiskBytes recomputes the size of the data files from readFileNum
+// through writeFileNum
+func (d *diskQueue) updateDiskBytes() {
+	var total int64
+	for i := d.readFileNum; i < d.writeFileNum; i++ {
+		fi, err := os.Stat(d.fileName(i))
+		if err != nil {
+			continue
+		}
+		total += fi.Size()
+	}
+	total += d.writePos
+	atomic.StoreInt64(&d.diskBytes, total)
+}
+
+// readOne performs a low level filesystem read for a single []byte
+// while advancing read positions and rolling files, if necessary
+func (d *diskQueue) readOne() ([]byte, error) {
+	var err error
+	var msgSize int32
+
+	if d.readFile == nil {
+		curFileName := d.fileName(d.readFileNum)
+		d.readFile, err = os.OpenFile(curFileName, os.O_RDONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+
+		d.logf(INFO, "DISKQUEUE(%s): readOne() opened %s", d.name, curFileName)
+
+		// positions are offsets in the uncompressed data of compressed files
+		d.reader, err = newDataReader(d.readFile, d.readPos)
+		if err != nil {
+			d.readFile.Close()
+			d.readFile = nil
+			return nil, err
+		}
+	}
+
+	err = binary.Read(d.reader, binary.BigEndian, &msgSize)
+	if err != nil {
+		d.readFile.Close()
+		d.readFile = nil
+		return nil, err
+	}
+
+	if msgSize < d.minMsgSize || msgSize > d.maxMsgSize {
+		// this file is corrupt and we have no reasonable guarantee on
+		// where a new message should begin
+		d.readFile.Close()
+		d.readFile = nil
+		return nil, fmt.Errorf("invalid message read size (%d)", msgSize)
+	}
+
+	readBuf := make([]byte, msgSize)
+	_, err = io.ReadFull(d.reader, readBuf)
+	if err != nil {
+		d.readFile.Close()
+		d.readFile = nil
+		return nil, err
+	}
+
+	totalBytes := int64(4 + msgSize)
+
+	// we only advance next* because we have not yet sent this to consumers
+	// (where readFileNum, readPos will actually be advanced)
+	d.nextReadPos = d.readPos + totalBytes
+	d.nextReadFileNum = d.readFileNum
+
+	// TODO: each data file should embed the maxBytesPerFile
+	// as the first 8 bytes (at creation time) ensuring that
+	// the value can change without affecting runtime
+	if d.nextReadPos > d.maxBytesPerFile {
+		if d.readFile != nil {
+			d.readFile.Close()
+			d.readFile = nil
+		}
+
+		d.nextReadFileNum++
+		d.nextReadPos = 0
+	}
+
+	return readBuf, nil
+}
+
+// writeOne performs a low level filesystem write for a single []byte
+// while advancing write positions and rolling files, if necessary
+func (d *diskQueue) writeOne(data []byte) error {
+	var err error
+
+	if d.writeFile == nil {
+		curFileName := d.fileName(d.writeFileNum)
+		d.writeFile, err = os.OpenFile(curFileName, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+
+		d.logf(INFO, "DISKQUEUE(%s): writeOne() opened %s", d.name, curFileName)
+
+		if d.writePos > 0 {
+			_, err = d.writeFile.Seek(d.writePos, 0)
+			if err != nil {
+				d.writeFile.Close()
+				d.writeFile = nil
+				return err
+			}
+		}
+	}
+
+	dataLen := int32(len(data))
+
+	if dataLen < d.minMsgSize || dataLen > d.maxMsgSize {
+		return fmt.Errorf("invalid message write size (%d) maxMsgSize=%d", dataLen, d.maxMsgSize)
+	}
+
+	d.writeBuf.Reset()
+	err = binary.Write(&d.writeBuf, binary.BigEndian, dataLen)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.writeBuf.Write(data)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := faults.Inject(faults.PartialWrite); ok {
+		d.writeFile.Write(d.writeBuf.Bytes()[:d.writeBuf.Len()/2])
+		d.writeFile.Close()
+		d.writeFile = nil
+		return errors.New("partial write (injected fault)")
+	}
+
+	// only write to the file once
+	_, err = d.writeFile.Write(d.writeBuf.Bytes())
+	if err != nil {
+		d.writeFile.Close()
+		d.writeFile = nil
+		return err
+	}
+
+	totalBytes := int64(4 + dataLen)
+	d.writePos += totalBytes
+	atomic.AddInt64(&d.depth, 1)
+	atomic.AddInt64(&d.diskBytes, totalBytes)
+
+	if d.writePos > d.maxBytesPerFile {
+		d.writeFileNum++
+		d.writePos = 0
+
+		// sync every time we start writing to a new file
+		err = d.sync()
+		if err != nil {
+			d.logf(ERROR, "DISKQUEUE(%s) failed to sync - %s", d.name, err)
+		}
+
+		if d.writeFile != nil {
+			d.writeFile.Close()
+			d.writeFile = nil
+		}
+	}
+
+	return err
+}
+
+// sync fsyncs the current writeFile and persists metadata
+func (d *diskQueue) sync() error {
+	faults.Sleep(faults.FsyncDelay)
+	if d.writeFile != nil {
+		err := d.writeFile.Sync()
+		if err != nil {
+			d.writeFile.Close()
+			d.writeFile = nil
+			return err
+		}
+	}
+
+	err := d.persistMetaData()
+	if err != nil {
+		return err
+	}
+
+	d.needSync = false
+	return nil
+}
+
+// retrieveMetaData initializes state from the filesystem
+func (d *diskQueue) retrieveMetaData() error {
+	var f *os.File
+	var err error
+
+	fileName := d.metaDataFileName()
+	f, err = os.OpenFile(fileName, os.O_RDONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var depth int64
+	_, err = fmt.Fscanf(f, "%d\n%d,%d\n%d,%d\n",
+		&depth,
+		&d.readFileNum, &d.readPos,
+		&d.writeFileNum, &d.writePos)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&d.depth, depth)
+	d.nextReadFileNum = d.readFileNum
+	d.nextReadPos = d.readPos
+
+	return nil
+}
+
+// persistMetaData atomically writes state to the filesystem
+func (d *diskQueue) persistMetaData() error {
+	var f *os.File
+	var err error
+
+	fileName := d.metaDataFileName()
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
+
+	// write to tmp file
+	f, err = os.OpenFile(tmpFileName, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(f, "%d\n%d,%d\n%d,%d\n",
+		atomic.LoadInt64(&d.depth),
+		d.readFileNum, d.readPos,
+		d.writeFileNum, d.writePos)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	f.Sync()
+	f.Close()
+
+	// atomically rename
+	return os.Rename(tmpFileName, fileName)
+}
+
+func (d *diskQueue) metaDataFileName() string {
+	return fmt.Sprintf(path.Join(d.dataPath, "%s.diskqueue.meta.dat"), d.name)
+}
+
+func (d *diskQueue) fileName(fileNum int64) string {
+	return fmt.Sprintf(path.Join(d.dataPath, "%s.diskqueue.%06d.dat"), d.name, fileNum)
+}
+
+func (d *diskQueue) checkTailCorruption(depth int64) {
+	if d.readFileNum < d.writeFileNum || d.readPos < d.writePos {
+		return
+	}
+
+	// we've reached the end of the diskqueue
+	// if depth isn't 0 something went wrong
+	if depth != 0 {
+		if depth < 0 {
+			d.logf(ERROR,
+				"DISKQUEUE(%s) negative depth at tail (%d), metadata corruption, resetting 0...",
+				d.name, depth)
+		} else if depth > 0 {
+			d.logf(ERROR,
+				"DISKQUEUE(%s) positive depth at tail (%d), data loss, resetting 0...",
+				d.name, depth)
+		}
+		// force set depth 0
+		atomic.StoreInt64(&d.depth, 0)
+		d.needSync = true
+	}
+
+	if d.readFileNum != d.writeFileNum || d.readPos != d.writePos {
+		if d.readFileNum > d.writeFileNum {
+			d.logf(ERROR,
+				"DISKQUEUE(%s) readFileNum > writeFileNum (%d > %d), corruption, skipping to next writeFileNum and resetting 0...",
+				d.name, d.readFileNum, d.writeFileNum)
+		}
+
+		if d.readPos > d.writePos {
+			d.logf(ERROR,
+				"DISKQUEUE(%s) readPos > writePos (%d > %d), corruption, skipping to next writeFileNum and resetting 0...",
+				d.name, d.readPos, d.writePos)
+		}
+
+		d.skipToNextRWFile()
+		d.needSync = true
+	}
+}
+
+func (d *diskQueue) moveForward() {
+	oldReadFileNum := d.readFileNum
+	d.readFileNum = d.nextReadFileNum
+	d.readPos = d.nextReadPos
+	depth := atomic.AddInt64(&d.depth, -1)
+
+	// see if we need to clean up the old file
+	if oldReadFileNum != d.nextReadFileNum {
+		// sync every time we start reading from a new file
+		d.needSync = true
+
+		fn := d.fileName(oldReadFileNum)
+		err := os.Remove(fn)
+		if err != nil {
+			d.logf(ERROR, "DISKQUEUE(%s) failed to Remove(%s) - %s", d.name, fn, err)
+		}
+		d.updateDiskBytes()
+	}
+
+	d.checkTailCorruption(depth)
+}
+
+func (d *diskQueue) handleReadError() {
+	// jump to the next read file and rename the current (bad) file
+	if d.readFileNum == d.writeFileNum {
+		// if you can't properly read from the current write file it's safe to
+		// assume that something is fucked and we should skip the current file too
+		if d.writeFile != nil {
+			d.writeFile.Close()
+			d.writeFile = nil
+		}
+		d.writeFileNum++
+		d.writePos = 0
+	}
+
+	badFn := d.fileName(d.readFileNum)
+	badRenameFn := badFn + ".bad"
+
+	d.logf(WARN,
+		"DISKQUEUE(%s) jump to next file and saving bad file as %s",
+		d.name, badRenameFn)
+
+	err := os.Rename(badFn, badRenameFn)
+	if err != nil {
+		d.logf(ERROR,
+			"DISKQUEUE(%s) failed to rename bad diskqueue file %s to %s",
+			d.name, badFn, badRenameFn)
+	}
+
+	d.readFileNum++
+	d.readPos = 0
+	d.nextReadFileNum = d.readFileNum
+	d.nextReadPos = 0
+	d.updateDiskBytes()
+
+	// significant state change, schedule a sync on the next iteration
+	d.needSync = true
+}
+
+// ioLoop provides the backend for exposing a go channel (via ReadChan())
+// in support of multiple concurrent queue consumers
+//
+// it works by looping and branching based on whether or not the queue has data
+// to read and blocking until data is either read or written over the appropriate
+// go channels
+//
+// conveniently this also means that we're asynchronously reading from the filesystem
+func (d *diskQueue) ioLoop() {
+	var dataRead []byte
+	var err error
+	var count int64
+	var r chan []byte
+	var group *GroupCommitter
+
+	// full data files are compressed one at a time, in order
+	compressedChan := make(chan compressResult, 1)
+	compressing := false
+	compressFileNum := d.readFileNum
+
+	// a lazy queue reads once wanted, and as long as its messages are received
+	wanted := false
+	releaseTimer := time.NewTimer(time.Hour)
+	releaseTimer.Stop()
+	var releaseChan <-chan time.Time
+
+	syncTicker := time.NewTicker(d.syncTimeout)
+
+	for {
+		// dont sync all the time :)
+		if count >= d.syncEvery {
+			d.needSync = true
+		}
+
+		if d.needSync {
+			err = d.sync()
+			if err != nil {
+				d.logf(ERROR, "DISKQUEUE(%s) failed to sync - %s", d.name, err)
+			}
+			count = 0
+		}
+
+		if d.compression != CompressionNone && !compressing {
+			if compressFileNum < d.readFileNum {
+				compressFileNum = d.readFileNum
+			}
+			if compressFileNum < d.writeFileNum {
+				compressing = true
+				go d.compressFile(compressFileNum, compressedChan)
+			}
+		}
+
+		r = nil
+		releaseChan = nil
+		if (d.readFileNum < d.writeFileNum) || (d.readPos < d.writePos) {
+			if d.nextReadPos == d.readPos && (d.lazyRead == 0 || wanted) {
+				dataRead, err = d.readOne()
+				if err != nil {
+					d.logf(ERROR, "DISKQUEUE(%s) reading at %d of %s - %s",
+						d.name, d.readPos, d.fileName(d.readFileNum), err)
+					d.handleReadError()
+					continue
+				}
+				if d.lazyRead > 0 {
+					releaseTimer.Reset(d.lazyRead)
+				}
+			}
+			if d.nextReadPos != d.readPos || d.nextReadFileNum != d.readFileNum {
+				r = d.readChan
+				if d.lazyRead > 0 {
+					releaseChan = releaseTimer.C
+				}
+			}
+		}
+
+		select {
+		// the Go channel spec dictates that nil channel operations (read or write)
+		// in a select are skipped, we set r to d.readChan only when there is data to read
+		case r <- dataRead:
+			count++
+			// moveForward sets needSync flag if a file is removed
+			d.moveForward()
+		case <-d.emptyChan:
+			d.emptyResponseChan <- d.deleteAllFiles()
+			count = 0
+		case count := <-d.discardChan:
+			d.discardedChan <- d.discard(count)
+		case dir := <-d.snapshotChan:
+			d.snapshotErrChan <- d.snapshot(dir)
+			count = 0
+		case dataWrite := <-d.writeChan:
+			count++
+			d.writeResponseChan <- d.writeOne(dataWrite)
+		case w := <-d.writeSyncChan:
+			count++
+			err := d.writeOne(w.data)
+			if err == nil && group != nil {
+				d.pendingSyncs = append(d.pendingSyncs, w.responseChan)
+				group.add(d)
+				continue
+			}
+			if err == nil {
+				err = d.sync()
+				count = 0
+			}
+			w.responseChan <- err
+		case res := <-compressedChan:
+			compressing = false
+			compressFileNum = res.fileNum + 1
+			d.compressed(res)
+		case d.compression = <-d.compressionChan:
+		case d.lazyRead = <-d.lazyReadChan:
+			wanted = d.lazyRead == 0
+		case <-d.readAheadChan:
+			wanted = true
+		case <-releaseChan:
+			// not received, don't keep it in memory
+			wanted = false
+			dataRead = nil
+			d.releaseRead()
+		case <-d.commitChan:
+			d.commitPending()
+		case p := <-d.syncPolicyChan:
+			d.syncEvery = p.Every
+			if p.Timeout != d.syncTimeout {
+				d.syncTimeout = p.Timeout
+				syncTicker.Stop()
+				syncTicker = time.NewTicker(d.syncTimeout)
+			}
+			group = p.Group
+			if group == nil {
+				// don't leave writes waiting for a commit that won't come
+				d.commitPending()
+			}
+		case <-syncTicker.C:
+			if count == 0 {
+				// avoid sync when there's no activity
+				continue
+			}
+			d.needSync = true
+		case <-d.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	d.commitPending()
+	if compressing {
+		d.compressed(<-compressedChan)
+	}
+	d.logf(INFO, "DISKQUEUE(%s): closing ... ioLoop", d.name)
+	syncTicker.Stop()
+	releaseTimer.Stop()
+	d.exitSyncChan <- 1
+}
@@ -0,0 +1,884 @@
+package diskqueue
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Equal(t *testing.T, expected, actual interface{}) {
+	if !reflect.DeepEqual(expected, actual) {
+		_, file, line, _ := runtime.Caller(1)
+		t.Logf("\033[31m%s:%d:\n\n\t   %#v (expected)\n\n\t!= %#v (actual)\033[39m\n\n",
+			filepath.Base(file), line, expected, actual)
+		t.FailNow()
+	}
+}
+
+func NotEqual(t *testing.T, expected, actual interface{}) {
+	if reflect.DeepEqual(expected, actual) {
+		_, file, line, _ := runtime.Caller(1)
+		t.Logf("\033[31m%s:%d:\n\n\tnexp: %#v\n\n\tgot:  %#v\033[39m\n\n",
+			filepath.Base(file), line, expected, actual)
+		t.FailNow()
+	}
+}
+
+func Nil(t *testing.T, object interface{}) {
+	if !isNil(object) {
+		_, file, line, _ := runtime.Caller(1)
+		t.Logf("\033[31m%s:%d:\n\n\t   <nil> (expected)\n\n\t!= %#v (actual)\033[39m\n\n",
+			filepath.Base(file), line, object)
+		t.FailNow()
+	}
+}
+
+func NotNil(t *testing.T, object interface{}) {
+	if isNil(object) {
+		_, file, line, _ := runtime.Caller(1)
+		t.Logf("\033[31m%s:%d:\n\n\tExpected value not to be <nil>\033[39m\n\n",
+			filepath.Base(file), line)
+		t.FailNow()
+	}
+}
+
+func isNil(object interface{}) bool {
+	if object == nil {
+		return true
+	}
+
+	value := reflect.ValueOf(object)
+	kind := value.Kind()
+	if kind >= reflect.Chan && kind <= reflect.Slice && value.IsNil() {
+		return true
+	}
+
+	return false
+}
+
+type tbLog interface {
+	Log(...interface{})
+}
+
+func NewTestLogger(tbl tbLog) AppLogFunc {
+	return func(lvl LogLevel, f string, args ...interface{}) {
+		tbl.Log(fmt.Sprintf(lvl.String()+": "+f, args...))
+	}
+}
+
+func TestDiskQueue(t *testing.T) {
+	l := NewTestLogger(t)
+
+	dqName := "test_disk_queue" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 4, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+	NotNil(t, dq)
+	Equal(t, int64(0), dq.Depth())
+
+	msg := []byte("test")
+	err = dq.Put(msg)
+	Nil(t, err)
+	Equal(t, int64(1), dq.Depth())
+
+	msgOut := <-dq.ReadChan()
+	Equal(t, msg, msgOut)
+}
+
+func TestDiskQueueRoll(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_roll" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	msg := bytes.Repeat([]byte{0}, 10)
+	ml := int64(len(msg))
+	dq := New(dqName, tmpDir, 9*(ml+4), int32(ml), 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+	NotNil(t, dq)
+	Equal(t, int64(0), dq.Depth())
+
+	for i := 0; i < 10; i++ {
+		err := dq.Put(msg)
+		Nil(t, err)
+		Equal(t, int64(i+1), dq.Depth())
+	}
+
+	Equal(t, int64(1), dq.(*diskQueue).writeFileNum)
+	Equal(t, int64(0), dq.(*diskQueue).writePos)
+}
+
+func TestDiskQueueDiscard(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_discard" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 9*14, 10, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+	NotNil(t, dq)
+
+	// 10 messages per file
+	for i := 0; i < 25; i++ {
+		err := dq.Put([]byte(fmt.Sprintf("%010d", i)))
+		Nil(t, err)
+	}
+	Equal(t, int64(25*14), dq.DiskBytes())
+
+	n, err := dq.DiscardOldestFile()
+	Nil(t, err)
+	Equal(t, int64(10), n)
+	Equal(t, int64(15), dq.Depth())
+	Equal(t, int64(15*14), dq.DiskBytes())
+	assertFileNotExist(t, dq.(*diskQueue).fileName(0))
+
+	n, err = dq.DiscardOldestFile()
+	Nil(t, err)
+	Equal(t, int64(10), n)
+
+	// the file being written to is never discarded
+	n, err = dq.DiscardOldestFile()
+	Nil(t, err)
+	Equal(t, int64(0), n)
+	Equal(t, int64(5), dq.Depth())
+	Equal(t, []byte("0000000020"), <-dq.ReadChan())
+
+	n, err = dq.Discard(2)
+	Nil(t, err)
+	Equal(t, int64(2), n)
+	Equal(t, []byte("0000000023"), <-dq.ReadChan())
+
+	n, err = dq.Discard(10)
+	Nil(t, err)
+	Equal(t, int64(1), n)
+	Equal(t, int64(0), dq.Depth())
+}
+
+func TestDiskQueueRecover(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_recover" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 9*14, 10, 1<<10, 2500, 2*time.Second, l)
+	for i := 0; i < 25; i++ {
+		err := dq.Put([]byte(fmt.Sprintf("%010d", i)))
+		Nil(t, err)
+	}
+	for i := 0; i < 3; i++ {
+		<-dq.ReadChan()
+	}
+	Nil(t, dq.Close())
+
+	names, err := Names(tmpDir)
+	Nil(t, err)
+	Equal(t, []string{dqName}, names)
+
+	// nothing to fix
+	fixes, err := Recover(dqName, tmpDir)
+	Nil(t, err)
+	Equal(t, 0, len(fixes))
+
+	// wrong depth and a partial message at the end of the write file
+	metaFile := dq.(*diskQueue).metaDataFileName()
+	err = ioutil.WriteFile(metaFile, []byte("99\n0,42\n2,70\n"), 0600)
+	Nil(t, err)
+	f, err := os.OpenFile(dq.(*diskQueue).fileName(2), os.O_WRONLY|os.O_APPEND, 0600)
+	Nil(t, err)
+	f.Write([]byte{0, 0, 0, 10, 1})
+	f.Close()
+
+	// checking doesn't fix them
+	problems, err := Check(dqName, tmpDir)
+	Nil(t, err)
+	Equal(t, []string{
+		fmt.Sprintf("partial message at the end of %s", dq.(*diskQueue).fileName(2)),
+		"depth was 99 instead of 22",
+	}, problems)
+	problems, err = Check(dqName, tmpDir)
+	Nil(t, err)
+	Equal(t, 2, len(problems))
+
+	fixes, err = Recover(dqName, tmpDir)
+	Nil(t, err)
+	Equal(t, 2, len(fixes))
+	m := readMetaDataFile(metaFile, 0)
+	Equal(t, md{depth: 22, readFileNum: 0, readPos: 42, writeFileNum: 2, writePos: 70}, m)
+
+	// missing metadata
+	os.Remove(metaFile)
+	fixes, err = Recover(dqName, tmpDir)
+	Nil(t, err)
+	Equal(t, []string{"missing metadata"}, fixes)
+
+	dq = New(dqName, tmpDir, 9*14, 10, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+	Equal(t, int64(25), dq.Depth())
+	Equal(t, []byte("0000000000"), <-dq.ReadChan())
+}
+
+func TestDiskQueueCompression(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_compression" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	msg := func(i int) []byte {
+		return []byte(fmt.Sprintf("%010d%s", i, bytes.Repeat([]byte("a"), 190)))
+	}
+
+	// 10 messages per file
+	dq := New(dqName, tmpDir, 9*204, 200, 1<<10, 2500, 2*time.Second, l)
+	dq.SetCompression(CompressionZstd)
+	for i := 0; i < 25; i++ {
+		err := dq.Put(msg(i))
+		Nil(t, err)
+	}
+	for i := 0; i < 3; i++ {
+		Equal(t, msg(i), <-dq.ReadChan())
+	}
+
+	// the 2 full files are compressed (in order), the one being written to isn't
+	for i := 0; i < 100; i++ {
+		_, compressed, _ := dataSize(dq.(*diskQueue).fileName(1))
+		if compressed && dq.DiskBytes() < 15*204 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := int64(0); i < 2; i++ {
+		size, compressed, err := dataSize(dq.(*diskQueue).fileName(i))
+		Nil(t, err)
+		Equal(t, true, compressed)
+		Equal(t, int64(10*204), size)
+	}
+	_, compressed, err := dataSize(dq.(*diskQueue).fileName(2))
+	Nil(t, err)
+	Equal(t, false, compressed)
+	if dq.DiskBytes() >= 15*204 {
+		t.Fatalf("disk bytes %d not compressed", dq.DiskBytes())
+	}
+	Nil(t, dq.Close())
+
+	fixes, err := Recover(dqName, tmpDir)
+	Nil(t, err)
+	Equal(t, 0, len(fixes))
+
+	// reading resumes in the middle of the compressed file
+	dq = New(dqName, tmpDir, 9*204, 200, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+	Equal(t, int64(22), dq.Depth())
+	for i := 3; i < 25; i++ {
+		Equal(t, msg(i), <-dq.ReadChan())
+	}
+}
+
+func TestDiskQueueLazyRead(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_lazy_read" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 4, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+	dq.SetLazyRead(50 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		err := dq.Put([]byte(fmt.Sprintf("msg%d", i)))
+		Nil(t, err)
+	}
+
+	// nothing is read until wanted
+	select {
+	case <-dq.ReadChan():
+		t.Fatal("read without ReadAhead")
+	case <-time.After(50 * time.Millisecond):
+	}
+	dq.ReadAhead()
+	Equal(t, []byte("msg0"), <-dq.ReadChan())
+
+	// a message read ahead but not received is released, not lost
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-dq.ReadChan():
+		t.Fatal("read after release without ReadAhead")
+	case <-time.After(50 * time.Millisecond):
+	}
+	dq.ReadAhead()
+	Equal(t, []byte("msg1"), <-dq.ReadChan())
+}
+
+func assertFileNotExist(t *testing.T, fn string) {
+	f, err := os.OpenFile(fn, os.O_RDONLY, 0600)
+	Equal(t, (*os.File)(nil), f)
+	Equal(t, true, os.IsNotExist(err))
+}
+
+func TestDiskQueueEmpty(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_empty" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	msg := bytes.Repeat([]byte{0}, 10)
+	dq := New(dqName, tmpDir, 100, 0, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+	NotNil(t, dq)
+	Equal(t, int64(0), dq.Depth())
+
+	for i := 0; i < 100; i++ {
+		err := dq.Put(msg)
+		Nil(t, err)
+		Equal(t, int64(i+1), dq.Depth())
+	}
+
+	for i := 0; i < 3; i++ {
+		<-dq.ReadChan()
+	}
+
+	for {
+		if dq.Depth() == 97 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	Equal(t, int64(97), dq.Depth())
+
+	numFiles := dq.(*diskQueue).writeFileNum
+	dq.Empty()
+
+	assertFileNotExist(t, dq.(*diskQueue).metaDataFileName())
+	for i := int64(0); i <= numFiles; i++ {
+		assertFileNotExist(t, dq.(*diskQueue).fileName(i))
+	}
+	Equal(t, int64(0), dq.Depth())
+	Equal(t, dq.(*diskQueue).writeFileNum, dq.(*diskQueue).readFileNum)
+	Equal(t, dq.(*diskQueue).writePos, dq.(*diskQueue).readPos)
+	Equal(t, dq.(*diskQueue).readPos, dq.(*diskQueue).nextReadPos)
+	Equal(t, dq.(*diskQueue).readFileNum, dq.(*diskQueue).nextReadFileNum)
+
+	for i := 0; i < 100; i++ {
+		err := dq.Put(msg)
+		Nil(t, err)
+		Equal(t, int64(i+1), dq.Depth())
+	}
+
+	for i := 0; i < 100; i++ {
+		<-dq.ReadChan()
+	}
+
+	for {
+		if dq.Depth() == 0 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	Equal(t, int64(0), dq.Depth())
+	Equal(t, dq.(*diskQueue).writeFileNum, dq.(*diskQueue).readFileNum)
+	Equal(t, dq.(*diskQueue).writePos, dq.(*diskQueue).readPos)
+	Equal(t, dq.(*diskQueue).readPos, dq.(*diskQueue).nextReadPos)
+}
+
+func TestDiskQueueCorruption(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_corruption" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// require a non-zero message length for the corrupt (len 0) test below
+	dq := New(dqName, tmpDir, 1000, 10, 1<<10, 5, 2*time.Second, l)
+	defer dq.Close()
+
+	msg := make([]byte, 123) // 127 bytes per message, 8 (1016 bytes) messages per file
+	for i := 0; i < 25; i++ {
+		dq.Put(msg)
+	}
+
+	Equal(t, int64(25), dq.Depth())
+
+	// corrupt the 2nd file
+	dqFn := dq.(*diskQueue).fileName(1)
+	os.Truncate(dqFn, 500) // 3 valid messages, 5 corrupted
+
+	for i := 0; i < 19; i++ { // 1 message leftover in 4th file
+		Equal(t, msg, <-dq.ReadChan())
+	}
+
+	// corrupt the 4th (current) file
+	dqFn = dq.(*diskQueue).fileName(3)
+	os.Truncate(dqFn, 100)
+
+	dq.Put(msg) // in 5th file
+
+	Equal(t, msg, <-dq.ReadChan())
+
+	// write a corrupt (len 0) message at the 5th (current) file
+	dq.(*diskQueue).writeFile.Write([]byte{0, 0, 0, 0})
+
+	// force a new 6th file - put into 5th, then readOne errors, then put into 6th
+	dq.Put(msg)
+	dq.Put(msg)
+
+	Equal(t, msg, <-dq.ReadChan())
+}
+
+type md struct {
+	depth        int64
+	readFileNum  int64
+	writeFileNum int64
+	readPos      int64
+	writePos     int64
+}
+
+func readMetaDataFile(fileName string, retried int) md {
+	f, err := os.OpenFile(fileName, os.O_RDONLY, 0600)
+	if err != nil {
+		// provide a simple retry that results in up to
+		// another 500ms for the file to be written.
+		if retried < 9 {
+			retried++
+			time.Sleep(50 * time.Millisecond)
+			return readMetaDataFile(fileName, retried)
+		}
+		panic(err)
+	}
+	defer f.Close()
+
+	var ret md
+	_, err = fmt.Fscanf(f, "%d\n%d,%d\n%d,%d\n",
+		&ret.depth,
+		&ret.readFileNum, &ret.readPos,
+		&ret.writeFileNum, &ret.writePos)
+	if err != nil {
+		panic(err)
+	}
+	return ret
+}
+
+func TestDiskQueueSyncAfterRead(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_read_after_sync" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1<<11, 0, 1<<10, 2500, 50*time.Millisecond, l)
+	defer dq.Close()
+
+	msg := make([]byte, 1000)
+	dq.Put(msg)
+
+	for i := 0; i < 10; i++ {
+		d := readMetaDataFile(dq.(*diskQueue).metaDataFileName(), 0)
+		if d.depth == 1 &&
+			d.readFileNum == 0 &&
+			d.writeFileNum == 0 &&
+			d.readPos == 0 &&
+			d.writePos == 1004 {
+			// success
+			goto next
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	panic("fail")
+
+next:
+	dq.Put(msg)
+	<-dq.ReadChan()
+
+	for i := 0; i < 10; i++ {
+		d := readMetaDataFile(dq.(*diskQueue).metaDataFileName(), 0)
+		if d.depth == 1 &&
+			d.readFileNum == 0 &&
+			d.writeFileNum == 0 &&
+			d.readPos == 1004 &&
+			d.writePos == 2008 {
+			// success
+			goto done
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	panic("fail")
+
+done:
+}
+
+func TestDiskQueuePutSync(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_put_sync" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// never sync on count or timer
+	dq := New(dqName, tmpDir, 1<<11, 0, 1<<10, 2500, time.Hour, l)
+	defer dq.Close()
+
+	msg := make([]byte, 1000)
+	err = dq.PutSync(msg)
+	Nil(t, err)
+
+	// metadata is persisted before PutSync returns
+	d := readMetaDataFile(dq.(*diskQueue).metaDataFileName(), 0)
+	Equal(t, int64(1), d.depth)
+	Equal(t, int64(1004), d.writePos)
+}
+
+func TestDiskQueueGroupCommit(t *testing.T) {
+	l := NewTestLogger(t)
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	g := NewGroupCommitter(10 * time.Millisecond)
+	defer g.Close()
+
+	var queues []Interface
+	for i := 0; i < 3; i++ {
+		dq := New("test_disk_queue_group_commit"+strconv.Itoa(i), tmpDir, 1<<11, 0, 1<<10, 2500, time.Hour, l)
+		defer dq.Close()
+		dq.SetSyncPolicy(SyncPolicy{Every: 2500, Timeout: time.Hour, Group: g})
+		queues = append(queues, dq)
+	}
+
+	var wg sync.WaitGroup
+	for _, dq := range queues {
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(dq Interface) {
+				Nil(t, dq.PutSync(make([]byte, 10)))
+				wg.Done()
+			}(dq)
+		}
+	}
+	wg.Wait()
+
+	for _, dq := range queues {
+		d := readMetaDataFile(dq.(*diskQueue).metaDataFileName(), 0)
+		Equal(t, int64(10), d.depth)
+		Equal(t, int64(140), d.writePos)
+	}
+}
+
+func TestDiskQueueTorture(t *testing.T) {
+	var wg sync.WaitGroup
+
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_torture" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 262144, 0, 1<<10, 2500, 2*time.Second, l)
+	NotNil(t, dq)
+	Equal(t, int64(0), dq.Depth())
+
+	msg := []byte("aaaaaaaaaabbbbbbbbbbccccccccccddddddddddeeeeeeeeeeffffffffff")
+
+	numWriters := 4
+	numReaders := 4
+	readExitChan := make(chan int)
+	writeExitChan := make(chan int)
+
+	var depth int64
+	for i := 0; i < numWriters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				time.Sleep(100000 * time.Nanosecond)
+				select {
+				case <-writeExitChan:
+					return
+				default:
+					err := dq.Put(msg)
+					if err == nil {
+						atomic.AddInt64(&depth, 1)
+					}
+				}
+			}
+		}()
+	}
+
+	time.Sleep(1 * time.Second)
+
+	dq.Close()
+
+	t.Logf("closing writeExitChan")
+	close(writeExitChan)
+	wg.Wait()
+
+	t.Logf("restarting diskqueue")
+
+	dq = New(dqName, tmpDir, 262144, 0, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+	NotNil(t, dq)
+	Equal(t, depth, dq.Depth())
+
+	var read int64
+	for i := 0; i < numReaders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				time.Sleep(100000 * time.Nanosecond)
+				select {
+				case m := <-dq.ReadChan():
+					Equal(t, m, msg)
+					atomic.AddInt64(&read, 1)
+				case <-readExitChan:
+					return
+				}
+			}
+		}()
+	}
+
+	t.Logf("waiting for depth 0")
+	for {
+		if dq.Depth() == 0 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Logf("closing readExitChan")
+	close(readExitChan)
+	wg.Wait()
+
+	Equal(t, depth, read)
+}
+
+func BenchmarkDiskQueuePut16(b *testing.B) {
+	benchmarkDiskQueuePut(16, b)
+}
+func BenchmarkDiskQueuePut64(b *testing.B) {
+	benchmarkDiskQueuePut(64, b)
+}
+func BenchmarkDiskQueuePut256(b *testing.B) {
+	benchmarkDiskQueuePut(256, b)
+}
+func BenchmarkDiskQueuePut1024(b *testing.B) {
+	benchmarkDiskQueuePut(1024, b)
+}
+func BenchmarkDiskQueuePut4096(b *testing.B) {
+	benchmarkDiskQueuePut(4096, b)
+}
+func BenchmarkDiskQueuePut16384(b *testing.B) {
+	benchmarkDiskQueuePut(16384, b)
+}
+func BenchmarkDiskQueuePut65536(b *testing.B) {
+	benchmarkDiskQueuePut(65536, b)
+}
+func BenchmarkDiskQueuePut262144(b *testing.B) {
+	benchmarkDiskQueuePut(262144, b)
+}
+func BenchmarkDiskQueuePut1048576(b *testing.B) {
+	benchmarkDiskQueuePut(1048576, b)
+}
+func benchmarkDiskQueuePut(size int64, b *testing.B) {
+	b.StopTimer()
+	l := NewTestLogger(b)
+	dqName := "bench_disk_queue_put" + strconv.Itoa(b.N) + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024768*100, 0, 1<<20, 2500, 2*time.Second, l)
+	defer dq.Close()
+	b.SetBytes(size)
+	data := make([]byte, size)
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		err := dq.Put(data)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func BenchmarkDiskWrite16(b *testing.B) {
+	benchmarkDiskWrite(16, b)
+}
+func BenchmarkDiskWrite64(b *testing.B) {
+	benchmarkDiskWrite(64, b)
+}
+func BenchmarkDiskWrite256(b *testing.B) {
+	benchmarkDiskWrite(256, b)
+}
+func BenchmarkDiskWrite1024(b *testing.B) {
+	benchmarkDiskWrite(1024, b)
+}
+func BenchmarkDiskWrite4096(b *testing.B) {
+	benchmarkDiskWrite(4096, b)
+}
+func BenchmarkDiskWrite16384(b *testing.B) {
+	benchmarkDiskWrite(16384, b)
+}
+func BenchmarkDiskWrite65536(b *testing.B) {
+	benchmarkDiskWrite(65536, b)
+}
+func BenchmarkDiskWrite262144(b *testing.B) {
+	benchmarkDiskWrite(262144, b)
+}
+func BenchmarkDiskWrite1048576(b *testing.B) {
+	benchmarkDiskWrite(1048576, b)
+}
+func benchmarkDiskWrite(size int64, b *testing.B) {
+	b.StopTimer()
+	fileName := "bench_disk_queue_put" + strconv.Itoa(b.N) + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	f, _ := os.OpenFile(path.Join(tmpDir, fileName), os.O_RDWR|os.O_CREATE, 0600)
+	b.SetBytes(size)
+	data := make([]byte, size)
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		f.Write(data)
+	}
+	f.Sync()
+}
+
+func BenchmarkDiskWriteBuffered16(b *testing.B) {
+	benchmarkDiskWriteBuffered(16, b)
+}
+func BenchmarkDiskWriteBuffered64(b *testing.B) {
+	benchmarkDiskWriteBuffered(64, b)
+}
+func BenchmarkDiskWriteBuffered256(b *testing.B) {
+	benchmarkDiskWriteBuffered(256, b)
+}
+func BenchmarkDiskWriteBuffered1024(b *testing.B) {
+	benchmarkDiskWriteBuffered(1024, b)
+}
+func BenchmarkDiskWriteBuffered4096(b *testing.B) {
+	benchmarkDiskWriteBuffered(4096, b)
+}
+func BenchmarkDiskWriteBuffered16384(b *testing.B) {
+	benchmarkDiskWriteBuffered(16384, b)
+}
+func BenchmarkDiskWriteBuffered65536(b *testing.B) {
+	benchmarkDiskWriteBuffered(65536, b)
+}
+func BenchmarkDiskWriteBuffered262144(b *testing.B) {
+	benchmarkDiskWriteBuffered(262144, b)
+}
+func BenchmarkDiskWriteBuffered1048576(b *testing.B) {
+	benchmarkDiskWriteBuffered(1048576, b)
+}
+func benchmarkDiskWriteBuffered(size int64, b *testing.B) {
+	b.StopTimer()
+	fileName := "bench_disk_queue_put" + strconv.Itoa(b.N) + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	f, _ := os.OpenFile(path.Join(tmpDir, fileName), os.O_RDWR|os.O_CREATE, 0600)
+	b.SetBytes(size)
+	data := make([]byte, size)
+	w := bufio.NewWriterSize(f, 1024*4)
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		w.Write(data)
+		if i%1024 == 0 {
+			w.Flush()
+		}
+	}
+	w.Flush()
+	f.Sync()
+}
+
+// you might want to run this like
+// $ go test -bench=DiskQueueGet -benchtime 0.1s
+// too avoid doing too many iterations.
+func BenchmarkDiskQueueGet16(b *testing.B) {
+	benchmarkDiskQueueGet(16, b)
+}
+func BenchmarkDiskQueueGet64(b *testing.B) {
+	benchmarkDiskQueueGet(64, b)
+}
+func BenchmarkDiskQueueGet256(b *testing.B) {
+	benchmarkDiskQueueGet(256, b)
+}
+func BenchmarkDiskQueueGet1024(b *testing.B) {
+	benchmarkDiskQueueGet(1024, b)
+}
+func BenchmarkDiskQueueGet4096(b *testing.B) {
+	benchmarkDiskQueueGet(4096, b)
+}
+func BenchmarkDiskQueueGet16384(b *testing.B) {
+	benchmarkDiskQueueGet(16384, b)
+}
+func BenchmarkDiskQueueGet65536(b *testing.B) {
+	benchmarkDiskQueueGet(65536, b)
+}
+func BenchmarkDiskQueueGet262144(b *testing.B) {
+	benchmarkDiskQueueGet(262144, b)
+}
+func BenchmarkDiskQueueGet1048576(b *testing.B) {
+	benchmarkDiskQueueGet(1048576, b)
+}
+
+func benchmarkDiskQueueGet(size int64, b *testing.B) {
+	b.StopTimer()
+	l := NewTestLogger(b)
+	dqName := "bench_disk_queue_get" + strconv.Itoa(b.N) + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024768, 0, 1<<30, 2500, 2*time.Second, l)
+	defer dq.Close()
+	b.SetBytes(size)
+	data := make([]byte, size)
+	for i := 0; i < b.N; i++ {
+		dq.Put(data)
+	}
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		<-dq.ReadChan()
+	}
+}
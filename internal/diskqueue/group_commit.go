@@ -0,0 +1,97 @@
+package diskqueue
+
+import (
+	"sync"
+	"time"
+)
+
+// GroupCommitter batches the fsyncs of synchronous writes (PutSync) across queues.
+//
+// Instead of fsyncing after each write, a queue with a GroupCommitter in its
+// SyncPolicy registers itself as dirty. After waiting up to interval for more
+// writes, the GroupCommitter fsyncs all dirty queues (concurrently), and only then
+// are the writes acknowledged. This trades a little latency for far fewer fsyncs
+// when there are many concurrent synchronous writers.
+type GroupCommitter struct {
+	interval time.Duration
+
+	sync.Mutex
+	dirty map[*diskQueue]struct{}
+
+	notifyChan chan int
+	exitChan   chan int
+	waitGroup  sync.WaitGroup
+}
+
+// NewGroupCommitter starts a GroupCommitter that commits at most every interval
+func NewGroupCommitter(interval time.Duration) *GroupCommitter {
+	g := &GroupCommitter{
+		interval:   interval,
+		dirty:      make(map[*diskQueue]struct{}),
+		notifyChan: make(chan int, 1),
+		exitChan:   make(chan int),
+	}
+	g.waitGroup.Add(1)
+	go g.commitLoop()
+	return g
+}
+
+// Close stops the GroupCommitter after committing any outstanding writes
+func (g *GroupCommitter) Close() {
+	close(g.exitChan)
+	g.waitGroup.Wait()
+	g.commit()
+}
+
+func (g *GroupCommitter) add(d *diskQueue) {
+	g.Lock()
+	g.dirty[d] = struct{}{}
+	g.Unlock()
+
+	select {
+	case g.notifyChan <- 1:
+	default:
+	}
+}
+
+func (g *GroupCommitter) commitLoop() {
+	defer g.waitGroup.Done()
+
+	timer := time.NewTimer(g.interval)
+	timer.Stop()
+	for {
+		select {
+		case <-g.notifyChan:
+		case <-g.exitChan:
+			return
+		}
+
+		// gather writes to other queues
+		timer.Reset(g.interval)
+		select {
+		case <-timer.C:
+		case <-g.exitChan:
+			timer.Stop()
+			return
+		}
+
+		g.commit()
+	}
+}
+
+func (g *GroupCommitter) commit() {
+	g.Lock()
+	dirty := g.dirty
+	g.dirty = make(map[*diskQueue]struct{})
+	g.Unlock()
+
+	var wg sync.WaitGroup
+	for d := range dirty {
+		wg.Add(1)
+		go func(d *diskQueue) {
+			d.commit()
+			wg.Done()
+		}(d)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,245 @@
+package diskqueue
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+var fileNameRegex = regexp.MustCompile(`^(.+)\.diskqueue\.(meta|\d{6,})\.dat$`)
+
+// Names returns the names of the queues that have files in dataPath
+func Names(dataPath string) ([]string, error) {
+	files, err := ioutil.ReadDir(dataPath)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, fi := range files {
+		m := fileNameRegex.FindStringSubmatch(fi.Name())
+		if m == nil || !fi.Mode().IsRegular() || seen[m[1]] {
+			continue
+		}
+		seen[m[1]] = true
+		names = append(names, m[1])
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Recover makes the metadata of the queue name in dataPath consistent with its data
+// files (e.g. after a crash or a partial copy of dataPath), returning a description
+// of each problem fixed. It must not be used while the queue is open.
+//
+// Data files that were already read are removed, a trailing partial message is
+// truncated and the depth is recounted.
+func Recover(name string, dataPath string) ([]string, error) {
+	return recoverQueue(name, dataPath, true)
+}
+
+// Check is like Recover, but only describes each problem found without fixing it
+func Check(name string, dataPath string) ([]string, error) {
+	return recoverQueue(name, dataPath, false)
+}
+
+func recoverQueue(name string, dataPath string, fix bool) ([]string, error) {
+	var fixes []string
+	d := &diskQueue{name: name, dataPath: dataPath}
+
+	fileNums, err := d.dataFileNums()
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.retrieveMetaData()
+	hasMeta := err == nil
+	if !hasMeta {
+		if len(fileNums) == 0 {
+			return nil, nil
+		}
+		fixes = append(fixes, "missing metadata")
+		d.readFileNum = fileNums[0]
+		d.writeFileNum = fileNums[len(fileNums)-1]
+	}
+	oldDepth := d.depth
+	oldMeta := [4]int64{d.readFileNum, d.readPos, d.writeFileNum, d.writePos}
+
+	// data files before the read position have been consumed
+	for _, fileNum := range fileNums {
+		if fileNum >= d.readFileNum {
+			break
+		}
+		fn := d.fileName(fileNum)
+		if !fix {
+			fixes = append(fixes, fmt.Sprintf("%s was already read", fn))
+			continue
+		}
+		err := os.Remove(fn)
+		if err != nil {
+			return nil, err
+		}
+		fixes = append(fixes, fmt.Sprintf("removed already read %s", fn))
+	}
+
+	// skip to the first data file that exists
+	for _, fileNum := range fileNums {
+		if fileNum < d.readFileNum {
+			continue
+		}
+		if fileNum > d.readFileNum && fileNum <= d.writeFileNum {
+			fixes = append(fixes, fmt.Sprintf("%s is missing", d.fileName(d.readFileNum)))
+			d.readFileNum = fileNum
+			d.readPos = 0
+		}
+		break
+	}
+
+	// data files after the write position were written after the metadata
+	if len(fileNums) > 0 && fileNums[len(fileNums)-1] > d.writeFileNum {
+		d.writeFileNum = fileNums[len(fileNums)-1]
+	}
+	size, compressed, err := dataSize(d.fileName(d.writeFileNum))
+	switch {
+	case err == nil && compressed:
+		// only full data files are compressed, don't append to it
+		d.writeFileNum++
+		d.writePos = 0
+	case err == nil:
+		d.writePos = size
+	case os.IsNotExist(err):
+		d.writePos = 0
+	default:
+		return nil, err
+	}
+
+	var depth int64
+	for i := d.readFileNum; i <= d.writeFileNum; i++ {
+		fn := d.fileName(i)
+		var startPos int64
+		if i == d.readFileNum {
+			startPos = d.readPos
+		}
+		count, endPos, err := countMessages(fn, startPos)
+		if os.IsNotExist(err) {
+			if i != d.writeFileNum {
+				fixes = append(fixes, fmt.Sprintf("%s is missing", fn))
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if i == d.readFileNum && startPos > endPos {
+			fixes = append(fixes, fmt.Sprintf("read position beyond the end of %s", fn))
+			d.readPos = endPos
+		}
+		size, compressed, err := dataSize(fn)
+		if err != nil {
+			return nil, err
+		}
+		if size > endPos && compressed {
+			return nil, fmt.Errorf("%s ends with a partial message", fn)
+		}
+		if size > endPos && !fix {
+			fixes = append(fixes, fmt.Sprintf("partial message at the end of %s", fn))
+		} else if size > endPos {
+			err = os.Truncate(fn, endPos)
+			if err != nil {
+				return nil, err
+			}
+			fixes = append(fixes, fmt.Sprintf("truncated partial message at the end of %s", fn))
+		}
+		if i == d.writeFileNum {
+			d.writePos = endPos
+		}
+		depth += count
+	}
+	d.depth = depth
+	d.nextReadFileNum = d.readFileNum
+	d.nextReadPos = d.readPos
+
+	if hasMeta && depth != oldDepth {
+		fixes = append(fixes, fmt.Sprintf("depth was %d instead of %d", oldDepth, depth))
+	}
+	if hasMeta && oldMeta != [4]int64{d.readFileNum, d.readPos, d.writeFileNum, d.writePos} {
+		fixes = append(fixes, fmt.Sprintf("positions were %d,%d %d,%d instead of %d,%d %d,%d",
+			oldMeta[0], oldMeta[1], oldMeta[2], oldMeta[3],
+			d.readFileNum, d.readPos, d.writeFileNum, d.writePos))
+	}
+	if len(fixes) == 0 || !fix {
+		return fixes, nil
+	}
+	return fixes, d.persistMetaData()
+}
+
+// dataFileNums returns the numbers of the queue's data files, in order
+func (d *diskQueue) dataFileNums() ([]int64, error) {
+	files, err := ioutil.ReadDir(d.dataPath)
+	if err != nil {
+		return nil, err
+	}
+	var fileNums []int64
+	for _, fi := range files {
+		m := fileNameRegex.FindStringSubmatch(fi.Name())
+		if m == nil || m[1] != d.name || m[2] == "meta" {
+			continue
+		}
+		fileNum, err := strconv.ParseInt(m[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		fileNums = append(fileNums, fileNum)
+	}
+	sort.Slice(fileNums, func(i, j int) bool { return fileNums[i] < fileNums[j] })
+	return fileNums, nil
+}
+
+// countMessages counts the complete messages in the data file fn (compressed or
+// not) from startPos, returning the count and the position after the last one
+func countMessages(fn string, startPos int64) (int64, int64, error) {
+	size, _, err := dataSize(fn)
+	if err != nil {
+		return 0, 0, err
+	}
+	if startPos > size {
+		return 0, size, nil
+	}
+
+	f, err := os.Open(fn)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	r, err := newDataReader(f, startPos)
+	if err != nil {
+		return 0, 0, err
+	}
+	var count int64
+	pos := startPos
+	for {
+		var msgSize int32
+		err := binary.Read(r, binary.BigEndian, &msgSize)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		if msgSize <= 0 || pos+4+int64(msgSize) > size {
+			break
+		}
+		_, err = r.Discard(int(msgSize))
+		if err != nil {
+			return 0, 0, err
+		}
+		pos += 4 + int64(msgSize)
+		count++
+	}
+	return count, pos, nil
+}
@@ -0,0 +1,55 @@
+// Package faults injects faults into nsqd for resilience tests. Faults are only
+// injected in binaries built with the faults build tag (go build -tags faults),
+// where they're set with /debug/faults, otherwise its functions do nothing.
+package faults
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// FsyncDelay delays the fsyncs of disk queues by the fault's Delay
+	FsyncDelay = "fsync_delay"
+	// PartialWrite makes disk queues write only half of a message, and fail
+	PartialWrite = "partial_write"
+	// DropFrame drops the message frames nsqd sends clients (the messages
+	// time out as if the client never got them)
+	DropFrame = "drop_frame"
+	// LookupdDelay delays the responses of nsqlookupd to nsqd by the fault's
+	// Delay
+	LookupdDelay = "lookupd_delay"
+)
+
+var names = []string{FsyncDelay, PartialWrite, DropFrame, LookupdDelay}
+
+// Fault is when (and how) a fault is injected: it's injected the Count times
+// (every time if 0) it's reached after having been reached Skip times
+type Fault struct {
+	Delay time.Duration `json:"delay,omitempty"`
+	Skip  int64         `json:"skip"`
+	Count int64         `json:"count"`
+
+	// times injected
+	Injected int64 `json:"injected"`
+}
+
+func validate(name string, f Fault) error {
+	valid := false
+	for _, n := range names {
+		if n == name {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return fmt.Errorf("unknown fault %q", name)
+	}
+	if f.Skip < 0 || f.Count < 0 {
+		return fmt.Errorf("skip and count of fault %s must be >= 0", name)
+	}
+	if (name == FsyncDelay || name == LookupdDelay) && f.Delay <= 0 {
+		return fmt.Errorf("fault %s needs a delay", name)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+// +build !faults
+
+package faults
+
+import (
+	"errors"
+)
+
+// Enabled reports whether nsqd was built with the faults build tag
+const Enabled = false
+
+var errDisabled = errors.New("not built with the faults build tag")
+
+func Set(name string, f Fault) error {
+	return errDisabled
+}
+
+func Clear(name string) {}
+
+func List() map[string]Fault {
+	return nil
+}
+
+func Inject(name string) (Fault, bool) {
+	return Fault{}, false
+}
+
+func Sleep(name string) {}
@@ -0,0 +1,77 @@
+// +build faults
+
+package faults
+
+import (
+	"sync"
+	"time"
+)
+
+// Enabled reports whether nsqd was built with the faults build tag
+const Enabled = true
+
+var faults = struct {
+	sync.Mutex
+	m map[string]*Fault
+}{m: make(map[string]*Fault)}
+
+// Set injects the fault name from now on, replacing its previous setting
+func Set(name string, f Fault) error {
+	err := validate(name, f)
+	if err != nil {
+		return err
+	}
+	f.Injected = 0
+	faults.Lock()
+	faults.m[name] = &f
+	faults.Unlock()
+	return nil
+}
+
+// Clear stops injecting the fault name, or all faults if name is empty
+func Clear(name string) {
+	faults.Lock()
+	if name == "" {
+		faults.m = make(map[string]*Fault)
+	} else {
+		delete(faults.m, name)
+	}
+	faults.Unlock()
+}
+
+// List returns the faults set
+func List() map[string]Fault {
+	faults.Lock()
+	defer faults.Unlock()
+	m := make(map[string]Fault, len(faults.m))
+	for name, f := range faults.m {
+		m[name] = *f
+	}
+	return m
+}
+
+// Inject reports whether the fault name is injected where it's reached
+func Inject(name string) (Fault, bool) {
+	faults.Lock()
+	defer faults.Unlock()
+	f, ok := faults.m[name]
+	if !ok {
+		return Fault{}, false
+	}
+	if f.Skip > 0 {
+		f.Skip--
+		return Fault{}, false
+	}
+	if f.Count > 0 && f.Injected >= f.Count {
+		return Fault{}, false
+	}
+	f.Injected++
+	return *f, true
+}
+
+// Sleep sleeps for the Delay of the fault name when it's injected
+func Sleep(name string) {
+	if f, ok := Inject(name); ok {
+		time.Sleep(f.Delay)
+	}
+}
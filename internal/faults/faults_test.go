@@ -0,0 +1,43 @@
+// +build faults
+
+package faults
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestInject(t *testing.T) {
+	defer Clear("")
+
+	test.NotNil(t, Set("unknown", Fault{}))
+	test.NotNil(t, Set(FsyncDelay, Fault{}))
+	test.NotNil(t, Set(DropFrame, Fault{Count: -1}))
+
+	_, ok := Inject(DropFrame)
+	test.Equal(t, false, ok)
+
+	test.Nil(t, Set(DropFrame, Fault{Skip: 2, Count: 3}))
+	var injected []bool
+	for i := 0; i < 7; i++ {
+		_, ok := Inject(DropFrame)
+		injected = append(injected, ok)
+	}
+	test.Equal(t, []bool{false, false, true, true, true, false, false}, injected)
+	test.Equal(t, int64(3), List()[DropFrame].Injected)
+
+	test.Nil(t, Set(LookupdDelay, Fault{Delay: 10 * time.Millisecond}))
+	start := time.Now()
+	Sleep(LookupdDelay)
+	if time.Since(start) < 10*time.Millisecond {
+		t.Fatal("fault not injected")
+	}
+	test.Equal(t, 2, len(List()))
+
+	Clear(LookupdDelay)
+	test.Equal(t, 1, len(List()))
+	Clear("")
+	test.Equal(t, 0, len(List()))
+}
@@ -1,9 +1,11 @@
 package http_api
 
 import (
+	"bytes"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -48,47 +50,67 @@ func NewClient(tlsConfig *tls.Config, connectTimeout time.Duration, requestTimeo
 // GETV1 is a helper function to perform a V1 HTTP request
 // and parse our NSQ daemon's expected response format, with deadlines.
 func (c *Client) GETV1(endpoint string, v interface{}) error {
+	body, err := c.GETV1Body(endpoint)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(body, &v)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GETV1Body performs a V1 HTTP request like GETV1 but returns the raw
+// response body instead of parsing it
+func (c *Client) GETV1Body(endpoint string) ([]byte, error) {
 retry:
 	req, err := http.NewRequest("GET", endpoint, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	req.Header.Add("Accept", "application/vnd.nsq; version=1.0")
 
 	resp, err := c.c.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if resp.StatusCode != 200 {
 		if resp.StatusCode == 403 && !strings.HasPrefix(endpoint, "https") {
 			endpoint, err = httpsEndpoint(endpoint, body)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			goto retry
 		}
-		return fmt.Errorf("got response %s %q", resp.Status, body)
-	}
-	err = json.Unmarshal(body, &v)
-	if err != nil {
-		return err
+		return nil, fmt.Errorf("got response %s %q", resp.Status, body)
 	}
 
-	return nil
+	return body, nil
 }
 
 // PostV1 is a helper function to perform a V1 HTTP request
 // and parse our NSQ daemon's expected response format, with deadlines.
 func (c *Client) POSTV1(endpoint string) error {
+	return c.POSTV1WithBody(endpoint, nil)
+}
+
+// POSTV1WithBody is POSTV1 with a request body
+func (c *Client) POSTV1WithBody(endpoint string, body []byte) error {
 retry:
-	req, err := http.NewRequest("POST", endpoint, nil)
+	var rdr io.Reader
+	if body != nil {
+		rdr = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest("POST", endpoint, rdr)
 	if err != nil {
 		return err
 	}
@@ -100,20 +122,20 @@ retry:
 		return err
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	respBody, err := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
 	if err != nil {
 		return err
 	}
 	if resp.StatusCode != 200 {
 		if resp.StatusCode == 403 && !strings.HasPrefix(endpoint, "https") {
-			endpoint, err = httpsEndpoint(endpoint, body)
+			endpoint, err = httpsEndpoint(endpoint, respBody)
 			if err != nil {
 				return err
 			}
 			goto retry
 		}
-		return fmt.Errorf("got response %s %q", resp.Status, body)
+		return fmt.Errorf("got response %s %q", resp.Status, respBody)
 	}
 
 	return nil
@@ -24,6 +24,10 @@ func (e Err) Error() string {
 	return e.Text
 }
 
+// StreamFunc can be returned by a handler to write a (large) successful response
+// body itself, after the status and headers have been sent
+type StreamFunc func(w io.Writer)
+
 func acceptVersion(req *http.Request) int {
 	if req.Header.Get("accept") == "application/vnd.nsq; version=1.0" {
 		return 1
@@ -73,6 +77,11 @@ func RespondV1(w http.ResponseWriter, code int, data interface{}) {
 
 	if code == 200 {
 		switch data.(type) {
+		case StreamFunc:
+			w.Header().Set("X-NSQ-Content-Type", "nsq; version=1.0")
+			w.WriteHeader(code)
+			data.(StreamFunc)(w)
+			return
 		case string:
 			response = []byte(data.(string))
 		case []byte:
@@ -91,9 +100,7 @@ func RespondV1(w http.ResponseWriter, code int, data interface{}) {
 
 	if code != 200 {
 		isJSON = true
-		response, _ = json.Marshal(struct {
-			Message string `json:"message"`
-		}{fmt.Sprintf("%s", data)})
+		response, _ = json.Marshal(NewErrorResponse(code, fmt.Sprintf("%s", data)))
 	}
 
 	if isJSON {
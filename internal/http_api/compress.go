@@ -12,6 +12,8 @@ import (
 	"io"
 	"net/http"
 	"strings"
+
+	"github.com/julienschmidt/httprouter"
 )
 
 type compressResponseWriter struct {
@@ -42,50 +44,49 @@ func (w *compressResponseWriter) Write(b []byte) (int, error) {
 // via the 'Accept-Encoding' header.
 func CompressHandler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-	L:
-		for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
-			switch strings.TrimSpace(enc) {
-			case "gzip":
-				w.Header().Set("Content-Encoding", "gzip")
-				w.Header().Add("Vary", "Accept-Encoding")
-
-				gw := gzip.NewWriter(w)
-				defer gw.Close()
-
-				h, hok := w.(http.Hijacker)
-				if !hok { /* w is not Hijacker... oh well... */
-					h = nil
-				}
-
-				w = &compressResponseWriter{
-					Writer:         gw,
-					ResponseWriter: w,
-					Hijacker:       h,
-				}
-
-				break L
-			case "deflate":
-				w.Header().Set("Content-Encoding", "deflate")
-				w.Header().Add("Vary", "Accept-Encoding")
+		w, closer := compressWriter(w, r)
+		defer closer()
+		h.ServeHTTP(w, r)
+	})
+}
 
-				fw, _ := flate.NewWriter(w, flate.DefaultCompression)
-				defer fw.Close()
+// Compress is a Decorator that compresses the response of a single endpoint
+// for clients that support it via the 'Accept-Encoding' header.
+func Compress(f APIHandler) APIHandler {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+		w, closer := compressWriter(w, req)
+		defer closer()
+		return f(w, req, ps)
+	}
+}
 
-				h, hok := w.(http.Hijacker)
-				if !hok { /* w is not Hijacker... oh well... */
-					h = nil
-				}
+// compressWriter wraps w with the first supported encoding in the request's
+// 'Accept-Encoding' header, the returned func must be called to flush it.
+func compressWriter(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		var cw io.WriteCloser
+		switch strings.TrimSpace(enc) {
+		case "gzip":
+			cw = gzip.NewWriter(w)
+		case "deflate":
+			cw, _ = flate.NewWriter(w, flate.DefaultCompression)
+		default:
+			continue
+		}
 
-				w = &compressResponseWriter{
-					Writer:         fw,
-					ResponseWriter: w,
-					Hijacker:       h,
-				}
+		w.Header().Set("Content-Encoding", strings.TrimSpace(enc))
+		w.Header().Add("Vary", "Accept-Encoding")
 
-				break L
-			}
+		h, hok := w.(http.Hijacker)
+		if !hok { /* w is not Hijacker... oh well... */
+			h = nil
 		}
 
-		h.ServeHTTP(w, r)
-	})
+		return &compressResponseWriter{
+			Writer:         cw,
+			ResponseWriter: w,
+			Hijacker:       h,
+		}, func() { cw.Close() }
+	}
+	return w, func() {}
 }
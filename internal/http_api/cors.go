@@ -0,0 +1,81 @@
+package http_api
+
+import (
+	"net/http"
+	"strings"
+)
+
+// CORS wraps h to add Cross-Origin Resource Sharing headers for requests from allowed
+// origins and to answer preflight requests.
+//
+// Each entry of allowOrigins may be a comma separated list of "*" (any origin), an
+// exact origin ("https://dash.example.com"), or a wildcard subdomain origin
+// ("https://*.example.com"). h is returned unmodified when allowOrigins is empty.
+func CORS(allowOrigins []string, h http.Handler) http.Handler {
+	var origins []string
+	for _, o := range allowOrigins {
+		for _, s := range strings.Split(o, ",") {
+			s = strings.TrimSpace(s)
+			if s != "" {
+				origins = append(origins, s)
+			}
+		}
+	}
+	if len(origins) == 0 {
+		return h
+	}
+	return &corsHandler{origins: origins, h: h}
+}
+
+type corsHandler struct {
+	origins []string
+	h       http.Handler
+}
+
+func (c *corsHandler) allowed(origin string) (string, bool) {
+	for _, o := range c.origins {
+		switch {
+		case o == "*":
+			return "*", true
+		case o == origin:
+			return origin, true
+		case strings.Contains(o, "*."):
+			i := strings.Index(o, "*.")
+			prefix, suffix := o[:i], o[i+1:]
+			if strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) &&
+				len(origin) > len(prefix)+len(suffix) {
+				return origin, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (c *corsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		c.h.ServeHTTP(w, req)
+		return
+	}
+
+	w.Header().Add("Vary", "Origin")
+	allowOrigin, ok := c.allowed(origin)
+	if !ok {
+		c.h.ServeHTTP(w, req)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+
+	if req.Method == "OPTIONS" && req.Header.Get("Access-Control-Request-Method") != "" {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE")
+		if headers := req.Header.Get("Access-Control-Request-Headers"); headers != "" {
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+		}
+		w.Header().Set("Access-Control-Max-Age", "86400")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Access-Control-Expose-Headers", "X-NSQ-Content-Type, Retry-After")
+	c.h.ServeHTTP(w, req)
+}
@@ -0,0 +1,201 @@
+package http_api
+
+import (
+	"net/http"
+	"regexp"
+)
+
+// ErrorResponse is the JSON envelope written for every non-200 V1 response.
+//
+// Code is a stable, machine readable identifier (see ErrorCodes) that clients
+// should branch on, Message is Code too (as in the bodies of older versions),
+// Description is a human readable description of Code, and Detail (optional)
+// carries request specific context such as an upstream error.
+type ErrorResponse struct {
+	Code        string `json:"code"`
+	Message     string `json:"message"`
+	Description string `json:"description"`
+	Detail      string `json:"detail,omitempty"`
+}
+
+// ErrorCodes documents the stable error codes returned by nsqd, nsqlookupd and nsqadmin.
+//
+// Codes are never renamed or removed; new codes may be added.
+var ErrorCodes = map[string]string{
+	// generic
+	"BAD_REQUEST":        "the request was invalid",
+	"INVALID_REQUEST":    "the request parameters could not be parsed",
+	"INVALID_BODY":       "the request body could not be parsed",
+	"FORBIDDEN":          "the request is not permitted",
+	"NOT_FOUND":          "the requested resource does not exist",
+	"METHOD_NOT_ALLOWED": "the HTTP method is not allowed for this resource",
+	"TOO_MANY_REQUESTS":  "rate limit exceeded, retry after the duration in the Retry-After header",
+	"TLS_REQUIRED":       "TLS is required, retry on the advertised HTTPS port",
+	"INTERNAL_ERROR":     "an internal error occurred",
+	"UPSTREAM_ERROR":     "a request to an upstream nsqd or nsqlookupd failed",
+	"EXITING":            "the daemon is shutting down",
+
+	// topic and channel arguments
+	"MISSING_ARG_TOPIC":   "the topic parameter is required",
+	"INVALID_ARG_TOPIC":   "the topic parameter is not a valid topic name",
+	"MISSING_ARG_CHANNEL": "the channel parameter is required",
+	"INVALID_ARG_CHANNEL": "the channel parameter is not a valid channel name",
+	"INVALID_TOPIC":       "the topic name is not valid",
+	"INVALID_CHANNEL":     "the channel name is not valid",
+	"TOPIC_NOT_FOUND":     "the topic does not exist",
+	"CHANNEL_NOT_FOUND":   "the channel does not exist",
+
+	// topic settings
+	"INVALID_ARG_MEM_QUEUE_SIZE":        "the mem_queue_size parameter is not an integer",
+	"INVALID_ARG_DURABLE":               "the durable parameter is not a boolean or not valid for the topic",
+	"INVALID_ARG_SYNC":                  "the sync parameter is not always or default",
+	"INVALID_ARG_SYNC_EVERY":            "the sync_every parameter is not a non-negative integer",
+	"INVALID_ARG_SYNC_TIMEOUT":          "the sync_timeout parameter is not a non-negative duration",
+	"INVALID_ARG_MAX_DISK_BYTES":        "the max_disk_bytes parameter is not a non-negative integer",
+	"INVALID_ARG_DISK_QUOTA":            "the disk_quota_policy parameter is not backpressure or truncate",
+	"INVALID_ARG_PUBLISHERS":            "the publishers parameter is not a comma separated list of non-empty identities",
+	"INVALID_ARG_IDLE_TIMEOUT":          "the idle_timeout parameter is not a duration",
+	"INVALID_ARG_EPHEMERAL_BUFFER_SIZE": "the ephemeral_buffer_size parameter is not a non-negative integer",
+	"INVALID_ARG_COMPRESSION":           "the compression parameter is not default, none or zstd",
+
+	"INVALID_ARG_CHANNEL_OVERFLOW":       "the channel_overflow parameter is not none or drop-oldest (with a limit)",
+	"INVALID_ARG_CHANNEL_MAX_DEPTH":      "the channel_max_depth parameter is not a non-negative integer",
+	"INVALID_ARG_CHANNEL_MAX_DISK_BYTES": "the channel_max_disk_bytes parameter is not a non-negative integer",
+
+	// channel settings
+	"INVALID_ARG_MAX_CLIENTS":         "the max_clients parameter is not a non-negative integer",
+	"INVALID_ARG_EXCLUSIVE":           "the exclusive parameter is not a boolean",
+	"INVALID_ARG_KEY_ROUTING":         "the key_routing parameter is not a boolean",
+	"INVALID_ARG_SAMPLE_RATE":         "the sample_rate parameter is not an integer in [0, 99]",
+	"INVALID_ARG_ALARM_DEPTH":         "the alarm_depth parameter is not an integer",
+	"INVALID_ARG_ALARM_AGE":           "the alarm_age parameter is not a duration",
+	"INVALID_ARG_START":               "the start parameter is not head, tail or a unix timestamp",
+	"INVALID_ARG_AUDIT_LOG":           "the audit_log parameter is not a boolean or the audit log could not be opened",
+	"INVALID_ARG_QUARANTINE_TIMEOUTS": "the quarantine_timeouts parameter is not a non-negative integer or not valid for the channel",
+
+	// publishing
+	"MSG_EMPTY":                "the message body is empty",
+	"MSG_TOO_BIG":              "the message exceeds --max-msg-size",
+	"BODY_TOO_BIG":             "the request body exceeds --max-body-size",
+	"BAD_BODY":                 "the multi-publish body is malformed",
+	"BAD_MESSAGE":              "a message in the multi-publish body is malformed",
+	"INVALID_DEFER":            "the defer parameter is not a valid duration",
+	"DISK_QUOTA_EXCEEDED":      "the topic is using more than its max_disk_bytes, retry later",
+	"INVALID_ARG_ASYNC":        "the async parameter is not a boolean",
+	"ASYNC_NOT_ALLOWED":        "async publishes are disabled (--async-pub-buffer-size=0)",
+	"ASYNC_BUFFER_FULL":        "--async-pub-buffer-size messages are waiting to be published, retry later",
+	"NAMESPACE_QUOTA_EXCEEDED": "the topic's namespace is at its max_topics (403) or max_publish_rate (429, retry later)",
+	"PUBLISHER_NOT_ALLOWED":    "the client is not one of the topic's publishers",
+	"INVALID_KEY":              "the key parameter is empty or longer than 255 bytes",
+	"MSG_ID_NOT_ALLOWED":       "the id parameter is only accepted with --msg-id-generator=producer",
+	"INVALID_MSG_ID":           "the message ID is not 16 printable ASCII characters matching --msg-id-pattern",
+	"INVALID_EVENT_TIMESTAMP":  "the event_timestamp parameter is not a positive unix timestamp in nanoseconds",
+	"HOPS_NOT_ALLOWED":         "the hops parameter is only accepted with --record-hops",
+	"INVALID_HOPS":             "the hops parameter is not a valid list of hops",
+	"MISSING_ARG_ID":           "the id parameter is required with --msg-id-generator=producer",
+
+	// configuration
+	"INVALID_OPTION": "the option does not exist or cannot be changed",
+	"INVALID_VALUE":  "the value is not valid for the option",
+	"BACKUP_FAILED":  "the snapshot could not be written",
+
+	"INVALID_ARG_DIR":     "the dir parameter is not a relative path without ..",
+	"BACKUP_DIR_DISABLED": "writing snapshots on the nsqd host is disabled (no --backup-dir)",
+	"DUMP_FAILED":         "the debug dump could not be written",
+
+	"INVALID_METADATA": "the topic and channel definitions are invalid or from a newer nsqd",
+
+	// topic migration
+	"MISSING_ARG_TARGET":    "the target parameter is required",
+	"MIGRATION_IN_PROGRESS": "the topic is already being migrated",
+	"MIGRATION_NOT_FOUND":   "the topic is not being migrated",
+	"TOPIC_EXISTS":          "a topic named by the to parameter already exists",
+
+	// topic draining
+	"INVALID_ARG_DRAIN":         "the drain parameter is not a boolean",
+	"INVALID_ARG_DRAIN_TIMEOUT": "the drain_timeout parameter is not a positive duration",
+	"DRAIN_NOT_FOUND":           "the topic is not being drained",
+	"TOPIC_DRAINING":            "the topic is being drained before its deletion and accepts no new messages",
+
+	// channel transfers
+	"MISSING_ARG_FROM": "the from parameter is required",
+	"MISSING_ARG_TO":   "the to parameter is required",
+	"INVALID_ARG_TO":   "the to parameter is not valid for the request",
+
+	// channel seeking
+	"RETENTION_DISABLED": "seeking channels requires --retention",
+
+	// channel audit log and listings
+	"INVALID_ARG_SINCE":  "the since parameter is not an RFC3339 time",
+	"INVALID_ARG_LIMIT":  "the limit parameter is not an integer in the allowed range",
+	"INVALID_ARG_OFFSET": "the offset parameter is not a non-negative integer",
+	"INVALID_ARG_SORT":   "the sort parameter is not a sortable field (optionally prefixed with -)",
+
+	// nsqlookupd
+	"MISSING_ARG_NODE":    "the node parameter is required",
+	"NODE_NOT_FOUND":      "the node is not registered",
+	"INVALID_REMOTE_ADDR": "the remote address could not be parsed",
+	"INVALID_ARG_ORDER":   "the order parameter is not load",
+
+	// nsqadmin
+	"INVALID_ACTION":          "the action is not valid for this resource",
+	"INVALID_ARG_METRIC":      "the metric parameter is not valid",
+	"INVALID_ARG_TARGET":      "the target parameter is not valid",
+	"NSQLOOKUPD_REQUIRED":     "the action needs nsqadmin configured with --lookupd-http-address",
+	"TOPOLOGY_CACHE_DISABLED": "the topology is not cached (--topology-refresh-interval=0)",
+
+	// fault injection
+	"FAULTS_DISABLED":   "fault injection is disabled (nsqd not built with the faults build tag)",
+	"INVALID_ARG_DELAY": "the delay parameter is not a duration",
+	"INVALID_ARG_SKIP":  "the skip parameter is not an integer",
+	"INVALID_ARG_COUNT": "the count parameter is not an integer",
+	"INVALID_ARG_NAME":  "the name parameter is not a known fault, or the fault's parameters are not valid for it",
+
+	// load generation
+	"LOADGEN_DISABLED": "load generation is disabled (no --loadgen)",
+	"INVALID_SIZE":     "the size parameter is not an integer in [1, --max-msg-size]",
+	"INVALID_RATE":     "the rate parameter is not a non-negative integer",
+	"INVALID_DURATION": "the duration parameter is not a positive duration (at most 1h for load generation)",
+}
+
+// statusCodes are the codes used for an Err whose Text is not itself a code
+var statusCodes = map[int]string{
+	400: "BAD_REQUEST",
+	403: "FORBIDDEN",
+	404: "NOT_FOUND",
+	405: "METHOD_NOT_ALLOWED",
+	429: "TOO_MANY_REQUESTS",
+	500: "INTERNAL_ERROR",
+	502: "UPSTREAM_ERROR",
+}
+
+var codeTextRegex = regexp.MustCompile(`^([A-Z][A-Z0-9_]*)(?:: (.*))?$`)
+
+// NewErrorResponse builds the envelope for an HTTP status and error text.
+//
+// Text of the form "CODE" or "CODE: detail" is split into its code and detail,
+// any other text becomes the detail of a code derived from the status.
+func NewErrorResponse(status int, text string) ErrorResponse {
+	var code, detail string
+	if m := codeTextRegex.FindStringSubmatch(text); m != nil {
+		code, detail = m[1], m[2]
+	} else {
+		code = statusCodes[status]
+		if code == "" {
+			code = statusCodes[500]
+		}
+		detail = text
+	}
+
+	description, ok := ErrorCodes[code]
+	if !ok {
+		description = http.StatusText(status)
+	}
+
+	return ErrorResponse{
+		Code:        code,
+		Message:     code,
+		Description: description,
+		Detail:      detail,
+	}
+}
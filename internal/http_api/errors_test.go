@@ -0,0 +1,45 @@
+package http_api
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var errCodeRegex = regexp.MustCompile(`Err\{[^,{}]+, "([A-Z][A-Z0-9_]*)`)
+
+// TestErrorCodesRegistered checks that every code returned by the handlers of
+// nsqd, nsqlookupd and nsqadmin is documented in ErrorCodes
+func TestErrorCodesRegistered(t *testing.T) {
+	var files []string
+	for _, dir := range []string{"../../nsqd", "../../nsqlookupd", "../../nsqadmin", "."} {
+		matches, err := filepath.Glob(filepath.Join(dir, "*.go"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, matches...)
+	}
+
+	found := 0
+	for _, fn := range files {
+		if strings.HasSuffix(fn, "_test.go") {
+			continue
+		}
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range errCodeRegex.FindAllSubmatch(data, -1) {
+			found++
+			code := string(m[1])
+			if _, ok := ErrorCodes[code]; !ok {
+				t.Errorf("%s: code %s is not in ErrorCodes", fn, code)
+			}
+		}
+	}
+	if found == 0 {
+		t.Fatal("found no error codes")
+	}
+}
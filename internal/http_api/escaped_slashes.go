@@ -0,0 +1,44 @@
+package http_api
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+var escapedSlashRegex = regexp.MustCompile(`(?i)%2f`)
+
+// EscapedSlashes wraps h so that path escaped slashes (%2F) aren't treated as
+// path separators when routing, letting a path parameter contain "/" (e.g. a
+// namespaced topic name). Parameters are left escaped for UnescapeSlashes.
+func EscapedSlashes(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.RawPath != "" && escapedSlashRegex.MatchString(req.URL.RawPath) {
+			parts := escapedSlashRegex.Split(req.URL.RawPath, -1)
+			for i, p := range parts {
+				p, err := url.PathUnescape(p)
+				if err != nil {
+					http.Error(w, "invalid path", http.StatusBadRequest)
+					return
+				}
+				parts[i] = p
+			}
+			req.URL.Path = strings.Join(parts, "%2F")
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// UnescapeSlashes is a Decorator that unescapes the slashes left escaped in
+// path parameters by EscapedSlashes
+func UnescapeSlashes(f APIHandler) APIHandler {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+		for i := range ps {
+			ps[i].Value = strings.Replace(ps[i].Value, "%2F", "/", -1)
+		}
+		return f(w, req, ps)
+	}
+}
@@ -0,0 +1,156 @@
+package http_api
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// RateLimiter is a token bucket that refills at a fixed rate (requests per second)
+// and allows bursts of up to one second's worth of requests.
+type RateLimiter struct {
+	sync.Mutex
+
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter allowing rate requests per second, or nil
+// (unlimited) when rate <= 0.
+func NewRateLimiter(rate float64) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	burst := math.Max(1, rate)
+	return &RateLimiter{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// Take consumes a token if one is available, otherwise it returns false and
+// the duration until the next token will be available.
+func (r *RateLimiter) Take() (bool, time.Duration) {
+	if r == nil {
+		return true, 0
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.refill(time.Now())
+	if r.tokens >= 1 {
+		r.tokens--
+		return true, 0
+	}
+	return false, r.wait()
+}
+
+// refill adds the tokens accrued since the last refill, r must be locked
+func (r *RateLimiter) refill(now time.Time) {
+	r.tokens = math.Min(r.burst, r.tokens+now.Sub(r.last).Seconds()*r.rate)
+	r.last = now
+}
+
+// wait is the duration until a token will be available, r must be locked
+func (r *RateLimiter) wait() time.Duration {
+	return time.Duration((1 - r.tokens) / r.rate * float64(time.Second))
+}
+
+// takeAll consumes a token from every limiter (nil limiters are ignored) if all
+// of them have one available, otherwise it consumes none and returns false and
+// the duration until they all will.
+//
+// The limiters are locked in order, so they must always be given in the same
+// order (e.g. the most specific first and a global one last).
+func takeAll(limiters []*RateLimiter) (bool, time.Duration) {
+	now := time.Now()
+	var wait time.Duration
+	for _, l := range limiters {
+		if l == nil {
+			continue
+		}
+		l.Lock()
+		defer l.Unlock()
+		l.refill(now)
+		if l.tokens < 1 && l.wait() > wait {
+			wait = l.wait()
+		}
+	}
+	if wait > 0 {
+		return false, wait
+	}
+	for _, l := range limiters {
+		if l != nil {
+			l.tokens--
+		}
+	}
+	return true, 0
+}
+
+// TakeN consumes n tokens (e.g. for a batch of messages) if they are
+// available. A batch larger than the burst is allowed when the bucket is full,
+// leaving it in debt until enough tokens have refilled.
+func (r *RateLimiter) TakeN(n float64) bool {
+	if r == nil {
+		return true
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.refill(time.Now())
+	if r.tokens >= math.Min(n, r.burst) {
+		r.tokens -= n
+		return true
+	}
+	return false
+}
+
+// RateLimit returns a Decorator that rejects requests with a 429 when any of the
+// given limiters (nil limiters are ignored) has no tokens available.
+//
+// A rejected request takes no token from any of the limiters, so e.g. requests
+// rejected by a global limiter don't use up a more specific one. The most specific
+// limiter should come first, the limiters of every route in the same order.
+func RateLimit(limiters ...*RateLimiter) Decorator {
+	return func(f APIHandler) APIHandler {
+		return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+			if err := rateLimited(w, limiters); err != nil {
+				return nil, err
+			}
+			return f(w, req, ps)
+		}
+	}
+}
+
+// RateLimitHandler is like RateLimit for a plain http.Handler (e.g. pprof)
+func RateLimitHandler(h http.Handler, limiters ...*RateLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := rateLimited(w, limiters); err != nil {
+			RespondV1(w, err.(Err).Code, err)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// rateLimited takes a token from every limiter, or sets the Retry-After header
+// and returns a 429 Err
+func rateLimited(w http.ResponseWriter, limiters []*RateLimiter) error {
+	ok, wait := takeAll(limiters)
+	if ok {
+		return nil
+	}
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	return Err{429, "TOO_MANY_REQUESTS"}
+}
@@ -0,0 +1,174 @@
+package http_api
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Param declares a parameter accepted by an endpoint
+type Param struct {
+	Name        string
+	In          string // "query", "path" or "body"
+	Type        string // "string", "integer", "boolean" or "object"
+	Required    bool
+	Description string
+}
+
+// Query declares a query string parameter
+func Query(name string, typ string, required bool, description string) Param {
+	return Param{name, "query", typ, required, description}
+}
+
+// Path declares a path parameter (i.e. a httprouter :name segment)
+func Path(name string, description string) Param {
+	return Param{name, "path", "string", true, description}
+}
+
+// Body declares the request body, typ "object" is JSON and anything else is raw bytes
+func Body(typ string, description string) Param {
+	return Param{"body", "body", typ, true, description}
+}
+
+// Route is the declaration of a single endpoint
+type Route struct {
+	Method  string
+	Path    string
+	Summary string
+	Params  []Param
+}
+
+// Router is an httprouter.Router that records the declared parameters of each
+// route so that an OpenAPI document can be generated from them
+type Router struct {
+	*httprouter.Router
+	routes []Route
+}
+
+func NewRouter() *Router {
+	return &Router{Router: httprouter.New()}
+}
+
+// Route registers handle for method and path and records its declaration
+func (r *Router) Route(method, path, summary string, handle httprouter.Handle, params ...Param) {
+	r.routes = append(r.routes, Route{method, path, summary, params})
+	r.Router.Handle(method, path, handle)
+}
+
+// RouteHandler is like Route for a plain http.Handler
+func (r *Router) RouteHandler(method, path, summary string, handler http.Handler, params ...Param) {
+	r.routes = append(r.routes, Route{method, path, summary, params})
+	r.Router.Handler(method, path, handler)
+}
+
+// Routes returns the declarations of all routes registered via Route or RouteHandler
+func (r *Router) Routes() []Route {
+	return r.routes
+}
+
+// SpecHandler returns an APIHandler that responds with the OpenAPI 3 document for r
+func (r *Router) SpecHandler(title string, version string) APIHandler {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+		return OpenAPISpec(title, version, r.routes), nil
+	}
+}
+
+// OpenAPISpec builds an OpenAPI 3 document describing routes
+func OpenAPISpec(title string, version string, routes []Route) map[string]interface{} {
+	paths := make(map[string]map[string]interface{})
+	for _, route := range routes {
+		p := openAPIPath(route.Path)
+		if _, ok := paths[p]; !ok {
+			paths[p] = make(map[string]interface{})
+		}
+
+		op := map[string]interface{}{
+			"summary": route.Summary,
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{"description": "OK"},
+				"default": map[string]interface{}{
+					"description": "error",
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{"$ref": "#/components/schemas/Error"},
+						},
+					},
+				},
+			},
+		}
+
+		var params []map[string]interface{}
+		for _, param := range route.Params {
+			if param.In == "body" {
+				contentType := "application/octet-stream"
+				if param.Type == "object" {
+					contentType = "application/json"
+				}
+				op["requestBody"] = map[string]interface{}{
+					"description": param.Description,
+					"required":    param.Required,
+					"content": map[string]interface{}{
+						contentType: map[string]interface{}{
+							"schema": map[string]interface{}{"type": param.Type},
+						},
+					},
+				}
+				continue
+			}
+			params = append(params, map[string]interface{}{
+				"name":        param.Name,
+				"in":          param.In,
+				"required":    param.Required,
+				"description": param.Description,
+				"schema":      map[string]interface{}{"type": param.Type},
+			})
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+
+		paths[p][strings.ToLower(route.Method)] = op
+	}
+
+	codes := make([]string, 0, len(ErrorCodes))
+	for code := range ErrorCodes {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]interface{}{
+			"title":   title,
+			"version": version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": map[string]interface{}{
+				"Error": map[string]interface{}{
+					"type":     "object",
+					"required": []string{"code", "message", "description"},
+					"properties": map[string]interface{}{
+						"code":        map[string]interface{}{"type": "string", "enum": codes},
+						"message":     map[string]interface{}{"type": "string", "enum": codes},
+						"description": map[string]interface{}{"type": "string"},
+						"detail":      map[string]interface{}{"type": "string"},
+					},
+				},
+			},
+		},
+	}
+}
+
+// openAPIPath converts httprouter :name and *name segments to OpenAPI {name} templates
+func openAPIPath(path string) string {
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		if len(part) > 1 && (part[0] == ':' || part[0] == '*') {
+			parts[i] = "{" + part[1:] + "}"
+		}
+	}
+	return strings.Join(parts, "/")
+}
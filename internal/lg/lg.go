@@ -63,7 +63,7 @@ func ParseLogLevel(levelstr string) (LogLevel, error) {
 		return DEBUG, nil
 	case "info":
 		return INFO, nil
-	case "warn":
+	case "warn", "warning":
 		return WARN, nil
 	case "error":
 		return ERROR, nil
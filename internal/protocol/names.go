@@ -2,20 +2,56 @@ package protocol
 
 import (
 	"regexp"
+	"strings"
 )
 
+// NamespaceSeparator separates the namespace a topic belongs to from the
+// rest of its name, e.g. tenantA/orders
+const NamespaceSeparator = "/"
+
 var validTopicChannelNameRegex = regexp.MustCompile(`^[\.a-zA-Z0-9_-]+(#ephemeral)?$`)
+var validNamespaceRegex = regexp.MustCompile(`^[\.a-zA-Z0-9_-]+$`)
 
 // IsValidTopicName checks a topic name for correctness
 func IsValidTopicName(name string) bool {
-	return isValidName(name)
+	namespace, rest := SplitNamespace(name)
+	if rest != name && !IsValidNamespace(namespace) {
+		return false
+	}
+	if len(name) > 64 {
+		return false
+	}
+	return isValidName(rest)
 }
 
 // IsValidChannelName checks a channel name for correctness
 func IsValidChannelName(name string) bool {
+	// nsqd quarantines the messages that keep timing out in a channel in
+	// <channel>#quarantine
+	if rest := strings.TrimSuffix(name, "#quarantine"); rest != name {
+		return !strings.HasSuffix(rest, "#ephemeral") && isValidName(rest)
+	}
 	return isValidName(name)
 }
 
+// IsValidNamespace checks a namespace name for correctness
+func IsValidNamespace(name string) bool {
+	if len(name) > 64 || len(name) < 1 {
+		return false
+	}
+	return validNamespaceRegex.MatchString(name)
+}
+
+// SplitNamespace returns the namespace of a topic name ("" if it has none)
+// and the rest of the name
+func SplitNamespace(topicName string) (string, string) {
+	parts := strings.SplitN(topicName, NamespaceSeparator, 2)
+	if len(parts) == 1 {
+		return "", topicName
+	}
+	return parts[0], parts[1]
+}
+
 func isValidName(name string) bool {
 	if len(name) > 64 || len(name) < 1 {
 		return false
@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"net"
+	"time"
+)
+
+// TCPOptions tunes TCP connections, e.g. to detect dead peers sooner over
+// flaky WAN links
+type TCPOptions struct {
+	// period between keep-alive probes (0 is the Go default, negative disables
+	// them)
+	KeepAlive time.Duration
+	// how long sent data may remain unacknowledged before the connection is
+	// closed (0 is the OS default, only supported on Linux)
+	UserTimeout time.Duration
+	NoDelay     bool
+}
+
+// Tune applies the options to conn, if it's a TCP connection
+func (o TCPOptions) Tune(conn net.Conn) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	switch {
+	case o.KeepAlive > 0:
+		err := tcpConn.SetKeepAlive(true)
+		if err != nil {
+			return err
+		}
+		err = tcpConn.SetKeepAlivePeriod(o.KeepAlive)
+		if err != nil {
+			return err
+		}
+	case o.KeepAlive < 0:
+		err := tcpConn.SetKeepAlive(false)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := tcpConn.SetNoDelay(o.NoDelay)
+	if err != nil {
+		return err
+	}
+
+	if o.UserTimeout > 0 {
+		return setUserTimeout(tcpConn, o.UserTimeout)
+	}
+	return nil
+}
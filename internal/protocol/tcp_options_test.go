@@ -0,0 +1,36 @@
+package protocol
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestTCPOptionsTune(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	test.Nil(t, err)
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	test.Nil(t, err)
+	defer conn.Close()
+
+	opts := TCPOptions{
+		KeepAlive: 5 * time.Second,
+		NoDelay:   false,
+	}
+	if runtime.GOOS == "linux" {
+		opts.UserTimeout = 10 * time.Second
+	}
+	test.Nil(t, opts.Tune(conn))
+	test.Nil(t, TCPOptions{KeepAlive: -1, NoDelay: true}.Tune(conn))
+
+	// other connections are left alone
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	test.Nil(t, opts.Tune(c1))
+}
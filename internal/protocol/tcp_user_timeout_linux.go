@@ -0,0 +1,29 @@
+// +build linux
+
+package protocol
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// TCP_USER_TIMEOUT from linux/tcp.h (not defined by package syscall)
+const tcpUserTimeout = 0x12
+
+// setUserTimeout sets TCP_USER_TIMEOUT of conn
+func setUserTimeout(conn *net.TCPConn, timeout time.Duration) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout,
+			int(timeout/time.Millisecond))
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
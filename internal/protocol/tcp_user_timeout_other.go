@@ -0,0 +1,14 @@
+// +build !linux
+
+package protocol
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// setUserTimeout is not supported beyond Linux
+func setUserTimeout(conn *net.TCPConn, timeout time.Duration) error {
+	return errors.New("TCP user timeout is only supported on Linux")
+}
@@ -4,6 +4,9 @@ import (
 	"strings"
 )
 
+// HostKey turns a <host>:<port> into a statsd key component (IPv6 hosts lose
+// their brackets)
 func HostKey(h string) string {
+	h = strings.NewReplacer("[", "", "]", "").Replace(h)
 	return strings.Replace(strings.Replace(h, ".", "_", -1), ":", "_", -1)
 }
@@ -0,0 +1,121 @@
+package statsd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Transport is a persistent TCP or TLS connection to statsd, for when UDP is too
+// lossy. Stats written to it are buffered until Flush, and those that fail to
+// send are kept (up to maxBufferSize bytes, dropping the oldest beyond that) to
+// retry on the next Flush. It is not safe for concurrent use.
+type Transport struct {
+	network       string
+	addr          string
+	tlsConfig     *tls.Config
+	timeout       time.Duration
+	maxBufferSize int
+
+	conn         net.Conn
+	buf          []byte
+	droppedCount uint64
+}
+
+// NewTransport returns a Transport to addr over network "tcp" or "tls"
+// (tlsConfig may be nil to verify statsd with the system roots), connecting and
+// writing with timeout
+func NewTransport(network string, addr string, tlsConfig *tls.Config, timeout time.Duration, maxBufferSize int) (*Transport, error) {
+	if network != "tcp" && network != "tls" {
+		return nil, fmt.Errorf("unsupported network %s", network)
+	}
+	return &Transport{
+		network:       network,
+		addr:          addr,
+		tlsConfig:     tlsConfig,
+		timeout:       timeout,
+		maxBufferSize: maxBufferSize,
+	}, nil
+}
+
+// Write buffers newline terminated stats
+func (t *Transport) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if over := len(t.buf) - t.maxBufferSize; over > 0 {
+		// drop whole stats, the oldest first
+		cut := len(t.buf)
+		if i := bytes.IndexByte(t.buf[over-1:], '\n'); i != -1 {
+			cut = over + i
+		}
+		t.droppedCount += uint64(bytes.Count(t.buf[:cut], []byte{'\n'}))
+		t.buf = append(t.buf[:0], t.buf[cut:]...)
+	}
+	return len(p), nil
+}
+
+// Buffered returns the number of bytes of stats waiting to be sent
+func (t *Transport) Buffered() int {
+	return len(t.buf)
+}
+
+// Dropped returns the number of stats dropped, as the buffer was full, since
+// the last call
+func (t *Transport) Dropped() uint64 {
+	dropped := t.droppedCount
+	t.droppedCount = 0
+	return dropped
+}
+
+// Flush sends the buffered stats, reconnecting once if that fails, keeping the
+// ones not sent to retry on the next Flush
+func (t *Transport) Flush() error {
+	var err error
+	for attempt := 0; attempt < 2 && len(t.buf) > 0; attempt++ {
+		if t.conn == nil {
+			err = t.connect()
+			if err != nil {
+				continue
+			}
+		}
+
+		var n int
+		t.conn.SetWriteDeadline(time.Now().Add(t.timeout))
+		n, err = t.conn.Write(t.buf)
+		// a stat partly written to a broken connection is sent again in full
+		sent := bytes.LastIndexByte(t.buf[:n], '\n') + 1
+		t.buf = append(t.buf[:0], t.buf[sent:]...)
+		if err == nil {
+			return nil
+		}
+		t.Close()
+	}
+	return err
+}
+
+func (t *Transport) connect() error {
+	dialer := &net.Dialer{Timeout: t.timeout}
+	var conn net.Conn
+	var err error
+	if t.network == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", t.addr, t.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", t.addr)
+	}
+	if err != nil {
+		return err
+	}
+	t.conn = conn
+	return nil
+}
+
+// Close closes the connection (a later Flush reconnects)
+func (t *Transport) Close() error {
+	if t.conn == nil {
+		return nil
+	}
+	err := t.conn.Close()
+	t.conn = nil
+	return err
+}
@@ -0,0 +1,60 @@
+package statsd
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestTransport(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	test.Nil(t, err)
+	addr := listener.Addr().String()
+
+	transport, err := NewTransport("tcp", addr, nil, time.Second, 25)
+	test.Nil(t, err)
+	defer transport.Close()
+	client := NewClient(transport, "nsq.")
+
+	// stats are kept while statsd is down, dropping the oldest beyond the buffer
+	listener.Close()
+	client.Incr("a", 1)
+	client.Incr("b", 2)
+	client.Incr("c", 3)
+	test.Equal(t, uint64(1), transport.Dropped())
+	test.NotNil(t, transport.Flush())
+	test.Equal(t, 20, transport.Buffered())
+
+	listener, err = net.Listen("tcp", addr)
+	test.Nil(t, err)
+	defer listener.Close()
+
+	client.Gauge("d", 4)
+	test.Equal(t, uint64(1), transport.Dropped())
+	test.Equal(t, uint64(0), transport.Dropped())
+	test.Nil(t, transport.Flush())
+	test.Equal(t, 0, transport.Buffered())
+
+	conn, err := listener.Accept()
+	test.Nil(t, err)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for _, expected := range []string{"nsq.c:3|c\n", "nsq.d:4|g\n"} {
+		line, err := r.ReadString('\n')
+		test.Nil(t, err)
+		test.Equal(t, expected, line)
+	}
+}
+
+func TestNewTransportNetwork(t *testing.T) {
+	_, err := NewTransport("udp", "127.0.0.1:8125", nil, time.Second, 32)
+	test.NotNil(t, err)
+}
+
+func TestHostKey(t *testing.T) {
+	test.Equal(t, "host_domain_com_4151", HostKey("host.domain.com:4151"))
+	test.Equal(t, "fd4a_622f_d2f2__1_4151", HostKey("[fd4a:622f:d2f2::1]:4151"))
+}
@@ -0,0 +1,218 @@
+package timingwheel
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	levelBits = 6
+	levelSize = 1 << levelBits
+	levelMask = levelSize - 1
+	numLevels = 5
+
+	// maxTicks is how far ahead the top level reaches, timers further away are
+	// put in its last slot and re-added from there
+	maxTicks = 1<<(levelBits*numLevels) - 1
+)
+
+// Timeouts is a hierarchical timing wheel of one-shot timers. It has levels of
+// levelSize slots, a slot of a level spanning a rotation of the level below. A
+// timer sits in the lowest level that reaches its expiry and moves down a level
+// (is cascaded) when its slot comes up, so adding, removing and expiring a
+// timer are O(1) however many are pending.
+//
+// Timers expire on the tick after their deadline, never before it.
+type Timeouts struct {
+	tick   time.Duration
+	expire func([]*Timer)
+
+	sync.Mutex
+	now     int64 // in ticks since the epoch
+	levels  [numLevels][levelSize]timerList
+	pending int
+
+	exitChan  chan int
+	waitGroup sync.WaitGroup
+}
+
+// Timer is a timeout of Timeouts, usually embedded in what it's the timeout of
+type Timer struct {
+	// Value identifies the timer to the expire func
+	Value interface{}
+
+	deadline   int64
+	list       *timerList
+	prev, next *Timer
+}
+
+// Deadline returns when the timer was last set to expire
+func (t *Timer) Deadline() time.Time {
+	return time.Unix(0, t.deadline)
+}
+
+type timerList struct {
+	head *Timer
+}
+
+func (l *timerList) push(t *Timer) {
+	t.list = l
+	t.prev = nil
+	t.next = l.head
+	if l.head != nil {
+		l.head.prev = t
+	}
+	l.head = t
+}
+
+func (l *timerList) remove(t *Timer) {
+	if t.prev != nil {
+		t.prev.next = t.next
+	} else {
+		l.head = t.next
+	}
+	if t.next != nil {
+		t.next.prev = t.prev
+	}
+	t.list = nil
+	t.prev = nil
+	t.next = nil
+}
+
+// NewTimeouts starts a Timeouts that advances every tick, calling expire (from
+// a single goroutine) with the timers that expired. The slice is reused, expire
+// must not keep it.
+func NewTimeouts(tick time.Duration, expire func([]*Timer)) *Timeouts {
+	w := &Timeouts{
+		tick:     tick,
+		expire:   expire,
+		now:      time.Now().UnixNano() / int64(tick),
+		exitChan: make(chan int),
+	}
+	w.waitGroup.Add(1)
+	go w.loop()
+	return w
+}
+
+// Stop stops the wheel, pending timers don't expire anymore
+func (w *Timeouts) Stop() {
+	close(w.exitChan)
+	w.waitGroup.Wait()
+}
+
+// Add (re)sets t to expire at deadline
+func (w *Timeouts) Add(t *Timer, deadline time.Time) {
+	w.Lock()
+	if t.list != nil {
+		t.list.remove(t)
+	} else {
+		w.pending++
+	}
+	t.deadline = deadline.UnixNano()
+	// the slot of now has been expired already
+	w.add(t, w.now+1)
+	w.Unlock()
+}
+
+// Remove stops t, returning whether it was pending (false if it expired)
+func (w *Timeouts) Remove(t *Timer) bool {
+	w.Lock()
+	defer w.Unlock()
+	if t.list == nil {
+		return false
+	}
+	t.list.remove(t)
+	w.pending--
+	return true
+}
+
+// Pending returns whether t is set and hasn't expired yet
+func (w *Timeouts) Pending(t *Timer) bool {
+	w.Lock()
+	defer w.Unlock()
+	return t.list != nil
+}
+
+// Len returns the number of pending timers
+func (w *Timeouts) Len() int {
+	w.Lock()
+	defer w.Unlock()
+	return w.pending
+}
+
+// add puts t in the slot of its expiry tick (at the earliest next) in the lowest
+// level that reaches it, it expects the caller to hold the lock
+func (w *Timeouts) add(t *Timer, next int64) {
+	tick := int64(w.tick)
+	expires := (t.deadline + tick - 1) / tick
+	if expires < next {
+		expires = next
+	}
+	delta := expires - w.now
+	if delta > maxTicks {
+		expires = w.now + maxTicks
+		delta = maxTicks
+	}
+	level := 0
+	for delta >= 1<<(levelBits*uint(level+1)) {
+		level++
+	}
+	slot := (expires >> (levelBits * uint(level))) & levelMask
+	w.levels[level][slot].push(t)
+}
+
+// advance moves the wheel to the tick target, cascading the timers of the
+// higher levels' slots that come up and appending those that expire to expired
+func (w *Timeouts) advance(target int64, expired []*Timer) []*Timer {
+	w.Lock()
+	defer w.Unlock()
+
+	for w.now < target {
+		w.now++
+		for level := 1; level < numLevels; level++ {
+			if w.now&(1<<(levelBits*uint(level))-1) != 0 {
+				break
+			}
+			list := &w.levels[level][(w.now>>(levelBits*uint(level)))&levelMask]
+			for list.head != nil {
+				t := list.head
+				list.remove(t)
+				// the slot of now in the lowest level is expired next
+				w.add(t, w.now)
+			}
+		}
+
+		list := &w.levels[0][w.now&levelMask]
+		for list.head != nil {
+			t := list.head
+			list.remove(t)
+			if t.deadline > w.now*int64(w.tick) {
+				// past the top level when added
+				w.add(t, w.now+1)
+				continue
+			}
+			w.pending--
+			expired = append(expired, t)
+		}
+	}
+	return expired
+}
+
+func (w *Timeouts) loop() {
+	defer w.waitGroup.Done()
+
+	var expired []*Timer
+	ticker := time.NewTicker(w.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			expired = w.advance(now.UnixNano()/int64(w.tick), expired[:0])
+			if len(expired) > 0 {
+				w.expire(expired)
+			}
+		case <-w.exitChan:
+			return
+		}
+	}
+}
@@ -0,0 +1,139 @@
+// Package timingwheel implements timing wheels: periodic tickers (Wheel) and
+// one-shot timeouts (Timeouts) of a coarse resolution, all driven by a single
+// goroutine and runtime timer instead of a runtime timer each.
+package timingwheel
+
+import (
+	"sync"
+	"time"
+)
+
+// Wheel advances one slot every tick, firing the tickers in the slot that are
+// due. A ticker of interval d sits in the slot d/tick ahead (wrapping around),
+// with the number of rotations left before it is due.
+type Wheel struct {
+	tick time.Duration
+
+	sync.Mutex
+	slots []map[*Ticker]struct{}
+	pos   int
+	due   []*Ticker
+
+	exitChan  chan int
+	waitGroup sync.WaitGroup
+}
+
+// Ticker delivers the time on C every interval (rounded up to the wheel's
+// tick), dropping ticks a slow receiver misses like a time.Ticker
+type Ticker struct {
+	C <-chan time.Time
+
+	c      chan time.Time
+	w      *Wheel
+	ticks  int
+	slot   int
+	rounds int
+}
+
+// New starts a Wheel of numSlots slots that advances every tick
+func New(tick time.Duration, numSlots int) *Wheel {
+	w := &Wheel{
+		tick:     tick,
+		slots:    make([]map[*Ticker]struct{}, numSlots),
+		exitChan: make(chan int),
+	}
+	for i := range w.slots {
+		w.slots[i] = make(map[*Ticker]struct{})
+	}
+	w.waitGroup.Add(1)
+	go w.loop()
+	return w
+}
+
+// Stop stops the wheel, its tickers don't fire anymore
+func (w *Wheel) Stop() {
+	close(w.exitChan)
+	w.waitGroup.Wait()
+}
+
+// NewTicker returns a Ticker firing every d
+func (w *Wheel) NewTicker(d time.Duration) *Ticker {
+	c := make(chan time.Time, 1)
+	t := &Ticker{
+		C: c,
+		c: c,
+		w: w,
+	}
+	t.Reset(d)
+	return t
+}
+
+// Reset stops the ticker and makes it fire every d from now
+func (t *Ticker) Reset(d time.Duration) {
+	ticks := int((d + t.w.tick - 1) / t.w.tick)
+	if ticks < 1 {
+		ticks = 1
+	}
+
+	w := t.w
+	w.Lock()
+	delete(w.slots[t.slot], t)
+	t.ticks = ticks
+	w.schedule(t)
+	w.Unlock()
+}
+
+// Stop stops the ticker, it doesn't close C
+func (t *Ticker) Stop() {
+	w := t.w
+	w.Lock()
+	delete(w.slots[t.slot], t)
+	w.Unlock()
+}
+
+// schedule expects the caller to hold the wheel's lock
+func (w *Wheel) schedule(t *Ticker) {
+	t.slot = (w.pos + t.ticks) % len(w.slots)
+	t.rounds = (t.ticks - 1) / len(w.slots)
+	w.slots[t.slot][t] = struct{}{}
+}
+
+func (w *Wheel) loop() {
+	defer w.waitGroup.Done()
+
+	ticker := time.NewTicker(w.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			w.advance(now)
+		case <-w.exitChan:
+			return
+		}
+	}
+}
+
+// advance moves to the next slot, firing (and rescheduling) its due tickers
+func (w *Wheel) advance(now time.Time) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.pos = (w.pos + 1) % len(w.slots)
+	slot := w.slots[w.pos]
+	w.due = w.due[:0]
+	for t := range slot {
+		if t.rounds > 0 {
+			t.rounds--
+			continue
+		}
+		delete(slot, t)
+		w.due = append(w.due, t)
+	}
+	for _, t := range w.due {
+		select {
+		case t.c <- now:
+		default:
+		}
+		w.schedule(t)
+	}
+}
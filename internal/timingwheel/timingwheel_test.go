@@ -0,0 +1,135 @@
+package timingwheel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestTicker(t *testing.T) {
+	w := New(time.Millisecond, 8)
+	defer w.Stop()
+
+	// longer than a rotation
+	start := time.Now()
+	ticker := w.NewTicker(20 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		<-ticker.C
+	}
+	elapsed := time.Since(start)
+	if elapsed < 60*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("3 ticks of 20ms took %s", elapsed)
+	}
+
+	ticker.Stop()
+	select {
+	case <-ticker.C:
+	default:
+	}
+	select {
+	case <-ticker.C:
+		t.Fatal("stopped ticker fired")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ticker.Reset(2 * time.Millisecond)
+	select {
+	case <-ticker.C:
+	case <-time.After(time.Second):
+		t.Fatal("reset ticker didn't fire")
+	}
+}
+
+func TestTickerDropsMissedTicks(t *testing.T) {
+	w := New(time.Millisecond, 8)
+	defer w.Stop()
+
+	ticker := w.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	time.Sleep(20 * time.Millisecond)
+	test.Equal(t, 1, len(ticker.C))
+}
+
+func BenchmarkTickers(b *testing.B) {
+	w := New(time.Millisecond, 1024)
+	defer w.Stop()
+
+	tickers := make([]*Ticker, 0, b.N)
+	for i := 0; i < b.N; i++ {
+		tickers = append(tickers, w.NewTicker(time.Duration(i%1000)*time.Millisecond))
+	}
+	for _, ticker := range tickers {
+		ticker.Stop()
+	}
+}
+
+func TestTimeoutsAdvance(t *testing.T) {
+	tick := time.Millisecond
+	w := &Timeouts{tick: tick}
+
+	// in the lower levels
+	deadlines := []int64{1, 2, 63, 64, 65, 4095, 4096, 100000, 1 << 18, 1 << 20}
+	timers := make([]*Timer, len(deadlines))
+	for i, d := range deadlines {
+		timers[i] = &Timer{Value: i}
+		w.Add(timers[i], time.Unix(0, d*int64(tick)))
+	}
+	test.Equal(t, len(deadlines), w.Len())
+
+	removed := &Timer{}
+	w.Add(removed, time.Unix(0, 100*int64(tick)))
+	test.Equal(t, true, w.Remove(removed))
+	test.Equal(t, false, w.Remove(removed))
+
+	var now int64
+	expired := []*Timer{}
+	step := func(target int64) {
+		expired = w.advance(target, expired[:0])
+		now = target
+	}
+	for i, d := range deadlines {
+		want := d
+		if want > now+1 {
+			step(want - 1)
+			test.Equal(t, 0, len(expired))
+		}
+		step(want)
+		test.Equal(t, 1, len(expired))
+		test.Equal(t, i, expired[0].Value)
+		test.Equal(t, false, w.Pending(timers[i]))
+	}
+	test.Equal(t, 0, w.Len())
+}
+
+func TestTimeouts(t *testing.T) {
+	expiredChan := make(chan interface{}, 10)
+	w := NewTimeouts(time.Millisecond, func(timers []*Timer) {
+		for _, timer := range timers {
+			expiredChan <- timer.Value
+		}
+	})
+	defer w.Stop()
+
+	start := time.Now()
+	t1 := &Timer{Value: 1}
+	t2 := &Timer{Value: 2}
+	w.Add(t1, start.Add(50*time.Millisecond))
+	w.Add(t2, start.Add(20*time.Millisecond))
+	test.Equal(t, 2, <-expiredChan)
+	test.Equal(t, 1, <-expiredChan)
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatal("timer expired before its deadline")
+	}
+
+	// reset before expiring
+	w.Add(t1, time.Now().Add(20*time.Millisecond))
+	w.Add(t1, time.Now().Add(40*time.Millisecond))
+	test.Equal(t, 1, w.Len())
+	test.Equal(t, 1, <-expiredChan)
+	select {
+	case v := <-expiredChan:
+		t.Fatalf("timer %v expired twice", v)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
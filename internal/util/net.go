@@ -0,0 +1,51 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ValidateBindFamily checks the network listeners are bound with (--bind-family):
+// tcp (dual-stack), tcp4 or tcp6
+func ValidateBindFamily(family string) error {
+	switch family {
+	case "tcp", "tcp4", "tcp6":
+		return nil
+	}
+	return fmt.Errorf("--bind-family (%s) must be tcp, tcp4 or tcp6", family)
+}
+
+// bindAddr has an unspecified host (0.0.0.0 or [::]) stand for all the
+// addresses of the family bound, so that the default listen addresses work with tcp6
+func bindAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		return net.JoinHostPort("", port)
+	}
+	return addr
+}
+
+// ResolveBindAddr resolves a listen address ([<host>]:<port>, an IPv6 host in
+// brackets) for family
+func ResolveBindAddr(family, addr string) (*net.TCPAddr, error) {
+	return net.ResolveTCPAddr(family, bindAddr(addr))
+}
+
+// Listen listens on addr with family (see ResolveBindAddr)
+func Listen(family, addr string) (net.Listener, error) {
+	return net.Listen(family, bindAddr(addr))
+}
+
+// IsValidHost reports whether host is a hostname or IP address as advertised
+// alongside ports (e.g. --broadcast-address): IPv6 addresses without brackets,
+// and no port
+func IsValidHost(host string) bool {
+	if host == "" || strings.ContainsAny(host, "[]/ ") {
+		return false
+	}
+	return net.ParseIP(host) != nil || !strings.Contains(host, ":")
+}
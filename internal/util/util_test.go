@@ -1,6 +1,7 @@
 package util
 
 import (
+	"net"
 	"testing"
 
 	"github.com/nsqio/nsq/internal/test"
@@ -34,3 +35,36 @@ func TestUniqRands(t *testing.T) {
 	x = UniqRands(10, 20)
 	test.Equal(t, 10, len(x))
 }
+
+func TestBindAddr(t *testing.T) {
+	test.Equal(t, ":4150", bindAddr("0.0.0.0:4150"))
+	test.Equal(t, ":4150", bindAddr("[::]:4150"))
+	test.Equal(t, "[::1]:4150", bindAddr("[::1]:4150"))
+	test.Equal(t, "127.0.0.1:4150", bindAddr("127.0.0.1:4150"))
+
+	_, err := ResolveBindAddr("tcp6", "0.0.0.0:4150")
+	test.Nil(t, err)
+	_, err = ResolveBindAddr("tcp6", "127.0.0.1:4150")
+	test.NotNil(t, err)
+	_, err = ResolveBindAddr("tcp", "::1:4150")
+	test.NotNil(t, err)
+	test.NotNil(t, ValidateBindFamily("udp"))
+}
+
+func TestListenIPv6(t *testing.T) {
+	l, err := Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback - %s", err)
+	}
+	defer l.Close()
+	test.Equal(t, "::1", l.Addr().(*net.TCPAddr).IP.String())
+}
+
+func TestIsValidHost(t *testing.T) {
+	for _, host := range []string{"host.domain.com", "192.168.1.17", "fd4a:622f:d2f2::1"} {
+		test.Equal(t, true, IsValidHost(host))
+	}
+	for _, host := range []string{"", "[fd4a:622f:d2f2::1]", "host.domain.com:4150", "192.168.1.17:4150"} {
+		test.Equal(t, false, IsValidHost(host))
+	}
+}
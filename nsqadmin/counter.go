@@ -0,0 +1,90 @@
+package nsqadmin
+
+import (
+	"sync"
+	"time"
+)
+
+// counterSeriesLength is the number of samples of the processed messages kept,
+// at least minRateInterval apart
+const counterSeriesLength = 120
+
+// counterSample is the number of messages processed across nsqd at a time, and
+// the messages per second since the previous sample
+type counterSample struct {
+	Time  int64   `json:"time"`
+	Total int64   `json:"total"`
+	Rate  float64 `json:"rate"`
+
+	at time.Time
+}
+
+type channelCount struct {
+	messageCount int64
+	at           time.Time
+}
+
+// messageCounter sums the messages processed by the channels of every nsqd from
+// the increase of their message counts between requests, so that the total
+// doesn't go back when an nsqd restarts (resetting its counts) and jump when it
+// catches up. It keeps the recent samples of the total for the counter page.
+type messageCounter struct {
+	sync.Mutex
+	counts map[string]channelCount
+	total  int64
+	series []counterSample
+}
+
+func newMessageCounter() *messageCounter {
+	return &messageCounter{
+		counts: make(map[string]channelCount),
+	}
+}
+
+// update records the message counts of channels (by node, topic and channel)
+// at now, returning the total and its recent samples
+func (c *messageCounter) update(counts map[string]int64, now time.Time) (counterSample, []counterSample) {
+	c.Lock()
+	defer c.Unlock()
+
+	seeded := len(c.series) > 0
+	for key, messageCount := range counts {
+		last, ok := c.counts[key]
+		switch {
+		case !ok:
+			// the messages it processed before it was first seen are only part
+			// of the initial total
+			if !seeded {
+				c.total += messageCount
+			}
+		case messageCount < last.messageCount:
+			// nsqd restarted (or re-created the channel)
+			c.total += messageCount
+		default:
+			c.total += messageCount - last.messageCount
+		}
+		c.counts[key] = channelCount{messageCount: messageCount, at: now}
+	}
+	for key, last := range c.counts {
+		if now.Sub(last.at) > maxRateSampleAge {
+			delete(c.counts, key)
+		}
+	}
+
+	sample := counterSample{Time: now.Unix(), Total: c.total, at: now}
+	if !seeded {
+		c.series = append(c.series, sample)
+	} else {
+		prev := c.series[len(c.series)-1]
+		elapsed := now.Sub(prev.at)
+		sample.Rate = prev.Rate
+		if elapsed >= minRateInterval {
+			sample.Rate = float64(c.total-prev.Total) / elapsed.Seconds()
+			c.series = append(c.series, sample)
+			if len(c.series) > counterSeriesLength {
+				c.series = c.series[len(c.series)-counterSeriesLength:]
+			}
+		}
+	}
+	return sample, append([]counterSample(nil), c.series...)
+}
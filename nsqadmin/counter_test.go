@@ -0,0 +1,45 @@
+package nsqadmin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestMessageCounter(t *testing.T) {
+	c := newMessageCounter()
+	now := time.Now()
+
+	sample, series := c.update(map[string]int64{"t:c:n1": 100, "t:c:n2": 50}, now)
+	test.Equal(t, int64(150), sample.Total)
+	test.Equal(t, 1, len(series))
+
+	// too soon for a sample
+	sample, series = c.update(map[string]int64{"t:c:n1": 110, "t:c:n2": 50}, now.Add(time.Second))
+	test.Equal(t, int64(160), sample.Total)
+	test.Equal(t, 1, len(series))
+
+	// n2 restarted, a channel created since only counts from now
+	now = now.Add(minRateInterval)
+	sample, series = c.update(map[string]int64{"t:c:n1": 200, "t:c:n2": 10, "t:c2:n1": 1000}, now)
+	test.Equal(t, int64(260), sample.Total)
+	test.Equal(t, float64(110)/minRateInterval.Seconds(), sample.Rate)
+	test.Equal(t, 2, len(series))
+
+	// n2 unreachable
+	now = now.Add(minRateInterval)
+	sample, _ = c.update(map[string]int64{"t:c:n1": 200, "t:c2:n1": 1000}, now)
+	test.Equal(t, int64(260), sample.Total)
+	test.Equal(t, float64(0), sample.Rate)
+	now = now.Add(minRateInterval)
+	sample, _ = c.update(map[string]int64{"t:c:n1": 200, "t:c:n2": 20, "t:c2:n1": 1000}, now)
+	test.Equal(t, int64(270), sample.Total)
+
+	for i := 0; i < counterSeriesLength; i++ {
+		now = now.Add(minRateInterval)
+		_, series = c.update(nil, now)
+	}
+	test.Equal(t, counterSeriesLength, len(series))
+	test.Equal(t, now.Unix(), series[len(series)-1].Time)
+}
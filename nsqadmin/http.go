@@ -13,6 +13,7 @@ import (
 	"net/url"
 	"path"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
@@ -53,6 +54,10 @@ type httpServer struct {
 	client   *http_api.Client
 	ci       *clusterinfo.ClusterInfo
 	basePath string
+	rates    *messageRates
+	counter  *messageCounter
+	// nil unless --topology-refresh-interval is set
+	topology *topologyCache
 }
 
 func NewHTTPServer(ctx *Context) *httpServer {
@@ -61,58 +66,108 @@ func NewHTTPServer(ctx *Context) *httpServer {
 	client := http_api.NewClient(ctx.nsqadmin.httpClientTLSConfig, ctx.nsqadmin.getOpts().HTTPClientConnectTimeout,
 		ctx.nsqadmin.getOpts().HTTPClientRequestTimeout)
 
-	router := httprouter.New()
+	ci := clusterinfo.New(ctx.nsqadmin.logf, client)
+	ci.SetMaxConcurrency(ctx.nsqadmin.getOpts().ClusterInfoMaxConcurrency)
+	ci.SetCacheTTL(ctx.nsqadmin.getOpts().ClusterInfoCacheTTL)
+
+	router := http_api.NewRouter()
 	router.HandleMethodNotAllowed = true
 	router.PanicHandler = http_api.LogPanicHandler(ctx.nsqadmin.logf)
 	router.NotFound = http_api.LogNotFoundHandler(ctx.nsqadmin.logf)
 	router.MethodNotAllowed = http_api.LogMethodNotAllowedHandler(ctx.nsqadmin.logf)
 	s := &httpServer{
 		ctx:      ctx,
-		router:   router,
+		router:   http_api.EscapedSlashes(router),
 		client:   client,
-		ci:       clusterinfo.New(ctx.nsqadmin.logf, client),
+		ci:       ci,
 		basePath: ctx.nsqadmin.getOpts().BasePath,
+		rates:    newMessageRates(),
+		counter:  newMessageCounter(),
+	}
+	if ctx.nsqadmin.getOpts().TopologyRefreshInterval > 0 {
+		// without the response cache, refreshes would be stale
+		topologyCI := clusterinfo.New(ctx.nsqadmin.logf, client)
+		topologyCI.SetMaxConcurrency(ctx.nsqadmin.getOpts().ClusterInfoMaxConcurrency)
+		s.topology = newTopologyCache(ctx, topologyCI)
 	}
 
 	bp := func(p string) string {
 		return path.Join(s.basePath, p)
 	}
 
-	router.Handle("GET", bp("/"), http_api.Decorate(s.indexHandler, log))
-	router.Handle("GET", bp("/ping"), http_api.Decorate(s.pingHandler, log, http_api.PlainText))
-
-	router.Handle("GET", bp("/topics"), http_api.Decorate(s.indexHandler, log))
-	router.Handle("GET", bp("/topics/:topic"), http_api.Decorate(s.indexHandler, log))
-	router.Handle("GET", bp("/topics/:topic/:channel"), http_api.Decorate(s.indexHandler, log))
-	router.Handle("GET", bp("/nodes"), http_api.Decorate(s.indexHandler, log))
-	router.Handle("GET", bp("/nodes/:node"), http_api.Decorate(s.indexHandler, log))
-	router.Handle("GET", bp("/counter"), http_api.Decorate(s.indexHandler, log))
-	router.Handle("GET", bp("/lookup"), http_api.Decorate(s.indexHandler, log))
-
-	router.Handle("GET", bp("/static/:asset"), http_api.Decorate(s.staticAssetHandler, log, http_api.PlainText))
-	router.Handle("GET", bp("/fonts/:asset"), http_api.Decorate(s.staticAssetHandler, log, http_api.PlainText))
+	topicParam := http_api.Path("topic", "topic name")
+	channelParam := http_api.Path("channel", "channel name")
+	nodeParam := http_api.Path("node", "<broadcast_address>:<http_port> of an nsqd")
+
+	router.Route("GET", bp("/"), "UI", http_api.Decorate(s.indexHandler, log))
+	router.Route("GET", bp("/ping"), "health check", http_api.Decorate(s.pingHandler, log, http_api.PlainText))
+	router.Route("GET", bp("/api/spec"), "OpenAPI specification", http_api.Decorate(router.SpecHandler("nsqadmin", version.Binary), log, http_api.V1))
+
+	router.Route("GET", bp("/topics"), "UI", http_api.Decorate(s.indexHandler, log))
+	router.Route("GET", bp("/topics/:topic"), "UI", http_api.Decorate(s.indexHandler, log), topicParam)
+	router.Route("GET", bp("/topics/:topic/:channel"), "UI", http_api.Decorate(s.indexHandler, log), topicParam, channelParam)
+	router.Route("GET", bp("/nodes"), "UI", http_api.Decorate(s.indexHandler, log))
+	router.Route("GET", bp("/nodes/:node"), "UI", http_api.Decorate(s.indexHandler, log), nodeParam)
+	router.Route("GET", bp("/counter"), "UI", http_api.Decorate(s.indexHandler, log))
+	router.Route("GET", bp("/lookup"), "UI", http_api.Decorate(s.indexHandler, log))
+	router.Route("GET", bp("/health"), "UI", http_api.Decorate(s.indexHandler, log))
+
+	router.Route("GET", bp("/static/:asset"), "static UI asset", http_api.Decorate(s.staticAssetHandler, log, http_api.PlainText),
+		http_api.Path("asset", "asset name"))
+	router.Route("GET", bp("/fonts/:asset"), "static UI font", http_api.Decorate(s.staticAssetHandler, log, http_api.PlainText),
+		http_api.Path("asset", "asset name"))
 	if s.ctx.nsqadmin.getOpts().ProxyGraphite {
 		proxy := NewSingleHostReverseProxy(ctx.nsqadmin.graphiteURL, ctx.nsqadmin.getOpts().HTTPClientConnectTimeout,
 			ctx.nsqadmin.getOpts().HTTPClientRequestTimeout)
-		router.Handler("GET", bp("/render"), proxy)
+		router.RouteHandler("GET", bp("/render"), "graphite render API proxy", proxy)
 	}
 
 	// v1 endpoints
-	router.Handle("GET", bp("/api/topics"), http_api.Decorate(s.topicsHandler, log, http_api.V1))
-	router.Handle("GET", bp("/api/topics/:topic"), http_api.Decorate(s.topicHandler, log, http_api.V1))
-	router.Handle("GET", bp("/api/topics/:topic/:channel"), http_api.Decorate(s.channelHandler, log, http_api.V1))
-	router.Handle("GET", bp("/api/nodes"), http_api.Decorate(s.nodesHandler, log, http_api.V1))
-	router.Handle("GET", bp("/api/nodes/:node"), http_api.Decorate(s.nodeHandler, log, http_api.V1))
-	router.Handle("POST", bp("/api/topics"), http_api.Decorate(s.createTopicChannelHandler, log, http_api.V1))
-	router.Handle("POST", bp("/api/topics/:topic"), http_api.Decorate(s.topicActionHandler, log, http_api.V1))
-	router.Handle("POST", bp("/api/topics/:topic/:channel"), http_api.Decorate(s.channelActionHandler, log, http_api.V1))
-	router.Handle("DELETE", bp("/api/nodes/:node"), http_api.Decorate(s.tombstoneNodeForTopicHandler, log, http_api.V1))
-	router.Handle("DELETE", bp("/api/topics/:topic"), http_api.Decorate(s.deleteTopicHandler, log, http_api.V1))
-	router.Handle("DELETE", bp("/api/topics/:topic/:channel"), http_api.Decorate(s.deleteChannelHandler, log, http_api.V1))
-	router.Handle("GET", bp("/api/counter"), http_api.Decorate(s.counterHandler, log, http_api.V1))
-	router.Handle("GET", bp("/api/graphite"), http_api.Decorate(s.graphiteHandler, log, http_api.V1))
-	router.Handle("GET", bp("/config/:opt"), http_api.Decorate(s.doConfig, log, http_api.V1))
-	router.Handle("PUT", bp("/config/:opt"), http_api.Decorate(s.doConfig, log, http_api.V1))
+	router.Route("GET", bp("/api/topics"), "all topics", http_api.Decorate(s.topicsHandler, log, http_api.V1),
+		http_api.Query("inactive", "boolean", false, "return topics known to nsqlookupd without producers"),
+		http_api.Query("namespace", "string", false, "filter to the topics of a namespace"))
+	router.Route("GET", bp("/api/namespaces"), "namespaces and their topics", http_api.Decorate(s.namespacesHandler, log, http_api.V1))
+	router.Route("GET", bp("/api/topics/:topic"), "topic statistics", http_api.Decorate(s.topicHandler, log, http_api.V1, http_api.UnescapeSlashes), topicParam)
+	router.Route("GET", bp("/api/topics/:topic/:channel"), "channel statistics", http_api.Decorate(s.channelHandler, log, http_api.V1, http_api.UnescapeSlashes), topicParam, channelParam)
+	router.Route("GET", bp("/api/totals"), "depth, in-flight count and publish rate of each topic summed across nsqd, with a per-nsqd breakdown", http_api.Decorate(s.totalsHandler, log, http_api.V1),
+		http_api.Query("topic", "string", false, "only this topic"),
+		http_api.Query("namespace", "string", false, "only the topics of a namespace"))
+	router.Route("GET", bp("/api/nodes"), "all nsqd", http_api.Decorate(s.nodesHandler, log, http_api.V1))
+	router.Route("GET", bp("/api/nodes/:node"), "nsqd statistics", http_api.Decorate(s.nodeHandler, log, http_api.V1), nodeParam)
+	router.Route("GET", bp("/api/cluster/health"), "reachability, version, depth, disk usage and lookupd registration of every nsqd", http_api.Decorate(s.clusterHealthHandler, log, http_api.V1))
+	router.Route("POST", bp("/api/topics"), "create a topic and optional channel", http_api.Decorate(s.createTopicChannelHandler, log, http_api.V1),
+		http_api.Body("object", `{"topic": "...", "channel": "...", "declare": true|false}`))
+	router.Route("POST", bp("/api/topics/:topic"), "pause, unpause or empty a topic", http_api.Decorate(s.topicActionHandler, log, http_api.V1, http_api.UnescapeSlashes),
+		topicParam, http_api.Body("object", `{"action": "pause|unpause|empty"}`))
+	router.Route("POST", bp("/api/topics/:topic/:channel"), "pause, unpause or empty a channel", http_api.Decorate(s.channelActionHandler, log, http_api.V1, http_api.UnescapeSlashes),
+		topicParam, channelParam, http_api.Body("object", `{"action": "pause|unpause|empty"}`))
+	router.Route("DELETE", bp("/api/nodes/:node"), "tombstone a topic producer", http_api.Decorate(s.tombstoneNodeForTopicHandler, log, http_api.V1),
+		nodeParam, http_api.Body("object", `{"topic": "..."}`))
+	router.Route("DELETE", bp("/api/topics/:topic"), "delete a topic", http_api.Decorate(s.deleteTopicHandler, log, http_api.V1, http_api.UnescapeSlashes), topicParam)
+	router.Route("DELETE", bp("/api/topics/:topic/:channel"), "delete a channel", http_api.Decorate(s.deleteChannelHandler, log, http_api.V1, http_api.UnescapeSlashes), topicParam, channelParam)
+	router.Route("GET", bp("/api/topology"), "age of the cached topics and nodes (see --topology-refresh-interval)", http_api.Decorate(s.topologyHandler, log, http_api.V1))
+	router.Route("POST", bp("/api/topology"), "refresh the cached topics and nodes", http_api.Decorate(s.refreshTopologyHandler, log, http_api.V1))
+	router.Route("GET", bp("/api/counter"), "total message counts", http_api.Decorate(s.counterHandler, log, http_api.V1))
+	router.Route("GET", bp("/api/graphite"), "graphite data for a rate metric", http_api.Decorate(s.graphiteHandler, log, http_api.V1),
+		http_api.Query("metric", "string", true, "metric name (rate)"),
+		http_api.Query("target", "string", true, "graphite target"))
+	router.Route("GET", bp("/config/:opt"), "get a runtime option", http_api.Decorate(s.doConfig, log, http_api.V1),
+		http_api.Path("opt", "option name (as in the config file)"))
+	router.Route("PUT", bp("/config/:opt"), "set a runtime option", http_api.Decorate(s.doConfig, log, http_api.V1),
+		http_api.Path("opt", "option name (as in the config file)"), http_api.Body("object", "JSON encoded option value"))
+
+	// v2 endpoints, paginated
+	listParams := []http_api.Param{
+		http_api.Query("offset", "integer", false, "number of items to skip (default 0)"),
+		http_api.Query("limit", "integer", false, "maximum number of items (default 100, max 1000)"),
+		http_api.Query("sort", "string", false, "field to sort by, prefixed with - for descending order"),
+		http_api.Query("q", "string", false, "only the items whose name contains this"),
+		http_api.Query("fields", "string", false, "comma separated fields of the items to return (default all)"),
+	}
+	router.Route("GET", bp("/api/v2/topics"), "page of the topics with their totals across nsqd (sort by topic_name, depth, channel_depth, in_flight_count, message_count or message_rate; the nodes field is only returned if selected)", http_api.Decorate(s.topicsV2Handler, log, http_api.V1),
+		append(listParams, http_api.Query("namespace", "string", false, "only the topics of a namespace"))...)
+	router.Route("GET", bp("/api/v2/nodes"), "page of the nsqd (sort by hostname, broadcast_address, version, tcp_port or http_port)", http_api.Decorate(s.nodesV2Handler, log, http_api.V1),
+		listParams...)
 
 	return s
 }
@@ -145,6 +200,8 @@ func (s *httpServer) indexHandler(w http.ResponseWriter, req *http.Request, ps h
 		StatsdPrefix        string
 		NSQLookupd          []string
 		IsAdmin             bool
+		// seconds, 0 without the topology cache
+		TopologyRefreshInterval int
 	}{
 		Version:             version.Binary,
 		ProxyGraphite:       s.ctx.nsqadmin.getOpts().ProxyGraphite,
@@ -156,6 +213,8 @@ func (s *httpServer) indexHandler(w http.ResponseWriter, req *http.Request, ps h
 		StatsdPrefix:        s.ctx.nsqadmin.getOpts().StatsdPrefix,
 		NSQLookupd:          s.ctx.nsqadmin.getOpts().NSQLookupdHTTPAddresses,
 		IsAdmin:             s.isAuthorizedAdminRequest(req),
+
+		TopologyRefreshInterval: int(s.ctx.nsqadmin.getOpts().TopologyRefreshInterval / time.Second),
 	})
 
 	return nil, nil
@@ -202,12 +261,7 @@ func (s *httpServer) topicsHandler(w http.ResponseWriter, req *http.Request, ps
 		return nil, http_api.Err{400, err.Error()}
 	}
 
-	var topics []string
-	if len(s.ctx.nsqadmin.getOpts().NSQLookupdHTTPAddresses) != 0 {
-		topics, err = s.ci.GetLookupdTopics(s.ctx.nsqadmin.getOpts().NSQLookupdHTTPAddresses)
-	} else {
-		topics, err = s.ci.GetNSQDTopics(s.ctx.nsqadmin.getOpts().NSQDHTTPAddresses)
-	}
+	topics, err := s.getTopics()
 	if err != nil {
 		pe, ok := err.(clusterinfo.PartialErr)
 		if !ok {
@@ -218,6 +272,16 @@ func (s *httpServer) topicsHandler(w http.ResponseWriter, req *http.Request, ps
 		messages = append(messages, pe.Error())
 	}
 
+	if namespace, _ := reqParams.Get("namespace"); namespace != "" {
+		var namespaceTopics []string
+		for _, topicName := range topics {
+			if ns, _ := protocol.SplitNamespace(topicName); ns == namespace {
+				namespaceTopics = append(namespaceTopics, topicName)
+			}
+		}
+		topics = namespaceTopics
+	}
+
 	inactive, _ := reqParams.Get("inactive")
 	if inactive == "true" {
 		topicChannelMap := make(map[string][]string)
@@ -225,8 +289,7 @@ func (s *httpServer) topicsHandler(w http.ResponseWriter, req *http.Request, ps
 			goto respond
 		}
 		for _, topicName := range topics {
-			producers, _ := s.ci.GetLookupdTopicProducers(
-				topicName, s.ctx.nsqadmin.getOpts().NSQLookupdHTTPAddresses)
+			producers, _ := s.getTopicProducers(topicName)
 			if len(producers) == 0 {
 				topicChannels, _ := s.ci.GetLookupdTopicChannels(
 					topicName, s.ctx.nsqadmin.getOpts().NSQLookupdHTTPAddresses)
@@ -246,14 +309,40 @@ func (s *httpServer) topicsHandler(w http.ResponseWriter, req *http.Request, ps
 	}{topics, maybeWarnMsg(messages)}, nil
 }
 
+func (s *httpServer) namespacesHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	var messages []string
+
+	topics, err := s.getTopics()
+	if err != nil {
+		pe, ok := err.(clusterinfo.PartialErr)
+		if !ok {
+			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to get topics - %s", err)
+			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+		}
+		s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
+		messages = append(messages, pe.Error())
+	}
+
+	namespaces := make(map[string][]string)
+	for _, topicName := range topics {
+		namespace, _ := protocol.SplitNamespace(topicName)
+		if namespace != "" {
+			namespaces[namespace] = append(namespaces[namespace], topicName)
+		}
+	}
+
+	return struct {
+		Namespaces map[string][]string `json:"namespaces"`
+		Message    string              `json:"message"`
+	}{namespaces, maybeWarnMsg(messages)}, nil
+}
+
 func (s *httpServer) topicHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	var messages []string
 
 	topicName := ps.ByName("topic")
 
-	producers, err := s.ci.GetTopicProducers(topicName,
-		s.ctx.nsqadmin.getOpts().NSQLookupdHTTPAddresses,
-		s.ctx.nsqadmin.getOpts().NSQDHTTPAddresses)
+	producers, err := s.getTopicProducers(topicName)
 	if err != nil {
 		pe, ok := err.(clusterinfo.PartialErr)
 		if !ok {
@@ -285,15 +374,74 @@ func (s *httpServer) topicHandler(w http.ResponseWriter, req *http.Request, ps h
 	}{allNodesTopicStats, maybeWarnMsg(messages)}, nil
 }
 
+func (s *httpServer) totalsHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	var messages []string
+
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+	topicName, _ := reqParams.Get("topic")
+	namespace, _ := reqParams.Get("namespace")
+
+	var producers clusterinfo.Producers
+	if topicName != "" {
+		producers, err = s.getTopicProducers(topicName)
+	} else {
+		producers, err = s.getProducers()
+	}
+	if err != nil {
+		pe, ok := err.(clusterinfo.PartialErr)
+		if !ok {
+			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to get producers - %s", err)
+			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+		}
+		s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
+		messages = append(messages, pe.Error())
+	}
+	topicStats, _, err := s.ci.GetNSQDStats(producers, topicName, "", false)
+	if err != nil {
+		pe, ok := err.(clusterinfo.PartialErr)
+		if !ok {
+			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to get nsqd stats - %s", err)
+			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+		}
+		s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
+		messages = append(messages, pe.Error())
+	}
+
+	if namespace != "" {
+		var namespaceTopicStats []*clusterinfo.TopicStats
+		for _, ts := range topicStats {
+			if ns, _ := protocol.SplitNamespace(ts.TopicName); ns == namespace {
+				namespaceTopicStats = append(namespaceTopicStats, ts)
+			}
+		}
+		topicStats = namespaceTopicStats
+	}
+
+	now := time.Now()
+	totals := clusterinfo.NewTopicTotals(topicStats, func(node string, topicName string, messageCount int64) float64 {
+		return s.rates.rate(node, topicName, messageCount, now)
+	})
+	s.rates.prune(now)
+	if totals == nil {
+		totals = []*clusterinfo.TopicTotals{}
+	}
+
+	return struct {
+		Topics  []*clusterinfo.TopicTotals `json:"topics"`
+		Message string                     `json:"message"`
+	}{totals, maybeWarnMsg(messages)}, nil
+}
+
 func (s *httpServer) channelHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	var messages []string
 
 	topicName := ps.ByName("topic")
 	channelName := ps.ByName("channel")
 
-	producers, err := s.ci.GetTopicProducers(topicName,
-		s.ctx.nsqadmin.getOpts().NSQLookupdHTTPAddresses,
-		s.ctx.nsqadmin.getOpts().NSQDHTTPAddresses)
+	producers, err := s.getTopicProducers(topicName)
 	if err != nil {
 		pe, ok := err.(clusterinfo.PartialErr)
 		if !ok {
@@ -323,7 +471,7 @@ func (s *httpServer) channelHandler(w http.ResponseWriter, req *http.Request, ps
 func (s *httpServer) nodesHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	var messages []string
 
-	producers, err := s.ci.GetProducers(s.ctx.nsqadmin.getOpts().NSQLookupdHTTPAddresses, s.ctx.nsqadmin.getOpts().NSQDHTTPAddresses)
+	producers, err := s.getProducers()
 	if err != nil {
 		pe, ok := err.(clusterinfo.PartialErr)
 		if !ok {
@@ -340,12 +488,64 @@ func (s *httpServer) nodesHandler(w http.ResponseWriter, req *http.Request, ps h
 	}{producers, maybeWarnMsg(messages)}, nil
 }
 
+func (s *httpServer) clusterHealthHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	var messages []string
+	var unreachable []string
+
+	lookupdAddrs := s.ctx.nsqadmin.getOpts().NSQLookupdHTTPAddresses
+	nsqdAddrs := s.ctx.nsqadmin.getOpts().NSQDHTTPAddresses
+
+	producers, err := s.ci.GetProducers(lookupdAddrs, nsqdAddrs)
+	if err != nil {
+		pe, ok := err.(clusterinfo.PartialErr)
+		if !ok && len(lookupdAddrs) != 0 {
+			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to get nodes - %s", err)
+			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+		}
+		s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
+		switch {
+		case len(lookupdAddrs) != 0:
+			messages = append(messages, pe.Error())
+		case ok:
+			// nsqd that failed to respond are reported as unreachable nodes
+			for _, e := range pe.Errors() {
+				if ne, ok := e.(clusterinfo.NodeErr); ok {
+					unreachable = append(unreachable, ne.Node)
+				}
+			}
+		default:
+			unreachable = nsqdAddrs
+		}
+	}
+	for _, addr := range unreachable {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			messages = append(messages, fmt.Sprintf("invalid nsqd address %s", addr))
+			continue
+		}
+		httpPort, _ := strconv.Atoi(port)
+		producers = append(producers, &clusterinfo.Producer{
+			Hostname:         host,
+			BroadcastAddress: host,
+			HTTPPort:         httpPort,
+		})
+	}
+
+	health := s.ci.GetNSQDHealth(producers, len(lookupdAddrs))
+
+	return struct {
+		*clusterinfo.ClusterHealth
+		Lookupd []string `json:"nsqlookupd"`
+		Message string   `json:"message"`
+	}{health, lookupdAddrs, maybeWarnMsg(messages)}, nil
+}
+
 func (s *httpServer) nodeHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	var messages []string
 
 	node := ps.ByName("node")
 
-	producers, err := s.ci.GetProducers(s.ctx.nsqadmin.getOpts().NSQLookupdHTTPAddresses, s.ctx.nsqadmin.getOpts().NSQDHTTPAddresses)
+	producers, err := s.getProducers()
 	if err != nil {
 		pe, ok := err.(clusterinfo.PartialErr)
 		if !ok {
@@ -433,6 +633,9 @@ func (s *httpServer) createTopicChannelHandler(w http.ResponseWriter, req *http.
 	var body struct {
 		Topic   string `json:"topic"`
 		Channel string `json:"channel"`
+		// also declare the channel in nsqlookupd, so that every nsqd creates it
+		// along with the topic
+		Declare bool `json:"declare"`
 	}
 
 	if !s.isAuthorizedAdminRequest(req) {
@@ -452,8 +655,15 @@ func (s *httpServer) createTopicChannelHandler(w http.ResponseWriter, req *http.
 		return nil, http_api.Err{400, "INVALID_CHANNEL"}
 	}
 
-	err = s.ci.CreateTopicChannel(body.Topic, body.Channel,
-		s.ctx.nsqadmin.getOpts().NSQLookupdHTTPAddresses)
+	lookupdHTTPAddrs := s.ctx.nsqadmin.getOpts().NSQLookupdHTTPAddresses
+	if body.Declare && (len(body.Channel) == 0 || strings.HasSuffix(body.Channel, "#ephemeral")) {
+		return nil, http_api.Err{400, "INVALID_CHANNEL"}
+	}
+	if body.Declare && len(lookupdHTTPAddrs) == 0 {
+		return nil, http_api.Err{400, "NSQLOOKUPD_REQUIRED"}
+	}
+
+	err = s.ci.CreateTopicChannel(body.Topic, body.Channel, lookupdHTTPAddrs)
 	if err != nil {
 		pe, ok := err.(clusterinfo.PartialErr)
 		if !ok {
@@ -464,10 +674,26 @@ func (s *httpServer) createTopicChannelHandler(w http.ResponseWriter, req *http.
 		messages = append(messages, pe.Error())
 	}
 
+	if body.Declare {
+		err = s.ci.DeclareChannel(body.Topic, body.Channel, lookupdHTTPAddrs)
+		if err != nil {
+			pe, ok := err.(clusterinfo.PartialErr)
+			if !ok {
+				s.ctx.nsqadmin.logf(LOG_ERROR, "failed to declare channel - %s", err)
+				return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+			}
+			s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
+			messages = append(messages, pe.Error())
+		}
+	}
+
 	s.notifyAdminAction("create_topic", body.Topic, "", "", req)
 	if len(body.Channel) > 0 {
 		s.notifyAdminAction("create_channel", body.Topic, body.Channel, "", req)
 	}
+	if body.Declare {
+		s.notifyAdminAction("declare_channel", body.Topic, body.Channel, "", req)
+	}
 
 	return struct {
 		Message string `json:"message"`
@@ -549,6 +775,8 @@ func (s *httpServer) topicChannelAction(req *http.Request, topicName string, cha
 
 	var body struct {
 		Action string `json:"action"`
+		Node   string `json:"node"`
+		Target string `json:"target"`
 	}
 
 	if !s.isAuthorizedAdminRequest(req) {
@@ -603,6 +831,19 @@ func (s *httpServer) topicChannelAction(req *http.Request, topicName string, cha
 
 			s.notifyAdminAction("empty_topic", topicName, "", "", req)
 		}
+	case "migrate":
+		if channelName != "" {
+			return nil, http_api.Err{400, "INVALID_ACTION"}
+		}
+		if body.Node == "" {
+			return nil, http_api.Err{400, "MISSING_ARG_NODE"}
+		}
+		if body.Target == "" {
+			return nil, http_api.Err{400, "MISSING_ARG_TARGET"}
+		}
+		err = s.ci.MigrateTopic(topicName, body.Node, body.Target)
+
+		s.notifyAdminAction("migrate_topic", topicName, "", body.Node, req)
 	default:
 		return nil, http_api.Err{400, "INVALID_ACTION"}
 	}
@@ -633,7 +874,7 @@ func (s *httpServer) counterHandler(w http.ResponseWriter, req *http.Request, ps
 	var messages []string
 	stats := make(map[string]*counterStats)
 
-	producers, err := s.ci.GetProducers(s.ctx.nsqadmin.getOpts().NSQLookupdHTTPAddresses, s.ctx.nsqadmin.getOpts().NSQDHTTPAddresses)
+	producers, err := s.getProducers()
 	if err != nil {
 		pe, ok := err.(clusterinfo.PartialErr)
 		if !ok {
@@ -670,10 +911,20 @@ func (s *httpServer) counterHandler(w http.ResponseWriter, req *http.Request, ps
 		}
 	}
 
+	counts := make(map[string]int64, len(stats))
+	for key, cs := range stats {
+		counts[key] = cs.MessageCount
+	}
+	sample, series := s.counter.update(counts, time.Now())
+
 	return struct {
-		Stats   map[string]*counterStats `json:"stats"`
-		Message string                   `json:"message"`
-	}{stats, maybeWarnMsg(messages)}, nil
+		Stats map[string]*counterStats `json:"stats"`
+		// messages processed across nsqd, see messageCounter
+		Total   int64           `json:"total"`
+		Rate    float64         `json:"rate"`
+		Series  []counterSample `json:"series"`
+		Message string          `json:"message"`
+	}{stats, sample.Total, sample.Rate, series, maybeWarnMsg(messages)}, nil
 }
 
 func (s *httpServer) graphiteHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
@@ -776,6 +1027,9 @@ func (s *httpServer) doConfig(w http.ResponseWriter, req *http.Request, ps httpr
 			return nil, http_api.Err{400, "INVALID_OPTION"}
 		}
 		s.ctx.nsqadmin.swapOpts(&opts)
+		if s.topology != nil {
+			s.topology.requestRefresh()
+		}
 	}
 
 	v, ok := getOptByCfgName(s.ctx.nsqadmin.getOpts(), opt)
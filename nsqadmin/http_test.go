@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -67,6 +68,14 @@ func bootstrapNSQCluster(t *testing.T) (string, []*nsqd.NSQD, []*nsqlookupd.NSQL
 }
 
 func bootstrapNSQClusterWithAuth(t *testing.T, withAuth bool) (string, []*nsqd.NSQD, []*nsqlookupd.NSQLookupd, *NSQAdmin) {
+	return bootstrapNSQClusterWithOptions(t, func(opts *Options) {
+		if withAuth {
+			opts.AdminUsers = []string{"matt"}
+		}
+	})
+}
+
+func bootstrapNSQClusterWithOptions(t *testing.T, setOpts func(opts *Options)) (string, []*nsqd.NSQD, []*nsqlookupd.NSQLookupd, *NSQAdmin) {
 	lgr := test.NewTestLogger(t)
 
 	nsqlookupdOpts := nsqlookupd.NewOptions()
@@ -113,9 +122,7 @@ func bootstrapNSQClusterWithAuth(t *testing.T, withAuth bool) (string, []*nsqd.N
 	nsqadminOpts.HTTPAddress = "127.0.0.1:0"
 	nsqadminOpts.NSQLookupdHTTPAddresses = []string{nsqlookupd1.RealHTTPAddr().String()}
 	nsqadminOpts.Logger = lgr
-	if withAuth {
-		nsqadminOpts.AdminUsers = []string{"matt"}
-	}
+	setOpts(nsqadminOpts)
 	nsqadmin1, err := New(nsqadminOpts)
 	if err != nil {
 		panic(err)
@@ -179,6 +186,58 @@ func TestHTTPTopicsGET(t *testing.T) {
 	test.Equal(t, topicName, tr.Topics[0])
 }
 
+func TestTopologyCache(t *testing.T) {
+	dataPath, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQClusterWithOptions(t, func(opts *Options) {
+		opts.TopologyRefreshInterval = time.Hour
+	})
+	defer os.RemoveAll(dataPath)
+	defer nsqds[0].Exit()
+	defer nsqlookupds[0].Exit()
+	defer nsqadmin1.Exit()
+
+	var status topologyStatus
+	get := func(path string, v interface{}) {
+		url := fmt.Sprintf("http://%s%s", nsqadmin1.RealHTTPAddr(), path)
+		resp, err := http.Get(url)
+		test.Nil(t, err)
+		test.Equal(t, 200, resp.StatusCode)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		t.Logf("%s", body)
+		err = json.Unmarshal(body, v)
+		test.Nil(t, err)
+	}
+	get("/api/topology", &status)
+	test.Equal(t, true, status.Enabled)
+	test.Equal(t, int64(3600), status.RefreshInterval)
+	test.NotNil(t, status.RefreshTime)
+	refreshTime := status.RefreshTime
+
+	// not queried before the next refresh
+	topicName := "test_topology_cache" + strconv.Itoa(int(time.Now().Unix()))
+	nsqds[0].GetTopic(topicName)
+	time.Sleep(100 * time.Millisecond)
+	tr := TopicsDoc{}
+	get("/api/topics", &tr)
+	test.Equal(t, 0, len(tr.Topics))
+
+	url := fmt.Sprintf("http://%s/api/topology", nsqadmin1.RealHTTPAddr())
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	test.Nil(t, err)
+	test.Equal(t, true, status.RefreshTime >= refreshTime)
+
+	get("/api/topics", &tr)
+	test.Equal(t, 1, len(tr.Topics))
+	test.Equal(t, topicName, tr.Topics[0])
+	ts := TopicStatsDoc{}
+	get("/api/topics/"+topicName, &ts)
+	test.Equal(t, 1, len(ts.NodeStats))
+}
+
 func TestHTTPTopicGET(t *testing.T) {
 	dataPath, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
 	defer os.RemoveAll(dataPath)
@@ -211,6 +270,57 @@ func TestHTTPTopicGET(t *testing.T) {
 	test.Equal(t, false, ts.Paused)
 }
 
+func TestHTTPNamespacedTopicGET(t *testing.T) {
+	dataPath, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
+	defer os.RemoveAll(dataPath)
+	defer nsqds[0].Exit()
+	defer nsqlookupds[0].Exit()
+	defer nsqadmin1.Exit()
+
+	topicName := "tenant/test_namespaced_topic_get" + strconv.Itoa(int(time.Now().Unix()))
+	nsqds[0].GetTopic(topicName)
+	nsqds[0].GetTopic("test_topic_get" + strconv.Itoa(int(time.Now().Unix())))
+	time.Sleep(100 * time.Millisecond)
+
+	client := http.Client{}
+	url := fmt.Sprintf("http://%s/api/topics?namespace=tenant", nsqadmin1.RealHTTPAddr())
+	resp, err := client.Get(url)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	tr := TopicsDoc{}
+	err = json.Unmarshal(body, &tr)
+	test.Nil(t, err)
+	test.Equal(t, []interface{}{topicName}, tr.Topics)
+
+	url = fmt.Sprintf("http://%s/api/namespaces", nsqadmin1.RealHTTPAddr())
+	resp, err = client.Get(url)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	nr := struct {
+		Namespaces map[string][]string `json:"namespaces"`
+	}{}
+	err = json.Unmarshal(body, &nr)
+	test.Nil(t, err)
+	test.Equal(t, map[string][]string{"tenant": {topicName}}, nr.Namespaces)
+
+	// the topic's slash is path escaped
+	url = fmt.Sprintf("http://%s/api/topics/%s", nsqadmin1.RealHTTPAddr(),
+		strings.Replace(topicName, "/", "%2F", 1))
+	resp, err = client.Get(url)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	ts := TopicStatsDoc{}
+	err = json.Unmarshal(body, &ts)
+	test.Nil(t, err)
+	test.Equal(t, topicName, ts.TopicName)
+}
+
 func TestHTTPNodesGET(t *testing.T) {
 	dataPath, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
 	defer os.RemoveAll(dataPath)
@@ -245,6 +355,174 @@ func TestHTTPNodesGET(t *testing.T) {
 	test.Equal(t, 0, len(testNode.Topics))
 }
 
+func TestHTTPClusterHealthGET(t *testing.T) {
+	dataPath, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
+	defer os.RemoveAll(dataPath)
+	defer nsqds[0].Exit()
+	defer nsqlookupds[0].Exit()
+	defer nsqadmin1.Exit()
+
+	topicName := "test_cluster_health" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqds[0].GetTopic(topicName)
+	topic.GetChannel("ch")
+	topic.PutMessage(nsqd.NewMessage(nsqd.MessageID{}, []byte("1234")))
+	time.Sleep(100 * time.Millisecond)
+
+	client := http.Client{}
+	url := fmt.Sprintf("http://%s/api/cluster/health", nsqadmin1.RealHTTPAddr())
+	req, _ := http.NewRequest("GET", url, nil)
+	resp, err := client.Do(req)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	t.Logf("%s", body)
+	var h clusterinfo.ClusterHealth
+	err = json.Unmarshal(body, &h)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(h.Nodes))
+	test.Equal(t, 1, h.Reachable)
+	test.Equal(t, 0, h.Unreachable)
+	test.Equal(t, false, h.VersionSkew)
+	test.Equal(t, int64(1), h.Depth)
+	n := h.Nodes[0]
+	test.Equal(t, true, n.Reachable)
+	test.Equal(t, version.Binary, n.Version)
+	test.Equal(t, nsqds[0].RealHTTPAddr().String(), n.Node)
+	test.Equal(t, 1, n.TopicCount)
+	test.Equal(t, 1, n.ChannelCount)
+	test.Equal(t, 1, n.LookupdRegistered)
+	test.Equal(t, false, n.Inconsistent)
+}
+
+func TestHTTPTotalsGET(t *testing.T) {
+	dataPath, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
+	defer os.RemoveAll(dataPath)
+	defer nsqds[0].Exit()
+	defer nsqlookupds[0].Exit()
+	defer nsqadmin1.Exit()
+
+	topicName := "test_totals" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqds[0].GetTopic(topicName)
+	topic.GetChannel("ch1")
+	topic.GetChannel("ch2")
+	topic.PutMessage(nsqd.NewMessage(nsqd.MessageID{}, []byte("1234")))
+	nsqds[0].GetTopic("other_totals" + strconv.Itoa(int(time.Now().Unix())))
+	time.Sleep(100 * time.Millisecond)
+
+	client := http.Client{}
+	url := fmt.Sprintf("http://%s/api/totals?topic=%s", nsqadmin1.RealHTTPAddr(), topicName)
+	resp, err := client.Get(url)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	t.Logf("%s", body)
+	var totals struct {
+		Topics []*clusterinfo.TopicTotals `json:"topics"`
+	}
+	err = json.Unmarshal(body, &totals)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(totals.Topics))
+	tt := totals.Topics[0]
+	test.Equal(t, topicName, tt.TopicName)
+	test.Equal(t, int64(0), tt.Depth)
+	test.Equal(t, int64(2), tt.ChannelDepth)
+	test.Equal(t, int64(1), tt.MessageCount)
+	test.Equal(t, float64(0), tt.MessageRate)
+	test.Equal(t, 1, len(tt.NodeTotals))
+	test.Equal(t, nsqds[0].RealHTTPAddr().String(), tt.NodeTotals[0].Node)
+	test.Equal(t, int64(2), tt.NodeTotals[0].ChannelDepth)
+}
+
+func TestHTTPTopicsV2GET(t *testing.T) {
+	dataPath, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
+	defer os.RemoveAll(dataPath)
+	defer nsqds[0].Exit()
+	defer nsqlookupds[0].Exit()
+	defer nsqadmin1.Exit()
+
+	prefix := "test_topics_v2" + strconv.Itoa(int(time.Now().Unix()))
+	for i := 0; i < 3; i++ {
+		topic := nsqds[0].GetTopic(prefix + "_" + strconv.Itoa(i))
+		for j := 0; j < i; j++ {
+			topic.PutMessage(nsqd.NewMessage(nsqd.MessageID{}, []byte("1234")))
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	type topicsV2Doc struct {
+		Total  int                      `json:"total"`
+		Offset int                      `json:"offset"`
+		Limit  int                      `json:"limit"`
+		Topics []map[string]interface{} `json:"topics"`
+	}
+	client := http.Client{}
+	get := func(query string) (int, topicsV2Doc) {
+		url := fmt.Sprintf("http://%s/api/v2/topics?q=%s&%s", nsqadmin1.RealHTTPAddr(), prefix, query)
+		resp, err := client.Get(url)
+		test.Nil(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		t.Logf("%s", body)
+		var doc topicsV2Doc
+		json.Unmarshal(body, &doc)
+		return resp.StatusCode, doc
+	}
+
+	code, doc := get("limit=2&offset=1")
+	test.Equal(t, 200, code)
+	test.Equal(t, 3, doc.Total)
+	test.Equal(t, 1, doc.Offset)
+	test.Equal(t, 2, doc.Limit)
+	test.Equal(t, 2, len(doc.Topics))
+	test.Equal(t, prefix+"_1", doc.Topics[0]["topic_name"])
+	test.Equal(t, prefix+"_2", doc.Topics[1]["topic_name"])
+	test.Equal(t, nil, doc.Topics[0]["nodes"])
+
+	code, doc = get("sort=-depth&fields=depth")
+	test.Equal(t, 200, code)
+	test.Equal(t, 3, len(doc.Topics))
+	test.Equal(t, prefix+"_2", doc.Topics[0]["topic_name"])
+	test.Equal(t, float64(2), doc.Topics[0]["depth"])
+	test.Equal(t, 2, len(doc.Topics[0]))
+
+	code, _ = get("sort=nope")
+	test.Equal(t, 400, code)
+	code, _ = get("limit=0")
+	test.Equal(t, 400, code)
+}
+
+func TestHTTPNodesV2GET(t *testing.T) {
+	dataPath, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
+	defer os.RemoveAll(dataPath)
+	defer nsqds[0].Exit()
+	defer nsqlookupds[0].Exit()
+	defer nsqadmin1.Exit()
+
+	client := http.Client{}
+	url := fmt.Sprintf("http://%s/api/v2/nodes?fields=version", nsqadmin1.RealHTTPAddr())
+	resp, err := client.Get(url)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	t.Logf("%s", body)
+	var doc struct {
+		Total int                      `json:"total"`
+		Nodes []map[string]interface{} `json:"nodes"`
+	}
+	err = json.Unmarshal(body, &doc)
+	test.Nil(t, err)
+	test.Equal(t, 1, doc.Total)
+	test.Equal(t, 1, len(doc.Nodes))
+	test.Equal(t, version.Binary, doc.Nodes[0]["version"])
+	test.Equal(t, 2, len(doc.Nodes[0]))
+}
+
 func TestHTTPChannelGET(t *testing.T) {
 	dataPath, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
 	defer os.RemoveAll(dataPath)
@@ -0,0 +1,146 @@
+package nsqadmin
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nsqio/nsq/internal/clusterinfo"
+	"github.com/nsqio/nsq/internal/http_api"
+	"github.com/nsqio/nsq/internal/protocol"
+)
+
+func (s *httpServer) topicsV2Handler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	var messages []string
+
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+	p, err := parseListParams(reqParams, []string{"topic_name", "depth", "channel_depth",
+		"in_flight_count", "message_count", "message_rate"})
+	if err != nil {
+		return nil, err
+	}
+
+	topics, err := s.getTopics()
+	if err != nil {
+		pe, ok := err.(clusterinfo.PartialErr)
+		if !ok {
+			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to get topics - %s", err)
+			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+		}
+		s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
+		messages = append(messages, pe.Error())
+	}
+
+	producers, err := s.getProducers()
+	if err != nil {
+		pe, ok := err.(clusterinfo.PartialErr)
+		if !ok {
+			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to get producers - %s", err)
+			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+		}
+		s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
+		messages = append(messages, pe.Error())
+	}
+	var topicStats []*clusterinfo.TopicStats
+	if len(producers) > 0 {
+		topicStats, _, err = s.ci.GetNSQDStats(producers, "", "", false)
+		if err != nil {
+			pe, ok := err.(clusterinfo.PartialErr)
+			if !ok {
+				s.ctx.nsqadmin.logf(LOG_ERROR, "failed to get nsqd stats - %s", err)
+				return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+			}
+			s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
+			messages = append(messages, pe.Error())
+		}
+	}
+
+	now := time.Now()
+	totals := clusterinfo.NewTopicTotals(topicStats, func(node string, topicName string, messageCount int64) float64 {
+		return s.rates.rate(node, topicName, messageCount, now)
+	})
+	s.rates.prune(now)
+	// topics without producers have no stats
+	known := make(map[string]bool, len(totals))
+	for _, t := range totals {
+		known[t.TopicName] = true
+	}
+	for _, topicName := range topics {
+		if !known[topicName] {
+			totals = append(totals, &clusterinfo.TopicTotals{TopicName: topicName})
+		}
+	}
+
+	namespace, _ := reqParams.Get("namespace")
+	withNodes := false
+	for _, field := range p.fields {
+		withNodes = withNodes || field == "nodes"
+	}
+	var selected []*clusterinfo.TopicTotals
+	for _, t := range totals {
+		if ns, _ := protocol.SplitNamespace(t.TopicName); namespace != "" && ns != namespace {
+			continue
+		}
+		if !withNodes {
+			t.NodeTotals = nil
+		}
+		selected = append(selected, t)
+	}
+
+	page, total, err := p.apply(selected, "topic_name")
+	if err != nil {
+		s.ctx.nsqadmin.logf(LOG_ERROR, "failed to list topics - %s", err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+
+	return struct {
+		Total   int                      `json:"total"`
+		Offset  int                      `json:"offset"`
+		Limit   int                      `json:"limit"`
+		Topics  []map[string]interface{} `json:"topics"`
+		Message string                   `json:"message"`
+	}{total, p.offset, p.limit, page, maybeWarnMsg(messages)}, nil
+}
+
+func (s *httpServer) nodesV2Handler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	var messages []string
+
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+	p, err := parseListParams(reqParams, []string{"hostname", "broadcast_address", "version",
+		"tcp_port", "http_port"})
+	if err != nil {
+		return nil, err
+	}
+
+	producers, err := s.getProducers()
+	if err != nil {
+		pe, ok := err.(clusterinfo.PartialErr)
+		if !ok {
+			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to get nodes - %s", err)
+			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+		}
+		s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
+		messages = append(messages, pe.Error())
+	}
+
+	page, total, err := p.apply(producers, "hostname")
+	if err != nil {
+		s.ctx.nsqadmin.logf(LOG_ERROR, "failed to list nodes - %s", err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+
+	return struct {
+		Total   int                      `json:"total"`
+		Offset  int                      `json:"offset"`
+		Limit   int                      `json:"limit"`
+		Nodes   []map[string]interface{} `json:"nodes"`
+		Message string                   `json:"message"`
+	}{total, p.offset, p.limit, page, maybeWarnMsg(messages)}, nil
+}
@@ -0,0 +1,146 @@
+package nsqadmin
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nsqio/nsq/internal/http_api"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// listParams are the pagination, sorting, filtering and field selection of a
+// v2 list endpoint, whose items are JSON objects named by their key field
+type listParams struct {
+	offset int
+	limit  int
+	sort   string
+	desc   bool
+	query  string
+	fields []string
+}
+
+// parseListParams parses the offset, limit, sort ("field" or "-field" for
+// descending, one of sortable), q (substring of the key field) and fields
+// (comma separated) query parameters
+func parseListParams(reqParams *http_api.ReqParams, sortable []string) (*listParams, error) {
+	p := &listParams{
+		limit: defaultListLimit,
+		sort:  sortable[0],
+	}
+
+	var err error
+	if v, _ := reqParams.Get("offset"); v != "" {
+		p.offset, err = strconv.Atoi(v)
+		if err != nil || p.offset < 0 {
+			return nil, http_api.Err{400, "INVALID_ARG_OFFSET"}
+		}
+	}
+	if v, _ := reqParams.Get("limit"); v != "" {
+		p.limit, err = strconv.Atoi(v)
+		if err != nil || p.limit < 1 || p.limit > maxListLimit {
+			return nil, http_api.Err{400, "INVALID_ARG_LIMIT"}
+		}
+	}
+	if v, _ := reqParams.Get("sort"); v != "" {
+		p.desc = strings.HasPrefix(v, "-")
+		p.sort = strings.TrimPrefix(v, "-")
+		found := false
+		for _, field := range sortable {
+			found = found || field == p.sort
+		}
+		if !found {
+			return nil, http_api.Err{400, "INVALID_ARG_SORT"}
+		}
+	}
+	p.query, _ = reqParams.Get("q")
+	if v, _ := reqParams.Get("fields"); v != "" {
+		p.fields = strings.Split(v, ",")
+	}
+	return p, nil
+}
+
+// apply returns the page of items (marshaled to JSON objects) matching p, and
+// the number of items matching before pagination. Items are filtered on and
+// tie broken by key, which is always selected.
+func (p *listParams) apply(items interface{}, key string) ([]map[string]interface{}, int, error) {
+	data, err := json.Marshal(items)
+	if err != nil {
+		return nil, 0, err
+	}
+	var objs []map[string]interface{}
+	err = json.Unmarshal(data, &objs)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	matching := objs[:0]
+	for _, obj := range objs {
+		name, _ := obj[key].(string)
+		if strings.Contains(name, p.query) {
+			matching = append(matching, obj)
+		}
+	}
+
+	sort.SliceStable(matching, func(i, j int) bool {
+		if c := compareJSON(matching[i][p.sort], matching[j][p.sort]); c != 0 {
+			return (c < 0) != p.desc
+		}
+		return compareJSON(matching[i][key], matching[j][key]) < 0
+	})
+
+	total := len(matching)
+	if p.offset >= total {
+		return []map[string]interface{}{}, total, nil
+	}
+	page := matching[p.offset:]
+	if len(page) > p.limit {
+		page = page[:p.limit]
+	}
+
+	if len(p.fields) > 0 {
+		for i, obj := range page {
+			selected := map[string]interface{}{key: obj[key]}
+			for _, field := range p.fields {
+				if v, ok := obj[field]; ok {
+					selected[field] = v
+				}
+			}
+			page[i] = selected
+		}
+	}
+	return page, total, nil
+}
+
+// compareJSON orders decoded JSON numbers, strings and booleans (mismatched or
+// other types compare equal)
+func compareJSON(a interface{}, b interface{}) int {
+	switch a := a.(type) {
+	case float64:
+		if b, ok := b.(float64); ok {
+			switch {
+			case a < b:
+				return -1
+			case a > b:
+				return 1
+			}
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b)
+		}
+	case bool:
+		if b, ok := b.(bool); ok && a != b {
+			if b {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
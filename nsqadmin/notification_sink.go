@@ -0,0 +1,205 @@
+package nsqadmin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"text/template"
+	"time"
+
+	"github.com/nsqio/nsq/internal/http_api"
+)
+
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// notificationSink delivers the notifications of admin actions somewhere
+// (--notification-http-endpoint, --notification-slack-webhook-url,
+// --notification-pagerduty-routing-key)
+type notificationSink interface {
+	String() string
+	Notify(a *AdminAction) error
+}
+
+// Summary describes the action in a line, for humans
+func (a *AdminAction) Summary() string {
+	target := a.Topic
+	if a.Channel != "" {
+		target += "/" + a.Channel
+	}
+	if a.Node != "" {
+		target += " on " + a.Node
+	}
+	by := a.User
+	if by == "" {
+		by = a.RemoteIP
+	}
+	return fmt.Sprintf("%s %s by %s via %s", a.Action, target, by, a.Via)
+}
+
+var notificationTemplateFuncs = template.FuncMap{
+	// json quotes a value for a JSON body
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+func parseNotificationTemplate(text string) (*template.Template, error) {
+	return template.New("notification").Funcs(notificationTemplateFuncs).Parse(text)
+}
+
+func newNotificationSinks(opts *Options) ([]notificationSink, error) {
+	client := &http.Client{
+		Transport: http_api.NewDeadlineTransport(opts.HTTPClientConnectTimeout, opts.HTTPClientRequestTimeout),
+	}
+
+	var sinks []notificationSink
+	if opts.NotificationHTTPEndpoint != "" {
+		s := &httpSink{
+			client:      client,
+			endpoint:    opts.NotificationHTTPEndpoint,
+			contentType: opts.NotificationHTTPContentType,
+		}
+		if s.contentType == "" {
+			s.contentType = "application/json"
+		}
+		if opts.NotificationHTTPTemplate != "" {
+			t, err := parseNotificationTemplate(opts.NotificationHTTPTemplate)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse --notification-http-template - %s", err)
+			}
+			s.template = t
+		}
+		sinks = append(sinks, s)
+	}
+	if opts.NotificationSlackWebhookURL != "" {
+		sinks = append(sinks, &slackSink{
+			client:     client,
+			webhookURL: opts.NotificationSlackWebhookURL,
+		})
+	}
+	if opts.NotificationPagerDutyRoutingKey != "" {
+		sinks = append(sinks, &pagerDutySink{
+			client:     client,
+			url:        pagerDutyEventsURL,
+			routingKey: opts.NotificationPagerDutyRoutingKey,
+		})
+	}
+	return sinks, nil
+}
+
+func postNotification(client *http.Client, endpoint string, contentType string, body io.Reader) error {
+	resp, err := client.Post(endpoint, contentType, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("got response %s %q", resp.Status, msg)
+	}
+	return nil
+}
+
+// httpSink POSTs the action as JSON, or the body rendered from
+// --notification-http-template with it
+type httpSink struct {
+	client      *http.Client
+	endpoint    string
+	contentType string
+	template    *template.Template
+}
+
+func (s *httpSink) String() string {
+	return "HTTP endpoint"
+}
+
+func (s *httpSink) Notify(a *AdminAction) error {
+	if s.template == nil {
+		body, err := json.Marshal(a)
+		if err != nil {
+			return err
+		}
+		return postNotification(s.client, s.endpoint, "application/json", bytes.NewReader(body))
+	}
+
+	var body bytes.Buffer
+	err := s.template.Execute(&body, a)
+	if err != nil {
+		return err
+	}
+	return postNotification(s.client, s.endpoint, s.contentType, &body)
+}
+
+// slackSink posts the summary of the action to a Slack incoming webhook
+type slackSink struct {
+	client     *http.Client
+	webhookURL string
+}
+
+func (s *slackSink) String() string {
+	return "Slack webhook"
+}
+
+func (s *slackSink) Notify(a *AdminAction) error {
+	body, err := json.Marshal(struct {
+		Text string `json:"text"`
+	}{
+		Text: fmt.Sprintf("nsqadmin: %s (<%s|details>)", a.Summary(), a.URL),
+	})
+	if err != nil {
+		return err
+	}
+	return postNotification(s.client, s.webhookURL, "application/json", bytes.NewReader(body))
+}
+
+// pagerDutySink triggers a PagerDuty event (Events API v2) of info severity
+// for the action, with its details
+type pagerDutySink struct {
+	client     *http.Client
+	url        string
+	routingKey string
+}
+
+func (s *pagerDutySink) String() string {
+	return "PagerDuty"
+}
+
+type pagerDutyPayload struct {
+	Summary       string       `json:"summary"`
+	Source        string       `json:"source"`
+	Severity      string       `json:"severity"`
+	Timestamp     string       `json:"timestamp"`
+	Component     string       `json:"component,omitempty"`
+	Group         string       `json:"group,omitempty"`
+	Class         string       `json:"class"`
+	CustomDetails *AdminAction `json:"custom_details"`
+}
+
+func (s *pagerDutySink) Notify(a *AdminAction) error {
+	body, err := json.Marshal(struct {
+		RoutingKey  string           `json:"routing_key"`
+		EventAction string           `json:"event_action"`
+		Payload     pagerDutyPayload `json:"payload"`
+	}{
+		RoutingKey:  s.routingKey,
+		EventAction: "trigger",
+		Payload: pagerDutyPayload{
+			Summary:       "nsqadmin: " + a.Summary(),
+			Source:        a.Via,
+			Severity:      "info",
+			Timestamp:     time.Unix(a.Timestamp, 0).UTC().Format(time.RFC3339),
+			Component:     a.Topic,
+			Group:         a.Channel,
+			Class:         a.Action,
+			CustomDetails: a,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return postNotification(s.client, s.url, "application/json", bytes.NewReader(body))
+}
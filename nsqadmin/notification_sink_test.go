@@ -0,0 +1,114 @@
+package nsqadmin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+type notificationRequest struct {
+	path        string
+	contentType string
+	body        string
+}
+
+func TestNotificationSinks(t *testing.T) {
+	requests := make(chan notificationRequest, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		requests <- notificationRequest{req.URL.Path, req.Header.Get("Content-Type"), string(body)}
+	}))
+	defer srv.Close()
+
+	dataPath, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQClusterWithOptions(t, func(opts *Options) {
+		opts.NotificationHTTPEndpoint = srv.URL + "/http"
+		opts.NotificationHTTPTemplate = `{{ .Action }} {{ .Topic }}: {{ json .Summary }}`
+		opts.NotificationHTTPContentType = "text/plain"
+		opts.NotificationSlackWebhookURL = srv.URL + "/slack"
+	})
+	defer os.RemoveAll(dataPath)
+	defer nsqds[0].Exit()
+	defer nsqlookupds[0].Exit()
+	defer nsqadmin1.Exit()
+
+	url := fmt.Sprintf("http://%s/api/topics", nsqadmin1.RealHTTPAddr())
+	body, _ := json.Marshal(map[string]interface{}{
+		"topic": "notified",
+	})
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(body))
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+
+	received := map[string]notificationRequest{}
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-requests:
+			received[r.path] = r
+		case <-time.After(5 * time.Second):
+			t.Fatal("notification not sent")
+		}
+	}
+
+	r := received["/http"]
+	test.Equal(t, "text/plain", r.contentType)
+	if !strings.HasPrefix(r.body, `create_topic notified: "create_topic notified by 127.0.0.1:`) {
+		t.Fatalf("unexpected templated notification %q", r.body)
+	}
+
+	var slack struct {
+		Text string `json:"text"`
+	}
+	r = received["/slack"]
+	test.Equal(t, "application/json", r.contentType)
+	test.Nil(t, json.Unmarshal([]byte(r.body), &slack))
+	if !strings.HasPrefix(slack.Text, "nsqadmin: create_topic notified by 127.0.0.1:") ||
+		!strings.HasSuffix(slack.Text, "/api/topics|details>)") {
+		t.Fatalf("unexpected Slack notification %q", slack.Text)
+	}
+
+	sink := &pagerDutySink{client: http.DefaultClient, url: srv.URL + "/pagerduty", routingKey: "key"}
+	err = sink.Notify(&AdminAction{
+		Action:    "delete_channel",
+		Topic:     "t",
+		Channel:   "c",
+		Timestamp: 1500000000,
+		User:      "alice",
+		Via:       "admin01",
+	})
+	test.Nil(t, err)
+	var event struct {
+		RoutingKey  string           `json:"routing_key"`
+		EventAction string           `json:"event_action"`
+		Payload     pagerDutyPayload `json:"payload"`
+	}
+	r = <-requests
+	test.Equal(t, "/pagerduty", r.path)
+	test.Nil(t, json.Unmarshal([]byte(r.body), &event))
+	test.Equal(t, "key", event.RoutingKey)
+	test.Equal(t, "trigger", event.EventAction)
+	test.Equal(t, "nsqadmin: delete_channel t/c by alice via admin01", event.Payload.Summary)
+	test.Equal(t, "2017-07-14T02:40:00Z", event.Payload.Timestamp)
+	test.Equal(t, "delete_channel", event.Payload.CustomDetails.Action)
+}
+
+func TestNotificationTemplateInvalid(t *testing.T) {
+	opts := NewOptions()
+	opts.NSQDHTTPAddresses = []string{"127.0.0.1:4151"}
+	opts.NotificationHTTPEndpoint = "http://127.0.0.1:1/"
+	opts.NotificationHTTPTemplate = "{{ .Action"
+	err := ValidateOptions(opts)
+	test.NotNil(t, err)
+	if !strings.HasPrefix(err.Error(), "failed to parse --notification-http-template") {
+		t.Fatalf("unexpected error %s", err)
+	}
+}
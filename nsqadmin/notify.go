@@ -39,7 +39,12 @@ func basicAuthUser(req *http.Request) string {
 }
 
 func (s *httpServer) notifyAdminAction(action, topic, channel, node string, req *http.Request) {
-	if s.ctx.nsqadmin.getOpts().NotificationHTTPEndpoint == "" {
+	// the action may have changed the topology
+	if s.topology != nil {
+		s.topology.requestRefresh()
+	}
+
+	if len(s.ctx.nsqadmin.notificationSinks) == 0 {
 		return
 	}
 	via, _ := os.Hostname()
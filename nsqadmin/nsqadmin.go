@@ -1,16 +1,13 @@
 package nsqadmin
 
 import (
-	"bytes"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
-	"net/http"
 	"net/url"
 	"os"
 	"path"
@@ -28,8 +25,10 @@ type NSQAdmin struct {
 	httpListener        net.Listener
 	waitGroup           util.WaitGroupWrapper
 	notifications       chan *AdminAction
+	notificationSinks   []notificationSink
 	graphiteURL         *url.URL
 	httpClientTLSConfig *tls.Config
+	exitChan            chan int
 }
 
 func New(opts *Options) (*NSQAdmin, error) {
@@ -39,23 +38,13 @@ func New(opts *Options) (*NSQAdmin, error) {
 
 	n := &NSQAdmin{
 		notifications: make(chan *AdminAction),
+		exitChan:      make(chan int),
 	}
 	n.swapOpts(opts)
 
-	if len(opts.NSQDHTTPAddresses) == 0 && len(opts.NSQLookupdHTTPAddresses) == 0 {
-		return nil, errors.New("--nsqd-http-address or --lookupd-http-address required")
-	}
-
-	if len(opts.NSQDHTTPAddresses) != 0 && len(opts.NSQLookupdHTTPAddresses) != 0 {
-		return nil, errors.New("use --nsqd-http-address or --lookupd-http-address not both")
-	}
-
-	if opts.HTTPClientTLSCert != "" && opts.HTTPClientTLSKey == "" {
-		return nil, errors.New("--http-client-tls-key must be specified with --http-client-tls-cert")
-	}
-
-	if opts.HTTPClientTLSKey != "" && opts.HTTPClientTLSCert == "" {
-		return nil, errors.New("--http-client-tls-cert must be specified with --http-client-tls-key")
+	err := ValidateOptions(opts)
+	if err != nil {
+		return nil, err
 	}
 
 	n.httpClientTLSConfig = &tls.Config{
@@ -82,47 +71,118 @@ func New(opts *Options) (*NSQAdmin, error) {
 		n.httpClientTLSConfig.RootCAs = tlsCertPool
 	}
 
+	if opts.ProxyGraphite {
+		url, err := url.Parse(opts.GraphiteURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse --graphite-url (%s) - %s", opts.GraphiteURL, err)
+		}
+		n.graphiteURL = url
+	}
+
+	n.notificationSinks, err = newNotificationSinks(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.BasePath = normalizeBasePath(opts.BasePath)
+
+	n.logf(LOG_INFO, version.String("nsqadmin"))
+
+	n.httpListener, err = util.Listen(n.getOpts().BindFamily, n.getOpts().HTTPAddress)
+	if err != nil {
+		return nil, fmt.Errorf("listen (%s) failed - %s", n.getOpts().HTTPAddress, err)
+	}
+
+	return n, nil
+}
+
+// ValidateOptions checks opts for problems that would prevent nsqadmin from starting
+// (without binding listeners)
+func ValidateOptions(opts *Options) error {
+	err := util.ValidateBindFamily(opts.BindFamily)
+	if err != nil {
+		return err
+	}
+	_, err = util.ResolveBindAddr(opts.BindFamily, opts.HTTPAddress)
+	if err != nil {
+		return fmt.Errorf("failed to parse --http-address (%s) - %s", opts.HTTPAddress, err)
+	}
+
+	if len(opts.NSQDHTTPAddresses) == 0 && len(opts.NSQLookupdHTTPAddresses) == 0 {
+		return errors.New("--nsqd-http-address or --lookupd-http-address required")
+	}
+
+	if len(opts.NSQDHTTPAddresses) != 0 && len(opts.NSQLookupdHTTPAddresses) != 0 {
+		return errors.New("use --nsqd-http-address or --lookupd-http-address not both")
+	}
+
+	if opts.NotificationHTTPTemplate != "" {
+		_, err := parseNotificationTemplate(opts.NotificationHTTPTemplate)
+		if err != nil {
+			return fmt.Errorf("failed to parse --notification-http-template - %s", err)
+		}
+	}
+
+	if opts.HTTPClientTLSCert != "" && opts.HTTPClientTLSKey == "" {
+		return errors.New("--http-client-tls-key must be specified with --http-client-tls-cert")
+	}
+
+	if opts.HTTPClientTLSKey != "" && opts.HTTPClientTLSCert == "" {
+		return errors.New("--http-client-tls-cert must be specified with --http-client-tls-key")
+	}
+
+	if opts.HTTPClientTLSCert != "" && opts.HTTPClientTLSKey != "" {
+		_, err := tls.LoadX509KeyPair(opts.HTTPClientTLSCert, opts.HTTPClientTLSKey)
+		if err != nil {
+			return fmt.Errorf("failed to LoadX509KeyPair %s, %s - %s",
+				opts.HTTPClientTLSCert, opts.HTTPClientTLSKey, err)
+		}
+	}
+
+	if opts.HTTPClientTLSRootCAFile != "" {
+		caCertFile, err := ioutil.ReadFile(opts.HTTPClientTLSRootCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read TLS root CA file %s - %s",
+				opts.HTTPClientTLSRootCAFile, err)
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(caCertFile) {
+			return fmt.Errorf("failed to AppendCertsFromPEM %s", opts.HTTPClientTLSRootCAFile)
+		}
+	}
+
 	for _, address := range opts.NSQLookupdHTTPAddresses {
 		_, err := net.ResolveTCPAddr("tcp", address)
 		if err != nil {
-			return nil, fmt.Errorf("failed to resolve --lookupd-http-address (%s) - %s", address, err)
+			return fmt.Errorf("failed to resolve --lookupd-http-address (%s) - %s", address, err)
 		}
 	}
 
 	for _, address := range opts.NSQDHTTPAddresses {
 		_, err := net.ResolveTCPAddr("tcp", address)
 		if err != nil {
-			return nil, fmt.Errorf("failed to resolve --nsqd-http-address (%s) - %s", address, err)
+			return fmt.Errorf("failed to resolve --nsqd-http-address (%s) - %s", address, err)
 		}
 	}
 
 	if opts.ProxyGraphite {
-		url, err := url.Parse(opts.GraphiteURL)
+		_, err := url.Parse(opts.GraphiteURL)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse --graphite-url (%s) - %s", opts.GraphiteURL, err)
-			os.Exit(1)
+			return fmt.Errorf("failed to parse --graphite-url (%s) - %s", opts.GraphiteURL, err)
 		}
-		n.graphiteURL = url
 	}
 
 	if opts.AllowConfigFromCIDR != "" {
 		_, _, err := net.ParseCIDR(opts.AllowConfigFromCIDR)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse --allow-config-from-cidr (%s) - %s", opts.AllowConfigFromCIDR, err)
+			return fmt.Errorf("failed to parse --allow-config-from-cidr (%s) - %s", opts.AllowConfigFromCIDR, err)
 		}
 	}
 
-	opts.BasePath = normalizeBasePath(opts.BasePath)
-
-	n.logf(LOG_INFO, version.String("nsqadmin"))
-
-	var err error
-	n.httpListener, err = net.Listen("tcp", n.getOpts().HTTPAddress)
-	if err != nil {
-		return nil, fmt.Errorf("listen (%s) failed - %s", n.getOpts().HTTPAddress, err)
+	if opts.TopologyRefreshInterval < 0 {
+		return errors.New("--topology-refresh-interval must be >= 0")
 	}
 
-	return n, nil
+	return nil
 }
 
 func normalizeBasePath(p string) string {
@@ -150,20 +210,13 @@ func (n *NSQAdmin) RealHTTPAddr() *net.TCPAddr {
 
 func (n *NSQAdmin) handleAdminActions() {
 	for action := range n.notifications {
-		content, err := json.Marshal(action)
-		if err != nil {
-			n.logf(LOG_ERROR, "failed to serialize admin action - %s", err)
-		}
-		httpclient := &http.Client{
-			Transport: http_api.NewDeadlineTransport(n.getOpts().HTTPClientConnectTimeout, n.getOpts().HTTPClientRequestTimeout),
-		}
-		n.logf(LOG_INFO, "POSTing notification to %s", n.getOpts().NotificationHTTPEndpoint)
-		resp, err := httpclient.Post(n.getOpts().NotificationHTTPEndpoint,
-			"application/json", bytes.NewBuffer(content))
-		if err != nil {
-			n.logf(LOG_ERROR, "failed to POST notification - %s", err)
+		for _, sink := range n.notificationSinks {
+			n.logf(LOG_INFO, "sending notification of %s to %s", action.Action, sink)
+			err := sink.Notify(action)
+			if err != nil {
+				n.logf(LOG_ERROR, "failed to send notification to %s - %s", sink, err)
+			}
 		}
-		resp.Body.Close()
 	}
 }
 
@@ -184,6 +237,9 @@ func (n *NSQAdmin) Main() error {
 		exitFunc(http_api.Serve(n.httpListener, http_api.CompressHandler(httpServer), "HTTP", n.logf))
 	})
 	n.waitGroup.Wrap(n.handleAdminActions)
+	if httpServer.topology != nil {
+		n.waitGroup.Wrap(httpServer.topology.loop)
+	}
 
 	err := <-exitCh
 	return err
@@ -194,5 +250,6 @@ func (n *NSQAdmin) Exit() {
 		n.httpListener.Close()
 	}
 	close(n.notifications)
+	close(n.exitChan)
 	n.waitGroup.Wait()
 }
@@ -12,9 +12,10 @@ type Options struct {
 	Logger    Logger
 
 	HTTPAddress string `flag:"http-address"`
+	BindFamily  string `flag:"bind-family"`
 	BasePath    string `flag:"base-path"`
 
-	GraphiteURL   string `flag:"graphite-url"`
+	GraphiteURL   string `flag:"graphite-url" secret:"true"`
 	ProxyGraphite bool   `flag:"proxy-graphite"`
 
 	StatsdPrefix        string `flag:"statsd-prefix"`
@@ -34,9 +35,17 @@ type Options struct {
 	HTTPClientTLSCert               string `flag:"http-client-tls-cert"`
 	HTTPClientTLSKey                string `flag:"http-client-tls-key"`
 
+	ClusterInfoMaxConcurrency int           `flag:"cluster-info-max-concurrency"`
+	ClusterInfoCacheTTL       time.Duration `flag:"cluster-info-cache-ttl"`
+	TopologyRefreshInterval   time.Duration `flag:"topology-refresh-interval"`
+
 	AllowConfigFromCIDR string `flag:"allow-config-from-cidr"`
 
-	NotificationHTTPEndpoint string `flag:"notification-http-endpoint"`
+	NotificationHTTPEndpoint        string `flag:"notification-http-endpoint" secret:"true"`
+	NotificationHTTPTemplate        string `flag:"notification-http-template"`
+	NotificationHTTPContentType     string `flag:"notification-http-content-type"`
+	NotificationSlackWebhookURL     string `flag:"notification-slack-webhook-url" secret:"true"`
+	NotificationPagerDutyRoutingKey string `flag:"notification-pagerduty-routing-key" secret:"true"`
 
 	AclHttpHeader string   `flag:"acl-http-header"`
 	AdminUsers    []string `flag:"admin-user" cfg:"admin_users"`
@@ -44,18 +53,21 @@ type Options struct {
 
 func NewOptions() *Options {
 	return &Options{
-		LogPrefix:                "[nsqadmin] ",
-		LogLevel:                 lg.INFO,
-		HTTPAddress:              "0.0.0.0:4171",
-		BasePath:                 "/",
-		StatsdPrefix:             "nsq.%s",
-		StatsdCounterFormat:      "stats.counters.%s.count",
-		StatsdGaugeFormat:        "stats.gauges.%s",
-		StatsdInterval:           60 * time.Second,
-		HTTPClientConnectTimeout: 2 * time.Second,
-		HTTPClientRequestTimeout: 5 * time.Second,
-		AllowConfigFromCIDR:      "127.0.0.1/8",
-		AclHttpHeader:            "X-Forwarded-User",
-		AdminUsers:               []string{},
+		LogPrefix:                 "[nsqadmin] ",
+		LogLevel:                  lg.INFO,
+		HTTPAddress:               "0.0.0.0:4171",
+		BindFamily:                "tcp",
+		BasePath:                  "/",
+		StatsdPrefix:              "nsq.%s",
+		StatsdCounterFormat:       "stats.counters.%s.count",
+		StatsdGaugeFormat:         "stats.gauges.%s",
+		StatsdInterval:            60 * time.Second,
+		HTTPClientConnectTimeout:  2 * time.Second,
+		HTTPClientRequestTimeout:  5 * time.Second,
+		ClusterInfoMaxConcurrency: 16,
+		ClusterInfoCacheTTL:       2 * time.Second,
+		AllowConfigFromCIDR:       "127.0.0.1/8",
+		AclHttpHeader:             "X-Forwarded-User",
+		AdminUsers:                []string{},
 	}
 }
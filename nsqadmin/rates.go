@@ -0,0 +1,67 @@
+package nsqadmin
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// minRateInterval is how far apart the message counts a rate is estimated
+	// from are at least, so that frequent requests don't make it noisy
+	minRateInterval = 5 * time.Second
+	// maxRateSampleAge is how long the message count of a topic that is no
+	// longer seen (e.g. deleted) is kept
+	maxRateSampleAge = time.Hour
+)
+
+type rateSample struct {
+	messageCount int64
+	at           time.Time
+	rate         float64
+}
+
+// messageRates estimates the messages per second published to topics on each
+// nsqd from the change in their message count between requests
+type messageRates struct {
+	sync.Mutex
+	samples map[string]rateSample
+}
+
+func newMessageRates() *messageRates {
+	return &messageRates{
+		samples: make(map[string]rateSample),
+	}
+}
+
+// rate records the message count of a topic on a node at now, returning its
+// rate since the previous sample (0 until there is one)
+func (r *messageRates) rate(node string, topicName string, messageCount int64, now time.Time) float64 {
+	key := node + "/" + topicName
+
+	r.Lock()
+	defer r.Unlock()
+	s, ok := r.samples[key]
+	if !ok || messageCount < s.messageCount {
+		// new, or nsqd restarted (or re-created the topic)
+		r.samples[key] = rateSample{messageCount: messageCount, at: now}
+		return 0
+	}
+	if elapsed := now.Sub(s.at); elapsed >= minRateInterval {
+		s.rate = float64(messageCount-s.messageCount) / elapsed.Seconds()
+		s.messageCount = messageCount
+		s.at = now
+		r.samples[key] = s
+	}
+	return s.rate
+}
+
+// prune forgets the samples not updated since before maxRateSampleAge
+func (r *messageRates) prune(now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+	for key, s := range r.samples {
+		if now.Sub(s.at) > maxRateSampleAge {
+			delete(r.samples, key)
+		}
+	}
+}
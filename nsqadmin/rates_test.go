@@ -0,0 +1,25 @@
+package nsqadmin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestMessageRates(t *testing.T) {
+	r := newMessageRates()
+	now := time.Now()
+
+	test.Equal(t, float64(0), r.rate("n1", "t", 100, now))
+	// too soon to tell
+	test.Equal(t, float64(0), r.rate("n1", "t", 110, now.Add(time.Second)))
+	test.Equal(t, float64(20), r.rate("n1", "t", 200, now.Add(minRateInterval)))
+	test.Equal(t, float64(20), r.rate("n1", "t", 210, now.Add(minRateInterval+time.Second)))
+	// nsqd restarted
+	test.Equal(t, float64(0), r.rate("n1", "t", 5, now.Add(2*minRateInterval)))
+
+	test.Equal(t, float64(0), r.rate("n2", "t", 100, now))
+	r.prune(now.Add(2*minRateInterval + maxRateSampleAge))
+	test.Equal(t, 1, len(r.samples))
+}
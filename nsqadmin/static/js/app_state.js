@@ -14,6 +14,7 @@ var AppState = Backbone.Model.extend({
             'NSQLOOKUPD': NSQLOOKUPD,
             'graph_interval': '2h',
             'IS_ADMIN': IS_ADMIN,
+            'TOPOLOGY_REFRESH_INTERVAL': TOPOLOGY_REFRESH_INTERVAL,
             'BASE_PATH': BASE_PATH
         };
     },
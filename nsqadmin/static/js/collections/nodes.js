@@ -25,7 +25,10 @@ var Nodes = Backbone.Collection.extend({
                 // it must be wrapped in '[ ]' when joined with port
                 jaddr = '[' + jaddr + ']';
             }
-            n['broadcast_address_http'] = jaddr + ':' + n['http_port'];
+            n['broadcast_address_http'] = n['broadcast_http_address'] ||
+                jaddr + ':' + n['http_port'];
+            n['broadcast_address_tcp'] = n['broadcast_tcp_address'] ||
+                jaddr + ':' + n['tcp_port'];
         });
         return resp['nodes'];
     }
@@ -21,7 +21,8 @@ var formatStatsdKey = function(metricType, key) {
 
 var statsdPrefix = function(host) {
     var prefix = AppState.get('STATSD_PREFIX');
-    var statsdHostKey = host.replace(/[\.:]/g, '_');
+    // as statsd.HostKey, IPv6 hosts lose their brackets
+    var statsdHostKey = host.replace(/[\[\]]/g, '').replace(/[\.:]/g, '_');
     prefix = prefix.replace(/%s/g, statsdHostKey);
     if (prefix.substring(prefix.length, 1) !== '.') {
         prefix += '.';
@@ -17,6 +17,7 @@ var LookupView = require('./lookup');
 var NodesView = require('./nodes');
 var NodeView = require('./node');
 var CounterView = require('./counter');
+var HealthView = require('./health');
 
 var Node = require('../models/node'); //eslint-disable-line no-undef
 var Topic = require('../models/topic');
@@ -42,6 +43,7 @@ var AppView = BaseView.extend({
         this.listenTo(Pubsub, 'nodes:show', this.showNodes);
         this.listenTo(Pubsub, 'node:show', this.showNode);
         this.listenTo(Pubsub, 'counter:show', this.showCounter);
+        this.listenTo(Pubsub, 'health:show', this.showHealth);
 
         this.listenTo(Pubsub, 'view:ready', function() {
             $('.rate').each(function(i, el) {
@@ -137,6 +139,12 @@ var AppView = BaseView.extend({
         });
     },
 
+    showHealth: function() {
+        this.showView(function() {
+            return new HealthView();
+        });
+    },
+
     onLinkClick: function(e) {
         if (e.ctrlKey || e.metaKey) {
             // allow ctrl+click to open in a new tab
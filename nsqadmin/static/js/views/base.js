@@ -96,6 +96,9 @@ var BaseView = Backbone.View.extend({
             try {
                 var parsed = JSON.parse(jqXHR.responseText);
                 msg = parsed['message'];
+                if (parsed['detail']) {
+                    msg += ' - ' + parsed['detail'];
+                }
             } catch (err) {
                 msg = 'ERROR: failed to decode JSON - ' + err.message;
             }
@@ -1,4 +1,3 @@
-var _ = require('underscore');
 var $ = require('jquery');
 
 var AppState = require('../app_state');
@@ -45,9 +44,9 @@ var CounterView = BaseView.extend({
                 return;
             }
 
-            var num = _.reduce(data['stats'], function(n, v) {
-                return n + v['message_count'];
-            }, 0);
+            // unlike the sum of the message counts, it doesn't go back when an
+            // nsqd restarts
+            var num = data['total'];
 
             if (this.currentNum === -1) {
                 // seed the display
@@ -11,26 +11,50 @@ var HeaderView = BaseView.extend({
     template: require('./header.hbs'),
 
     events: {
-        'click .dropdown-menu li': 'onGraphIntervalClick'
+        'click .dropdown-menu li': 'onGraphIntervalClick',
+        'click .topology-refresh': 'onTopologyRefreshClick'
     },
 
     initialize: function() {
         BaseView.prototype.initialize.apply(this, arguments);
         this.listenTo(AppState, 'change:graph_interval', this.render);
+        if (AppState.get('TOPOLOGY_REFRESH_INTERVAL') > 0) {
+            this.updateTopologyAge();
+            setInterval(this.updateTopologyAge.bind(this), 5000);
+        }
     },
 
     getRenderCtx: function() {
         return _.extend(BaseView.prototype.getRenderCtx.apply(this, arguments), {
             'graph_intervals': ['1h', '2h', '12h', '24h', '48h', '168h', 'off'],
-            'graph_interval': AppState.get('graph_interval')
+            'graph_interval': AppState.get('graph_interval'),
+            'topology_refresh_interval': AppState.get('TOPOLOGY_REFRESH_INTERVAL')
         });
     },
 
+    postRender: function() {
+        this.$('.topology-age').text(this.topologyAge || '');
+    },
+
     onReset: function() {
         this.render();
         this.$('.dropdown-toggle').dropdown();
     },
 
+    updateTopologyAge: function() {
+        $.get(AppState.apiPath('/topology')).done(function(data) {
+            this.topologyAge = data['refresh_time'] ? data['age'] + 's ago' : 'pending';
+            this.$('.topology-age').text(this.topologyAge);
+        }.bind(this));
+    },
+
+    onTopologyRefreshClick: function(e) {
+        e.preventDefault();
+        $.post(AppState.apiPath('/topology'))
+            .done(function() { window.location.reload(); })
+            .fail(this.handleAJAXError.bind(this));
+    },
+
     onGraphIntervalClick: function(e) {
         e.stopPropagation();
         AppState.set('graph_interval', $(e.target).text());
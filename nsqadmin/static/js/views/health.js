@@ -0,0 +1,34 @@
+var $ = require('jquery');
+
+var Pubsub = require('../lib/pubsub');
+var AppState = require('../app_state');
+
+var BaseView = require('./base');
+
+var HealthView = BaseView.extend({
+    className: 'health container-fluid',
+
+    template: require('./spinner.hbs'),
+
+    events: {
+        'click .conn-count': 'onClickConnCount'
+    },
+
+    initialize: function() {
+        BaseView.prototype.initialize.apply(this, arguments);
+        $.ajax(AppState.apiPath('/cluster/health'))
+            .done(function(data) {
+                this.template = require('./health.hbs');
+                this.render(data);
+            }.bind(this))
+            .fail(this.handleViewError.bind(this))
+            .always(Pubsub.trigger.bind(Pubsub, 'view:ready'));
+    },
+
+    onClickConnCount: function(e) {
+        e.preventDefault();
+        $(e.target).next().toggle();
+    }
+});
+
+module.exports = HealthView;
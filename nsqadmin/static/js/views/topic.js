@@ -15,7 +15,8 @@ var TopicView = BaseView.extend({
     template: require('./spinner.hbs'),
 
     events: {
-        'click .topic-actions button': 'topicAction'
+        'click .topic-actions button': 'topicAction',
+        'click .migrate-link': 'onMigrateClick'
     },
 
     initialize: function() {
@@ -50,6 +51,26 @@ var TopicView = BaseView.extend({
                     .fail(this.handleAJAXError.bind(this));
             }
         }.bind(this));
+    },
+
+    onMigrateClick: function(e) {
+        e.preventDefault();
+        e.stopPropagation();
+        var node = $(e.currentTarget).data('node');
+        var txt = 'Migrate <em>' + this.model.get('name') + '</em> from <em>' + node +
+            '</em> to (&lt;host&gt;:&lt;http_port&gt; of an nsqd):';
+        bootbox.prompt(txt, function(target) {
+            if (!target) {
+                return;
+            }
+            $.post(this.model.url(), JSON.stringify({
+                'action': 'migrate',
+                'node': node,
+                'target': target
+            }))
+                .done(function() { window.location.reload(true); })
+                .fail(this.handleAJAXError.bind(this));
+        }.bind(this));
     }
 });
 
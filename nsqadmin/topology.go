@@ -0,0 +1,181 @@
+package nsqadmin
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nsqio/nsq/internal/clusterinfo"
+	"github.com/nsqio/nsq/internal/http_api"
+)
+
+// topology is what nsqadmin knows of the cluster's topics and nsqd, with the
+// errors querying nsqlookupd (or nsqd without) returned
+type topology struct {
+	topics       []string
+	topicsErr    error
+	producers    clusterinfo.Producers
+	producersErr error
+	refreshTime  time.Time
+}
+
+// topicProducers returns the nsqd producing topicName, like
+// ClusterInfo.GetTopicProducers (tombstoned producers aren't)
+func (t *topology) topicProducers(topicName string) clusterinfo.Producers {
+	var producers clusterinfo.Producers
+	for _, p := range t.producers {
+		for _, pt := range p.Topics {
+			if pt.Topic == topicName && !pt.Tombstoned {
+				producers = append(producers, p)
+				break
+			}
+		}
+	}
+	return producers
+}
+
+// topologyCache refreshes the topology in the background every
+// --topology-refresh-interval, for page loads not to query every nsqlookupd
+// (or nsqd) themselves. It's refreshed early after admin actions and on
+// request (POST /api/topology).
+type topologyCache struct {
+	ctx *Context
+	ci  *clusterinfo.ClusterInfo
+
+	current     atomic.Value // *topology
+	refreshLock sync.Mutex
+	refreshChan chan int
+}
+
+func newTopologyCache(ctx *Context, ci *clusterinfo.ClusterInfo) *topologyCache {
+	return &topologyCache{
+		ctx:         ctx,
+		ci:          ci,
+		refreshChan: make(chan int, 1),
+	}
+}
+
+// get returns the last topology, nil until the first refresh
+func (c *topologyCache) get() *topology {
+	t, _ := c.current.Load().(*topology)
+	return t
+}
+
+func (c *topologyCache) refresh() *topology {
+	c.refreshLock.Lock()
+	defer c.refreshLock.Unlock()
+
+	start := time.Now()
+	lookupdHTTPAddrs := c.ctx.nsqadmin.getOpts().NSQLookupdHTTPAddresses
+	nsqdHTTPAddrs := c.ctx.nsqadmin.getOpts().NSQDHTTPAddresses
+	t := &topology{}
+	if len(lookupdHTTPAddrs) != 0 {
+		t.topics, t.topicsErr = c.ci.GetLookupdTopics(lookupdHTTPAddrs)
+	} else {
+		t.topics, t.topicsErr = c.ci.GetNSQDTopics(nsqdHTTPAddrs)
+	}
+	t.producers, t.producersErr = c.ci.GetProducers(lookupdHTTPAddrs, nsqdHTTPAddrs)
+	t.refreshTime = time.Now()
+	c.current.Store(t)
+
+	c.ctx.nsqadmin.logf(LOG_DEBUG, "refreshed topology (%d topics, %d nodes) in %s",
+		len(t.topics), len(t.producers), t.refreshTime.Sub(start))
+	return t
+}
+
+// requestRefresh refreshes the topology soon, without waiting for it
+func (c *topologyCache) requestRefresh() {
+	select {
+	case c.refreshChan <- 1:
+	default:
+	}
+}
+
+func (c *topologyCache) loop() {
+	c.refresh()
+
+	ticker := time.NewTicker(c.ctx.nsqadmin.getOpts().TopologyRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.refreshChan:
+		case <-c.ctx.nsqadmin.exitChan:
+			return
+		}
+		c.refresh()
+	}
+}
+
+// getTopics returns the topics known to nsqlookupd (or nsqd without), from the
+// topology cache when enabled
+func (s *httpServer) getTopics() ([]string, error) {
+	if t := s.cachedTopology(); t != nil {
+		return append([]string(nil), t.topics...), t.topicsErr
+	}
+	if len(s.ctx.nsqadmin.getOpts().NSQLookupdHTTPAddresses) != 0 {
+		return s.ci.GetLookupdTopics(s.ctx.nsqadmin.getOpts().NSQLookupdHTTPAddresses)
+	}
+	return s.ci.GetNSQDTopics(s.ctx.nsqadmin.getOpts().NSQDHTTPAddresses)
+}
+
+// getProducers returns all nsqd, from the topology cache when enabled
+func (s *httpServer) getProducers() (clusterinfo.Producers, error) {
+	if t := s.cachedTopology(); t != nil {
+		return append(clusterinfo.Producers(nil), t.producers...), t.producersErr
+	}
+	return s.ci.GetProducers(s.ctx.nsqadmin.getOpts().NSQLookupdHTTPAddresses,
+		s.ctx.nsqadmin.getOpts().NSQDHTTPAddresses)
+}
+
+// getTopicProducers returns the nsqd producing topicName, from the topology
+// cache when enabled
+func (s *httpServer) getTopicProducers(topicName string) (clusterinfo.Producers, error) {
+	if t := s.cachedTopology(); t != nil {
+		return t.topicProducers(topicName), t.producersErr
+	}
+	return s.ci.GetTopicProducers(topicName,
+		s.ctx.nsqadmin.getOpts().NSQLookupdHTTPAddresses,
+		s.ctx.nsqadmin.getOpts().NSQDHTTPAddresses)
+}
+
+func (s *httpServer) cachedTopology() *topology {
+	if s.topology == nil {
+		return nil
+	}
+	return s.topology.get()
+}
+
+type topologyStatus struct {
+	Enabled         bool  `json:"enabled"`
+	RefreshInterval int64 `json:"refresh_interval"`
+	// unix time of the last refresh (0 before the first one), and how long ago
+	// it was in seconds
+	RefreshTime int64 `json:"refresh_time"`
+	Age         int64 `json:"age"`
+}
+
+func (s *httpServer) newTopologyStatus(t *topology) topologyStatus {
+	status := topologyStatus{
+		Enabled:         s.topology != nil,
+		RefreshInterval: int64(s.ctx.nsqadmin.getOpts().TopologyRefreshInterval / time.Second),
+	}
+	if t != nil {
+		status.RefreshTime = t.refreshTime.Unix()
+		status.Age = int64(time.Since(t.refreshTime) / time.Second)
+	}
+	return status
+}
+
+func (s *httpServer) topologyHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	return s.newTopologyStatus(s.cachedTopology()), nil
+}
+
+func (s *httpServer) refreshTopologyHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if s.topology == nil {
+		return nil, http_api.Err{400, "TOPOLOGY_CACHE_DISABLED"}
+	}
+	return s.newTopologyStatus(s.topology.refresh()), nil
+}
@@ -0,0 +1,192 @@
+package nsqd
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/nsqio/nsq/internal/http_api"
+)
+
+// alarmClearRatio is the fraction of its thresholds a channel's depth and oldest
+// message age must fall below for its alarm to clear, so that a channel hovering
+// around a threshold doesn't raise an alarm on every check
+const alarmClearRatio = 0.8
+
+const (
+	ChannelAlarmRaised  = "alarm"
+	ChannelAlarmCleared = "clear"
+)
+
+// ChannelAlarm is sent to --channel-alarm-webhook and published to
+// --channel-alarm-topic when a channel's alarm is raised or cleared
+type ChannelAlarm struct {
+	Event        string `json:"event"`
+	Node         string `json:"node"`
+	Topic        string `json:"topic"`
+	Channel      string `json:"channel"`
+	Depth        int64  `json:"depth"`
+	MaxDepth     int64  `json:"max_depth"`
+	OldestMsgAge int64  `json:"oldest_msg_age_ms"`
+	MaxAge       int64  `json:"max_age_ms"`
+	Timestamp    int64  `json:"timestamp"`
+}
+
+// Alarm returns the channel's overrides of --channel-alarm-depth and
+// --channel-alarm-age (0 if not overridden, negative if disabled)
+func (c *Channel) Alarm() (int64, time.Duration) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.alarmDepth, c.alarmAge
+}
+
+// SetAlarm overrides --channel-alarm-depth and --channel-alarm-age for the
+// channel (0 reverts to the nsqd option, negative disables the threshold). An
+// alarm is raised when the channel's depth or the age of its oldest queued
+// message reaches its threshold, and cleared once both are below
+// alarmClearRatio of them.
+func (c *Channel) SetAlarm(depth int64, age time.Duration) {
+	c.Lock()
+	c.alarmDepth = depth
+	c.alarmAge = age
+	c.Unlock()
+
+	c.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): channel(%s): alarm set to depth %d age %s",
+		c.topicName, c.name, depth, age)
+}
+
+// IsAlarmRaised returns whether the channel is over an alarm threshold
+func (c *Channel) IsAlarmRaised() bool {
+	return atomic.LoadInt32(&c.alarmRaised) == 1
+}
+
+// alarmThresholds returns the channel's depth and age thresholds (0 if disabled)
+func (c *Channel) alarmThresholds() (int64, time.Duration) {
+	opts := c.ctx.nsqd.getOpts()
+	depth, age := c.Alarm()
+	if depth == 0 {
+		depth = opts.ChannelAlarmDepth
+	}
+	if age == 0 {
+		age = opts.ChannelAlarmAge
+	}
+	if depth < 0 {
+		depth = 0
+	}
+	if age < 0 {
+		age = 0
+	}
+	return depth, age
+}
+
+// oldestMsgAge estimates the age of the oldest queued message from the newer of
+// the timestamp of the last message sent to a client and when the channel was
+// last seen empty, as the queue can't be peeked (requeued messages are older)
+func (c *Channel) oldestMsgAge(now time.Time) time.Duration {
+	if c.Depth() == 0 {
+		atomic.StoreInt64(&c.lastEmptyTimestamp, now.UnixNano())
+		return 0
+	}
+	ts := atomic.LoadInt64(&c.lastEmptyTimestamp)
+	if sent := atomic.LoadInt64(&c.lastSentTimestamp); sent > ts {
+		ts = sent
+	}
+	return now.Sub(time.Unix(0, ts))
+}
+
+// checkAlarm raises or clears the channel's alarm, returning the event to send
+// (nil if its state didn't change)
+func (c *Channel) checkAlarm(now time.Time) *ChannelAlarm {
+	maxDepth, maxAge := c.alarmThresholds()
+	depth := c.Depth()
+	age := c.oldestMsgAge(now)
+
+	var event string
+	if !c.IsAlarmRaised() {
+		if (maxDepth > 0 && depth >= maxDepth) || (maxAge > 0 && age >= maxAge) {
+			event = ChannelAlarmRaised
+			atomic.StoreInt32(&c.alarmRaised, 1)
+		}
+	} else {
+		if (maxDepth == 0 || float64(depth) < float64(maxDepth)*alarmClearRatio) &&
+			(maxAge == 0 || float64(age) < float64(maxAge)*alarmClearRatio) {
+			event = ChannelAlarmCleared
+			atomic.StoreInt32(&c.alarmRaised, 0)
+		}
+	}
+	if event == "" {
+		return nil
+	}
+
+	return &ChannelAlarm{
+		Event:        event,
+		Topic:        c.topicName,
+		Channel:      c.name,
+		Depth:        depth,
+		MaxDepth:     maxDepth,
+		OldestMsgAge: int64(age / time.Millisecond),
+		MaxAge:       int64(maxAge / time.Millisecond),
+		Timestamp:    now.Unix(),
+	}
+}
+
+// channelAlarmLoop checks the alarms of all channels every
+// --channel-alarm-check-interval
+func (n *NSQD) channelAlarmLoop() {
+	opts := n.getOpts()
+	client := http_api.NewClient(nil, opts.HTTPClientConnectTimeout, opts.HTTPClientRequestTimeout)
+	ticker := time.NewTicker(opts.ChannelAlarmCheckInterval)
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, c := range n.channels() {
+				alarm := c.checkAlarm(now)
+				if alarm == nil {
+					continue
+				}
+				n.sendChannelAlarm(client, alarm)
+			}
+		case <-n.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	n.logf(LOG_INFO, "CHANNELALARMS: closing")
+	ticker.Stop()
+}
+
+// sendChannelAlarm logs the alarm and sends it to --channel-alarm-webhook and
+// --channel-alarm-topic
+func (n *NSQD) sendChannelAlarm(client *http_api.Client, alarm *ChannelAlarm) {
+	opts := n.getOpts()
+	alarm.Node = opts.BroadcastAddress
+
+	level := LOG_WARN
+	if alarm.Event == ChannelAlarmCleared {
+		level = LOG_INFO
+	}
+	n.logf(level, "TOPIC(%s): channel(%s): %s depth %d (max %d) oldest message %dms (max %dms)",
+		alarm.Topic, alarm.Channel, alarm.Event, alarm.Depth, alarm.MaxDepth, alarm.OldestMsgAge, alarm.MaxAge)
+
+	body, err := json.Marshal(alarm)
+	if err != nil {
+		n.logf(LOG_ERROR, "failed to marshal channel alarm - %s", err)
+		return
+	}
+
+	if opts.ChannelAlarmWebhook != "" {
+		err := client.POSTV1WithBody(opts.ChannelAlarmWebhook, body)
+		if err != nil {
+			n.logf(LOG_ERROR, "failed to send channel alarm to %s - %s", opts.ChannelAlarmWebhook, err)
+		}
+	}
+
+	if opts.ChannelAlarmTopic != "" {
+		topic := n.GetTopic(opts.ChannelAlarmTopic)
+		err := topic.PutMessage(NewMessage(topic.GenerateID(), body))
+		if err != nil {
+			n.logf(LOG_ERROR, "failed to publish channel alarm to %s - %s", opts.ChannelAlarmTopic, err)
+		}
+	}
+}
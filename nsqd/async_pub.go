@@ -0,0 +1,128 @@
+package nsqd
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// ErrAsyncPubFull is returned when a message is published asynchronously
+	// while --async-pub-buffer-size messages are waiting to be put in topics
+	ErrAsyncPubFull = errors.New("async publish buffer full")
+	// ErrAsyncPubClosed is returned when a message is published asynchronously
+	// while nsqd exits
+	ErrAsyncPubClosed = errors.New("async publish buffer closed")
+)
+
+type asyncPub struct {
+	topic     *Topic
+	msg       *Message
+	publisher string
+}
+
+// asyncPublisher puts the messages published with /pub?async=true in their
+// topics, in the order they were published, after the publishers were answered.
+// Publishers are refused once --async-pub-buffer-size messages are waiting.
+type asyncPublisher struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	publishedCount uint64
+	failedCount    uint64
+
+	nsqd *NSQD
+
+	sync.RWMutex
+	closed   bool
+	pubChan  chan asyncPub
+	exitChan chan int
+	doneChan chan int
+}
+
+func newAsyncPublisher(n *NSQD, size int) *asyncPublisher {
+	p := &asyncPublisher{
+		nsqd:     n,
+		pubChan:  make(chan asyncPub, size),
+		exitChan: make(chan int),
+		doneChan: make(chan int),
+	}
+	go p.loop()
+	return p
+}
+
+// publish hands msg over to be put in topic, returning ErrAsyncPubFull rather
+// than waiting when the buffer is full
+func (p *asyncPublisher) publish(topic *Topic, msg *Message, publisher string) error {
+	p.RLock()
+	defer p.RUnlock()
+	if p.closed {
+		return ErrAsyncPubClosed
+	}
+	select {
+	case p.pubChan <- asyncPub{topic, msg, publisher}:
+		return nil
+	default:
+		return ErrAsyncPubFull
+	}
+}
+
+func (p *asyncPublisher) loop() {
+	for {
+		select {
+		case ap := <-p.pubChan:
+			p.put(ap)
+		case <-p.exitChan:
+			// put the messages still buffered before the topics close
+			for {
+				select {
+				case ap := <-p.pubChan:
+					p.put(ap)
+				default:
+					close(p.doneChan)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (p *asyncPublisher) put(ap asyncPub) {
+	err := ap.topic.PutMessage(ap.msg)
+	if err != nil {
+		atomic.AddUint64(&p.failedCount, 1)
+		p.nsqd.logf(LOG_ERROR, "TOPIC(%s): failed to put message published asynchronously by %s - %s",
+			ap.topic.name, ap.publisher, err)
+		return
+	}
+	atomic.AddUint64(&p.publishedCount, 1)
+	ap.topic.countPublished(ap.publisher, 1)
+}
+
+// Close refuses further messages and puts those buffered in their topics, it
+// must be called before the topics are closed
+func (p *asyncPublisher) Close() {
+	p.Lock()
+	p.closed = true
+	p.Unlock()
+	close(p.exitChan)
+	<-p.doneChan
+}
+
+// AsyncPubStats are the stats of the messages published asynchronously
+type AsyncPubStats struct {
+	// messages waiting to be put in their topics, and how many may
+	Depth      int `json:"depth"`
+	BufferSize int `json:"buffer_size"`
+	// messages put in their topics, and that failed to be (e.g. over their
+	// max_disk_bytes) since startup
+	PublishedCount uint64 `json:"published_count"`
+	FailedCount    uint64 `json:"failed_count"`
+}
+
+func (p *asyncPublisher) stats() AsyncPubStats {
+	return AsyncPubStats{
+		Depth:          len(p.pubChan),
+		BufferSize:     cap(p.pubChan),
+		PublishedCount: atomic.LoadUint64(&p.publishedCount),
+		FailedCount:    atomic.LoadUint64(&p.failedCount),
+	}
+}
@@ -0,0 +1,254 @@
+package nsqd
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AuditRecord is written to a channel's audit log when a client finishes a
+// message, see Channel.SetAuditLog
+type AuditRecord struct {
+	ID           string `json:"id"`
+	Client       string `json:"client"`
+	ClientID     string `json:"client_id"`
+	Hostname     string `json:"hostname"`
+	AuthIdentity string `json:"auth_identity,omitempty"`
+	Attempts     uint16 `json:"attempts"`
+	Timestamp    int64  `json:"timestamp"`
+	FinishTime   int64  `json:"fin_ts"`
+}
+
+// AuditFilter selects the records returned by Channel.QueryAuditLog
+type AuditFilter struct {
+	// only the records of a message (all if empty)
+	ID string
+	// only messages finished at or after (all if zero)
+	Since time.Time
+	Limit int
+}
+
+// auditLog appends the AuditRecords of a channel to <data path>/<backend
+// name>.audit.log, rotating it to .audit.log.1 (and so on up to
+// --audit-log-max-files, deleting older ones) once it reaches
+// --audit-log-max-bytes
+type auditLog struct {
+	enabled int32
+
+	sync.Mutex
+	ctx      *context
+	fileName string
+	f        *os.File
+	size     int64
+}
+
+func newAuditLog(ctx *context, dataPath string, backendName string) *auditLog {
+	return &auditLog{
+		ctx:      ctx,
+		fileName: path.Join(dataPath, backendName+".audit.log"),
+	}
+}
+
+func (l *auditLog) isEnabled() bool {
+	return atomic.LoadInt32(&l.enabled) == 1
+}
+
+// setEnabled opens or closes the log
+func (l *auditLog) setEnabled(enabled bool) error {
+	l.Lock()
+	defer l.Unlock()
+	if !enabled {
+		atomic.StoreInt32(&l.enabled, 0)
+		return l.closeFile()
+	}
+	if l.f == nil {
+		err := l.openFile()
+		if err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt32(&l.enabled, 1)
+	return nil
+}
+
+func (l *auditLog) openFile() error {
+	f, err := os.OpenFile(l.fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f = f
+	l.size = fi.Size()
+	return nil
+}
+
+func (l *auditLog) closeFile() error {
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+func (l *auditLog) close() error {
+	l.Lock()
+	defer l.Unlock()
+	return l.closeFile()
+}
+
+func (l *auditLog) write(r AuditRecord) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.Lock()
+	defer l.Unlock()
+	if l.f == nil {
+		return errors.New("audit log is closed")
+	}
+	opts := l.ctx.nsqd.getOpts()
+	if l.size > 0 && l.size+int64(len(line)) > opts.AuditLogMaxBytes {
+		err := l.rotate(opts.AuditLogMaxFiles)
+		if err != nil {
+			return err
+		}
+	}
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// rotate renames the log to .1 (and .1 to .2, and so on), it expects the
+// caller to hold the lock
+func (l *auditLog) rotate(maxFiles int) error {
+	err := l.closeFile()
+	if err != nil {
+		return err
+	}
+	os.Remove(fmt.Sprintf("%s.%d", l.fileName, maxFiles))
+	for i := maxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.fileName, i), fmt.Sprintf("%s.%d", l.fileName, i+1))
+	}
+	err = os.Rename(l.fileName, l.fileName+".1")
+	if err != nil {
+		return err
+	}
+	return l.openFile()
+}
+
+// query returns the records matching filter, oldest first
+func (l *auditLog) query(filter AuditFilter) ([]AuditRecord, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	fileNames := []string{l.fileName}
+	for i := 1; ; i++ {
+		fileName := fmt.Sprintf("%s.%d", l.fileName, i)
+		if _, err := os.Stat(fileName); err != nil {
+			break
+		}
+		fileNames = append([]string{fileName}, fileNames...)
+	}
+
+	records := []AuditRecord{}
+	for _, fileName := range fileNames {
+		f, err := os.Open(fileName)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var r AuditRecord
+			if json.Unmarshal(scanner.Bytes(), &r) != nil {
+				continue
+			}
+			if filter.ID != "" && r.ID != filter.ID {
+				continue
+			}
+			if r.FinishTime < filter.Since.UnixNano() {
+				continue
+			}
+			records = append(records, r)
+			if len(records) == filter.Limit {
+				f.Close()
+				return records, nil
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// IsAuditLogged returns whether the channel records finished messages
+func (c *Channel) IsAuditLogged() bool {
+	return c.auditLog.isEnabled()
+}
+
+// SetAuditLog sets whether the channel records who finished each message, when
+// and after how many attempts, for proof of processing. The log is kept when
+// the channel is deleted.
+func (c *Channel) SetAuditLog(enabled bool) error {
+	if c.ephemeral && enabled {
+		return errors.New("#ephemeral channels cannot have an audit log")
+	}
+	if c.IsAuditLogged() == enabled {
+		return nil
+	}
+	err := c.auditLog.setEnabled(enabled)
+	if err != nil {
+		return err
+	}
+	c.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): channel(%s): audit log set to %t", c.topicName, c.name, enabled)
+	return nil
+}
+
+// QueryAuditLog returns the audit records of the channel matching filter,
+// oldest first
+func (c *Channel) QueryAuditLog(filter AuditFilter) ([]AuditRecord, error) {
+	return c.auditLog.query(filter)
+}
+
+// auditFinish records that clientID finished msg
+func (c *Channel) auditFinish(clientID int64, msg *Message) {
+	c.RLock()
+	client, ok := c.clients[clientID]
+	c.RUnlock()
+	r := AuditRecord{
+		ID:         string(msg.ID[:]),
+		Attempts:   msg.Attempts,
+		Timestamp:  msg.Timestamp,
+		FinishTime: time.Now().UnixNano(),
+	}
+	if ok {
+		stats := client.Stats()
+		r.Client = stats.RemoteAddress
+		r.ClientID = stats.ClientID
+		r.Hostname = stats.Hostname
+		r.AuthIdentity = stats.AuthIdentity
+	}
+	err := c.auditLog.write(r)
+	if err != nil {
+		c.ctx.nsqd.logf(LOG_ERROR, "TOPIC(%s): channel(%s): failed to write audit log - %s",
+			c.topicName, c.name, err)
+	}
+}
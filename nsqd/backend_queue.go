@@ -1,5 +1,11 @@
 package nsqd
 
+import (
+	"time"
+
+	"github.com/nsqio/nsq/internal/diskqueue"
+)
+
 // BackendQueue represents the behavior for the secondary message
 // storage system
 type BackendQueue interface {
@@ -10,3 +16,68 @@ type BackendQueue interface {
 	Depth() int64
 	Empty() error
 }
+
+// syncBackendQueue is implemented by a BackendQueue that can acknowledge a write
+// only once it is on stable storage
+type syncBackendQueue interface {
+	PutSync([]byte) error
+}
+
+// syncPolicyBackendQueue is implemented by a BackendQueue whose fsync policy can
+// be changed at runtime
+type syncPolicyBackendQueue interface {
+	SetSyncPolicy(diskqueue.SyncPolicy)
+}
+
+func setBackendSyncPolicy(bq BackendQueue, p diskqueue.SyncPolicy) {
+	if sbq, ok := bq.(syncPolicyBackendQueue); ok {
+		sbq.SetSyncPolicy(p)
+	}
+}
+
+// compressionBackendQueue is implemented by a BackendQueue that can compress the
+// messages it stores on disk
+type compressionBackendQueue interface {
+	SetCompression(string)
+}
+
+func setBackendCompression(bq BackendQueue, compression string) {
+	if cbq, ok := bq.(compressionBackendQueue); ok {
+		cbq.SetCompression(compression)
+	}
+}
+
+// lazyBackendQueue is implemented by a BackendQueue that can read its messages
+// from disk only once a reader is about to receive them
+type lazyBackendQueue interface {
+	SetLazyRead(time.Duration)
+	ReadAhead()
+}
+
+func setBackendLazyRead(bq BackendQueue, timeout time.Duration) {
+	if lbq, ok := bq.(lazyBackendQueue); ok {
+		lbq.SetLazyRead(timeout)
+	}
+}
+
+// backendReadAhead tells bq that a reader is about to receive from its ReadChan
+func backendReadAhead(bq BackendQueue) {
+	if lbq, ok := bq.(lazyBackendQueue); ok {
+		lbq.ReadAhead()
+	}
+}
+
+// diskUsageBackendQueue is implemented by a BackendQueue that stores messages on
+// disk and can drop its oldest ones
+type diskUsageBackendQueue interface {
+	DiskBytes() int64
+	Discard(int64) (int64, error)
+	DiscardOldestFile() (int64, error)
+}
+
+func backendDiskBytes(bq BackendQueue) int64 {
+	if dbq, ok := bq.(diskUsageBackendQueue); ok {
+		return dbq.DiskBytes()
+	}
+	return 0
+}
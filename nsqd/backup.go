@@ -0,0 +1,240 @@
+package nsqd
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/nsqio/nsq/internal/diskqueue"
+	"github.com/nsqio/nsq/internal/protocol"
+)
+
+// snapshotBackendQueue is implemented by a BackendQueue that can write a
+// consistent copy of itself to a directory
+type snapshotBackendQueue interface {
+	Snapshot(dir string) error
+}
+
+// Backup writes a snapshot of the topics and channels to dir (which must be empty
+// or not exist): their metadata and the messages in their diskqueues. Each
+// diskqueue's writes are blocked while it is copied.
+//
+// Messages only held in memory (including in flight and deferred messages) are not
+// part of the snapshot.
+func (n *NSQD) Backup(dir string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(files) > 0 {
+		return fmt.Errorf("%s is not empty", dir)
+	}
+
+	n.Lock()
+	data, err := n.metadata()
+	var backends []BackendQueue
+	for _, topic := range n.topicMap {
+		if topic.ephemeral {
+			continue
+		}
+		backends = append(backends, topic.backend)
+		topic.RLock()
+		for _, channel := range topic.channelMap {
+			if !channel.ephemeral {
+				backends = append(backends, channel.backend)
+			}
+		}
+		topic.RUnlock()
+	}
+	n.Unlock()
+	if err != nil {
+		return err
+	}
+
+	n.logf(LOG_INFO, "NSQ: writing backup of %d diskqueues to %s", len(backends), dir)
+
+	for _, bq := range backends {
+		sbq, ok := bq.(snapshotBackendQueue)
+		if !ok {
+			continue
+		}
+		err = sbq.Snapshot(dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the metadata is written last so that an incomplete backup can't be restored
+	return writeSyncFile(path.Join(dir, "nsqd.dat"), data)
+}
+
+// restore imports the snapshot at src (a directory or tar file written by Backup)
+// into the empty data paths
+func (n *NSQD) restore(src string) error {
+	opts := n.getOpts()
+
+	_, err := os.Stat(newMetadataFile(opts))
+	if err == nil {
+		return fmt.Errorf("--data-path=%s already contains metadata", opts.DataPath)
+	}
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		tmpDir, err := ioutil.TempDir(opts.DataPath, "restore-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmpDir)
+		err = extractTar(src, tmpDir)
+		if err != nil {
+			return err
+		}
+		src = tmpDir
+	}
+
+	data, err := ioutil.ReadFile(path.Join(src, "nsqd.dat"))
+	if err != nil {
+		return err
+	}
+	var m meta
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return fmt.Errorf("failed to parse metadata - %s", err)
+	}
+	if m.SchemaVersion > metadataSchemaVersion {
+		return fmt.Errorf("metadata has schema version %d (newer than %d)",
+			m.SchemaVersion, metadataSchemaVersion)
+	}
+	// the metadata is rewritten as is, apart from the data paths of topics
+	var js map[string]interface{}
+	err = json.Unmarshal(data, &js)
+	if err != nil {
+		return fmt.Errorf("failed to parse metadata - %s", err)
+	}
+	topicsData, _ := js["topics"].([]interface{})
+	if len(topicsData) != len(m.Topics) {
+		return errors.New("failed to parse metadata - invalid topics")
+	}
+
+	paths := dataPaths(opts)
+	for i, t := range m.Topics {
+		if !protocol.IsValidTopicName(t.Name) {
+			return fmt.Errorf("invalid topic name %s", t.Name)
+		}
+		dataPath := t.DataPath
+		if !containsString(paths, dataPath) {
+			dataPath = opts.DataPath
+		}
+		if len(paths) > 1 {
+			topicsData[i].(map[string]interface{})["data_path"] = dataPath
+		}
+
+		err = diskqueue.Restore(getTopicBackendName(t.Name), src, dataPath)
+		if err != nil {
+			return err
+		}
+		for _, c := range t.Channels {
+			if !protocol.IsValidChannelName(c.Name) {
+				return fmt.Errorf("invalid channel name %s", c.Name)
+			}
+			err = diskqueue.Restore(getBackendName(t.Name, c.Name), src, dataPath)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err = json.Marshal(js)
+	if err != nil {
+		return err
+	}
+	err = writeMetadataFile(newMetadataFile(opts), data)
+	if err != nil {
+		return err
+	}
+
+	n.logf(LOG_INFO, "NSQ: restored %d topics from %s", len(m.Topics), src)
+	return nil
+}
+
+// writeTar writes the files in dir to w as a tar archive
+func writeTar(w io.Writer, dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	for _, fi := range files {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path.Join(dir, fi.Name()))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// extractTar extracts the files of the tar archive fn (as written by writeTar)
+// to dir
+func extractTar(fn string, dir string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Base(hdr.Name)
+		if name != hdr.Name || name == "." || name == ".." {
+			return fmt.Errorf("invalid file name %q in archive", hdr.Name)
+		}
+		out, err := os.OpenFile(path.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, tr)
+		out.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
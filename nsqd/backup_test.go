@@ -0,0 +1,101 @@
+package nsqd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestBackupRestore(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	backupDir, err := ioutil.TempDir("", "nsq-test-backup-")
+	test.Nil(t, err)
+	defer os.RemoveAll(backupDir)
+	opts.BackupDir = backupDir
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_backup" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	for i := 0; i < 5; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte(strconv.Itoa(i)))
+		test.Nil(t, topic.PutMessage(msg))
+	}
+	for channel.Depth() != 5 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// only relative paths under --backup-dir may be written to
+	for _, dir := range []string{backupDir, "../nsq-test-backup", "a/../../b"} {
+		url := fmt.Sprintf("http://%s/backup?dir=%s", httpAddr, dir)
+		resp, err := http.Post(url, "application/json", nil)
+		test.Nil(t, err)
+		test.Equal(t, 400, resp.StatusCode)
+		resp.Body.Close()
+	}
+
+	url := fmt.Sprintf("http://%s/backup?dir=snapshot", httpAddr)
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+
+	// the directory must be empty
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 500, resp.StatusCode)
+	resp.Body.Close()
+
+	tarFile := path.Join(opts.DataPath, "backup.tar")
+	url = fmt.Sprintf("http://%s/backup", httpAddr)
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, "application/x-tar", resp.Header.Get("Content-Type"))
+	f, err := os.Create(tarFile)
+	test.Nil(t, err)
+	_, err = io.Copy(f, resp.Body)
+	test.Nil(t, err)
+	f.Close()
+	resp.Body.Close()
+
+	for _, src := range []string{path.Join(backupDir, "snapshot"), tarFile} {
+		opts := NewOptions()
+		opts.Logger = test.NewTestLogger(t)
+		opts.RestoreFrom = src
+		_, _, restored := mustStartNSQD(opts)
+		test.Nil(t, restored.LoadMetadata())
+
+		topic, err := restored.GetExistingTopic(topicName)
+		test.Nil(t, err)
+		channel, err := topic.GetExistingChannel("ch")
+		test.Nil(t, err)
+		test.Equal(t, int64(5), channel.Depth())
+		msg, err := decodeMessage(<-channel.readBackend())
+		test.Nil(t, err)
+		test.Equal(t, []byte("0"), msg.Body)
+
+		restored.Exit()
+		os.RemoveAll(opts.DataPath)
+	}
+
+	// restoring into a data path with metadata fails
+	opts = NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DataPath = path.Join(backupDir, "snapshot")
+	opts.RestoreFrom = tarFile
+	_, err = New(opts)
+	test.NotNil(t, err)
+}
@@ -0,0 +1,42 @@
+package nsqd
+
+import (
+	"net"
+	"strconv"
+)
+
+// broadcastTCPAddress is the <addr>:<port> of the TCP listener advertised to
+// nsqlookupd and clients
+func (n *NSQD) broadcastTCPAddress() string {
+	return n.broadcastAddr(n.getOpts().BroadcastTCPAddress, n.RealTCPAddr())
+}
+
+// broadcastHTTPAddress is the <addr>:<port> of the HTTP listener advertised to
+// nsqlookupd and clients
+func (n *NSQD) broadcastHTTPAddress() string {
+	return n.broadcastAddr(n.getOpts().BroadcastHTTPAddress, n.RealHTTPAddr())
+}
+
+// broadcastHTTPSAddress is the <addr>:<port> of the HTTPS listener advertised to
+// nsqlookupd and clients, "" without one
+func (n *NSQD) broadcastHTTPSAddress() string {
+	if n.httpsListener == nil {
+		return ""
+	}
+	return n.broadcastAddr(n.getOpts().BroadcastHTTPSAddress, n.RealHTTPSAddr())
+}
+
+func (n *NSQD) broadcastAddr(addr string, listenAddr *net.TCPAddr) string {
+	if addr != "" {
+		return addr
+	}
+	return net.JoinHostPort(n.getOpts().BroadcastAddress, strconv.Itoa(listenAddr.Port))
+}
+
+// broadcastPort is the port of a broadcast address (validated by
+// ValidateOptions)
+func broadcastPort(addr string) int {
+	_, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.Atoi(port)
+	return p
+}
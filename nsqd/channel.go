@@ -2,17 +2,17 @@ package nsqd
 
 import (
 	"bytes"
-	"container/heap"
+	"encoding/binary"
 	"errors"
-	"math"
+	"hash/fnv"
+	"math/rand"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/nsqio/go-diskqueue"
+	"github.com/nsqio/nsq/internal/diskqueue"
 	"github.com/nsqio/nsq/internal/lg"
-	"github.com/nsqio/nsq/internal/pqueue"
 	"github.com/nsqio/nsq/internal/quantile"
 )
 
@@ -23,8 +23,19 @@ type Consumer interface {
 	TimedOutMessage()
 	Stats() ClientStats
 	Empty()
+	// FinishedDelivery is called with the time a message the client finished
+	// was delivered to it, see --processing-latency-percentile
+	FinishedDelivery(deliveryTS time.Time)
 }
 
+// ErrTooManyClients is returned when a client subscribes to a channel that has
+// its max clients
+var ErrTooManyClients = errors.New("E_TOO_MANY_CLIENTS")
+
+// ErrTooManyChannelConsumers is returned when a client subscribes to a channel
+// that has --max-channel-consumers clients
+var ErrTooManyChannelConsumers = errors.New("E_TOO_MANY_CHANNEL_CONSUMERS")
+
 // Channel represents the concrete type for a NSQ channel (and also
 // implements the Queue interface)
 //
@@ -39,6 +50,29 @@ type Channel struct {
 	messageCount uint64
 	timeoutCount uint64
 
+	// messages discarded by the drop-oldest overflow policy, or because the
+	// in-memory buffer of an #ephemeral channel was full
+	overflowDropCount uint64
+	// subscriptions refused for exceeding a client limit
+	rejectedClientCount uint64
+	deadClientCount     uint64
+	quarantinedCount    uint64
+	// messages published to the topic but not put in the channel, see
+	// SetSampleRate
+	sampledOutCount uint64
+	// messages sent to clients, and those of them sent before (requeued or
+	// timed out), see countDelivery
+	deliveryCount   uint64
+	redeliveryCount uint64
+	// the only client sent messages in exclusive mode (0 if none)
+	activeClientID int64
+	// timestamps bounding the age of the oldest queued message, see oldestMsgAge
+	lastSentTimestamp  int64
+	lastEmptyTimestamp int64
+	// messages published to the topic before this (unix nanoseconds) aren't
+	// put in the channel, see Topic.GetChannelFrom
+	startTimestamp int64
+
 	sync.RWMutex
 
 	topicName string
@@ -54,47 +88,92 @@ type Channel struct {
 	// state tracking
 	clients        map[int64]Consumer
 	paused         int32
+	pauseMutex     sync.Mutex
+	pausedUntil    time.Time
+	durable        int32
 	ephemeral      bool
 	deleteCallback func(*Channel)
 	deleter        sync.Once
 
+	// overflow policy, see Topic.SetChannelOverflow
+	overflowPolicy string
+	maxDepth       int64
+	maxDiskBytes   int64
+
+	// maximum number of clients (0 is only limited by --max-channel-consumers)
+	maxClients int
+	// only one client at a time is sent messages, see SetExclusive
+	exclusive int32
+	// messages are sent to clients by key, see SetKeyRouting
+	keyRouting  int32
+	routedChans map[int64]chan *Message
+	// percentage of the topic's messages put in the channel (0 is all)
+	sampleRate int32
+	// alarm thresholds, see SetAlarm
+	alarmDepth  int64
+	alarmAge    time.Duration
+	alarmRaised int32
+	// who finished which messages, see SetAuditLog
+	auditLog *auditLog
+	// messages that keep timing out are quarantined, see SetQuarantineTimeouts
+	isQuarantine       bool
+	quarantineTimeouts int
+	quarantine         quarantineState
+	// stops the requeuing of retained messages, see Topic.SeekChannel
+	seekStop chan int
+
 	// Stats tracking
 	e2eProcessingLatencyStream *quantile.Quantile
+	processingLatencyStream    *quantile.Quantile
+	eventLagStream             *quantile.Quantile
+	redeliveryRate             redeliveryRate
 
-	// TODO: these can be DRYd up
-	deferredMessages map[MessageID]*pqueue.Item
-	deferredPQ       pqueue.PriorityQueue
+	// the timeouts of these are in the nsqd's timing wheel, see processTimeouts
+	deferredMessages map[MessageID]*Message
 	deferredMutex    sync.Mutex
 	inFlightMessages map[MessageID]*Message
-	inFlightPQ       inFlightPqueue
 	inFlightMutex    sync.Mutex
 }
 
 // NewChannel creates a new instance of the Channel type and returns a pointer
 func NewChannel(topicName string, channelName string, ctx *context,
-	deleteCallback func(*Channel)) *Channel {
+	dataPath string, memQueueSize int64, deleteCallback func(*Channel)) *Channel {
 
 	c := &Channel{
 		topicName:      topicName,
 		name:           channelName,
 		memoryMsgChan:  nil,
 		clients:        make(map[int64]Consumer),
+		routedChans:    make(map[int64]chan *Message),
 		deleteCallback: deleteCallback,
+		overflowPolicy: ChannelOverflowNone,
 		ctx:            ctx,
 	}
-	// create mem-queue only if size > 0 (do not use unbuffered chan)
-	if ctx.nsqd.getOpts().MemQueueSize > 0 {
-		c.memoryMsgChan = make(chan *Message, ctx.nsqd.getOpts().MemQueueSize)
-	}
+	c.lastEmptyTimestamp = time.Now().UnixNano()
+	c.auditLog = newAuditLog(ctx, dataPath, getBackendName(topicName, channelName))
+	c.memoryMsgChan = newMemoryMsgChan(memQueueSize)
 	if len(ctx.nsqd.getOpts().E2EProcessingLatencyPercentiles) > 0 {
 		c.e2eProcessingLatencyStream = quantile.New(
 			ctx.nsqd.getOpts().E2EProcessingLatencyWindowTime,
 			ctx.nsqd.getOpts().E2EProcessingLatencyPercentiles,
 		)
 	}
+	if len(ctx.nsqd.getOpts().ProcessingLatencyPercentiles) > 0 {
+		c.processingLatencyStream = quantile.New(
+			ctx.nsqd.getOpts().E2EProcessingLatencyWindowTime,
+			ctx.nsqd.getOpts().ProcessingLatencyPercentiles,
+		)
+	}
+	if len(ctx.nsqd.getOpts().EventLagPercentiles) > 0 {
+		c.eventLagStream = quantile.New(
+			ctx.nsqd.getOpts().E2EProcessingLatencyWindowTime,
+			ctx.nsqd.getOpts().EventLagPercentiles,
+		)
+	}
 
-	c.initPQ()
+	c.initTimeouts()
 
+	c.isQuarantine = strings.HasSuffix(channelName, QuarantineSuffix)
 	if strings.HasSuffix(channelName, "#ephemeral") {
 		c.ephemeral = true
 		c.backend = newDummyBackendQueue()
@@ -107,14 +186,16 @@ func NewChannel(topicName string, channelName string, ctx *context,
 		backendName := getBackendName(topicName, channelName)
 		c.backend = diskqueue.New(
 			backendName,
-			ctx.nsqd.getOpts().DataPath,
+			dataPath,
 			ctx.nsqd.getOpts().MaxBytesPerFile,
 			int32(minValidMsgLength),
-			int32(ctx.nsqd.getOpts().MaxMsgSize)+minValidMsgLength,
+			int32(ctx.nsqd.getOpts().MaxMsgSize)+maxMsgOverhead,
 			ctx.nsqd.getOpts().SyncEvery,
 			ctx.nsqd.getOpts().SyncTimeout,
 			dqLogf,
 		)
+		// don't hold messages of a backlog in memory until a client is ready
+		setBackendLazyRead(c.backend, lazyReadTimeout)
 	}
 
 	c.ctx.nsqd.Notify(c)
@@ -122,17 +203,22 @@ func NewChannel(topicName string, channelName string, ctx *context,
 	return c
 }
 
-func (c *Channel) initPQ() {
-	pqSize := int(math.Max(1, float64(c.ctx.nsqd.getOpts().MemQueueSize)/10))
+// initTimeouts forgets the in-flight and deferred messages, stopping their timeouts
+func (c *Channel) initTimeouts() {
+	timeouts := c.ctx.nsqd.timeouts
 
 	c.inFlightMutex.Lock()
+	for _, msg := range c.inFlightMessages {
+		timeouts.Remove(&msg.timer)
+	}
 	c.inFlightMessages = make(map[MessageID]*Message)
-	c.inFlightPQ = newInFlightPqueue(pqSize)
 	c.inFlightMutex.Unlock()
 
 	c.deferredMutex.Lock()
-	c.deferredMessages = make(map[MessageID]*pqueue.Item)
-	c.deferredPQ = pqueue.New(pqSize)
+	for _, msg := range c.deferredMessages {
+		timeouts.Remove(&msg.timer)
+	}
+	c.deferredMessages = make(map[MessageID]*Message)
 	c.deferredMutex.Unlock()
 }
 
@@ -176,6 +262,11 @@ func (c *Channel) exit(deleted bool) error {
 	}
 	c.RUnlock()
 
+	err := c.auditLog.close()
+	if err != nil {
+		c.ctx.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to close audit log - %s", c.name, err)
+	}
+
 	if deleted {
 		// empty the queue (deletes the backend files, too)
 		c.Empty()
@@ -191,7 +282,7 @@ func (c *Channel) Empty() error {
 	c.Lock()
 	defer c.Unlock()
 
-	c.initPQ()
+	c.initTimeouts()
 	for _, client := range c.clients {
 		client.Empty()
 	}
@@ -208,6 +299,62 @@ finish:
 	return c.backend.Empty()
 }
 
+// TransferTo puts the messages queued in the channel (not those in flight or
+// deferred) in dst, a channel of the same topic, removing them from the channel
+// if move is true. It returns how many were transferred. Messages are read from
+// the queue, so pause the channel first for its clients not to receive any
+// during the transfer.
+func (c *Channel) TransferTo(dst *Channel, move bool) (int64, error) {
+	var count int64
+	// copied messages are requeued, don't read them again
+	depth := c.Depth()
+	for count < depth {
+		var msg *Message
+		backendReadAhead(c.backend)
+		select {
+		case msg = <-c.memoryMsgChan:
+		case buf := <-c.backend.ReadChan():
+			var err error
+			msg, err = decodeMessage(buf)
+			if err != nil {
+				c.ctx.nsqd.logf(LOG_ERROR, "failed to decode message - %s", err)
+				depth--
+				continue
+			}
+		case <-time.After(queueReadTimeout):
+			return count, nil
+		}
+
+		dstMsg := msg
+		if !move {
+			dstMsg = msg.copy()
+			err := c.put(msg)
+			if err != nil {
+				return count, err
+			}
+		}
+		err := dst.PutMessage(dstMsg)
+		if err != nil {
+			if move {
+				if err := c.put(msg); err != nil {
+					c.ctx.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to requeue msg(%s) - %s", c.name, msg.ID, err)
+				}
+			}
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// queueReadTimeout is how long reading a channel's queue (TransferTo,
+// migrations) waits for the next message
+const queueReadTimeout = 100 * time.Millisecond
+
+// lazyReadTimeout is how long a channel's backend keeps a message it read from
+// disk for a ready client that didn't receive it
+const lazyReadTimeout = time.Second
+
 // flush persists all the messages in internal memory buffers to the backend
 // it does not drain inflight/deferred because it is only called in Close()
 func (c *Channel) flush() error {
@@ -221,7 +368,7 @@ func (c *Channel) flush() error {
 	for {
 		select {
 		case msg := <-c.memoryMsgChan:
-			err := writeMessageToBackend(&msgBuf, msg, c.backend)
+			err := writeMessageToBackend(&msgBuf, msg, c.backend, c.ctx.nsqd.getOpts().BackendMsgEnvelope)
 			if err != nil {
 				c.ctx.nsqd.logf(LOG_ERROR, "failed to write message to backend - %s", err)
 			}
@@ -233,7 +380,7 @@ func (c *Channel) flush() error {
 finish:
 	c.inFlightMutex.Lock()
 	for _, msg := range c.inFlightMessages {
-		err := writeMessageToBackend(&msgBuf, msg, c.backend)
+		err := writeMessageToBackend(&msgBuf, msg, c.backend, c.ctx.nsqd.getOpts().BackendMsgEnvelope)
 		if err != nil {
 			c.ctx.nsqd.logf(LOG_ERROR, "failed to write message to backend - %s", err)
 		}
@@ -241,9 +388,8 @@ finish:
 	c.inFlightMutex.Unlock()
 
 	c.deferredMutex.Lock()
-	for _, item := range c.deferredMessages {
-		msg := item.Value.(*Message)
-		err := writeMessageToBackend(&msgBuf, msg, c.backend)
+	for _, msg := range c.deferredMessages {
+		err := writeMessageToBackend(&msgBuf, msg, c.backend, c.ctx.nsqd.getOpts().BackendMsgEnvelope)
 		if err != nil {
 			c.ctx.nsqd.logf(LOG_ERROR, "failed to write message to backend - %s", err)
 		}
@@ -257,14 +403,54 @@ func (c *Channel) Depth() int64 {
 	return int64(len(c.memoryMsgChan)) + c.backend.Depth()
 }
 
+// readBackend returns the ReadChan of the channel's backend for a ready client,
+// asking the backend to read its next message from disk
+func (c *Channel) readBackend() chan []byte {
+	backendReadAhead(c.backend)
+	return c.backend.ReadChan()
+}
+
 func (c *Channel) Pause() error {
+	return c.PauseUntil(time.Time{})
+}
+
+// PauseUntil pauses the channel until t, when nsqd unpauses it (a zero t pauses
+// it until UnPause)
+func (c *Channel) PauseUntil(t time.Time) error {
+	c.pauseMutex.Lock()
+	defer c.pauseMutex.Unlock()
+	c.pausedUntil = t
 	return c.doPause(true)
 }
 
 func (c *Channel) UnPause() error {
+	c.pauseMutex.Lock()
+	defer c.pauseMutex.Unlock()
+	c.pausedUntil = time.Time{}
 	return c.doPause(false)
 }
 
+// PausedUntil returns when nsqd unpauses the channel (zero if it isn't paused
+// or is paused until UnPause)
+func (c *Channel) PausedUntil() time.Time {
+	c.pauseMutex.Lock()
+	defer c.pauseMutex.Unlock()
+	return c.pausedUntil
+}
+
+// resumeIfDue unpauses the channel if it was paused until now or earlier,
+// returning whether it did
+func (c *Channel) resumeIfDue(now time.Time) bool {
+	c.pauseMutex.Lock()
+	defer c.pauseMutex.Unlock()
+	if c.pausedUntil.IsZero() || now.Before(c.pausedUntil) {
+		return false
+	}
+	c.pausedUntil = time.Time{}
+	c.doPause(false)
+	return true
+}
+
 func (c *Channel) doPause(pause bool) error {
 	if pause {
 		atomic.StoreInt32(&c.paused, 1)
@@ -288,6 +474,72 @@ func (c *Channel) IsPaused() bool {
 	return atomic.LoadInt32(&c.paused) == 1
 }
 
+// MaxClients returns the maximum number of clients that may subscribe to the
+// channel (0 if only limited by --max-channel-consumers)
+func (c *Channel) MaxClients() int {
+	c.RLock()
+	defer c.RUnlock()
+	return c.maxClients
+}
+
+// SetMaxClients limits the number of clients that may subscribe to the channel
+// (0 is only limited by --max-channel-consumers), e.g. 1 for a singleton
+// consumer. Clients already subscribed are not disconnected.
+func (c *Channel) SetMaxClients(maxClients int) error {
+	if maxClients < 0 {
+		return errors.New("max clients must be >= 0")
+	}
+
+	c.Lock()
+	c.maxClients = maxClients
+	c.Unlock()
+
+	c.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): channel(%s): max-clients set to %d", c.topicName, c.name, maxClients)
+	return nil
+}
+
+// SampleRate returns the percentage of the topic's messages put in the channel
+// (0 is all)
+func (c *Channel) SampleRate() int32 {
+	return atomic.LoadInt32(&c.sampleRate)
+}
+
+// SetSampleRate puts only a random sampleRate percent (1-99, or 0 for all) of
+// the messages published to the topic in the channel, whatever the sample rate
+// of its clients, e.g. for a tap channel that sees 1% of the traffic
+func (c *Channel) SetSampleRate(sampleRate int32) error {
+	if sampleRate < 0 || sampleRate > 99 {
+		return errors.New("sample rate must be [0,99]")
+	}
+	atomic.StoreInt32(&c.sampleRate, sampleRate)
+
+	c.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): channel(%s): sample-rate set to %d", c.topicName, c.name, sampleRate)
+	return nil
+}
+
+// sample returns whether a message published to the topic is put in the
+// channel, see SetSampleRate
+func (c *Channel) sample() bool {
+	sampleRate := atomic.LoadInt32(&c.sampleRate)
+	if sampleRate == 0 || rand.Int31n(100) < sampleRate {
+		return true
+	}
+	atomic.AddUint64(&c.sampledOutCount, 1)
+	return false
+}
+
+// receives returns whether a message published to the topic is put in the
+// channel, see Topic.GetChannelFrom, SetSampleRate and QuarantineSuffix
+func (c *Channel) receives(m *Message) bool {
+	if c.isQuarantine {
+		return false
+	}
+	if m.Timestamp < atomic.LoadInt64(&c.startTimestamp) {
+		return false
+	}
+	return c.sample()
+}
+
 // PutMessage writes a Message to the queue
 func (c *Channel) PutMessage(m *Message) error {
 	c.RLock()
@@ -295,6 +547,9 @@ func (c *Channel) PutMessage(m *Message) error {
 	if c.Exiting() {
 		return errors.New("exiting")
 	}
+	if c.overflowPolicy == ChannelOverflowDropOldest {
+		c.dropOldest()
+	}
 	err := c.put(m)
 	if err != nil {
 		return err
@@ -303,12 +558,89 @@ func (c *Channel) PutMessage(m *Message) error {
 	return nil
 }
 
+// dropOldest discards the oldest queued messages to make room for one more within
+// the channel's overflow limits, it expects the caller to handle locking
+func (c *Channel) dropOldest() {
+	var dropped int64
+	dbq, _ := c.backend.(diskUsageBackendQueue)
+
+	if c.maxDepth > 0 {
+		excess := c.Depth() - c.maxDepth + 1
+		for excess > 0 && len(c.memoryMsgChan) > 0 {
+			select {
+			case msg := <-c.memoryMsgChan:
+				releaseMessage(msg)
+				dropped++
+				excess--
+			default:
+			}
+		}
+		if excess > 0 && dbq != nil {
+			n, _ := dbq.Discard(excess)
+			dropped += n
+		}
+	}
+
+	if c.maxDiskBytes > 0 && dbq != nil {
+		for dbq.DiskBytes() >= c.maxDiskBytes {
+			n, err := dbq.DiscardOldestFile()
+			if err != nil || n == 0 {
+				break
+			}
+			dropped += n
+		}
+	}
+
+	if dropped > 0 {
+		atomic.AddUint64(&c.overflowDropCount, uint64(dropped))
+	}
+}
+
+// setOverflow changes the channel's overflow policy, see Topic.SetChannelOverflow
+func (c *Channel) setOverflow(policy string, maxDepth int64, maxDiskBytes int64) {
+	c.Lock()
+	c.overflowPolicy = policy
+	c.maxDepth = maxDepth
+	c.maxDiskBytes = maxDiskBytes
+	c.Unlock()
+}
+
 func (c *Channel) put(m *Message) error {
+	if c.ephemeral {
+		// there is no backend to overflow to
+		select {
+		case c.memoryMsgChan <- m:
+		default:
+			atomic.AddUint64(&c.overflowDropCount, 1)
+			releaseMessage(m)
+		}
+		return nil
+	}
+
+	if atomic.LoadInt32(&c.durable) == 1 {
+		b := bufferPoolGet()
+		err := writeMessageToBackendSync(b, m, c.backend, c.ctx.nsqd.getOpts().BackendMsgEnvelope)
+		bufferPoolPut(b)
+		c.ctx.nsqd.SetHealth(err)
+		if err != nil {
+			c.ctx.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to write message to backend - %s",
+				c.name, err)
+			return err
+		}
+		releaseMessage(m)
+		return nil
+	}
+
+	memoryMsgChan := c.memoryMsgChan
+	if c.stagingFull() {
+		// after the backlog, rather than in memory
+		memoryMsgChan = nil
+	}
 	select {
-	case c.memoryMsgChan <- m:
+	case memoryMsgChan <- m:
 	default:
 		b := bufferPoolGet()
-		err := writeMessageToBackend(b, m, c.backend)
+		err := writeMessageToBackend(b, m, c.backend, c.ctx.nsqd.getOpts().BackendMsgEnvelope)
 		bufferPoolPut(b)
 		c.ctx.nsqd.SetHealth(err)
 		if err != nil {
@@ -316,10 +648,31 @@ func (c *Channel) put(m *Message) error {
 				c.name, err)
 			return err
 		}
+		releaseMessage(m)
 	}
 	return nil
 }
 
+// stagingFull returns whether the channel has a backlog on disk and already keeps
+// --channel-staging-size messages in memory
+func (c *Channel) stagingFull() bool {
+	limit := c.ctx.nsqd.getOpts().ChannelStagingSize
+	return limit > 0 && int64(len(c.memoryMsgChan)) >= limit && c.backend.Depth() > 0
+}
+
+// setDurable switches the channel to (or from) write-through mode, see Topic.SetDurable
+func (c *Channel) setDurable(durable bool) {
+	if !durable {
+		atomic.StoreInt32(&c.durable, 0)
+		return
+	}
+	atomic.StoreInt32(&c.durable, 1)
+	drainMemoryMsgChan(c.memoryMsgChan, c.backend, c.ctx.nsqd.getOpts().BackendMsgEnvelope, func(err error) {
+		c.ctx.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to write message to backend - %s",
+			c.name, err)
+	})
+}
+
 func (c *Channel) PutMessageDeferred(msg *Message, timeout time.Duration) {
 	atomic.AddUint64(&c.messageCount, 1)
 	c.StartDeferredTimeout(msg, timeout)
@@ -331,7 +684,6 @@ func (c *Channel) TouchMessage(clientID int64, id MessageID, clientMsgTimeout ti
 	if err != nil {
 		return err
 	}
-	c.removeFromInFlightPQ(msg)
 
 	newTimeout := time.Now().Add(clientMsgTimeout)
 	if newTimeout.Sub(msg.deliveryTS) >=
@@ -340,13 +692,7 @@ func (c *Channel) TouchMessage(clientID int64, id MessageID, clientMsgTimeout ti
 		newTimeout = msg.deliveryTS.Add(c.ctx.nsqd.getOpts().MaxMsgTimeout)
 	}
 
-	msg.pri = newTimeout.UnixNano()
-	err = c.pushInFlightMessage(msg)
-	if err != nil {
-		return err
-	}
-	c.addToInFlightPQ(msg)
-	return nil
+	return c.pushInFlightMessage(msg, newTimeout)
 }
 
 // FinishMessage successfully discards an in-flight message
@@ -355,10 +701,26 @@ func (c *Channel) FinishMessage(clientID int64, id MessageID) error {
 	if err != nil {
 		return err
 	}
-	c.removeFromInFlightPQ(msg)
+	c.forgetTimeouts(msg.ID)
 	if c.e2eProcessingLatencyStream != nil {
 		c.e2eProcessingLatencyStream.Insert(msg.Timestamp)
 	}
+	if c.eventLagStream != nil && msg.EventTimestamp != 0 {
+		c.eventLagStream.Insert(msg.EventTimestamp)
+	}
+	if c.processingLatencyStream != nil {
+		c.processingLatencyStream.Insert(msg.deliveryTS.UnixNano())
+		c.RLock()
+		client, ok := c.clients[clientID]
+		c.RUnlock()
+		if ok {
+			client.FinishedDelivery(msg.deliveryTS)
+		}
+	}
+	if c.IsAuditLogged() {
+		c.auditFinish(clientID, msg)
+	}
+	releaseMessage(msg)
 	return nil
 }
 
@@ -374,7 +736,6 @@ func (c *Channel) RequeueMessage(clientID int64, id MessageID, timeout time.Dura
 	if err != nil {
 		return err
 	}
-	c.removeFromInFlightPQ(msg)
 	atomic.AddUint64(&c.requeueCount, 1)
 
 	if timeout == 0 {
@@ -392,6 +753,31 @@ func (c *Channel) RequeueMessage(clientID int64, id MessageID, timeout time.Dura
 	return c.StartDeferredTimeout(msg, timeout)
 }
 
+// ReapClient immediately requeues the messages in flight to a client whose
+// connection is dead, rather than waiting for them to time out, returning how
+// many were requeued
+func (c *Channel) ReapClient(clientID int64) int {
+	atomic.AddUint64(&c.deadClientCount, 1)
+
+	var ids []MessageID
+	c.inFlightMutex.Lock()
+	for id, msg := range c.inFlightMessages {
+		if msg.clientID == clientID {
+			ids = append(ids, id)
+		}
+	}
+	c.inFlightMutex.Unlock()
+
+	requeued := 0
+	for _, id := range ids {
+		// the client may have finished or requeued it since
+		if c.RequeueMessage(clientID, id, 0) == nil {
+			requeued++
+		}
+	}
+	return requeued
+}
+
 // AddClient adds a client to the Channel's client list
 func (c *Channel) AddClient(clientID int64, client Consumer) error {
 	c.Lock()
@@ -402,57 +788,212 @@ func (c *Channel) AddClient(clientID int64, client Consumer) error {
 		return nil
 	}
 
+	if c.maxClients > 0 && len(c.clients) >= c.maxClients {
+		atomic.AddUint64(&c.rejectedClientCount, 1)
+		return ErrTooManyClients
+	}
+
 	maxChannelConsumers := c.ctx.nsqd.getOpts().MaxChannelConsumers
 	if maxChannelConsumers != 0 && len(c.clients) >= maxChannelConsumers {
-		return errors.New("E_TOO_MANY_CHANNEL_CONSUMERS")
+		atomic.AddUint64(&c.rejectedClientCount, 1)
+		return ErrTooManyChannelConsumers
 	}
 
 	c.clients[clientID] = client
+	c.routedChans[clientID] = make(chan *Message, routedMsgChanSize)
+	if atomic.LoadInt32(&c.exclusive) == 1 && atomic.LoadInt64(&c.activeClientID) == 0 {
+		c.electActiveClient()
+	}
 	return nil
 }
 
 // RemoveClient removes a client from the Channel's client list
 func (c *Channel) RemoveClient(clientID int64) {
 	c.Lock()
-	defer c.Unlock()
-
 	_, ok := c.clients[clientID]
 	if !ok {
+		c.Unlock()
 		return
 	}
 	delete(c.clients, clientID)
+	routedChan := c.routedChans[clientID]
+	delete(c.routedChans, clientID)
+
+	if atomic.LoadInt32(&c.exclusive) == 1 && atomic.LoadInt64(&c.activeClientID) == clientID {
+		c.electActiveClient()
+	}
 
 	if len(c.clients) == 0 && c.ephemeral == true {
 		go c.deleter.Do(func() { c.deleteCallback(c) })
 	}
+	c.Unlock()
+
+	// messages routed to the client but not yet sent are routed again
+	for {
+		select {
+		case msg := <-routedChan:
+			err := c.put(msg)
+			if err != nil {
+				c.ctx.nsqd.logf(LOG_ERROR, "TOPIC(%s): channel(%s): failed to requeue routed message - %s",
+					c.topicName, c.name, err)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// routedMsgChanSize is how many messages may wait to be sent to a client they
+// were routed to by key
+const routedMsgChanSize = 16
+
+// keyRoutingRetryDelay is how long a message is deferred when the client its
+// key is routed to has routedMsgChanSize messages waiting
+const keyRoutingRetryDelay = 10 * time.Millisecond
+
+// IsKeyRouted returns whether messages with a key are sent to the client their
+// key is routed to
+func (c *Channel) IsKeyRouted() bool {
+	return atomic.LoadInt32(&c.keyRouting) == 1
+}
+
+// SetKeyRouting changes whether messages published with a key are always sent
+// to the same client (while the channel's clients don't change), chosen by
+// rendezvous hashing of the key and client IDs so that when clients come and
+// go only the keys of those clients move. Messages without a key are sent to
+// any client. A client that stays subscribed with RDY 0 holds back the
+// messages of its keys. Exclusive channels ignore keys.
+func (c *Channel) SetKeyRouting(keyRouting bool) {
+	if keyRouting == c.IsKeyRouted() {
+		return
+	}
+	if keyRouting {
+		atomic.StoreInt32(&c.keyRouting, 1)
+	} else {
+		atomic.StoreInt32(&c.keyRouting, 0)
+	}
+	c.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): channel(%s): key-routing set to %t", c.topicName, c.name, keyRouting)
+}
+
+// routedMsgChan returns the chan of messages routed to clientID by key
+func (c *Channel) routedMsgChan(clientID int64) chan *Message {
+	c.RLock()
+	defer c.RUnlock()
+	return c.routedChans[clientID]
+}
+
+// routeByKey hands msg, which clientID received, to the client its key is
+// routed to, returning false if clientID should send it
+func (c *Channel) routeByKey(msg *Message, clientID int64) bool {
+	if msg.Key == "" || !c.IsKeyRouted() || c.IsExclusive() {
+		return false
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+	var target int64
+	var targetScore uint64
+	var buf [8]byte
+	for id := range c.clients {
+		h := fnv.New64a()
+		h.Write([]byte(msg.Key))
+		binary.BigEndian.PutUint64(buf[:], uint64(id))
+		h.Write(buf[:])
+		if score := h.Sum64(); target == 0 || score > targetScore {
+			target, targetScore = id, score
+		}
+	}
+	if target == 0 || target == clientID {
+		return false
+	}
+
+	select {
+	case c.routedChans[target] <- msg:
+	default:
+		c.StartDeferredTimeout(msg, keyRoutingRetryDelay)
+	}
+	return true
+}
+
+// IsExclusive returns whether only one client at a time is sent messages
+func (c *Channel) IsExclusive() bool {
+	return atomic.LoadInt32(&c.exclusive) == 1
+}
+
+// SetExclusive changes whether only one client at a time (the active client)
+// is sent messages, for singleton consumers. The longest subscribed client is
+// active, the others are standbys until it disconnects. Messages in flight to
+// a client that disconnects time out and are sent to the next active client.
+func (c *Channel) SetExclusive(exclusive bool) {
+	c.Lock()
+	defer c.Unlock()
+	if exclusive == c.IsExclusive() {
+		return
+	}
+	if exclusive {
+		atomic.StoreInt32(&c.exclusive, 1)
+		c.electActiveClient()
+	} else {
+		atomic.StoreInt32(&c.exclusive, 0)
+		atomic.StoreInt64(&c.activeClientID, 0)
+		// wake the standbys' messagePumps
+		for _, client := range c.clients {
+			client.UnPause()
+		}
+	}
+
+	c.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): channel(%s): exclusive set to %t", c.topicName, c.name, exclusive)
+}
+
+// isActiveClient returns whether clientID may be sent messages
+func (c *Channel) isActiveClient(clientID int64) bool {
+	return atomic.LoadInt32(&c.exclusive) == 0 || atomic.LoadInt64(&c.activeClientID) == clientID
+}
+
+// electActiveClient makes the longest subscribed client active (client IDs
+// increase), expecting the caller to hold the lock
+func (c *Channel) electActiveClient() {
+	var activeID int64
+	for id := range c.clients {
+		if activeID == 0 || id < activeID {
+			activeID = id
+		}
+	}
+	atomic.StoreInt64(&c.activeClientID, activeID)
+	if activeID == 0 {
+		return
+	}
+	c.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): channel(%s): client %d is the active exclusive consumer",
+		c.topicName, c.name, activeID)
+	// wake its messagePump
+	c.clients[activeID].UnPause()
 }
 
 func (c *Channel) StartInFlightTimeout(msg *Message, clientID int64, timeout time.Duration) error {
 	now := time.Now()
+	atomic.StoreInt64(&c.lastSentTimestamp, msg.Timestamp)
 	msg.clientID = clientID
 	msg.deliveryTS = now
-	msg.pri = now.Add(timeout).UnixNano()
-	err := c.pushInFlightMessage(msg)
-	if err != nil {
-		return err
-	}
-	c.addToInFlightPQ(msg)
-	return nil
+	c.countDelivery(msg, now)
+	return c.pushInFlightMessage(msg, now.Add(timeout))
 }
 
 func (c *Channel) StartDeferredTimeout(msg *Message, timeout time.Duration) error {
-	absTs := time.Now().Add(timeout).UnixNano()
-	item := &pqueue.Item{Value: msg, Priority: absTs}
-	err := c.pushDeferredMessage(item)
-	if err != nil {
-		return err
-	}
-	c.addToDeferredPQ(item)
-	return nil
+	return c.pushDeferredMessage(msg, time.Now().Add(timeout))
 }
 
-// pushInFlightMessage atomically adds a message to the in-flight dictionary
-func (c *Channel) pushInFlightMessage(msg *Message) error {
+// setTimeout (re)sets msg's timeout in the nsqd's timing wheel, it expects the
+// caller to hold the mutex of the in-flight (or deferred) dictionary msg is in
+func (c *Channel) setTimeout(msg *Message, deferred bool, deadline time.Time) {
+	msg.timer.Value = msg
+	msg.timeoutChannel = c
+	msg.deferredTimeout = deferred
+	c.ctx.nsqd.timeouts.Add(&msg.timer, deadline)
+}
+
+// pushInFlightMessage atomically adds a message to the in-flight dictionary,
+// timing out at deadline
+func (c *Channel) pushInFlightMessage(msg *Message, deadline time.Time) error {
 	c.inFlightMutex.Lock()
 	_, ok := c.inFlightMessages[msg.ID]
 	if ok {
@@ -460,11 +1001,14 @@ func (c *Channel) pushInFlightMessage(msg *Message) error {
 		return errors.New("ID already in flight")
 	}
 	c.inFlightMessages[msg.ID] = msg
+	c.setTimeout(msg, false, deadline)
 	c.inFlightMutex.Unlock()
 	return nil
 }
 
-// popInFlightMessage atomically removes a message from the in-flight dictionary
+// popInFlightMessage atomically removes a message from the in-flight dictionary,
+// stopping its timeout. A message whose timeout expired is no longer in flight
+// even if processTimeouts hasn't got to it yet.
 func (c *Channel) popInFlightMessage(clientID int64, id MessageID) (*Message, error) {
 	c.inFlightMutex.Lock()
 	msg, ok := c.inFlightMessages[id]
@@ -476,115 +1020,82 @@ func (c *Channel) popInFlightMessage(clientID int64, id MessageID) (*Message, er
 		c.inFlightMutex.Unlock()
 		return nil, errors.New("client does not own message")
 	}
-	delete(c.inFlightMessages, id)
-	c.inFlightMutex.Unlock()
-	return msg, nil
-}
-
-func (c *Channel) addToInFlightPQ(msg *Message) {
-	c.inFlightMutex.Lock()
-	c.inFlightPQ.Push(msg)
-	c.inFlightMutex.Unlock()
-}
-
-func (c *Channel) removeFromInFlightPQ(msg *Message) {
-	c.inFlightMutex.Lock()
-	if msg.index == -1 {
-		// this item has already been popped off the pqueue
+	if !c.ctx.nsqd.timeouts.Remove(&msg.timer) {
 		c.inFlightMutex.Unlock()
-		return
+		return nil, errors.New("ID not in flight")
 	}
-	c.inFlightPQ.Remove(msg.index)
+	delete(c.inFlightMessages, id)
 	c.inFlightMutex.Unlock()
+	return msg, nil
 }
 
-func (c *Channel) pushDeferredMessage(item *pqueue.Item) error {
+// pushDeferredMessage atomically adds a message to the deferred dictionary, to
+// be put in the channel at deadline
+func (c *Channel) pushDeferredMessage(msg *Message, deadline time.Time) error {
 	c.deferredMutex.Lock()
-	// TODO: these map lookups are costly
-	id := item.Value.(*Message).ID
-	_, ok := c.deferredMessages[id]
+	_, ok := c.deferredMessages[msg.ID]
 	if ok {
 		c.deferredMutex.Unlock()
 		return errors.New("ID already deferred")
 	}
-	c.deferredMessages[id] = item
+	c.deferredMessages[msg.ID] = msg
+	c.setTimeout(msg, true, deadline)
 	c.deferredMutex.Unlock()
 	return nil
 }
 
-func (c *Channel) popDeferredMessage(id MessageID) (*pqueue.Item, error) {
-	c.deferredMutex.Lock()
-	// TODO: these map lookups are costly
-	item, ok := c.deferredMessages[id]
-	if !ok {
-		c.deferredMutex.Unlock()
-		return nil, errors.New("ID not deferred")
+// popExpiredMessage atomically removes a message whose timeout expired from the
+// in-flight (or deferred) dictionary, returning false if it's no longer there
+// (e.g. the channel was emptied meanwhile)
+func (c *Channel) popExpiredMessage(msg *Message) bool {
+	mutex := &c.inFlightMutex
+	if msg.deferredTimeout {
+		mutex = &c.deferredMutex
 	}
-	delete(c.deferredMessages, id)
-	c.deferredMutex.Unlock()
-	return item, nil
-}
-
-func (c *Channel) addToDeferredPQ(item *pqueue.Item) {
-	c.deferredMutex.Lock()
-	heap.Push(&c.deferredPQ, item)
-	c.deferredMutex.Unlock()
-}
-
-func (c *Channel) processDeferredQueue(t int64) bool {
-	c.exitMutex.RLock()
-	defer c.exitMutex.RUnlock()
-
-	if c.Exiting() {
+	mutex.Lock()
+	defer mutex.Unlock()
+	// the dictionaries are replaced when the channel is emptied
+	messages := c.inFlightMessages
+	if msg.deferredTimeout {
+		messages = c.deferredMessages
+	}
+	if messages[msg.ID] != msg {
 		return false
 	}
+	delete(messages, msg.ID)
+	return true
+}
 
-	dirty := false
-	for {
-		c.deferredMutex.Lock()
-		item, _ := c.deferredPQ.PeekAndShift(t)
-		c.deferredMutex.Unlock()
-
-		if item == nil {
-			goto exit
-		}
-		dirty = true
-
-		msg := item.Value.(*Message)
-		_, err := c.popDeferredMessage(msg.ID)
-		if err != nil {
-			goto exit
+// processTimeouts requeues the in-flight messages (or quarantines those that
+// keep timing out) and puts the deferred messages whose timeouts expired, see
+// NSQD.processTimeouts
+func (c *Channel) processTimeouts(msgs []*Message) {
+	var quarantined []*Message
+	// moved to the quarantine channel once the exit mutex is released, as that
+	// takes the topic lock
+	defer func() {
+		if len(quarantined) > 0 {
+			c.quarantineMessages(quarantined)
 		}
-		c.put(msg)
-	}
+	}()
 
-exit:
-	return dirty
-}
-
-func (c *Channel) processInFlightQueue(t int64) bool {
 	c.exitMutex.RLock()
 	defer c.exitMutex.RUnlock()
 
 	if c.Exiting() {
-		return false
+		// flushed to the backend along with the rest
+		return
 	}
 
-	dirty := false
-	for {
-		c.inFlightMutex.Lock()
-		msg, _ := c.inFlightPQ.PeekAndShift(t)
-		c.inFlightMutex.Unlock()
-
-		if msg == nil {
-			goto exit
+	for _, msg := range msgs {
+		if !c.popExpiredMessage(msg) {
+			continue
 		}
-		dirty = true
-
-		_, err := c.popInFlightMessage(msg.clientID, msg.ID)
-		if err != nil {
-			goto exit
+		if msg.deferredTimeout {
+			c.put(msg)
+			continue
 		}
+
 		atomic.AddUint64(&c.timeoutCount, 1)
 		c.RLock()
 		client, ok := c.clients[msg.clientID]
@@ -592,9 +1103,10 @@ func (c *Channel) processInFlightQueue(t int64) bool {
 		if ok {
 			client.TimedOutMessage()
 		}
+		if c.timedOut(msg) {
+			quarantined = append(quarantined, msg)
+			continue
+		}
 		c.put(msg)
 	}
-
-exit:
-	return dirty
 }
@@ -1,14 +1,18 @@
 package nsqd
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/nsqio/go-nsq"
 	"github.com/nsqio/nsq/internal/test"
 )
 
@@ -65,7 +69,6 @@ func TestInFlightWorker(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
 	opts.MsgTimeout = 100 * time.Millisecond
-	opts.QueueScanRefreshInterval = 100 * time.Millisecond
 	_, _, nsqd := mustStartNSQD(opts)
 	defer os.RemoveAll(opts.DataPath)
 	defer nsqd.Exit()
@@ -84,13 +87,8 @@ func TestInFlightWorker(t *testing.T) {
 	channel.Unlock()
 	test.Equal(t, count, inFlightMsgs)
 
-	channel.inFlightMutex.Lock()
-	inFlightPQMsgs := len(channel.inFlightPQ)
-	channel.inFlightMutex.Unlock()
-	test.Equal(t, count, inFlightPQMsgs)
+	test.Equal(t, count, nsqd.timeouts.Len())
 
-	// the in flight worker has a resolution of 100ms so we need to wait
-	// at least that much longer than our msgTimeout (in worst case)
 	time.Sleep(4 * opts.MsgTimeout)
 
 	channel.Lock()
@@ -98,10 +96,7 @@ func TestInFlightWorker(t *testing.T) {
 	channel.Unlock()
 	test.Equal(t, 0, inFlightMsgs)
 
-	channel.inFlightMutex.Lock()
-	inFlightPQMsgs = len(channel.inFlightPQ)
-	channel.inFlightMutex.Unlock()
-	test.Equal(t, 0, inFlightPQMsgs)
+	test.Equal(t, 0, nsqd.timeouts.Len())
 }
 
 func TestChannelEmpty(t *testing.T) {
@@ -124,19 +119,42 @@ func TestChannelEmpty(t *testing.T) {
 
 	channel.RequeueMessage(0, msgs[len(msgs)-1].ID, 100*time.Millisecond)
 	test.Equal(t, 24, len(channel.inFlightMessages))
-	test.Equal(t, 24, len(channel.inFlightPQ))
 	test.Equal(t, 1, len(channel.deferredMessages))
-	test.Equal(t, 1, len(channel.deferredPQ))
+	test.Equal(t, 25, nsqd.timeouts.Len())
 
 	channel.Empty()
 
 	test.Equal(t, 0, len(channel.inFlightMessages))
-	test.Equal(t, 0, len(channel.inFlightPQ))
 	test.Equal(t, 0, len(channel.deferredMessages))
-	test.Equal(t, 0, len(channel.deferredPQ))
+	test.Equal(t, 0, nsqd.timeouts.Len())
 	test.Equal(t, int64(0), channel.Depth())
 }
 
+func TestChannelOverflowDropOldest(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 5
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_overflow" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	test.NotNil(t, topic.SetChannelOverflow(ChannelOverflowDropOldest, 0, 0))
+	test.Nil(t, topic.SetChannelOverflow(ChannelOverflowDropOldest, 8, 0))
+	channel := topic.GetChannel("channel")
+
+	for i := 0; i < 20; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte(strconv.Itoa(i)))
+		test.Nil(t, channel.PutMessage(msg))
+	}
+
+	test.Equal(t, int64(8), channel.Depth())
+	test.Equal(t, uint64(12), atomic.LoadUint64(&channel.overflowDropCount))
+	msg := <-channel.memoryMsgChan
+	test.Equal(t, []byte("15"), msg.Body)
+}
+
 func TestChannelEmptyConsumer(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -200,6 +218,350 @@ func TestMaxChannelConsumers(t *testing.T) {
 	test.NotEqual(t, err, nil)
 }
 
+func TestChannelMaxClients(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_max_clients" + strconv.Itoa(int(time.Now().Unix()))
+	channel := nsqd.GetTopic(topicName).GetChannel("ch")
+	test.Nil(t, channel.SetMaxClients(1))
+	test.NotNil(t, channel.SetMaxClients(-1))
+
+	conn1, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn1.Close()
+	identify(t, conn1, nil, frameTypeResponse)
+	sub(t, conn1, topicName, "ch")
+
+	conn2, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn2.Close()
+	identify(t, conn2, nil, frameTypeResponse)
+	_, err = nsq.Subscribe(topicName, "ch").WriteTo(conn2)
+	test.Nil(t, err)
+	readValidate(t, conn2, frameTypeError,
+		fmt.Sprintf("E_TOO_MANY_CLIENTS SUB clients of %s:ch exceeds limit of 1", topicName))
+
+	stats := nsqd.GetStats(topicName, "ch", false)
+	test.Equal(t, 1, stats[0].Channels[0].MaxClients)
+	test.Equal(t, uint64(1), stats[0].Channels[0].RejectedCount)
+}
+
+func TestChannelExclusive(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_exclusive" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.GetChannel("ch").SetExclusive(true)
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := mustConnectNSQD(tcpAddr)
+		test.Nil(t, err)
+		defer conn.Close()
+		identify(t, conn, nil, frameTypeResponse)
+		sub(t, conn, topicName, "ch")
+		_, err = nsq.Ready(1).WriteTo(conn)
+		test.Nil(t, err)
+		conns = append(conns, conn)
+	}
+
+	stats := nsqd.GetStats(topicName, "ch", true)
+	test.Equal(t, true, stats[0].Channels[0].Exclusive)
+	standbys := 0
+	for _, c := range stats[0].Channels[0].Clients {
+		if c.Standby {
+			standbys++
+		}
+	}
+	test.Equal(t, 1, standbys)
+
+	// the first subscriber is active
+	msg := NewMessage(topic.GenerateID(), []byte("test body"))
+	topic.PutMessage(msg)
+	resp, err := nsq.ReadResponse(conns[0])
+	test.Nil(t, err)
+	frameType, data, _ := nsq.UnpackResponse(resp)
+	msgOut, _ := decodeMessage(data)
+	test.Equal(t, frameTypeMessage, frameType)
+	test.Equal(t, msg.ID, msgOut.ID)
+
+	// and fails over to the second when it disconnects
+	conns[0].Close()
+	msg = NewMessage(topic.GenerateID(), []byte("test body"))
+	topic.PutMessage(msg)
+	resp, err = nsq.ReadResponse(conns[1])
+	test.Nil(t, err)
+	frameType, data, _ = nsq.UnpackResponse(resp)
+	msgOut, _ = decodeMessage(data)
+	test.Equal(t, frameTypeMessage, frameType)
+	test.Equal(t, msg.ID, msgOut.ID)
+}
+
+func TestChannelKeyRouting(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	// keys go through the diskqueue
+	opts.MemQueueSize = 0
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_key_routing" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.GetChannel("ch").SetKeyRouting(true)
+
+	for i := 0; i < 2; i++ {
+		conn, err := mustConnectNSQD(tcpAddr)
+		test.Nil(t, err)
+		defer conn.Close()
+		identify(t, conn, nil, frameTypeResponse)
+		sub(t, conn, topicName, "ch")
+		_, err = nsq.Ready(10).WriteTo(conn)
+		test.Nil(t, err)
+	}
+
+	pubConn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer pubConn.Close()
+	identify(t, pubConn, nil, frameTypeResponse)
+	for i := 0; i < 10; i++ {
+		cmd := &nsq.Command{
+			Name:   []byte("PUB"),
+			Params: [][]byte{[]byte(topicName), []byte("user-1")},
+			Body:   []byte("test body"),
+		}
+		_, err = cmd.WriteTo(pubConn)
+		test.Nil(t, err)
+		readValidate(t, pubConn, frameTypeResponse, "OK")
+	}
+
+	// all the messages are in flight to the same client
+	var inFlight []int64
+	for i := 0; i < 100; i++ {
+		stats := nsqd.GetStats(topicName, "ch", true)
+		inFlight = nil
+		for _, c := range stats[0].Channels[0].Clients {
+			inFlight = append(inFlight, c.InFlightCount)
+		}
+		if inFlight[0]+inFlight[1] == 10 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, true, inFlight[0] == 10 || inFlight[1] == 10)
+
+	stats := nsqd.GetStats(topicName, "ch", false)
+	test.Equal(t, true, stats[0].Channels[0].KeyRouting)
+}
+
+func TestChannelSampleRate(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_sample_rate" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	all := topic.GetChannel("all")
+	tap := topic.GetChannel("tap")
+	test.NotNil(t, tap.SetSampleRate(100))
+	test.Nil(t, tap.SetSampleRate(10))
+
+	for i := 0; i < 1000; i++ {
+		topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+	}
+	for i := 0; i < 100 && atomic.LoadUint64(&tap.messageCount)+atomic.LoadUint64(&tap.sampledOutCount) < 1000; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, int64(1000), all.Depth())
+
+	stats := nsqd.GetStats(topicName, "tap", false)
+	test.Equal(t, int32(10), stats[0].Channels[0].SampleRate)
+	test.Equal(t, uint64(1000), stats[0].Channels[0].MessageCount+stats[0].Channels[0].SampledOut)
+	test.Equal(t, true, stats[0].Channels[0].MessageCount < 200)
+}
+
+func TestChannelEphemeralBufferSize(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_ephemeral_buffer_size" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	test.Nil(t, topic.SetEphemeralBufferSize(2))
+	channel := topic.GetChannel("tap#ephemeral")
+
+	for i := 0; i < 5; i++ {
+		channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+	}
+
+	// messages that don't fit are dropped and counted
+	stats := nsqd.GetStats(topicName, "tap#ephemeral", false)
+	test.Equal(t, int64(2), stats[0].Channels[0].Depth)
+	test.Equal(t, int64(2), stats[0].Channels[0].BufferSize)
+	test.Equal(t, uint64(3), stats[0].Channels[0].DropCount)
+}
+
+func TestChannelStagingSize(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 10
+	opts.ChannelStagingSize = 2
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_staging_size" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	for i := 0; i < 12; i++ {
+		channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+	}
+	test.Equal(t, 10, len(channel.memoryMsgChan))
+	test.Equal(t, int64(2), channel.backend.Depth())
+
+	// with a backlog on disk, only 2 new messages are kept in memory
+	for i := 0; i < 10; i++ {
+		<-channel.memoryMsgChan
+	}
+	for i := 0; i < 5; i++ {
+		channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+	}
+	test.Equal(t, 2, len(channel.memoryMsgChan))
+	test.Equal(t, int64(5), channel.backend.Depth())
+}
+
+func TestChannelAlarm(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.ChannelAlarmTopic = "alarms"
+	opts.ChannelAlarmCheckInterval = 10 * time.Millisecond
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	alarms := nsqd.GetTopic("alarms").GetChannel("ch")
+	nextAlarm := func() ChannelAlarm {
+		var alarm ChannelAlarm
+		select {
+		case msg := <-alarms.memoryMsgChan:
+			test.Nil(t, json.Unmarshal(msg.Body, &alarm))
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for alarm")
+		}
+		return alarm
+	}
+
+	topicName := "test_channel_alarm" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	channel.SetAlarm(5, -1)
+
+	for i := 0; i < 5; i++ {
+		channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+	}
+	alarm := nextAlarm()
+	test.Equal(t, ChannelAlarmRaised, alarm.Event)
+	test.Equal(t, topicName, alarm.Topic)
+	test.Equal(t, int64(5), alarm.Depth)
+	test.Equal(t, int64(5), alarm.MaxDepth)
+	test.Equal(t, true, channel.IsAlarmRaised())
+
+	// it only clears once the depth is below 80% of the threshold
+	<-channel.memoryMsgChan
+	time.Sleep(50 * time.Millisecond)
+	test.Equal(t, true, channel.IsAlarmRaised())
+	<-channel.memoryMsgChan
+
+	alarm = nextAlarm()
+	test.Equal(t, ChannelAlarmCleared, alarm.Event)
+	test.Equal(t, int64(3), alarm.Depth)
+	test.Equal(t, false, channel.IsAlarmRaised())
+}
+
+func TestChannelAlarmAge(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_channel_alarm_age")
+	channel := topic.GetChannel("ch")
+	channel.SetAlarm(0, time.Minute)
+
+	now := time.Now()
+	test.Equal(t, (*ChannelAlarm)(nil), channel.checkAlarm(now))
+	channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+	test.Equal(t, (*ChannelAlarm)(nil), channel.checkAlarm(now.Add(59*time.Second)))
+
+	alarm := channel.checkAlarm(now.Add(time.Minute))
+	test.NotNil(t, alarm)
+	test.Equal(t, ChannelAlarmRaised, alarm.Event)
+	test.Equal(t, int64(60000), alarm.OldestMsgAge)
+
+	// sending a message to a client means older ones have been too
+	msg := <-channel.memoryMsgChan
+	msg.Timestamp = now.Add(55 * time.Second).UnixNano()
+	channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+	channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+	alarm = channel.checkAlarm(now.Add(time.Minute))
+	test.NotNil(t, alarm)
+	test.Equal(t, ChannelAlarmCleared, alarm.Event)
+	test.Equal(t, int64(5000), alarm.OldestMsgAge)
+}
+
+func TestChannelStart(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	now := time.Now()
+	start, err := ParseChannelStart("tail", now)
+	test.Nil(t, err)
+	test.Equal(t, now.UnixNano(), start)
+	start, err = ParseChannelStart(strconv.FormatInt(now.Add(-time.Hour).Unix(), 10), now)
+	test.Nil(t, err)
+	_, err = ParseChannelStart(strconv.FormatInt(now.Add(time.Hour).Unix(), 10), now)
+	test.NotNil(t, err)
+	_, err = ParseChannelStart("middle", now)
+	test.NotNil(t, err)
+
+	topicName := "test_channel_start" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	head := topic.GetChannelFrom("head", 0)
+	fromHourAgo := topic.GetChannelFrom("from_hour_ago", start)
+
+	old := NewMessage(topic.GenerateID(), []byte("old"))
+	old.Timestamp = now.Add(-2 * time.Hour).UnixNano()
+	topic.PutMessage(old)
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("new")))
+
+	// an existing channel keeps where it started from
+	test.Equal(t, fromHourAgo, topic.GetChannelFrom("from_hour_ago", 0))
+
+	for i := 0; i < 100 && (head.Depth() < 2 || fromHourAgo.Depth() < 1); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, int64(2), head.Depth())
+	test.Equal(t, int64(1), fromHourAgo.Depth())
+	msg := <-fromHourAgo.memoryMsgChan
+	test.Equal(t, []byte("new"), msg.Body)
+}
+
 func TestChannelHealth(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -248,3 +610,191 @@ func TestChannelHealth(t *testing.T) {
 	resp.Body.Close()
 	test.Equal(t, "OK", string(body))
 }
+
+func TestChannelReleasesFinishedMessage(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_release_message" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel1 := topic.GetChannel("ch1")
+	channel2 := topic.GetChannel("ch2")
+
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	id := msg.ID
+	topic.PutMessage(msg)
+
+	// each channel has its own instance
+	outputMsg1 := <-channel1.memoryMsgChan
+	outputMsg2 := <-channel2.memoryMsgChan
+	test.Equal(t, id, outputMsg1.ID)
+	test.Equal(t, id, outputMsg2.ID)
+	test.Equal(t, false, outputMsg1 == outputMsg2)
+
+	channel1.StartInFlightTimeout(outputMsg1, 0, opts.MsgTimeout)
+	test.Nil(t, channel1.FinishMessage(0, id))
+	var zeroID MessageID
+	test.Equal(t, zeroID, outputMsg1.ID)
+	test.Nil(t, outputMsg1.Body)
+	test.Equal(t, id, outputMsg2.ID)
+}
+
+func TestChannelQuarantine(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.QuarantineTimeouts = 2
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_quarantine" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	id := msg.ID
+	topic.PutMessage(msg)
+	timeout := func() {
+		msg := <-channel.memoryMsgChan
+		test.Equal(t, id, msg.ID)
+		channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+		// as if it expired
+		test.Equal(t, true, nsqd.timeouts.Remove(&msg.timer))
+		channel.processTimeouts([]*Message{msg})
+	}
+
+	// redelivered after the first timeout, quarantined after the second
+	timeout()
+	test.Equal(t, int64(1), channel.Depth())
+	timeout()
+	test.Equal(t, int64(0), channel.Depth())
+	test.Equal(t, uint64(1), channel.QuarantinedCount())
+
+	quarantine, err := topic.GetExistingChannel("ch" + QuarantineSuffix)
+	test.Nil(t, err)
+	test.Equal(t, true, quarantine.IsQuarantine())
+	test.Equal(t, int64(1), quarantine.Depth())
+	quarantined := channel.QuarantinedMessages()
+	test.Equal(t, 1, len(quarantined))
+	test.Equal(t, string(id[:]), quarantined[0].ID)
+	test.Equal(t, 2, quarantined[0].Timeouts)
+
+	// the quarantine channel isn't put the topic's messages
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+	<-channel.memoryMsgChan
+	test.Equal(t, int64(1), quarantine.Depth())
+
+	url := fmt.Sprintf("http://%s/channel/redrive?topic=%s&channel=ch", httpAddr, topicName)
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, `{"count":1}`, string(body))
+	test.Equal(t, int64(1), channel.Depth())
+	test.Equal(t, int64(0), quarantine.Depth())
+	test.Equal(t, 0, len(channel.QuarantinedMessages()))
+	msg = <-channel.memoryMsgChan
+	test.Equal(t, id, msg.ID)
+}
+
+func TestChannelRedeliveries(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_redeliveries" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	deliver := func() *Message {
+		msg := <-channel.memoryMsgChan
+		msg.Attempts++
+		channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+		return msg
+	}
+
+	// requeued once, redelivered and finished
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("a")))
+	msg := deliver()
+	test.Nil(t, channel.RequeueMessage(0, msg.ID, 0))
+	msg = deliver()
+	test.Nil(t, channel.FinishMessage(0, msg.ID))
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("b")))
+	msg = deliver()
+	test.Nil(t, channel.FinishMessage(0, msg.ID))
+
+	stats := nsqd.GetStats(topicName, "ch", false)
+	test.Equal(t, uint64(3), stats[0].Channels[0].DeliveryCount)
+	test.Equal(t, uint64(1), stats[0].Channels[0].RedeliveryCount)
+	test.Equal(t, 1.0/3, stats[0].Channels[0].RedeliveryRate)
+
+	// only the deliveries of the last window count towards the rate
+	var r redeliveryRate
+	now := time.Now()
+	r.add(now, true)
+	test.Equal(t, 1.0, r.rate(now))
+	now = now.Add(redeliveryRateWindow / 2)
+	r.add(now, false)
+	test.Equal(t, 0.5, r.rate(now))
+	now = now.Add(redeliveryRateWindow / 2)
+	test.Equal(t, 0.0, r.rate(now))
+	test.Equal(t, 0.0, r.rate(now.Add(redeliveryRateWindow)))
+}
+
+func TestChannelFinishRetainedMessage(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_finish_retained_message")
+	channel := topic.GetChannel("ch")
+
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	id := msg.ID
+	test.Nil(t, channel.PutMessage(msg))
+	msg = <-channel.memoryMsgChan
+
+	// as messagePump does while it writes the message, which can be finished
+	// in the meantime
+	msg.retain()
+	channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+	test.Nil(t, channel.FinishMessage(0, id))
+	test.Equal(t, id, msg.ID)
+	test.Equal(t, []byte("test"), msg.Body)
+
+	releaseMessage(msg)
+	var zeroID MessageID
+	test.Equal(t, zeroID, msg.ID)
+	test.Nil(t, msg.Body)
+}
+
+func BenchmarkChannelPutFinish(b *testing.B) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(b)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("bench_put_finish" + strconv.Itoa(b.N))
+	channels := []*Channel{topic.GetChannel("ch1"), topic.GetChannel("ch2")}
+	body := make([]byte, 256)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		topic.PutMessage(NewMessage(topic.GenerateID(), body))
+		for _, channel := range channels {
+			msg := <-channel.memoryMsgChan
+			channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+			channel.FinishMessage(0, msg.ID)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"compress/flate"
 	"crypto/tls"
+	"encoding/binary"
 	"fmt"
 	"net"
 	"sync"
@@ -12,10 +13,15 @@ import (
 
 	"github.com/golang/snappy"
 	"github.com/nsqio/nsq/internal/auth"
+	"github.com/nsqio/nsq/internal/quantile"
 )
 
 const defaultBufferSize = 16 * 1024
 
+// maxBatchFrames bounds the message frames written at once (each takes two of the
+// 1024 iovecs writev accepts)
+const maxBatchFrames = 512
+
 const (
 	stateInit = iota
 	stateDisconnected
@@ -38,13 +44,23 @@ type identifyDataV2 struct {
 	SampleRate          int32  `json:"sample_rate"`
 	UserAgent           string `json:"user_agent"`
 	MsgTimeout          int    `json:"msg_timeout"`
+	MsgEnvelope         int32  `json:"msg_envelope"`
+	AdaptiveFlush       bool   `json:"adaptive_flush"`
+	RdyHints            bool   `json:"rdy_hints"`
+	PublishCredits      bool   `json:"publish_credits"`
+	MsgIDs              bool   `json:"msg_ids"`
+	EventTimestamps     bool   `json:"event_timestamps"`
+	Hops                bool   `json:"hops"`
 }
 
 type identifyEvent struct {
 	OutputBufferTimeout time.Duration
+	AdaptiveFlush       bool
 	HeartbeatInterval   time.Duration
 	SampleRate          int32
 	MsgTimeout          time.Duration
+	RdyHintInterval     time.Duration
+	PublishCredits      bool
 }
 
 type clientV2 struct {
@@ -54,6 +70,8 @@ type clientV2 struct {
 	MessageCount  uint64
 	FinishCount   uint64
 	RequeueCount  uint64
+	// messages the client may still publish, see checkPublishCredits
+	PublishCredits int64
 
 	pubCounts map[string]uint64
 
@@ -77,11 +95,33 @@ type clientV2 struct {
 
 	OutputBufferSize    int
 	OutputBufferTimeout time.Duration
+	// flush as soon as the channel has no more messages queued, instead of
+	// after OutputBufferTimeout
+	AdaptiveFlush bool
 
 	HeartbeatInterval time.Duration
 
 	MsgTimeout time.Duration
 
+	// how often the client is sent RDY hints, 0 unless it opted in
+	RdyHintInterval time.Duration
+
+	// the credits granted to the client at most, 0 unless it opted in (see
+	// grantPublishCredits)
+	PublishCreditWindow int64
+	creditTopic         atomic.Value // *Topic
+	creditChan          chan int
+
+	// the messages the client publishes start with their IDs, which it opted in
+	// to with --msg-id-generator=producer
+	MsgIDs bool
+	// the messages the client publishes start with their event timestamps
+	// (after their IDs), see Message.EventTimestamp
+	EventTimestamps bool
+	// the messages the client republishes start with their hops (after their
+	// event timestamps), which it opted in to with --record-hops
+	MsgHops bool
+
 	State          int32
 	ConnectTime    time.Time
 	Channel        *Channel
@@ -90,8 +130,14 @@ type clientV2 struct {
 
 	ClientID string
 	Hostname string
+	// negotiated in IDENTIFY, see identifyFeatures
+	Features []string
+
+	SampleRate  int32
+	MsgEnvelope int32
 
-	SampleRate int32
+	// deliver to FIN time of its messages, see --processing-latency-percentile
+	processingLatencyStream *quantile.Quantile
 
 	IdentifyEventChan chan identifyEvent
 	SubEventChan      chan *Channel
@@ -104,8 +150,16 @@ type clientV2 struct {
 	lenBuf   [4]byte
 	lenSlice []byte
 
+	// message frames waiting to be written with a single writev (see queueMessage),
+	// the headers of the frames are in batchHeaders and the bodies are not copied
+	batch        net.Buffers
+	batchBytes   int
+	batchHeaders []byte
+
 	AuthSecret string
 	AuthState  *auth.State
+	// the identity whose quotas this client counts against
+	quotaIdentity string
 }
 
 func newClientV2(id int64, conn net.Conn, ctx *context) *clientV2 {
@@ -121,12 +175,14 @@ func newClientV2(id int64, conn net.Conn, ctx *context) *clientV2 {
 		Conn: conn,
 
 		Reader: bufio.NewReaderSize(conn, defaultBufferSize),
-		Writer: bufio.NewWriterSize(conn, defaultBufferSize),
+		Writer: bufio.NewWriterSize(conn, int(ctx.nsqd.getOpts().OutputBufferSize)),
 
-		OutputBufferSize:    defaultBufferSize,
+		OutputBufferSize:    int(ctx.nsqd.getOpts().OutputBufferSize),
 		OutputBufferTimeout: ctx.nsqd.getOpts().OutputBufferTimeout,
+		AdaptiveFlush:       ctx.nsqd.getOpts().AdaptiveOutputFlush,
 
-		MsgTimeout: ctx.nsqd.getOpts().MsgTimeout,
+		MsgTimeout:  ctx.nsqd.getOpts().MsgTimeout,
+		MsgEnvelope: MsgEnvelopeV1,
 
 		// ReadyStateChan has a buffer of 1 to guarantee that in the event
 		// there is a race the state update is not lost
@@ -140,12 +196,19 @@ func newClientV2(id int64, conn net.Conn, ctx *context) *clientV2 {
 
 		SubEventChan:      make(chan *Channel, 1),
 		IdentifyEventChan: make(chan identifyEvent, 1),
+		creditChan:        make(chan int, 1),
 
 		// heartbeats are client configurable but default to 30s
 		HeartbeatInterval: ctx.nsqd.getOpts().ClientTimeout / 2,
 
 		pubCounts: make(map[string]uint64),
 	}
+	if len(ctx.nsqd.getOpts().ProcessingLatencyPercentiles) > 0 {
+		c.processingLatencyStream = quantile.New(
+			ctx.nsqd.getOpts().E2EProcessingLatencyWindowTime,
+			ctx.nsqd.getOpts().ProcessingLatencyPercentiles,
+		)
+	}
 	c.lenSlice = c.lenBuf[:]
 	return c
 }
@@ -172,6 +235,11 @@ func (c *clientV2) Identify(data identifyDataV2) error {
 	if err != nil {
 		return err
 	}
+	if data.AdaptiveFlush {
+		c.writeLock.Lock()
+		c.AdaptiveFlush = true
+		c.writeLock.Unlock()
+	}
 
 	err = c.SetSampleRate(data.SampleRate)
 	if err != nil {
@@ -183,11 +251,45 @@ func (c *clientV2) Identify(data identifyDataV2) error {
 		return err
 	}
 
+	err = c.SetMsgEnvelope(data.MsgEnvelope)
+	if err != nil {
+		return err
+	}
+
+	if data.RdyHints {
+		c.writeLock.Lock()
+		c.RdyHintInterval = c.ctx.nsqd.getOpts().RdyHintInterval
+		c.writeLock.Unlock()
+	}
+
+	if data.PublishCredits {
+		// IDENTIFY is the first command, nothing is published meanwhile
+		c.PublishCreditWindow = c.ctx.nsqd.getOpts().PublishCreditWindow
+		atomic.StoreInt64(&c.PublishCredits, c.PublishCreditWindow)
+	}
+
+	if data.MsgIDs {
+		if !c.ctx.nsqd.msgIDPolicy.producerIDs() {
+			return fmt.Errorf("msg_ids requires --msg-id-generator=%s", MsgIDGeneratorProducer)
+		}
+		c.MsgIDs = true
+	}
+	c.EventTimestamps = data.EventTimestamps
+	if data.Hops {
+		if !c.ctx.nsqd.getOpts().RecordHops {
+			return fmt.Errorf("hops requires --record-hops")
+		}
+		c.MsgHops = true
+	}
+
 	ie := identifyEvent{
 		OutputBufferTimeout: c.OutputBufferTimeout,
+		AdaptiveFlush:       c.AdaptiveFlush,
 		HeartbeatInterval:   c.HeartbeatInterval,
 		SampleRate:          c.SampleRate,
 		MsgTimeout:          c.MsgTimeout,
+		RdyHintInterval:     c.RdyHintInterval,
+		PublishCredits:      c.PublishCreditWindow > 0,
 	}
 
 	// update the client's message pump
@@ -204,6 +306,7 @@ func (c *clientV2) Stats() ClientStats {
 	clientID := c.ClientID
 	hostname := c.Hostname
 	userAgent := c.UserAgent
+	features := c.Features
 	var identity string
 	var identityURL string
 	if c.AuthState != nil {
@@ -239,6 +342,10 @@ func (c *clientV2) Stats() ClientStats {
 		AuthIdentity:    identity,
 		AuthIdentityURL: identityURL,
 		PubCounts:       pubCounts,
+		Features:        features,
+	}
+	if c.processingLatencyStream != nil {
+		stats.ProcessingLatency = c.processingLatencyStream.Result()
 	}
 	if stats.TLS {
 		p := prettyConnectionState{c.tlsConn.ConnectionState()}
@@ -250,6 +357,13 @@ func (c *clientV2) Stats() ClientStats {
 	return stats
 }
 
+// SetFeatures records the features the client negotiated in IDENTIFY
+func (c *clientV2) SetFeatures(features []string) {
+	c.metaLock.Lock()
+	c.Features = features
+	c.metaLock.Unlock()
+}
+
 func (c *clientV2) IsProducer() bool {
 	c.metaLock.RLock()
 	retval := len(c.pubCounts) > 0
@@ -310,7 +424,7 @@ func (p *prettyConnectionState) GetVersion() string {
 }
 
 func (c *clientV2) IsReadyForMessages() bool {
-	if c.Channel.IsPaused() {
+	if c.Channel.IsPaused() || !c.Channel.isActiveClient(c.ID) {
 		return false
 	}
 
@@ -347,6 +461,12 @@ func (c *clientV2) FinishedMessage() {
 	c.tryUpdateReadyState()
 }
 
+func (c *clientV2) FinishedDelivery(deliveryTS time.Time) {
+	if c.processingLatencyStream != nil {
+		c.processingLatencyStream.Insert(deliveryTS.UnixNano())
+	}
+}
+
 func (c *clientV2) Empty() {
 	atomic.StoreInt64(&c.InFlightCount, 0)
 	c.tryUpdateReadyState()
@@ -363,6 +483,16 @@ func (c *clientV2) PublishedMessage(topic string, count uint64) {
 	c.metaLock.Unlock()
 }
 
+// publisherName returns what the client is counted as in the publishers of a
+// topic, see Topic.TopPublishers
+func (c *clientV2) publisherName() string {
+	identity := ""
+	if c.AuthState != nil {
+		identity = c.AuthState.Identity
+	}
+	return publisherName(identity, c.CommonName(), c.String())
+}
+
 func (c *clientV2) TimedOutMessage() {
 	atomic.AddInt64(&c.InFlightCount, -1)
 	c.tryUpdateReadyState()
@@ -408,6 +538,13 @@ func (c *clientV2) SetHeartbeatInterval(desiredInterval int) error {
 	return nil
 }
 
+// readTimeout is how long the client may send nothing for before it's
+// considered dead, see --heartbeat-miss-limit
+func (c *clientV2) readTimeout() time.Duration {
+	opts := c.ctx.nsqd.getOpts()
+	return c.HeartbeatInterval*time.Duration(opts.HeartbeatMissLimit) + opts.HeartbeatGracePeriod
+}
+
 func (c *clientV2) SetOutputBuffer(desiredSize int, desiredTimeout int) error {
 	c.writeLock.Lock()
 	defer c.writeLock.Unlock()
@@ -433,7 +570,10 @@ func (c *clientV2) SetOutputBuffer(desiredSize int, desiredTimeout int) error {
 		c.OutputBufferTimeout = 0
 	case desiredSize == 0:
 		// do nothing (use default)
-	case desiredSize >= 64 && desiredSize <= int(c.ctx.nsqd.getOpts().MaxOutputBufferSize):
+	case true &&
+		desiredSize >= int(c.ctx.nsqd.getOpts().MinOutputBufferSize) &&
+		desiredSize <= int(c.ctx.nsqd.getOpts().MaxOutputBufferSize):
+
 		c.OutputBufferSize = desiredSize
 	default:
 		return fmt.Errorf("output buffer size (%d) is invalid", desiredSize)
@@ -458,6 +598,18 @@ func (c *clientV2) SetSampleRate(sampleRate int32) error {
 	return nil
 }
 
+func (c *clientV2) SetMsgEnvelope(msgEnvelope int32) error {
+	switch msgEnvelope {
+	case 0:
+		msgEnvelope = MsgEnvelopeV1
+	case MsgEnvelopeV1, MsgEnvelopeV2, MsgEnvelopeV3:
+	default:
+		return fmt.Errorf("msg envelope (%d) is invalid", msgEnvelope)
+	}
+	atomic.StoreInt32(&c.MsgEnvelope, msgEnvelope)
+	return nil
+}
+
 func (c *clientV2) SetMsgTimeout(msgTimeout int) error {
 	c.writeLock.Lock()
 	defer c.writeLock.Unlock()
@@ -532,7 +684,80 @@ func (c *clientV2) UpgradeSnappy() error {
 	return nil
 }
 
+// canBatch returns whether message frames can be written to the connection directly
+// (with writev) instead of through Writer, which is when nothing wraps the
+// connection and output buffering is enabled
+func (c *clientV2) canBatch() bool {
+	return c.tlsConn == nil && c.flateWriter == nil &&
+		atomic.LoadInt32(&c.Snappy) == 0 && c.OutputBufferSize > 1
+}
+
+// batchFrames returns how many message frames are batched before they are written,
+// a quarter of the client's RDY count so that high RDY consumers get large writes
+// while low RDY consumers don't wait for the output buffer timeout
+func (c *clientV2) batchFrames() int {
+	n := atomic.LoadInt64(&c.ReadyCount) / 4
+	switch {
+	case n < 1:
+		return 1
+	case n > maxBatchFrames:
+		return maxBatchFrames
+	}
+	return int(n)
+}
+
+// queueMessage adds a message frame to the batch, writing the batch when it has
+// reached batchFrames or the output buffer size. The caller must hold writeLock.
+func (c *clientV2) queueMessage(msg *Message) error {
+	start := len(c.batchHeaders)
+	c.batchHeaders = append(c.batchHeaders, 0, 0, 0, 0, 0, 0, 0, 0)
+	c.batchHeaders = msg.appendHeader(c.batchHeaders, atomic.LoadInt32(&c.MsgEnvelope))
+	header := c.batchHeaders[start:]
+	size := len(header) + len(msg.Body)
+	binary.BigEndian.PutUint32(header[:4], uint32(size-4))
+	binary.BigEndian.PutUint32(header[4:8], uint32(frameTypeMessage))
+
+	c.batch = append(c.batch, header, msg.Body)
+	c.batchBytes += size
+
+	if c.batchBytes >= c.OutputBufferSize || len(c.batch)/2 >= c.batchFrames() {
+		return c.writeBatch()
+	}
+	return nil
+}
+
+// writeBatch writes the batched message frames to the connection. The caller must
+// hold writeLock.
+func (c *clientV2) writeBatch() error {
+	if len(c.batch) == 0 {
+		return nil
+	}
+
+	var zeroTime time.Time
+	if c.HeartbeatInterval > 0 {
+		c.SetWriteDeadline(time.Now().Add(c.HeartbeatInterval))
+	} else {
+		c.SetWriteDeadline(zeroTime)
+	}
+
+	bufs := c.batch
+	_, err := bufs.WriteTo(c.Conn)
+
+	for i := range c.batch {
+		c.batch[i] = nil
+	}
+	c.batch = c.batch[:0]
+	c.batchBytes = 0
+	c.batchHeaders = c.batchHeaders[:0]
+	return err
+}
+
 func (c *clientV2) Flush() error {
+	err := c.writeBatch()
+	if err != nil {
+		return err
+	}
+
 	var zeroTime time.Time
 	if c.HeartbeatInterval > 0 {
 		c.SetWriteDeadline(time.Now().Add(c.HeartbeatInterval))
@@ -540,7 +765,7 @@ func (c *clientV2) Flush() error {
 		c.SetWriteDeadline(zeroTime)
 	}
 
-	err := c.Writer.Flush()
+	err = c.Writer.Flush()
 	if err != nil {
 		return err
 	}
@@ -558,26 +783,32 @@ func (c *clientV2) QueryAuthd() error {
 		return err
 	}
 
-	tlsEnabled := atomic.LoadInt32(&c.TLS) == 1
-	commonName := ""
-	if tlsEnabled {
-		tlsConnState := c.tlsConn.ConnectionState()
-		if len(tlsConnState.PeerCertificates) > 0 {
-			commonName = tlsConnState.PeerCertificates[0].Subject.CommonName
-		}
-	}
-
-	authState, err := auth.QueryAnyAuthd(c.ctx.nsqd.getOpts().AuthHTTPAddresses,
-		remoteIP, tlsEnabled, commonName, c.AuthSecret,
-		c.ctx.nsqd.getOpts().HTTPClientConnectTimeout,
-		c.ctx.nsqd.getOpts().HTTPClientRequestTimeout)
+	authState, err := c.ctx.nsqd.authProvider.Authorize(&auth.Request{
+		RemoteIP:   remoteIP,
+		TLS:        atomic.LoadInt32(&c.TLS) == 1,
+		CommonName: c.CommonName(),
+		Secret:     c.AuthSecret,
+	})
 	if err != nil {
 		return err
 	}
 	c.AuthState = authState
+	c.ctx.nsqd.quotas.update(c.quotaIdentity, authState.Quotas)
 	return nil
 }
 
+// CommonName returns the common name of the client's TLS certificate, if any
+func (c *clientV2) CommonName() string {
+	if atomic.LoadInt32(&c.TLS) != 1 {
+		return ""
+	}
+	tlsConnState := c.tlsConn.ConnectionState()
+	if len(tlsConnState.PeerCertificates) == 0 {
+		return ""
+	}
+	return tlsConnState.PeerCertificates[0].Subject.CommonName
+}
+
 func (c *clientV2) Auth(secret string) error {
 	c.AuthSecret = secret
 	return c.QueryAuthd()
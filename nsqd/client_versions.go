@@ -0,0 +1,169 @@
+package nsqd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/blang/semver"
+)
+
+// clientVersionPolicy refuses clients whose IDENTIFY user_agent names a client
+// library older than its --min-client-version, e.g. go-nsq/1.1.0, to help drive
+// library upgrades. Clients of other libraries, or that don't IDENTIFY, are
+// allowed.
+type clientVersionPolicy struct {
+	rejectedCount uint64
+
+	minVersions map[string]semver.Version
+}
+
+func newClientVersionPolicy(opts *Options) (*clientVersionPolicy, error) {
+	p := &clientVersionPolicy{
+		minVersions: make(map[string]semver.Version),
+	}
+	for _, v := range opts.MinClientVersions {
+		library, version := parseUserAgent(v)
+		if library == "" || version == "" {
+			return nil, fmt.Errorf("invalid --min-client-version %q - must be library/version", v)
+		}
+		min, err := semver.ParseTolerant(version)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --min-client-version %q - %s", v, err)
+		}
+		p.minVersions[library] = min
+	}
+	return p, nil
+}
+
+// parseUserAgent returns the library and version of a user agent such as
+// "go-nsq/1.0.7" or "pynsq/0.9.0 tornado/5.1"
+func parseUserAgent(userAgent string) (string, string) {
+	fields := strings.Fields(userAgent)
+	if len(fields) == 0 {
+		return "", ""
+	}
+	parts := strings.SplitN(fields[0], "/", 2)
+	if len(parts) != 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// check returns an error if a client with userAgent may not connect
+func (p *clientVersionPolicy) check(userAgent string) error {
+	library, version := parseUserAgent(userAgent)
+	min, ok := p.minVersions[library]
+	if !ok {
+		return nil
+	}
+	v, err := semver.ParseTolerant(version)
+	if err != nil || v.LT(min) {
+		atomic.AddUint64(&p.rejectedCount, 1)
+		return fmt.Errorf("client %s is below the minimum version %s/%s", userAgent, library, min)
+	}
+	return nil
+}
+
+// identifyFeatures returns the features a client negotiated in IDENTIFY
+func identifyFeatures(data identifyDataV2, tlsv1 bool, deflate bool, snappy bool) []string {
+	var features []string
+	for _, f := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"feature_negotiation", data.FeatureNegotiation},
+		{"tls_v1", tlsv1},
+		{"deflate", deflate},
+		{"snappy", snappy},
+		{"heartbeat_interval", data.HeartbeatInterval != 0},
+		{"output_buffer", data.OutputBufferSize != 0 || data.OutputBufferTimeout != 0},
+		{"adaptive_flush", data.AdaptiveFlush},
+		{"sample_rate", data.SampleRate > 0},
+		{"msg_timeout", data.MsgTimeout > 0},
+		{"msg_envelope", data.MsgEnvelope > 0},
+		{"rdy_hints", data.RdyHints},
+		{"publish_credits", data.PublishCredits},
+		{"msg_ids", data.MsgIDs},
+		{"event_timestamps", data.EventTimestamps},
+		{"hops", data.Hops},
+	} {
+		if f.enabled {
+			features = append(features, f.name)
+		}
+	}
+	return features
+}
+
+// ClientCount is the number of connected clients with a user agent, protocol
+// or feature
+type ClientCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// ClientSummary is what client libraries, versions and features are connected
+type ClientSummary struct {
+	ClientCount   int               `json:"client_count"`
+	UserAgents    []ClientCount     `json:"user_agents"`
+	Protocols     []ClientCount     `json:"protocols"`
+	Features      []ClientCount     `json:"features"`
+	MinVersions   map[string]string `json:"min_versions"`
+	RejectedCount uint64            `json:"rejected_count"`
+}
+
+// GetClientSummary counts the connected clients by user agent, protocol and
+// negotiated feature
+func (n *NSQD) GetClientSummary() ClientSummary {
+	n.clientLock.RLock()
+	clients := make([]Client, 0, len(n.clients))
+	for _, c := range n.clients {
+		clients = append(clients, c)
+	}
+	n.clientLock.RUnlock()
+
+	userAgents := make(map[string]int)
+	protocols := make(map[string]int)
+	features := make(map[string]int)
+	for _, c := range clients {
+		stats := c.Stats()
+		userAgent := stats.UserAgent
+		if userAgent == "" {
+			userAgent = "unknown"
+		}
+		userAgents[userAgent]++
+		protocols[stats.Version]++
+		for _, f := range stats.Features {
+			features[f]++
+		}
+	}
+
+	minVersions := make(map[string]string)
+	for library, v := range n.clientVersions.minVersions {
+		minVersions[library] = v.String()
+	}
+	return ClientSummary{
+		ClientCount:   len(clients),
+		UserAgents:    sortedClientCounts(userAgents),
+		Protocols:     sortedClientCounts(protocols),
+		Features:      sortedClientCounts(features),
+		MinVersions:   minVersions,
+		RejectedCount: atomic.LoadUint64(&n.clientVersions.rejectedCount),
+	}
+}
+
+// sortedClientCounts returns counts by name, the most common first
+func sortedClientCounts(counts map[string]int) []ClientCount {
+	sorted := make([]ClientCount, 0, len(counts))
+	for name, count := range counts {
+		sorted = append(sorted, ClientCount{name, count})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Count != sorted[j].Count {
+			return sorted[i].Count > sorted[j].Count
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
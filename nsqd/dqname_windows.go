@@ -2,9 +2,32 @@
 
 package nsqd
 
+import (
+	"strings"
+
+	"github.com/nsqio/nsq/internal/protocol"
+)
+
 // On Windows, file names cannot contain colons.
 func getBackendName(topicName, channelName string) string {
 	// backend names, for uniqueness, automatically include the topic... <topic>;<channel>
-	backendName := topicName + ";" + channelName
+	backendName := getTopicBackendName(topicName) + ";" + channelName
 	return backendName
 }
+
+// parseBackendName is the inverse of getBackendName (channelName is empty for the
+// backend of a topic)
+func parseBackendName(backendName string) (string, string) {
+	parts := strings.SplitN(backendName, ";", 2)
+	topicName := strings.Replace(parts[0], "~", protocol.NamespaceSeparator, 1)
+	if len(parts) == 1 {
+		return topicName, ""
+	}
+	return topicName, parts[1]
+}
+
+// getTopicBackendName returns the backend name of a topic, with the namespace
+// separator of namespaced topics replaced as file names cannot contain it
+func getTopicBackendName(topicName string) string {
+	return strings.Replace(topicName, protocol.NamespaceSeparator, "~", 1)
+}
@@ -0,0 +1,134 @@
+package nsqd
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	// defaultDrainTimeout is how long a draining topic waits for its channels to
+	// empty before it is deleted regardless, unless the request says otherwise
+	defaultDrainTimeout = 5 * time.Minute
+	drainPollDelay      = 100 * time.Millisecond
+)
+
+// ErrTopicDraining is returned when publishing to a topic that is being drained
+// before it is deleted
+var ErrTopicDraining = errors.New("topic is draining for deletion")
+
+// topicDrain deletes a topic once the messages already published to it have
+// been consumed: it stops accepting publishes and waits for its channels to be
+// empty (nothing queued, in flight or deferred) or for the timeout to pass
+type topicDrain struct {
+	topic        *Topic
+	startTime    time.Time
+	deadline     time.Time
+	initialDepth int64
+}
+
+// DrainStats reports the progress of a topic's drain
+type DrainStats struct {
+	TopicName string `json:"topic_name"`
+	StartTime int64  `json:"start_time"`
+	Deadline  int64  `json:"deadline"`
+	// messages left to consume when the drain started, and now
+	InitialDepth int64 `json:"initial_depth"`
+	Depth        int64 `json:"depth"`
+}
+
+// DrainAndDelete stops accepting publishes to the topic and deletes it once its
+// channels are empty, or after timeout, in the background (see DrainStats)
+func (t *Topic) DrainAndDelete(timeout time.Duration) error {
+	now := time.Now()
+	d := &topicDrain{
+		topic:     t,
+		startTime: now,
+		deadline:  now.Add(timeout),
+	}
+	d.initialDepth = d.remaining()
+
+	t.Lock()
+	if t.mirroring() {
+		t.Unlock()
+		return ErrMigrationInProgress
+	}
+	if t.getDrain() != nil {
+		t.Unlock()
+		return nil
+	}
+	t.drain.Store(d)
+	t.Unlock()
+
+	t.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): draining %d messages before deleting (timeout %s)",
+		t.name, d.initialDepth, timeout)
+	go d.loop()
+	return nil
+}
+
+// DrainStats returns the progress of the topic's drain
+func (t *Topic) DrainStats() (DrainStats, bool) {
+	d := t.getDrain()
+	if d == nil {
+		return DrainStats{}, false
+	}
+	return DrainStats{
+		TopicName:    t.name,
+		StartTime:    d.startTime.Unix(),
+		Deadline:     d.deadline.Unix(),
+		InitialDepth: d.initialDepth,
+		Depth:        d.remaining(),
+	}, true
+}
+
+func (t *Topic) getDrain() *topicDrain {
+	return t.drain.Load().(*topicDrain)
+}
+
+// draining reports whether publishes to the topic are refused
+func (t *Topic) draining() bool {
+	return t.getDrain() != nil
+}
+
+// remaining is the number of messages left to consume. Without channels, the
+// messages queued in the topic have no consumers to wait for.
+func (d *topicDrain) remaining() int64 {
+	channels := d.topic.loadChannels()
+	if len(channels) == 0 {
+		return 0
+	}
+	depth := d.topic.Depth()
+	for _, c := range channels {
+		depth += c.Depth() + channelPending(c)
+	}
+	return depth
+}
+
+func (d *topicDrain) loop() {
+	t := d.topic
+	ticker := time.NewTicker(drainPollDelay)
+	defer ticker.Stop()
+	for {
+		depth := d.remaining()
+		if depth == 0 {
+			t.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): drained", t.name)
+			break
+		}
+		if time.Now().After(d.deadline) {
+			t.ctx.nsqd.logf(LOG_WARN, "TOPIC(%s): drain timed out, deleting %d messages",
+				t.name, depth)
+			break
+		}
+
+		select {
+		case <-ticker.C:
+		case <-t.exitChan:
+			// deleted (or closed) meanwhile
+			return
+		}
+	}
+
+	err := t.ctx.nsqd.DeleteExistingTopic(t.name)
+	if err != nil {
+		t.ctx.nsqd.logf(LOG_ERROR, "TOPIC(%s): failed to delete drained topic - %s", t.name, err)
+	}
+}
@@ -0,0 +1,102 @@
+package nsqd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"runtime/pprof"
+	"time"
+
+	"github.com/nsqio/nsq/internal/version"
+)
+
+// dumpProfiles are the profiles written by Dump, to <name>.pb.gz (for go tool
+// pprof), and the goroutines' full stacks to goroutine.txt too
+var dumpProfiles = []string{"goroutine", "heap", "mutex", "block"}
+
+// dumpState is the state of nsqd written by Dump to state.json
+type dumpState struct {
+	Time       int64        `json:"time"`
+	Version    string       `json:"version"`
+	StartTime  int64        `json:"start_time"`
+	Health     string       `json:"health"`
+	Goroutines int          `json:"goroutines"`
+	Topics     int          `json:"topics"`
+	Channels   int          `json:"channels"`
+	Clients    int          `json:"clients"`
+	Memory     memStats     `json:"memory"`
+	Stats      []TopicStats `json:"stats"`
+}
+
+// Dump writes the goroutine, heap, mutex and block profiles and the state of nsqd
+// (topics, channels and clients) to a new directory in dir named after the time,
+// returning its path, for analysis after an incident. The mutex and block
+// profiles are empty unless their rates were set (see /debug/setblockrate and
+// /debug/setmutexfraction).
+func (n *NSQD) Dump(dir string) (string, error) {
+	now := time.Now()
+	dumpDir := path.Join(dir, "nsqd-dump-"+now.UTC().Format("20060102T150405.000Z"))
+	err := os.Mkdir(dumpDir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	for _, name := range dumpProfiles {
+		err = writeProfile(path.Join(dumpDir, name+".pb.gz"), name, 0)
+		if err != nil {
+			return "", err
+		}
+	}
+	err = writeProfile(path.Join(dumpDir, "goroutine.txt"), "goroutine", 2)
+	if err != nil {
+		return "", err
+	}
+
+	n.RLock()
+	numTopics := len(n.topicMap)
+	n.RUnlock()
+	n.clientLock.RLock()
+	numClients := len(n.clients)
+	n.clientLock.RUnlock()
+	state := dumpState{
+		Time:       now.Unix(),
+		Version:    version.Binary,
+		StartTime:  n.GetStartTime().Unix(),
+		Health:     n.GetHealth(),
+		Goroutines: runtime.NumGoroutine(),
+		Topics:     numTopics,
+		Channels:   len(n.channels()),
+		Clients:    numClients,
+		Memory:     getMemStats(),
+		Stats:      n.GetStats("", "", true),
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	err = writeSyncFile(path.Join(dumpDir, "state.json"), data)
+	if err != nil {
+		return "", err
+	}
+
+	n.logf(LOG_INFO, "NSQ: dumped profiles and state to %s", dumpDir)
+	return dumpDir, nil
+}
+
+func writeProfile(fn string, name string, debug int) error {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	err = pprof.Lookup(name).WriteTo(f, debug)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write %s profile - %s", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package nsqd
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nsqio/nsq/internal/faults"
+	"github.com/nsqio/nsq/internal/http_api"
+)
+
+// doFaults lists the faults injected (see internal/faults), only in nsqd built
+// with the faults build tag
+func (s *httpServer) doFaults(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if !faults.Enabled {
+		return nil, http_api.Err{403, "FAULTS_DISABLED"}
+	}
+	return struct {
+		Faults map[string]faults.Fault `json:"faults"`
+	}{faults.List()}, nil
+}
+
+func (s *httpServer) doSetFault(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if !faults.Enabled {
+		return nil, http_api.Err{403, "FAULTS_DISABLED"}
+	}
+
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	var f faults.Fault
+	if v := reqParams.Get("delay"); v != "" {
+		f.Delay, err = time.ParseDuration(v)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_ARG_DELAY"}
+		}
+	}
+	if v := reqParams.Get("skip"); v != "" {
+		f.Skip, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_ARG_SKIP"}
+		}
+	}
+	if v := reqParams.Get("count"); v != "" {
+		f.Count, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_ARG_COUNT"}
+		}
+	}
+
+	name := reqParams.Get("name")
+	err = faults.Set(name, f)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_ARG_NAME: " + err.Error()}
+	}
+	s.ctx.nsqd.logf(LOG_WARN, "FAULTS: injecting %s (delay %s, skip %d, count %d)",
+		name, f.Delay, f.Skip, f.Count)
+	return nil, nil
+}
+
+func (s *httpServer) doClearFaults(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if !faults.Enabled {
+		return nil, http_api.Err{403, "FAULTS_DISABLED"}
+	}
+
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+	faults.Clear(reqParams.Get("name"))
+	return nil, nil
+}
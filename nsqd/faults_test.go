@@ -0,0 +1,62 @@
+// +build faults
+
+package nsqd
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/nsqio/nsq/internal/faults"
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestFaultDropFrame(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+	defer faults.Clear("")
+
+	url := fmt.Sprintf("http://%s/debug/faults?name=drop_frame&count=1", httpAddr)
+	req, _ := http.NewRequest("PUT", url, nil)
+	resp, err := http.DefaultClient.Do(req)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+
+	topicName := "test_fault_drop_frame" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	ch := topic.GetChannel("ch")
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	topic.PutMessage(msg)
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	identify(t, conn, map[string]interface{}{
+		"msg_timeout": 1000,
+	}, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+
+	// the first delivery is dropped, the message is delivered again once it
+	// timed out
+	resp2, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	_, data, _ := nsq.UnpackResponse(resp2)
+	msgOut, err := decodeMessage(data)
+	test.Nil(t, err)
+	test.Equal(t, msg.ID, msgOut.ID)
+	test.Equal(t, uint16(2), msgOut.Attempts)
+	test.Equal(t, 1, int(atomic.LoadUint64(&ch.timeoutCount)))
+	test.Equal(t, int64(1), faults.List()[faults.DropFrame].Injected)
+}
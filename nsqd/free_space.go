@@ -0,0 +1,17 @@
+// +build !windows
+
+package nsqd
+
+import (
+	"syscall"
+)
+
+// freeSpace returns the number of bytes available to nsqd on the filesystem of path
+func freeSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(path, &st)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
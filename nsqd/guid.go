@@ -103,3 +103,11 @@ func (g guid) Hex() MessageID {
 	hex.Encode(h[:], b[:])
 	return h
 }
+
+func (f *guidFactory) NewID() (MessageID, error) {
+	id, err := f.NewGUID()
+	if err != nil {
+		return MessageID{}, err
+	}
+	return id.Hex(), nil
+}
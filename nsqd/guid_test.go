@@ -1,8 +1,13 @@
 package nsqd
 
 import (
+	"bytes"
+	"encoding/binary"
 	"testing"
+	"time"
 	"unsafe"
+
+	"github.com/nsqio/nsq/internal/test"
 )
 
 func BenchmarkGUIDCopy(b *testing.B) {
@@ -40,3 +45,31 @@ func BenchmarkGUID(b *testing.B) {
 	}
 	b.Logf("okays=%d errors=%d bads=%d", okays, errors, fails)
 }
+
+func TestRandomIDFactory(t *testing.T) {
+	factory := newRandomIDFactory()
+	start := time.Now().UnixNano() / int64(time.Millisecond)
+	var previd MessageID
+	for i := 0; i < 10000; i++ {
+		id, err := factory.NewID()
+		test.Nil(t, err)
+		if bytes.Compare(id[:], previd[:]) <= 0 {
+			t.Fatalf("ID %s not after %s", id[:], previd[:])
+		}
+		previd = id
+	}
+
+	b, err := crockfordBase32.DecodeString(string(previd[:]))
+	test.Nil(t, err)
+	ts := int64(binary.BigEndian.Uint64(b[:8]) >> 16)
+	if ts < start || ts > time.Now().UnixNano()/int64(time.Millisecond) {
+		t.Fatalf("ID %s timestamp %d out of range", previd[:], ts)
+	}
+}
+
+func BenchmarkRandomID(b *testing.B) {
+	factory := newRandomIDFactory()
+	for i := 0; i < b.N; i++ {
+		factory.NewID()
+	}
+}
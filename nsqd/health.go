@@ -0,0 +1,142 @@
+package nsqd
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	HealthOK   = "ok"
+	HealthWarn = "warn"
+	HealthFail = "fail"
+)
+
+// HealthCheck is the result of one of the checks of /health
+type HealthCheck struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// Health is the result of the checks of /health, failed if any check failed.
+// Checks that warn (an unreachable nsqlookupd) don't fail it: nsqd still
+// accepts and delivers messages.
+type Health struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+func (h Health) String() string {
+	if h.Status == HealthOK {
+		return "OK"
+	}
+	var problems []string
+	for _, c := range h.Checks {
+		if c.Status != HealthOK {
+			problems = append(problems, fmt.Sprintf("%s %s - %s", c.Name, c.Status, c.Message))
+		}
+	}
+	if h.Status == HealthWarn {
+		return "OK - " + strings.Join(problems, ", ")
+	}
+	return "NOK - " + strings.Join(problems, ", ")
+}
+
+func (h *Health) add(c HealthCheck) {
+	h.Checks = append(h.Checks, c)
+	if c.Status == HealthFail || (c.Status == HealthWarn && h.Status == HealthOK) {
+		h.Status = c.Status
+	}
+}
+
+// CheckHealth checks that nsqd can write (and sync) its data paths, that they
+// have --health-min-free-bytes free, that the nsqlookupd respond to heartbeats
+// and that the metadata was last persisted successfully
+func (n *NSQD) CheckHealth() Health {
+	opts := n.getOpts()
+	h := Health{Status: HealthOK}
+
+	check := HealthCheck{Name: "health", Status: HealthOK}
+	if err := n.GetError(); err != nil {
+		check.Status = HealthFail
+		check.Message = err.Error()
+	}
+	h.add(check)
+
+	for _, dataPath := range dataPaths(opts) {
+		h.add(checkDataPathWritable(dataPath))
+		h.add(checkFreeSpace(dataPath, opts.HealthMinFreeBytes))
+	}
+
+	for _, lp := range n.lookupPeers.Load().([]*lookupPeer) {
+		h.add(checkLookupPeer(lp))
+	}
+
+	h.add(n.checkMetadata())
+	return h
+}
+
+// checkDataPathWritable writes, syncs and removes a file in dataPath, as disk
+// queues do
+func checkDataPathWritable(dataPath string) HealthCheck {
+	check := HealthCheck{Name: "writable:" + dataPath, Status: HealthOK}
+	fn := path.Join(dataPath, fmt.Sprintf(".health.%d.tmp", rand.Int()))
+	err := writeSyncFile(fn, []byte("ok"))
+	if err == nil {
+		err = os.Remove(fn)
+	}
+	if err != nil {
+		check.Status = HealthFail
+		check.Message = err.Error()
+	}
+	return check
+}
+
+func checkFreeSpace(dataPath string, minFreeBytes int64) HealthCheck {
+	check := HealthCheck{Name: "free_space:" + dataPath, Status: HealthOK}
+	free, err := freeSpace(dataPath)
+	switch {
+	case err != nil:
+		check.Status = HealthFail
+		check.Message = err.Error()
+	case free < uint64(minFreeBytes):
+		check.Status = HealthFail
+		check.Message = fmt.Sprintf("%d bytes free, below %d", free, minFreeBytes)
+	default:
+		check.Message = fmt.Sprintf("%d bytes free", free)
+	}
+	return check
+}
+
+// checkLookupPeer warns unless the nsqlookupd responded within two heartbeats
+func checkLookupPeer(lp *lookupPeer) HealthCheck {
+	check := HealthCheck{Name: "lookupd:" + lp.String(), Status: HealthOK}
+	last := atomic.LoadInt64(&lp.lastResponse)
+	switch {
+	case last == 0:
+		check.Status = HealthWarn
+		check.Message = "no response yet"
+	case time.Since(time.Unix(0, last)) > 2*lookupHeartbeatInterval:
+		check.Status = HealthWarn
+		check.Message = fmt.Sprintf("no response for %s", time.Since(time.Unix(0, last)).Truncate(time.Second))
+	}
+	return check
+}
+
+func (n *NSQD) checkMetadata() HealthCheck {
+	check := HealthCheck{Name: "metadata", Status: HealthOK}
+	if err := n.metadataErr.Load().(errStore).err; err != nil {
+		check.Status = HealthFail
+		check.Message = fmt.Sprintf("failed to persist - %s", err)
+		return check
+	}
+	if last := atomic.LoadInt64(&n.metadataPersisted); last != 0 {
+		check.Message = fmt.Sprintf("persisted %s ago", time.Since(time.Unix(0, last)).Truncate(time.Second))
+	}
+	return check
+}
@@ -0,0 +1,77 @@
+package nsqd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrHopLoop is returned by recordHop for messages that already transited this
+// nsqd, or this cluster with --cluster-name, i.e. that were forwarded in a loop
+var ErrHopLoop = errors.New("message already transited this cluster")
+
+// isValidClusterName reports whether name may be a --cluster-name, which is
+// recorded in hops (cluster/nsqd)
+func isValidClusterName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') &&
+			c != '_' && c != '.' && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// hopNSQD is this nsqd in hops, prefixed with its cluster with --cluster-name
+func (n *NSQD) hopNSQD() string {
+	clusterName := n.getOpts().ClusterName
+	if clusterName == "" {
+		return n.broadcastTCPAddress()
+	}
+	return clusterName + "/" + n.broadcastTCPAddress()
+}
+
+// recordHop sets the hops of msg to hops, where it was published before it was
+// republished to this nsqd (e.g. by nsq_to_nsq, "" if it wasn't), followed by
+// the hop of producer publishing it to this nsqd. It returns ErrHopLoop when
+// hops include this nsqd or, with --cluster-name, any nsqd of its cluster: the
+// message was already published there, republishing it again would loop.
+func (n *NSQD) recordHop(msg *Message, hops string, producer string) error {
+	for i := 0; i < len(hops); i++ {
+		if hops[i] <= ' ' || hops[i] > '~' {
+			return fmt.Errorf("hops %q must be printable ASCII without spaces", hops)
+		}
+	}
+	nsqd := n.hopNSQD()
+	if hops != "" {
+		clusterName := n.getOpts().ClusterName
+		for _, hop := range strings.Split(hops, ",") {
+			// producers may contain @ (e.g. user@host), nsqd can't
+			i := strings.LastIndexByte(hop, '@')
+			hopNSQD := hop[i+1:]
+			if hopNSQD == nsqd || (clusterName != "" && strings.HasPrefix(hopNSQD, clusterName+"/")) {
+				return ErrHopLoop
+			}
+		}
+	}
+	hop := producer + "@" + nsqd
+	if hops != "" {
+		hop = hops + "," + hop
+	}
+	if len(hop) > MaxHopsLength {
+		return fmt.Errorf("hops length %d > %d", len(hop), MaxHopsLength)
+	}
+	msg.Hops = hop
+	return nil
+}
+
+// countLoopDrops records that count messages published to the topic were dropped
+// with ErrHopLoop
+func (t *Topic) countLoopDrops(count uint64) {
+	atomic.AddUint64(&t.loopDropCount, count)
+}
@@ -7,10 +7,12 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/pprof"
 	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"strconv"
@@ -31,6 +33,23 @@ var boolParams = map[string]bool{
 	"0":     false,
 }
 
+// httpRateLimits are shared by the HTTP and HTTPS servers
+type httpRateLimits struct {
+	global *http_api.RateLimiter
+	pub    *http_api.RateLimiter
+	stats  *http_api.RateLimiter
+	admin  *http_api.RateLimiter
+}
+
+func newHTTPRateLimits(opts *Options) *httpRateLimits {
+	return &httpRateLimits{
+		global: http_api.NewRateLimiter(opts.HTTPRateLimit),
+		pub:    http_api.NewRateLimiter(opts.HTTPRateLimitPub),
+		stats:  http_api.NewRateLimiter(opts.HTTPRateLimitStats),
+		admin:  http_api.NewRateLimiter(opts.HTTPRateLimitAdmin),
+	}
+}
+
 type httpServer struct {
 	ctx         *context
 	tlsEnabled  bool
@@ -41,7 +60,7 @@ type httpServer struct {
 func newHTTPServer(ctx *context, tlsEnabled bool, tlsRequired bool) *httpServer {
 	log := http_api.Log(ctx.nsqd.logf)
 
-	router := httprouter.New()
+	router := http_api.NewRouter()
 	router.HandleMethodNotAllowed = true
 	router.PanicHandler = http_api.LogPanicHandler(ctx.nsqd.logf)
 	router.NotFound = http_api.LogNotFoundHandler(ctx.nsqd.logf)
@@ -50,42 +69,172 @@ func newHTTPServer(ctx *context, tlsEnabled bool, tlsRequired bool) *httpServer
 		ctx:         ctx,
 		tlsEnabled:  tlsEnabled,
 		tlsRequired: tlsRequired,
-		router:      router,
+		router:      http_api.CORS(ctx.nsqd.getOpts().HTTPAllowOrigins, router),
 	}
 
-	router.Handle("GET", "/ping", http_api.Decorate(s.pingHandler, log, http_api.PlainText))
-	router.Handle("GET", "/info", http_api.Decorate(s.doInfo, log, http_api.V1))
+	limits := ctx.nsqd.httpRateLimits
+	pubLimit := http_api.RateLimit(limits.pub, limits.global)
+	statsLimit := http_api.RateLimit(limits.stats, limits.global)
+	adminLimit := http_api.RateLimit(limits.admin, limits.global)
+
+	topicParam := http_api.Query("topic", "string", true, "topic name")
+	channelParam := http_api.Query("channel", "string", true, "channel name")
+	optParam := http_api.Path("opt", "option name (as in the config file)")
+	asyncParam := http_api.Query("async", "boolean", false, "answer once messages are buffered rather than put in the topic, see --async-pub-buffer-size")
+
+	// not rate limited, so health checks keep passing while clients are throttled
+	router.Route("GET", "/ping", "health check", http_api.Decorate(s.pingHandler, log, http_api.PlainText))
+	router.Route("GET", "/health", "check the data paths, nsqlookupd and metadata (verbose=true for each check)", http_api.Decorate(s.healthHandler, log))
+	router.Route("GET", "/info", "version and address information", http_api.Decorate(s.doInfo, statsLimit, log, http_api.V1))
+	router.Route("GET", "/api/spec", "OpenAPI specification", http_api.Decorate(router.SpecHandler("nsqd", version.Binary), statsLimit, log, http_api.V1))
 
 	// v1 negotiate
-	router.Handle("POST", "/pub", http_api.Decorate(s.doPUB, http_api.V1))
-	router.Handle("POST", "/mpub", http_api.Decorate(s.doMPUB, http_api.V1))
-	router.Handle("GET", "/stats", http_api.Decorate(s.doStats, log, http_api.V1))
+	router.Route("POST", "/pub", "publish a message", http_api.Decorate(s.doPUB, pubLimit, http_api.V1),
+		topicParam,
+		http_api.Query("defer", "integer", false, "milliseconds to defer delivery"),
+		http_api.Query("key", "string", false, "routing key, see key_routing channels"),
+		http_api.Query("id", "string", false, "message ID, required with --msg-id-generator=producer"),
+		http_api.Query("event_timestamp", "integer", false, "nanosecond timestamp of the event the message is about"),
+		http_api.Query("hops", "string", false, "hops of the message before it was republished, with --record-hops"),
+		asyncParam,
+		http_api.Body("string", "message body"))
+	router.Route("POST", "/mpub", "publish multiple messages", http_api.Decorate(s.doMPUB, pubLimit, http_api.V1),
+		topicParam,
+		http_api.Query("binary", "boolean", false, "body is in the binary MPUB format instead of newline delimited"),
+		http_api.Query("key", "string", false, "routing key of all the messages, see key_routing channels"),
+		http_api.Query("event_timestamp", "integer", false, "nanosecond timestamp of the event all the messages are about"),
+		http_api.Query("hops", "string", false, "hops of all the messages before they were republished, with --record-hops"),
+		http_api.Body("string", "message bodies"))
+	router.Route("POST", "/pub/stream", "publish newline delimited JSON messages, answering each line with a JSON line once it's published", http_api.Decorate(s.doPUBStream, pubLimit, http_api.V1),
+		topicParam,
+		http_api.Query("key", "string", false, "routing key of all the messages, see key_routing channels"),
+		http_api.Query("event_timestamp", "integer", false, "nanosecond timestamp of the event all the messages are about"),
+		http_api.Query("hops", "string", false, "hops of all the messages before they were republished, with --record-hops"),
+		asyncParam,
+		http_api.Body("string", "newline delimited JSON messages"))
+	router.Route("GET", "/stats", "topic, channel and client statistics", http_api.Decorate(s.doStats, statsLimit, log, http_api.V1, http_api.Compress),
+		http_api.Query("format", "string", false, "text or json"),
+		http_api.Query("topic", "string", false, "filter to topic"),
+		http_api.Query("channel", "string", false, "filter to channel"),
+		http_api.Query("namespace", "string", false, "filter to topics in namespace"),
+		http_api.Query("include_clients", "boolean", false, "include client statistics (default true)"))
+	router.Route("GET", "/namespaces", "namespaces, their topics, settings and usage", http_api.Decorate(s.doNamespaces, statsLimit, log, http_api.V1))
+	router.Route("GET", "/clients", "connected client libraries, versions and negotiated features", http_api.Decorate(s.doClients, statsLimit, log, http_api.V1))
 
 	// only v1
-	router.Handle("POST", "/topic/create", http_api.Decorate(s.doCreateTopic, log, http_api.V1))
-	router.Handle("POST", "/topic/delete", http_api.Decorate(s.doDeleteTopic, log, http_api.V1))
-	router.Handle("POST", "/topic/empty", http_api.Decorate(s.doEmptyTopic, log, http_api.V1))
-	router.Handle("POST", "/topic/pause", http_api.Decorate(s.doPauseTopic, log, http_api.V1))
-	router.Handle("POST", "/topic/unpause", http_api.Decorate(s.doPauseTopic, log, http_api.V1))
-	router.Handle("POST", "/channel/create", http_api.Decorate(s.doCreateChannel, log, http_api.V1))
-	router.Handle("POST", "/channel/delete", http_api.Decorate(s.doDeleteChannel, log, http_api.V1))
-	router.Handle("POST", "/channel/empty", http_api.Decorate(s.doEmptyChannel, log, http_api.V1))
-	router.Handle("POST", "/channel/pause", http_api.Decorate(s.doPauseChannel, log, http_api.V1))
-	router.Handle("POST", "/channel/unpause", http_api.Decorate(s.doPauseChannel, log, http_api.V1))
-	router.Handle("GET", "/config/:opt", http_api.Decorate(s.doConfig, log, http_api.V1))
-	router.Handle("PUT", "/config/:opt", http_api.Decorate(s.doConfig, log, http_api.V1))
+	memQueueSizeParam := http_api.Query("mem_queue_size", "integer", false, "override --mem-queue-size for the topic (-1 reverts to --mem-queue-size)")
+	durableParam := http_api.Query("durable", "boolean", false, "acknowledge PUB only once messages are fsynced to disk")
+	syncParams := []http_api.Param{
+		http_api.Query("sync", "string", false, "always (fsync every write) or default (revert sync_every and sync_timeout)"),
+		http_api.Query("sync_every", "integer", false, "override --sync-every for the topic (0 reverts to --sync-every)"),
+		http_api.Query("sync_timeout", "string", false, "override --sync-timeout for the topic (0 reverts to --sync-timeout)"),
+		http_api.Query("compression", "string", false, "override --disk-compression for the topic: none, zstd or default (reverts to --disk-compression)"),
+	}
+	diskParams := []http_api.Param{
+		http_api.Query("max_disk_bytes", "integer", false, "limit the bytes on disk of the topic and its channels (0 is unlimited)"),
+		http_api.Query("disk_quota_policy", "string", false, "backpressure (reject publishes) or truncate (drop the oldest messages) when over max_disk_bytes"),
+		http_api.Query("channel_overflow", "string", false, "none or drop-oldest (discard the oldest messages of channels over their limit)"),
+		http_api.Query("channel_max_depth", "integer", false, "depth at which channel_overflow applies (0 is unlimited)"),
+		http_api.Query("channel_max_disk_bytes", "integer", false, "bytes on disk at which channel_overflow applies (0 is unlimited)"),
+	}
+	topicConfigParams := append([]http_api.Param{topicParam, memQueueSizeParam, durableParam}, syncParams...)
+	topicConfigParams = append(topicConfigParams, diskParams...)
+	topicConfigParams = append(topicConfigParams,
+		http_api.Query("publishers", "string", false, "comma separated auth identities or TLS certificate common names allowed to publish (empty allows any)"),
+		http_api.Query("idle_timeout", "string", false, "override --topic-idle-timeout for the topic (0 reverts to --topic-idle-timeout, negative never deletes it)"),
+		http_api.Query("ephemeral_buffer_size", "integer", false, "override --ephemeral-buffer-size for new #ephemeral channels of the topic (0 reverts to --ephemeral-buffer-size)"))
+	router.Route("POST", "/topic/create", "create a topic", http_api.Decorate(s.doCreateTopic, adminLimit, log, http_api.V1), topicConfigParams...)
+	router.Route("GET", "/topic/config", "get a topic's settings", http_api.Decorate(s.doTopicConfig, adminLimit, log, http_api.V1), topicParam)
+	router.Route("POST", "/topic/config", "change a topic's settings", http_api.Decorate(s.doTopicConfig, adminLimit, log, http_api.V1), topicConfigParams...)
+	router.Route("GET", "/topic/delete", "progress of a topic's drain before it is deleted", http_api.Decorate(s.doDeleteTopic, adminLimit, log, http_api.V1), topicParam)
+	router.Route("POST", "/topic/delete", "delete a topic", http_api.Decorate(s.doDeleteTopic, adminLimit, log, http_api.V1), topicParam,
+		http_api.Query("drain", "boolean", false, "refuse publishes and delete the topic once its channels are empty, in the background (see GET /topic/delete)"),
+		http_api.Query("drain_timeout", "string", false, "delete a draining topic regardless after this long, as a Go duration (e.g. 90s or 1h, default 5m)"))
+	router.Route("POST", "/topic/rename", "rename a topic, keeping its backlog, channels and settings", http_api.Decorate(s.doRenameTopic, adminLimit, log, http_api.V1),
+		topicParam, http_api.Query("to", "string", true, "new topic name"))
+	router.Route("POST", "/topic/empty", "empty a topic", http_api.Decorate(s.doEmptyTopic, adminLimit, log, http_api.V1), topicParam)
+	router.Route("POST", "/topic/pause", "pause a topic", http_api.Decorate(s.doPauseTopic, adminLimit, log, http_api.V1), topicParam)
+	router.Route("POST", "/topic/unpause", "unpause a topic", http_api.Decorate(s.doPauseTopic, adminLimit, log, http_api.V1), topicParam)
+	router.Route("GET", "/topic/migrate", "progress of a topic's migration to another nsqd", http_api.Decorate(s.doMigrateTopic, adminLimit, log, http_api.V1), topicParam)
+	router.Route("POST", "/topic/migrate", "migrate a topic to another nsqd (forward publishes, drain channels, then tombstone this node)", http_api.Decorate(s.doMigrateTopic, adminLimit, log, http_api.V1),
+		topicParam, http_api.Query("target", "string", true, "<host>:<http_port> of the nsqd to migrate to"))
+	router.Route("POST", "/topic/migrate/cancel", "stop a topic's migration", http_api.Decorate(s.doCancelMigration, adminLimit, log, http_api.V1), topicParam)
+	maxClientsParam := http_api.Query("max_clients", "integer", false, "maximum number of clients that may subscribe (0 is only limited by --max-channel-consumers)")
+	exclusiveParam := http_api.Query("exclusive", "boolean", false, "send messages to only one client at a time, failing over to another when it disconnects")
+	keyRoutingParam := http_api.Query("key_routing", "boolean", false, "send messages published with the same key to the same client")
+	sampleRateParam := http_api.Query("sample_rate", "integer", false, "percentage (1-99) of the topic's messages put in the channel (0 is all)")
+	alarmDepthParam := http_api.Query("alarm_depth", "integer", false, "depth at which the channel raises an alarm (0 is --channel-alarm-depth, negative never)")
+	auditLogParam := http_api.Query("audit_log", "boolean", false, "record who finished each message, see /channel/audit")
+	alarmAgeParam := http_api.Query("alarm_age", "string", false, "age of the oldest queued message at which the channel raises an alarm, as a Go duration (e.g. 15m, 0 is --channel-alarm-age, negative never)")
+	quarantineTimeoutsParam := http_api.Query("quarantine_timeouts", "integer", false, "timeouts after which a message is moved to <channel>#quarantine (0 is --quarantine-timeouts, negative never)")
+	router.Route("POST", "/channel/create", "create a channel", http_api.Decorate(s.doCreateChannel, adminLimit, log, http_api.V1), topicParam, channelParam,
+		http_api.Query("start", "string", false, "where a new channel starts from: head (the messages the topic has buffered, default), tail (new messages) or a unix timestamp"),
+		maxClientsParam, exclusiveParam, keyRoutingParam, sampleRateParam, alarmDepthParam, alarmAgeParam, auditLogParam, quarantineTimeoutsParam)
+	router.Route("GET", "/channel/config", "get a channel's settings", http_api.Decorate(s.doChannelConfig, adminLimit, log, http_api.V1), topicParam, channelParam)
+	router.Route("POST", "/channel/config", "change a channel's settings", http_api.Decorate(s.doChannelConfig, adminLimit, log, http_api.V1), topicParam, channelParam, maxClientsParam, exclusiveParam, keyRoutingParam, sampleRateParam, alarmDepthParam, alarmAgeParam, auditLogParam, quarantineTimeoutsParam)
+	router.Route("POST", "/channel/mpub", "publish multiple messages to a single channel (used by topic migration)", http_api.Decorate(s.doChannelMPUB, adminLimit, http_api.V1),
+		topicParam, channelParam, http_api.Body("string", "message bodies in the binary MPUB format"))
+	transferParams := []http_api.Param{
+		topicParam,
+		http_api.Query("from", "string", true, "channel to read the queued messages of"),
+		http_api.Query("to", "string", true, "channel of the same topic to put them in"),
+	}
+	router.Route("POST", "/channel/copy", "copy a channel's queued messages to another channel", http_api.Decorate(s.doTransferChannel, adminLimit, log, http_api.V1), transferParams...)
+	router.Route("POST", "/channel/move", "move a channel's queued messages to another channel", http_api.Decorate(s.doTransferChannel, adminLimit, log, http_api.V1), transferParams...)
+	router.Route("GET", "/channel/audit", "records of who finished the channel's messages, oldest first", http_api.Decorate(s.doChannelAudit, adminLimit, log, http_api.V1),
+		topicParam, channelParam,
+		http_api.Query("id", "string", false, "only the records of a message"),
+		http_api.Query("since", "string", false, "only messages finished at or after this RFC3339 time"),
+		http_api.Query("limit", "integer", false, "maximum number of records (default 100, max 10000)"))
+	router.Route("POST", "/channel/seek", "move a channel to the messages published at or after a time, back within --retention or forward", http_api.Decorate(s.doSeekChannel, adminLimit, log, http_api.V1),
+		topicParam, channelParam, http_api.Query("to", "string", true, "RFC3339 time, not in the future"))
+	router.Route("GET", "/channel/quarantine", "the messages recently moved to a channel's <channel>#quarantine channel", http_api.Decorate(s.doChannelQuarantine, adminLimit, log, http_api.V1), topicParam, channelParam)
+	router.Route("POST", "/channel/redrive", "move the messages queued in a channel's <channel>#quarantine channel back to it", http_api.Decorate(s.doRedriveChannel, adminLimit, log, http_api.V1), topicParam, channelParam)
+	router.Route("POST", "/channel/delete", "delete a channel", http_api.Decorate(s.doDeleteChannel, adminLimit, log, http_api.V1), topicParam, channelParam)
+	router.Route("POST", "/channel/empty", "empty a channel", http_api.Decorate(s.doEmptyChannel, adminLimit, log, http_api.V1), topicParam, channelParam)
+	router.Route("POST", "/channel/pause", "pause a channel", http_api.Decorate(s.doPauseChannel, adminLimit, log, http_api.V1), topicParam, channelParam,
+		http_api.Query("duration", "string", false, "unpause the channel after this long, as a Go duration (e.g. 30m, default never), also across restarts"))
+	router.Route("POST", "/channel/unpause", "unpause a channel", http_api.Decorate(s.doPauseChannel, adminLimit, log, http_api.V1), topicParam, channelParam)
+	router.Route("GET", "/config/:opt", "get a runtime option", http_api.Decorate(s.doConfig, adminLimit, log, http_api.V1), optParam)
+	router.Route("PUT", "/config/:opt", "set a runtime option", http_api.Decorate(s.doConfig, adminLimit, log, http_api.V1),
+		optParam, http_api.Body("object", "JSON encoded option value"))
+	router.Route("POST", "/backup", "snapshot metadata and diskqueues to a directory (or as a tar stream)", http_api.Decorate(s.doBackup, adminLimit, log, http_api.V1),
+		http_api.Query("dir", "string", false, "empty directory, relative to --backup-dir, to write the snapshot to on the nsqd host (default: respond with a tar archive)"))
+	router.Route("GET", "/metadata/export", "topic and channel definitions (pause state and settings)", http_api.Decorate(s.doExportMetadata, adminLimit, log, http_api.V1))
+	router.Route("POST", "/metadata/import", "create topics and channels and apply their pause state and settings", http_api.Decorate(s.doImportMetadata, adminLimit, log, http_api.V1),
+		http_api.Body("object", "topic and channel definitions as returned by /metadata/export"))
 
 	// debug
-	router.HandlerFunc("GET", "/debug/pprof/", pprof.Index)
-	router.HandlerFunc("GET", "/debug/pprof/cmdline", pprof.Cmdline)
-	router.HandlerFunc("GET", "/debug/pprof/symbol", pprof.Symbol)
-	router.HandlerFunc("POST", "/debug/pprof/symbol", pprof.Symbol)
-	router.HandlerFunc("GET", "/debug/pprof/profile", pprof.Profile)
-	router.Handler("GET", "/debug/pprof/heap", pprof.Handler("heap"))
-	router.Handler("GET", "/debug/pprof/goroutine", pprof.Handler("goroutine"))
-	router.Handler("GET", "/debug/pprof/block", pprof.Handler("block"))
-	router.Handle("PUT", "/debug/setblockrate", http_api.Decorate(setBlockRateHandler, log, http_api.PlainText))
-	router.Handler("GET", "/debug/pprof/threadcreate", pprof.Handler("threadcreate"))
+	router.RouteHandler("GET", "/debug/pprof/", "pprof index", http_api.RateLimitHandler(http.HandlerFunc(pprof.Index), limits.admin, limits.global))
+	router.RouteHandler("GET", "/debug/pprof/cmdline", "pprof command line", http_api.RateLimitHandler(http.HandlerFunc(pprof.Cmdline), limits.admin, limits.global))
+	router.RouteHandler("GET", "/debug/pprof/symbol", "pprof symbol lookup", http_api.RateLimitHandler(http.HandlerFunc(pprof.Symbol), limits.admin, limits.global))
+	router.RouteHandler("POST", "/debug/pprof/symbol", "pprof symbol lookup", http_api.RateLimitHandler(http.HandlerFunc(pprof.Symbol), limits.admin, limits.global))
+	router.RouteHandler("GET", "/debug/pprof/profile", "pprof CPU profile", http_api.RateLimitHandler(http.HandlerFunc(pprof.Profile), limits.admin, limits.global),
+		http_api.Query("seconds", "integer", false, "profile duration"))
+	router.RouteHandler("GET", "/debug/pprof/heap", "pprof heap profile", http_api.RateLimitHandler(pprof.Handler("heap"), limits.admin, limits.global))
+	router.RouteHandler("GET", "/debug/pprof/goroutine", "pprof goroutine profile", http_api.RateLimitHandler(pprof.Handler("goroutine"), limits.admin, limits.global))
+	router.RouteHandler("GET", "/debug/pprof/block", "pprof block profile", http_api.RateLimitHandler(pprof.Handler("block"), limits.admin, limits.global))
+	router.Route("PUT", "/debug/setblockrate", "set the block profile rate", http_api.Decorate(setBlockRateHandler, adminLimit, log, http_api.PlainText),
+		http_api.Query("rate", "integer", true, "block profile rate"))
+	router.RouteHandler("GET", "/debug/pprof/threadcreate", "pprof thread creation profile", http_api.RateLimitHandler(pprof.Handler("threadcreate"), limits.admin, limits.global))
+	router.RouteHandler("GET", "/debug/pprof/mutex", "pprof mutex profile", http_api.RateLimitHandler(pprof.Handler("mutex"), limits.admin, limits.global))
+	router.Route("PUT", "/debug/setmutexfraction", "set the mutex profile fraction", http_api.Decorate(setMutexFractionHandler, adminLimit, log, http_api.PlainText),
+		http_api.Query("rate", "integer", true, "mutex profile fraction (1/rate of contention events are reported)"))
+	router.Route("POST", "/debug/dump", "write goroutine, heap, mutex and block profiles and the state of nsqd to a new timestamped directory, for post-incident analysis", http_api.Decorate(s.doDump, adminLimit, log, http_api.V1),
+		http_api.Query("dir", "string", false, "existing directory, relative to --data-path, to create the dump directory in (default --data-path)"))
+	router.Route("POST", "/debug/loadgen", "publish synthesized messages to a topic from within nsqd, to test its capacity without clients or the network (requires --loadgen)", http_api.Decorate(s.doLoadgen, adminLimit, log, http_api.V1),
+		topicParam,
+		http_api.Query("rate", "integer", false, "messages per second (default 0, i.e., as fast as possible)"),
+		http_api.Query("size", "integer", false, "message size in bytes (default 100)"),
+		http_api.Query("duration", "string", false, "how long to publish for, responding when done (default 10s, max 1h)"))
+	router.Route("GET", "/debug/faults", "faults injected for resilience tests (requires nsqd built with -tags faults)", http_api.Decorate(s.doFaults, adminLimit, log, http_api.V1))
+	router.Route("PUT", "/debug/faults", "inject a fault: fsync_delay, partial_write, drop_frame or lookupd_delay (requires nsqd built with -tags faults)", http_api.Decorate(s.doSetFault, adminLimit, log, http_api.V1),
+		http_api.Query("name", "string", true, "fault name"),
+		http_api.Query("delay", "string", false, "delay of fsync_delay and lookupd_delay"),
+		http_api.Query("skip", "integer", false, "times the fault is reached before it's injected (default 0)"),
+		http_api.Query("count", "integer", false, "times the fault is injected (default 0, i.e., every time)"))
+	router.Route("DELETE", "/debug/faults", "stop injecting a fault, or all faults (requires nsqd built with -tags faults)", http_api.Decorate(s.doClearFaults, adminLimit, log, http_api.V1),
+		http_api.Query("name", "string", false, "fault name (default: all)"))
 
 	return s
 }
@@ -99,14 +248,109 @@ func setBlockRateHandler(w http.ResponseWriter, req *http.Request, ps httprouter
 	return nil, nil
 }
 
+func setMutexFractionHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	rate, err := strconv.Atoi(req.FormValue("rate"))
+	if err != nil {
+		return nil, http_api.Err{http.StatusBadRequest, fmt.Sprintf("invalid mutex profile fraction : %s", err.Error())}
+	}
+	runtime.SetMutexProfileFraction(rate)
+	return nil, nil
+}
+
+func (s *httpServer) doDump(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	dir, _ := reqParams.Get("dir")
+	dir, ok := confineDir(s.ctx.nsqd.getOpts().DataPath, dir)
+	if !ok {
+		return nil, http_api.Err{400, "INVALID_ARG_DIR"}
+	}
+	dumpDir, err := s.ctx.nsqd.Dump(dir)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to dump to %s - %s", dir, err)
+		return nil, http_api.Err{500, "DUMP_FAILED: " + err.Error()}
+	}
+	return struct {
+		Dir string `json:"dir"`
+	}{dumpDir}, nil
+}
+
+func (s *httpServer) doLoadgen(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if !s.ctx.nsqd.getOpts().LoadgenEnabled {
+		return nil, http_api.Err{403, "LOADGEN_DISABLED"}
+	}
+
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	var rate int64
+	if v := reqParams.Get("rate"); v != "" {
+		rate, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || rate < 0 {
+			return nil, http_api.Err{400, "INVALID_RATE"}
+		}
+	}
+	size := 100
+	if v := reqParams.Get("size"); v != "" {
+		size, err = strconv.Atoi(v)
+		if err != nil || size < 1 || int64(size) > s.ctx.nsqd.getOpts().MaxMsgSize {
+			return nil, http_api.Err{400, "INVALID_SIZE"}
+		}
+	}
+	duration := 10 * time.Second
+	if v := reqParams.Get("duration"); v != "" {
+		duration, err = time.ParseDuration(v)
+		if err != nil || duration <= 0 || duration > time.Hour {
+			return nil, http_api.Err{400, "INVALID_DURATION"}
+		}
+	}
+
+	_, topic, err := s.getTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// stop early if the client goes away or nsqd exits
+	stopChan := make(chan struct{})
+	doneChan := make(chan struct{})
+	defer close(doneChan)
+	go func() {
+		select {
+		case <-req.Context().Done():
+		case <-s.ctx.nsqd.exitChan:
+		case <-doneChan:
+			return
+		}
+		close(stopChan)
+	}()
+
+	s.ctx.nsqd.logf(LOG_INFO, "LOADGEN: publishing %d byte messages to %s at %d/s for %s",
+		size, topic.name, rate, duration)
+	result := loadgen(topic, rate, size, duration, stopChan)
+	s.ctx.nsqd.logf(LOG_INFO, "LOADGEN: published %d messages to %s at %.0f/s",
+		result.Published, topic.name, result.Rate)
+	return result, nil
+}
+
 func (s *httpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if !s.tlsEnabled && s.tlsRequired {
-		resp := fmt.Sprintf(`{"message": "TLS_REQUIRED", "https_port": %d}`,
-			s.ctx.nsqd.RealHTTPSAddr().Port)
+		resp, _ := json.Marshal(struct {
+			http_api.ErrorResponse
+			HTTPSPort int `json:"https_port"`
+		}{
+			http_api.NewErrorResponse(403, "TLS_REQUIRED"),
+			s.ctx.nsqd.RealHTTPSAddr().Port,
+		})
 		w.Header().Set("X-NSQ-Content-Type", "nsq; version=1.0")
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		w.WriteHeader(403)
-		io.WriteString(w, resp)
+		w.Write(resp)
 		return
 	}
 	s.router.ServeHTTP(w, req)
@@ -120,25 +364,51 @@ func (s *httpServer) pingHandler(w http.ResponseWriter, req *http.Request, ps ht
 	return health, nil
 }
 
+// healthHandler responds like pingHandler, or with each check as JSON with
+// verbose=true, with a 500 status when a check failed
+func (s *httpServer) healthHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	health := s.ctx.nsqd.CheckHealth()
+	code := 200
+	if health.Status == HealthFail {
+		code = 500
+	}
+
+	if boolParams[req.URL.Query().Get("verbose")] {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(health)
+		return nil, nil
+	}
+	w.WriteHeader(code)
+	io.WriteString(w, health.String())
+	return nil, nil
+}
+
 func (s *httpServer) doInfo(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	hostname, err := os.Hostname()
 	if err != nil {
 		return nil, http_api.Err{500, err.Error()}
 	}
 	return struct {
-		Version          string `json:"version"`
-		BroadcastAddress string `json:"broadcast_address"`
-		Hostname         string `json:"hostname"`
-		HTTPPort         int    `json:"http_port"`
-		TCPPort          int    `json:"tcp_port"`
-		StartTime        int64  `json:"start_time"`
+		Version               string `json:"version"`
+		BroadcastAddress      string `json:"broadcast_address"`
+		Hostname              string `json:"hostname"`
+		HTTPPort              int    `json:"http_port"`
+		TCPPort               int    `json:"tcp_port"`
+		BroadcastTCPAddress   string `json:"broadcast_tcp_address"`
+		BroadcastHTTPAddress  string `json:"broadcast_http_address"`
+		BroadcastHTTPSAddress string `json:"broadcast_https_address,omitempty"`
+		StartTime             int64  `json:"start_time"`
 	}{
-		Version:          version.Binary,
-		BroadcastAddress: s.ctx.nsqd.getOpts().BroadcastAddress,
-		Hostname:         hostname,
-		TCPPort:          s.ctx.nsqd.RealTCPAddr().Port,
-		HTTPPort:         s.ctx.nsqd.RealHTTPAddr().Port,
-		StartTime:        s.ctx.nsqd.GetStartTime().Unix(),
+		Version:               version.Binary,
+		BroadcastAddress:      s.ctx.nsqd.getOpts().BroadcastAddress,
+		Hostname:              hostname,
+		TCPPort:               broadcastPort(s.ctx.nsqd.broadcastTCPAddress()),
+		HTTPPort:              broadcastPort(s.ctx.nsqd.broadcastHTTPAddress()),
+		BroadcastTCPAddress:   s.ctx.nsqd.broadcastTCPAddress(),
+		BroadcastHTTPAddress:  s.ctx.nsqd.broadcastHTTPAddress(),
+		BroadcastHTTPSAddress: s.ctx.nsqd.broadcastHTTPSAddress(),
+		StartTime:             s.ctx.nsqd.GetStartTime().Unix(),
 	}, nil
 }
 
@@ -179,9 +449,35 @@ func (s *httpServer) getTopicFromQuery(req *http.Request) (url.Values, *Topic, e
 		return nil, nil, http_api.Err{400, "INVALID_TOPIC"}
 	}
 
+	if _, err := s.ctx.nsqd.GetExistingTopic(topicName); err != nil {
+		if err := s.ctx.nsqd.namePolicy.checkTopic(topicName); err != nil {
+			return nil, nil, http_api.Err{400, "INVALID_TOPIC"}
+		}
+	}
+
+	if err := s.ctx.nsqd.checkNamespaceTopicLimit(topicName); err != nil {
+		return nil, nil, http_api.Err{403, "NAMESPACE_QUOTA_EXCEEDED"}
+	}
+
 	return reqParams, s.ctx.nsqd.GetTopic(topicName), nil
 }
 
+// isPublisherAllowed returns whether the request may publish to topic, which
+// over HTTP requires the common name of an HTTPS client certificate to be
+// one of the topic's publishers (if it has any)
+func (s *httpServer) isPublisherAllowed(req *http.Request, topic *Topic) bool {
+	return topic.IsPublisherAllowed(requestCommonName(req))
+}
+
+// requestCommonName returns the TLS certificate common name of the client of
+// req (empty if none)
+func requestCommonName(req *http.Request) string {
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		return req.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	return ""
+}
+
 func (s *httpServer) doPUB(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	// TODO: one day I'd really like to just error on chunked requests
 	// to be able to fail "too big" requests before we even read
@@ -222,12 +518,57 @@ func (s *httpServer) doPUB(w http.ResponseWriter, req *http.Request, ps httprout
 		}
 	}
 
+	key, err := getKeyFromQuery(reqParams)
+	if err != nil {
+		return nil, err
+	}
+	eventTimestamp, err := getEventTimestampFromQuery(reqParams)
+	if err != nil {
+		return nil, err
+	}
+	async, err := s.getAsyncFromQuery(reqParams)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.isPublisherAllowed(req, topic) {
+		return nil, http_api.Err{403, "PUBLISHER_NOT_ALLOWED"}
+	}
+
+	if err := s.ctx.nsqd.checkNamespacePublish(topic.name, 1); err != nil {
+		return nil, http_api.Err{429, "NAMESPACE_QUOTA_EXCEEDED"}
+	}
+
 	msg := NewMessage(topic.GenerateID(), body)
+	if err := s.setMessageID(msg, reqParams); err != nil {
+		return nil, err
+	}
+	msg.Producer = req.RemoteAddr
+	msg.Key = key
+	msg.EventTimestamp = eventTimestamp
 	msg.deferred = deferred
+	err = s.recordHops(msg, reqParams, req.RemoteAddr)
+	if err == ErrHopLoop {
+		topic.countLoopDrops(1)
+		return "OK", nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if async {
+		return s.publishAsync(topic, msg, publisherName("", requestCommonName(req), req.RemoteAddr))
+	}
 	err = topic.PutMessage(msg)
+	if err == ErrDiskQuotaExceeded {
+		return nil, http_api.Err{507, "DISK_QUOTA_EXCEEDED"}
+	}
+	if err == ErrTopicDraining {
+		return nil, http_api.Err{409, "TOPIC_DRAINING"}
+	}
 	if err != nil {
 		return nil, http_api.Err{503, "EXITING"}
 	}
+	topic.countPublished(publisherName("", requestCommonName(req), req.RemoteAddr), 1)
 
 	return "OK", nil
 }
@@ -243,82 +584,1077 @@ func (s *httpServer) doMPUB(w http.ResponseWriter, req *http.Request, ps httprou
 		return nil, http_api.Err{413, "BODY_TOO_BIG"}
 	}
 
-	reqParams, topic, err := s.getTopicFromQuery(req)
-	if err != nil {
-		return nil, err
+	reqParams, topic, err := s.getTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := getKeyFromQuery(reqParams)
+	if err != nil {
+		return nil, err
+	}
+	eventTimestamp, err := getEventTimestampFromQuery(reqParams)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.isPublisherAllowed(req, topic) {
+		return nil, http_api.Err{403, "PUBLISHER_NOT_ALLOWED"}
+	}
+
+	// text mode is default, but unrecognized binary opt considered true
+	binaryMode := false
+	if vals, ok := reqParams["binary"]; ok {
+		if binaryMode, ok = boolParams[vals[0]]; !ok {
+			binaryMode = true
+			s.ctx.nsqd.logf(LOG_WARN, "deprecated value '%s' used for /mpub binary param", vals[0])
+		}
+	}
+	if binaryMode {
+		tmp := make([]byte, 4)
+		msgs, err = readMPUB(req.Body, tmp, topic,
+			s.ctx.nsqd.getOpts().MaxMsgSize, s.ctx.nsqd.getOpts().MaxBodySize)
+		if err != nil {
+			e := err.(*protocol.FatalClientErr)
+			return nil, http_api.Err{413, fmt.Sprintf("%s: %s", e.Code[2:], e.Desc)}
+		}
+		for _, msg := range msgs {
+			msg.Producer = req.RemoteAddr
+		}
+	} else {
+		// add 1 so that it's greater than our max when we test for it
+		// (LimitReader returns a "fake" EOF)
+		readMax := s.ctx.nsqd.getOpts().MaxBodySize + 1
+		rdr := bufio.NewReader(io.LimitReader(req.Body, readMax))
+		total := 0
+		for !exit {
+			var block []byte
+			block, err = rdr.ReadBytes('\n')
+			if err != nil {
+				if err != io.EOF {
+					return nil, http_api.Err{500, "INTERNAL_ERROR"}
+				}
+				exit = true
+			}
+			total += len(block)
+			if int64(total) == readMax {
+				return nil, http_api.Err{413, "BODY_TOO_BIG"}
+			}
+
+			if len(block) > 0 && block[len(block)-1] == '\n' {
+				block = block[:len(block)-1]
+			}
+
+			// silently discard 0 length messages
+			// this maintains the behavior pre 0.2.22
+			if len(block) == 0 {
+				continue
+			}
+
+			if int64(len(block)) > s.ctx.nsqd.getOpts().MaxMsgSize {
+				return nil, http_api.Err{413, "MSG_TOO_BIG"}
+			}
+
+			msg := NewMessage(topic.GenerateID(), block)
+			msg.Producer = req.RemoteAddr
+			msgs = append(msgs, msg)
+		}
+	}
+
+	// with --msg-id-generator=producer messages start with their IDs
+	if s.ctx.nsqd.msgIDPolicy.producerIDs() {
+		if err := s.ctx.nsqd.msgIDPolicy.takeIDs(msgs); err != nil {
+			return nil, http_api.Err{400, "INVALID_MSG_ID"}
+		}
+	}
+	for _, msg := range msgs {
+		msg.Key = key
+		msg.EventTimestamp = eventTimestamp
+		err = s.recordHops(msg, reqParams, req.RemoteAddr)
+		if err == ErrHopLoop {
+			// all messages have the same hops
+			topic.countLoopDrops(uint64(len(msgs)))
+			return "OK", nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.ctx.nsqd.checkNamespacePublish(topic.name, len(msgs)); err != nil {
+		return nil, http_api.Err{429, "NAMESPACE_QUOTA_EXCEEDED"}
+	}
+
+	err = topic.PutMessages(msgs)
+	if err == ErrDiskQuotaExceeded {
+		return nil, http_api.Err{507, "DISK_QUOTA_EXCEEDED"}
+	}
+	if err == ErrTopicDraining {
+		return nil, http_api.Err{409, "TOPIC_DRAINING"}
+	}
+	if err != nil {
+		return nil, http_api.Err{503, "EXITING"}
+	}
+	topic.countPublished(publisherName("", requestCommonName(req), req.RemoteAddr), uint64(len(msgs)))
+
+	return "OK", nil
+}
+
+// doPUBStream publishes each line of the request body as a JSON message, as it
+// is read, and answers it with a line of JSON (its line number and status, and
+// its error code and message if it failed) so that producers can pipeline
+// messages on a single connection. Blank lines are skipped.
+func (s *httpServer) doPUBStream(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, err := s.getTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	key, err := getKeyFromQuery(reqParams)
+	if err != nil {
+		return nil, err
+	}
+	eventTimestamp, err := getEventTimestampFromQuery(reqParams)
+	if err != nil {
+		return nil, err
+	}
+	async, err := s.getAsyncFromQuery(reqParams)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.isPublisherAllowed(req, topic) {
+		return nil, http_api.Err{403, "PUBLISHER_NOT_ALLOWED"}
+	}
+
+	publisher := publisherName("", requestCommonName(req), req.RemoteAddr)
+	publish := func(line []byte) error {
+		msg := NewMessage(topic.GenerateID(), line)
+		// with --msg-id-generator=producer lines start with their IDs
+		if s.ctx.nsqd.msgIDPolicy.producerIDs() {
+			if err := s.ctx.nsqd.msgIDPolicy.takeIDs([]*Message{msg}); err != nil {
+				return http_api.Err{400, "INVALID_MSG_ID"}
+			}
+		}
+		if !json.Valid(msg.Body) {
+			return http_api.Err{400, "BAD_MESSAGE"}
+		}
+		if err := s.ctx.nsqd.checkNamespacePublish(topic.name, 1); err != nil {
+			return http_api.Err{429, "NAMESPACE_QUOTA_EXCEEDED"}
+		}
+		msg.Producer = req.RemoteAddr
+		msg.Key = key
+		msg.EventTimestamp = eventTimestamp
+		err := s.recordHops(msg, reqParams, req.RemoteAddr)
+		if err == ErrHopLoop {
+			topic.countLoopDrops(1)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if async {
+			_, err = s.publishAsync(topic, msg, publisher)
+			return err
+		}
+		err = topic.PutMessage(msg)
+		if err == ErrDiskQuotaExceeded {
+			return http_api.Err{507, "DISK_QUOTA_EXCEEDED"}
+		}
+		if err == ErrTopicDraining {
+			return http_api.Err{409, "TOPIC_DRAINING"}
+		}
+		if err != nil {
+			return http_api.Err{503, "EXITING"}
+		}
+		topic.countPublished(publisher, 1)
+		return nil
+	}
+
+	// HTTP/1.x answers are written while the body is read, HTTP/2 is full
+	// duplex anyway
+	rc := http.NewResponseController(w)
+	rc.EnableFullDuplex()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	return http_api.StreamFunc(func(io.Writer) {
+		r := bufio.NewReader(req.Body)
+		bw := bufio.NewWriter(w)
+		enc := json.NewEncoder(bw)
+		for lineNum := 1; ; lineNum++ {
+			line, tooBig, err := readStreamLine(r, s.ctx.nsqd.getOpts().MaxMsgSize)
+			if len(line) > 0 || tooBig {
+				ack := pubStreamAck{Line: lineNum, Status: 200}
+				var pubErr error
+				if tooBig {
+					pubErr = http_api.Err{413, "MSG_TOO_BIG"}
+				} else {
+					pubErr = publish(line)
+				}
+				if pubErr != nil {
+					e := pubErr.(http_api.Err)
+					resp := http_api.NewErrorResponse(e.Code, e.Text)
+					ack = pubStreamAck{lineNum, e.Code, resp.Code, resp.Message, resp.Description}
+				}
+				enc.Encode(ack)
+			}
+			if err != nil {
+				if err != io.EOF {
+					s.ctx.nsqd.logf(LOG_ERROR, "TOPIC(%s): failed to read /pub/stream body from %s - %s",
+						topic.name, req.RemoteAddr, err)
+				}
+				break
+			}
+			// answer what was read when waiting for more
+			if r.Buffered() == 0 {
+				bw.Flush()
+				rc.Flush()
+			}
+		}
+		bw.Flush()
+	}), nil
+}
+
+// pubStreamAck is the answer to a line of /pub/stream
+type pubStreamAck struct {
+	Line        int    `json:"line"`
+	Status      int    `json:"status"`
+	Code        string `json:"code,omitempty"`
+	Message     string `json:"message,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// readStreamLine reads a line (without its line ending) of at most max bytes,
+// or reports that it's longer and skips it
+func readStreamLine(r *bufio.Reader, max int64) ([]byte, bool, error) {
+	var line []byte
+	tooBig := false
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if !tooBig {
+			line = append(line, chunk...)
+			line = bytes.TrimRight(line, "\r\n")
+			if int64(len(line)) > max {
+				line, tooBig = nil, true
+			}
+		}
+		if err != bufio.ErrBufferFull {
+			return line, tooBig, err
+		}
+	}
+}
+
+// getAsyncFromQuery returns the optional async param of publishes, refused
+// with --async-pub-buffer-size=0
+func (s *httpServer) getAsyncFromQuery(reqParams url.Values) (bool, error) {
+	vals, ok := reqParams["async"]
+	if !ok {
+		return false, nil
+	}
+	async, ok := boolParams[vals[0]]
+	if !ok {
+		return false, http_api.Err{400, "INVALID_ARG_ASYNC"}
+	}
+	if async && s.ctx.nsqd.asyncPublisher == nil {
+		return false, http_api.Err{400, "ASYNC_NOT_ALLOWED"}
+	}
+	return async, nil
+}
+
+// publishAsync hands msg over to be put in topic after answering, see
+// asyncPublisher
+func (s *httpServer) publishAsync(topic *Topic, msg *Message, publisher string) (interface{}, error) {
+	err := s.ctx.nsqd.asyncPublisher.publish(topic, msg, publisher)
+	if err == ErrAsyncPubFull {
+		return nil, http_api.Err{503, "ASYNC_BUFFER_FULL"}
+	}
+	if err != nil {
+		return nil, http_api.Err{503, "EXITING"}
+	}
+	return "OK", nil
+}
+
+// getKeyFromQuery returns the optional routing key of published messages
+// setMessageID sets the ID of msg to the id param, which producers must supply
+// with --msg-id-generator=producer (and only then)
+func (s *httpServer) setMessageID(msg *Message, reqParams url.Values) error {
+	vals, ok := reqParams["id"]
+	if !s.ctx.nsqd.msgIDPolicy.producerIDs() {
+		if ok {
+			return http_api.Err{400, "MSG_ID_NOT_ALLOWED"}
+		}
+		return nil
+	}
+	if !ok {
+		return http_api.Err{400, "MISSING_ARG_ID"}
+	}
+	if err := s.ctx.nsqd.msgIDPolicy.check([]byte(vals[0])); err != nil {
+		return http_api.Err{400, "INVALID_MSG_ID"}
+	}
+	copy(msg.ID[:], vals[0])
+	return nil
+}
+
+func getKeyFromQuery(reqParams url.Values) (string, error) {
+	vals, ok := reqParams["key"]
+	if !ok {
+		return "", nil
+	}
+	if len(vals[0]) == 0 || len(vals[0]) > MaxKeyLength {
+		return "", http_api.Err{400, "INVALID_KEY"}
+	}
+	return vals[0], nil
+}
+
+// getEventTimestampFromQuery returns the optional event_timestamp param (0 if
+// not given), see Message.EventTimestamp
+func getEventTimestampFromQuery(reqParams url.Values) (int64, error) {
+	vals, ok := reqParams["event_timestamp"]
+	if !ok {
+		return 0, nil
+	}
+	ts, err := strconv.ParseInt(vals[0], 10, 64)
+	if err != nil || ts <= 0 {
+		return 0, http_api.Err{400, "INVALID_EVENT_TIMESTAMP"}
+	}
+	return ts, nil
+}
+
+// recordHops records the hops of msg with --record-hops, after the optional
+// hops param. It returns ErrHopLoop when msg already transited this cluster, it
+// must then be dropped without failing the request.
+func (s *httpServer) recordHops(msg *Message, reqParams url.Values, producer string) error {
+	vals, ok := reqParams["hops"]
+	if !s.ctx.nsqd.getOpts().RecordHops {
+		if ok {
+			return http_api.Err{400, "HOPS_NOT_ALLOWED"}
+		}
+		return nil
+	}
+	var hops string
+	if ok {
+		hops = vals[0]
+	}
+	err := s.ctx.nsqd.recordHop(msg, hops, producer)
+	if err == ErrHopLoop {
+		return err
+	}
+	if err != nil {
+		return http_api.Err{400, "INVALID_HOPS"}
+	}
+	return nil
+}
+
+func (s *httpServer) doCreateTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, err := s.getTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	return nil, s.setTopicConfig(topic, reqParams)
+}
+
+func (s *httpServer) doTopicConfig(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+
+	topic, err := s.ctx.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		return nil, http_api.Err{404, "TOPIC_NOT_FOUND"}
+	}
+
+	if req.Method == "POST" {
+		err = s.setTopicConfig(topic, reqParams.Values)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	memQueueSize, _ := topic.MemQueueSize()
+	maxDiskBytes, diskQuotaPolicy := topic.DiskQuota()
+	channelOverflow, channelMaxDepth, channelMaxDiskBytes := topic.ChannelOverflow()
+	publishers := topic.Publishers()
+	idleTimeout := topic.IdleTimeout()
+	if idleTimeout == 0 {
+		idleTimeout = s.ctx.nsqd.getOpts().TopicIdleTimeout
+	}
+	topic.RLock()
+	syncPolicy := topic.diskqueueSyncPolicy()
+	compression := topic.diskqueueCompression()
+	ephemeralBufferSize := topic.effectiveEphemeralBufferSize()
+	topic.RUnlock()
+	return struct {
+		MemQueueSize        int64    `json:"mem_queue_size"`
+		Durable             bool     `json:"durable"`
+		SyncEvery           int64    `json:"sync_every"`
+		SyncTimeout         string   `json:"sync_timeout"`
+		Compression         string   `json:"compression"`
+		MaxDiskBytes        int64    `json:"max_disk_bytes"`
+		DiskQuotaPolicy     string   `json:"disk_quota_policy"`
+		ChannelOverflow     string   `json:"channel_overflow"`
+		ChannelMaxDepth     int64    `json:"channel_max_depth"`
+		ChannelMaxDiskBytes int64    `json:"channel_max_disk_bytes"`
+		Publishers          []string `json:"publishers,omitempty"`
+		IdleTimeout         string   `json:"idle_timeout"`
+		EphemeralBufferSize int64    `json:"ephemeral_buffer_size"`
+	}{memQueueSize, topic.IsDurable(), syncPolicy.Every, syncPolicy.Timeout.String(), compression,
+		maxDiskBytes, diskQuotaPolicy, channelOverflow, channelMaxDepth, channelMaxDiskBytes, publishers,
+		idleTimeout.String(), ephemeralBufferSize}, nil
+}
+
+// setTopicConfig applies the topic settings present in reqParams
+func (s *httpServer) setTopicConfig(topic *Topic, reqParams url.Values) error {
+	changed, err := applyTopicConfig(topic, reqParams)
+	if err != nil || !changed {
+		return err
+	}
+	s.ctx.nsqd.Lock()
+	s.ctx.nsqd.PersistMetadata()
+	s.ctx.nsqd.Unlock()
+	return nil
+}
+
+// topicConfigKeys are the settings applyTopicConfig understands
+var topicConfigKeys = []string{"mem_queue_size", "durable", "sync", "sync_every", "sync_timeout", "compression",
+	"max_disk_bytes", "disk_quota_policy", "channel_overflow", "channel_max_depth", "channel_max_disk_bytes",
+	"publishers", "idle_timeout", "ephemeral_buffer_size"}
+
+// applyTopicConfig applies the topic settings present in reqParams, returning
+// whether any were
+func applyTopicConfig(topic *Topic, reqParams url.Values) (bool, error) {
+	changed := false
+
+	if v, ok := reqParams["mem_queue_size"]; ok {
+		memQueueSize, err := strconv.ParseInt(v[0], 10, 64)
+		if err != nil {
+			return false, http_api.Err{400, "INVALID_ARG_MEM_QUEUE_SIZE"}
+		}
+		err = topic.SetMemQueueSize(memQueueSize)
+		if err != nil {
+			return false, http_api.Err{503, "EXITING"}
+		}
+		changed = true
+	}
+
+	if v, ok := reqParams["durable"]; ok {
+		durable, err := strconv.ParseBool(v[0])
+		if err != nil {
+			return false, http_api.Err{400, "INVALID_ARG_DURABLE"}
+		}
+		err = topic.SetDurable(durable)
+		if err != nil {
+			return false, http_api.Err{400, "INVALID_ARG_DURABLE: " + err.Error()}
+		}
+		changed = true
+	}
+
+	_, hasSync := reqParams["sync"]
+	_, hasSyncEvery := reqParams["sync_every"]
+	_, hasSyncTimeout := reqParams["sync_timeout"]
+	if hasSync || hasSyncEvery || hasSyncTimeout {
+		syncEvery, syncTimeout := topic.SyncPolicy()
+		switch reqParams.Get("sync") {
+		case "":
+		case "always":
+			syncEvery = 1
+		case "default":
+			syncEvery, syncTimeout = 0, 0
+		default:
+			return false, http_api.Err{400, "INVALID_ARG_SYNC"}
+		}
+		if hasSyncEvery {
+			v, err := strconv.ParseInt(reqParams.Get("sync_every"), 10, 64)
+			if err != nil || v < 0 {
+				return false, http_api.Err{400, "INVALID_ARG_SYNC_EVERY"}
+			}
+			syncEvery = v
+		}
+		if hasSyncTimeout {
+			v, err := time.ParseDuration(reqParams.Get("sync_timeout"))
+			if err != nil || v < 0 {
+				return false, http_api.Err{400, "INVALID_ARG_SYNC_TIMEOUT"}
+			}
+			syncTimeout = v
+		}
+		topic.SetSyncPolicy(syncEvery, syncTimeout)
+		changed = true
+	}
+
+	if v, ok := reqParams["compression"]; ok {
+		compression := v[0]
+		if compression == "default" {
+			compression = ""
+		}
+		err := topic.SetCompression(compression)
+		if err != nil {
+			return false, http_api.Err{400, "INVALID_ARG_COMPRESSION"}
+		}
+		changed = true
+	}
+
+	_, hasMaxDiskBytes := reqParams["max_disk_bytes"]
+	_, hasDiskQuotaPolicy := reqParams["disk_quota_policy"]
+	if hasMaxDiskBytes || hasDiskQuotaPolicy {
+		maxDiskBytes, diskQuotaPolicy := topic.DiskQuota()
+		if hasMaxDiskBytes {
+			v, err := strconv.ParseInt(reqParams.Get("max_disk_bytes"), 10, 64)
+			if err != nil || v < 0 {
+				return false, http_api.Err{400, "INVALID_ARG_MAX_DISK_BYTES"}
+			}
+			maxDiskBytes = v
+		}
+		if hasDiskQuotaPolicy {
+			diskQuotaPolicy = reqParams.Get("disk_quota_policy")
+		}
+		err := topic.SetDiskQuota(maxDiskBytes, diskQuotaPolicy)
+		if err != nil {
+			return false, http_api.Err{400, "INVALID_ARG_DISK_QUOTA"}
+		}
+		changed = true
+	}
+
+	_, hasChannelOverflow := reqParams["channel_overflow"]
+	_, hasChannelMaxDepth := reqParams["channel_max_depth"]
+	_, hasChannelMaxDiskBytes := reqParams["channel_max_disk_bytes"]
+	if hasChannelOverflow || hasChannelMaxDepth || hasChannelMaxDiskBytes {
+		policy, maxDepth, maxDiskBytes := topic.ChannelOverflow()
+		if hasChannelOverflow {
+			policy = reqParams.Get("channel_overflow")
+		}
+		if hasChannelMaxDepth {
+			v, err := strconv.ParseInt(reqParams.Get("channel_max_depth"), 10, 64)
+			if err != nil || v < 0 {
+				return false, http_api.Err{400, "INVALID_ARG_CHANNEL_MAX_DEPTH"}
+			}
+			maxDepth = v
+		}
+		if hasChannelMaxDiskBytes {
+			v, err := strconv.ParseInt(reqParams.Get("channel_max_disk_bytes"), 10, 64)
+			if err != nil || v < 0 {
+				return false, http_api.Err{400, "INVALID_ARG_CHANNEL_MAX_DISK_BYTES"}
+			}
+			maxDiskBytes = v
+		}
+		err := topic.SetChannelOverflow(policy, maxDepth, maxDiskBytes)
+		if err != nil {
+			return false, http_api.Err{400, "INVALID_ARG_CHANNEL_OVERFLOW: " + err.Error()}
+		}
+		changed = true
+	}
+
+	if v, ok := reqParams["idle_timeout"]; ok {
+		idleTimeout, err := time.ParseDuration(v[0])
+		if err != nil {
+			return false, http_api.Err{400, "INVALID_ARG_IDLE_TIMEOUT"}
+		}
+		topic.SetIdleTimeout(idleTimeout)
+		changed = true
+	}
+
+	if v, ok := reqParams["ephemeral_buffer_size"]; ok {
+		size, err := strconv.ParseInt(v[0], 10, 64)
+		if err != nil {
+			return false, http_api.Err{400, "INVALID_ARG_EPHEMERAL_BUFFER_SIZE"}
+		}
+		err = topic.SetEphemeralBufferSize(size)
+		if err != nil {
+			return false, http_api.Err{400, "INVALID_ARG_EPHEMERAL_BUFFER_SIZE"}
+		}
+		changed = true
+	}
+
+	if v, ok := reqParams["publishers"]; ok {
+		var publishers []string
+		if v[0] != "" {
+			publishers = strings.Split(v[0], ",")
+		}
+		err := topic.SetPublishers(publishers)
+		if err != nil {
+			return false, http_api.Err{400, "INVALID_ARG_PUBLISHERS"}
+		}
+		changed = true
+	}
+
+	return changed, nil
+}
+
+func (s *httpServer) doEmptyTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+
+	if !protocol.IsValidTopicName(topicName) {
+		return nil, http_api.Err{400, "INVALID_TOPIC"}
+	}
+
+	topic, err := s.ctx.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		return nil, http_api.Err{404, "TOPIC_NOT_FOUND"}
+	}
+
+	err = topic.Empty()
+	if err != nil {
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+
+	return nil, nil
+}
+
+func (s *httpServer) doDeleteTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+
+	drain := false
+	if v, err := reqParams.Get("drain"); err == nil {
+		drain, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_ARG_DRAIN"}
+		}
+	}
+	drainTimeout := defaultDrainTimeout
+	if v, err := reqParams.Get("drain_timeout"); err == nil {
+		drainTimeout, err = time.ParseDuration(v)
+		if err != nil || drainTimeout <= 0 {
+			return nil, http_api.Err{400, "INVALID_ARG_DRAIN_TIMEOUT"}
+		}
+	}
+
+	if req.Method == "POST" && !drain {
+		err = s.ctx.nsqd.DeleteExistingTopic(topicName)
+		if err != nil {
+			return nil, http_api.Err{404, "TOPIC_NOT_FOUND"}
+		}
+		return nil, nil
+	}
+
+	topic, err := s.ctx.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		return nil, http_api.Err{404, "TOPIC_NOT_FOUND"}
+	}
+	if req.Method == "POST" {
+		err = topic.DrainAndDelete(drainTimeout)
+		if err == ErrMigrationInProgress {
+			return nil, http_api.Err{409, "MIGRATION_IN_PROGRESS"}
+		}
+	}
+
+	stats, ok := topic.DrainStats()
+	if !ok {
+		return nil, http_api.Err{404, "DRAIN_NOT_FOUND"}
+	}
+	return stats, nil
+}
+
+func (s *httpServer) doRenameTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+	newName, err := reqParams.Get("to")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_TO"}
+	}
+	if !protocol.IsValidTopicName(newName) || strings.HasSuffix(newName, "#ephemeral") ||
+		s.ctx.nsqd.namePolicy.checkTopic(newName) != nil {
+		return nil, http_api.Err{400, "INVALID_ARG_TO"}
+	}
+
+	topic, err := s.ctx.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		return nil, http_api.Err{404, "TOPIC_NOT_FOUND"}
+	}
+	if topic.ephemeral {
+		return nil, http_api.Err{400, "INVALID_ARG_TOPIC"}
+	}
+	if err := s.ctx.nsqd.checkNamespaceTopicLimit(newName); err != nil {
+		return nil, http_api.Err{403, "NAMESPACE_QUOTA_EXCEEDED"}
+	}
+
+	err = s.ctx.nsqd.RenameTopic(topicName, newName)
+	switch err {
+	case nil:
+	case ErrTopicExists:
+		return nil, http_api.Err{409, "TOPIC_EXISTS"}
+	case ErrMigrationInProgress:
+		return nil, http_api.Err{409, "MIGRATION_IN_PROGRESS"}
+	case ErrTopicDraining:
+		return nil, http_api.Err{409, "TOPIC_DRAINING"}
+	default:
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+
+	return nil, nil
+}
+
+func (s *httpServer) doPauseTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+
+	topic, err := s.ctx.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		return nil, http_api.Err{404, "TOPIC_NOT_FOUND"}
+	}
+
+	if strings.Contains(req.URL.Path, "unpause") {
+		err = topic.UnPause()
+	} else {
+		err = topic.Pause()
+	}
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failure in %s - %s", req.URL.Path, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+
+	// pro-actively persist metadata so in case of process failure
+	// nsqd won't suddenly (un)pause a topic
+	s.ctx.nsqd.Lock()
+	s.ctx.nsqd.PersistMetadata()
+	s.ctx.nsqd.Unlock()
+	return nil, nil
+}
+
+func (s *httpServer) doMigrateTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+
+	topic, err := s.ctx.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		return nil, http_api.Err{404, "TOPIC_NOT_FOUND"}
+	}
+
+	if req.Method == "POST" {
+		target, err := reqParams.Get("target")
+		if err != nil {
+			return nil, http_api.Err{400, "MISSING_ARG_TARGET"}
+		}
+		_, _, err = net.SplitHostPort(target)
+		if err != nil || s.isOwnHTTPAddress(target) {
+			return nil, http_api.Err{400, "INVALID_ARG_TARGET"}
+		}
+
+		err = topic.Migrate(target)
+		if err == ErrMigrationInProgress {
+			return nil, http_api.Err{409, "MIGRATION_IN_PROGRESS"}
+		}
+		if err == ErrTopicDraining {
+			return nil, http_api.Err{409, "TOPIC_DRAINING"}
+		}
+		if err != nil {
+			s.ctx.nsqd.logf(LOG_ERROR, "failed to migrate topic %s to %s - %s", topicName, target, err)
+			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+		}
+	}
+
+	stats, ok := topic.MigrationStats()
+	if !ok {
+		return nil, http_api.Err{404, "MIGRATION_NOT_FOUND"}
+	}
+	return stats, nil
+}
+
+func (s *httpServer) doCancelMigration(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+
+	topic, err := s.ctx.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		return nil, http_api.Err{404, "TOPIC_NOT_FOUND"}
+	}
+
+	err = topic.CancelMigration()
+	if err != nil {
+		return nil, http_api.Err{404, "MIGRATION_NOT_FOUND"}
+	}
+	stats, _ := topic.MigrationStats()
+	return stats, nil
+}
+
+// isOwnHTTPAddress reports whether addr is this nsqd's HTTP address
+func (s *httpServer) isOwnHTTPAddress(addr string) bool {
+	port := s.ctx.nsqd.RealHTTPAddr().Port
+	return addr == s.ctx.nsqd.RealHTTPAddr().String() ||
+		addr == net.JoinHostPort(s.ctx.nsqd.getOpts().BroadcastAddress, strconv.Itoa(port)) ||
+		addr == s.ctx.nsqd.broadcastHTTPAddress()
+}
+
+func (s *httpServer) doChannelMPUB(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if req.ContentLength > s.ctx.nsqd.getOpts().MaxBodySize {
+		return nil, http_api.Err{413, "BODY_TOO_BIG"}
+	}
+
+	reqParams, topic, err := s.getTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	channelName := reqParams.Get("channel")
+	if channelName == "" {
+		return nil, http_api.Err{400, "MISSING_ARG_CHANNEL"}
+	}
+	if !protocol.IsValidChannelName(channelName) {
+		return nil, http_api.Err{400, "INVALID_ARG_CHANNEL"}
+	}
+
+	tmp := make([]byte, 4)
+	msgs, err := readMPUB(req.Body, tmp, topic,
+		s.ctx.nsqd.getOpts().MaxMsgSize, s.ctx.nsqd.getOpts().MaxBodySize)
+	if err != nil {
+		e := err.(*protocol.FatalClientErr)
+		return nil, http_api.Err{413, fmt.Sprintf("%s: %s", e.Code[2:], e.Desc)}
+	}
+
+	channel := topic.GetChannel(channelName)
+	for _, msg := range msgs {
+		msg.Producer = req.RemoteAddr
+		err = channel.PutMessage(msg)
+		if err != nil {
+			return nil, http_api.Err{503, "EXITING"}
+		}
+	}
+
+	return "OK", nil
+}
+
+func (s *httpServer) doCreateChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := topic.GetExistingChannel(channelName); err != nil {
+		if err := s.ctx.nsqd.namePolicy.checkChannel(channelName); err != nil {
+			return nil, http_api.Err{400, "INVALID_CHANNEL"}
+		}
+	}
+	start, err := ParseChannelStart(reqParams.Values.Get("start"), time.Now())
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_ARG_START"}
+	}
+	channel := topic.GetChannelFrom(channelName, start)
+	return nil, s.setChannelConfig(channel, reqParams.Values)
+}
+
+func (s *httpServer) doChannelConfig(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+
+	if req.Method == "POST" {
+		err = s.setChannelConfig(channel, reqParams.Values)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	alarmDepth, alarmAge := channel.Alarm()
+	return struct {
+		MaxClients         int    `json:"max_clients"`
+		Exclusive          bool   `json:"exclusive"`
+		KeyRouting         bool   `json:"key_routing"`
+		SampleRate         int32  `json:"sample_rate"`
+		AlarmDepth         int64  `json:"alarm_depth"`
+		AlarmAge           string `json:"alarm_age"`
+		AuditLog           bool   `json:"audit_log"`
+		QuarantineTimeouts int    `json:"quarantine_timeouts"`
+	}{channel.MaxClients(), channel.IsExclusive(), channel.IsKeyRouted(), channel.SampleRate(),
+		alarmDepth, alarmAge.String(), channel.IsAuditLogged(), channel.QuarantineTimeouts()}, nil
+}
+
+// setChannelConfig applies the channel settings present in reqParams
+func (s *httpServer) setChannelConfig(channel *Channel, reqParams url.Values) error {
+	changed := false
+
+	if v, ok := reqParams["max_clients"]; ok {
+		maxClients, err := strconv.Atoi(v[0])
+		if err != nil {
+			return http_api.Err{400, "INVALID_ARG_MAX_CLIENTS"}
+		}
+		err = channel.SetMaxClients(maxClients)
+		if err != nil {
+			return http_api.Err{400, "INVALID_ARG_MAX_CLIENTS"}
+		}
+		changed = true
+	}
+
+	if v, ok := reqParams["exclusive"]; ok {
+		exclusive, err := strconv.ParseBool(v[0])
+		if err != nil {
+			return http_api.Err{400, "INVALID_ARG_EXCLUSIVE"}
+		}
+		channel.SetExclusive(exclusive)
+		changed = true
 	}
 
-	// text mode is default, but unrecognized binary opt considered true
-	binaryMode := false
-	if vals, ok := reqParams["binary"]; ok {
-		if binaryMode, ok = boolParams[vals[0]]; !ok {
-			binaryMode = true
-			s.ctx.nsqd.logf(LOG_WARN, "deprecated value '%s' used for /mpub binary param", vals[0])
+	if v, ok := reqParams["key_routing"]; ok {
+		keyRouting, err := strconv.ParseBool(v[0])
+		if err != nil {
+			return http_api.Err{400, "INVALID_ARG_KEY_ROUTING"}
 		}
+		channel.SetKeyRouting(keyRouting)
+		changed = true
 	}
-	if binaryMode {
-		tmp := make([]byte, 4)
-		msgs, err = readMPUB(req.Body, tmp, topic,
-			s.ctx.nsqd.getOpts().MaxMsgSize, s.ctx.nsqd.getOpts().MaxBodySize)
+
+	if v, ok := reqParams["sample_rate"]; ok {
+		sampleRate, err := strconv.ParseInt(v[0], 10, 32)
 		if err != nil {
-			return nil, http_api.Err{413, err.(*protocol.FatalClientErr).Code[2:]}
+			return http_api.Err{400, "INVALID_ARG_SAMPLE_RATE"}
 		}
-	} else {
-		// add 1 so that it's greater than our max when we test for it
-		// (LimitReader returns a "fake" EOF)
-		readMax := s.ctx.nsqd.getOpts().MaxBodySize + 1
-		rdr := bufio.NewReader(io.LimitReader(req.Body, readMax))
-		total := 0
-		for !exit {
-			var block []byte
-			block, err = rdr.ReadBytes('\n')
+		err = channel.SetSampleRate(int32(sampleRate))
+		if err != nil {
+			return http_api.Err{400, "INVALID_ARG_SAMPLE_RATE"}
+		}
+		changed = true
+	}
+
+	_, hasAlarmDepth := reqParams["alarm_depth"]
+	_, hasAlarmAge := reqParams["alarm_age"]
+	if hasAlarmDepth || hasAlarmAge {
+		alarmDepth, alarmAge := channel.Alarm()
+		var err error
+		if hasAlarmDepth {
+			alarmDepth, err = strconv.ParseInt(reqParams.Get("alarm_depth"), 10, 64)
 			if err != nil {
-				if err != io.EOF {
-					return nil, http_api.Err{500, "INTERNAL_ERROR"}
-				}
-				exit = true
+				return http_api.Err{400, "INVALID_ARG_ALARM_DEPTH"}
 			}
-			total += len(block)
-			if int64(total) == readMax {
-				return nil, http_api.Err{413, "BODY_TOO_BIG"}
+		}
+		if hasAlarmAge {
+			alarmAge, err = time.ParseDuration(reqParams.Get("alarm_age"))
+			if err != nil {
+				return http_api.Err{400, "INVALID_ARG_ALARM_AGE"}
 			}
+		}
+		channel.SetAlarm(alarmDepth, alarmAge)
+		changed = true
+	}
 
-			if len(block) > 0 && block[len(block)-1] == '\n' {
-				block = block[:len(block)-1]
-			}
+	if v, ok := reqParams["audit_log"]; ok {
+		auditLog, err := strconv.ParseBool(v[0])
+		if err != nil {
+			return http_api.Err{400, "INVALID_ARG_AUDIT_LOG"}
+		}
+		err = channel.SetAuditLog(auditLog)
+		if err != nil {
+			s.ctx.nsqd.logf(LOG_ERROR, "TOPIC(%s): channel(%s): failed to set audit log - %s",
+				channel.topicName, channel.name, err)
+			return http_api.Err{400, "INVALID_ARG_AUDIT_LOG"}
+		}
+		changed = true
+	}
 
-			// silently discard 0 length messages
-			// this maintains the behavior pre 0.2.22
-			if len(block) == 0 {
-				continue
-			}
+	if v, ok := reqParams["quarantine_timeouts"]; ok {
+		timeouts, err := strconv.Atoi(v[0])
+		if err != nil {
+			return http_api.Err{400, "INVALID_ARG_QUARANTINE_TIMEOUTS"}
+		}
+		err = channel.SetQuarantineTimeouts(timeouts)
+		if err != nil {
+			return http_api.Err{400, "INVALID_ARG_QUARANTINE_TIMEOUTS"}
+		}
+		changed = true
+	}
 
-			if int64(len(block)) > s.ctx.nsqd.getOpts().MaxMsgSize {
-				return nil, http_api.Err{413, "MSG_TOO_BIG"}
-			}
+	if !changed {
+		return nil
+	}
+	s.ctx.nsqd.Lock()
+	s.ctx.nsqd.PersistMetadata()
+	s.ctx.nsqd.Unlock()
+	return nil
+}
 
-			msg := NewMessage(topic.GenerateID(), block)
-			msgs = append(msgs, msg)
-		}
+func (s *httpServer) doEmptyChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
 	}
 
-	err = topic.PutMessages(msgs)
+	channel, err := topic.GetExistingChannel(channelName)
 	if err != nil {
-		return nil, http_api.Err{503, "EXITING"}
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
 	}
 
-	return "OK", nil
+	err = channel.Empty()
+	if err != nil {
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+
+	return nil, nil
 }
 
-func (s *httpServer) doCreateTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
-	_, _, err := s.getTopicFromQuery(req)
-	return nil, err
+func (s *httpServer) doDeleteChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	err = topic.DeleteExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+
+	return nil, nil
 }
 
-func (s *httpServer) doEmptyTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+// doTransferChannel copies or moves the messages queued in one channel to
+// another of the same topic, e.g. back from a quarantine channel
+func (s *httpServer) doTransferChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	reqParams, err := http_api.NewReqParams(req)
 	if err != nil {
-		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
 		return nil, http_api.Err{400, "INVALID_REQUEST"}
 	}
 
@@ -326,89 +1662,130 @@ func (s *httpServer) doEmptyTopic(w http.ResponseWriter, req *http.Request, ps h
 	if err != nil {
 		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
 	}
-
-	if !protocol.IsValidTopicName(topicName) {
-		return nil, http_api.Err{400, "INVALID_TOPIC"}
+	from, err := reqParams.Get("from")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_FROM"}
+	}
+	to, err := reqParams.Get("to")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_TO"}
+	}
+	if from == to {
+		return nil, http_api.Err{400, "INVALID_ARG_TO"}
 	}
 
 	topic, err := s.ctx.nsqd.GetExistingTopic(topicName)
 	if err != nil {
 		return nil, http_api.Err{404, "TOPIC_NOT_FOUND"}
 	}
+	src, err := topic.GetExistingChannel(from)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+	dst, err := topic.GetExistingChannel(to)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
 
-	err = topic.Empty()
+	move := strings.HasSuffix(req.URL.Path, "/move")
+	count, err := src.TransferTo(dst, move)
+	s.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): transferred %d messages from channel %s to %s (move %t)",
+		topicName, count, from, to, move)
 	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "TOPIC(%s): failed to transfer messages from channel %s to %s - %s",
+			topicName, from, to, err)
 		return nil, http_api.Err{500, "INTERNAL_ERROR"}
 	}
 
-	return nil, nil
+	return struct {
+		Count int64 `json:"count"`
+	}{count}, nil
 }
 
-func (s *httpServer) doDeleteTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
-	reqParams, err := http_api.NewReqParams(req)
+// doChannelAudit queries the audit log of a channel, e.g. whether and when a
+// message was processed
+func (s *httpServer) doChannelAudit(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
 	if err != nil {
-		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
-		return nil, http_api.Err{400, "INVALID_REQUEST"}
+		return nil, err
 	}
 
-	topicName, err := reqParams.Get("topic")
+	channel, err := topic.GetExistingChannel(channelName)
 	if err != nil {
-		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+
+	filter := AuditFilter{
+		ID:    reqParams.Values.Get("id"),
+		Limit: 100,
+	}
+	if v := reqParams.Values.Get("since"); v != "" {
+		filter.Since, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_ARG_SINCE"}
+		}
+	}
+	if v := reqParams.Values.Get("limit"); v != "" {
+		filter.Limit, err = strconv.Atoi(v)
+		if err != nil || filter.Limit < 1 || filter.Limit > 10000 {
+			return nil, http_api.Err{400, "INVALID_ARG_LIMIT"}
+		}
 	}
 
-	err = s.ctx.nsqd.DeleteExistingTopic(topicName)
+	records, err := channel.QueryAuditLog(filter)
 	if err != nil {
-		return nil, http_api.Err{404, "TOPIC_NOT_FOUND"}
+		s.ctx.nsqd.logf(LOG_ERROR, "TOPIC(%s): channel(%s): failed to read audit log - %s",
+			topic.name, channelName, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
 	}
 
-	return nil, nil
+	return struct {
+		Records []AuditRecord `json:"records"`
+	}{records}, nil
 }
 
-func (s *httpServer) doPauseTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
-	reqParams, err := http_api.NewReqParams(req)
+// doSeekChannel moves a channel to the messages published at or after a time,
+// back within --retention to reprocess them or forward to skip a backlog, see
+// Topic.SeekChannel
+func (s *httpServer) doSeekChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
 	if err != nil {
-		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
-		return nil, http_api.Err{400, "INVALID_REQUEST"}
+		return nil, err
 	}
 
-	topicName, err := reqParams.Get("topic")
+	channel, err := topic.GetExistingChannel(channelName)
 	if err != nil {
-		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
 	}
 
-	topic, err := s.ctx.nsqd.GetExistingTopic(topicName)
+	toParam, err := reqParams.Get("to")
 	if err != nil {
-		return nil, http_api.Err{404, "TOPIC_NOT_FOUND"}
+		return nil, http_api.Err{400, "MISSING_ARG_TO"}
+	}
+	to, err := time.Parse(time.RFC3339, toParam)
+	if err != nil || to.After(time.Now()) {
+		return nil, http_api.Err{400, "INVALID_ARG_TO"}
 	}
 
-	if strings.Contains(req.URL.Path, "unpause") {
-		err = topic.UnPause()
-	} else {
-		err = topic.Pause()
+	discarded, err := topic.SeekChannel(channel, to)
+	if err == ErrRetentionDisabled {
+		return nil, http_api.Err{400, "RETENTION_DISABLED"}
 	}
 	if err != nil {
-		s.ctx.nsqd.logf(LOG_ERROR, "failure in %s - %s", req.URL.Path, err)
+		s.ctx.nsqd.logf(LOG_ERROR, "TOPIC(%s): channel(%s): failed to seek - %s", topic.name, channelName, err)
 		return nil, http_api.Err{500, "INTERNAL_ERROR"}
 	}
+	s.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): channel(%s): seeked to %s, discarding %d queued messages",
+		topic.name, channelName, to.Format(time.RFC3339), discarded)
 
-	// pro-actively persist metadata so in case of process failure
-	// nsqd won't suddenly (un)pause a topic
-	s.ctx.nsqd.Lock()
-	s.ctx.nsqd.PersistMetadata()
-	s.ctx.nsqd.Unlock()
-	return nil, nil
-}
-
-func (s *httpServer) doCreateChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
-	_, topic, channelName, err := s.getExistingTopicFromQuery(req)
-	if err != nil {
-		return nil, err
-	}
-	topic.GetChannel(channelName)
-	return nil, nil
+	return struct {
+		Discarded int64 `json:"discarded"`
+	}{discarded}, nil
 }
 
-func (s *httpServer) doEmptyChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+// doChannelQuarantine returns the messages a channel recently quarantined, and
+// how many are queued in its quarantine channel
+func (s *httpServer) doChannelQuarantine(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	_, topic, channelName, err := s.getExistingTopicFromQuery(req)
 	if err != nil {
 		return nil, err
@@ -419,26 +1796,43 @@ func (s *httpServer) doEmptyChannel(w http.ResponseWriter, req *http.Request, ps
 		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
 	}
 
-	err = channel.Empty()
-	if err != nil {
-		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	var depth int64
+	if quarantine, err := topic.GetExistingChannel(channelName + QuarantineSuffix); err == nil {
+		depth = quarantine.Depth()
 	}
 
-	return nil, nil
+	return struct {
+		Channel          string               `json:"channel"`
+		Depth            int64                `json:"depth"`
+		QuarantinedCount uint64               `json:"quarantined_count"`
+		Messages         []QuarantinedMessage `json:"messages"`
+	}{channelName + QuarantineSuffix, depth, channel.QuarantinedCount(),
+		channel.QuarantinedMessages()}, nil
 }
 
-func (s *httpServer) doDeleteChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+func (s *httpServer) doRedriveChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	_, topic, channelName, err := s.getExistingTopicFromQuery(req)
 	if err != nil {
 		return nil, err
 	}
 
-	err = topic.DeleteExistingChannel(channelName)
+	channel, err := topic.GetExistingChannel(channelName)
 	if err != nil {
 		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
 	}
+	if channel.IsQuarantine() {
+		return nil, http_api.Err{400, "INVALID_ARG_CHANNEL"}
+	}
 
-	return nil, nil
+	count, err := topic.Redrive(channelName)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "TOPIC(%s): channel(%s): %s", topic.name, channelName, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+
+	return struct {
+		Count int64 `json:"count"`
+	}{count}, nil
 }
 
 func (s *httpServer) doPauseChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
@@ -455,7 +1849,15 @@ func (s *httpServer) doPauseChannel(w http.ResponseWriter, req *http.Request, ps
 	if strings.Contains(req.URL.Path, "unpause") {
 		err = channel.UnPause()
 	} else {
-		err = channel.Pause()
+		var pausedUntil time.Time
+		if v := req.URL.Query().Get("duration"); v != "" {
+			duration, err := time.ParseDuration(v)
+			if err != nil || duration <= 0 {
+				return nil, http_api.Err{400, "INVALID_DURATION"}
+			}
+			pausedUntil = time.Now().Add(duration)
+		}
+		err = channel.PauseUntil(pausedUntil)
 	}
 	if err != nil {
 		s.ctx.nsqd.logf(LOG_ERROR, "failure in %s - %s", req.URL.Path, err)
@@ -481,6 +1883,7 @@ func (s *httpServer) doStats(w http.ResponseWriter, req *http.Request, ps httpro
 	formatString, _ := reqParams.Get("format")
 	topicName, _ := reqParams.Get("topic")
 	channelName, _ := reqParams.Get("channel")
+	namespaceName, _ := reqParams.Get("namespace")
 	includeClientsParam, _ := reqParams.Get("include_clients")
 	jsonFormat := formatString == "json"
 
@@ -538,22 +1941,47 @@ func (s *httpServer) doStats(w http.ResponseWriter, req *http.Request, ps httpro
 		producerStats = filteredProducerStats
 	}
 
+	// filter by namespace (if specified)
+	if len(namespaceName) > 0 {
+		filteredStats := make([]TopicStats, 0)
+		for _, topicStats := range stats {
+			if ns, _ := protocol.SplitNamespace(topicStats.TopicName); ns == namespaceName {
+				filteredStats = append(filteredStats, topicStats)
+			}
+		}
+		stats = filteredStats
+	}
+
+	var identityStats []IdentityStats
+	if s.ctx.nsqd.IsAuthEnabled() {
+		identityStats = s.ctx.nsqd.quotas.stats()
+	}
+
 	ms := getMemStats()
+	ts := s.ctx.nsqd.timeoutPool.stats()
+	var asyncPub *AsyncPubStats
+	if s.ctx.nsqd.asyncPublisher != nil {
+		as := s.ctx.nsqd.asyncPublisher.stats()
+		asyncPub = &as
+	}
 	if !jsonFormat {
-		return s.printStats(stats, producerStats, ms, health, startTime, uptime), nil
+		return s.printStats(stats, producerStats, identityStats, ms, ts, health, startTime, uptime), nil
 	}
 
 	return struct {
-		Version   string        `json:"version"`
-		Health    string        `json:"health"`
-		StartTime int64         `json:"start_time"`
-		Topics    []TopicStats  `json:"topics"`
-		Memory    memStats      `json:"memory"`
-		Producers []ClientStats `json:"producers"`
-	}{version.Binary, health, startTime.Unix(), stats, ms, producerStats}, nil
+		Version    string          `json:"version"`
+		Health     string          `json:"health"`
+		StartTime  int64           `json:"start_time"`
+		Topics     []TopicStats    `json:"topics"`
+		Memory     memStats        `json:"memory"`
+		Timeouts   TimeoutStats    `json:"timeouts"`
+		Producers  []ClientStats   `json:"producers"`
+		Identities []IdentityStats `json:"identities,omitempty"`
+		AsyncPub   *AsyncPubStats  `json:"async_pub,omitempty"`
+	}{version.Binary, health, startTime.Unix(), stats, ms, ts, producerStats, identityStats, asyncPub}, nil
 }
 
-func (s *httpServer) printStats(stats []TopicStats, producerStats []ClientStats, ms memStats, health string, startTime time.Time, uptime time.Duration) []byte {
+func (s *httpServer) printStats(stats []TopicStats, producerStats []ClientStats, identityStats []IdentityStats, ms memStats, ts TimeoutStats, health string, startTime time.Time, uptime time.Duration) []byte {
 	var buf bytes.Buffer
 	w := &buf
 
@@ -576,6 +2004,12 @@ func (s *httpServer) printStats(stats []TopicStats, producerStats []ClientStats,
 	fmt.Fprintf(w, "   %-25s\t%d\n", "next_gc_bytes", ms.NextGCBytes)
 	fmt.Fprintf(w, "   %-25s\t%d\n", "gc_total_runs", ms.GCTotalRuns)
 
+	fmt.Fprintf(w, "\nTimeouts:\n")
+	fmt.Fprintf(w, "   %-25s\t%d\n", "workers", ts.Workers)
+	fmt.Fprintf(w, "   %-25s\t%d\n", "max_workers", ts.MaxWorkers)
+	fmt.Fprintf(w, "   %-25s\t%d\n", "expired_count", ts.ExpiredCount)
+	fmt.Fprintf(w, "   %-25s\t%d\n", "last_processing_usec", ts.LastProcessingUsec)
+
 	if len(stats) == 0 {
 		fmt.Fprintf(w, "\nTopics: None\n")
 	} else {
@@ -597,6 +2031,9 @@ func (s *httpServer) printStats(stats []TopicStats, producerStats []ClientStats,
 			t.MessageCount,
 			t.E2eProcessingLatency,
 		)
+		for _, p := range t.Publishers {
+			fmt.Fprintf(w, "      publisher %-25s msgs: %-8d\n", p.Publisher, p.Count)
+		}
 		for _, c := range t.Channels {
 			if c.Paused {
 				pausedPrefix = "   *P "
@@ -661,9 +2098,138 @@ func (s *httpServer) printStats(stats []TopicStats, producerStats []ClientStats,
 		}
 	}
 
+	if s.ctx.nsqd.IsAuthEnabled() {
+		if len(identityStats) == 0 {
+			fmt.Fprintf(w, "\nIdentities: None\n")
+		} else {
+			fmt.Fprintf(w, "\nIdentities:\n")
+		}
+		// quotas of 0 are unlimited
+		for _, i := range identityStats {
+			fmt.Fprintf(w, "   [%-21s] conns: %d/%d topics: %d/%d pub-rate: %g msgs: %-8d rejected: %d\n",
+				i.Identity,
+				i.Connections,
+				i.MaxConnections,
+				len(i.Topics),
+				i.MaxTopics,
+				i.MaxPublishRate,
+				i.PublishCount,
+				i.RejectedCount,
+			)
+		}
+	}
+
 	return buf.Bytes()
 }
 
+func (s *httpServer) doBackup(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	dir, _ := reqParams.Get("dir")
+	if dir != "" {
+		backupDir := s.ctx.nsqd.getOpts().BackupDir
+		if backupDir == "" {
+			return nil, http_api.Err{403, "BACKUP_DIR_DISABLED"}
+		}
+		var ok bool
+		dir, ok = confineDir(backupDir, dir)
+		if !ok {
+			return nil, http_api.Err{400, "INVALID_ARG_DIR"}
+		}
+		err = s.ctx.nsqd.Backup(dir)
+		if err != nil {
+			s.ctx.nsqd.logf(LOG_ERROR, "failed to write backup to %s - %s", dir, err)
+			return nil, http_api.Err{500, "BACKUP_FAILED: " + err.Error()}
+		}
+		return nil, nil
+	}
+
+	// snapshot next to the data so that full diskqueue files can be hard linked
+	tmpDir, err := ioutil.TempDir(s.ctx.nsqd.getOpts().DataPath, "backup-")
+	if err != nil {
+		return nil, http_api.Err{500, "BACKUP_FAILED: " + err.Error()}
+	}
+	err = s.ctx.nsqd.Backup(tmpDir)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to write backup - %s", err)
+		return nil, http_api.Err{500, "BACKUP_FAILED: " + err.Error()}
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", `attachment; filename="nsqd-backup.tar"`)
+	return http_api.StreamFunc(func(w io.Writer) {
+		defer os.RemoveAll(tmpDir)
+		err := writeTar(w, tmpDir)
+		if err != nil {
+			s.ctx.nsqd.logf(LOG_ERROR, "failed to stream backup - %s", err)
+		}
+	}), nil
+}
+
+// confineDir returns the directory dir of a query parameter under root, false if
+// dir is absolute or contains .. (i.e. could write anywhere on the nsqd host)
+func confineDir(root string, dir string) (string, bool) {
+	if filepath.IsAbs(dir) || strings.HasPrefix(dir, "/") {
+		return "", false
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(dir), "/") {
+		if elem == ".." {
+			return "", false
+		}
+	}
+	return filepath.Join(root, dir), true
+}
+
+func (s *httpServer) doNamespaces(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	return struct {
+		Namespaces []NamespaceStats `json:"namespaces"`
+	}{s.ctx.nsqd.GetNamespaceStats()}, nil
+}
+
+func (s *httpServer) doClients(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	return s.ctx.nsqd.GetClientSummary(), nil
+}
+
+func (s *httpServer) doExportMetadata(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	m, err := s.ctx.nsqd.ExportMetadata()
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to export metadata - %s", err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	return m, nil
+}
+
+func (s *httpServer) doImportMetadata(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	// add 1 so that it's greater than our max when we test for it
+	// (LimitReader returns a "fake" EOF)
+	readMax := s.ctx.nsqd.getOpts().MaxBodySize + 1
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, readMax))
+	if err != nil {
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	if int64(len(body)) == readMax {
+		return nil, http_api.Err{413, "BODY_TOO_BIG"}
+	}
+
+	var m meta
+	err = json.Unmarshal(body, &m)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_BODY"}
+	}
+
+	err = s.ctx.nsqd.ImportMetadata(&m)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to import metadata - %s", err)
+		return nil, http_api.Err{400, "INVALID_METADATA: " + err.Error()}
+	}
+	return nil, nil
+}
+
 func (s *httpServer) doConfig(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	opt := ps.ByName("opt")
 
@@ -693,6 +2259,9 @@ func (s *httpServer) doConfig(w http.ResponseWriter, req *http.Request, ps httpr
 				return nil, http_api.Err{400, "INVALID_VALUE"}
 			}
 			opts.LogLevel = logLevel
+		case "broadcast_address":
+			// sent to nsqlookupd without reconnecting
+			opts.BroadcastAddress = string(body)
 		default:
 			return nil, http_api.Err{400, "INVALID_OPTION"}
 		}
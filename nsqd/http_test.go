@@ -1,14 +1,19 @@
 package nsqd
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"net"
 	"net/http"
 	"os"
+	"path"
 	"runtime"
 	"strconv"
 	"sync"
@@ -25,7 +30,9 @@ import (
 )
 
 type ErrMessage struct {
+	Code    string `json:"code"`
 	Message string `json:"message"`
+	Detail  string `json:"detail"`
 }
 
 type InfoDoc struct {
@@ -35,6 +42,10 @@ type InfoDoc struct {
 	HTTPPort         int    `json:"http_port"`
 	TCPPort          int    `json:"tcp_port"`
 	StartTime        int64  `json:"start_time"`
+
+	BroadcastTCPAddress   string `json:"broadcast_tcp_address"`
+	BroadcastHTTPAddress  string `json:"broadcast_http_address"`
+	BroadcastHTTPSAddress string `json:"broadcast_https_address"`
 }
 
 func TestHTTPpub(t *testing.T) {
@@ -77,7 +88,7 @@ func TestHTTPpubEmpty(t *testing.T) {
 	defer resp.Body.Close()
 	body, _ := ioutil.ReadAll(resp.Body)
 	test.Equal(t, 400, resp.StatusCode)
-	test.Equal(t, `{"message":"MSG_EMPTY"}`, string(body))
+	test.Equal(t, `{"code":"MSG_EMPTY","message":"MSG_EMPTY","description":"the message body is empty"}`, string(body))
 
 	time.Sleep(5 * time.Millisecond)
 
@@ -229,6 +240,111 @@ func TestHTTPpubDefer(t *testing.T) {
 	test.Equal(t, 1, numDef)
 }
 
+func TestHTTPpubAsync(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_pub_async" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	for _, tc := range []struct {
+		async  string
+		status int
+		body   string
+	}{
+		{"true", 200, "OK"},
+		{"1", 200, "OK"},
+		{"yes", 400, `{"code":"INVALID_ARG_ASYNC","message":"INVALID_ARG_ASYNC","description":"the async parameter is not a boolean"}`},
+	} {
+		url := fmt.Sprintf("http://%s/pub?topic=%s&async=%s", httpAddr, topicName, tc.async)
+		resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("test message"))
+		test.Nil(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		test.Equal(t, tc.status, resp.StatusCode)
+		test.Equal(t, tc.body, string(body))
+	}
+
+	for i := 0; i < 100 && topic.Depth() < 2; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	test.Equal(t, int64(2), topic.Depth())
+	test.Equal(t, uint64(2), nsqd.asyncPublisher.stats().PublishedCount)
+
+	// refused rather than waiting when the buffer is full, and once closed
+	p := &asyncPublisher{pubChan: make(chan asyncPub, 1)}
+	test.Nil(t, p.publish(topic, NewMessage(topic.GenerateID(), []byte("a")), ""))
+	test.Equal(t, ErrAsyncPubFull, p.publish(topic, NewMessage(topic.GenerateID(), []byte("b")), ""))
+	p.closed = true
+	test.Equal(t, ErrAsyncPubClosed, p.publish(topic, NewMessage(topic.GenerateID(), []byte("c")), ""))
+
+	// and not at all with --async-pub-buffer-size=0
+	opts = NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.AsyncPubBufferSize = 0
+	_, httpAddr, nsqd2 := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd2.Exit()
+	url := fmt.Sprintf("http://%s/pub?topic=%s&async=true", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("test message"))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+}
+
+func TestHTTPpubStream(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxMsgSize = 100
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_pub_stream" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	// each line is answered before the next is sent
+	pr, pw := io.Pipe()
+	go pw.Write([]byte(`{"n":1}` + "\n"))
+	url := fmt.Sprintf("http://%s/pub/stream?topic=%s", httpAddr, topicName)
+	resp, err := http.Post(url, "application/x-ndjson", pr)
+	test.Nil(t, err)
+	defer resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+	r := bufio.NewReader(resp.Body)
+	for _, tc := range []struct {
+		line string
+		ack  string
+	}{
+		{"", `{"line":1,"status":200}`},
+		{"\r\n" + `{"n":2}` + "\r\n", `{"line":3,"status":200}`},
+		{"not json\n", `{"line":4,"status":400,"code":"BAD_MESSAGE","message":"BAD_MESSAGE","description":"a message in the multi-publish body is malformed"}`},
+		{`"` + strings.Repeat("a", 100) + `"` + "\n", `{"line":5,"status":413,"code":"MSG_TOO_BIG","message":"MSG_TOO_BIG","description":"the message exceeds --max-msg-size"}`},
+	} {
+		if tc.line != "" {
+			_, err = pw.Write([]byte(tc.line))
+			test.Nil(t, err)
+		}
+		ack, err := r.ReadString('\n')
+		test.Nil(t, err)
+		test.Equal(t, tc.ack+"\n", ack)
+	}
+	_, err = pw.Write([]byte(`{"n":6}`))
+	test.Nil(t, err)
+	pw.Close()
+	ack, err := r.ReadString('\n')
+	test.Nil(t, err)
+	test.Equal(t, `{"line":6,"status":200}`+"\n", ack)
+	_, err = r.ReadString('\n')
+	test.Equal(t, io.EOF, err)
+
+	test.Equal(t, int64(3), topic.Depth())
+}
+
 func TestHTTPSRequire(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -417,7 +533,7 @@ func TestHTTPV1TopicChannel(t *testing.T) {
 	t.Logf("%s", body)
 	err = json.Unmarshal(body, &em)
 	test.Nil(t, err)
-	test.Equal(t, "MISSING_ARG_TOPIC", em.Message)
+	test.Equal(t, "MISSING_ARG_TOPIC", em.Code)
 
 	url = fmt.Sprintf("http://%s/topic/pause?topic=%s", httpAddr, topicName+"abc")
 	resp, err = http.Post(url, "application/json", nil)
@@ -430,7 +546,7 @@ func TestHTTPV1TopicChannel(t *testing.T) {
 	t.Logf("%s", body)
 	err = json.Unmarshal(body, &em)
 	test.Nil(t, err)
-	test.Equal(t, "TOPIC_NOT_FOUND", em.Message)
+	test.Equal(t, "TOPIC_NOT_FOUND", em.Code)
 
 	url = fmt.Sprintf("http://%s/topic/pause?topic=%s", httpAddr, topicName)
 	resp, err = http.Post(url, "application/json", nil)
@@ -658,7 +774,7 @@ func TestHTTPerrors(t *testing.T) {
 	defer resp.Body.Close()
 	body, _ := ioutil.ReadAll(resp.Body)
 	test.Equal(t, 405, resp.StatusCode)
-	test.Equal(t, `{"message":"METHOD_NOT_ALLOWED"}`, string(body))
+	test.Equal(t, `{"code":"METHOD_NOT_ALLOWED","message":"METHOD_NOT_ALLOWED","description":"the HTTP method is not allowed for this resource"}`, string(body))
 
 	url = fmt.Sprintf("http://%s/not_found", httpAddr)
 	resp, err = http.Get(url)
@@ -666,7 +782,7 @@ func TestHTTPerrors(t *testing.T) {
 	defer resp.Body.Close()
 	body, _ = ioutil.ReadAll(resp.Body)
 	test.Equal(t, 404, resp.StatusCode)
-	test.Equal(t, `{"message":"NOT_FOUND"}`, string(body))
+	test.Equal(t, `{"code":"NOT_FOUND","message":"NOT_FOUND","description":"the requested resource does not exist"}`, string(body))
 }
 
 func TestDeleteTopic(t *testing.T) {
@@ -689,7 +805,7 @@ func TestDeleteTopic(t *testing.T) {
 	t.Logf("%s", body)
 	err = json.Unmarshal(body, &em)
 	test.Nil(t, err)
-	test.Equal(t, "MISSING_ARG_TOPIC", em.Message)
+	test.Equal(t, "MISSING_ARG_TOPIC", em.Code)
 
 	topicName := "test_http_delete_topic" + strconv.Itoa(int(time.Now().Unix()))
 
@@ -704,7 +820,7 @@ func TestDeleteTopic(t *testing.T) {
 	t.Logf("%s", body)
 	err = json.Unmarshal(body, &em)
 	test.Nil(t, err)
-	test.Equal(t, "TOPIC_NOT_FOUND", em.Message)
+	test.Equal(t, "TOPIC_NOT_FOUND", em.Code)
 
 	nsqd.GetTopic(topicName)
 
@@ -738,7 +854,7 @@ func TestEmptyTopic(t *testing.T) {
 	t.Logf("%s", body)
 	err = json.Unmarshal(body, &em)
 	test.Nil(t, err)
-	test.Equal(t, "MISSING_ARG_TOPIC", em.Message)
+	test.Equal(t, "MISSING_ARG_TOPIC", em.Code)
 
 	topicName := "test_http_empty_topic" + strconv.Itoa(int(time.Now().Unix()))
 
@@ -753,7 +869,7 @@ func TestEmptyTopic(t *testing.T) {
 	t.Logf("%s", body)
 	err = json.Unmarshal(body, &em)
 	test.Nil(t, err)
-	test.Equal(t, "INVALID_TOPIC", em.Message)
+	test.Equal(t, "INVALID_TOPIC", em.Code)
 
 	url = fmt.Sprintf("http://%s/topic/empty?topic=%s", httpAddr, topicName)
 	resp, err = http.Post(url, "application/json", nil)
@@ -766,7 +882,7 @@ func TestEmptyTopic(t *testing.T) {
 	t.Logf("%s", body)
 	err = json.Unmarshal(body, &em)
 	test.Nil(t, err)
-	test.Equal(t, "TOPIC_NOT_FOUND", em.Message)
+	test.Equal(t, "TOPIC_NOT_FOUND", em.Code)
 
 	nsqd.GetTopic(topicName)
 
@@ -800,7 +916,7 @@ func TestEmptyChannel(t *testing.T) {
 	t.Logf("%s", body)
 	err = json.Unmarshal(body, &em)
 	test.Nil(t, err)
-	test.Equal(t, "MISSING_ARG_TOPIC", em.Message)
+	test.Equal(t, "MISSING_ARG_TOPIC", em.Code)
 
 	topicName := "test_http_empty_channel" + strconv.Itoa(int(time.Now().Unix()))
 
@@ -815,7 +931,7 @@ func TestEmptyChannel(t *testing.T) {
 	t.Logf("%s", body)
 	err = json.Unmarshal(body, &em)
 	test.Nil(t, err)
-	test.Equal(t, "MISSING_ARG_CHANNEL", em.Message)
+	test.Equal(t, "MISSING_ARG_CHANNEL", em.Code)
 
 	channelName := "ch"
 
@@ -830,7 +946,7 @@ func TestEmptyChannel(t *testing.T) {
 	t.Logf("%s", body)
 	err = json.Unmarshal(body, &em)
 	test.Nil(t, err)
-	test.Equal(t, "TOPIC_NOT_FOUND", em.Message)
+	test.Equal(t, "TOPIC_NOT_FOUND", em.Code)
 
 	topic := nsqd.GetTopic(topicName)
 
@@ -845,7 +961,7 @@ func TestEmptyChannel(t *testing.T) {
 	t.Logf("%s", body)
 	err = json.Unmarshal(body, &em)
 	test.Nil(t, err)
-	test.Equal(t, "CHANNEL_NOT_FOUND", em.Message)
+	test.Equal(t, "CHANNEL_NOT_FOUND", em.Code)
 
 	topic.GetChannel(channelName)
 
@@ -879,6 +995,242 @@ func TestInfo(t *testing.T) {
 	err = json.Unmarshal(body, &info)
 	test.Nil(t, err)
 	test.Equal(t, version.Binary, info.Version)
+	test.Equal(t, httpAddr.Port, info.HTTPPort)
+	test.Equal(t, net.JoinHostPort(opts.BroadcastAddress, strconv.Itoa(httpAddr.Port)), info.BroadcastHTTPAddress)
+	test.Equal(t, "", info.BroadcastHTTPSAddress)
+}
+
+func TestInfoBroadcastAddresses(t *testing.T) {
+	lopts := nsqlookupd.NewOptions()
+	lopts.Logger = test.NewTestLogger(t)
+	_, _, lookupd := mustStartNSQLookupd(lopts)
+	defer lookupd.Exit()
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.NSQLookupdTCPAddresses = []string{lookupd.RealTCPAddr().String()}
+	opts.BroadcastAddress = "internal.host"
+	opts.BroadcastTCPAddress = "external.host:14150"
+	opts.BroadcastHTTPAddress = "external.host:14151"
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	var info InfoDoc
+	url := fmt.Sprintf("http://%s/info", httpAddr)
+	err := http_api.NewClient(nil, ConnectTimeout, RequestTimeout).GETV1(url, &info)
+	test.Nil(t, err)
+	test.Equal(t, "internal.host", info.BroadcastAddress)
+	// the ports advertised along with broadcast_address follow the listeners'
+	test.Equal(t, 14150, info.TCPPort)
+	test.Equal(t, 14151, info.HTTPPort)
+	test.Equal(t, "external.host:14150", info.BroadcastTCPAddress)
+	test.Equal(t, "external.host:14151", info.BroadcastHTTPAddress)
+
+	var peerInfos []*nsqlookupd.PeerInfo
+	for i := 0; i < 100 && len(peerInfos) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		peerInfos = lookupd.DB.FindProducers("client", "", "").PeerInfo()
+	}
+	test.Equal(t, 1, len(peerInfos))
+	test.Equal(t, "external.host:14150", peerInfos[0].BroadcastTCPAddress)
+	test.Equal(t, "external.host:14151", peerInfos[0].BroadcastHTTPAddress)
+	test.Equal(t, 14151, peerInfos[0].HTTPPort)
+}
+
+func TestHTTPSpec(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	var spec struct {
+		OpenAPI string `json:"openapi"`
+		Paths   map[string]map[string]struct {
+			Parameters []struct {
+				Name     string `json:"name"`
+				In       string `json:"in"`
+				Required bool   `json:"required"`
+			} `json:"parameters"`
+		} `json:"paths"`
+	}
+
+	url := fmt.Sprintf("http://%s/api/spec", httpAddr)
+	resp, err := http.Get(url)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	err = json.Unmarshal(body, &spec)
+	test.Nil(t, err)
+	test.Equal(t, "3.0.0", spec.OpenAPI)
+
+	pub := spec.Paths["/pub"]["post"]
+	test.Equal(t, "topic", pub.Parameters[0].Name)
+	test.Equal(t, "query", pub.Parameters[0].In)
+	test.Equal(t, true, pub.Parameters[0].Required)
+
+	config := spec.Paths["/config/{opt}"]["put"]
+	test.Equal(t, "opt", config.Parameters[0].Name)
+	test.Equal(t, "path", config.Parameters[0].In)
+}
+
+func TestHTTPRateLimit(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.HTTPRateLimitStats = 1
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	url := fmt.Sprintf("http://%s/stats", httpAddr)
+	resp, err := http.Get(url)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	resp, err = http.Get(url)
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 429, resp.StatusCode)
+	test.Equal(t, "1", resp.Header.Get("Retry-After"))
+	test.Equal(t, `{"code":"TOO_MANY_REQUESTS","message":"TOO_MANY_REQUESTS","description":"rate limit exceeded, retry after the duration in the Retry-After header"}`, string(body))
+
+	// other endpoint classes are unaffected
+	topicName := "test_http_rate_limit" + strconv.Itoa(int(time.Now().Unix()))
+	url = fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName)
+	resp, err = http.Post(url, "application/octet-stream", bytes.NewBufferString("test message"))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+}
+
+func TestHTTPRateLimitGlobal(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.HTTPRateLimit = 1
+	opts.HTTPRateLimitPub = 0.1
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/stats", httpAddr))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	// rejected by the global limit, without using up the /pub one
+	topicName := "test_http_rate_limit_global" + strconv.Itoa(int(time.Now().Unix()))
+	url := fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName)
+	resp, err = http.Post(url, "application/octet-stream", bytes.NewBufferString("test message"))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 429, resp.StatusCode)
+
+	time.Sleep(1100 * time.Millisecond)
+	resp, err = http.Post(url, "application/octet-stream", bytes.NewBufferString("test message"))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+}
+
+func TestHTTPRateLimitDebugAndHealth(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.HTTPRateLimit = 1
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	url := fmt.Sprintf("http://%s/debug/pprof/cmdline", httpAddr)
+	resp, err := http.Get(url)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	resp, err = http.Get(url)
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 429, resp.StatusCode)
+	test.Equal(t, "1", resp.Header.Get("Retry-After"))
+	test.Equal(t, `{"code":"TOO_MANY_REQUESTS","message":"TOO_MANY_REQUESTS","description":"rate limit exceeded, retry after the duration in the Retry-After header"}`, string(body))
+
+	// health checks are exempt
+	for _, endpoint := range []string{"/ping", "/health", "/ping", "/health"} {
+		resp, err = http.Get(fmt.Sprintf("http://%s%s", httpAddr, endpoint))
+		test.Nil(t, err)
+		resp.Body.Close()
+		test.Equal(t, 200, resp.StatusCode)
+	}
+}
+
+func TestHTTPCORS(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.HTTPAllowOrigins = []string{"https://*.example.com"}
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	client := &http.Client{}
+	url := fmt.Sprintf("http://%s/stats?format=json", httpAddr)
+
+	req, _ := http.NewRequest("OPTIONS", url, nil)
+	req.Header.Set("Origin", "https://dash.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	req.Header.Set("Access-Control-Request-Headers", "Accept")
+	resp, err := client.Do(req)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 204, resp.StatusCode)
+	test.Equal(t, "https://dash.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	test.Equal(t, "Accept", resp.Header.Get("Access-Control-Allow-Headers"))
+
+	req, _ = http.NewRequest("GET", url, nil)
+	req.Header.Set("Origin", "https://dash.example.com")
+	resp, err = client.Do(req)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, "https://dash.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+
+	req, _ = http.NewRequest("GET", url, nil)
+	req.Header.Set("Origin", "https://example.org")
+	resp, err = client.Do(req)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, "", resp.Header.Get("Access-Control-Allow-Origin"))
+}
+
+func TestHTTPStatsCompressed(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_stats_compressed" + strconv.Itoa(int(time.Now().Unix()))
+	nsqd.GetTopic(topicName)
+
+	url := fmt.Sprintf("http://%s/stats?format=json", httpAddr)
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	test.Nil(t, err)
+	defer resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+
+	gr, err := gzip.NewReader(resp.Body)
+	test.Nil(t, err)
+	body, err := ioutil.ReadAll(gr)
+	test.Nil(t, err)
+	test.Equal(t, true, strings.Contains(string(body), topicName))
 }
 
 func BenchmarkHTTPpub(b *testing.B) {
@@ -922,3 +1274,712 @@ func BenchmarkHTTPpub(b *testing.B) {
 	b.StopTimer()
 	nsqd.Exit()
 }
+
+func TestHTTPTopicConfig(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_mem_queue_size" + strconv.Itoa(int(time.Now().Unix()))
+	url := fmt.Sprintf("http://%s/topic/create?topic=%s&mem_queue_size=0", httpAddr, topicName)
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+
+	topic, err := nsqd.GetExistingTopic(topicName)
+	test.Nil(t, err)
+	size, isSet := topic.MemQueueSize()
+	test.Equal(t, int64(0), size)
+	test.Equal(t, true, isSet)
+
+	m, err := getMetadata(nsqd)
+	test.Nil(t, err)
+	test.Equal(t, int64(0), *m.Topics[0].MemQueueSize)
+
+	url = fmt.Sprintf("http://%s/topic/config?topic=%s&mem_queue_size=50", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, `{"mem_queue_size":50,"durable":false,"sync_every":2500,"sync_timeout":"2s","compression":"none","max_disk_bytes":0,"disk_quota_policy":"backpressure","channel_overflow":"none","channel_max_depth":0,"channel_max_disk_bytes":0,"idle_timeout":"0s","ephemeral_buffer_size":50}`, string(body))
+
+	url = fmt.Sprintf("http://%s/topic/config?topic=%s&sync=always&sync_timeout=100ms", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, `{"mem_queue_size":50,"durable":false,"sync_every":1,"sync_timeout":"100ms","compression":"none","max_disk_bytes":0,"disk_quota_policy":"backpressure","channel_overflow":"none","channel_max_depth":0,"channel_max_disk_bytes":0,"idle_timeout":"0s","ephemeral_buffer_size":50}`, string(body))
+
+	m, err = getMetadata(nsqd)
+	test.Nil(t, err)
+	test.Equal(t, int64(1), m.Topics[0].SyncEvery)
+	test.Equal(t, "100ms", m.Topics[0].SyncTimeout)
+
+	url = fmt.Sprintf("http://%s/topic/config?topic=%s&max_disk_bytes=1048576&disk_quota_policy=truncate", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+
+	m, err = getMetadata(nsqd)
+	test.Nil(t, err)
+	test.Equal(t, int64(1048576), m.Topics[0].MaxDiskBytes)
+	test.Equal(t, DiskQuotaTruncate, m.Topics[0].DiskQuota)
+
+	url = fmt.Sprintf("http://%s/topic/config?topic=%s&compression=zstd", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+
+	m, err = getMetadata(nsqd)
+	test.Nil(t, err)
+	test.Equal(t, "zstd", m.Topics[0].Compression)
+
+	url = fmt.Sprintf("http://%s/topic/config?topic=%s&compression=default", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+	test.Equal(t, "", topic.Compression())
+
+	url = fmt.Sprintf("http://%s/topic/config?topic=%s&compression=lz4", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 400, resp.StatusCode)
+	resp.Body.Close()
+
+	url = fmt.Sprintf("http://%s/topic/config?topic=%s&mem_queue_size=abc", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 400, resp.StatusCode)
+	resp.Body.Close()
+
+	url = fmt.Sprintf("http://%s/topic/config?topic=%s&disk_quota_policy=abc", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 400, resp.StatusCode)
+	resp.Body.Close()
+}
+
+func TestHTTPNamespaces(t *testing.T) {
+	f, err := ioutil.TempFile("", "nsqd-namespaces")
+	test.Nil(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString(`
+[tenantA]
+max_topics = 2
+
+[tenantA.topic_defaults]
+mem_queue_size = 10
+max_disk_bytes = 1048576
+`)
+	f.Close()
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.NamespaceConfig = f.Name()
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	for _, topicName := range []string{"tenantA/orders", "tenantA/payments", "tenantB/orders"} {
+		url := fmt.Sprintf("http://%s/topic/create?topic=%s", httpAddr, topicName)
+		resp, err := http.Post(url, "application/json", nil)
+		test.Nil(t, err)
+		test.Equal(t, 200, resp.StatusCode)
+		resp.Body.Close()
+	}
+
+	topic, err := nsqd.GetExistingTopic("tenantA/orders")
+	test.Nil(t, err)
+	size, isSet := topic.MemQueueSize()
+	test.Equal(t, int64(10), size)
+	test.Equal(t, true, isSet)
+	topic, err = nsqd.GetExistingTopic("tenantB/orders")
+	test.Nil(t, err)
+	_, isSet = topic.MemQueueSize()
+	test.Equal(t, false, isSet)
+
+	url := fmt.Sprintf("http://%s/pub?topic=tenantA/invoices", httpAddr)
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("test message"))
+	test.Nil(t, err)
+	test.Equal(t, 403, resp.StatusCode)
+	resp.Body.Close()
+	_, err = nsqd.GetExistingTopic("tenantA/invoices")
+	test.NotNil(t, err)
+
+	resp, err = http.Get(fmt.Sprintf("http://%s/namespaces", httpAddr))
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	var ns struct {
+		Namespaces []struct {
+			Name          string   `json:"name"`
+			Topics        []string `json:"topics"`
+			MaxTopics     int      `json:"max_topics"`
+			RejectedCount uint64   `json:"rejected_count"`
+		} `json:"namespaces"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&ns)
+	resp.Body.Close()
+	test.Nil(t, err)
+	test.Equal(t, 2, len(ns.Namespaces))
+	test.Equal(t, "tenantA", ns.Namespaces[0].Name)
+	test.Equal(t, []string{"tenantA/orders", "tenantA/payments"}, ns.Namespaces[0].Topics)
+	test.Equal(t, 2, ns.Namespaces[0].MaxTopics)
+	test.Equal(t, uint64(1), ns.Namespaces[0].RejectedCount)
+	test.Equal(t, "tenantB", ns.Namespaces[1].Name)
+	test.Equal(t, 0, ns.Namespaces[1].MaxTopics)
+
+	resp, err = http.Get(fmt.Sprintf("http://%s/stats?format=json&namespace=tenantB", httpAddr))
+	test.Nil(t, err)
+	var stats struct {
+		Topics []TopicStats `json:"topics"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	resp.Body.Close()
+	test.Nil(t, err)
+	test.Equal(t, 1, len(stats.Topics))
+	test.Equal(t, "tenantB/orders", stats.Topics[0].TopicName)
+}
+
+func TestHTTPMetadataExportImport(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_metadata" + strconv.Itoa(int(time.Now().Unix()))
+	url := fmt.Sprintf("http://%s/topic/create?topic=%s&mem_queue_size=10&sync_every=5&max_disk_bytes=1048576", httpAddr, topicName)
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+	topic, _ := nsqd.GetExistingTopic(topicName)
+	topic.GetChannel("ch2")
+	topic.GetChannel("ch1").Pause()
+	topic.Pause()
+
+	url = fmt.Sprintf("http://%s/metadata/export", httpAddr)
+	resp, err = http.Get(url)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, `{"schema_version":1,"topics":[{"name":"`+topicName+`","paused":true,"mem_queue_size":10,"sync_every":5,"max_disk_bytes":1048576,"disk_quota_policy":"backpressure","channels":[{"name":"ch1","paused":true},{"name":"ch2","paused":false}]}]}`, string(body))
+
+	opts2 := NewOptions()
+	opts2.Logger = test.NewTestLogger(t)
+	_, httpAddr2, nsqd2 := mustStartNSQD(opts2)
+	defer os.RemoveAll(opts2.DataPath)
+	defer nsqd2.Exit()
+
+	url = fmt.Sprintf("http://%s/metadata/import", httpAddr2)
+	resp, err = http.Post(url, "application/json", bytes.NewReader(body))
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+
+	topic, err = nsqd2.GetExistingTopic(topicName)
+	test.Nil(t, err)
+	test.Equal(t, true, topic.IsPaused())
+	size, _ := topic.MemQueueSize()
+	test.Equal(t, int64(10), size)
+	maxDiskBytes, _ := topic.DiskQuota()
+	test.Equal(t, int64(1048576), maxDiskBytes)
+	channel, err := topic.GetExistingChannel("ch1")
+	test.Nil(t, err)
+	test.Equal(t, true, channel.IsPaused())
+	_, err = topic.GetExistingChannel("ch2")
+	test.Nil(t, err)
+
+	m, err := getMetadata(nsqd2)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(m.Topics))
+	test.Equal(t, 2, len(m.Topics[0].Channels))
+
+	// the pause state is applied as given
+	body = []byte(`{"topics":[{"name":"` + topicName + `","paused":false,"channels":[{"name":"ch1","paused":false}]}]}`)
+	resp, err = http.Post(url, "application/json", bytes.NewReader(body))
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+	test.Equal(t, false, topic.IsPaused())
+	test.Equal(t, false, channel.IsPaused())
+	size, _ = topic.MemQueueSize()
+	test.Equal(t, int64(10), size)
+
+	for _, body := range []string{
+		`{"topics":[{"name":"invalid topic","channels":[]}]}`,
+		`{"schema_version":1000,"topics":[]}`,
+		`{"topics":`,
+	} {
+		resp, err = http.Post(url, "application/json", strings.NewReader(body))
+		test.Nil(t, err)
+		test.Equal(t, 400, resp.StatusCode)
+		resp.Body.Close()
+	}
+	_, err = nsqd2.GetExistingTopic("invalid topic")
+	test.NotNil(t, err)
+}
+
+func TestHTTPTopicMigrate(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	targetOpts := NewOptions()
+	targetOpts.Logger = test.NewTestLogger(t)
+	_, targetHTTPAddr, target := mustStartNSQD(targetOpts)
+	defer os.RemoveAll(targetOpts.DataPath)
+	defer target.Exit()
+
+	topicName := "test_http_migrate" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.GetChannel("ch1")
+	topic.GetChannel("ch2").Pause()
+	for i := 0; i < 10; i++ {
+		topic.PutMessage(NewMessage(topic.GenerateID(), []byte("backlog")))
+	}
+
+	url := fmt.Sprintf("http://%s/topic/migrate?topic=%s&target=%s", httpAddr, topicName, httpAddr)
+	resp, err := http.Post(url, "application/octet-stream", nil)
+	test.Nil(t, err)
+	test.Equal(t, 400, resp.StatusCode)
+	resp.Body.Close()
+
+	url = fmt.Sprintf("http://%s/topic/migrate?topic=%s&target=%s", httpAddr, topicName, targetHTTPAddr)
+	resp, err = http.Post(url, "application/octet-stream", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+
+	var stats MigrationStats
+	for i := 0; i < 100; i++ {
+		stats, _ = topic.MigrationStats()
+		if stats.State == MigrationComplete {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	test.Equal(t, MigrationComplete, stats.State)
+	test.Equal(t, uint64(20), stats.DrainCount)
+
+	targetTopic, err := target.GetExistingTopic(topicName)
+	test.Nil(t, err)
+	ch1, err := targetTopic.GetExistingChannel("ch1")
+	test.Nil(t, err)
+	ch2, err := targetTopic.GetExistingChannel("ch2")
+	test.Nil(t, err)
+	test.Equal(t, int64(10), ch1.Depth())
+	test.Equal(t, int64(10), ch2.Depth())
+	test.Equal(t, true, ch2.IsPaused())
+	test.Equal(t, 0, len(topic.loadChannels()))
+
+	// publishes to the old node are still forwarded
+	for i := 0; i < 5; i++ {
+		topic.PutMessage(NewMessage(topic.GenerateID(), []byte("mirrored")))
+	}
+	for i := 0; i < 100 && ch1.Depth() < 15; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	test.Equal(t, int64(15), ch1.Depth())
+	test.Equal(t, int64(15), ch2.Depth())
+
+	url = fmt.Sprintf("http://%s/topic/migrate/cancel?topic=%s", httpAddr, topicName)
+	resp, err = http.Post(url, "application/octet-stream", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	err = json.Unmarshal(body, &stats)
+	test.Nil(t, err)
+	test.Equal(t, MigrationCanceled, stats.State)
+	test.Equal(t, uint64(5), stats.MirrorCount)
+}
+
+func TestHTTPTopicDeleteDrain(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_delete_drain" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	for i := 0; i < 2; i++ {
+		topic.PutMessage(NewMessage(topic.GenerateID(), []byte("backlog")))
+	}
+
+	url := fmt.Sprintf("http://%s/topic/delete?topic=%s", httpAddr, topicName)
+	resp, err := http.Get(url)
+	test.Nil(t, err)
+	test.Equal(t, 404, resp.StatusCode)
+	resp.Body.Close()
+
+	resp, err = http.Post(url+"&drain=true", "application/octet-stream", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	var stats DrainStats
+	err = json.Unmarshal(body, &stats)
+	test.Nil(t, err)
+	test.Equal(t, int64(2), stats.InitialDepth)
+
+	// publishes are refused
+	pubURL := fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName)
+	resp, err = http.Post(pubURL, "application/octet-stream", bytes.NewBufferString("late"))
+	test.Nil(t, err)
+	test.Equal(t, 409, resp.StatusCode)
+	resp.Body.Close()
+
+	// deleted once consumed
+	for i := 0; i < 2; i++ {
+		msg := <-channel.memoryMsgChan
+		channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+		stats, _ = topic.DrainStats()
+		test.Equal(t, int64(2-i), stats.Depth)
+		channel.FinishMessage(0, msg.ID)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err = nsqd.GetExistingTopic(topicName); err != nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	test.NotNil(t, err)
+
+	// or after the timeout regardless
+	topic = nsqd.GetTopic(topicName)
+	topic.GetChannel("ch")
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("unconsumed")))
+	resp, err = http.Post(url+"&drain=true&drain_timeout=100ms", "application/octet-stream", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+	for i := 0; i < 100; i++ {
+		if _, err = nsqd.GetExistingTopic(topicName); err != nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	test.NotNil(t, err)
+}
+
+func TestHTTPLoadgen(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_loadgen" + strconv.Itoa(int(time.Now().Unix()))
+	url := fmt.Sprintf("http://%s/debug/loadgen?topic=%s&rate=1000&size=10&duration=200ms", httpAddr, topicName)
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 403, resp.StatusCode)
+	resp.Body.Close()
+
+	opts.LoadgenEnabled = true
+	nsqd.swapOpts(opts)
+
+	resp, err = http.Post(strings.Replace(url, "size=10", "size=0", 1), "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 400, resp.StatusCode)
+	resp.Body.Close()
+
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	var result loadgenResult
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	test.Nil(t, err)
+	test.Equal(t, topicName, result.Topic)
+	test.Equal(t, 10, result.Size)
+	test.Equal(t, "", result.Error)
+	if result.Published < 150 || result.Published > 201 {
+		t.Fatalf("published %d messages, expected ~200", result.Published)
+	}
+
+	topic, err := nsqd.GetExistingTopic(topicName)
+	test.Nil(t, err)
+	test.Equal(t, result.Published, topic.Depth())
+}
+
+func TestHTTPChannelTransfer(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_channel_transfer" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	mainChannel := topic.GetChannel("main")
+	quarantine := topic.GetChannel("quarantine")
+	for i := 0; i < 5; i++ {
+		quarantine.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+	}
+
+	transfer := func(action string, to string) (int, int64) {
+		url := fmt.Sprintf("http://%s/channel/%s?topic=%s&from=quarantine&to=%s", httpAddr, action, topicName, to)
+		resp, err := http.Post(url, "application/json", nil)
+		test.Nil(t, err)
+		defer resp.Body.Close()
+		var r struct {
+			Count int64 `json:"count"`
+		}
+		json.NewDecoder(resp.Body).Decode(&r)
+		return resp.StatusCode, r.Count
+	}
+
+	status, _ := transfer("copy", "missing")
+	test.Equal(t, 404, status)
+
+	status, count := transfer("copy", "main")
+	test.Equal(t, 200, status)
+	test.Equal(t, int64(5), count)
+	test.Equal(t, int64(5), quarantine.Depth())
+	test.Equal(t, int64(5), mainChannel.Depth())
+
+	status, count = transfer("move", "main")
+	test.Equal(t, 200, status)
+	test.Equal(t, int64(5), count)
+	test.Equal(t, int64(0), quarantine.Depth())
+	test.Equal(t, int64(10), mainChannel.Depth())
+}
+
+func TestHTTPTopicRename(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_topic_rename" + strconv.Itoa(int(time.Now().Unix()))
+	newName := topicName + "_v2"
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	channel.Pause()
+	channel.SetMaxClients(2)
+	for i := 0; i < 5; i++ {
+		topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+	}
+	nsqd.GetTopic("existing")
+
+	url := fmt.Sprintf("http://%s/topic/rename?topic=%s&to=existing", httpAddr, topicName)
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 409, resp.StatusCode)
+	resp.Body.Close()
+
+	url = fmt.Sprintf("http://%s/topic/rename?topic=%s&to=%s", httpAddr, topicName, newName)
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+
+	_, err = nsqd.GetExistingTopic(topicName)
+	test.NotNil(t, err)
+	topic, err = nsqd.GetExistingTopic(newName)
+	test.Nil(t, err)
+	channel, err = topic.GetExistingChannel("ch")
+	test.Nil(t, err)
+	test.Equal(t, true, channel.IsPaused())
+	test.Equal(t, 2, channel.MaxClients())
+	for i := 0; i < 100 && channel.Depth() < 5; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, int64(5), channel.Depth())
+}
+
+func TestHTTPChannelAudit(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.AuditLogMaxBytes = 500
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_channel_audit" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	url := fmt.Sprintf("http://%s/channel/create?topic=%s&channel=ch&audit_log=true", httpAddr, topicName)
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(5).WriteTo(conn)
+	test.Nil(t, err)
+
+	for i := 0; i < 5; i++ {
+		topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+	}
+	var ids []string
+	for i := 0; i < 5; i++ {
+		resp, _ := nsq.ReadResponse(conn)
+		_, data, _ := nsq.UnpackResponse(resp)
+		msg, err := decodeMessage(data)
+		test.Nil(t, err)
+		ids = append(ids, string(msg.ID[:]))
+		_, err = nsq.Finish(nsq.MessageID(msg.ID)).WriteTo(conn)
+		test.Nil(t, err)
+	}
+
+	query := func(params string) []AuditRecord {
+		url := fmt.Sprintf("http://%s/channel/audit?topic=%s&channel=ch%s", httpAddr, topicName, params)
+		resp, err := http.Get(url)
+		test.Nil(t, err)
+		defer resp.Body.Close()
+		test.Equal(t, 200, resp.StatusCode)
+		var r struct {
+			Records []AuditRecord `json:"records"`
+		}
+		test.Nil(t, json.NewDecoder(resp.Body).Decode(&r))
+		return r.Records
+	}
+
+	// FIN is asynchronous
+	var records []AuditRecord
+	for i := 0; i < 100 && len(records) < 5; i++ {
+		records = query("")
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, 5, len(records))
+	for i, r := range records {
+		test.Equal(t, ids[i], r.ID)
+		test.Equal(t, "test", r.ClientID)
+		test.Equal(t, uint16(1), r.Attempts)
+	}
+
+	// the log was rotated
+	_, err = os.Stat(path.Join(opts.DataPath, getBackendName(topicName, "ch")+".audit.log.1"))
+	test.Nil(t, err)
+
+	records = query("&id=" + ids[2])
+	test.Equal(t, 1, len(records))
+	test.Equal(t, ids[2], records[0].ID)
+	test.Equal(t, 2, len(query("&limit=2")))
+}
+
+func TestHTTPHealth(t *testing.T) {
+	lopts := nsqlookupd.NewOptions()
+	lopts.Logger = test.NewTestLogger(t)
+	_, _, lookupd := mustStartNSQLookupd(lopts)
+	defer lookupd.Exit()
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.NSQLookupdTCPAddresses = []string{lookupd.RealTCPAddr().String(), "127.0.0.1:1"}
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	nsqd.GetTopic("test_http_health")
+	time.Sleep(50 * time.Millisecond)
+
+	getHealth := func(verbose bool) (int, string) {
+		url := fmt.Sprintf("http://%s/health?verbose=%t", httpAddr, verbose)
+		resp, err := http.Get(url)
+		test.Nil(t, err)
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	checks := func(body string) map[string]HealthCheck {
+		var h Health
+		test.Nil(t, json.Unmarshal([]byte(body), &h))
+		m := make(map[string]HealthCheck)
+		for _, c := range h.Checks {
+			m[c.Name] = c
+		}
+		return m
+	}
+
+	// an unreachable nsqlookupd only warns
+	code, body := getHealth(false)
+	test.Equal(t, 200, code)
+	test.Equal(t, "OK - lookupd:127.0.0.1:1 warn - no response yet", body)
+
+	code, body = getHealth(true)
+	test.Equal(t, 200, code)
+	c := checks(body)
+	test.Equal(t, HealthOK, c["health"].Status)
+	test.Equal(t, HealthOK, c["writable:"+opts.DataPath].Status)
+	test.Equal(t, HealthOK, c["free_space:"+opts.DataPath].Status)
+	test.Equal(t, HealthOK, c["lookupd:"+lookupd.RealTCPAddr().String()].Status)
+	test.Equal(t, HealthWarn, c["lookupd:127.0.0.1:1"].Status)
+	test.Equal(t, HealthOK, c["metadata"].Status)
+	test.Equal(t, "persisted 0s ago", c["metadata"].Message)
+
+	newOpts := *opts
+	newOpts.HealthMinFreeBytes = math.MaxInt64
+	nsqd.swapOpts(&newOpts)
+
+	code, body = getHealth(true)
+	test.Equal(t, 500, code)
+	c = checks(body)
+	test.Equal(t, HealthFail, c["free_space:"+opts.DataPath].Status)
+
+	code, body = getHealth(false)
+	test.Equal(t, 500, code)
+	test.Equal(t, true, strings.HasPrefix(body, "NOK - free_space:"+opts.DataPath+" fail - "))
+}
+
+func TestHTTPDump(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	nsqd.GetTopic("test_http_dump").GetChannel("ch")
+
+	url := fmt.Sprintf("http://%s/debug/dump", httpAddr)
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	defer resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	var dump struct {
+		Dir string `json:"dir"`
+	}
+	test.Nil(t, json.NewDecoder(resp.Body).Decode(&dump))
+	test.Equal(t, opts.DataPath, path.Dir(dump.Dir))
+
+	for _, fn := range []string{"goroutine.pb.gz", "goroutine.txt", "heap.pb.gz", "mutex.pb.gz", "block.pb.gz"} {
+		_, err := os.Stat(path.Join(dump.Dir, fn))
+		test.Nil(t, err)
+	}
+	data, err := ioutil.ReadFile(path.Join(dump.Dir, "state.json"))
+	test.Nil(t, err)
+	var state dumpState
+	test.Nil(t, json.Unmarshal(data, &state))
+	test.Equal(t, 1, state.Topics)
+	test.Equal(t, 1, state.Channels)
+	test.Equal(t, "test_http_dump", state.Stats[0].TopicName)
+
+	// dumps may only be written under --data-path
+	for _, dir := range []string{os.TempDir(), "..", "a/../../b"} {
+		url := fmt.Sprintf("http://%s/debug/dump?dir=%s", httpAddr, dir)
+		resp, err := http.Post(url, "application/json", nil)
+		test.Nil(t, err)
+		test.Equal(t, 400, resp.StatusCode)
+		resp.Body.Close()
+	}
+}
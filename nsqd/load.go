@@ -0,0 +1,69 @@
+package nsqd
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+// nodeLoad is the load nsqd reports to nsqlookupd with its heartbeats, for
+// /lookup to list less loaded nsqd first
+type nodeLoad struct {
+	// messages queued in topics and channels
+	depth   int64
+	clients int
+	// messages published per second since the last heartbeat
+	publishRate float64
+}
+
+// loadSampler measures the publish rate between samples
+type loadSampler struct {
+	messageCount uint64
+	time         time.Time
+}
+
+func (n *NSQD) sampleLoad(s *loadSampler) nodeLoad {
+	var load nodeLoad
+	var messageCount uint64
+
+	n.RLock()
+	topics := make([]*Topic, 0, len(n.topicMap))
+	for _, t := range n.topicMap {
+		topics = append(topics, t)
+	}
+	n.RUnlock()
+	for _, t := range topics {
+		load.depth += t.Depth()
+		for _, c := range t.loadChannels() {
+			load.depth += c.Depth()
+		}
+		messageCount += atomic.LoadUint64(&t.messageCount)
+	}
+
+	n.clientLock.RLock()
+	load.clients = len(n.clients)
+	n.clientLock.RUnlock()
+
+	now := time.Now()
+	// deleted topics take their counts along
+	if !s.time.IsZero() && messageCount >= s.messageCount {
+		load.publishRate = float64(messageCount-s.messageCount) / now.Sub(s.time).Seconds()
+	}
+	s.messageCount = messageCount
+	s.time = now
+	return load
+}
+
+// pingCommand is a heartbeat reporting load, as PING params that nsqlookupd
+// unaware of them ignore
+func pingCommand(load nodeLoad) *nsq.Command {
+	cmd := nsq.Ping()
+	cmd.Params = [][]byte{
+		[]byte("depth=" + strconv.FormatInt(load.depth, 10)),
+		[]byte("clients=" + strconv.Itoa(load.clients)),
+		[]byte("publish_rate=" + strconv.FormatFloat(load.publishRate, 'f', 2, 64)),
+	}
+	return cmd
+}
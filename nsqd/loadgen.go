@@ -0,0 +1,91 @@
+package nsqd
+
+import (
+	"crypto/rand"
+	"time"
+
+	"github.com/nsqio/nsq/internal/quantile"
+)
+
+// loadgenBatchSize is the most messages put on a topic at once
+const loadgenBatchSize = 100
+
+type loadgenResult struct {
+	Topic           string           `json:"topic"`
+	TargetRate      int64            `json:"target_rate"`
+	Size            int              `json:"size"`
+	DurationSeconds float64          `json:"duration_seconds"`
+	Published       int64            `json:"published"`
+	Rate            float64          `json:"rate"`
+	PutLatency      *quantile.Result `json:"put_latency"`
+	Error           string           `json:"error,omitempty"`
+}
+
+// loadgen puts synthesized messages of size bytes on topic at rate per second
+// (0 as fast as possible) for d, or until stopChan is closed or a put fails,
+// so that capacity tests can measure nsqd without clients or the network
+// limiting them. Messages that fall behind schedule are put as soon as
+// possible, in batches of up to loadgenBatchSize.
+func loadgen(topic *Topic, rate int64, size int, d time.Duration, stopChan <-chan struct{}) *loadgenResult {
+	r := &loadgenResult{
+		Topic:      topic.name,
+		TargetRate: rate,
+		Size:       size,
+	}
+	body := make([]byte, size)
+	rand.Read(body)
+	// long enough that no latencies are discarded
+	putLatency := quantile.New(4*d, []float64{0.5, 0.99, 0.999, 1.0})
+
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	start := time.Now()
+loop:
+	for {
+		elapsed := time.Since(start)
+		if elapsed >= d {
+			break
+		}
+		n := int64(loadgenBatchSize)
+		if rate > 0 {
+			n = int64(float64(rate)*elapsed.Seconds()) - r.Published
+			if n > loadgenBatchSize {
+				n = loadgenBatchSize
+			}
+		}
+		if n <= 0 {
+			select {
+			case <-ticker.C:
+				continue
+			case <-stopChan:
+				break loop
+			}
+		}
+		select {
+		case <-stopChan:
+			break loop
+		default:
+		}
+
+		msgs := make([]*Message, n)
+		for i := range msgs {
+			// bodies are only read, so they can be shared
+			msgs[i] = NewMessage(topic.GenerateID(), body)
+			msgs[i].Producer = "loadgen"
+		}
+		putStart := time.Now()
+		err := topic.PutMessages(msgs)
+		putLatency.Insert(putStart.UnixNano())
+		if err != nil {
+			r.Error = err.Error()
+			break
+		}
+		r.Published += n
+	}
+
+	elapsed := time.Since(start)
+	r.DurationSeconds = elapsed.Seconds()
+	r.Rate = float64(r.Published) / elapsed.Seconds()
+	r.PutLatency = putLatency.Result()
+	return r
+}
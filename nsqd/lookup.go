@@ -14,14 +14,7 @@ import (
 
 func connectCallback(n *NSQD, hostname string) func(*lookupPeer) {
 	return func(lp *lookupPeer) {
-		ci := make(map[string]interface{})
-		ci["version"] = version.Binary
-		ci["tcp_port"] = n.RealTCPAddr().Port
-		ci["http_port"] = n.RealHTTPAddr().Port
-		ci["hostname"] = hostname
-		ci["broadcast_address"] = n.getOpts().BroadcastAddress
-
-		cmd, err := nsq.Identify(ci)
+		cmd, err := nsq.Identify(n.lookupPeerInfo(hostname))
 		if err != nil {
 			lp.Close()
 			return
@@ -75,6 +68,48 @@ func connectCallback(n *NSQD, hostname string) func(*lookupPeer) {
 	}
 }
 
+// lookupPeerInfo is what nsqd identifies itself to nsqlookupd with
+func (n *NSQD) lookupPeerInfo(hostname string) map[string]interface{} {
+	ci := make(map[string]interface{})
+	ci["version"] = version.Binary
+	ci["hostname"] = hostname
+	ci["broadcast_address"] = n.getOpts().BroadcastAddress
+	// the ports of broadcast_address for older consumers
+	ci["tcp_port"] = broadcastPort(n.broadcastTCPAddress())
+	ci["http_port"] = broadcastPort(n.broadcastHTTPAddress())
+	ci["broadcast_tcp_address"] = n.broadcastTCPAddress()
+	ci["broadcast_http_address"] = n.broadcastHTTPAddress()
+	if addr := n.broadcastHTTPSAddress(); addr != "" {
+		ci["broadcast_https_address"] = addr
+	}
+	return ci
+}
+
+// updatePeerInfo sends nsqlookupd nsqd's new peer info (see lookupPeerInfo).
+// nsqlookupd that don't support UPDATE are reconnected to, which identifies
+// nsqd anew.
+func (n *NSQD) updatePeerInfo(lp *lookupPeer, hostname string) {
+	body, err := json.Marshal(n.lookupPeerInfo(hostname))
+	if err != nil {
+		n.logf(LOG_ERROR, "LOOKUPD(%s): marshaling peer info - %s", lp, err)
+		return
+	}
+	cmd := &nsq.Command{Name: []byte("UPDATE"), Body: body}
+	n.logf(LOG_INFO, "LOOKUPD(%s): %s", lp, cmd)
+	resp, err := lp.Command(cmd)
+	if err != nil {
+		n.logf(LOG_ERROR, "LOOKUPD(%s): %s - %s", lp, cmd, err)
+		return
+	}
+	if !bytes.Equal(resp, []byte("OK")) {
+		n.logf(LOG_WARN, "LOOKUPD(%s): %s - %s, reconnecting", lp, cmd, resp)
+		lp.Close()
+	}
+}
+
+// lookupHeartbeatInterval is how often nsqd sends nsqlookupd a heartbeat
+const lookupHeartbeatInterval = 15 * time.Second
+
 func (n *NSQD) lookupLoop() {
 	var lookupPeers []*lookupPeer
 	var lookupAddrs []string
@@ -86,8 +121,13 @@ func (n *NSQD) lookupLoop() {
 		os.Exit(1)
 	}
 
+	broadcastAddress := n.getOpts().BroadcastAddress
+	// topics count the messages published since startup, the first heartbeat's
+	// rate is since then (without sampling the topics' backends yet)
+	loadSampler := loadSampler{time: time.Now()}
+
 	// for announcements, lookupd determines the host automatically
-	ticker := time.Tick(15 * time.Second)
+	ticker := time.Tick(lookupHeartbeatInterval)
 	for {
 		if connect {
 			for _, host := range n.getOpts().NSQLookupdTCPAddresses {
@@ -95,7 +135,7 @@ func (n *NSQD) lookupLoop() {
 					continue
 				}
 				n.logf(LOG_INFO, "LOOKUP(%s): adding peer", host)
-				lookupPeer := newLookupPeer(host, n.getOpts().MaxBodySize, n.logf,
+				lookupPeer := newLookupPeer(host, n.getOpts(), n.logf,
 					connectCallback(n, hostname))
 				lookupPeer.Command(nil) // start the connection
 				lookupPeers = append(lookupPeers, lookupPeer)
@@ -108,9 +148,9 @@ func (n *NSQD) lookupLoop() {
 		select {
 		case <-ticker:
 			// send a heartbeat and read a response (read detects closed conns)
+			cmd := pingCommand(n.sampleLoad(&loadSampler))
 			for _, lookupPeer := range lookupPeers {
 				n.logf(LOG_DEBUG, "LOOKUPD(%s): sending heartbeat", lookupPeer)
-				cmd := nsq.Ping()
 				_, err := lookupPeer.Command(cmd)
 				if err != nil {
 					n.logf(LOG_ERROR, "LOOKUPD(%s): %s - %s", lookupPeer, cmd, err)
@@ -163,6 +203,14 @@ func (n *NSQD) lookupLoop() {
 			lookupPeers = tmpPeers
 			lookupAddrs = tmpAddrs
 			connect = true
+
+			// new peers identify with the new address when connecting
+			if addr := n.getOpts().BroadcastAddress; addr != broadcastAddress {
+				broadcastAddress = addr
+				for _, lp := range lookupPeers {
+					n.updatePeerInfo(lp, hostname)
+				}
+			}
 		case <-n.exitChan:
 			goto exit
 		}
@@ -5,10 +5,13 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/nsqio/go-nsq"
+	"github.com/nsqio/nsq/internal/faults"
 	"github.com/nsqio/nsq/internal/lg"
+	"github.com/nsqio/nsq/internal/protocol"
 )
 
 // lookupPeer is a low-level type for connecting/reading/writing to nsqlookupd
@@ -17,12 +20,18 @@ import (
 // gracefully (i.e. it is all handled by the library).  Clients can simply use the
 // Command interface to perform a round-trip.
 type lookupPeer struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	lastResponse int64 // unix nanoseconds of the last round-trip
+
 	logf            lg.AppLogFunc
 	addr            string
 	conn            net.Conn
 	state           int32
 	connectCallback func(*lookupPeer)
 	maxBodySize     int64
+	tcpOptions      protocol.TCPOptions
+	readTimeout     time.Duration
+	writeTimeout    time.Duration
 	Info            peerInfo
 }
 
@@ -37,12 +46,19 @@ type peerInfo struct {
 // newLookupPeer creates a new lookupPeer instance connecting to the supplied address.
 //
 // The supplied connectCallback will be called *every* time the instance connects.
-func newLookupPeer(addr string, maxBodySize int64, l lg.AppLogFunc, connectCallback func(*lookupPeer)) *lookupPeer {
+func newLookupPeer(addr string, opts *Options, l lg.AppLogFunc, connectCallback func(*lookupPeer)) *lookupPeer {
 	return &lookupPeer{
-		logf:            l,
-		addr:            addr,
-		state:           stateDisconnected,
-		maxBodySize:     maxBodySize,
+		logf:        l,
+		addr:        addr,
+		state:       stateDisconnected,
+		maxBodySize: opts.MaxBodySize,
+		tcpOptions: protocol.TCPOptions{
+			KeepAlive:   opts.TCPKeepAlive,
+			UserTimeout: opts.TCPUserTimeout,
+			NoDelay:     opts.TCPNoDelay,
+		},
+		readTimeout:     opts.LookupdReadTimeout,
+		writeTimeout:    opts.LookupdWriteTimeout,
 		connectCallback: connectCallback,
 	}
 }
@@ -54,6 +70,10 @@ func (lp *lookupPeer) Connect() error {
 	if err != nil {
 		return err
 	}
+	err = lp.tcpOptions.Tune(conn)
+	if err != nil {
+		lp.logf(lg.WARN, "LOOKUP failed to tune TCP connection to %s - %s", lp.addr, err)
+	}
 	lp.conn = conn
 	return nil
 }
@@ -65,13 +85,13 @@ func (lp *lookupPeer) String() string {
 
 // Read implements the io.Reader interface, adding deadlines
 func (lp *lookupPeer) Read(data []byte) (int, error) {
-	lp.conn.SetReadDeadline(time.Now().Add(time.Second))
+	lp.conn.SetReadDeadline(time.Now().Add(lp.readTimeout))
 	return lp.conn.Read(data)
 }
 
 // Write implements the io.Writer interface, adding deadlines
 func (lp *lookupPeer) Write(data []byte) (int, error) {
-	lp.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	lp.conn.SetWriteDeadline(time.Now().Add(lp.writeTimeout))
 	return lp.conn.Write(data)
 }
 
@@ -118,11 +138,13 @@ func (lp *lookupPeer) Command(cmd *nsq.Command) ([]byte, error) {
 		lp.Close()
 		return nil, err
 	}
+	faults.Sleep(faults.LookupdDelay)
 	resp, err := readResponseBounded(lp, lp.maxBodySize)
 	if err != nil {
 		lp.Close()
 		return nil, err
 	}
+	atomic.StoreInt64(&lp.lastResponse, time.Now().UnixNano())
 	return resp, nil
 }
 
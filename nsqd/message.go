@@ -4,15 +4,55 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/nsqio/nsq/internal/timingwheel"
+)
+
+const (
+	MsgIDLength         = 16
+	minValidMsgLength   = MsgIDLength + 8 + 2       // Timestamp + Attempts
+	minValidMsgV2Length = minValidMsgLength + 4 + 2 // Checksum + Producer length
+
+	// maxProducerLength bounds the producer address in the v2 envelope
+	maxProducerLength = 255
+	// MaxKeyLength bounds the routing key of a message
+	MaxKeyLength = 255
+	// MaxHopsLength bounds the hops of a message, see Message.Hops
+	MaxHopsLength = 4096
+	// maxMsgOverhead is the most a message written to a backend adds to its body
+	maxMsgOverhead = minValidMsgV2Length + maxProducerLength + 8 + 2 + MaxHopsLength + 2 + MaxKeyLength
 )
 
+// the message envelopes a client can negotiate with IDENTIFY
 const (
-	MsgIDLength       = 16
-	minValidMsgLength = MsgIDLength + 8 + 2 // Timestamp + Attempts
+	MsgEnvelopeV1 = 1
+	MsgEnvelopeV2 = 2
+	MsgEnvelopeV3 = 3
 )
 
+// extendedMsgFlag is set in the timestamp of messages written to a backend
+// in the v2 envelope (timestamps are never negative), see Message.writeTo
+const extendedMsgFlag = 1 << 63
+
+// keyedMsgFlag is set in the timestamp of messages written to a backend with a
+// routing key, which follows the producer address
+const keyedMsgFlag = 1 << 62
+
+// eventTimeFlag and hopsFlag are set in the producer length of messages in the
+// v2 envelope written to a backend (or in the v3 envelope) with an event
+// timestamp or hops, which follow the producer address
+const (
+	eventTimeFlag = 1 << 15
+	hopsFlag      = 1 << 14
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
 type MessageID [MsgIDLength]byte
 
 type Message struct {
@@ -20,21 +60,92 @@ type Message struct {
 	Body      []byte
 	Timestamp int64
 	Attempts  uint16
+	Checksum  uint32 // CRC-32C of Body
+	Producer  string // address of the client that published it
+	Key       string // routing key, see Channel.SetKeyRouting
+
+	// when the event the message is about happened (nanoseconds), supplied by
+	// the producer (0 if it wasn't), whereas Timestamp is when nsqd received it
+	EventTimestamp int64
+	// the path of the message with --record-hops, oldest first and separated by
+	// commas, each the address of the client that published it and of the nsqd
+	// it was published to (producer@nsqd), see NSQD.recordHop
+	Hops string
 
 	// for in-flight handling
 	deliveryTS time.Time
 	clientID   int64
-	pri        int64
-	index      int
 	deferred   time.Duration
+
+	// the in-flight (or deferred) timeout, see Channel.processTimeouts
+	timer           timingwheel.Timer
+	timeoutChannel  *Channel
+	deferredTimeout bool
+
+	// references to the message, see retain
+	refs int32
+}
+
+// Messages are reused (see releaseMessage) so a Message has a single owner at a time:
+// whoever publishes it gives it up to the topic, the topic gives it (or a copy per
+// channel) up to the channels and a channel keeps it until it is finished (or
+// dropped, or written to the backend), when it is released. A client's messagePump
+// keeps a reference of its own while it writes a message it put in flight.
+//
+// Bodies are not pooled: the copies of a message share its body, and batched
+// writes (see clientV2.queueMessage) and backend writes reference it after the
+// message was released.
+var messagePool = sync.Pool{
+	New: func() interface{} {
+		return &Message{}
+	},
+}
+
+// getMessage returns a zero Message from the pool, referenced once
+func getMessage() *Message {
+	m := messagePool.Get().(*Message)
+	m.refs = 1
+	return m
 }
 
 func NewMessage(id MessageID, body []byte) *Message {
-	return &Message{
-		ID:        id,
-		Body:      body,
-		Timestamp: time.Now().UnixNano(),
+	m := getMessage()
+	m.ID = id
+	m.Body = body
+	m.Timestamp = time.Now().UnixNano()
+	m.Checksum = crc32.Checksum(body, crc32cTable)
+	return m
+}
+
+// copy returns a new Message with the same ID, body and annotations
+func (m *Message) copy() *Message {
+	c := getMessage()
+	c.ID = m.ID
+	c.Body = m.Body
+	c.Timestamp = m.Timestamp
+	c.Checksum = m.Checksum
+	c.Producer = m.Producer
+	c.Key = m.Key
+	c.EventTimestamp = m.EventTimestamp
+	c.Hops = m.Hops
+	c.deferred = m.deferred
+	return c
+}
+
+// retain adds a reference to m for a goroutine that keeps reading it after giving
+// it up, which releases it when it's done
+func (m *Message) retain() {
+	atomic.AddInt32(&m.refs, 1)
+}
+
+// releaseMessage drops a reference to m, returning it to the pool once there are
+// none left. m must not be referenced afterwards
+func releaseMessage(m *Message) {
+	if atomic.AddInt32(&m.refs, -1) > 0 {
+		return
 	}
+	*m = Message{}
+	messagePool.Put(m)
 }
 
 func (m *Message) WriteTo(w io.Writer) (int64, error) {
@@ -65,6 +176,151 @@ func (m *Message) WriteTo(w io.Writer) (int64, error) {
 	return total, nil
 }
 
+// appendHeader appends the message as written by WriteTo (or WriteToV2 for
+// MsgEnvelopeV2, WriteToV3 for MsgEnvelopeV3) apart from the body to b
+func (m *Message) appendHeader(b []byte, envelope int32) []byte {
+	var buf [10]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(m.Timestamp))
+	binary.BigEndian.PutUint16(buf[8:10], uint16(m.Attempts))
+	b = append(b, buf[:10]...)
+	b = append(b, m.ID[:]...)
+	if envelope != MsgEnvelopeV2 && envelope != MsgEnvelopeV3 {
+		return b
+	}
+
+	producer := m.Producer
+	if len(producer) > maxProducerLength {
+		producer = producer[:maxProducerLength]
+	}
+	binary.BigEndian.PutUint32(buf[:4], m.Checksum)
+	binary.BigEndian.PutUint16(buf[4:6], m.producerLen(producer, envelope == MsgEnvelopeV3))
+	b = append(b, buf[:6]...)
+	b = append(b, producer...)
+	if envelope != MsgEnvelopeV3 {
+		return b
+	}
+	if m.EventTimestamp != 0 {
+		binary.BigEndian.PutUint64(buf[:8], uint64(m.EventTimestamp))
+		b = append(b, buf[:8]...)
+	}
+	if m.Hops != "" {
+		binary.BigEndian.PutUint16(buf[:2], uint16(len(m.Hops)))
+		b = append(b, buf[:2]...)
+		b = append(b, m.Hops...)
+	}
+	return b
+}
+
+// producerLen returns the producer length of the v2 envelope, with the flags of
+// the annotations that follow the producer when they're included
+func (m *Message) producerLen(producer string, annotations bool) uint16 {
+	producerLen := uint16(len(producer))
+	if annotations && m.EventTimestamp != 0 {
+		producerLen |= eventTimeFlag
+	}
+	if annotations && m.Hops != "" {
+		producerLen |= hopsFlag
+	}
+	return producerLen
+}
+
+// WriteToV2 writes the message in the v2 envelope (see decodeMessageV2)
+func (m *Message) WriteToV2(w io.Writer) (int64, error) {
+	return m.writeToV2(w, 0, false)
+}
+
+// WriteToV3 writes the message in the v3 envelope, the v2 envelope with the
+// event timestamp and hops (see decodeMessageV2)
+func (m *Message) WriteToV3(w io.Writer) (int64, error) {
+	return m.writeToV2(w, 0, true)
+}
+
+func (m *Message) writeToV2(w io.Writer, flags uint64, annotations bool) (int64, error) {
+	var buf [16]byte
+	var total int64
+
+	producer := m.Producer
+	if len(producer) > maxProducerLength {
+		producer = producer[:maxProducerLength]
+	}
+
+	binary.BigEndian.PutUint64(buf[:8], uint64(m.Timestamp)|flags)
+	binary.BigEndian.PutUint16(buf[8:10], uint16(m.Attempts))
+
+	n, err := w.Write(buf[:10])
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = w.Write(m.ID[:])
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	binary.BigEndian.PutUint32(buf[10:14], m.Checksum)
+	binary.BigEndian.PutUint16(buf[14:16], m.producerLen(producer, annotations))
+	n, err = w.Write(buf[10:16])
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	n, err = io.WriteString(w, producer)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	if annotations && m.EventTimestamp != 0 {
+		binary.BigEndian.PutUint64(buf[:8], uint64(m.EventTimestamp))
+		n, err = w.Write(buf[:8])
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+
+	if annotations && m.Hops != "" {
+		binary.BigEndian.PutUint16(buf[:2], uint16(len(m.Hops)))
+		n, err = w.Write(buf[:2])
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+
+		n, err = io.WriteString(w, m.Hops)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+
+	if flags&keyedMsgFlag != 0 {
+		binary.BigEndian.PutUint16(buf[:2], uint16(len(m.Key)))
+		n, err = w.Write(buf[:2])
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+
+		n, err = io.WriteString(w, m.Key)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+
+	n, err = w.Write(m.Body)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	return total, nil
+}
+
 // decodeMessage deserializes data (as []byte) and creates a new Message
 // message format:
 // [x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x]...
@@ -75,26 +331,142 @@ func (m *Message) WriteTo(w io.Writer) (int64, error) {
 //                        (uint16)
 //                         2-byte
 //                        attempts
+//
+// messages written to a backend in the v2 envelope have extendedMsgFlag set in
+// the timestamp (see Message.writeTo), others are in the format above
 func decodeMessage(b []byte) (*Message, error) {
-	var msg Message
-
 	if len(b) < minValidMsgLength {
 		return nil, fmt.Errorf("invalid message buffer size (%d)", len(b))
 	}
 
-	msg.Timestamp = int64(binary.BigEndian.Uint64(b[:8]))
+	ts := binary.BigEndian.Uint64(b[:8])
+	if ts&extendedMsgFlag != 0 {
+		return decodeMessageV2(b)
+	}
+
+	msg := getMessage()
+	msg.Timestamp = int64(ts)
 	msg.Attempts = binary.BigEndian.Uint16(b[8:10])
 	copy(msg.ID[:], b[10:10+MsgIDLength])
 	msg.Body = b[10+MsgIDLength:]
+	msg.Checksum = crc32.Checksum(msg.Body, crc32cTable)
 
-	return &msg, nil
+	return msg, nil
 }
 
-func writeMessageToBackend(buf *bytes.Buffer, msg *Message, bq BackendQueue) error {
+// decodeMessageV2 deserializes data in the v2 envelope and creates a new Message
+// message format:
+// [x][x][x][x][x][x][x][x][x][x][x][x]...[x][x][x][x][x][x][x][x][x][x]...[x][x]...
+// |       (int64)        ||    ||  16-byte  ||  (uint32)  ||    ||  N-byte  || N-byte
+// |       8-byte         ||    || message ID||   4-byte   ||    || producer || body
+// --------------------------------------------------------------------------------...
+//   nanosecond timestamp    ^^                 CRC-32C of    ^^   address of the
+//   (received by nsqd)   (uint16)             the body    (uint16)  publishing client
+//                         2-byte                           2-byte
+//                        attempts                          producer length
+//
+// with eventTimeFlag set in the producer length, an 8-byte (int64) event
+// timestamp follows the producer address, then with hopsFlag set a 2-byte
+// (uint16) hops length and the hops, and with keyedMsgFlag set in the
+// timestamp, a 2-byte (uint16) key length and the routing key follow these
+func decodeMessageV2(b []byte) (*Message, error) {
+	if len(b) < minValidMsgV2Length {
+		return nil, fmt.Errorf("invalid message buffer size (%d)", len(b))
+	}
+
+	pos := 10 + MsgIDLength
+	producerFlags := binary.BigEndian.Uint16(b[pos+4 : pos+6])
+	producerLen := int(producerFlags &^ (eventTimeFlag | hopsFlag))
+	if len(b) < pos+6+producerLen {
+		return nil, fmt.Errorf("invalid message buffer size (%d)", len(b))
+	}
+
+	ts := binary.BigEndian.Uint64(b[:8])
+	var eventTimestamp int64
+	keyPos := pos + 6 + producerLen
+	if producerFlags&eventTimeFlag != 0 {
+		if len(b) < keyPos+8 {
+			return nil, fmt.Errorf("invalid message buffer size (%d)", len(b))
+		}
+		eventTimestamp = int64(binary.BigEndian.Uint64(b[keyPos : keyPos+8]))
+		keyPos += 8
+	}
+	var hops string
+	if producerFlags&hopsFlag != 0 {
+		if len(b) < keyPos+2 {
+			return nil, fmt.Errorf("invalid message buffer size (%d)", len(b))
+		}
+		hopsLen := int(binary.BigEndian.Uint16(b[keyPos : keyPos+2]))
+		if len(b) < keyPos+2+hopsLen {
+			return nil, fmt.Errorf("invalid message buffer size (%d)", len(b))
+		}
+		hops = string(b[keyPos+2 : keyPos+2+hopsLen])
+		keyPos += 2 + hopsLen
+	}
+	var key string
+	bodyPos := keyPos
+	if ts&keyedMsgFlag != 0 {
+		if len(b) < keyPos+2 {
+			return nil, fmt.Errorf("invalid message buffer size (%d)", len(b))
+		}
+		keyLen := int(binary.BigEndian.Uint16(b[keyPos : keyPos+2]))
+		bodyPos = keyPos + 2 + keyLen
+		if len(b) < bodyPos {
+			return nil, fmt.Errorf("invalid message buffer size (%d)", len(b))
+		}
+		key = string(b[keyPos+2 : bodyPos])
+	}
+
+	msg := getMessage()
+	msg.Timestamp = int64(ts &^ (extendedMsgFlag | keyedMsgFlag))
+	msg.Attempts = binary.BigEndian.Uint16(b[8:10])
+	copy(msg.ID[:], b[10:10+MsgIDLength])
+	msg.Checksum = binary.BigEndian.Uint32(b[pos : pos+4])
+	pos += 6
+	msg.Producer = string(b[pos : pos+producerLen])
+	msg.Key = key
+	msg.EventTimestamp = eventTimestamp
+	msg.Hops = hops
+	msg.Body = b[bodyPos:]
+
+	return msg, nil
+}
+
+// writeTo writes the message as stored in a backend (see decodeMessage), in the
+// v1 envelope that older versions read unless envelope (--backend-msg-envelope) is
+// MsgEnvelopeV2 or the message has a routing key, event timestamp or hops that
+// only the v2 envelope keeps. Older versions can't read the v2 envelope, so
+// nsqd can't be downgraded while its backends hold such messages.
+func (m *Message) writeTo(w io.Writer, envelope int) (int64, error) {
+	switch {
+	case m.Key != "":
+		return m.writeToV2(w, extendedMsgFlag|keyedMsgFlag, true)
+	case envelope == MsgEnvelopeV2 || m.EventTimestamp != 0 || m.Hops != "":
+		return m.writeToV2(w, extendedMsgFlag, true)
+	}
+	return m.WriteTo(w)
+}
+
+func writeMessageToBackend(buf *bytes.Buffer, msg *Message, bq BackendQueue, envelope int) error {
 	buf.Reset()
-	_, err := msg.WriteTo(buf)
+	_, err := msg.writeTo(buf, envelope)
 	if err != nil {
 		return err
 	}
 	return bq.Put(buf.Bytes())
 }
+
+// writeMessageToBackendSync is like writeMessageToBackend but returns only once
+// the message is fsynced (when supported by the backend)
+func writeMessageToBackendSync(buf *bytes.Buffer, msg *Message, bq BackendQueue, envelope int) error {
+	sbq, ok := bq.(syncBackendQueue)
+	if !ok {
+		return writeMessageToBackend(buf, msg, bq, envelope)
+	}
+	buf.Reset()
+	_, err := msg.writeTo(buf, envelope)
+	if err != nil {
+		return err
+	}
+	return sbq.PutSync(buf.Bytes())
+}
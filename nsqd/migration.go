@@ -0,0 +1,485 @@
+package nsqd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nsqio/nsq/internal/http_api"
+	"github.com/nsqio/nsq/internal/util"
+)
+
+const (
+	// MigrationDraining is the state of a migration while new messages are
+	// forwarded to the target and the backlog of each channel is moved to it
+	MigrationDraining = "draining"
+	// MigrationComplete is the state of a migration once the backlog has been
+	// moved and this node has been tombstoned; any message still published to
+	// the topic here continues to be forwarded to the target
+	MigrationComplete = "complete"
+	// MigrationCanceled is the state of a migration stopped before the topic
+	// was deleted, messages not yet forwarded stay on this node
+	MigrationCanceled = "canceled"
+)
+
+const (
+	migrationMaxBatch   = 256
+	migrationRetryDelay = time.Second
+	migrationPollDelay  = 100 * time.Millisecond
+)
+
+var (
+	ErrMigrationInProgress = errors.New("migration in progress")
+	ErrNoMigration         = errors.New("no migration in progress")
+)
+
+// topicMigration moves a topic to another nsqd: messages published to the topic
+// are forwarded to the target, the backlog of each channel is drained into the
+// same channel on the target and, finally, this node is tombstoned for the topic
+// on all nsqlookupd and its (now empty) channels deleted so that consumers move
+// to the target
+type topicMigration struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	mirrorCount uint64
+	drainCount  uint64
+
+	topic     *Topic
+	target    string
+	startTime time.Time
+	client    *http_api.Client
+
+	mirrorChan chan *Message
+	exitChan   chan int
+	exitOnce   sync.Once
+	waitGroup  util.WaitGroupWrapper
+
+	sync.Mutex
+	state   string
+	lastErr string
+	created map[string]bool
+}
+
+// MigrationStats reports the progress of a topic migration
+type MigrationStats struct {
+	TopicName   string `json:"topic_name"`
+	Target      string `json:"target"`
+	State       string `json:"state"`
+	Error       string `json:"error,omitempty"`
+	StartTime   int64  `json:"start_time"`
+	MirrorCount uint64 `json:"mirror_count"`
+	DrainCount  uint64 `json:"drain_count"`
+	Depth       int64  `json:"depth"`
+}
+
+// Migrate starts moving the topic to the nsqd whose HTTP address is target
+//
+// the topic and its channels are created on the target before this returns,
+// the rest of the migration happens in the background, see MigrationStats
+func (t *Topic) Migrate(target string) error {
+	if m := t.getMigration(); m != nil && m.active() {
+		return ErrMigrationInProgress
+	}
+	if t.draining() {
+		return ErrTopicDraining
+	}
+
+	opts := t.ctx.nsqd.getOpts()
+	m := &topicMigration{
+		topic:      t,
+		target:     target,
+		startTime:  time.Now(),
+		client:     http_api.NewClient(nil, opts.HTTPClientConnectTimeout, opts.HTTPClientRequestTimeout),
+		mirrorChan: make(chan *Message, migrationMaxBatch),
+		exitChan:   make(chan int),
+		state:      MigrationDraining,
+		created:    make(map[string]bool),
+	}
+
+	// channels must exist on the target before messages are forwarded to it,
+	// otherwise the first channel created there would receive all of them
+	endpoint := fmt.Sprintf("http://%s/topic/create?topic=%s", target, url.QueryEscape(t.name))
+	err := m.client.POSTV1(endpoint)
+	if err != nil {
+		return err
+	}
+	for _, c := range t.loadChannels() {
+		err = m.createChannel(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	t.Lock()
+	if old := t.getMigration(); old != nil && old.active() {
+		t.Unlock()
+		return ErrMigrationInProgress
+	}
+	t.migration.Store(m)
+	t.Unlock()
+
+	t.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): migrating to %s", t.name, target)
+
+	m.waitGroup.Wrap(m.mirrorLoop)
+	m.waitGroup.Wrap(m.drainLoop)
+	t.notifyChannelUpdate()
+	return nil
+}
+
+// CancelMigration stops forwarding messages to the target of the topic's migration
+func (t *Topic) CancelMigration() error {
+	m := t.getMigration()
+	if m == nil || !m.active() {
+		return ErrNoMigration
+	}
+	m.stop()
+	m.setState(MigrationCanceled)
+	t.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): migration to %s canceled", t.name, m.target)
+	t.notifyChannelUpdate()
+	return nil
+}
+
+// MigrationStats returns the progress of the topic's current (or last) migration
+func (t *Topic) MigrationStats() (MigrationStats, bool) {
+	m := t.getMigration()
+	if m == nil {
+		return MigrationStats{}, false
+	}
+	m.Lock()
+	defer m.Unlock()
+	return MigrationStats{
+		TopicName:   t.name,
+		Target:      m.target,
+		State:       m.state,
+		Error:       m.lastErr,
+		StartTime:   m.startTime.Unix(),
+		MirrorCount: atomic.LoadUint64(&m.mirrorCount),
+		DrainCount:  atomic.LoadUint64(&m.drainCount),
+		Depth:       m.depth(),
+	}, true
+}
+
+func (t *Topic) getMigration() *topicMigration {
+	return t.migration.Load().(*topicMigration)
+}
+
+// mirroring reports whether messages are forwarded rather than delivered to channels
+func (t *Topic) mirroring() bool {
+	m := t.getMigration()
+	return m != nil && m.active()
+}
+
+func (m *topicMigration) active() bool {
+	select {
+	case <-m.exitChan:
+		return false
+	default:
+		return true
+	}
+}
+
+func (m *topicMigration) stop() {
+	m.exitOnce.Do(func() {
+		close(m.exitChan)
+	})
+	m.waitGroup.Wait()
+}
+
+func (m *topicMigration) setState(state string) {
+	m.Lock()
+	m.state = state
+	m.Unlock()
+}
+
+func (m *topicMigration) setError(err error) {
+	m.Lock()
+	if err != nil {
+		m.lastErr = err.Error()
+	} else {
+		m.lastErr = ""
+	}
+	m.Unlock()
+}
+
+// depth is the number of messages that remain to be moved
+func (m *topicMigration) depth() int64 {
+	depth := m.topic.Depth() + int64(len(m.mirrorChan))
+	for _, c := range m.topic.loadChannels() {
+		depth += c.Depth() + channelPending(c)
+	}
+	return depth
+}
+
+// mirror hands a message published to the topic over to be forwarded, it
+// returns false if the migration has stopped and the message should be delivered
+// to the topic's channels instead
+func (m *topicMigration) mirror(msg *Message) bool {
+	select {
+	case m.mirrorChan <- msg:
+		return true
+	case <-m.exitChan:
+		return false
+	}
+}
+
+func (m *topicMigration) createChannel(c *Channel) error {
+	m.Lock()
+	created := m.created[c.name]
+	m.Unlock()
+	if created {
+		return nil
+	}
+
+	endpoint := fmt.Sprintf("http://%s/channel/create?topic=%s&channel=%s",
+		m.target, url.QueryEscape(m.topic.name), url.QueryEscape(c.name))
+	err := m.client.POSTV1(endpoint)
+	if err != nil {
+		return err
+	}
+	if c.IsPaused() {
+		endpoint = fmt.Sprintf("http://%s/channel/pause?topic=%s&channel=%s",
+			m.target, url.QueryEscape(m.topic.name), url.QueryEscape(c.name))
+		err = m.client.POSTV1(endpoint)
+		if err != nil {
+			return err
+		}
+	}
+
+	m.Lock()
+	m.created[c.name] = true
+	m.Unlock()
+	return nil
+}
+
+// mirrorLoop forwards the messages published to the topic to the target topic
+func (m *topicMigration) mirrorLoop() {
+	var msgs []*Message
+	endpoint := fmt.Sprintf("http://%s/mpub?topic=%s&binary=true", m.target, url.QueryEscape(m.topic.name))
+
+	for {
+		select {
+		case msg := <-m.mirrorChan:
+			msgs = append(msgs[:0], msg)
+		case <-m.exitChan:
+			goto exit
+		}
+	batch:
+		for len(msgs) < migrationMaxBatch {
+			select {
+			case msg := <-m.mirrorChan:
+				msgs = append(msgs, msg)
+			default:
+				break batch
+			}
+		}
+
+		if !m.forwardMirrored(endpoint, msgs) {
+			m.requeueMirrored(msgs)
+			goto exit
+		}
+		atomic.AddUint64(&m.mirrorCount, uint64(len(msgs)))
+		for _, msg := range msgs {
+			releaseMessage(msg)
+		}
+	}
+
+exit:
+	for {
+		select {
+		case msg := <-m.mirrorChan:
+			m.requeueMirrored([]*Message{msg})
+		default:
+			return
+		}
+	}
+}
+
+// forwardMirrored forwards messages to the target, deferred messages one at a
+// time so that they keep their timeout
+func (m *topicMigration) forwardMirrored(endpoint string, msgs []*Message) bool {
+	var immediate []*Message
+	for _, msg := range msgs {
+		if msg.deferred == 0 {
+			immediate = append(immediate, msg)
+			continue
+		}
+		dpub := fmt.Sprintf("http://%s/pub?topic=%s&defer=%d", m.target,
+			url.QueryEscape(m.topic.name), int64(msg.deferred/time.Millisecond))
+		if !m.forward(dpub, msg.Body) {
+			return false
+		}
+	}
+	if len(immediate) == 0 {
+		return true
+	}
+	return m.forward(endpoint, encodeMPUB(immediate))
+}
+
+// requeueMirrored returns messages that could not be forwarded to the topic
+func (m *topicMigration) requeueMirrored(msgs []*Message) {
+	t := m.topic
+	for _, msg := range msgs {
+		err := t.put(msg)
+		if err != nil {
+			t.ctx.nsqd.logf(LOG_ERROR, "TOPIC(%s): failed to requeue msg(%s) - %s", t.name, msg.ID, err)
+		}
+	}
+}
+
+// drainLoop moves the backlog of every channel to the target, then tombstones
+// this node for the topic and deletes its channels
+func (m *topicMigration) drainLoop() {
+	t := m.topic
+	for {
+		drained := true
+		for _, c := range t.loadChannels() {
+			err := m.createChannel(c)
+			if err != nil {
+				m.setError(err)
+				drained = false
+				continue
+			}
+			n, ok := m.drainChannel(c)
+			if !ok {
+				return
+			}
+			if n > 0 || c.Depth() > 0 || channelPending(c) > 0 {
+				drained = false
+			}
+		}
+		if drained && t.Depth() == 0 && len(m.mirrorChan) == 0 {
+			break
+		}
+		select {
+		case <-time.After(migrationPollDelay):
+		case <-m.exitChan:
+			return
+		}
+	}
+
+	n := t.ctx.nsqd
+	node := n.broadcastHTTPAddress()
+	for {
+		err := n.ci.TombstoneTopicProducer(t.name, node, n.lookupdHTTPAddrs())
+		m.setError(err)
+		if err == nil {
+			break
+		}
+		n.logf(LOG_ERROR, "TOPIC(%s): migration failed to tombstone %s - %s", t.name, node, err)
+		select {
+		case <-time.After(migrationRetryDelay):
+		case <-m.exitChan:
+			return
+		}
+	}
+
+	// consumers are disconnected and, with this node tombstoned, find the target
+	for _, c := range t.loadChannels() {
+		err := t.DeleteExistingChannel(c.name)
+		if err != nil {
+			n.logf(LOG_ERROR, "TOPIC(%s): migration failed to delete channel(%s) - %s", t.name, c.name, err)
+		}
+	}
+
+	m.setState(MigrationComplete)
+	n.logf(LOG_INFO, "TOPIC(%s): migration to %s complete", t.name, m.target)
+}
+
+// drainChannel forwards the messages queued in a channel to the same channel on
+// the target, it returns how many were forwarded and false if the migration stopped
+func (m *topicMigration) drainChannel(c *Channel) (int, bool) {
+	var total int
+	endpoint := fmt.Sprintf("http://%s/channel/mpub?topic=%s&channel=%s",
+		m.target, url.QueryEscape(m.topic.name), url.QueryEscape(c.name))
+
+	for {
+		var msgs []*Message
+		for len(msgs) < migrationMaxBatch {
+			backendReadAhead(c.backend)
+			select {
+			case msg := <-c.memoryMsgChan:
+				msgs = append(msgs, msg)
+				continue
+			case buf := <-c.backend.ReadChan():
+				msg, err := decodeMessage(buf)
+				if err != nil {
+					c.ctx.nsqd.logf(LOG_ERROR, "failed to decode message - %s", err)
+					continue
+				}
+				msgs = append(msgs, msg)
+				continue
+			case <-time.After(queueReadTimeout):
+			}
+			break
+		}
+		if len(msgs) == 0 {
+			return total, true
+		}
+
+		if !m.forward(endpoint, encodeMPUB(msgs)) {
+			for _, msg := range msgs {
+				err := c.put(msg)
+				if err != nil {
+					c.ctx.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to requeue msg(%s) - %s", c.name, msg.ID, err)
+				}
+			}
+			return total, false
+		}
+		atomic.AddUint64(&m.drainCount, uint64(len(msgs)))
+		total += len(msgs)
+		for _, msg := range msgs {
+			releaseMessage(msg)
+		}
+	}
+}
+
+// forward POSTs body to endpoint until it succeeds, it returns false if the
+// migration stopped first
+func (m *topicMigration) forward(endpoint string, body []byte) bool {
+	for {
+		err := m.client.POSTV1WithBody(endpoint, body)
+		m.setError(err)
+		if err == nil {
+			return true
+		}
+		m.topic.ctx.nsqd.logf(LOG_ERROR, "TOPIC(%s): migration failed to forward to %s - %s",
+			m.topic.name, m.target, err)
+		select {
+		case <-time.After(migrationRetryDelay):
+		case <-m.exitChan:
+			return false
+		}
+	}
+}
+
+// channelPending is the number of messages in flight or deferred in a channel,
+// these return to its queue (or are finished) eventually
+func channelPending(c *Channel) int64 {
+	c.inFlightMutex.Lock()
+	n := len(c.inFlightMessages)
+	c.inFlightMutex.Unlock()
+	c.deferredMutex.Lock()
+	n += len(c.deferredMessages)
+	c.deferredMutex.Unlock()
+	return int64(n)
+}
+
+// encodeMPUB encodes message bodies in the binary /mpub (and MPUB) format
+func encodeMPUB(msgs []*Message) []byte {
+	size := 4
+	for _, msg := range msgs {
+		size += 4 + len(msg.Body)
+	}
+	var buf bytes.Buffer
+	buf.Grow(size)
+	binary.Write(&buf, binary.BigEndian, int32(len(msgs)))
+	for _, msg := range msgs {
+		binary.Write(&buf, binary.BigEndian, int32(len(msg.Body)))
+		buf.Write(msg.Body)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,153 @@
+package nsqd
+
+import (
+	crand "crypto/rand"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	MsgIDGeneratorSnowflake = "snowflake"
+	MsgIDGeneratorRandom    = "random"
+	MsgIDGeneratorProducer  = "producer"
+)
+
+// idGenerator generates the IDs of the messages published to a topic
+type idGenerator interface {
+	NewID() (MessageID, error)
+}
+
+// msgIDPolicy is how the IDs of published messages are generated (see
+// --msg-id-generator) or, supplied by producers, validated
+type msgIDPolicy struct {
+	generator string
+	pattern   *regexp.Regexp
+}
+
+func newMsgIDPolicy(opts *Options) (*msgIDPolicy, error) {
+	switch opts.MsgIDGenerator {
+	case MsgIDGeneratorSnowflake, MsgIDGeneratorRandom, MsgIDGeneratorProducer:
+	default:
+		return nil, fmt.Errorf("invalid --msg-id-generator (%s) - must be %s, %s or %s", opts.MsgIDGenerator,
+			MsgIDGeneratorSnowflake, MsgIDGeneratorRandom, MsgIDGeneratorProducer)
+	}
+	pattern, err := compileNamePattern(opts.MsgIDPattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --msg-id-pattern - %s", err)
+	}
+	return &msgIDPolicy{
+		generator: opts.MsgIDGenerator,
+		pattern:   pattern,
+	}, nil
+}
+
+// newGenerator returns the ID generator of a topic. Producers supply the IDs of
+// the messages they publish with --msg-id-generator=producer, the messages nsqd
+// publishes itself (e.g. alarms) then get random IDs.
+func (p *msgIDPolicy) newGenerator(nodeID int64) idGenerator {
+	if p.generator == MsgIDGeneratorSnowflake {
+		return NewGUIDFactory(nodeID)
+	}
+	return newRandomIDFactory()
+}
+
+// producerIDs reports whether producers supply the IDs of messages
+func (p *msgIDPolicy) producerIDs() bool {
+	return p.generator == MsgIDGeneratorProducer
+}
+
+// takeIDs replaces the generated IDs of msgs with the IDs supplied by their
+// producer, the first MsgIDLength bytes of their bodies
+func (p *msgIDPolicy) takeIDs(msgs []*Message) error {
+	for _, msg := range msgs {
+		if len(msg.Body) <= MsgIDLength {
+			return fmt.Errorf("message body size %d doesn't fit an ID and a body", len(msg.Body))
+		}
+		err := p.check(msg.Body[:MsgIDLength])
+		if err != nil {
+			return err
+		}
+		copy(msg.ID[:], msg.Body[:MsgIDLength])
+		msg.Body = msg.Body[MsgIDLength:]
+		msg.Checksum = crc32.Checksum(msg.Body, crc32cTable)
+	}
+	return nil
+}
+
+// check returns an error if a producer may not supply id. IDs are sent back in
+// FIN, REQ and TOUCH so must be printable ASCII without spaces, and they must
+// match --msg-id-pattern.
+func (p *msgIDPolicy) check(id []byte) error {
+	if len(id) != MsgIDLength {
+		return fmt.Errorf("message ID %q length %d must be %d", id, len(id), MsgIDLength)
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return fmt.Errorf("message ID %q must be printable ASCII without spaces", id)
+		}
+	}
+	if p.pattern != nil && !p.pattern.Match(id) {
+		return fmt.Errorf("message ID %q does not match %s", id, p.pattern)
+	}
+	return nil
+}
+
+// crockfordBase32 sorts like the bits it encodes
+var crockfordBase32 = base32.NewEncoding("0123456789ABCDEFGHJKMNPQRSTVWXYZ").WithPadding(base32.NoPadding)
+
+// randomIDFactory generates IDs laid out like UUIDv7 (RFC 9562), a 48 bit
+// millisecond timestamp followed by random bits, but with only 32 random bits
+// to fit a MessageID in Crockford's base32. IDs are unique across nsqd without
+// distinct --node-id and sort by time. Within a millisecond the random bits of
+// the previous ID are incremented (as for ULIDs) so that IDs still increase.
+type randomIDFactory struct {
+	sync.Mutex
+
+	rand          *rand.Rand
+	lastTimestamp int64
+	lastRandom    uint32
+}
+
+func newRandomIDFactory() *randomIDFactory {
+	var seed [8]byte
+	_, err := crand.Read(seed[:])
+	if err != nil {
+		binary.BigEndian.PutUint64(seed[:], uint64(time.Now().UnixNano()))
+	}
+	return &randomIDFactory{
+		rand: rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(seed[:])))),
+	}
+}
+
+func (f *randomIDFactory) NewID() (MessageID, error) {
+	var id MessageID
+
+	f.Lock()
+	ts := time.Now().UnixNano() / int64(time.Millisecond)
+	// keep increasing when time goes backwards
+	if ts <= f.lastTimestamp {
+		if f.lastRandom == 1<<32-1 {
+			f.Unlock()
+			return id, ErrSequenceExpired
+		}
+		ts = f.lastTimestamp
+		f.lastRandom++
+	} else {
+		f.lastRandom = f.rand.Uint32()
+	}
+	f.lastTimestamp = ts
+	random := f.lastRandom
+	f.Unlock()
+
+	var b [10]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(ts)<<16)
+	binary.BigEndian.PutUint32(b[6:], random)
+	crockfordBase32.Encode(id[:], b[:])
+	return id, nil
+}
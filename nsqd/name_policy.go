@@ -0,0 +1,75 @@
+package nsqd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// namePolicy restricts the names of topics and channels created by clients,
+// beyond what the protocol allows, e.g. to enforce team.service.event names
+type namePolicy struct {
+	maxLength        int
+	topicPattern     *regexp.Regexp
+	channelPattern   *regexp.Regexp
+	reservedPrefixes []string
+}
+
+func newNamePolicy(opts *Options) (*namePolicy, error) {
+	p := &namePolicy{
+		maxLength:        opts.MaxNameLength,
+		reservedPrefixes: opts.ReservedNamePrefixes,
+	}
+	if p.maxLength < 0 || p.maxLength > 64 {
+		return nil, fmt.Errorf("--max-name-length must be between 0 and 64")
+	}
+	var err error
+	p.topicPattern, err = compileNamePattern(opts.TopicNamePattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --topic-name-pattern - %s", err)
+	}
+	p.channelPattern, err = compileNamePattern(opts.ChannelNamePattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --channel-name-pattern - %s", err)
+	}
+	for _, prefix := range p.reservedPrefixes {
+		if prefix == "" {
+			return nil, fmt.Errorf("--reserved-name-prefix must not be empty")
+		}
+	}
+	return p, nil
+}
+
+// compileNamePattern compiles pattern to match whole names
+func compileNamePattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+// checkTopic returns an error if a client may not create topicName
+func (p *namePolicy) checkTopic(topicName string) error {
+	return p.check(topicName, p.topicPattern)
+}
+
+// checkChannel returns an error if a client may not create channelName
+func (p *namePolicy) checkChannel(channelName string) error {
+	return p.check(channelName, p.channelPattern)
+}
+
+func (p *namePolicy) check(name string, pattern *regexp.Regexp) error {
+	if p.maxLength > 0 && len(name) > p.maxLength {
+		return fmt.Errorf("longer than %d characters", p.maxLength)
+	}
+	for _, prefix := range p.reservedPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return fmt.Errorf("prefix %q is reserved", prefix)
+		}
+	}
+	// patterns don't need to allow for the #ephemeral or #quarantine suffixes
+	if pattern != nil && !pattern.MatchString(strings.TrimSuffix(strings.TrimSuffix(name, QuarantineSuffix), "#ephemeral")) {
+		return fmt.Errorf("does not match %s", pattern)
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package nsqd
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nsqio/nsq/internal/http_api"
+	"github.com/nsqio/nsq/internal/protocol"
+)
+
+// namespaceConfig is the --namespace-config of a namespace, e.g.
+//
+//	[tenantA]
+//	max_topics = 100
+//	max_publish_rate = 5000
+//	identities = ["team-a"]
+//
+//	[tenantA.topic_defaults]
+//	mem_queue_size = 1000
+//	max_disk_bytes = 10737418240
+type namespaceConfig struct {
+	// topics that may exist in the namespace (0 is unlimited)
+	MaxTopics int `toml:"max_topics" json:"max_topics"`
+	// messages per second that may be published to its topics, across all
+	// clients (0 is unlimited)
+	MaxPublishRate int64 `toml:"max_publish_rate" json:"max_publish_rate"`
+	// auth identities allowed to publish and subscribe to its topics (all
+	// authorized identities when empty), requires auth to be enabled
+	Identities []string `toml:"identities" json:"identities"`
+	// settings of its new topics, as for POST /topic/config
+	TopicDefaults map[string]interface{} `toml:"topic_defaults" json:"topic_defaults"`
+}
+
+type namespace struct {
+	publishCount  uint64
+	rejectedCount uint64
+
+	name          string
+	config        namespaceConfig
+	topicDefaults url.Values
+	publishLimit  *http_api.RateLimiter
+}
+
+// NamespaceStats are the settings and usage of a namespace
+type NamespaceStats struct {
+	Name   string   `json:"name"`
+	Topics []string `json:"topics"`
+	namespaceConfig
+	PublishCount  uint64 `json:"publish_count"`
+	RejectedCount uint64 `json:"rejected_count"`
+}
+
+// loadNamespaces reads --namespace-config
+func loadNamespaces(path string) (map[string]*namespace, error) {
+	namespaces := make(map[string]*namespace)
+	if path == "" {
+		return namespaces, nil
+	}
+
+	var configs map[string]namespaceConfig
+	md, err := toml.DecodeFile(path, &configs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse --namespace-config %s - %s", path, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("unknown --namespace-config settings %v", undecoded)
+	}
+
+	for name, config := range configs {
+		if !protocol.IsValidNamespace(name) {
+			return nil, fmt.Errorf("invalid namespace name %q in --namespace-config", name)
+		}
+		if config.MaxTopics < 0 || config.MaxPublishRate < 0 {
+			return nil, fmt.Errorf("namespace %s max_topics and max_publish_rate must be >= 0", name)
+		}
+		defaults := url.Values{}
+		for k, v := range config.TopicDefaults {
+			known := false
+			for _, key := range topicConfigKeys {
+				if k == key {
+					known = true
+				}
+			}
+			if !known {
+				return nil, fmt.Errorf("namespace %s has unknown topic_defaults setting %s", name, k)
+			}
+			if list, ok := v.([]interface{}); ok {
+				// e.g. publishers
+				values := make([]string, len(list))
+				for i, item := range list {
+					values[i] = fmt.Sprint(item)
+				}
+				v = strings.Join(values, ",")
+			}
+			defaults.Set(k, fmt.Sprint(v))
+		}
+		namespaces[name] = &namespace{
+			name:          name,
+			config:        config,
+			topicDefaults: defaults,
+			publishLimit:  http_api.NewRateLimiter(float64(config.MaxPublishRate)),
+		}
+	}
+	return namespaces, nil
+}
+
+// getNamespace returns the configured namespace of topicName, or nil
+func (n *NSQD) getNamespace(topicName string) *namespace {
+	name, _ := protocol.SplitNamespace(topicName)
+	if name == "" {
+		return nil
+	}
+	return n.namespaces[name]
+}
+
+// namespaceTopics returns the topics in each namespace
+func (n *NSQD) namespaceTopics() map[string][]string {
+	topics := make(map[string][]string)
+	n.RLock()
+	for topicName := range n.topicMap {
+		name, _ := protocol.SplitNamespace(topicName)
+		if name != "" {
+			topics[name] = append(topics[name], topicName)
+		}
+	}
+	n.RUnlock()
+	for _, t := range topics {
+		sort.Strings(t)
+	}
+	return topics
+}
+
+// checkNamespaceTopicLimit returns an error if creating topicName would exceed
+// its namespace's max_topics
+func (n *NSQD) checkNamespaceTopicLimit(topicName string) error {
+	ns := n.getNamespace(topicName)
+	if ns == nil || ns.config.MaxTopics == 0 {
+		return nil
+	}
+	count := 0
+	n.RLock()
+	_, exists := n.topicMap[topicName]
+	for name := range n.topicMap {
+		if nsName, _ := protocol.SplitNamespace(name); nsName == ns.name {
+			count++
+		}
+	}
+	n.RUnlock()
+	if exists || count < ns.config.MaxTopics {
+		return nil
+	}
+	atomic.AddUint64(&ns.rejectedCount, 1)
+	return fmt.Errorf("namespace %s exceeds limit of %d topics", ns.name, ns.config.MaxTopics)
+}
+
+// checkNamespaceIdentity returns an error if identity may not use topicName
+func (n *NSQD) checkNamespaceIdentity(topicName string, identity string) error {
+	ns := n.getNamespace(topicName)
+	if ns == nil || len(ns.config.Identities) == 0 {
+		return nil
+	}
+	for _, i := range ns.config.Identities {
+		if i == identity {
+			return nil
+		}
+	}
+	atomic.AddUint64(&ns.rejectedCount, 1)
+	return fmt.Errorf("identity %q is not allowed in namespace %s", identity, ns.name)
+}
+
+// checkNamespacePublish takes count messages from the publish rate of
+// topicName's namespace
+func (n *NSQD) checkNamespacePublish(topicName string, count int) error {
+	ns := n.getNamespace(topicName)
+	if ns == nil {
+		return nil
+	}
+	if !ns.publishLimit.TakeN(float64(count)) {
+		atomic.AddUint64(&ns.rejectedCount, 1)
+		return fmt.Errorf("namespace %s exceeds limit of %d messages/s", ns.name, ns.config.MaxPublishRate)
+	}
+	atomic.AddUint64(&ns.publishCount, uint64(count))
+	return nil
+}
+
+// applyNamespaceDefaults applies the topic_defaults of a new topic's namespace
+func (n *NSQD) applyNamespaceDefaults(t *Topic) {
+	ns := n.getNamespace(t.name)
+	if ns == nil || len(ns.topicDefaults) == 0 {
+		return
+	}
+	changed, err := applyTopicConfig(t, ns.topicDefaults)
+	if err != nil {
+		n.logf(LOG_ERROR, "TOPIC(%s): failed to apply namespace %s topic_defaults - %s", t.name, ns.name, err)
+	}
+	if changed {
+		n.Lock()
+		n.PersistMetadata()
+		n.Unlock()
+	}
+}
+
+// GetNamespaceStats returns the configured namespaces and those that have
+// topics
+func (n *NSQD) GetNamespaceStats() []NamespaceStats {
+	topics := n.namespaceTopics()
+	for name := range n.namespaces {
+		if _, ok := topics[name]; !ok {
+			topics[name] = []string{}
+		}
+	}
+	stats := make([]NamespaceStats, 0, len(topics))
+	for name, t := range topics {
+		s := NamespaceStats{Name: name, Topics: t}
+		if ns, ok := n.namespaces[name]; ok {
+			s.namespaceConfig = ns.config
+			s.PublishCount = atomic.LoadUint64(&ns.publishCount)
+			s.RejectedCount = atomic.LoadUint64(&ns.rejectedCount)
+		}
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
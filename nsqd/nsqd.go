@@ -12,16 +12,22 @@ import (
 	"net"
 	"os"
 	"path"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/nsqio/nsq/internal/auth"
 	"github.com/nsqio/nsq/internal/clusterinfo"
 	"github.com/nsqio/nsq/internal/dirlock"
+	"github.com/nsqio/nsq/internal/diskqueue"
 	"github.com/nsqio/nsq/internal/http_api"
 	"github.com/nsqio/nsq/internal/protocol"
 	"github.com/nsqio/nsq/internal/statsd"
+	"github.com/nsqio/nsq/internal/timingwheel"
 	"github.com/nsqio/nsq/internal/util"
 	"github.com/nsqio/nsq/internal/version"
 )
@@ -32,6 +38,18 @@ const (
 	TLSRequired
 )
 
+const (
+	// timerWheelTick is the resolution of client output buffer flushes and
+	// heartbeats, shorter intervals are rounded up to it
+	timerWheelTick = 5 * time.Millisecond
+	// timerWheelSlots makes a rotation of the wheel ~5s, longer intervals
+	// (e.g. the default 30s heartbeat) take several
+	timerWheelSlots = 1024
+
+	// timeoutWheelTick is the resolution of in-flight and deferred timeouts
+	timeoutWheelTick = 10 * time.Millisecond
+)
+
 type errStore struct {
 	err error
 }
@@ -43,31 +61,48 @@ type Client interface {
 
 type NSQD struct {
 	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
-	clientIDSequence int64
+	clientIDSequence  int64
+	metadataPersisted int64
 
 	sync.RWMutex
 
 	opts atomic.Value
 
-	dl        *dirlock.DirLock
-	isLoading int32
-	errValue  atomic.Value
-	startTime time.Time
+	dls         []*dirlock.DirLock
+	isLoading   int32
+	errValue    atomic.Value
+	metadataErr atomic.Value
+	startTime   time.Time
 
 	topicMap map[string]*Topic
 
+	// data paths of topics recorded in metadata (until the topic is created)
+	topicPlacements map[string]string
+	placementCount  uint64
+
 	clientLock sync.RWMutex
 	clients    map[int64]Client
 
 	lookupPeers atomic.Value
 
-	tcpServer     *tcpServer
-	tcpListener   net.Listener
-	httpListener  net.Listener
-	httpsListener net.Listener
-	tlsConfig     *tls.Config
-
-	poolSize int
+	tcpServer      *tcpServer
+	tcpListener    net.Listener
+	httpListener   net.Listener
+	httpsListener  net.Listener
+	tlsConfig      *tls.Config
+	authProvider   auth.Provider
+	quotas         *identityQuotas
+	namePolicy     *namePolicy
+	msgIDPolicy    *msgIDPolicy
+	clientVersions *clientVersionPolicy
+	namespaces     map[string]*namespace
+
+	httpRateLimits *httpRateLimits
+	groupCommitter *diskqueue.GroupCommitter
+	timers         *timingwheel.Wheel
+	timeouts       *timingwheel.Timeouts
+	timeoutPool    *timeoutPool
+	asyncPublisher *asyncPublisher
 
 	notifyChan           chan interface{}
 	optsNotificationChan chan struct{}
@@ -80,10 +115,8 @@ type NSQD struct {
 func New(opts *Options) (*NSQD, error) {
 	var err error
 
-	dataPath := opts.DataPath
-	if opts.DataPath == "" {
-		cwd, _ := os.Getwd()
-		dataPath = cwd
+	if len(opts.DataPaths) > 0 {
+		opts.DataPath = opts.DataPaths[0]
 	}
 	if opts.Logger == nil {
 		opts.Logger = log.New(os.Stderr, opts.LogPrefix, log.Ldate|log.Ltime|log.Lmicroseconds)
@@ -96,7 +129,8 @@ func New(opts *Options) (*NSQD, error) {
 		exitChan:             make(chan int),
 		notifyChan:           make(chan interface{}),
 		optsNotificationChan: make(chan struct{}, 1),
-		dl:                   dirlock.New(dataPath),
+		topicPlacements:      make(map[string]string),
+		quotas:               newIdentityQuotas(),
 	}
 	httpcli := http_api.NewClient(nil, opts.HTTPClientConnectTimeout, opts.HTTPClientRequestTimeout)
 	n.ci = clusterinfo.New(n.logf, httpcli)
@@ -105,26 +139,48 @@ func New(opts *Options) (*NSQD, error) {
 
 	n.swapOpts(opts)
 	n.errValue.Store(errStore{})
+	n.metadataErr.Store(errStore{})
+	n.httpRateLimits = newHTTPRateLimits(opts)
 
-	err = n.dl.Lock()
-	if err != nil {
-		return nil, fmt.Errorf("--data-path=%s in use (possibly by another instance of nsqd)", dataPath)
+	for _, dataPath := range dataPaths(opts) {
+		if dataPath == "" {
+			cwd, _ := os.Getwd()
+			dataPath = cwd
+		}
+		dl := dirlock.New(dataPath)
+		err = dl.Lock()
+		if err != nil {
+			return nil, fmt.Errorf("--data-path=%s in use (possibly by another instance of nsqd)", dataPath)
+		}
+		n.dls = append(n.dls, dl)
 	}
 
-	if opts.MaxDeflateLevel < 1 || opts.MaxDeflateLevel > 9 {
-		return nil, errors.New("--max-deflate-level must be [1,9]")
+	err = ValidateOptions(opts)
+	if err != nil {
+		return nil, err
 	}
 
-	if opts.ID < 0 || opts.ID >= 1024 {
-		return nil, errors.New("--node-id must be [0,1024)")
+	if opts.RestoreFrom != "" {
+		err = n.restore(opts.RestoreFrom)
+		if err != nil {
+			return nil, fmt.Errorf("failed to restore from %s - %s", opts.RestoreFrom, err)
+		}
 	}
 
-	if opts.StatsdPrefix != "" {
-		var port string
-		_, port, err = net.SplitHostPort(opts.HTTPAddress)
+	if opts.Recover {
+		err = n.recoverDataPaths()
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse HTTP address (%s) - %s", opts.HTTPAddress, err)
+			return nil, fmt.Errorf("failed to recover --data-path - %s", err)
 		}
+	}
+
+	err = n.startupCheck()
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.StatsdPrefix != "" {
+		_, port, _ := net.SplitHostPort(opts.HTTPAddress)
 		statsdHostKey := statsd.HostKey(net.JoinHostPort(opts.BroadcastAddress, port))
 		prefixWithHost := strings.Replace(opts.StatsdPrefix, "%s", statsdHostKey, -1)
 		if prefixWithHost[len(prefixWithHost)-1] != '.' {
@@ -141,39 +197,329 @@ func New(opts *Options) (*NSQD, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to build TLS config - %s", err)
 	}
-	if tlsConfig == nil && opts.TLSRequired != TLSNotRequired {
-		return nil, errors.New("cannot require TLS client connections without TLS key and cert")
-	}
 	n.tlsConfig = tlsConfig
 
-	for _, v := range opts.E2EProcessingLatencyPercentiles {
-		if v <= 0 || v > 1 {
-			return nil, fmt.Errorf("invalid E2E processing latency percentile: %v", v)
-		}
+	n.authProvider, err = newAuthProvider(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	n.namePolicy, err = newNamePolicy(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	n.msgIDPolicy, err = newMsgIDPolicy(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	n.clientVersions, err = newClientVersionPolicy(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	n.namespaces, err = loadNamespaces(opts.NamespaceConfig)
+	if err != nil {
+		return nil, err
 	}
 
 	n.logf(LOG_INFO, version.String("nsqd"))
 	n.logf(LOG_INFO, "ID: %d", opts.ID)
+	if n.authProvider != nil {
+		n.logf(LOG_INFO, "AUTH: %s", n.authProvider)
+	}
+	for name, ns := range n.namespaces {
+		if len(ns.config.Identities) > 0 && n.authProvider == nil {
+			n.logf(LOG_WARN, "namespace %s identities have no effect without auth", name)
+		}
+	}
 
 	n.tcpServer = &tcpServer{}
-	n.tcpListener, err = net.Listen("tcp", opts.TCPAddress)
+	n.tcpListener, err = util.Listen(opts.BindFamily, opts.TCPAddress)
 	if err != nil {
 		return nil, fmt.Errorf("listen (%s) failed - %s", opts.TCPAddress, err)
 	}
-	n.httpListener, err = net.Listen("tcp", opts.HTTPAddress)
+	n.httpListener, err = util.Listen(opts.BindFamily, opts.HTTPAddress)
 	if err != nil {
 		return nil, fmt.Errorf("listen (%s) failed - %s", opts.HTTPAddress, err)
 	}
 	if n.tlsConfig != nil && opts.HTTPSAddress != "" {
-		n.httpsListener, err = tls.Listen("tcp", opts.HTTPSAddress, n.tlsConfig)
+		n.httpsListener, err = util.Listen(opts.BindFamily, opts.HTTPSAddress)
 		if err != nil {
 			return nil, fmt.Errorf("listen (%s) failed - %s", opts.HTTPSAddress, err)
 		}
+		n.httpsListener = tls.NewListener(n.httpsListener, n.tlsConfig)
+	}
+
+	if opts.SyncGroupCommit > 0 {
+		n.groupCommitter = diskqueue.NewGroupCommitter(opts.SyncGroupCommit)
+	}
+
+	// the output buffer and heartbeat tickers of all clients are driven by one
+	// timing wheel rather than two runtime timers per client
+	n.timers = timingwheel.New(timerWheelTick, timerWheelSlots)
+	// and the in-flight and deferred timeouts of all channels by another,
+	// rather than scanning each channel's
+	n.timeoutPool = newTimeoutPool(opts.QueueScanWorkerPoolMax)
+	n.timeouts = timingwheel.NewTimeouts(timeoutWheelTick, n.processTimeouts)
+	if opts.AsyncPubBufferSize > 0 {
+		n.asyncPublisher = newAsyncPublisher(n, opts.AsyncPubBufferSize)
+	}
+
+	// last, so that failing to start doesn't look like a crash to the next nsqd
+	err = writeSyncFile(runningFile(opts), []byte(strconv.Itoa(os.Getpid())))
+	if err != nil {
+		return nil, fmt.Errorf("failed to write %s - %s", runningFile(opts), err)
 	}
 
 	return n, nil
 }
 
+// ValidateOptions checks opts for problems that would prevent nsqd from starting
+// (without binding listeners or locking --data-path)
+func ValidateOptions(opts *Options) error {
+	if opts.MaxDeflateLevel < 1 || opts.MaxDeflateLevel > 9 {
+		return errors.New("--max-deflate-level must be [1,9]")
+	}
+
+	if opts.QueueScanWorkerPoolMax < 1 {
+		return errors.New("--queue-scan-worker-pool-max must be >= 1")
+	}
+
+	if opts.ID < 0 || opts.ID >= 1024 {
+		return errors.New("--node-id must be [0,1024)")
+	}
+
+	if err := util.ValidateBindFamily(opts.BindFamily); err != nil {
+		return err
+	}
+
+	for _, a := range []struct {
+		flagName string
+		addr     string
+	}{
+		{"--tcp-address", opts.TCPAddress},
+		{"--http-address", opts.HTTPAddress},
+		{"--https-address", opts.HTTPSAddress},
+	} {
+		if a.addr == "" && a.flagName == "--https-address" {
+			continue
+		}
+		_, err := util.ResolveBindAddr(opts.BindFamily, a.addr)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s (%s) - %s", a.flagName, a.addr, err)
+		}
+	}
+
+	if !util.IsValidHost(opts.BroadcastAddress) {
+		return fmt.Errorf("--broadcast-address (%s) must be a hostname or IP address (without brackets or port)", opts.BroadcastAddress)
+	}
+
+	for _, a := range []struct {
+		flagName string
+		addr     string
+	}{
+		{"--broadcast-tcp-address", opts.BroadcastTCPAddress},
+		{"--broadcast-http-address", opts.BroadcastHTTPAddress},
+		{"--broadcast-https-address", opts.BroadcastHTTPSAddress},
+	} {
+		if a.addr == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(a.addr)
+		if err == nil {
+			_, err = strconv.ParseUint(port, 10, 16)
+		}
+		if err == nil && !util.IsValidHost(host) {
+			err = errors.New("invalid host")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to parse %s (%s) - %s", a.flagName, a.addr, err)
+		}
+	}
+
+	for _, addr := range opts.NSQLookupdTCPAddresses {
+		_, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("failed to parse --lookupd-tcp-address (%s) - %s", addr, err)
+		}
+	}
+
+	for _, dataPath := range dataPaths(opts) {
+		if dataPath == "" {
+			continue
+		}
+		fi, err := os.Stat(dataPath)
+		if err != nil {
+			return fmt.Errorf("invalid --data-path (%s) - %s", dataPath, err)
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("invalid --data-path (%s) - not a directory", dataPath)
+		}
+	}
+	switch opts.DataPathPlacement {
+	case PlacementRoundRobin, PlacementFreeSpace:
+	default:
+		return fmt.Errorf("invalid --data-path-placement (%s) - must be %s or %s",
+			opts.DataPathPlacement, PlacementRoundRobin, PlacementFreeSpace)
+	}
+
+	for _, d := range []struct {
+		flagName string
+		d        time.Duration
+	}{
+		{"--msg-timeout", opts.MsgTimeout},
+		{"--max-msg-timeout", opts.MaxMsgTimeout},
+		{"--max-heartbeat-interval", opts.MaxHeartbeatInterval},
+		{"--sync-timeout", opts.SyncTimeout},
+		{"--statsd-interval", opts.StatsdInterval},
+		{"--profiling-interval", opts.ProfilingInterval},
+		{"--lookupd-read-timeout", opts.LookupdReadTimeout},
+		{"--lookupd-write-timeout", opts.LookupdWriteTimeout},
+	} {
+		if d.d <= 0 {
+			return fmt.Errorf("%s must be > 0", d.flagName)
+		}
+	}
+	if opts.SyncGroupCommit < 0 {
+		return errors.New("--sync-group-commit must be >= 0")
+	}
+	if opts.ChannelStagingSize < 0 {
+		return errors.New("--channel-staging-size must be >= 0")
+	}
+	if opts.BackendMsgEnvelope != MsgEnvelopeV1 && opts.BackendMsgEnvelope != MsgEnvelopeV2 {
+		return fmt.Errorf("invalid --backend-msg-envelope (%d) - must be %d or %d",
+			opts.BackendMsgEnvelope, MsgEnvelopeV1, MsgEnvelopeV2)
+	}
+
+	if !diskqueue.ValidCompression(opts.DiskCompression) {
+		return fmt.Errorf("--disk-compression must be %s or %s", diskqueue.CompressionNone, diskqueue.CompressionZstd)
+	}
+	if opts.MsgTimeout > opts.MaxMsgTimeout {
+		return errors.New("--msg-timeout must be <= --max-msg-timeout")
+	}
+	if opts.MinOutputBufferSize < 1 {
+		return errors.New("--min-output-buffer-size must be >= 1")
+	}
+	if opts.OutputBufferSize < opts.MinOutputBufferSize || opts.OutputBufferSize > opts.MaxOutputBufferSize {
+		return errors.New("--output-buffer-size must be between --min-output-buffer-size and --max-output-buffer-size")
+	}
+	if opts.MinOutputBufferTimeout > opts.MaxOutputBufferTimeout {
+		return errors.New("--min-output-buffer-timeout must be <= --max-output-buffer-timeout")
+	}
+	if opts.TopicWarmup < 0 {
+		return errors.New("--topic-warmup must be >= 0")
+	}
+	if opts.Retention < 0 {
+		return errors.New("--retention must be >= 0")
+	}
+	if opts.ChannelAlarmDepth < 0 || opts.ChannelAlarmAge < 0 {
+		return errors.New("--channel-alarm-depth and --channel-alarm-age must be >= 0")
+	}
+	if opts.ChannelAlarmTopic != "" && !protocol.IsValidTopicName(opts.ChannelAlarmTopic) {
+		return fmt.Errorf("invalid --channel-alarm-topic (%s)", opts.ChannelAlarmTopic)
+	}
+	if opts.QuarantineTimeouts < 0 {
+		return errors.New("--quarantine-timeouts must be >= 0")
+	}
+	if opts.AuditLogMaxBytes < 1 || opts.AuditLogMaxFiles < 1 {
+		return errors.New("--audit-log-max-bytes and --audit-log-max-files must be >= 1")
+	}
+	if opts.TCPUserTimeout < 0 {
+		return errors.New("--tcp-user-timeout must be >= 0")
+	}
+	if opts.TCPUserTimeout > 0 && runtime.GOOS != "linux" {
+		return errors.New("--tcp-user-timeout is only supported on Linux")
+	}
+	switch opts.StatsdProtocol {
+	case "udp", "tcp", "tls":
+	default:
+		return fmt.Errorf("invalid --statsd-protocol (%s) - must be udp, tcp or tls", opts.StatsdProtocol)
+	}
+	if opts.StatsdBufferSize < 1 {
+		return errors.New("--statsd-buffer-size must be >= 1")
+	}
+	_, err := buildStatsdTLSConfig(opts)
+	if err != nil {
+		return fmt.Errorf("failed to build statsd TLS config - %s", err)
+	}
+	if opts.PublisherStatsTopN < 0 {
+		return errors.New("--publisher-stats-top-n must be >= 0")
+	}
+	if opts.HeartbeatMissLimit < 1 {
+		return errors.New("--heartbeat-miss-limit must be >= 1")
+	}
+	if opts.HeartbeatGracePeriod < 0 {
+		return errors.New("--heartbeat-grace-period must be >= 0")
+	}
+	if opts.RdyHintInterval < 0 {
+		return errors.New("--rdy-hint-interval must be >= 0")
+	}
+	if opts.PublishCreditWindow < 0 {
+		return errors.New("--publish-credit-window must be >= 0")
+	}
+	if opts.HealthMinFreeBytes < 0 {
+		return errors.New("--health-min-free-bytes must be >= 0")
+	}
+
+	tlsRequired := opts.TLSRequired
+	if opts.TLSClientAuthPolicy != "" && tlsRequired == TLSNotRequired {
+		tlsRequired = TLSRequired
+	}
+	tlsConfig, err := buildTLSConfig(opts)
+	if err != nil {
+		return fmt.Errorf("failed to build TLS config - %s", err)
+	}
+	if tlsConfig == nil && tlsRequired != TLSNotRequired {
+		return errors.New("cannot require TLS client connections without TLS key and cert")
+	}
+
+	authProviders := 0
+	for _, enabled := range []bool{
+		len(opts.AuthHTTPAddresses) != 0,
+		opts.AuthFile != "",
+		opts.AuthPluginAddress != "",
+	} {
+		if enabled {
+			authProviders++
+		}
+	}
+	if authProviders > 1 {
+		return errors.New("only one of --auth-http-address, --auth-file and --auth-plugin-address may be given")
+	}
+
+	if opts.AsyncPubBufferSize < 0 {
+		return errors.New("--async-pub-buffer-size must be >= 0")
+	}
+	if opts.ClusterName != "" {
+		if !opts.RecordHops {
+			return errors.New("--cluster-name requires --record-hops")
+		}
+		if !isValidClusterName(opts.ClusterName) {
+			return fmt.Errorf("invalid --cluster-name (%s) - must be letters, digits, _, . or -", opts.ClusterName)
+		}
+	}
+
+	for _, v := range opts.E2EProcessingLatencyPercentiles {
+		if v <= 0 || v > 1 {
+			return fmt.Errorf("invalid E2E processing latency percentile: %v", v)
+		}
+	}
+	for _, v := range opts.ProcessingLatencyPercentiles {
+		if v <= 0 || v > 1 {
+			return fmt.Errorf("invalid processing latency percentile: %v", v)
+		}
+	}
+	for _, v := range opts.EventLagPercentiles {
+		if v <= 0 || v > 1 {
+			return fmt.Errorf("invalid event lag percentile: %v", v)
+		}
+	}
+
+	return nil
+}
+
 func (n *NSQD) getOpts() *Options {
 	return n.opts.Load().(*Options)
 }
@@ -274,25 +620,68 @@ func (n *NSQD) Main() error {
 		})
 	}
 
-	n.waitGroup.Wrap(n.queueScanLoop)
+	n.waitGroup.Wrap(n.idleTopicLoop)
+	n.waitGroup.Wrap(n.pauseLoop)
+	n.waitGroup.Wrap(n.channelAlarmLoop)
 	n.waitGroup.Wrap(n.lookupLoop)
 	if n.getOpts().StatsdAddress != "" {
 		n.waitGroup.Wrap(n.statsdLoop)
 	}
+	if n.getOpts().ProfilingEndpoint != "" {
+		n.waitGroup.Wrap(n.profilingLoop)
+	}
 
 	err := <-exitCh
 	return err
 }
 
+// metadataSchemaVersion is incremented on incompatible changes to nsqd.dat
+const metadataSchemaVersion = 1
+
 type meta struct {
-	Topics []struct {
-		Name     string `json:"name"`
-		Paused   bool   `json:"paused"`
-		Channels []struct {
-			Name   string `json:"name"`
-			Paused bool   `json:"paused"`
-		} `json:"channels"`
-	} `json:"topics"`
+	SchemaVersion int         `json:"schema_version"`
+	Topics        []topicMeta `json:"topics"`
+}
+
+type topicMeta struct {
+	Name         string `json:"name"`
+	Paused       bool   `json:"paused"`
+	MemQueueSize *int64 `json:"mem_queue_size,omitempty"`
+	Durable      bool   `json:"durable,omitempty"`
+	SyncEvery    int64  `json:"sync_every,omitempty"`
+	SyncTimeout  string `json:"sync_timeout,omitempty"`
+	Compression  string `json:"compression,omitempty"`
+	DataPath     string `json:"data_path,omitempty"`
+	MaxDiskBytes int64  `json:"max_disk_bytes,omitempty"`
+	DiskQuota    string `json:"disk_quota_policy,omitempty"`
+
+	ChannelOverflow     string `json:"channel_overflow,omitempty"`
+	ChannelMaxDepth     int64  `json:"channel_max_depth,omitempty"`
+	ChannelMaxDiskBytes int64  `json:"channel_max_disk_bytes,omitempty"`
+
+	Publishers  []string `json:"publishers,omitempty"`
+	IdleTimeout string   `json:"idle_timeout,omitempty"`
+
+	EphemeralBufferSize int64 `json:"ephemeral_buffer_size,omitempty"`
+
+	Channels []channelMeta `json:"channels"`
+}
+
+type channelMeta struct {
+	Name       string `json:"name"`
+	Paused     bool   `json:"paused"`
+	MaxClients int    `json:"max_clients,omitempty"`
+	Exclusive  bool   `json:"exclusive,omitempty"`
+	KeyRouting bool   `json:"key_routing,omitempty"`
+	SampleRate int32  `json:"sample_rate,omitempty"`
+	AlarmDepth int64  `json:"alarm_depth,omitempty"`
+	AlarmAge   string `json:"alarm_age,omitempty"`
+	AuditLog   bool   `json:"audit_log,omitempty"`
+
+	// RFC3339 time a paused channel is unpaused at
+	PausedUntil string `json:"paused_until,omitempty"`
+
+	QuarantineTimeouts int `json:"quarantine_timeouts,omitempty"`
 }
 
 func newMetadataFile(opts *Options) string {
@@ -323,24 +712,69 @@ func writeSyncFile(fn string, data []byte) error {
 	return err
 }
 
-func (n *NSQD) LoadMetadata() error {
-	atomic.StoreInt32(&n.isLoading, 1)
-	defer atomic.StoreInt32(&n.isLoading, 0)
+// writeMetadataFile atomically replaces the metadata file fn with data, keeping the
+// previous generation (if valid) as fn.prev
+func writeMetadataFile(fn string, data []byte) error {
+	prevData, err := ioutil.ReadFile(fn)
+	if err == nil && json.Valid(prevData) {
+		err = writeSyncFile(fn+".prev", prevData)
+		if err != nil {
+			return err
+		}
+	}
 
-	fn := newMetadataFile(n.getOpts())
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fn, rand.Int())
+	err = writeSyncFile(tmpFileName, data)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpFileName, fn)
+	if err != nil {
+		return err
+	}
+	return syncDir(path.Dir(fn))
+}
 
+// readMetadataFile parses the metadata file fn, falling back to the previous
+// generation if fn is corrupt (m is nil for a fresh start)
+func (n *NSQD) readMetadataFile(fn string) (*meta, error) {
 	data, err := readOrEmpty(fn)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if data == nil {
-		return nil // fresh start
+		return nil, nil
 	}
 
 	var m meta
 	err = json.Unmarshal(data, &m)
 	if err != nil {
-		return fmt.Errorf("failed to parse metadata in %s - %s", fn, err)
+		prevData, prevErr := readOrEmpty(fn + ".prev")
+		if prevErr != nil || prevData == nil || json.Unmarshal(prevData, &m) != nil {
+			return nil, fmt.Errorf("failed to parse metadata in %s - %s", fn, err)
+		}
+		n.logf(LOG_WARN, "failed to parse metadata in %s - %s, using previous generation %s.prev",
+			fn, err, fn)
+	}
+	if m.SchemaVersion > metadataSchemaVersion {
+		return nil, fmt.Errorf("metadata in %s has schema version %d (newer than %d)",
+			fn, m.SchemaVersion, metadataSchemaVersion)
+	}
+	return &m, nil
+}
+
+func (n *NSQD) LoadMetadata() error {
+	atomic.StoreInt32(&n.isLoading, 1)
+	defer atomic.StoreInt32(&n.isLoading, 0)
+
+	fn := newMetadataFile(n.getOpts())
+
+	m, err := n.readMetadataFile(fn)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return nil // fresh start
 	}
 
 	for _, t := range m.Topics {
@@ -348,31 +782,170 @@ func (n *NSQD) LoadMetadata() error {
 			n.logf(LOG_WARN, "skipping creation of invalid topic %s", t.Name)
 			continue
 		}
+		if t.DataPath != "" {
+			n.Lock()
+			n.topicPlacements[t.Name] = t.DataPath
+			n.Unlock()
+		}
 		topic := n.GetTopic(t.Name)
-		if t.Paused {
-			topic.Pause()
+		err := applyTopicMetadata(topic, t)
+		if err != nil {
+			n.logf(LOG_WARN, "ignoring invalid settings of topic %s - %s", t.Name, err)
 		}
 		for _, c := range t.Channels {
 			if !protocol.IsValidChannelName(c.Name) {
 				n.logf(LOG_WARN, "skipping creation of invalid channel %s", c.Name)
 				continue
 			}
-			channel := topic.GetChannel(c.Name)
-			if c.Paused {
-				channel.Pause()
-			}
+			applyChannelMetadata(topic.GetChannel(c.Name), c)
 		}
 		topic.Start()
 	}
 	return nil
 }
 
+// applyTopicMetadata applies the settings of t to topic (apart from its channels),
+// returning the first that is invalid
+func applyTopicMetadata(topic *Topic, t topicMeta) error {
+	var firstErr error
+	setErr := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if t.Paused {
+		topic.Pause()
+	}
+	if t.MemQueueSize != nil {
+		setErr(topic.SetMemQueueSize(*t.MemQueueSize))
+	}
+	if t.Durable {
+		setErr(topic.SetDurable(true))
+	}
+	if t.SyncEvery > 0 || t.SyncTimeout != "" {
+		syncTimeout, err := time.ParseDuration(t.SyncTimeout)
+		if err != nil && t.SyncTimeout != "" {
+			setErr(fmt.Errorf("invalid sync_timeout %q", t.SyncTimeout))
+		}
+		setErr(topic.SetSyncPolicy(t.SyncEvery, syncTimeout))
+	}
+	if t.Compression != "" {
+		setErr(topic.SetCompression(t.Compression))
+	}
+	if t.MaxDiskBytes > 0 {
+		setErr(topic.SetDiskQuota(t.MaxDiskBytes, t.DiskQuota))
+	}
+	if t.ChannelOverflow != "" {
+		setErr(topic.SetChannelOverflow(t.ChannelOverflow, t.ChannelMaxDepth, t.ChannelMaxDiskBytes))
+	}
+	if len(t.Publishers) > 0 {
+		setErr(topic.SetPublishers(t.Publishers))
+	}
+	if t.IdleTimeout != "" {
+		idleTimeout, err := time.ParseDuration(t.IdleTimeout)
+		if err != nil {
+			setErr(fmt.Errorf("invalid idle_timeout %q", t.IdleTimeout))
+		} else {
+			topic.SetIdleTimeout(idleTimeout)
+		}
+	}
+	if t.EphemeralBufferSize > 0 {
+		setErr(topic.SetEphemeralBufferSize(t.EphemeralBufferSize))
+	}
+	return firstErr
+}
+
+// applyChannelMetadata applies the pause state and settings of c to a new channel
+func applyChannelMetadata(channel *Channel, c channelMeta) {
+	if c.Paused {
+		// a pause that ended while nsqd was down ends on the next check
+		pausedUntil, err := parsePausedUntil(c.PausedUntil)
+		if err != nil {
+			channel.ctx.nsqd.logf(LOG_WARN, "TOPIC(%s): channel(%s): ignoring %s",
+				channel.topicName, channel.name, err)
+		}
+		channel.PauseUntil(pausedUntil)
+	}
+	if c.MaxClients > 0 {
+		channel.SetMaxClients(c.MaxClients)
+	}
+	if c.Exclusive {
+		channel.SetExclusive(true)
+	}
+	if c.KeyRouting {
+		channel.SetKeyRouting(true)
+	}
+	if c.SampleRate > 0 {
+		channel.SetSampleRate(c.SampleRate)
+	}
+	if c.AlarmDepth != 0 || c.AlarmAge != "" {
+		alarmAge, err := parseAlarmAge(c.AlarmAge)
+		if err != nil {
+			channel.ctx.nsqd.logf(LOG_WARN, "TOPIC(%s): channel(%s): ignoring %s",
+				channel.topicName, channel.name, err)
+		}
+		channel.SetAlarm(c.AlarmDepth, alarmAge)
+	}
+	if c.AuditLog {
+		err := channel.SetAuditLog(true)
+		if err != nil {
+			channel.ctx.nsqd.logf(LOG_ERROR, "TOPIC(%s): channel(%s): failed to open audit log - %s",
+				channel.topicName, channel.name, err)
+		}
+	}
+	if c.QuarantineTimeouts != 0 {
+		err := channel.SetQuarantineTimeouts(c.QuarantineTimeouts)
+		if err != nil {
+			channel.ctx.nsqd.logf(LOG_WARN, "TOPIC(%s): channel(%s): ignoring quarantine_timeouts - %s",
+				channel.topicName, channel.name, err)
+		}
+	}
+}
+
+// parsePausedUntil parses the persisted paused_until of a channel
+func parsePausedUntil(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid paused_until %q", s)
+	}
+	return t, nil
+}
+
+// parseAlarmAge parses the persisted alarm_age of a channel
+func parseAlarmAge(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid alarm_age %q", s)
+	}
+	return d, nil
+}
+
 func (n *NSQD) PersistMetadata() error {
 	// persist metadata about what topics/channels we have, across restarts
 	fileName := newMetadataFile(n.getOpts())
 
 	n.logf(LOG_INFO, "NSQ: persisting topic/channel metadata to %s", fileName)
 
+	data, err := n.metadata()
+	if err == nil {
+		err = writeMetadataFile(fileName, data)
+	}
+	n.metadataErr.Store(errStore{err: err})
+	if err == nil {
+		atomic.StoreInt64(&n.metadataPersisted, time.Now().UnixNano())
+	}
+	return err
+}
+
+// metadata expects the caller to hold n's lock
+func (n *NSQD) metadata() ([]byte, error) {
 	js := make(map[string]interface{})
 	topics := []interface{}{}
 	for _, topic := range n.topicMap {
@@ -382,9 +955,48 @@ func (n *NSQD) PersistMetadata() error {
 		topicData := make(map[string]interface{})
 		topicData["name"] = topic.name
 		topicData["paused"] = topic.IsPaused()
+		if memQueueSize, isSet := topic.MemQueueSize(); isSet {
+			topicData["mem_queue_size"] = memQueueSize
+		}
+		if topic.IsDurable() {
+			topicData["durable"] = true
+		}
+		if len(dataPaths(n.getOpts())) > 1 {
+			topicData["data_path"] = topic.dataPath
+		}
+		syncEvery, syncTimeout := topic.SyncPolicy()
+		if syncEvery > 0 {
+			topicData["sync_every"] = syncEvery
+		}
+		if syncTimeout > 0 {
+			topicData["sync_timeout"] = syncTimeout.String()
+		}
+		if compression := topic.Compression(); compression != "" {
+			topicData["compression"] = compression
+		}
+		if maxDiskBytes, policy := topic.DiskQuota(); maxDiskBytes > 0 {
+			topicData["max_disk_bytes"] = maxDiskBytes
+			topicData["disk_quota_policy"] = policy
+		}
+		if policy, maxDepth, maxDiskBytes := topic.ChannelOverflow(); policy != ChannelOverflowNone {
+			topicData["channel_overflow"] = policy
+			topicData["channel_max_depth"] = maxDepth
+			topicData["channel_max_disk_bytes"] = maxDiskBytes
+		}
+		if publishers := topic.Publishers(); len(publishers) > 0 {
+			topicData["publishers"] = publishers
+		}
+		if idleTimeout := topic.IdleTimeout(); idleTimeout != 0 {
+			topicData["idle_timeout"] = idleTimeout.String()
+		}
+		if size := topic.EphemeralBufferSize(); size > 0 {
+			topicData["ephemeral_buffer_size"] = size
+		}
 		channels := []interface{}{}
 		topic.Lock()
 		for _, channel := range topic.channelMap {
+			// before the channel lock, which (un)pausing takes after the pause mutex
+			pausedUntil := channel.PausedUntil()
 			channel.Lock()
 			if channel.ephemeral {
 				channel.Unlock()
@@ -393,6 +1005,33 @@ func (n *NSQD) PersistMetadata() error {
 			channelData := make(map[string]interface{})
 			channelData["name"] = channel.name
 			channelData["paused"] = channel.IsPaused()
+			if !pausedUntil.IsZero() {
+				channelData["paused_until"] = pausedUntil.Format(time.RFC3339Nano)
+			}
+			if channel.maxClients > 0 {
+				channelData["max_clients"] = channel.maxClients
+			}
+			if channel.IsExclusive() {
+				channelData["exclusive"] = true
+			}
+			if channel.IsKeyRouted() {
+				channelData["key_routing"] = true
+			}
+			if sampleRate := channel.SampleRate(); sampleRate > 0 {
+				channelData["sample_rate"] = sampleRate
+			}
+			if channel.alarmDepth != 0 {
+				channelData["alarm_depth"] = channel.alarmDepth
+			}
+			if channel.alarmAge != 0 {
+				channelData["alarm_age"] = channel.alarmAge.String()
+			}
+			if channel.IsAuditLogged() {
+				channelData["audit_log"] = true
+			}
+			if channel.quarantineTimeouts != 0 {
+				channelData["quarantine_timeouts"] = channel.quarantineTimeouts
+			}
 			channels = append(channels, channelData)
 			channel.Unlock()
 		}
@@ -400,27 +1039,112 @@ func (n *NSQD) PersistMetadata() error {
 		topicData["channels"] = channels
 		topics = append(topics, topicData)
 	}
+	js["schema_version"] = metadataSchemaVersion
 	js["version"] = version.Binary
 	js["topics"] = topics
 
-	data, err := json.Marshal(&js)
+	return json.Marshal(&js)
+}
+
+// ExportMetadata returns the definitions of the topics and channels (including their
+// pause state and settings) in the format accepted by ImportMetadata, sorted by name
+// and without node specific fields
+func (n *NSQD) ExportMetadata() (*meta, error) {
+	n.Lock()
+	data, err := n.metadata()
+	n.Unlock()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
-
-	err = writeSyncFile(tmpFileName, data)
+	var m meta
+	err = json.Unmarshal(data, &m)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	sort.Slice(m.Topics, func(i, j int) bool { return m.Topics[i].Name < m.Topics[j].Name })
+	for i := range m.Topics {
+		m.Topics[i].DataPath = ""
+		channels := m.Topics[i].Channels
+		sort.Slice(channels, func(i, j int) bool { return channels[i].Name < channels[j].Name })
+	}
+	return &m, nil
+}
+
+// ImportMetadata creates the topics and channels defined in m (as returned by
+// ExportMetadata) and applies their pause state and settings. Topics, channels and
+// settings that m does not mention are left unchanged.
+func (n *NSQD) ImportMetadata(m *meta) error {
+	if m.SchemaVersion > metadataSchemaVersion {
+		return fmt.Errorf("schema version %d is newer than %d",
+			m.SchemaVersion, metadataSchemaVersion)
+	}
+	for _, t := range m.Topics {
+		if !protocol.IsValidTopicName(t.Name) {
+			return fmt.Errorf("invalid topic name %q", t.Name)
+		}
+		for _, c := range t.Channels {
+			if !protocol.IsValidChannelName(c.Name) {
+				return fmt.Errorf("invalid channel name %q", c.Name)
+			}
+		}
 	}
-	err = os.Rename(tmpFileName, fileName)
+
+	var firstErr error
+	for _, t := range m.Topics {
+		topic := n.GetTopic(t.Name)
+		err := applyTopicMetadata(topic, t)
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("topic %s - %s", t.Name, err)
+		}
+		if !t.Paused && topic.IsPaused() {
+			topic.UnPause()
+		}
+		for _, c := range t.Channels {
+			channel := topic.GetChannel(c.Name)
+			pausedUntil, err := parsePausedUntil(c.PausedUntil)
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("channel %s:%s - %s", t.Name, c.Name, err)
+			}
+			if c.Paused {
+				channel.PauseUntil(pausedUntil)
+			} else if channel.IsPaused() {
+				channel.UnPause()
+			}
+			err = channel.SetMaxClients(c.MaxClients)
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("channel %s:%s - %s", t.Name, c.Name, err)
+			}
+			channel.SetExclusive(c.Exclusive)
+			channel.SetKeyRouting(c.KeyRouting)
+			err = channel.SetSampleRate(c.SampleRate)
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("channel %s:%s - %s", t.Name, c.Name, err)
+			}
+			alarmAge, err := parseAlarmAge(c.AlarmAge)
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("channel %s:%s - %s", t.Name, c.Name, err)
+			}
+			channel.SetAlarm(c.AlarmDepth, alarmAge)
+			err = channel.SetAuditLog(c.AuditLog)
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("channel %s:%s - %s", t.Name, c.Name, err)
+			}
+			err = channel.SetQuarantineTimeouts(c.QuarantineTimeouts)
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("channel %s:%s - %s", t.Name, c.Name, err)
+			}
+		}
+	}
+	n.logf(LOG_INFO, "NSQ: imported %d topics", len(m.Topics))
+
+	n.Lock()
+	err := n.PersistMetadata()
+	n.Unlock()
 	if err != nil {
 		return err
 	}
-	// technically should fsync DataPath here
-
-	return nil
+	return firstErr
 }
 
 func (n *NSQD) Exit() {
@@ -439,6 +1163,11 @@ func (n *NSQD) Exit() {
 		n.httpsListener.Close()
 	}
 
+	// before the topics close
+	if n.asyncPublisher != nil {
+		n.asyncPublisher.Close()
+	}
+
 	n.Lock()
 	err := n.PersistMetadata()
 	if err != nil {
@@ -450,10 +1179,27 @@ func (n *NSQD) Exit() {
 	}
 	n.Unlock()
 
+	if n.groupCommitter != nil {
+		n.groupCommitter.Close()
+	}
+
 	n.logf(LOG_INFO, "NSQ: stopping subsystems")
 	close(n.exitChan)
 	n.waitGroup.Wait()
-	n.dl.Unlock()
+	if n.timers != nil {
+		n.timers.Stop()
+	}
+	if n.timeouts != nil {
+		n.timeouts.Stop()
+		n.timeoutPool.Close()
+	}
+	err = os.Remove(runningFile(n.getOpts()))
+	if err != nil && !os.IsNotExist(err) {
+		n.logf(LOG_ERROR, "failed to remove %s - %s", runningFile(n.getOpts()), err)
+	}
+	for _, dl := range n.dls {
+		dl.Unlock()
+	}
 	n.logf(LOG_INFO, "NSQ: bye")
 }
 
@@ -478,7 +1224,7 @@ func (n *NSQD) GetTopic(topicName string) *Topic {
 	deleteCallback := func(t *Topic) {
 		n.DeleteExistingTopic(t.name)
 	}
-	t = NewTopic(topicName, &context{n}, deleteCallback)
+	t = NewTopic(topicName, &context{n}, n.topicDataPath(topicName), deleteCallback)
 	n.topicMap[topicName] = t
 
 	n.Unlock()
@@ -491,6 +1237,9 @@ func (n *NSQD) GetTopic(topicName string) *Topic {
 		return t
 	}
 
+	n.applyNamespaceDefaults(t)
+	t.warmUp(n.getOpts().TopicWarmup)
+
 	// if using lookupd, make a blocking call to get the topics, and immediately create them.
 	// this makes sure that any message received is buffered to the right channels
 	lookupdHTTPAddrs := n.lookupdHTTPAddrs()
@@ -547,9 +1296,36 @@ func (n *NSQD) DeleteExistingTopic(topicName string) error {
 	delete(n.topicMap, topicName)
 	n.Unlock()
 
+	n.quotas.deleteTopic(topicName)
+
 	return nil
 }
 
+// PauseTopics pauses all topics that are not already paused and returns them so
+// that they can later be resumed with UnPauseTopics (without resuming any topics
+// that were paused beforehand)
+func (n *NSQD) PauseTopics() []*Topic {
+	var paused []*Topic
+	n.RLock()
+	for _, t := range n.topicMap {
+		if !t.IsPaused() {
+			paused = append(paused, t)
+		}
+	}
+	n.RUnlock()
+	for _, t := range paused {
+		t.Pause()
+	}
+	return paused
+}
+
+// UnPauseTopics resumes topics previously paused by PauseTopics
+func (n *NSQD) UnPauseTopics(topics []*Topic) {
+	for _, t := range topics {
+		t.UnPause()
+	}
+}
+
 func (n *NSQD) Notify(v interface{}) {
 	// since the in-memory metadata is incomplete,
 	// should not persist metadata while loading it.
@@ -589,120 +1365,83 @@ func (n *NSQD) channels() []*Channel {
 	return channels
 }
 
-// resizePool adjusts the size of the pool of queueScanWorker goroutines
-//
-// 	1 <= pool <= min(num * 0.25, QueueScanWorkerPoolMax)
-//
-func (n *NSQD) resizePool(num int, workCh chan *Channel, responseCh chan bool, closeCh chan int) {
-	idealPoolSize := int(float64(num) * 0.25)
-	if idealPoolSize < 1 {
-		idealPoolSize = 1
-	} else if idealPoolSize > n.getOpts().QueueScanWorkerPoolMax {
-		idealPoolSize = n.getOpts().QueueScanWorkerPoolMax
-	}
-	for {
-		if idealPoolSize == n.poolSize {
-			break
-		} else if idealPoolSize < n.poolSize {
-			// contract
-			closeCh <- 1
-			n.poolSize--
-		} else {
-			// expand
-			n.waitGroup.Wrap(func() {
-				n.queueScanWorker(workCh, responseCh, closeCh)
-			})
-			n.poolSize++
+// processTimeouts handles the in-flight and deferred messages whose timeouts
+// expired, the channels' concurrently (see timeoutPool)
+func (n *NSQD) processTimeouts(timers []*timingwheel.Timer) {
+	var channels []*Channel
+	byChannel := make(map[*Channel][]*Message)
+	for _, t := range timers {
+		msg := t.Value.(*Message)
+		c := msg.timeoutChannel
+		if _, ok := byChannel[c]; !ok {
+			channels = append(channels, c)
 		}
+		byChannel[c] = append(byChannel[c], msg)
 	}
+	n.timeoutPool.process(channels, byChannel)
 }
 
-// queueScanWorker receives work (in the form of a channel) from queueScanLoop
-// and processes the deferred and in-flight queues
-func (n *NSQD) queueScanWorker(workCh chan *Channel, responseCh chan bool, closeCh chan int) {
+// idleTopicLoop deletes topics that have been idle for their idle timeout
+// (--topic-idle-timeout unless overridden), checking every
+// TopicIdleCheckInterval. Deleting a topic deregisters it from nsqlookupd.
+func (n *NSQD) idleTopicLoop() {
+	ticker := time.NewTicker(n.getOpts().TopicIdleCheckInterval)
 	for {
 		select {
-		case c := <-workCh:
-			now := time.Now().UnixNano()
-			dirty := false
-			if c.processInFlightQueue(now) {
-				dirty = true
+		case now := <-ticker.C:
+			var idle []*Topic
+			n.RLock()
+			for _, t := range n.topicMap {
+				if t.isIdle(now) {
+					idle = append(idle, t)
+				}
 			}
-			if c.processDeferredQueue(now) {
-				dirty = true
+			n.RUnlock()
+			for _, t := range idle {
+				n.logf(LOG_INFO, "TOPIC(%s): deleting idle topic", t.name)
+				n.DeleteExistingTopic(t.name)
 			}
-			responseCh <- dirty
-		case <-closeCh:
-			return
+		case <-n.exitChan:
+			goto exit
 		}
 	}
-}
 
-// queueScanLoop runs in a single goroutine to process in-flight and deferred
-// priority queues. It manages a pool of queueScanWorker (configurable max of
-// QueueScanWorkerPoolMax (default: 4)) that process channels concurrently.
-//
-// It copies Redis's probabilistic expiration algorithm: it wakes up every
-// QueueScanInterval (default: 100ms) to select a random QueueScanSelectionCount
-// (default: 20) channels from a locally cached list (refreshed every
-// QueueScanRefreshInterval (default: 5s)).
-//
-// If either of the queues had work to do the channel is considered "dirty".
-//
-// If QueueScanDirtyPercent (default: 25%) of the selected channels were dirty,
-// the loop continues without sleep.
-func (n *NSQD) queueScanLoop() {
-	workCh := make(chan *Channel, n.getOpts().QueueScanSelectionCount)
-	responseCh := make(chan bool, n.getOpts().QueueScanSelectionCount)
-	closeCh := make(chan int)
-
-	workTicker := time.NewTicker(n.getOpts().QueueScanInterval)
-	refreshTicker := time.NewTicker(n.getOpts().QueueScanRefreshInterval)
-
-	channels := n.channels()
-	n.resizePool(len(channels), workCh, responseCh, closeCh)
+exit:
+	n.logf(LOG_INFO, "IDLETOPICS: closing")
+	ticker.Stop()
+}
 
+// pauseLoop unpauses the channels paused until a time that has passed,
+// checking every PauseCheckInterval
+func (n *NSQD) pauseLoop() {
+	ticker := time.NewTicker(n.getOpts().PauseCheckInterval)
 	for {
 		select {
-		case <-workTicker.C:
-			if len(channels) == 0 {
-				continue
+		case now := <-ticker.C:
+			resumed := false
+			for _, c := range n.channels() {
+				if c.resumeIfDue(now) {
+					n.logf(LOG_INFO, "TOPIC(%s): channel(%s): pause ended, unpausing",
+						c.topicName, c.name)
+					resumed = true
+				}
+			}
+			if resumed {
+				n.Lock()
+				err := n.PersistMetadata()
+				n.Unlock()
+				if err != nil {
+					n.logf(LOG_ERROR, "failed to persist metadata - %s", err)
+				}
 			}
-		case <-refreshTicker.C:
-			channels = n.channels()
-			n.resizePool(len(channels), workCh, responseCh, closeCh)
-			continue
 		case <-n.exitChan:
 			goto exit
 		}
-
-		num := n.getOpts().QueueScanSelectionCount
-		if num > len(channels) {
-			num = len(channels)
-		}
-
-	loop:
-		for _, i := range util.UniqRands(num, len(channels)) {
-			workCh <- channels[i]
-		}
-
-		numDirty := 0
-		for i := 0; i < num; i++ {
-			if <-responseCh {
-				numDirty++
-			}
-		}
-
-		if float64(numDirty)/float64(num) > n.getOpts().QueueScanDirtyPercent {
-			goto loop
-		}
 	}
 
 exit:
-	n.logf(LOG_INFO, "QUEUESCAN: closing")
-	close(closeCh)
-	workTicker.Stop()
-	refreshTicker.Stop()
+	n.logf(LOG_INFO, "PAUSE: closing")
+	ticker.Stop()
 }
 
 func buildTLSConfig(opts *Options) (*tls.Config, error) {
@@ -751,6 +1490,33 @@ func buildTLSConfig(opts *Options) (*tls.Config, error) {
 	return tlsConfig, nil
 }
 
+// newAuthProvider returns the auth.Provider configured by opts, or nil when
+// auth is disabled
+func newAuthProvider(opts *Options) (auth.Provider, error) {
+	switch {
+	case len(opts.AuthHTTPAddresses) != 0:
+		return &auth.HTTPProvider{
+			Addresses:      opts.AuthHTTPAddresses,
+			ConnectTimeout: opts.HTTPClientConnectTimeout,
+			RequestTimeout: opts.HTTPClientRequestTimeout,
+		}, nil
+	case opts.AuthFile != "":
+		p, err := auth.NewFileProvider(opts.AuthFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load --auth-file - %s", err)
+		}
+		return p, nil
+	case opts.AuthPluginAddress != "":
+		p, err := auth.NewPluginProvider(opts.AuthPluginAddress,
+			opts.HTTPClientConnectTimeout, opts.HTTPClientRequestTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse --auth-plugin-address - %s", err)
+		}
+		return p, nil
+	}
+	return nil, nil
+}
+
 func (n *NSQD) IsAuthEnabled() bool {
-	return len(n.getOpts().AuthHTTPAddresses) != 0
+	return n.authProvider != nil
 }
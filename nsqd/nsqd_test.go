@@ -1,13 +1,18 @@
 package nsqd
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -86,7 +91,7 @@ func TestStartup(t *testing.T) {
 	for i := 0; i < iterations/2; i++ {
 		select {
 		case msg = <-channel1.memoryMsgChan:
-		case b := <-channel1.backend.ReadChan():
+		case b := <-channel1.readBackend():
 			msg, _ = decodeMessage(b)
 		}
 		t.Logf("read message %d", i+1)
@@ -142,7 +147,7 @@ func TestStartup(t *testing.T) {
 	for i := 0; i < iterations/2; i++ {
 		select {
 		case msg = <-channel1.memoryMsgChan:
-		case b := <-channel1.backend.ReadChan():
+		case b := <-channel1.readBackend():
 			msg, _ = decodeMessage(b)
 		}
 		t.Logf("read message %d", i+1)
@@ -240,6 +245,163 @@ func TestPauseMetadata(t *testing.T) {
 	test.Equal(t, false, isPaused(nsqd, 0, 0))
 }
 
+func TestPauseUntil(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.PauseCheckInterval = 10 * time.Millisecond
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "pause_until" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	pause := func(duration string) int {
+		url := fmt.Sprintf("http://%s/channel/pause?topic=%s&channel=ch&duration=%s", httpAddr, topicName, duration)
+		resp, err := http.Post(url, "application/json", nil)
+		test.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	waitUnpaused := func(c *Channel) {
+		for i := 0; c.IsPaused(); i++ {
+			if i > 100 {
+				t.Fatal("channel not unpaused")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	test.Equal(t, 400, pause("soon"))
+	test.Equal(t, 400, pause("-1s"))
+	test.Equal(t, false, channel.IsPaused())
+
+	test.Equal(t, 200, pause("200ms"))
+	test.Equal(t, true, channel.IsPaused())
+	m, err := getMetadata(nsqd)
+	test.Nil(t, err)
+	pausedUntil, err := parsePausedUntil(m.Topics[0].Channels[0].PausedUntil)
+	test.Nil(t, err)
+	test.Equal(t, channel.PausedUntil().UnixNano(), pausedUntil.UnixNano())
+
+	waitUnpaused(channel)
+	test.Equal(t, true, channel.PausedUntil().IsZero())
+	// pauseLoop persists the metadata after unpausing the channel
+	for i := 0; ; i++ {
+		m, err = getMetadata(nsqd)
+		test.Nil(t, err)
+		if !m.Topics[0].Channels[0].Paused {
+			break
+		}
+		if i > 100 {
+			t.Fatal("unpause not persisted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, "", m.Topics[0].Channels[0].PausedUntil)
+
+	// a pause that ended while nsqd was down ends once it's back
+	channel2 := topic.GetChannel("ch2")
+	applyChannelMetadata(channel2, channelMeta{
+		Name:        "ch2",
+		Paused:      true,
+		PausedUntil: time.Now().Add(-time.Minute).Format(time.RFC3339Nano),
+	})
+	test.Equal(t, true, channel2.IsPaused())
+	waitUnpaused(channel2)
+}
+
+func TestPauseTopics(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic1 := nsqd.GetTopic("pause_topics1")
+	topic2 := nsqd.GetTopic("pause_topics2")
+	topic2.Pause()
+
+	paused := nsqd.PauseTopics()
+	test.Equal(t, 1, len(paused))
+	test.Equal(t, true, topic1.IsPaused())
+	test.Equal(t, true, topic2.IsPaused())
+
+	nsqd.UnPauseTopics(paused)
+	test.Equal(t, false, topic1.IsPaused())
+	test.Equal(t, true, topic2.IsPaused())
+}
+
+func TestIdleTopics(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.TopicIdleTimeout = 100 * time.Millisecond
+	opts.TopicIdleCheckInterval = 10 * time.Millisecond
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	nsqd.GetTopic("idle_topic")
+	nsqd.GetTopic("idle_topic_channel").GetChannel("ch")
+	nsqd.GetTopic("idle_topic_never").SetIdleTimeout(-1)
+	queued := nsqd.GetTopic("idle_topic_queued")
+	queued.PutMessage(NewMessage(queued.GenerateID(), []byte("test")))
+
+	time.Sleep(250 * time.Millisecond)
+
+	_, err := nsqd.GetExistingTopic("idle_topic")
+	test.NotNil(t, err)
+	for _, name := range []string{"idle_topic_channel", "idle_topic_never", "idle_topic_queued"} {
+		_, err = nsqd.GetExistingTopic(name)
+		test.Nil(t, err)
+	}
+}
+
+func TestDataPathPlacement(t *testing.T) {
+	var paths []string
+	for i := 0; i < 2; i++ {
+		tmpDir, err := ioutil.TempDir("", "nsq-test-")
+		test.Nil(t, err)
+		defer os.RemoveAll(tmpDir)
+		paths = append(paths, tmpDir)
+	}
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DataPaths = paths
+	_, _, nsqd := mustStartNSQD(opts)
+
+	placed := make(map[string]string)
+	for i := 0; i < 4; i++ {
+		topic := nsqd.GetTopic("placement" + strconv.Itoa(i))
+		test.Equal(t, paths[i%2], topic.dataPath)
+		placed[topic.name] = topic.dataPath
+	}
+	nsqd.Lock()
+	test.Nil(t, nsqd.PersistMetadata())
+	nsqd.Unlock()
+	m, err := getMetadata(nsqd)
+	test.Nil(t, err)
+	for _, topic := range m.Topics {
+		test.Equal(t, placed[topic.Name], topic.DataPath)
+	}
+	nsqd.Exit()
+
+	// the placement recorded in metadata is reused after restart
+	opts = NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DataPaths = paths
+	_, _, nsqd = mustStartNSQD(opts)
+	defer nsqd.Exit()
+	test.Nil(t, nsqd.LoadMetadata())
+	for name, dataPath := range placed {
+		topic, err := nsqd.GetExistingTopic(name)
+		test.Nil(t, err)
+		test.Equal(t, dataPath, topic.dataPath)
+	}
+}
+
 func mustStartNSQLookupd(opts *nsqlookupd.Options) (*net.TCPAddr, *net.TCPAddr, *nsqlookupd.NSQLookupd) {
 	opts.TCPAddress = "127.0.0.1:0"
 	opts.HTTPAddress = "127.0.0.1:0"
@@ -256,6 +418,150 @@ func mustStartNSQLookupd(opts *nsqlookupd.Options) (*net.TCPAddr, *net.TCPAddr,
 	return lookupd.RealTCPAddr(), lookupd.RealHTTPAddr(), lookupd
 }
 
+func TestRecover(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	topicName := "test_recover" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	for i := 0; i < 5; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		test.Nil(t, topic.PutMessage(msg))
+	}
+	for channel.Depth() != 5 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	nsqd.Exit()
+
+	// lose the metadata of nsqd and of the channel's diskqueue
+	os.Remove(newMetadataFile(opts))
+	os.Remove(fmt.Sprintf("%s/%s.diskqueue.meta.dat", opts.DataPath, getBackendName(topicName, "ch")))
+
+	opts.Recover = true
+	_, _, nsqd = mustStartNSQD(opts)
+	defer nsqd.Exit()
+	test.Nil(t, nsqd.LoadMetadata())
+
+	topic, err := nsqd.GetExistingTopic(topicName)
+	test.Nil(t, err)
+	channel, err = topic.GetExistingChannel("ch")
+	test.Nil(t, err)
+	test.Equal(t, int64(5), channel.Depth())
+}
+
+func TestStartupCheck(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	topicName := "test_startup_check" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	for i := 0; i < 5; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		test.Nil(t, topic.PutMessage(msg))
+	}
+	for channel.Depth() != 5 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	nsqd.Exit()
+	_, err := os.Stat(runningFile(opts))
+	test.Equal(t, true, os.IsNotExist(err))
+
+	// crash with the channel's depth wrong and the disk queue of a channel not
+	// in the metadata yet
+	corrupt := func() {
+		metaFile := fmt.Sprintf("%s/%s.diskqueue.meta.dat", opts.DataPath, getBackendName(topicName, "ch"))
+		data, err := ioutil.ReadFile(metaFile)
+		test.Nil(t, err)
+		ioutil.WriteFile(metaFile, append([]byte("9"), data[1:]...), 0600)
+		orphanFile := fmt.Sprintf("%s/%s.diskqueue.meta.dat", opts.DataPath, getBackendName(topicName, "orphan"))
+		ioutil.WriteFile(orphanFile, []byte("0\n0,0\n0,0\n"), 0600)
+		ioutil.WriteFile(runningFile(opts), nil, 0600)
+	}
+	corrupt()
+
+	_, _, nsqd = mustStartNSQD(opts)
+	test.Nil(t, nsqd.LoadMetadata())
+	topic, err = nsqd.GetExistingTopic(topicName)
+	test.Nil(t, err)
+	channel, err = topic.GetExistingChannel("ch")
+	test.Nil(t, err)
+	test.Equal(t, int64(5), channel.Depth())
+	_, err = topic.GetExistingChannel("orphan")
+	test.Nil(t, err)
+	topic.DeleteExistingChannel("orphan")
+	nsqd.Exit()
+
+	corrupt()
+	opts.StrictStartup = true
+	_, err = New(opts)
+	test.NotNil(t, err)
+	test.Equal(t, fmt.Sprintf("--strict-startup found 2 problems in --data-path (repair them with --recover):\n"+
+		"\tDISKQUEUE(%s): depth was 9 instead of 5\n"+
+		"\tDISKQUEUE(%s): in %s but not in the metadata",
+		getBackendName(topicName, "ch"), getBackendName(topicName, "orphan"), opts.DataPath), err.Error())
+}
+
+func TestStartupFailureLeavesNoRunningFile(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tmpDir, err := ioutil.TempDir("", "nsq-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	opts.DataPath = tmpDir
+	opts.TCPAddress = "127.0.0.1:0"
+	opts.HTTPAddress = "127.0.0.1:0"
+	opts.TLSCert = "./test/certs/missing.pem"
+	opts.TLSKey = "./test/certs/missing.key"
+
+	_, err = New(opts)
+	test.NotNil(t, err)
+	_, err = os.Stat(runningFile(opts))
+	test.Equal(t, true, os.IsNotExist(err))
+}
+
+func TestMetadataPreviousGeneration(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	nsqd.GetTopic("test_metadata_prev")
+	nsqd.Lock()
+	test.Nil(t, nsqd.PersistMetadata())
+	test.Nil(t, nsqd.PersistMetadata())
+	nsqd.Unlock()
+	m, err := getMetadata(nsqd)
+	test.Nil(t, err)
+	test.Equal(t, metadataSchemaVersion, m.SchemaVersion)
+	nsqd.Exit()
+
+	// a corrupt nsqd.dat falls back to the previous generation
+	fn := newMetadataFile(opts)
+	// (without Main, which would race with the immediate Exit)
+	test.Nil(t, ioutil.WriteFile(fn, []byte(`{"topics":[{"na`), 0600))
+	nsqd, err = New(opts)
+	test.Nil(t, err)
+	test.Nil(t, nsqd.LoadMetadata())
+	_, err = nsqd.GetExistingTopic("test_metadata_prev")
+	test.Nil(t, err)
+	nsqd.Exit()
+
+	// metadata written by a newer nsqd is not loaded
+	test.Nil(t, ioutil.WriteFile(fn, []byte(`{"schema_version":1000,"topics":[]}`), 0600))
+	nsqd, err = New(opts)
+	test.Nil(t, err)
+	defer nsqd.Exit()
+	test.NotNil(t, nsqd.LoadMetadata())
+}
+
 func TestReconfigure(t *testing.T) {
 	lopts := nsqlookupd.NewOptions()
 	lopts.Logger = test.NewTestLogger(t)
@@ -278,6 +584,7 @@ func TestReconfigure(t *testing.T) {
 
 	newOpts := NewOptions()
 	newOpts.Logger = opts.Logger
+	newOpts.DataPath = opts.DataPath
 	newOpts.NSQLookupdTCPAddresses = []string{lookupd1.RealTCPAddr().String()}
 	nsqd.swapOpts(newOpts)
 	nsqd.triggerOptsNotification()
@@ -295,6 +602,7 @@ func TestReconfigure(t *testing.T) {
 
 	newOpts = NewOptions()
 	newOpts.Logger = opts.Logger
+	newOpts.DataPath = opts.DataPath
 	newOpts.NSQLookupdTCPAddresses = []string{lookupd2.RealTCPAddr().String(), lookupd3.RealTCPAddr().String()}
 	nsqd.swapOpts(newOpts)
 	nsqd.triggerOptsNotification()
@@ -316,6 +624,51 @@ func TestReconfigure(t *testing.T) {
 	test.Equal(t, newOpts.NSQLookupdTCPAddresses, lookupPeers)
 }
 
+func TestReconfigureBroadcastAddress(t *testing.T) {
+	lopts := nsqlookupd.NewOptions()
+	lopts.Logger = test.NewTestLogger(t)
+	_, _, lookupd := mustStartNSQLookupd(lopts)
+	defer lookupd.Exit()
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.NSQLookupdTCPAddresses = []string{lookupd.RealTCPAddr().String()}
+	opts.BroadcastAddress = "127.0.0.1"
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_reconfigure_broadcast" + strconv.Itoa(int(time.Now().Unix()))
+	nsqd.GetTopic(topicName)
+
+	broadcastAddresses := func() []string {
+		var addrs []string
+		for _, pi := range lookupd.DB.FindProducers("topic", topicName, "").PeerInfo() {
+			addrs = append(addrs, pi.BroadcastAddress)
+		}
+		return addrs
+	}
+	for i := 0; i < 100 && len(broadcastAddresses()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, []string{"127.0.0.1"}, broadcastAddresses())
+
+	url := fmt.Sprintf("http://%s/config/broadcast_address", httpAddr)
+	req, err := http.NewRequest("PUT", url, bytes.NewBufferString("localhost"))
+	test.Nil(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	for i := 0; i < 100 && broadcastAddresses()[0] != "localhost"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// updated in place, without unregistering
+	test.Equal(t, []string{"localhost"}, broadcastAddresses())
+	test.Equal(t, 1, len(lookupd.DB.FindProducers("client", "", "")))
+}
+
 func TestCluster(t *testing.T) {
 	lopts := nsqlookupd.NewOptions()
 	lopts.Logger = test.NewTestLogger(t)
@@ -418,6 +771,10 @@ func TestCluster(t *testing.T) {
 func TestSetHealth(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
+	tmpDir, err := ioutil.TempDir("", "nsq-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	opts.DataPath = tmpDir
 	nsqd, err := New(opts)
 	test.Nil(t, err)
 	defer nsqd.Exit()
@@ -439,3 +796,124 @@ func TestSetHealth(t *testing.T) {
 	test.Equal(t, "OK", nsqd.GetHealth())
 	test.Equal(t, true, nsqd.IsHealthy())
 }
+
+func TestSampleLoad(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 100
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	var s loadSampler
+	load := nsqd.sampleLoad(&s)
+	test.Equal(t, nodeLoad{}, load)
+
+	topic := nsqd.GetTopic("sample_load")
+	topic.GetChannel("ch")
+	for i := 0; i < 10; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		topic.PutMessage(msg)
+	}
+	// the messages reach the channel asynchronously
+	for i := 0; i < 100 && topic.Depth() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	load = nsqd.sampleLoad(&s)
+	test.Equal(t, int64(10), load.depth)
+	test.Equal(t, 0, load.clients)
+	if load.publishRate <= 0 {
+		t.Fatalf("publish rate %f after publishing", load.publishRate)
+	}
+
+	cmd := pingCommand(nodeLoad{depth: 10, clients: 2, publishRate: 1.5})
+	test.Equal(t, "PING depth=10 clients=2 publish_rate=1.50", cmd.String())
+}
+
+func TestValidateOptions(t *testing.T) {
+	opts := NewOptions()
+	test.Nil(t, ValidateOptions(opts))
+
+	opts = NewOptions()
+	opts.DataPath = "/does/not/exist"
+	test.NotNil(t, ValidateOptions(opts))
+
+	opts = NewOptions()
+	opts.TCPAddress = "127.0.0.1:notaport"
+	test.NotNil(t, ValidateOptions(opts))
+
+	opts = NewOptions()
+	opts.MsgTimeout = 2 * opts.MaxMsgTimeout
+	test.NotNil(t, ValidateOptions(opts))
+
+	opts = NewOptions()
+	opts.TLSRequired = TLSRequired
+	test.NotNil(t, ValidateOptions(opts))
+
+	opts = NewOptions()
+	opts.BroadcastTCPAddress = "external.host"
+	test.NotNil(t, ValidateOptions(opts))
+	opts.BroadcastTCPAddress = "external.host:14150"
+	test.Nil(t, ValidateOptions(opts))
+	opts.BroadcastTCPAddress = "[fd4a:622f:d2f2::1]:14150"
+	test.Nil(t, ValidateOptions(opts))
+
+	opts = NewOptions()
+	opts.BroadcastAddress = "[fd4a:622f:d2f2::1]"
+	test.NotNil(t, ValidateOptions(opts))
+	opts.BroadcastAddress = "fd4a:622f:d2f2::1"
+	test.Nil(t, ValidateOptions(opts))
+
+	opts = NewOptions()
+	opts.BindFamily = "udp"
+	test.NotNil(t, ValidateOptions(opts))
+	// the default addresses are unspecified, of any family
+	opts.BindFamily = "tcp6"
+	test.Nil(t, ValidateOptions(opts))
+	opts.TCPAddress = "127.0.0.1:4150"
+	test.NotNil(t, ValidateOptions(opts))
+}
+
+func TestProfiling(t *testing.T) {
+	type upload struct {
+		params url.Values
+		size   int
+	}
+	uploads := make(chan upload, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.URL.Path == "/ingest" {
+			select {
+			case uploads <- upload{req.URL.Query(), len(body)}:
+			default:
+			}
+		}
+	}))
+	defer srv.Close()
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.ID = 7
+	opts.ProfilingEndpoint = srv.URL
+	opts.ProfilingInterval = 50 * time.Millisecond
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	seen := make(map[string]bool)
+	for len(seen) < 2 {
+		select {
+		case u := <-uploads:
+			name := u.params.Get("name")
+			profile := name[:strings.Index(name, "{")]
+			seen[profile] = true
+			test.Equal(t, true, strings.Contains(name, "node_id=7"))
+			test.Equal(t, "pprof", u.params.Get("format"))
+			test.Equal(t, true, u.size > 0)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("profiles not uploaded (got %v)", seen)
+		}
+	}
+	test.Equal(t, map[string]bool{"nsqd.cpu": true, "nsqd.heap": true}, seen)
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/nsqio/nsq/internal/diskqueue"
 	"github.com/nsqio/nsq/internal/lg"
 )
 
@@ -23,23 +24,55 @@ type Options struct {
 	HTTPAddress              string        `flag:"http-address"`
 	HTTPSAddress             string        `flag:"https-address"`
 	BroadcastAddress         string        `flag:"broadcast-address"`
+	BroadcastTCPAddress      string        `flag:"broadcast-tcp-address"`
+	BroadcastHTTPAddress     string        `flag:"broadcast-http-address"`
+	BroadcastHTTPSAddress    string        `flag:"broadcast-https-address"`
+	BindFamily               string        `flag:"bind-family"`
 	NSQLookupdTCPAddresses   []string      `flag:"lookupd-tcp-address" cfg:"nsqlookupd_tcp_addresses"`
-	AuthHTTPAddresses        []string      `flag:"auth-http-address" cfg:"auth_http_addresses"`
+	AuthHTTPAddresses        []string      `flag:"auth-http-address" cfg:"auth_http_addresses" secret:"true"`
+	AuthFile                 string        `flag:"auth-file"`
+	AuthPluginAddress        string        `flag:"auth-plugin-address" secret:"true"`
+	NamespaceConfig          string        `flag:"namespace-config"`
 	HTTPClientConnectTimeout time.Duration `flag:"http-client-connect-timeout" cfg:"http_client_connect_timeout"`
 	HTTPClientRequestTimeout time.Duration `flag:"http-client-request-timeout" cfg:"http_client_request_timeout"`
+	HTTPAllowOrigins         []string      `flag:"http-allow-origins" cfg:"http_allow_origins"`
+
+	// tuning of TCP connections of clients and to nsqlookupd (the read and
+	// write deadlines of clients follow their heartbeat interval)
+	TCPKeepAlive        time.Duration `flag:"tcp-keepalive"`
+	TCPUserTimeout      time.Duration `flag:"tcp-user-timeout"`
+	TCPNoDelay          bool          `flag:"tcp-nodelay"`
+	LookupdReadTimeout  time.Duration `flag:"lookupd-read-timeout"`
+	LookupdWriteTimeout time.Duration `flag:"lookupd-write-timeout"`
+
+	// HTTP API rate limits (requests per second, 0 is unlimited)
+	HTTPRateLimit      float64 `flag:"http-rate-limit"`
+	HTTPRateLimitPub   float64 `flag:"http-rate-limit-pub"`
+	HTTPRateLimitStats float64 `flag:"http-rate-limit-stats"`
+	HTTPRateLimitAdmin float64 `flag:"http-rate-limit-admin"`
+
+	// allow POST /debug/loadgen to publish synthesized messages
+	LoadgenEnabled bool `flag:"loadgen"`
 
 	// diskqueue options
-	DataPath        string        `flag:"data-path"`
-	MemQueueSize    int64         `flag:"mem-queue-size"`
-	MaxBytesPerFile int64         `flag:"max-bytes-per-file"`
-	SyncEvery       int64         `flag:"sync-every"`
-	SyncTimeout     time.Duration `flag:"sync-timeout"`
-
-	QueueScanInterval        time.Duration
-	QueueScanRefreshInterval time.Duration
-	QueueScanSelectionCount  int `flag:"queue-scan-selection-count"`
-	QueueScanWorkerPoolMax   int `flag:"queue-scan-worker-pool-max"`
-	QueueScanDirtyPercent    float64
+	DataPath            string        // the first of DataPaths, stores metadata
+	DataPaths           []string      `flag:"data-path" cfg:"data_path"`
+	DataPathPlacement   string        `flag:"data-path-placement"`
+	BackupDir           string        `flag:"backup-dir"`
+	RestoreFrom         string        `flag:"restore-from"`
+	Recover             bool          `flag:"recover"`
+	StrictStartup       bool          `flag:"strict-startup"`
+	MemQueueSize        int64         `flag:"mem-queue-size"`
+	EphemeralBufferSize int64         `flag:"ephemeral-buffer-size"`
+	ChannelStagingSize  int64         `flag:"channel-staging-size"`
+	MaxBytesPerFile     int64         `flag:"max-bytes-per-file"`
+	SyncEvery           int64         `flag:"sync-every"`
+	SyncTimeout         time.Duration `flag:"sync-timeout"`
+	SyncGroupCommit     time.Duration `flag:"sync-group-commit"`
+	DiskCompression     string        `flag:"disk-compression"`
+	BackendMsgEnvelope  int           `flag:"backend-msg-envelope"`
+
+	QueueScanWorkerPoolMax int `flag:"queue-scan-worker-pool-max"`
 
 	// msg and command options
 	MsgTimeout    time.Duration `flag:"msg-timeout"`
@@ -49,14 +82,80 @@ type Options struct {
 	MaxReqTimeout time.Duration `flag:"max-req-timeout"`
 	ClientTimeout time.Duration
 
+	// how the IDs of published messages are generated, or validated when
+	// producers supply them
+	MsgIDGenerator string `flag:"msg-id-generator"`
+	MsgIDPattern   string `flag:"msg-id-pattern"`
+
+	// record the path of messages through nsqd, see Message.Hops, and drop those
+	// that already transited this cluster
+	RecordHops  bool   `flag:"record-hops"`
+	ClusterName string `flag:"cluster-name"`
+
+	// messages published with /pub?async=true waiting to be put in their
+	// topics (0 refuses async publishes)
+	AsyncPubBufferSize int `flag:"async-pub-buffer-size"`
+
+	// a client that sends nothing for this many heartbeat intervals plus the
+	// grace period is considered dead, and its in-flight messages requeued
+	HeartbeatMissLimit   int           `flag:"heartbeat-miss-limit"`
+	HeartbeatGracePeriod time.Duration `flag:"heartbeat-grace-period"`
+
+	// delete topics without channels, messages or publishes for this long (0 never)
+	TopicIdleTimeout       time.Duration `flag:"topic-idle-timeout"`
+	TopicIdleCheckInterval time.Duration
+
+	// hold the messages of new topics this long so channels created meanwhile all get them (0 never)
+	TopicWarmup time.Duration `flag:"topic-warmup"`
+
+	// keep a copy of the messages delivered to channels this long, for channels to seek back (0 never)
+	Retention time.Duration `flag:"retention"`
+
+	// alarm when a channel's depth or oldest message age reaches these (0 never)
+	ChannelAlarmDepth         int64         `flag:"channel-alarm-depth"`
+	ChannelAlarmAge           time.Duration `flag:"channel-alarm-age"`
+	ChannelAlarmWebhook       string        `flag:"channel-alarm-webhook" secret:"true"`
+	ChannelAlarmTopic         string        `flag:"channel-alarm-topic"`
+	ChannelAlarmCheckInterval time.Duration
+
+	// how often channels paused for a duration are checked to be unpaused
+	PauseCheckInterval time.Duration
+
+	// move messages that time out this many times to <channel>#quarantine (0 never)
+	QuarantineTimeouts int `flag:"quarantine-timeouts"`
+
+	// rotation of the audit logs of channels
+	AuditLogMaxBytes int64 `flag:"audit-log-max-bytes"`
+	AuditLogMaxFiles int   `flag:"audit-log-max-files"`
+
+	// naming policy for topics and channels created by clients
+	MaxNameLength        int      `flag:"max-name-length"`
+	TopicNamePattern     string   `flag:"topic-name-pattern"`
+	ChannelNamePattern   string   `flag:"channel-name-pattern"`
+	ReservedNamePrefixes []string `flag:"reserved-name-prefix" cfg:"reserved_name_prefixes"`
+
+	// count messages published to each topic by publisher, showing the top N in stats
+	PublisherStatsTopN int `flag:"publisher-stats-top-n"`
+
+	// fail /health when a data path has less free space
+	HealthMinFreeBytes int64 `flag:"health-min-free-bytes"`
+
+	// refuse clients of these library/version user agents below the version
+	MinClientVersions []string `flag:"min-client-version" cfg:"min_client_versions"`
+
 	// client overridable configuration options
 	MaxHeartbeatInterval   time.Duration `flag:"max-heartbeat-interval"`
 	MaxRdyCount            int64         `flag:"max-rdy-count"`
 	MaxOutputBufferSize    int64         `flag:"max-output-buffer-size"`
+	MinOutputBufferSize    int64         `flag:"min-output-buffer-size"`
+	OutputBufferSize       int64         `flag:"output-buffer-size"`
 	MaxOutputBufferTimeout time.Duration `flag:"max-output-buffer-timeout"`
 	MinOutputBufferTimeout time.Duration `flag:"min-output-buffer-timeout"`
 	OutputBufferTimeout    time.Duration `flag:"output-buffer-timeout"`
+	AdaptiveOutputFlush    bool          `flag:"adaptive-output-flush"`
 	MaxChannelConsumers    int           `flag:"max-channel-consumers"`
+	RdyHintInterval        time.Duration `flag:"rdy-hint-interval"`
+	PublishCreditWindow    int64         `flag:"publish-credit-window"`
 
 	// statsd integration
 	StatsdAddress       string        `flag:"statsd-address"`
@@ -64,10 +163,21 @@ type Options struct {
 	StatsdInterval      time.Duration `flag:"statsd-interval"`
 	StatsdMemStats      bool          `flag:"statsd-mem-stats"`
 	StatsdUDPPacketSize int           `flag:"statsd-udp-packet-size"`
+	StatsdProtocol      string        `flag:"statsd-protocol"`
+	StatsdTLSRootCAFile string        `flag:"statsd-tls-root-ca-file"`
+	StatsdBufferSize    int           `flag:"statsd-buffer-size"`
+
+	// continuous profiling
+	ProfilingEndpoint string        `flag:"profiling-endpoint" secret:"true"`
+	ProfilingInterval time.Duration `flag:"profiling-interval"`
 
 	// e2e message latency
 	E2EProcessingLatencyWindowTime  time.Duration `flag:"e2e-processing-latency-window-time"`
 	E2EProcessingLatencyPercentiles []float64     `flag:"e2e-processing-latency-percentile" cfg:"e2e_processing_latency_percentiles"`
+	// deliver to FIN time, per channel and client
+	ProcessingLatencyPercentiles []float64 `flag:"processing-latency-percentile" cfg:"processing_latency_percentiles"`
+	// event (see Message.EventTimestamp) to FIN time, per channel
+	EventLagPercentiles []float64 `flag:"event-lag-percentile" cfg:"event_lag_percentiles"`
 
 	// TLS config
 	TLSCert             string `flag:"tls-cert"`
@@ -102,23 +212,28 @@ func NewOptions() *Options {
 		HTTPAddress:      "0.0.0.0:4151",
 		HTTPSAddress:     "0.0.0.0:4152",
 		BroadcastAddress: hostname,
+		BindFamily:       "tcp",
 
 		NSQLookupdTCPAddresses: make([]string, 0),
 		AuthHTTPAddresses:      make([]string, 0),
+		HTTPAllowOrigins:       make([]string, 0),
 
 		HTTPClientConnectTimeout: 2 * time.Second,
 		HTTPClientRequestTimeout: 5 * time.Second,
 
-		MemQueueSize:    10000,
-		MaxBytesPerFile: 100 * 1024 * 1024,
-		SyncEvery:       2500,
-		SyncTimeout:     2 * time.Second,
+		TCPNoDelay:          true,
+		LookupdReadTimeout:  time.Second,
+		LookupdWriteTimeout: time.Second,
+
+		DataPathPlacement:  PlacementRoundRobin,
+		MemQueueSize:       10000,
+		MaxBytesPerFile:    100 * 1024 * 1024,
+		SyncEvery:          2500,
+		SyncTimeout:        2 * time.Second,
+		DiskCompression:    diskqueue.CompressionNone,
+		BackendMsgEnvelope: MsgEnvelopeV1,
 
-		QueueScanInterval:        100 * time.Millisecond,
-		QueueScanRefreshInterval: 5 * time.Second,
-		QueueScanSelectionCount:  20,
-		QueueScanWorkerPoolMax:   4,
-		QueueScanDirtyPercent:    0.25,
+		QueueScanWorkerPoolMax: 4,
 
 		MsgTimeout:    60 * time.Second,
 		MaxMsgTimeout: 15 * time.Minute,
@@ -127,18 +242,41 @@ func NewOptions() *Options {
 		MaxReqTimeout: 1 * time.Hour,
 		ClientTimeout: 60 * time.Second,
 
+		MsgIDGenerator: MsgIDGeneratorSnowflake,
+
+		AsyncPubBufferSize: 10000,
+
+		HeartbeatMissLimit: 2,
+
+		TopicIdleCheckInterval: time.Minute,
+
+		ChannelAlarmCheckInterval: 10 * time.Second,
+
+		PauseCheckInterval: time.Second,
+
+		AuditLogMaxBytes: 100 * 1024 * 1024,
+		AuditLogMaxFiles: 10,
+
 		MaxHeartbeatInterval:   60 * time.Second,
 		MaxRdyCount:            2500,
 		MaxOutputBufferSize:    64 * 1024,
+		MinOutputBufferSize:    64,
+		OutputBufferSize:       defaultBufferSize,
 		MaxOutputBufferTimeout: 30 * time.Second,
 		MinOutputBufferTimeout: 25 * time.Millisecond,
 		OutputBufferTimeout:    250 * time.Millisecond,
 		MaxChannelConsumers:    0,
+		RdyHintInterval:        5 * time.Second,
+		PublishCreditWindow:    1000,
 
 		StatsdPrefix:        "nsq.%s",
 		StatsdInterval:      60 * time.Second,
 		StatsdMemStats:      true,
 		StatsdUDPPacketSize: 508,
+		StatsdProtocol:      "udp",
+		StatsdBufferSize:    1024 * 1024,
+
+		ProfilingInterval: 10 * time.Second,
 
 		E2EProcessingLatencyWindowTime: time.Duration(10 * time.Minute),
 
@@ -0,0 +1,72 @@
+package nsqd
+
+import (
+	"strings"
+)
+
+const (
+	PlacementRoundRobin = "round-robin"
+	PlacementFreeSpace  = "free-space"
+)
+
+// dataPaths returns all configured data paths, the first of which stores metadata
+func dataPaths(opts *Options) []string {
+	if len(opts.DataPaths) > 0 {
+		return opts.DataPaths
+	}
+	return []string{opts.DataPath}
+}
+
+// topicDataPath returns the data path to store a new topic (and its channels) in,
+// either the one recorded in metadata or, for a topic new to this nsqd, one chosen
+// according to --data-path-placement
+//
+// this expects the caller to handle locking
+func (n *NSQD) topicDataPath(topicName string) string {
+	opts := n.getOpts()
+	paths := dataPaths(opts)
+
+	if dataPath, ok := n.topicPlacements[topicName]; ok {
+		delete(n.topicPlacements, topicName)
+		if !containsString(paths, dataPath) {
+			n.logf(LOG_WARN, "TOPIC(%s): data path %s is no longer a --data-path, using it anyway",
+				topicName, dataPath)
+		}
+		return dataPath
+	}
+
+	if len(paths) == 1 || strings.HasSuffix(topicName, "#ephemeral") {
+		return paths[0]
+	}
+
+	if opts.DataPathPlacement == PlacementFreeSpace {
+		var best string
+		var bestFree uint64
+		for _, p := range paths {
+			free, err := freeSpace(p)
+			if err != nil {
+				n.logf(LOG_WARN, "failed to get free space of %s - %s", p, err)
+				continue
+			}
+			if best == "" || free > bestFree {
+				best, bestFree = p, free
+			}
+		}
+		if best != "" {
+			return best
+		}
+	}
+
+	dataPath := paths[n.placementCount%uint64(len(paths))]
+	n.placementCount++
+	return dataPath
+}
+
+func containsString(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
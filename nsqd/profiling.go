@@ -0,0 +1,110 @@
+package nsqd
+
+import (
+	"bytes"
+	stdcontext "context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nsqio/nsq/internal/http_api"
+)
+
+// profilingLabels are the labels of the profiles of nsqd (pyroscope syntax)
+func profilingLabels(opts *Options) string {
+	hostname, _ := os.Hostname()
+	labels := []string{
+		"hostname=" + hostname,
+		"broadcast_address=" + opts.BroadcastAddress,
+		"node_id=" + strconv.FormatInt(opts.ID, 10),
+	}
+	for i, l := range labels {
+		// pyroscope label values can't contain these
+		labels[i] = strings.NewReplacer(",", "_", "{", "_", "}", "_", " ", "_").Replace(l)
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// setProfilingLabels labels the samples of the goroutine (and the goroutines it
+// starts) in profiles, e.g. with the topic and channel whose messages it handles
+func setProfilingLabels(labels ...string) {
+	pprof.SetGoroutineLabels(pprof.WithLabels(stdcontext.Background(), pprof.Labels(labels...)))
+}
+
+// profilingLoop uploads a CPU profile covering each --profiling-interval and a
+// heap profile at its end to --profiling-endpoint, with the pyroscope ingest
+// API. Samples are labeled with the topic and channel of the message pumps.
+func (n *NSQD) profilingLoop() {
+	opts := n.getOpts()
+	client := &http.Client{
+		Transport: http_api.NewDeadlineTransport(opts.HTTPClientConnectTimeout, opts.HTTPClientRequestTimeout),
+	}
+	labels := profilingLabels(opts)
+
+	ticker := time.NewTicker(opts.ProfilingInterval)
+	defer ticker.Stop()
+	for {
+		start := time.Now()
+		var cpu bytes.Buffer
+		// fails while another CPU profile is taken (e.g. /debug/pprof/profile)
+		cpuErr := pprof.StartCPUProfile(&cpu)
+		if cpuErr != nil {
+			n.logf(LOG_WARN, "PROFILING: failed to start CPU profile - %s", cpuErr)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-n.exitChan:
+			if cpuErr == nil {
+				pprof.StopCPUProfile()
+			}
+			return
+		}
+		end := time.Now()
+
+		if cpuErr == nil {
+			pprof.StopCPUProfile()
+			n.uploadProfile(client, "cpu", labels, start, end, &cpu)
+		}
+		var heap bytes.Buffer
+		err := pprof.Lookup("heap").WriteTo(&heap, 0)
+		if err != nil {
+			n.logf(LOG_ERROR, "PROFILING: failed to write heap profile - %s", err)
+			continue
+		}
+		n.uploadProfile(client, "heap", labels, start, end, &heap)
+	}
+}
+
+func (n *NSQD) uploadProfile(client *http.Client, name string, labels string, start time.Time, end time.Time, body io.Reader) {
+	endpoint := n.getOpts().ProfilingEndpoint
+	params := url.Values{}
+	params.Set("name", "nsqd."+name+labels)
+	params.Set("from", strconv.FormatInt(start.Unix(), 10))
+	params.Set("until", strconv.FormatInt(end.Unix(), 10))
+	params.Set("format", "pprof")
+	params.Set("spyName", "gospy")
+	if name == "cpu" {
+		params.Set("sampleRate", "100")
+	}
+
+	u := fmt.Sprintf("%s/ingest?%s", strings.TrimSuffix(endpoint, "/"), params.Encode())
+	resp, err := client.Post(u, "application/octet-stream", body)
+	if err != nil {
+		n.logf(LOG_ERROR, "PROFILING: failed to upload %s profile - %s", name, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		n.logf(LOG_ERROR, "PROFILING: failed to upload %s profile - got response %s %q",
+			name, resp.Status, msg)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"math/rand"
 	"net"
@@ -13,7 +14,9 @@ import (
 	"time"
 	"unsafe"
 
+	"github.com/nsqio/nsq/internal/faults"
 	"github.com/nsqio/nsq/internal/protocol"
+	"github.com/nsqio/nsq/internal/timingwheel"
 	"github.com/nsqio/nsq/internal/version"
 )
 
@@ -23,6 +26,8 @@ const (
 	frameTypeResponse int32 = 0
 	frameTypeError    int32 = 1
 	frameTypeMessage  int32 = 2
+	// sent unprompted to clients that opted in, see rdyHintFrame
+	frameTypeControl int32 = 3
 )
 
 var separatorBytes = []byte(" ")
@@ -51,9 +56,12 @@ func (p *protocolV2) IOLoop(conn net.Conn) error {
 	go p.messagePump(client, messagePumpStartedChan)
 	<-messagePumpStartedChan
 
+	// a client that misses --heartbeat-miss-limit heartbeats is dead, e.g. its
+	// host crashed leaving the connection half-open
+	dead := false
 	for {
 		if client.HeartbeatInterval > 0 {
-			client.SetReadDeadline(time.Now().Add(client.HeartbeatInterval * 2))
+			client.SetReadDeadline(time.Now().Add(client.readTimeout()))
 		} else {
 			client.SetReadDeadline(zeroTime)
 		}
@@ -64,6 +72,9 @@ func (p *protocolV2) IOLoop(conn net.Conn) error {
 		if err != nil {
 			if err == io.EOF {
 				err = nil
+			} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				dead = true
+				err = fmt.Errorf("no command or heartbeat response for %s", client.readTimeout())
 			} else {
 				err = fmt.Errorf("failed to read command - %s", err)
 			}
@@ -115,18 +126,47 @@ func (p *protocolV2) IOLoop(conn net.Conn) error {
 	conn.Close()
 	close(client.ExitChan)
 	if client.Channel != nil {
+		if dead {
+			requeued := client.Channel.ReapClient(client.ID)
+			p.ctx.nsqd.logf(LOG_WARN, "PROTOCOL(V2): [%s] is dead, requeued %d in-flight messages",
+				client, requeued)
+		}
 		client.Channel.RemoveClient(client.ID)
 	}
 
 	p.ctx.nsqd.RemoveClient(client.ID)
+	p.ctx.nsqd.quotas.disconnect(client.quotaIdentity)
 	return err
 }
 
 func (p *protocolV2) SendMessage(client *clientV2, msg *Message) error {
 	p.ctx.nsqd.logf(LOG_DEBUG, "PROTOCOL(V2): writing msg(%s) to client(%s) - %s", msg.ID, client, msg.Body)
-	var buf = &bytes.Buffer{}
+	if _, ok := faults.Inject(faults.DropFrame); ok {
+		p.ctx.nsqd.logf(LOG_WARN, "PROTOCOL(V2): dropping msg(%s) to client(%s) (injected fault)", msg.ID, client)
+		return nil
+	}
 
-	_, err := msg.WriteTo(buf)
+	client.writeLock.Lock()
+	if client.canBatch() {
+		err := client.queueMessage(msg)
+		client.writeLock.Unlock()
+		return err
+	}
+	client.writeLock.Unlock()
+
+	buf := bufferPoolGet()
+	defer bufferPoolPut(buf)
+	buf.Reset()
+
+	var err error
+	switch atomic.LoadInt32(&client.MsgEnvelope) {
+	case MsgEnvelopeV2:
+		_, err = msg.WriteToV2(buf)
+	case MsgEnvelopeV3:
+		_, err = msg.WriteToV3(buf)
+	default:
+		_, err = msg.WriteTo(buf)
+	}
 	if err != nil {
 		return err
 	}
@@ -149,7 +189,14 @@ func (p *protocolV2) Send(client *clientV2, frameType int32, data []byte) error
 		client.SetWriteDeadline(zeroTime)
 	}
 
-	_, err := protocol.SendFramedResponse(client.Writer, frameType, data)
+	// batched message frames go first
+	err := client.writeBatch()
+	if err != nil {
+		client.writeLock.Unlock()
+		return err
+	}
+
+	_, err = protocol.SendFramedResponse(client.Writer, frameType, data)
 	if err != nil {
 		client.writeLock.Unlock()
 		return err
@@ -203,19 +250,30 @@ func (p *protocolV2) messagePump(client *clientV2, startedChan chan bool) {
 	var err error
 	var memoryMsgChan chan *Message
 	var backendMsgChan chan []byte
+	var routedMsgChan chan *Message
+	var clientRoutedMsgChan chan *Message
 	var subChannel *Channel
 	// NOTE: `flusherChan` is used to bound message latency for
 	// the pathological case of a channel on a low volume topic
 	// with >1 clients having >1 RDY counts
 	var flusherChan <-chan time.Time
 	var sampleRate int32
+	// see rdyHintFrame
+	var rdyHintTicker *timingwheel.Ticker
+	var rdyHintChan <-chan time.Time
+	var rdyHint int64
+	// see grantPublishCredits
+	var creditTicker *timingwheel.Ticker
+	var creditTickerChan <-chan time.Time
+	var creditChan chan int
 
 	subEventChan := client.SubEventChan
 	identifyEventChan := client.IdentifyEventChan
-	outputBufferTicker := time.NewTicker(client.OutputBufferTimeout)
-	heartbeatTicker := time.NewTicker(client.HeartbeatInterval)
+	outputBufferTicker := p.ctx.nsqd.timers.NewTicker(client.OutputBufferTimeout)
+	heartbeatTicker := p.ctx.nsqd.timers.NewTicker(client.HeartbeatInterval)
 	heartbeatChan := heartbeatTicker.C
 	msgTimeout := client.MsgTimeout
+	adaptiveFlush := client.AdaptiveFlush
 
 	// v2 opportunistically buffers data to clients to reduce write system calls
 	// we force flush in two cases:
@@ -223,6 +281,10 @@ func (p *protocolV2) messagePump(client *clientV2, startedChan chan bool) {
 	//    2. we're buffered and the channel has nothing left to send us
 	//       (ie. we would block in this loop anyway)
 	//
+	// with adaptive flushing we also flush as soon as we're buffered and the
+	// channel has no messages queued, rather than making low throughput
+	// channels wait for the output buffer timeout
+	//
 	flushed := true
 
 	// signal to the goroutine that started the messagePump
@@ -234,6 +296,7 @@ func (p *protocolV2) messagePump(client *clientV2, startedChan chan bool) {
 			// the client is not ready to receive messages...
 			memoryMsgChan = nil
 			backendMsgChan = nil
+			routedMsgChan = nil
 			flusherChan = nil
 			// force flush
 			client.writeLock.Lock()
@@ -243,17 +306,32 @@ func (p *protocolV2) messagePump(client *clientV2, startedChan chan bool) {
 				goto exit
 			}
 			flushed = true
+		} else if adaptiveFlush && !flushed && subChannel.Depth() == 0 {
+			// nothing queued that could fill the output buffer...
+			client.writeLock.Lock()
+			err = client.Flush()
+			client.writeLock.Unlock()
+			if err != nil {
+				goto exit
+			}
+			flushed = true
+			memoryMsgChan = subChannel.memoryMsgChan
+			backendMsgChan = subChannel.readBackend()
+			routedMsgChan = clientRoutedMsgChan
+			flusherChan = nil
 		} else if flushed {
 			// last iteration we flushed...
 			// do not select on the flusher ticker channel
 			memoryMsgChan = subChannel.memoryMsgChan
-			backendMsgChan = subChannel.backend.ReadChan()
+			backendMsgChan = subChannel.readBackend()
+			routedMsgChan = clientRoutedMsgChan
 			flusherChan = nil
 		} else {
 			// we're buffered (if there isn't any more data we should flush)...
 			// select on the flusher ticker channel, too
 			memoryMsgChan = subChannel.memoryMsgChan
-			backendMsgChan = subChannel.backend.ReadChan()
+			backendMsgChan = subChannel.readBackend()
+			routedMsgChan = clientRoutedMsgChan
 			flusherChan = outputBufferTicker.C
 		}
 
@@ -273,27 +351,65 @@ func (p *protocolV2) messagePump(client *clientV2, startedChan chan bool) {
 		case subChannel = <-subEventChan:
 			// you can't SUB anymore
 			subEventChan = nil
+			setProfilingLabels("topic", subChannel.topicName, "channel", subChannel.name)
+			clientRoutedMsgChan = subChannel.routedMsgChan(client.ID)
 		case identifyData := <-identifyEventChan:
 			// you can't IDENTIFY anymore
 			identifyEventChan = nil
 
 			outputBufferTicker.Stop()
 			if identifyData.OutputBufferTimeout > 0 {
-				outputBufferTicker = time.NewTicker(identifyData.OutputBufferTimeout)
+				outputBufferTicker = p.ctx.nsqd.timers.NewTicker(identifyData.OutputBufferTimeout)
 			}
 
 			heartbeatTicker.Stop()
 			heartbeatChan = nil
 			if identifyData.HeartbeatInterval > 0 {
-				heartbeatTicker = time.NewTicker(identifyData.HeartbeatInterval)
+				heartbeatTicker = p.ctx.nsqd.timers.NewTicker(identifyData.HeartbeatInterval)
 				heartbeatChan = heartbeatTicker.C
 			}
 
+			adaptiveFlush = identifyData.AdaptiveFlush
+
 			if identifyData.SampleRate > 0 {
 				sampleRate = identifyData.SampleRate
 			}
 
 			msgTimeout = identifyData.MsgTimeout
+
+			if identifyData.RdyHintInterval > 0 {
+				rdyHintTicker = p.ctx.nsqd.timers.NewTicker(identifyData.RdyHintInterval)
+				rdyHintChan = rdyHintTicker.C
+			}
+
+			if identifyData.PublishCredits {
+				creditTicker = p.ctx.nsqd.timers.NewTicker(publishCreditCheckInterval)
+				creditTickerChan = creditTicker.C
+				creditChan = client.creditChan
+			}
+		case <-creditTickerChan:
+			err = p.grantPublishCredits(client)
+			if err != nil {
+				goto exit
+			}
+		case <-creditChan:
+			err = p.grantPublishCredits(client)
+			if err != nil {
+				goto exit
+			}
+		case <-rdyHintChan:
+			if subChannel == nil {
+				continue
+			}
+			hint := subChannel.rdyHint(p.ctx.nsqd.getOpts().MaxRdyCount)
+			if hint == rdyHint {
+				continue
+			}
+			err = p.Send(client, frameTypeControl, rdyHintFrame(hint))
+			if err != nil {
+				goto exit
+			}
+			rdyHint = hint
 		case <-heartbeatChan:
 			err = p.Send(client, frameTypeResponse, heartbeatBytes)
 			if err != nil {
@@ -309,24 +425,50 @@ func (p *protocolV2) messagePump(client *clientV2, startedChan chan bool) {
 				p.ctx.nsqd.logf(LOG_ERROR, "failed to decode message - %s", err)
 				continue
 			}
+			if subChannel.routeByKey(msg, client.ID) {
+				continue
+			}
 			msg.Attempts++
 
+			// a FIN (or a timeout) releases msg as soon as it's in flight, hold
+			// on to it until it's written
+			msg.retain()
 			subChannel.StartInFlightTimeout(msg, client.ID, msgTimeout)
 			client.SendingMessage()
 			err = p.SendMessage(client, msg)
+			releaseMessage(msg)
 			if err != nil {
 				goto exit
 			}
 			flushed = false
 		case msg := <-memoryMsgChan:
+			if subChannel.routeByKey(msg, client.ID) {
+				continue
+			}
 			if sampleRate > 0 && rand.Int31n(100) > sampleRate {
+				releaseMessage(msg)
 				continue
 			}
 			msg.Attempts++
 
+			msg.retain()
 			subChannel.StartInFlightTimeout(msg, client.ID, msgTimeout)
 			client.SendingMessage()
 			err = p.SendMessage(client, msg)
+			releaseMessage(msg)
+			if err != nil {
+				goto exit
+			}
+			flushed = false
+		case msg := <-routedMsgChan:
+			// routed to this client by key, see Channel.SetKeyRouting
+			msg.Attempts++
+
+			msg.retain()
+			subChannel.StartInFlightTimeout(msg, client.ID, msgTimeout)
+			client.SendingMessage()
+			err = p.SendMessage(client, msg)
+			releaseMessage(msg)
 			if err != nil {
 				goto exit
 			}
@@ -340,6 +482,12 @@ exit:
 	p.ctx.nsqd.logf(LOG_INFO, "PROTOCOL(V2): [%s] exiting messagePump", client)
 	heartbeatTicker.Stop()
 	outputBufferTicker.Stop()
+	if rdyHintTicker != nil {
+		rdyHintTicker.Stop()
+	}
+	if creditTicker != nil {
+		creditTicker.Stop()
+	}
 	if err != nil {
 		p.ctx.nsqd.logf(LOG_ERROR, "PROTOCOL(V2): [%s] messagePump error - %s", client, err)
 	}
@@ -382,6 +530,12 @@ func (p *protocolV2) IDENTIFY(client *clientV2, params [][]byte) ([]byte, error)
 
 	p.ctx.nsqd.logf(LOG_DEBUG, "PROTOCOL(V2): [%s] %+v", client, identifyData)
 
+	err = p.ctx.nsqd.clientVersions.check(identifyData.UserAgent)
+	if err != nil {
+		p.ctx.nsqd.logf(LOG_WARN, "PROTOCOL(V2): [%s] refusing client - %s", client, err)
+		return nil, protocol.NewFatalClientErr(nil, "E_CLIENT_VERSION", "IDENTIFY "+err.Error())
+	}
+
 	err = client.Identify(identifyData)
 	if err != nil {
 		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "IDENTIFY "+err.Error())
@@ -389,6 +543,7 @@ func (p *protocolV2) IDENTIFY(client *clientV2, params [][]byte) ([]byte, error)
 
 	// bail out early if we're not negotiating features
 	if !identifyData.FeatureNegotiation {
+		client.SetFeatures(identifyFeatures(identifyData, false, false, false))
 		return okBytes, nil
 	}
 
@@ -406,6 +561,7 @@ func (p *protocolV2) IDENTIFY(client *clientV2, params [][]byte) ([]byte, error)
 	if deflate && snappy {
 		return nil, protocol.NewFatalClientErr(nil, "E_IDENTIFY_FAILED", "cannot enable both deflate and snappy compression")
 	}
+	client.SetFeatures(identifyFeatures(identifyData, tlsv1, deflate, snappy))
 
 	resp, err := json.Marshal(struct {
 		MaxRdyCount         int64  `json:"max_rdy_count"`
@@ -421,6 +577,13 @@ func (p *protocolV2) IDENTIFY(client *clientV2, params [][]byte) ([]byte, error)
 		AuthRequired        bool   `json:"auth_required"`
 		OutputBufferSize    int    `json:"output_buffer_size"`
 		OutputBufferTimeout int64  `json:"output_buffer_timeout"`
+		AdaptiveFlush       bool   `json:"adaptive_flush"`
+		MsgEnvelope         int32  `json:"msg_envelope"`
+		RdyHints            bool   `json:"rdy_hints"`
+		PublishCredits      int64  `json:"publish_credits"`
+		MsgIDs              bool   `json:"msg_ids"`
+		EventTimestamps     bool   `json:"event_timestamps"`
+		Hops                bool   `json:"hops"`
 	}{
 		MaxRdyCount:         p.ctx.nsqd.getOpts().MaxRdyCount,
 		Version:             version.Binary,
@@ -435,6 +598,13 @@ func (p *protocolV2) IDENTIFY(client *clientV2, params [][]byte) ([]byte, error)
 		AuthRequired:        p.ctx.nsqd.IsAuthEnabled(),
 		OutputBufferSize:    client.OutputBufferSize,
 		OutputBufferTimeout: int64(client.OutputBufferTimeout / time.Millisecond),
+		AdaptiveFlush:       client.AdaptiveFlush,
+		MsgEnvelope:         atomic.LoadInt32(&client.MsgEnvelope),
+		RdyHints:            client.RdyHintInterval > 0,
+		PublishCredits:      atomic.LoadInt64(&client.PublishCredits),
+		MsgIDs:              client.MsgIDs,
+		EventTimestamps:     client.EventTimestamps,
+		Hops:                client.MsgHops,
 	})
 	if err != nil {
 		return nil, protocol.NewFatalClientErr(err, "E_IDENTIFY_FAILED", "IDENTIFY failed "+err.Error())
@@ -535,6 +705,12 @@ func (p *protocolV2) AUTH(client *clientV2, params [][]byte) ([]byte, error) {
 		return nil, protocol.NewFatalClientErr(nil, "E_UNAUTHORIZED", "AUTH no authorizations found")
 	}
 
+	err = p.ctx.nsqd.quotas.connect(client.AuthState.Identity, client.AuthState.Quotas)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(nil, "E_QUOTA_EXCEEDED", "AUTH "+err.Error())
+	}
+	client.quotaIdentity = client.AuthState.Identity
+
 	resp, err := json.Marshal(struct {
 		Identity        string `json:"identity"`
 		IdentityURL     string `json:"identity_url"`
@@ -575,6 +751,55 @@ func (p *protocolV2) CheckAuth(client *clientV2, cmd, topicName, channelName str
 			return protocol.NewFatalClientErr(nil, "E_UNAUTHORIZED",
 				fmt.Sprintf("AUTH failed for %s on %q %q", cmd, topicName, channelName))
 		}
+		if err := client.ctx.nsqd.checkNamespaceIdentity(topicName, client.quotaIdentity); err != nil {
+			return protocol.NewFatalClientErr(nil, "E_UNAUTHORIZED",
+				fmt.Sprintf("AUTH failed for %s on %q %q - %s", cmd, topicName, channelName, err))
+		}
+	}
+	return nil
+}
+
+// getTopic gets or creates topicName, counting a new topic against the
+// quotas of its namespace and the client's identity
+func (p *protocolV2) getTopic(client *clientV2, cmd string, topicName string) (*Topic, error) {
+	if topic, err := p.ctx.nsqd.GetExistingTopic(topicName); err == nil {
+		return topic, nil
+	}
+	if err := p.ctx.nsqd.namePolicy.checkTopic(topicName); err != nil {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_TOPIC",
+			fmt.Sprintf("%s topic name %q is not allowed, %s", cmd, topicName, err))
+	}
+	if err := p.ctx.nsqd.checkNamespaceTopicLimit(topicName); err != nil {
+		return nil, protocol.NewFatalClientErr(nil, "E_QUOTA_EXCEEDED", cmd+" "+err.Error())
+	}
+	if err := p.ctx.nsqd.quotas.createTopic(client.quotaIdentity, topicName); err != nil {
+		return nil, protocol.NewFatalClientErr(nil, "E_QUOTA_EXCEEDED", cmd+" "+err.Error())
+	}
+	return p.ctx.nsqd.GetTopic(topicName), nil
+}
+
+// checkPublisher returns an error if the client isn't one of topic's
+// publishers
+func (p *protocolV2) checkPublisher(client *clientV2, cmd string, topic *Topic) error {
+	identity := ""
+	if client.AuthState != nil {
+		identity = client.AuthState.Identity
+	}
+	if !topic.IsPublisherAllowed(identity, client.CommonName()) {
+		return protocol.NewFatalClientErr(nil, "E_UNAUTHORIZED",
+			fmt.Sprintf("%s not allowed to publish to %q", cmd, topic.name))
+	}
+	return nil
+}
+
+// checkPublishQuota takes count messages from the publish rate quotas of the
+// client's identity and topicName's namespace
+func (p *protocolV2) checkPublishQuota(client *clientV2, cmd string, topicName string, count int) error {
+	if err := p.ctx.nsqd.quotas.publish(client.quotaIdentity, count); err != nil {
+		return protocol.NewClientErr(nil, "E_QUOTA_EXCEEDED", cmd+" "+err.Error())
+	}
+	if err := p.ctx.nsqd.checkNamespacePublish(topicName, count); err != nil {
+		return protocol.NewClientErr(nil, "E_QUOTA_EXCEEDED", cmd+" "+err.Error())
 	}
 	return nil
 }
@@ -608,14 +833,37 @@ func (p *protocolV2) SUB(client *clientV2, params [][]byte) ([]byte, error) {
 		return nil, err
 	}
 
+	// where the channel starts from, if SUB creates it
+	var start int64
+	if len(params) > 3 {
+		var err error
+		start, err = ParseChannelStart(string(params[3]), time.Now())
+		if err != nil {
+			return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "SUB "+err.Error())
+		}
+	}
+
 	// This retry-loop is a work-around for a race condition, where the
 	// last client can leave the channel between GetChannel() and AddClient().
 	// Avoid adding a client to an ephemeral channel / topic which has started exiting.
 	var channel *Channel
 	for {
-		topic := p.ctx.nsqd.GetTopic(topicName)
-		channel = topic.GetChannel(channelName)
-		if err := channel.AddClient(client.ID, client); err != nil {
+		topic, err := p.getTopic(client, "SUB", topicName)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := topic.GetExistingChannel(channelName); err != nil {
+			if err := p.ctx.nsqd.namePolicy.checkChannel(channelName); err != nil {
+				return nil, protocol.NewFatalClientErr(nil, "E_BAD_CHANNEL",
+					fmt.Sprintf("SUB channel name %q is not allowed, %s", channelName, err))
+			}
+		}
+		channel = topic.GetChannelFrom(channelName, start)
+		if err := channel.AddClient(client.ID, client); err == ErrTooManyClients {
+			return nil, protocol.NewFatalClientErr(nil, "E_TOO_MANY_CLIENTS",
+				fmt.Sprintf("SUB clients of %s:%s exceeds limit of %d",
+					topicName, channelName, channel.MaxClients()))
+		} else if err != nil {
 			return nil, protocol.NewFatalClientErr(nil, "E_TOO_MANY_CHANNEL_CONSUMERS",
 				fmt.Sprintf("channel consumers for %s:%s exceeds limit of %d",
 					topicName, channelName, p.ctx.nsqd.getOpts().MaxChannelConsumers))
@@ -773,6 +1021,11 @@ func (p *protocolV2) PUB(client *clientV2, params [][]byte) ([]byte, error) {
 			fmt.Sprintf("PUB topic name %q is not valid", topicName))
 	}
 
+	key, err := readMessageKey("PUB", params, 2)
+	if err != nil {
+		return nil, err
+	}
+
 	bodyLen, err := readLen(client.Reader, client.lenSlice)
 	if err != nil {
 		return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", "PUB failed to read message body size")
@@ -798,14 +1051,46 @@ func (p *protocolV2) PUB(client *clientV2, params [][]byte) ([]byte, error) {
 		return nil, err
 	}
 
-	topic := p.ctx.nsqd.GetTopic(topicName)
+	if err := p.checkPublishCredits(client, "PUB", 1); err != nil {
+		return nil, err
+	}
+
+	if err := p.checkPublishQuota(client, "PUB", topicName, 1); err != nil {
+		return nil, err
+	}
+
+	topic, err := p.getTopic(client, "PUB", topicName)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.checkPublisher(client, "PUB", topic); err != nil {
+		return nil, err
+	}
 	msg := NewMessage(topic.GenerateID(), messageBody)
+	if err := p.takeMessageIDs(client, "PUB", []*Message{msg}); err != nil {
+		return nil, err
+	}
+	if err := p.takeEventTimestamps(client, "PUB", []*Message{msg}); err != nil {
+		return nil, err
+	}
+	kept, err := p.recordHops(client, "PUB", topic, []*Message{msg})
+	if err != nil {
+		return nil, err
+	}
+	if len(kept) == 0 {
+		// looped, see ErrHopLoop
+		return okBytes, nil
+	}
+	msg.Producer = client.String()
+	msg.Key = key
 	err = topic.PutMessage(msg)
 	if err != nil {
-		return nil, protocol.NewFatalClientErr(err, "E_PUB_FAILED", "PUB failed "+err.Error())
+		return nil, putErr(err, "E_PUB_FAILED", "PUB failed")
 	}
 
 	client.PublishedMessage(topicName, 1)
+	topic.countPublished(client.publisherName(), 1)
+	client.usePublishCredits(topic, 1)
 
 	return okBytes, nil
 }
@@ -823,11 +1108,22 @@ func (p *protocolV2) MPUB(client *clientV2, params [][]byte) ([]byte, error) {
 			fmt.Sprintf("E_BAD_TOPIC MPUB topic name %q is not valid", topicName))
 	}
 
+	key, err := readMessageKey("MPUB", params, 2)
+	if err != nil {
+		return nil, err
+	}
+
 	if err := p.CheckAuth(client, "MPUB", topicName, ""); err != nil {
 		return nil, err
 	}
 
-	topic := p.ctx.nsqd.GetTopic(topicName)
+	topic, err := p.getTopic(client, "MPUB", topicName)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.checkPublisher(client, "MPUB", topic); err != nil {
+		return nil, err
+	}
 
 	bodyLen, err := readLen(client.Reader, client.lenSlice)
 	if err != nil {
@@ -849,16 +1145,44 @@ func (p *protocolV2) MPUB(client *clientV2, params [][]byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := p.takeMessageIDs(client, "MPUB", messages); err != nil {
+		return nil, err
+	}
+	if err := p.takeEventTimestamps(client, "MPUB", messages); err != nil {
+		return nil, err
+	}
+	messages, err = p.recordHops(client, "MPUB", topic, messages)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		// all looped, see ErrHopLoop
+		return okBytes, nil
+	}
+	for _, msg := range messages {
+		msg.Producer = client.String()
+		msg.Key = key
+	}
+
+	if err := p.checkPublishCredits(client, "MPUB", len(messages)); err != nil {
+		return nil, err
+	}
+
+	if err := p.checkPublishQuota(client, "MPUB", topicName, len(messages)); err != nil {
+		return nil, err
+	}
 
 	// if we've made it this far we've validated all the input,
 	// the only possible error is that the topic is exiting during
 	// this next call (and no messages will be queued in that case)
 	err = topic.PutMessages(messages)
 	if err != nil {
-		return nil, protocol.NewFatalClientErr(err, "E_MPUB_FAILED", "MPUB failed "+err.Error())
+		return nil, putErr(err, "E_MPUB_FAILED", "MPUB failed")
 	}
 
 	client.PublishedMessage(topicName, uint64(len(messages)))
+	topic.countPublished(client.publisherName(), uint64(len(messages)))
+	client.usePublishCredits(topic, len(messages))
 
 	return okBytes, nil
 }
@@ -889,6 +1213,11 @@ func (p *protocolV2) DPUB(client *clientV2, params [][]byte) ([]byte, error) {
 				timeoutMs, p.ctx.nsqd.getOpts().MaxReqTimeout/time.Millisecond))
 	}
 
+	key, err := readMessageKey("DPUB", params, 3)
+	if err != nil {
+		return nil, err
+	}
+
 	bodyLen, err := readLen(client.Reader, client.lenSlice)
 	if err != nil {
 		return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", "DPUB failed to read message body size")
@@ -914,15 +1243,47 @@ func (p *protocolV2) DPUB(client *clientV2, params [][]byte) ([]byte, error) {
 		return nil, err
 	}
 
-	topic := p.ctx.nsqd.GetTopic(topicName)
+	if err := p.checkPublishCredits(client, "DPUB", 1); err != nil {
+		return nil, err
+	}
+
+	if err := p.checkPublishQuota(client, "DPUB", topicName, 1); err != nil {
+		return nil, err
+	}
+
+	topic, err := p.getTopic(client, "DPUB", topicName)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.checkPublisher(client, "DPUB", topic); err != nil {
+		return nil, err
+	}
 	msg := NewMessage(topic.GenerateID(), messageBody)
+	if err := p.takeMessageIDs(client, "DPUB", []*Message{msg}); err != nil {
+		return nil, err
+	}
+	if err := p.takeEventTimestamps(client, "DPUB", []*Message{msg}); err != nil {
+		return nil, err
+	}
+	kept, err := p.recordHops(client, "DPUB", topic, []*Message{msg})
+	if err != nil {
+		return nil, err
+	}
+	if len(kept) == 0 {
+		// looped, see ErrHopLoop
+		return okBytes, nil
+	}
+	msg.Producer = client.String()
+	msg.Key = key
 	msg.deferred = timeoutDuration
 	err = topic.PutMessage(msg)
 	if err != nil {
-		return nil, protocol.NewFatalClientErr(err, "E_DPUB_FAILED", "DPUB failed "+err.Error())
+		return nil, putErr(err, "E_DPUB_FAILED", "DPUB failed")
 	}
 
 	client.PublishedMessage(topicName, 1)
+	topic.countPublished(client.publisherName(), 1)
+	client.usePublishCredits(topic, 1)
 
 	return okBytes, nil
 }
@@ -997,6 +1358,104 @@ func readMPUB(r io.Reader, tmp []byte, topic *Topic, maxMessageSize int64, maxBo
 	return messages, nil
 }
 
+// takeMessageIDs sets the IDs of the messages published by client to the IDs
+// their bodies start with, which it must supply with --msg-id-generator=producer
+// (IDENTIFY msg_ids)
+func (p *protocolV2) takeMessageIDs(client *clientV2, cmd string, msgs []*Message) error {
+	if !client.MsgIDs {
+		if p.ctx.nsqd.msgIDPolicy.producerIDs() {
+			return protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+				fmt.Sprintf("%s requires message IDs (IDENTIFY msg_ids)", cmd))
+		}
+		return nil
+	}
+	err := p.ctx.nsqd.msgIDPolicy.takeIDs(msgs)
+	if err != nil {
+		return protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE", fmt.Sprintf("%s %s", cmd, err))
+	}
+	return nil
+}
+
+// takeEventTimestamps sets the event timestamps of the messages published by
+// client to the 8-byte (int64) nanosecond timestamps their bodies start with,
+// when it IDENTIFY'd with event_timestamps
+func (p *protocolV2) takeEventTimestamps(client *clientV2, cmd string, msgs []*Message) error {
+	if !client.EventTimestamps {
+		return nil
+	}
+	for _, msg := range msgs {
+		if len(msg.Body) <= 8 {
+			return protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+				fmt.Sprintf("%s message body size %d doesn't fit an event timestamp and a body", cmd, len(msg.Body)))
+		}
+		ts := int64(binary.BigEndian.Uint64(msg.Body[:8]))
+		if ts <= 0 {
+			return protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+				fmt.Sprintf("%s invalid event timestamp %d", cmd, ts))
+		}
+		msg.EventTimestamp = ts
+		msg.Body = msg.Body[8:]
+		msg.Checksum = crc32.Checksum(msg.Body, crc32cTable)
+	}
+	return nil
+}
+
+// recordHops records the hops of the messages published by client with
+// --record-hops, after the hops their bodies start with (a 2-byte (uint16) length
+// and the hops) when it IDENTIFY'd with hops. It returns the messages that
+// didn't loop, those that already transited this cluster are dropped (see
+// ErrHopLoop) without failing the publish so that republishers move on.
+func (p *protocolV2) recordHops(client *clientV2, cmd string, topic *Topic, msgs []*Message) ([]*Message, error) {
+	if !p.ctx.nsqd.getOpts().RecordHops {
+		return msgs, nil
+	}
+	kept := msgs[:0]
+	for _, msg := range msgs {
+		var hops string
+		if client.MsgHops {
+			if len(msg.Body) < 2 {
+				return nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+					fmt.Sprintf("%s message body size %d doesn't fit hops", cmd, len(msg.Body)))
+			}
+			hopsLen := int(binary.BigEndian.Uint16(msg.Body[:2]))
+			if len(msg.Body) <= 2+hopsLen {
+				return nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+					fmt.Sprintf("%s message body size %d doesn't fit %d bytes of hops and a body", cmd, len(msg.Body), hopsLen))
+			}
+			hops = string(msg.Body[2 : 2+hopsLen])
+			msg.Body = msg.Body[2+hopsLen:]
+			msg.Checksum = crc32.Checksum(msg.Body, crc32cTable)
+		}
+		err := p.ctx.nsqd.recordHop(msg, hops, client.String())
+		if err == ErrHopLoop {
+			continue
+		}
+		if err != nil {
+			return nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE", fmt.Sprintf("%s %s", cmd, err))
+		}
+		kept = append(kept, msg)
+	}
+	if dropped := len(msgs) - len(kept); dropped > 0 {
+		topic.countLoopDrops(uint64(dropped))
+		p.ctx.nsqd.logf(LOG_DEBUG, "PROTOCOL(V2): [%s] %s dropped %d messages that already transited this cluster",
+			client, cmd, dropped)
+	}
+	return kept, nil
+}
+
+// readMessageKey returns the optional routing key param of a publish command at
+// params[i]
+func readMessageKey(cmd string, params [][]byte, i int) (string, error) {
+	if len(params) <= i {
+		return "", nil
+	}
+	if len(params[i]) == 0 || len(params[i]) > MaxKeyLength {
+		return "", protocol.NewFatalClientErr(nil, "E_INVALID",
+			fmt.Sprintf("%s key length %d out of range 1-%d", cmd, len(params[i]), MaxKeyLength))
+	}
+	return string(params[i]), nil
+}
+
 // validate and cast the bytes on the wire to a message ID
 func getMessageID(p []byte) (*MessageID, error) {
 	if len(p) != MsgIDLength {
@@ -1020,3 +1479,15 @@ func enforceTLSPolicy(client *clientV2, p *protocolV2, command []byte) error {
 	}
 	return nil
 }
+
+// putErr returns the error for a failed publish, which is fatal unless the topic
+// is over its disk quota or draining
+func putErr(err error, code string, desc string) error {
+	if err == ErrDiskQuotaExceeded {
+		return protocol.NewClientErr(err, "E_DISK_QUOTA_EXCEEDED", desc+" "+err.Error())
+	}
+	if err == ErrTopicDraining {
+		return protocol.NewClientErr(err, "E_TOPIC_DRAINING", desc+" "+err.Error())
+	}
+	return protocol.NewFatalClientErr(err, code, desc+" "+err.Error())
+}
@@ -5,9 +5,11 @@ import (
 	"bytes"
 	"compress/flate"
 	"crypto/tls"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"math"
@@ -19,6 +21,7 @@ import (
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -27,6 +30,7 @@ import (
 	"github.com/golang/snappy"
 	"github.com/nsqio/go-nsq"
 	"github.com/nsqio/nsq/internal/protocol"
+	"github.com/nsqio/nsq/internal/quantile"
 	"github.com/nsqio/nsq/internal/test"
 )
 
@@ -125,6 +129,59 @@ func TestChannelTopicNames(t *testing.T) {
 	test.Equal(t, true, protocol.IsValidTopicName("test-with_period."))
 	test.Equal(t, true, protocol.IsValidTopicName("test#ephemeral"))
 	test.Equal(t, false, protocol.IsValidTopicName("test:ephemeral"))
+	test.Equal(t, true, protocol.IsValidTopicName("tenant/test"))
+	test.Equal(t, true, protocol.IsValidTopicName("tenant/test#ephemeral"))
+	test.Equal(t, false, protocol.IsValidTopicName("tenant/"))
+	test.Equal(t, false, protocol.IsValidTopicName("/test"))
+	test.Equal(t, false, protocol.IsValidTopicName("a/b/c"))
+	test.Equal(t, false, protocol.IsValidChannelName("tenant/ch"))
+}
+
+func TestNamePolicy(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxNameLength = 20
+	opts.TopicNamePattern = `[a-z]+\.[a-z]+\.[a-z_]+`
+	opts.ReservedNamePrefixes = []string{"__"}
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	// existing topics and channels aren't subject to the policy
+	nsqd.GetTopic("legacy").GetChannel("__ch")
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	_, err = nsq.Publish("billing.invoices.created", []byte("test body")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeError, `E_BAD_TOPIC PUB topic name "billing.invoices.created" is not allowed, longer than 20 characters`)
+
+	conn, err = mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	_, err = nsq.Publish("invoices", []byte("test body")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeError, `E_BAD_TOPIC PUB topic name "invoices" is not allowed, does not match ^(?:[a-z]+\.[a-z]+\.[a-z_]+)$`)
+
+	conn, err = mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	_, err = nsq.Publish("billing.inv.new", []byte("test body")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeResponse, "OK")
+	_, err = nsq.Subscribe("billing.inv.new", "__ch").WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeError, `E_BAD_CHANNEL SUB channel name "__ch" is not allowed, prefix "__" is reserved`)
+
+	conn, err = mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, "legacy", "__ch")
 }
 
 // exercise the basic operations of the V2 protocol
@@ -283,6 +340,59 @@ func TestClientHeartbeat(t *testing.T) {
 	test.Nil(t, err)
 }
 
+func TestClientHeartbeatMissed(t *testing.T) {
+	topicName := "test_hb_missed_v2" + strconv.Itoa(int(time.Now().Unix()))
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.ClientTimeout = 200 * time.Millisecond
+	opts.HeartbeatGracePeriod = 100 * time.Millisecond
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+
+	for {
+		resp, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		frameType, data, _ := nsq.UnpackResponse(resp)
+		if frameType == frameTypeMessage {
+			msg, err := decodeMessage(data)
+			test.Nil(t, err)
+			test.Equal(t, []byte("test body"), msg.Body)
+			break
+		}
+	}
+
+	// send nothing, as if the client's host crashed, so that its in-flight
+	// message is requeued long before --msg-timeout
+	start := time.Now()
+	for i := 0; i < 100 && channel.Depth() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, int64(1), channel.Depth())
+	test.Equal(t, true, time.Since(start) >= 200*time.Millisecond)
+
+	stats := NewChannelStats(channel, nil, 0)
+	test.Equal(t, 0, stats.InFlightCount)
+	test.Equal(t, uint64(1), stats.DeadCount)
+	test.Equal(t, uint64(1), stats.RequeueCount)
+	test.Equal(t, uint64(0), stats.TimeoutCount)
+}
+
 func TestClientHeartbeatDisableSUB(t *testing.T) {
 	topicName := "test_hb_v2" + strconv.Itoa(int(time.Now().Unix()))
 
@@ -819,6 +929,279 @@ func TestOutputBufferingValidity(t *testing.T) {
 	test.Equal(t, "E_BAD_BODY IDENTIFY output buffer timeout (1001) is invalid", string(data))
 }
 
+func TestAdaptiveOutputFlush(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.LogLevel = LOG_DEBUG
+	opts.MaxOutputBufferSize = 512 * 1024
+	opts.MaxOutputBufferTimeout = 2 * time.Second
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_adaptive_output_flush" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	outputBufferTimeout := 2000
+
+	topic := nsqd.GetTopic(topicName)
+	msg := NewMessage(topic.GenerateID(), []byte("test body"))
+	topic.PutMessage(msg)
+
+	start := time.Now()
+	data := identify(t, conn, map[string]interface{}{
+		"output_buffer_size":    256 * 1024,
+		"output_buffer_timeout": outputBufferTimeout,
+		"adaptive_flush":        true,
+	}, frameTypeResponse)
+	r := struct {
+		AdaptiveFlush bool `json:"adaptive_flush"`
+	}{}
+	err = json.Unmarshal(data, &r)
+	test.Nil(t, err)
+	test.Equal(t, true, r.AdaptiveFlush)
+	sub(t, conn, topicName, "ch")
+
+	_, err = nsq.Ready(10).WriteTo(conn)
+	test.Nil(t, err)
+
+	// the channel is empty once the message is sent, so it's flushed
+	// without waiting for the output buffer timeout
+	resp, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	end := time.Now()
+
+	test.Equal(t, true, int(end.Sub(start)/time.Millisecond) < outputBufferTimeout)
+
+	frameType, data, err := nsq.UnpackResponse(resp)
+	msgOut, _ := decodeMessage(data)
+	test.Equal(t, frameTypeMessage, frameType)
+	test.Equal(t, msg.ID, msgOut.ID)
+}
+
+func TestRdyHints(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.RdyHintInterval = 10 * time.Millisecond
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_rdy_hints" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.GetChannel("ch")
+	for i := 0; i < 30; i++ {
+		topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+	}
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	data := identify(t, conn, map[string]interface{}{
+		"rdy_hints": true,
+	}, frameTypeResponse)
+	r := struct {
+		RdyHints bool `json:"rdy_hints"`
+	}{}
+	err = json.Unmarshal(data, &r)
+	test.Nil(t, err)
+	test.Equal(t, true, r.RdyHints)
+	sub(t, conn, topicName, "ch")
+
+	// the whole backlog for a single client
+	readValidate(t, conn, frameTypeControl, `{"type":"rdy_hint","max_rdy_count":30}`)
+
+	// shared with a client that didn't opt in
+	conn2, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn2.Close()
+	data = identify(t, conn2, nil, frameTypeResponse)
+	err = json.Unmarshal(data, &r)
+	test.Nil(t, err)
+	test.Equal(t, false, r.RdyHints)
+	sub(t, conn2, topicName, "ch")
+
+	readValidate(t, conn, frameTypeControl, `{"type":"rdy_hint","max_rdy_count":15}`)
+}
+
+func TestPublishCredits(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.PublishCreditWindow = 4
+	opts.MemQueueSize = 2
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_publish_credits" + strconv.Itoa(int(time.Now().Unix()))
+	nsqd.GetTopic(topicName).GetChannel("ch")
+	pressuredTopicName := topicName + "_pressured"
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	data := identify(t, conn, map[string]interface{}{
+		"publish_credits": true,
+	}, frameTypeResponse)
+	r := struct {
+		PublishCredits int64 `json:"publish_credits"`
+	}{}
+	err = json.Unmarshal(data, &r)
+	test.Nil(t, err)
+	test.Equal(t, int64(4), r.PublishCredits)
+
+	mpub := func(topicName string, n int) {
+		body := make([][]byte, n)
+		for i := range body {
+			body[i] = []byte("test body")
+		}
+		cmd, _ := nsq.MultiPublish(topicName, body)
+		_, err := cmd.WriteTo(conn)
+		test.Nil(t, err)
+	}
+	// the grant races the response
+	readFrames := func(n int) map[int32]string {
+		frames := make(map[int32]string)
+		for i := 0; i < n; i++ {
+			resp, err := nsq.ReadResponse(conn)
+			test.Nil(t, err)
+			frameType, data, err := nsq.UnpackResponse(resp)
+			test.Nil(t, err)
+			frames[frameType] = string(data)
+		}
+		return frames
+	}
+
+	// half the window used, replenished
+	mpub(topicName, 2)
+	test.Equal(t, map[int32]string{
+		frameTypeResponse: "OK",
+		frameTypeControl:  `{"type":"publish_credits","credits":2}`,
+	}, readFrames(2))
+
+	mpub(topicName, 5)
+	readValidate(t, conn, frameTypeError, "E_NO_CREDITS MPUB needs 5 publish credits, has 4")
+
+	// more than the in-memory queue of a topic without channels, credits are
+	// withheld until it's consumed
+	mpub(pressuredTopicName, 3)
+	readValidate(t, conn, frameTypeResponse, "OK")
+	conn.SetReadDeadline(time.Now().Add(3 * publishCreditCheckInterval))
+	_, err = nsq.ReadResponse(conn)
+	test.NotNil(t, err)
+	test.Equal(t, true, err.(net.Error).Timeout())
+	conn.SetReadDeadline(time.Time{})
+
+	nsqd.GetTopic(pressuredTopicName).GetChannel("ch")
+	readValidate(t, conn, frameTypeControl, `{"type":"publish_credits","credits":3}`)
+}
+
+func TestProducerMsgIDs(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MsgIDGenerator = MsgIDGeneratorProducer
+	opts.MsgIDPattern = `order-[0-9]{10}`
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_producer_msg_ids" + strconv.Itoa(int(time.Now().Unix()))
+	nsqd.GetTopic(topicName).GetChannel("ch")
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	_, err = nsq.Publish(topicName, []byte("test body")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeError, "E_BAD_MESSAGE PUB requires message IDs (IDENTIFY msg_ids)")
+
+	conn, err = mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	data := identify(t, conn, map[string]interface{}{
+		"msg_ids": true,
+	}, frameTypeResponse)
+	r := struct {
+		MsgIDs bool `json:"msg_ids"`
+	}{}
+	err = json.Unmarshal(data, &r)
+	test.Nil(t, err)
+	test.Equal(t, true, r.MsgIDs)
+	_, err = nsq.Publish(topicName, []byte("order-0000000001test body")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeResponse, "OK")
+	cmd, _ := nsq.MultiPublish(topicName, [][]byte{[]byte("order-0000000002a"), []byte("order-0000000003b")})
+	_, err = cmd.WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeResponse, "OK")
+	_, err = nsq.Publish(topicName, []byte("order-00000000x4test body")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeError, `E_BAD_MESSAGE PUB message ID "order-00000000x4" does not match ^(?:order-[0-9]{10})$`)
+
+	resp, err := http.Post(fmt.Sprintf("http://%s/pub?topic=%s&id=order-0000000004", httpAddr, topicName),
+		"application/octet-stream", bytes.NewBufferString("c"))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	resp, err = http.Post(fmt.Sprintf("http://%s/pub?topic=%s&id=order%%200000000005", httpAddr, topicName),
+		"application/octet-stream", bytes.NewBufferString("d"))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+
+	conn, err = mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(4).WriteTo(conn)
+	test.Nil(t, err)
+	for _, expected := range []struct {
+		id   string
+		body string
+	}{
+		{"order-0000000001", "test body"},
+		{"order-0000000002", "a"},
+		{"order-0000000003", "b"},
+		{"order-0000000004", "c"},
+	} {
+		resp, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		test.Nil(t, err)
+		test.Equal(t, frameTypeMessage, frameType)
+		msg, err := decodeMessage(data)
+		test.Nil(t, err)
+		test.Equal(t, expected.id, string(msg.ID[:]))
+		test.Equal(t, expected.body, string(msg.Body))
+	}
+
+	// the checksums are of the bodies without the IDs
+	msg := NewMessage(MessageID{}, []byte("order-0000000005e"))
+	test.Nil(t, nsqd.msgIDPolicy.takeIDs([]*Message{msg}))
+	test.Equal(t, crc32.Checksum([]byte("e"), crc32cTable), msg.Checksum)
+}
+
+func TestMsgIDsNotAllowed(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	data := identify(t, conn, map[string]interface{}{
+		"msg_ids": true,
+	}, frameTypeError)
+	test.Equal(t, "E_BAD_BODY IDENTIFY msg_ids requires --msg-id-generator=producer", string(data))
+}
+
 func TestTLS(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -1326,44 +1709,457 @@ func TestTLSSnappy(t *testing.T) {
 	test.Equal(t, []byte("OK"), data)
 }
 
-func TestClientMsgTimeout(t *testing.T) {
+func TestMsgEnvelopeV2(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
-	opts.LogLevel = LOG_DEBUG
-	opts.QueueScanRefreshInterval = 100 * time.Millisecond
+	opts.MemQueueSize = 0
+	opts.MaxMsgSize = 100
+	// keep the producer address of messages written to the diskqueue
+	opts.BackendMsgEnvelope = MsgEnvelopeV2
 	tcpAddr, _, nsqd := mustStartNSQD(opts)
 	defer os.RemoveAll(opts.DataPath)
 	defer nsqd.Exit()
 
-	topicName := "test_cmsg_timeout" + strconv.Itoa(int(time.Now().Unix()))
-	topic := nsqd.GetTopic(topicName)
-	ch := topic.GetChannel("ch")
-	msg := NewMessage(topic.GenerateID(), make([]byte, 100))
-	topic.PutMessage(msg)
+	topicName := "test_msg_envelope" + strconv.Itoa(int(time.Now().Unix()))
 
-	// without this the race detector thinks there's a write
-	// to msg.Attempts that races with the read in the protocol's messagePump...
-	// it does not reflect a realistically possible condition
-	topic.PutMessage(NewMessage(topic.GenerateID(), make([]byte, 100)))
+	pubConn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer pubConn.Close()
+	identify(t, pubConn, nil, frameTypeResponse)
+	_, err = nsq.Publish(topicName, []byte("test body")).WriteTo(pubConn)
+	test.Nil(t, err)
+	readValidate(t, pubConn, frameTypeResponse, "OK")
+
+	// the envelope doesn't count towards --max-msg-size
+	_, err = nsq.Publish(topicName, make([]byte, 100)).WriteTo(pubConn)
+	test.Nil(t, err)
+	readValidate(t, pubConn, frameTypeResponse, "OK")
 
 	conn, err := mustConnectNSQD(tcpAddr)
 	test.Nil(t, err)
 	defer conn.Close()
 
-	identify(t, conn, map[string]interface{}{
-		"msg_timeout": 1000,
+	data := identify(t, conn, map[string]interface{}{
+		"msg_envelope": MsgEnvelopeV2,
 	}, frameTypeResponse)
+	r := struct {
+		MsgEnvelope int32 `json:"msg_envelope"`
+	}{}
+	err = json.Unmarshal(data, &r)
+	test.Nil(t, err)
+	test.Equal(t, int32(MsgEnvelopeV2), r.MsgEnvelope)
 	sub(t, conn, topicName, "ch")
 
-	test.Equal(t, 0, int(atomic.LoadUint64(&ch.timeoutCount)))
-	test.Equal(t, 0, int(atomic.LoadUint64(&ch.requeueCount)))
-
 	_, err = nsq.Ready(1).WriteTo(conn)
 	test.Nil(t, err)
-
-	resp, _ := nsq.ReadResponse(conn)
-	_, data, _ := nsq.UnpackResponse(resp)
-	msgOut, err := decodeMessage(data)
+	resp, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	test.Nil(t, err)
+	test.Equal(t, frameTypeMessage, frameType)
+
+	// the message went through the diskqueue (--mem-queue-size=0)
+	msg, err := decodeMessageV2(data)
+	test.Nil(t, err)
+	test.Equal(t, []byte("test body"), msg.Body)
+	test.Equal(t, crc32.Checksum(msg.Body, crc32.MakeTable(crc32.Castagnoli)), msg.Checksum)
+	test.Equal(t, pubConn.LocalAddr().String(), msg.Producer)
+	test.Equal(t, uint16(1), msg.Attempts)
+	test.Equal(t, true, msg.Timestamp > 0 && msg.Timestamp <= time.Now().UnixNano())
+
+	conn, err = mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	data = identify(t, conn, map[string]interface{}{
+		"msg_envelope": 4,
+	}, frameTypeError)
+	test.Equal(t, "E_BAD_BODY IDENTIFY msg envelope (4) is invalid", string(data))
+}
+
+func TestBackendMsgEnvelope(t *testing.T) {
+	var buf bytes.Buffer
+	msg := NewMessage(MessageID{'a'}, []byte("test body"))
+	msg.Producer = "127.0.0.1:1234"
+
+	// readable by older versions unless a v2 envelope is required
+	_, err := msg.writeTo(&buf, MsgEnvelopeV1)
+	test.Nil(t, err)
+	test.Equal(t, uint64(0), binary.BigEndian.Uint64(buf.Bytes()[:8])&extendedMsgFlag)
+	decoded, err := decodeMessage(buf.Bytes())
+	test.Nil(t, err)
+	test.Equal(t, msg.Body, decoded.Body)
+	test.Equal(t, msg.Checksum, decoded.Checksum)
+	test.Equal(t, "", decoded.Producer)
+
+	for _, tc := range []struct {
+		envelope int
+		hops     string
+	}{{MsgEnvelopeV2, ""}, {MsgEnvelopeV1, "producer@nsqd"}} {
+		buf.Reset()
+		msg.Hops = tc.hops
+		_, err = msg.writeTo(&buf, tc.envelope)
+		test.Nil(t, err)
+		test.Equal(t, uint64(extendedMsgFlag), binary.BigEndian.Uint64(buf.Bytes()[:8])&extendedMsgFlag)
+		decoded, err = decodeMessage(buf.Bytes())
+		test.Nil(t, err)
+		test.Equal(t, msg.Producer, decoded.Producer)
+		test.Equal(t, tc.hops, decoded.Hops)
+	}
+}
+
+func TestEventTimestamps(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	opts.EventLagPercentiles = []float64{0.5}
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_event_timestamps" + strconv.Itoa(int(time.Now().Unix()))
+	nsqd.GetTopic(topicName).GetChannel("ch")
+	eventTimestamp := time.Now().Add(-time.Minute).UnixNano()
+	withEventTimestamp := func(ts int64, body string) []byte {
+		b := make([]byte, 8, 8+len(body))
+		binary.BigEndian.PutUint64(b, uint64(ts))
+		return append(b, body...)
+	}
+
+	pubConn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer pubConn.Close()
+	data := identify(t, pubConn, map[string]interface{}{
+		"event_timestamps": true,
+	}, frameTypeResponse)
+	r := struct {
+		EventTimestamps bool `json:"event_timestamps"`
+	}{}
+	err = json.Unmarshal(data, &r)
+	test.Nil(t, err)
+	test.Equal(t, true, r.EventTimestamps)
+	_, err = nsq.Publish(topicName, withEventTimestamp(eventTimestamp, "a")).WriteTo(pubConn)
+	test.Nil(t, err)
+	readValidate(t, pubConn, frameTypeResponse, "OK")
+	cmd, _ := nsq.MultiPublish(topicName, [][]byte{withEventTimestamp(eventTimestamp+1, "b")})
+	_, err = cmd.WriteTo(pubConn)
+	test.Nil(t, err)
+	readValidate(t, pubConn, frameTypeResponse, "OK")
+
+	resp, err := http.Post(fmt.Sprintf("http://%s/pub?topic=%s&event_timestamp=%d", httpAddr, topicName, eventTimestamp+2),
+		"application/octet-stream", bytes.NewBufferString("c"))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	resp, err = http.Post(fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName),
+		"application/octet-stream", bytes.NewBufferString("d"))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	resp, err = http.Post(fmt.Sprintf("http://%s/pub?topic=%s&event_timestamp=-1", httpAddr, topicName),
+		"application/octet-stream", bytes.NewBufferString("e"))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+
+	// the messages went through the diskqueue (--mem-queue-size=0)
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, map[string]interface{}{
+		"msg_envelope": MsgEnvelopeV3,
+	}, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(4).WriteTo(conn)
+	test.Nil(t, err)
+	for _, expected := range []struct {
+		body           string
+		eventTimestamp int64
+	}{
+		{"a", eventTimestamp},
+		{"b", eventTimestamp + 1},
+		{"c", eventTimestamp + 2},
+		{"d", 0},
+	} {
+		resp, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		test.Nil(t, err)
+		test.Equal(t, frameTypeMessage, frameType)
+		msg, err := decodeMessageV2(data)
+		test.Nil(t, err)
+		test.Equal(t, expected.body, string(msg.Body))
+		test.Equal(t, expected.eventTimestamp, msg.EventTimestamp)
+		test.Equal(t, crc32.Checksum(msg.Body, crc32cTable), msg.Checksum)
+		_, err = nsq.Finish(nsq.MessageID(msg.ID)).WriteTo(conn)
+		test.Nil(t, err)
+	}
+
+	// the event lag of the messages with event timestamps
+	var lag *quantile.Result
+	for i := 0; i < 100; i++ {
+		stats := nsqd.GetStats(topicName, "ch", false)
+		lag = stats[0].Channels[0].EventLag
+		if lag != nil && lag.Count == 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.NotNil(t, lag)
+	test.Equal(t, 3, lag.Count)
+	if lag.Percentiles[0]["value"] < float64(time.Minute) {
+		t.Fatalf("event lag %v below a minute", lag.Percentiles[0]["value"])
+	}
+}
+
+func TestRecordHops(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	opts.RecordHops = true
+	opts.BroadcastTCPAddress = "nsqd-b:4150"
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_record_hops" + strconv.Itoa(int(time.Now().Unix()))
+	nsqd.GetTopic(topicName).GetChannel("ch")
+	withHops := func(hops string, body string) []byte {
+		b := make([]byte, 2, 2+len(hops)+len(body))
+		binary.BigEndian.PutUint16(b, uint16(len(hops)))
+		return append(append(b, hops...), body...)
+	}
+
+	pubConn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer pubConn.Close()
+	identify(t, pubConn, nil, frameTypeResponse)
+	_, err = nsq.Publish(topicName, []byte("a")).WriteTo(pubConn)
+	test.Nil(t, err)
+	readValidate(t, pubConn, frameTypeResponse, "OK")
+
+	republishConn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer republishConn.Close()
+	data := identify(t, republishConn, map[string]interface{}{
+		"hops": true,
+	}, frameTypeResponse)
+	r := struct {
+		Hops bool `json:"hops"`
+	}{}
+	err = json.Unmarshal(data, &r)
+	test.Nil(t, err)
+	test.Equal(t, true, r.Hops)
+	_, err = nsq.Publish(topicName, withHops("10.0.0.1:5000@nsqd-a:4150", "b")).WriteTo(republishConn)
+	test.Nil(t, err)
+	readValidate(t, republishConn, frameTypeResponse, "OK")
+
+	resp, err := http.Post(fmt.Sprintf("http://%s/pub?topic=%s&hops=10.0.0.2:5000@nsqd-a:4150", httpAddr, topicName),
+		"application/octet-stream", bytes.NewBufferString("c"))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	// the messages went through the diskqueue (--mem-queue-size=0)
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, map[string]interface{}{
+		"msg_envelope": MsgEnvelopeV3,
+	}, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(3).WriteTo(conn)
+	test.Nil(t, err)
+	for _, expected := range []struct {
+		body string
+		hops string
+	}{
+		{"a", pubConn.LocalAddr().String() + "@nsqd-b:4150"},
+		{"b", "10.0.0.1:5000@nsqd-a:4150," + republishConn.LocalAddr().String() + "@nsqd-b:4150"},
+		{"c", "10.0.0.2:5000@nsqd-a:4150,"},
+	} {
+		resp, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		test.Nil(t, err)
+		test.Equal(t, frameTypeMessage, frameType)
+		msg, err := decodeMessageV2(data)
+		test.Nil(t, err)
+		test.Equal(t, expected.body, string(msg.Body))
+		if !strings.HasPrefix(msg.Hops, expected.hops) || !strings.HasSuffix(msg.Hops, "@nsqd-b:4150") {
+			t.Fatalf("unexpected hops %q", msg.Hops)
+		}
+		test.Equal(t, crc32.Checksum(msg.Body, crc32cTable), msg.Checksum)
+	}
+
+	// hops are only recorded with --record-hops
+	opts = NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqd2 := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd2.Exit()
+	conn, err = mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	data = identify(t, conn, map[string]interface{}{
+		"hops": true,
+	}, frameTypeError)
+	test.Equal(t, "E_BAD_BODY IDENTIFY hops requires --record-hops", string(data))
+}
+
+func TestHopLoops(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.RecordHops = true
+	opts.ClusterName = "east"
+	opts.BroadcastTCPAddress = "nsqd-b:4150"
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_hop_loops" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	withHops := func(hops string, body string) []byte {
+		b := make([]byte, 2, 2+len(hops)+len(body))
+		binary.BigEndian.PutUint16(b, uint16(len(hops)))
+		return append(append(b, hops...), body...)
+	}
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, map[string]interface{}{
+		"hops": true,
+	}, frameTypeResponse)
+	// looping messages are dropped without failing the publish
+	cmd, _ := nsq.MultiPublish(topicName, [][]byte{
+		withHops("10.0.0.1:5000@east/nsqd-a:4150", "a"),
+		withHops("10.0.0.1:5000@west/nsqd-c:4150", "b"),
+		withHops("10.0.0.1:5000@west/nsqd-c:4150,10.0.0.2:5000@east/nsqd-b:4150", "c"),
+	})
+	_, err = cmd.WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeResponse, "OK")
+	_, err = nsq.Publish(topicName, withHops("user@10.0.0.1:5000@east/nsqd-a:4150", "d")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeResponse, "OK")
+
+	resp, err := http.Post(fmt.Sprintf("http://%s/pub?topic=%s&hops=10.0.0.3:5000@east/nsqd-a:4150", httpAddr, topicName),
+		"application/octet-stream", bytes.NewBufferString("e"))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	test.Equal(t, int64(1), topic.Depth())
+	stats := nsqd.GetStats(topicName, "", false)
+	test.Equal(t, uint64(1), stats[0].MessageCount)
+	test.Equal(t, uint64(4), stats[0].LoopDropCount)
+
+	opts = NewOptions()
+	opts.ClusterName = "east"
+	test.NotNil(t, ValidateOptions(opts))
+	opts.RecordHops = true
+	test.Nil(t, ValidateOptions(opts))
+	opts.ClusterName = "east/1"
+	test.NotNil(t, ValidateOptions(opts))
+}
+
+func TestBatchedMessageFrames(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_batched_frames" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.GetChannel("ch")
+	var ids []MessageID
+	for i := 0; i < 25; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte(strconv.Itoa(i)))
+		ids = append(ids, msg.ID)
+		test.Nil(t, topic.PutMessage(msg))
+	}
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	identify(t, conn, map[string]interface{}{
+		"output_buffer_timeout": 50,
+	}, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	// frames are written 10 at a time (a quarter of RDY) and the rest after
+	// the output buffer timeout
+	_, err = nsq.Ready(40).WriteTo(conn)
+	test.Nil(t, err)
+	for i := 0; i < 25; i++ {
+		resp, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		test.Nil(t, err)
+		test.Equal(t, frameTypeMessage, frameType)
+		msg, err := decodeMessage(data)
+		test.Nil(t, err)
+		test.Equal(t, ids[i], msg.ID)
+		test.Equal(t, []byte(strconv.Itoa(i)), msg.Body)
+	}
+
+	// a response frame is written after the batched message frames
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	test.Nil(t, topic.PutMessage(msg))
+	time.Sleep(10 * time.Millisecond)
+	_, err = nsq.Finish(nsq.MessageID{}).WriteTo(conn)
+	test.Nil(t, err)
+	resp, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	frameType, _, err := nsq.UnpackResponse(resp)
+	test.Nil(t, err)
+	test.Equal(t, frameTypeMessage, frameType)
+	resp, err = nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	frameType, _, err = nsq.UnpackResponse(resp)
+	test.Nil(t, err)
+	test.Equal(t, frameTypeError, frameType)
+}
+
+func TestClientMsgTimeout(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.LogLevel = LOG_DEBUG
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_cmsg_timeout" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	ch := topic.GetChannel("ch")
+	msg := NewMessage(topic.GenerateID(), make([]byte, 100))
+	topic.PutMessage(msg)
+
+	// without this the race detector thinks there's a write
+	// to msg.Attempts that races with the read in the protocol's messagePump...
+	// it does not reflect a realistically possible condition
+	topic.PutMessage(NewMessage(topic.GenerateID(), make([]byte, 100)))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	identify(t, conn, map[string]interface{}{
+		"msg_timeout": 1000,
+	}, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	test.Equal(t, 0, int(atomic.LoadUint64(&ch.timeoutCount)))
+	test.Equal(t, 0, int(atomic.LoadUint64(&ch.requeueCount)))
+
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+
+	resp, _ := nsq.ReadResponse(conn)
+	_, data, _ := nsq.UnpackResponse(resp)
+	msgOut, err := decodeMessage(data)
 	test.Equal(t, msg.ID, msgOut.ID)
 	test.Equal(t, msg.Body, msgOut.Body)
 
@@ -1464,11 +2260,11 @@ func TestReqTimeoutRange(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 
 	channel.deferredMutex.Lock()
-	pqItem := channel.deferredMessages[msg.ID]
+	deferred := channel.deferredMessages[msg.ID]
 	channel.deferredMutex.Unlock()
 
-	test.NotNil(t, pqItem)
-	test.Equal(t, true, pqItem.Priority >= minTs)
+	test.NotNil(t, deferred)
+	test.Equal(t, true, deferred.timer.Deadline().UnixNano() >= minTs)
 }
 
 func TestClientAuth(t *testing.T) {
@@ -1494,6 +2290,139 @@ func TestClientAuth(t *testing.T) {
 	runAuthTest(t, authResponse, authSecret, authError, authSuccess, tlsEnabled, commonName)
 }
 
+func TestClientAuthFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "nsqd-auth")
+	test.Nil(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`{"ttl": 10, "identities": [
+		{"secret": "testsecret", "identity": "tester", "authorizations":
+			[{"topic": "test", "channels": [".*"], "permissions": ["subscribe", "publish"]}]}
+	]}`)
+	test.Nil(t, err)
+	f.Close()
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.AuthFile = f.Name()
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	authCmd(t, conn, "wrongsecret", "")
+	readValidate(t, conn, frameTypeError, "E_UNAUTHORIZED AUTH no authorizations found")
+
+	conn, err = mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	authCmd(t, conn, "testsecret", `{"identity":"tester","identity_url":"","permission_count":1}`)
+	sub(t, conn, "test", "ch")
+}
+
+func TestClientAuthQuotas(t *testing.T) {
+	f, err := ioutil.TempFile("", "nsqd-auth")
+	test.Nil(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`{"ttl": 10, "identities": [
+		{"secret": "testsecret", "identity": "tester", "authorizations":
+			[{"topic": ".*", "channels": [".*"], "permissions": ["subscribe", "publish"]}],
+		 "quotas": {"max_topics": 1, "max_publish_rate": 1, "max_connections": 1}}
+	]}`)
+	test.Nil(t, err)
+	f.Close()
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.AuthFile = f.Name()
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	authCmd(t, conn, "testsecret", `{"identity":"tester","identity_url":"","permission_count":1}`)
+
+	conn2, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn2.Close()
+	identify(t, conn2, nil, frameTypeResponse)
+	authCmd(t, conn2, "testsecret", "")
+	readValidate(t, conn2, frameTypeError, "E_QUOTA_EXCEEDED AUTH tester exceeds limit of 1 connections")
+
+	_, err = nsq.Publish("test", []byte("test body")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeResponse, "OK")
+	_, err = nsq.Publish("test", []byte("test body")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeError, "E_QUOTA_EXCEEDED PUB tester exceeds limit of 1 messages/s")
+
+	stats := nsqd.quotas.stats()
+	test.Equal(t, 1, len(stats))
+	test.Equal(t, 1, stats[0].Connections)
+	test.Equal(t, []string{"test"}, stats[0].Topics)
+	test.Equal(t, uint64(1), stats[0].PublishCount)
+	test.Equal(t, uint64(2), stats[0].RejectedCount)
+
+	_, err = nsq.Subscribe("test2", "ch").WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeError, "E_QUOTA_EXCEEDED SUB tester exceeds limit of 1 topics")
+	_, err = nsqd.GetExistingTopic("test2")
+	test.NotNil(t, err)
+}
+
+func TestClientAuthPublishers(t *testing.T) {
+	f, err := ioutil.TempFile("", "nsqd-auth")
+	test.Nil(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`{"ttl": 10, "identities": [
+		{"secret": "billing", "identity": "billing", "authorizations":
+			[{"topic": ".*", "channels": [".*"], "permissions": ["subscribe", "publish"]}]},
+		{"secret": "other", "identity": "other", "authorizations":
+			[{"topic": ".*", "channels": [".*"], "permissions": ["subscribe", "publish"]}]}
+	]}`)
+	test.Nil(t, err)
+	f.Close()
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.AuthFile = f.Name()
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("invoices")
+	test.Nil(t, topic.SetPublishers([]string{"billing"}))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	authCmd(t, conn, "billing", `{"identity":"billing","identity_url":"","permission_count":1}`)
+	_, err = nsq.Publish("invoices", []byte("test body")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeResponse, "OK")
+
+	conn, err = mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	authCmd(t, conn, "other", `{"identity":"other","identity_url":"","permission_count":1}`)
+	_, err = nsq.Publish("other", []byte("test body")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeResponse, "OK")
+	_, err = nsq.Publish("invoices", []byte("test body")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeError, `E_UNAUTHORIZED PUB not allowed to publish to "invoices"`)
+
+	test.Equal(t, int64(1), topic.Depth())
+}
+
 func runAuthTest(t *testing.T, authResponse string, authSecret string, authError string,
 	authSuccess string, tlsEnabled bool, commonName string) {
 	var err error
@@ -1602,6 +2531,10 @@ func testIOLoopReturnsClientErr(t *testing.T, fakeConn test.FakeNetConn) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
 	opts.LogLevel = LOG_DEBUG
+	tmpDir, err := ioutil.TempDir("", "nsq-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	opts.DataPath = tmpDir
 
 	nsqd, err := New(opts)
 	test.Nil(t, err)
@@ -1618,6 +2551,9 @@ func BenchmarkProtocolV2Exec(b *testing.B) {
 	b.StopTimer()
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(b)
+	tmpDir, _ := ioutil.TempDir("", "nsq-test-")
+	defer os.RemoveAll(tmpDir)
+	opts.DataPath = tmpDir
 	nsqd, _ := New(opts)
 	ctx := &context{nsqd}
 	p := &protocolV2{ctx}
@@ -1926,3 +2862,46 @@ func BenchmarkProtocolV2MultiSub2(b *testing.B)  { benchmarkProtocolV2MultiSub(b
 func BenchmarkProtocolV2MultiSub4(b *testing.B)  { benchmarkProtocolV2MultiSub(b, 4) }
 func BenchmarkProtocolV2MultiSub8(b *testing.B)  { benchmarkProtocolV2MultiSub(b, 8) }
 func BenchmarkProtocolV2MultiSub16(b *testing.B) { benchmarkProtocolV2MultiSub(b, 16) }
+
+func TestMinClientVersion(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MinClientVersions = []string{"go-nsq/1.1.0"}
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	data := identify(t, conn, map[string]interface{}{
+		"user_agent": "go-nsq/1.0.7",
+	}, frameTypeError)
+	test.Equal(t, "E_CLIENT_VERSION IDENTIFY client go-nsq/1.0.7 is below the minimum version go-nsq/1.1.0", string(data))
+
+	for _, userAgent := range []string{"go-nsq/1.1.0", "pynsq/0.9.0"} {
+		conn, err := mustConnectNSQD(tcpAddr)
+		test.Nil(t, err)
+		defer conn.Close()
+		identify(t, conn, map[string]interface{}{
+			"user_agent":  userAgent,
+			"sample_rate": 50,
+		}, frameTypeResponse)
+	}
+
+	// the refused client is removed once its connection is closed
+	var summary ClientSummary
+	for i := 0; i < 100; i++ {
+		summary = nsqd.GetClientSummary()
+		if summary.ClientCount == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, 2, summary.ClientCount)
+	test.Equal(t, []ClientCount{{"go-nsq/1.1.0", 1}, {"pynsq/0.9.0", 1}}, summary.UserAgents)
+	test.Equal(t, []ClientCount{{"V2", 2}}, summary.Protocols)
+	test.Equal(t, []ClientCount{{"feature_negotiation", 2}, {"sample_rate", 2}}, summary.Features)
+	test.Equal(t, map[string]string{"go-nsq": "1.1.0"}, summary.MinVersions)
+	test.Equal(t, uint64(1), summary.RejectedCount)
+}
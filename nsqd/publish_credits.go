@@ -0,0 +1,94 @@
+package nsqd
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/nsqio/nsq/internal/protocol"
+)
+
+// publishCreditCheckInterval is how often credits withheld from a producer are
+// reconsidered
+const publishCreditCheckInterval = 100 * time.Millisecond
+
+// Producers that opt in with IDENTIFY publish_credits may only publish as many
+// messages as they have credits for. They're granted --publish-credit-window
+// credits at first and more (back up to the window) with a control frame once
+// they've used half of them, unless the topic they last published to is under
+// pressure: credits are withheld until it recovers, slowing them down smoothly
+// instead of failing their publishes.
+
+// checkPublishCredits fails a publish of count messages the client doesn't have
+// the credits for
+func (p *protocolV2) checkPublishCredits(client *clientV2, cmd string, count int) error {
+	if client.PublishCreditWindow == 0 {
+		return nil
+	}
+	credits := atomic.LoadInt64(&client.PublishCredits)
+	if int64(count) > credits {
+		return protocol.NewClientErr(nil, "E_NO_CREDITS",
+			fmt.Sprintf("%s needs %d publish credits, has %d", cmd, count, credits))
+	}
+	return nil
+}
+
+// usePublishCredits takes the credits of count messages published to topic,
+// waking the client's messagePump to replenish them
+func (c *clientV2) usePublishCredits(topic *Topic, count int) {
+	if c.PublishCreditWindow == 0 {
+		return
+	}
+	atomic.AddInt64(&c.PublishCredits, -int64(count))
+	c.creditTopic.Store(topic)
+	select {
+	case c.creditChan <- 1:
+	default:
+	}
+}
+
+// grantPublishCredits grants the client credits back up to its window once it
+// has used half of them, unless the topic it last published to is under
+// pressure. It's only called from the client's messagePump.
+func (p *protocolV2) grantPublishCredits(client *clientV2) error {
+	window := client.PublishCreditWindow
+	credits := atomic.LoadInt64(&client.PublishCredits)
+	if credits > window/2 {
+		return nil
+	}
+	if topic, ok := client.creditTopic.Load().(*Topic); ok && topic.underPressure() {
+		return nil
+	}
+
+	grant := window - credits
+	atomic.AddInt64(&client.PublishCredits, grant)
+	return p.Send(client, frameTypeControl, publishCreditsFrame(grant))
+}
+
+// publishCreditsFrame is the body of the control frame granting a producer
+// credits for as many more messages
+func publishCreditsFrame(credits int64) []byte {
+	body, _ := json.Marshal(struct {
+		Type    string `json:"type"`
+		Credits int64  `json:"credits"`
+	}{"publish_credits", credits})
+	return body
+}
+
+// underPressure reports whether publishes to the topic outpace its delivery:
+// its in-memory queue is full, or it's over 90% of its disk quota
+func (t *Topic) underPressure() bool {
+	memQueueSize, _ := t.MemQueueSize()
+	if memQueueSize > 0 && t.Depth() >= memQueueSize {
+		return true
+	}
+	maxBytes, _ := t.DiskQuota()
+	if maxBytes <= 0 {
+		return false
+	}
+	t.RLock()
+	diskBytes := t.diskBytes()
+	t.RUnlock()
+	return diskBytes >= maxBytes/10*9
+}
@@ -0,0 +1,85 @@
+package nsqd
+
+import (
+	"net"
+	"sort"
+	"sync"
+)
+
+// maxPublishersCounted bounds the publishers counted per topic, messages of
+// those beyond are counted as otherPublishers
+const maxPublishersCounted = 1000
+
+const otherPublishers = "other"
+
+// PublisherCount is the number of messages a publisher has published to a
+// topic, see --publisher-stats-top-n
+type PublisherCount struct {
+	Publisher string `json:"publisher"`
+	Count     uint64 `json:"count"`
+}
+
+// publisherCounts counts the messages published to a topic by publisher
+type publisherCounts struct {
+	sync.Mutex
+	counts map[string]uint64
+}
+
+// publisherName returns what a publisher is counted as: its auth identity, else
+// its TLS certificate common name, else the host of its remote address (which
+// changes port with every connection)
+func publisherName(identity string, commonName string, remoteAddr string) string {
+	if identity != "" {
+		return identity
+	}
+	if commonName != "" {
+		return commonName
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// countPublished records that publisher published count messages to the topic,
+// if --publisher-stats-top-n is set
+func (t *Topic) countPublished(publisher string, count uint64) {
+	if t.ctx.nsqd.getOpts().PublisherStatsTopN == 0 {
+		return
+	}
+
+	p := &t.publisherCounts
+	p.Lock()
+	defer p.Unlock()
+	if p.counts == nil {
+		p.counts = make(map[string]uint64)
+	}
+	if _, ok := p.counts[publisher]; !ok && len(p.counts) >= maxPublishersCounted {
+		publisher = otherPublishers
+	}
+	p.counts[publisher] += count
+}
+
+// TopPublishers returns the n publishers that published the most messages to
+// the topic since it was created (or nsqd started), the most first
+func (t *Topic) TopPublishers(n int) []PublisherCount {
+	p := &t.publisherCounts
+	p.Lock()
+	top := make([]PublisherCount, 0, len(p.counts))
+	for publisher, count := range p.counts {
+		top = append(top, PublisherCount{publisher, count})
+	}
+	p.Unlock()
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Publisher < top[j].Publisher
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
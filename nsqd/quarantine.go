@@ -0,0 +1,218 @@
+package nsqd
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// QuarantineSuffix names the channel the messages of a channel that keep timing
+// out are moved to, see Channel.SetQuarantineTimeouts. Quarantine channels
+// aren't put the topic's messages.
+const QuarantineSuffix = "#quarantine"
+
+// maxRecentlyQuarantined bounds the quarantined messages a channel lists
+const maxRecentlyQuarantined = 100
+
+// QuarantinedMessage is a message moved to a quarantine channel
+type QuarantinedMessage struct {
+	ID            string `json:"id"`
+	Attempts      uint16 `json:"attempts"`
+	Timeouts      int    `json:"timeouts"`
+	Timestamp     int64  `json:"timestamp"`
+	QuarantinedAt int64  `json:"quarantined_at"`
+}
+
+// quarantineState counts the timeouts of the messages of a channel and lists
+// those it recently quarantined
+type quarantineState struct {
+	sync.Mutex
+	timeouts map[MessageID]int
+	recent   []QuarantinedMessage
+}
+
+// IsQuarantine returns whether the channel is the quarantine channel of another
+func (c *Channel) IsQuarantine() bool {
+	return c.isQuarantine
+}
+
+// QuarantineTimeouts returns the channel's override of --quarantine-timeouts (0
+// if not overridden, negative if disabled)
+func (c *Channel) QuarantineTimeouts() int {
+	c.RLock()
+	defer c.RUnlock()
+	return c.quarantineTimeouts
+}
+
+// SetQuarantineTimeouts overrides --quarantine-timeouts for the channel (0
+// reverts to the nsqd option, negative disables quarantining). A message that
+// times out that many times is moved to the channel's <channel>#quarantine
+// channel instead of being redelivered, to be reviewed (e.g. by subscribing to
+// it) and redriven back, see QuarantinedMessages and Topic.Redrive.
+func (c *Channel) SetQuarantineTimeouts(timeouts int) error {
+	if timeouts > 0 && (c.ephemeral || c.isQuarantine) {
+		return errors.New("#ephemeral and #quarantine channels cannot be quarantined")
+	}
+	c.Lock()
+	c.quarantineTimeouts = timeouts
+	c.Unlock()
+
+	c.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): channel(%s): quarantine timeouts set to %d",
+		c.topicName, c.name, timeouts)
+	return nil
+}
+
+// quarantineLimit returns the number of timeouts after which a message is
+// quarantined (0 if never)
+func (c *Channel) quarantineLimit() int {
+	if c.ephemeral || c.isQuarantine {
+		return 0
+	}
+	limit := c.QuarantineTimeouts()
+	if limit == 0 {
+		limit = c.ctx.nsqd.getOpts().QuarantineTimeouts
+	}
+	if limit < 0 {
+		return 0
+	}
+	return limit
+}
+
+// timedOut counts a timeout of msg, returning whether it is to be quarantined
+func (c *Channel) timedOut(msg *Message) bool {
+	limit := c.quarantineLimit()
+	if limit == 0 {
+		return false
+	}
+
+	q := &c.quarantine
+	q.Lock()
+	defer q.Unlock()
+	if q.timeouts == nil {
+		q.timeouts = make(map[MessageID]int)
+	}
+	q.timeouts[msg.ID]++
+	return q.timeouts[msg.ID] >= limit
+}
+
+// forgetTimeouts stops counting the timeouts of a message that was finished
+func (c *Channel) forgetTimeouts(id MessageID) {
+	q := &c.quarantine
+	q.Lock()
+	if len(q.timeouts) > 0 {
+		delete(q.timeouts, id)
+	}
+	q.Unlock()
+}
+
+// quarantineMessages moves timed out msgs to the channel's quarantine channel,
+// it takes the topic lock so the caller must not hold the channel's exit mutex
+func (c *Channel) quarantineMessages(msgs []*Message) {
+	var dst *Channel
+	topic, err := c.ctx.nsqd.GetExistingTopic(c.topicName)
+	if err == nil {
+		dst, err = topic.getQuarantineChannel(c.name)
+	}
+
+	now := time.Now()
+	q := &c.quarantine
+	for _, msg := range msgs {
+		q.Lock()
+		m := QuarantinedMessage{
+			ID:            string(msg.ID[:]),
+			Attempts:      msg.Attempts,
+			Timeouts:      q.timeouts[msg.ID],
+			Timestamp:     msg.Timestamp,
+			QuarantinedAt: now.UnixNano(),
+		}
+		delete(q.timeouts, msg.ID)
+		q.Unlock()
+
+		// msg must not be referenced after put
+		if err == nil {
+			err = dst.PutMessage(msg)
+		}
+		if err != nil {
+			c.ctx.nsqd.logf(LOG_ERROR, "TOPIC(%s): channel(%s): failed to quarantine message %s, requeueing - %s",
+				c.topicName, c.name, m.ID, err)
+			c.exitMutex.RLock()
+			if !c.Exiting() {
+				c.put(msg)
+			}
+			c.exitMutex.RUnlock()
+			continue
+		}
+
+		atomic.AddUint64(&c.quarantinedCount, 1)
+		q.Lock()
+		q.recent = append(q.recent, m)
+		if len(q.recent) > maxRecentlyQuarantined {
+			q.recent = q.recent[len(q.recent)-maxRecentlyQuarantined:]
+		}
+		q.Unlock()
+		c.ctx.nsqd.logf(LOG_WARN, "TOPIC(%s): channel(%s): quarantined message %s after %d timeouts",
+			c.topicName, c.name, m.ID, m.Timeouts)
+	}
+}
+
+// QuarantinedCount returns how many messages the channel has quarantined
+func (c *Channel) QuarantinedCount() uint64 {
+	return atomic.LoadUint64(&c.quarantinedCount)
+}
+
+// QuarantinedMessages returns the messages the channel recently quarantined
+// (and not redriven since), the oldest first
+func (c *Channel) QuarantinedMessages() []QuarantinedMessage {
+	q := &c.quarantine
+	q.Lock()
+	defer q.Unlock()
+	return append([]QuarantinedMessage{}, q.recent...)
+}
+
+// getQuarantineChannel returns the quarantine channel of channelName, creating
+// it if needed (unless the topic is exiting)
+func (t *Topic) getQuarantineChannel(channelName string) (*Channel, error) {
+	t.Lock()
+	if atomic.LoadInt32(&t.exitFlag) == 1 {
+		t.Unlock()
+		return nil, errors.New("exiting")
+	}
+	channel, isNew := t.getOrCreateChannel(channelName+QuarantineSuffix, 0)
+	t.Unlock()
+
+	if isNew {
+		t.notifyChannelUpdate()
+	}
+	return channel, nil
+}
+
+// Redrive moves the messages queued in the quarantine channel of channelName
+// back to it, returning how many were moved
+func (t *Topic) Redrive(channelName string) (int64, error) {
+	channel, err := t.GetExistingChannel(channelName)
+	if err != nil {
+		return 0, err
+	}
+	if channel.IsQuarantine() {
+		return 0, errors.New("cannot redrive a #quarantine channel")
+	}
+	src, err := t.GetExistingChannel(channelName + QuarantineSuffix)
+	if err != nil {
+		return 0, nil
+	}
+
+	count, err := src.TransferTo(channel, true)
+	if err != nil {
+		return count, fmt.Errorf("failed to redrive - %s", err)
+	}
+
+	q := &channel.quarantine
+	q.Lock()
+	q.recent = nil
+	q.Unlock()
+	t.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): channel(%s): redrove %d quarantined messages",
+		t.name, channelName, count)
+	return count, nil
+}
@@ -0,0 +1,183 @@
+package nsqd
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/nsqio/nsq/internal/auth"
+	"github.com/nsqio/nsq/internal/http_api"
+)
+
+// identityQuotas tracks what each authenticated identity is using across its
+// connections, enforcing the quotas returned by the auth provider. Clients
+// without an identity aren't subject to quotas.
+type identityQuotas struct {
+	sync.Mutex
+	identities map[string]*identityUsage
+}
+
+type identityUsage struct {
+	quotas       auth.Quotas
+	connections  int
+	topics       map[string]struct{}
+	publishLimit *http_api.RateLimiter
+
+	publishCount  uint64
+	rejectedCount uint64
+}
+
+type IdentityStats struct {
+	Identity       string   `json:"identity"`
+	Connections    int      `json:"connections"`
+	MaxConnections int      `json:"max_connections"`
+	Topics         []string `json:"topics"`
+	MaxTopics      int      `json:"max_topics"`
+	MaxPublishRate float64  `json:"max_publish_rate"`
+	PublishCount   uint64   `json:"publish_count"`
+	RejectedCount  uint64   `json:"rejected_count"`
+}
+
+func newIdentityQuotas() *identityQuotas {
+	return &identityQuotas{
+		identities: make(map[string]*identityUsage),
+	}
+}
+
+// setQuotas updates quotas, with the lock held
+func (u *identityUsage) setQuotas(quotas auth.Quotas) {
+	if u.publishLimit == nil || quotas.MaxPublishRate != u.quotas.MaxPublishRate {
+		u.publishLimit = http_api.NewRateLimiter(quotas.MaxPublishRate)
+	}
+	u.quotas = quotas
+}
+
+// connect counts a connection authenticated as identity
+func (q *identityQuotas) connect(identity string, quotas auth.Quotas) error {
+	if identity == "" {
+		return nil
+	}
+	q.Lock()
+	defer q.Unlock()
+	u, ok := q.identities[identity]
+	if !ok {
+		u = &identityUsage{topics: make(map[string]struct{})}
+		q.identities[identity] = u
+	}
+	u.setQuotas(quotas)
+	if quotas.MaxConnections > 0 && u.connections >= quotas.MaxConnections {
+		u.rejectedCount++
+		return fmt.Errorf("%s exceeds limit of %d connections", identity, quotas.MaxConnections)
+	}
+	u.connections++
+	return nil
+}
+
+// update applies quotas returned when a connection's authorizations were
+// refreshed
+func (q *identityQuotas) update(identity string, quotas auth.Quotas) {
+	if identity == "" {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+	if u, ok := q.identities[identity]; ok {
+		u.setQuotas(quotas)
+	}
+}
+
+func (q *identityQuotas) disconnect(identity string) {
+	if identity == "" {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+	u, ok := q.identities[identity]
+	if !ok {
+		return
+	}
+	u.connections--
+	if u.connections <= 0 && len(u.topics) == 0 {
+		delete(q.identities, identity)
+	}
+}
+
+// createTopic records that identity is creating topicName
+func (q *identityQuotas) createTopic(identity string, topicName string) error {
+	if identity == "" {
+		return nil
+	}
+	q.Lock()
+	defer q.Unlock()
+	u, ok := q.identities[identity]
+	if !ok {
+		return nil
+	}
+	if _, ok := u.topics[topicName]; ok {
+		return nil
+	}
+	if u.quotas.MaxTopics > 0 && len(u.topics) >= u.quotas.MaxTopics {
+		u.rejectedCount++
+		return fmt.Errorf("%s exceeds limit of %d topics", identity, u.quotas.MaxTopics)
+	}
+	u.topics[topicName] = struct{}{}
+	return nil
+}
+
+// deleteTopic stops counting topicName against the identity that created it
+func (q *identityQuotas) deleteTopic(topicName string) {
+	q.Lock()
+	defer q.Unlock()
+	for identity, u := range q.identities {
+		delete(u.topics, topicName)
+		if u.connections <= 0 && len(u.topics) == 0 {
+			delete(q.identities, identity)
+		}
+	}
+}
+
+// publish takes count messages from identity's publish rate
+func (q *identityQuotas) publish(identity string, count int) error {
+	if identity == "" {
+		return nil
+	}
+	q.Lock()
+	defer q.Unlock()
+	u, ok := q.identities[identity]
+	if !ok {
+		return nil
+	}
+	if !u.publishLimit.TakeN(float64(count)) {
+		u.rejectedCount++
+		return fmt.Errorf("%s exceeds limit of %g messages/s", identity, u.quotas.MaxPublishRate)
+	}
+	u.publishCount += uint64(count)
+	return nil
+}
+
+func (q *identityQuotas) stats() []IdentityStats {
+	q.Lock()
+	defer q.Unlock()
+	stats := make([]IdentityStats, 0, len(q.identities))
+	for identity, u := range q.identities {
+		topics := make([]string, 0, len(u.topics))
+		for t := range u.topics {
+			topics = append(topics, t)
+		}
+		sort.Strings(topics)
+		stats = append(stats, IdentityStats{
+			Identity:       identity,
+			Connections:    u.connections,
+			MaxConnections: u.quotas.MaxConnections,
+			Topics:         topics,
+			MaxTopics:      u.quotas.MaxTopics,
+			MaxPublishRate: u.quotas.MaxPublishRate,
+			PublishCount:   u.publishCount,
+			RejectedCount:  u.rejectedCount,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Identity < stats[j].Identity
+	})
+	return stats
+}
@@ -0,0 +1,42 @@
+package nsqd
+
+import (
+	"encoding/json"
+)
+
+// rdyHint is the max RDY count suggested to each client of the channel for its
+// backlog (the messages queued and in flight) to be shared evenly between them,
+// it's between 1 and maxRdyCount
+func (c *Channel) rdyHint(maxRdyCount int64) int64 {
+	c.RLock()
+	clients := int64(len(c.clients))
+	c.RUnlock()
+	if clients < 1 {
+		clients = 1
+	}
+
+	c.inFlightMutex.Lock()
+	inFlight := int64(len(c.inFlightMessages))
+	c.inFlightMutex.Unlock()
+	backlog := c.Depth() + inFlight
+
+	hint := (backlog + clients - 1) / clients
+	if hint < 1 {
+		hint = 1
+	} else if hint > maxRdyCount {
+		hint = maxRdyCount
+	}
+	return hint
+}
+
+// rdyHintFrame is the body of the control frame suggesting a max RDY count to a
+// client, sent every --rdy-hint-interval when it changes to clients that opted
+// in with IDENTIFY rdy_hints. Clients may lower their RDY count to it to share
+// the channel's messages with its other clients without heuristics of their own.
+func rdyHintFrame(maxRdyCount int64) []byte {
+	body, _ := json.Marshal(struct {
+		Type        string `json:"type"`
+		MaxRdyCount int64  `json:"max_rdy_count"`
+	}{"rdy_hint", maxRdyCount})
+	return body
+}
@@ -0,0 +1,125 @@
+package nsqd
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/nsqio/nsq/internal/diskqueue"
+	"github.com/nsqio/nsq/internal/protocol"
+	"github.com/nsqio/nsq/internal/version"
+)
+
+// recoverDataPaths repairs the diskqueues found in the data paths and adds the
+// topics and channels they belong to that are missing from the metadata, logging
+// each problem fixed (see --recover)
+func (n *NSQD) recoverDataPaths() error {
+	opts := n.getOpts()
+	paths := dataPaths(opts)
+	var fixed int
+
+	fn := newMetadataFile(opts)
+	data, err := readOrEmpty(fn)
+	if err != nil {
+		return err
+	}
+	js := make(map[string]interface{})
+	if data != nil {
+		err = json.Unmarshal(data, &js)
+		if err != nil {
+			n.logf(LOG_WARN, "RECOVER: %s is corrupt, rebuilding it - %s", fn, err)
+			js = make(map[string]interface{})
+			fixed++
+		}
+	}
+	topicsData, _ := js["topics"].([]interface{})
+	topics := make(map[string]map[string]interface{})
+	for _, t := range topicsData {
+		topicData, ok := t.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := topicData["name"].(string)
+		topics[name] = topicData
+	}
+	metadataChanged := fixed > 0
+
+	for _, dataPath := range paths {
+		names, err := diskqueue.Names(dataPath)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			fixes, err := diskqueue.Recover(name, dataPath)
+			if err != nil {
+				return fmt.Errorf("failed to recover diskqueue %s - %s", name, err)
+			}
+			for _, fix := range fixes {
+				n.logf(LOG_WARN, "RECOVER: DISKQUEUE(%s): %s", name, fix)
+			}
+			fixed += len(fixes)
+
+			topicName, channelName := parseBackendName(name)
+			if !protocol.IsValidTopicName(topicName) ||
+				(channelName != "" && !protocol.IsValidChannelName(channelName)) {
+				n.logf(LOG_WARN, "RECOVER: DISKQUEUE(%s): skipping invalid topic/channel name", name)
+				continue
+			}
+
+			topicData, ok := topics[topicName]
+			if !ok {
+				topicData = map[string]interface{}{
+					"name":     topicName,
+					"paused":   false,
+					"channels": []interface{}{},
+				}
+				if len(paths) > 1 {
+					topicData["data_path"] = dataPath
+				}
+				topics[topicName] = topicData
+				topicsData = append(topicsData, topicData)
+				n.logf(LOG_WARN, "RECOVER: TOPIC(%s): added to metadata", topicName)
+				metadataChanged = true
+				fixed++
+			}
+			if channelName == "" {
+				continue
+			}
+			channelsData, _ := topicData["channels"].([]interface{})
+			found := false
+			for _, c := range channelsData {
+				if channelData, ok := c.(map[string]interface{}); ok && channelData["name"] == channelName {
+					found = true
+					break
+				}
+			}
+			if !found {
+				topicData["channels"] = append(channelsData, map[string]interface{}{
+					"name":   channelName,
+					"paused": false,
+				})
+				n.logf(LOG_WARN, "RECOVER: TOPIC(%s): channel %s added to metadata", topicName, channelName)
+				metadataChanged = true
+				fixed++
+			}
+		}
+	}
+
+	if metadataChanged {
+		if _, ok := js["schema_version"]; !ok {
+			js["schema_version"] = metadataSchemaVersion
+		}
+		js["version"] = version.Binary
+		js["topics"] = topicsData
+		data, err = json.Marshal(&js)
+		if err != nil {
+			return err
+		}
+		err = writeMetadataFile(fn, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	n.logf(LOG_INFO, "RECOVER: fixed %d problems", fixed)
+	return nil
+}
@@ -0,0 +1,76 @@
+package nsqd
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// redeliveryRateWindow is the window of the redelivery rate of channels,
+	// made of redeliveryRateBuckets that expire one at a time
+	redeliveryRateWindow  = time.Minute
+	redeliveryRateBuckets = 6
+)
+
+// redeliveryRate is the fraction of the deliveries of the last
+// redeliveryRateWindow that were redeliveries
+type redeliveryRate struct {
+	sync.Mutex
+	buckets [redeliveryRateBuckets]struct {
+		slot         int64
+		deliveries   uint64
+		redeliveries uint64
+	}
+}
+
+func redeliveryRateSlot(now time.Time) int64 {
+	return now.UnixNano() / int64(redeliveryRateWindow/redeliveryRateBuckets)
+}
+
+func (r *redeliveryRate) add(now time.Time, redelivery bool) {
+	slot := redeliveryRateSlot(now)
+	r.Lock()
+	b := &r.buckets[slot%redeliveryRateBuckets]
+	if b.slot != slot {
+		b.slot = slot
+		b.deliveries = 0
+		b.redeliveries = 0
+	}
+	b.deliveries++
+	if redelivery {
+		b.redeliveries++
+	}
+	r.Unlock()
+}
+
+// rate returns the fraction of the deliveries in the window that were
+// redeliveries (0 without deliveries)
+func (r *redeliveryRate) rate(now time.Time) float64 {
+	slot := redeliveryRateSlot(now)
+	var deliveries, redeliveries uint64
+	r.Lock()
+	for _, b := range r.buckets {
+		if b.slot > slot-redeliveryRateBuckets {
+			deliveries += b.deliveries
+			redeliveries += b.redeliveries
+		}
+	}
+	r.Unlock()
+	if deliveries == 0 {
+		return 0
+	}
+	return float64(redeliveries) / float64(deliveries)
+}
+
+// countDelivery records the delivery of msg to a client of the channel, a
+// redelivery if it was delivered before (requeued or timed out), i.e. a
+// duplicate that consumers must absorb
+func (c *Channel) countDelivery(msg *Message, now time.Time) {
+	redelivery := msg.Attempts > 1
+	atomic.AddUint64(&c.deliveryCount, 1)
+	if redelivery {
+		atomic.AddUint64(&c.redeliveryCount, 1)
+	}
+	c.redeliveryRate.add(now, redelivery)
+}
@@ -0,0 +1,160 @@
+package nsqd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// ErrTopicExists is returned when renaming a topic to the name of another
+var ErrTopicExists = errors.New("topic already exists")
+
+// RenameTopic renames a topic, keeping its backlog (messages in flight or
+// deferred are requeued), channels and settings, e.g. for a service rename.
+// nsqlookupd is told the old topic is gone and the new one exists. Clients of
+// the topic are disconnected, and publishing to the old name creates it anew.
+func (n *NSQD) RenameTopic(oldName string, newName string) error {
+	if strings.HasSuffix(oldName, "#ephemeral") || strings.HasSuffix(newName, "#ephemeral") {
+		return errors.New("ephemeral topics cannot be renamed")
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	topic, ok := n.topicMap[oldName]
+	if !ok {
+		return errors.New("topic does not exist")
+	}
+	if _, ok := n.topicMap[newName]; ok {
+		return ErrTopicExists
+	}
+	if m := topic.getMigration(); m != nil && m.active() {
+		return ErrMigrationInProgress
+	}
+	if topic.draining() {
+		return ErrTopicDraining
+	}
+
+	settings, err := n.topicMetadata(oldName)
+	if err != nil {
+		return err
+	}
+
+	// writes the backlog to disk
+	err = topic.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close topic - %s", err)
+	}
+	delete(n.topicMap, oldName)
+	n.quotas.deleteTopic(oldName)
+	// de-register the topic and its channels from nsqlookupd (they're exiting)
+	for _, channel := range topic.loadChannels() {
+		n.Notify(channel)
+	}
+	n.Notify(topic)
+
+	var channelNames []string
+	for _, c := range settings.Channels {
+		channelNames = append(channelNames, c.Name)
+	}
+	err = renameBackendFiles(topic.dataPath, oldName, newName, channelNames)
+	if err != nil {
+		n.logf(LOG_ERROR, "TOPIC(%s): failed to rename to %s - %s", oldName, newName, err)
+		n.reopenTopic(oldName, topic.dataPath, settings)
+		return err
+	}
+
+	n.reopenTopic(newName, topic.dataPath, settings)
+	n.logf(LOG_INFO, "TOPIC(%s): renamed to %s", oldName, newName)
+	return n.PersistMetadata()
+}
+
+// topicMetadata returns the settings and channels of a topic as persisted, it
+// expects the caller to hold n's lock
+func (n *NSQD) topicMetadata(topicName string) (topicMeta, error) {
+	data, err := n.metadata()
+	if err != nil {
+		return topicMeta{}, err
+	}
+	var m meta
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return topicMeta{}, err
+	}
+	for _, t := range m.Topics {
+		if t.Name == topicName {
+			return t, nil
+		}
+	}
+	return topicMeta{}, errors.New("topic does not exist")
+}
+
+// reopenTopic creates and starts a topic whose backend files are in dataPath,
+// with the settings and channels of t, it expects the caller to hold n's lock
+func (n *NSQD) reopenTopic(topicName string, dataPath string, t topicMeta) *Topic {
+	deleteCallback := func(t *Topic) {
+		n.DeleteExistingTopic(t.name)
+	}
+	topic := NewTopic(topicName, &context{n}, dataPath, deleteCallback)
+	n.topicMap[topicName] = topic
+
+	err := applyTopicMetadata(topic, t)
+	if err != nil {
+		n.logf(LOG_WARN, "ignoring invalid settings of topic %s - %s", topicName, err)
+	}
+	for _, c := range t.Channels {
+		applyChannelMetadata(topic.GetChannel(c.Name), c)
+	}
+	topic.Start()
+	return topic
+}
+
+// renameBackendFiles renames the diskqueue (and audit log) files in dataPath of a topic and its
+// channels from oldName to newName, undoing that if it fails
+func renameBackendFiles(dataPath string, oldName string, newName string, channelNames []string) error {
+	backends := [][2]string{{getTopicBackendName(oldName), getTopicBackendName(newName)}}
+	for _, channelName := range channelNames {
+		backends = append(backends, [2]string{
+			getBackendName(oldName, channelName),
+			getBackendName(newName, channelName),
+		})
+	}
+
+	files, err := ioutil.ReadDir(dataPath)
+	if err != nil {
+		return err
+	}
+
+	var renamed [][2]string
+	undo := func() {
+		for i := len(renamed) - 1; i >= 0; i-- {
+			os.Rename(renamed[i][1], renamed[i][0])
+		}
+	}
+	for _, b := range backends {
+		re := regexp.MustCompile("^" + regexp.QuoteMeta(b[0]) + `(\.diskqueue\.(meta|\d{6})\.dat|\.audit\.log(\.\d+)?)$`)
+		for _, fi := range files {
+			if !re.MatchString(fi.Name()) {
+				continue
+			}
+			src := path.Join(dataPath, fi.Name())
+			dst := path.Join(dataPath, b[1]+strings.TrimPrefix(fi.Name(), b[0]))
+			if _, err := os.Stat(dst); err == nil {
+				undo()
+				return fmt.Errorf("%s already exists", dst)
+			}
+			err := os.Rename(src, dst)
+			if err != nil {
+				undo()
+				return err
+			}
+			renamed = append(renamed, [2]string{src, dst})
+		}
+	}
+	return syncDir(dataPath)
+}
@@ -0,0 +1,375 @@
+package nsqd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrRetentionDisabled is returned by Topic.SeekChannel without --retention
+var ErrRetentionDisabled = errors.New("seeking channels requires --retention")
+
+// retentionLog keeps a copy of the messages a topic delivered to its channels
+// for --retention, for channels to be moved back to reprocess them (see
+// Topic.SeekChannel). Messages are appended to <data path>/<backend
+// name>.retained.<n>.dat segments of up to --max-bytes-per-file, each a 4-byte
+// (uint32) size and the message as written to a backend, and segments are
+// deleted once they were last written to --retention ago.
+type retentionLog struct {
+	sync.Mutex
+	ctx      *context
+	fileName string // with %06d for the segment number
+
+	first int64
+	last  int64
+	f     *os.File
+	w     *bufio.Writer
+	size  int64 // of the last segment
+}
+
+// retentionPos is a position in a retentionLog, the end of the messages written
+// before it
+type retentionPos struct {
+	segment int64
+	offset  int64
+}
+
+func newRetentionLog(ctx *context, dataPath string, backendName string) (*retentionLog, error) {
+	l := &retentionLog{
+		ctx:      ctx,
+		fileName: path.Join(dataPath, backendName+".retained.%06d.dat"),
+	}
+
+	// carry on from the segments of a previous run
+	matches, err := filepath.Glob(path.Join(dataPath, backendName+".retained.*.dat"))
+	if err != nil {
+		return nil, err
+	}
+	l.first = -1
+	for _, m := range matches {
+		s := strings.TrimSuffix(strings.TrimPrefix(path.Base(m), backendName+".retained."), ".dat")
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			continue
+		}
+		if l.first == -1 || n < l.first {
+			l.first = n
+		}
+		if n > l.last {
+			l.last = n
+		}
+	}
+	if l.first == -1 {
+		l.first = 0
+	}
+
+	err = l.openSegment()
+	if err != nil {
+		return nil, err
+	}
+	l.prune()
+	return l, nil
+}
+
+func (l *retentionLog) segmentName(n int64) string {
+	return fmt.Sprintf(l.fileName, n)
+}
+
+func (l *retentionLog) openSegment() error {
+	f, err := os.OpenFile(l.segmentName(l.last), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f = f
+	l.w = bufio.NewWriter(f)
+	l.size = fi.Size()
+	return nil
+}
+
+// write appends m, rolling to a new segment once the last one is full
+func (l *retentionLog) write(m *Message) error {
+	b := bufferPoolGet()
+	defer bufferPoolPut(b)
+	b.Reset()
+	b.Write([]byte{0, 0, 0, 0})
+	_, err := m.writeTo(b, MsgEnvelopeV2)
+	if err != nil {
+		return err
+	}
+	buf := b.Bytes()
+	binary.BigEndian.PutUint32(buf, uint32(len(buf)-4))
+
+	l.Lock()
+	defer l.Unlock()
+	if l.f == nil {
+		return errors.New("retention log is closed")
+	}
+	if l.size > 0 && l.size+int64(len(buf)) > l.ctx.nsqd.getOpts().MaxBytesPerFile {
+		err := l.closeSegment()
+		if err != nil {
+			return err
+		}
+		l.last++
+		err = l.openSegment()
+		if err != nil {
+			return err
+		}
+		l.prune()
+	}
+	n, err := l.w.Write(buf)
+	l.size += int64(n)
+	return err
+}
+
+func (l *retentionLog) closeSegment() error {
+	if l.f == nil {
+		return nil
+	}
+	err := l.w.Flush()
+	if closeErr := l.f.Close(); err == nil {
+		err = closeErr
+	}
+	l.f = nil
+	return err
+}
+
+// prune deletes the segments before the last one that were last written to
+// --retention ago, it expects the caller to hold the lock
+func (l *retentionLog) prune() {
+	cutoff := time.Now().Add(-l.ctx.nsqd.getOpts().Retention)
+	for ; l.first < l.last; l.first++ {
+		fi, err := os.Stat(l.segmentName(l.first))
+		if err == nil && fi.ModTime().After(cutoff) {
+			return
+		}
+		err = os.Remove(l.segmentName(l.first))
+		if err != nil && !os.IsNotExist(err) {
+			l.ctx.nsqd.logf(LOG_ERROR, "failed to remove retained segment %s - %s", l.segmentName(l.first), err)
+			return
+		}
+	}
+}
+
+// end flushes the log and returns the position after the last message
+func (l *retentionLog) end() (retentionPos, error) {
+	l.Lock()
+	defer l.Unlock()
+	if l.f == nil {
+		return retentionPos{}, errors.New("retention log is closed")
+	}
+	return retentionPos{l.last, l.size}, l.w.Flush()
+}
+
+// read calls fn with the messages written before end, from the first segment
+// last written to at or after since (messages can't have been published after
+// the segment they're in was written to), until fn returns false
+func (l *retentionLog) read(since time.Time, end retentionPos, fn func(*Message) bool) error {
+	l.Lock()
+	first := l.first
+	l.Unlock()
+
+	for n := first; n <= end.segment; n++ {
+		f, err := os.Open(l.segmentName(n))
+		if os.IsNotExist(err) {
+			// pruned meanwhile
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if n < end.segment && fi.ModTime().Before(since) {
+			f.Close()
+			continue
+		}
+
+		limit := fi.Size()
+		if n == end.segment {
+			limit = end.offset
+		}
+		more, err := readSegment(bufio.NewReader(io.LimitReader(f, limit)), fn)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s - %s", l.segmentName(n), err)
+		}
+		if !more {
+			return nil
+		}
+	}
+	return nil
+}
+
+// readSegment calls fn with the messages in r, returning false if fn did
+func readSegment(r io.Reader, fn func(*Message) bool) (bool, error) {
+	var size [4]byte
+	var buf []byte
+	for {
+		_, err := io.ReadFull(r, size[:])
+		if err == nil {
+			buf = make([]byte, binary.BigEndian.Uint32(size[:]))
+			_, err = io.ReadFull(r, buf)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// the end, or the rest wasn't written before nsqd stopped
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		msg, err := decodeMessage(buf)
+		if err != nil {
+			return false, err
+		}
+		if !fn(msg) {
+			return false, nil
+		}
+	}
+}
+
+// close flushes and closes the log, delete removes its segments too
+func (l *retentionLog) close() error {
+	l.Lock()
+	defer l.Unlock()
+	return l.closeSegment()
+}
+
+func (l *retentionLog) delete() error {
+	l.Lock()
+	defer l.Unlock()
+	l.closeSegment()
+	for n := l.first; n <= l.last; n++ {
+		err := os.Remove(l.segmentName(n))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+type seekRequest struct {
+	channel *Channel
+	to      time.Time
+	result  chan error
+	// how many queued messages the channel discarded
+	discarded int64
+}
+
+// SeekChannel moves channel to the messages published at or after to, which
+// may be back (within --retention) to reprocess them, or forward to skip a
+// backlog. It discards the messages queued in the channel and requeues those
+// the topic retained that were published at or after to, in the background, as
+// new messages keep being delivered. It returns how many messages it discarded.
+//
+// Messages in flight or deferred are kept, and may be delivered again.
+func (t *Topic) SeekChannel(channel *Channel, to time.Time) (int64, error) {
+	if t.retention == nil {
+		return 0, ErrRetentionDisabled
+	}
+	req := &seekRequest{
+		channel: channel,
+		to:      to,
+		result:  make(chan error, 1),
+	}
+	// messagePump seeks between messages, so that each is either discarded and
+	// retained or delivered after the seek
+	select {
+	case t.seekChan <- req:
+	case <-t.exitChan:
+		return 0, errors.New("exiting")
+	}
+	err := <-req.result
+	return req.discarded, err
+}
+
+// seek runs req in messagePump
+func (t *Topic) seek(req *seekRequest) {
+	end, err := t.retention.end()
+	if err != nil {
+		req.result <- err
+		return
+	}
+	req.discarded = req.channel.discardQueued()
+	req.channel.replay(t.retention, req.to, end)
+	req.result <- nil
+}
+
+// discardQueued discards the messages queued in the channel (not in flight or
+// deferred), returning how many
+func (c *Channel) discardQueued() int64 {
+	c.Lock()
+	defer c.Unlock()
+
+	count := c.backend.Depth()
+	for {
+		select {
+		case msg := <-c.memoryMsgChan:
+			releaseMessage(msg)
+			count++
+			continue
+		default:
+		}
+		break
+	}
+	err := c.backend.Empty()
+	if err != nil {
+		c.ctx.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to empty backend - %s", c.name, err)
+	}
+	return count
+}
+
+// replay puts the messages of rl written before end and published at or after
+// to in the channel, in the background until the next seek
+func (c *Channel) replay(rl *retentionLog, to time.Time, end retentionPos) {
+	stop := make(chan int)
+	c.Lock()
+	if c.seekStop != nil {
+		close(c.seekStop)
+	}
+	c.seekStop = stop
+	c.Unlock()
+
+	go func() {
+		var count int64
+		err := rl.read(to, end, func(msg *Message) bool {
+			select {
+			case <-stop:
+				return false
+			default:
+			}
+			if msg.Timestamp < to.UnixNano() || !c.receives(msg) {
+				releaseMessage(msg)
+				return true
+			}
+			err := c.PutMessage(msg)
+			if err != nil {
+				releaseMessage(msg)
+				return false
+			}
+			count++
+			return true
+		})
+		if err != nil {
+			c.ctx.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to read retained messages - %s", c.name, err)
+		}
+		c.ctx.nsqd.logf(LOG_INFO, "CHANNEL(%s): requeued %d retained messages published since %s",
+			c.name, count, to.Format(time.RFC3339))
+	}()
+}
@@ -0,0 +1,136 @@
+package nsqd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/nsqio/nsq/internal/diskqueue"
+)
+
+// runningFile exists in --data-path while nsqd runs, finding it at startup means
+// the previous nsqd didn't exit cleanly
+func runningFile(opts *Options) string {
+	return path.Join(opts.DataPath, "nsqd.running")
+}
+
+// startupCheck cross-checks the metadata with the disk queues in the data paths
+// when the previous nsqd didn't exit cleanly, or always with --strict-startup.
+// nsqd refuses to start on problems with --strict-startup, otherwise they're
+// repaired as with --recover. New writes runningFile once the rest of its setup
+// succeeded.
+func (n *NSQD) startupCheck() error {
+	opts := n.getOpts()
+	_, err := os.Stat(runningFile(opts))
+	crashed := err == nil
+
+	if crashed || opts.StrictStartup {
+		if crashed {
+			n.logf(LOG_WARN, "NSQ: previous nsqd didn't exit cleanly, checking --data-path")
+		}
+		problems, err := n.checkDataPaths()
+		if err != nil {
+			return err
+		}
+		for _, p := range problems {
+			n.logf(LOG_WARN, "STARTUP CHECK: %s", p)
+		}
+		switch {
+		case len(problems) == 0:
+			n.logf(LOG_INFO, "STARTUP CHECK: no problems found")
+		case opts.StrictStartup:
+			return fmt.Errorf("--strict-startup found %d problems in --data-path (repair them with --recover):\n\t%s",
+				len(problems), strings.Join(problems, "\n\t"))
+		default:
+			err = n.recoverDataPaths()
+			if err != nil {
+				return fmt.Errorf("failed to recover --data-path - %s", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkDataPaths describes the problems of the disk queues in the data paths and
+// of the metadata's topics and channels: disk queues inconsistent with their
+// data files (see diskqueue.Check), topics and channels without disk queues (or
+// not in their topic's data path) and disk queues missing from the metadata
+func (n *NSQD) checkDataPaths() ([]string, error) {
+	opts := n.getOpts()
+	paths := dataPaths(opts)
+	var problems []string
+
+	fn := newMetadataFile(opts)
+	data, err := readOrEmpty(fn)
+	if err != nil {
+		return nil, err
+	}
+	var m meta
+	if data != nil {
+		err = json.Unmarshal(data, &m)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s is corrupt - %s", fn, err))
+		}
+	}
+
+	// data path of each disk queue
+	queues := make(map[string]string)
+	for _, dataPath := range paths {
+		names, err := diskqueue.Names(dataPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if otherPath, ok := queues[name]; ok {
+				problems = append(problems, fmt.Sprintf("DISKQUEUE(%s): in both %s and %s",
+					name, otherPath, dataPath))
+				continue
+			}
+			queues[name] = dataPath
+			found, err := diskqueue.Check(name, dataPath)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("DISKQUEUE(%s): failed to check - %s", name, err))
+			}
+			for _, p := range found {
+				problems = append(problems, fmt.Sprintf("DISKQUEUE(%s): %s", name, p))
+			}
+		}
+	}
+
+	for _, t := range m.Topics {
+		topicPath := paths[0]
+		if t.DataPath != "" {
+			topicPath = t.DataPath
+		}
+		names := []string{getTopicBackendName(t.Name)}
+		descs := []string{fmt.Sprintf("TOPIC(%s)", t.Name)}
+		for _, c := range t.Channels {
+			names = append(names, getBackendName(t.Name, c.Name))
+			descs = append(descs, fmt.Sprintf("TOPIC(%s): channel %s", t.Name, c.Name))
+		}
+		for i, name := range names {
+			desc := descs[i]
+			dataPath, ok := queues[name]
+			delete(queues, name)
+			switch {
+			case !ok:
+				// closing a disk queue writes its metadata, even when empty
+				problems = append(problems, fmt.Sprintf("%s: no disk queue in %s", desc, topicPath))
+			case dataPath != topicPath:
+				problems = append(problems, fmt.Sprintf("%s: disk queue in %s instead of %s",
+					desc, dataPath, topicPath))
+			}
+		}
+	}
+
+	var orphans []string
+	for name, dataPath := range queues {
+		orphans = append(orphans, fmt.Sprintf("DISKQUEUE(%s): in %s but not in the metadata", name, dataPath))
+	}
+	sort.Strings(orphans)
+	return append(problems, orphans...), nil
+}
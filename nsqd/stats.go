@@ -4,6 +4,7 @@ import (
 	"runtime"
 	"sort"
 	"sync/atomic"
+	"time"
 
 	"github.com/nsqio/nsq/internal/quantile"
 )
@@ -16,11 +17,23 @@ type TopicStats struct {
 	MessageCount uint64         `json:"message_count"`
 	MessageBytes uint64         `json:"message_bytes"`
 	Paused       bool           `json:"paused"`
+	MemQueueSize int64          `json:"mem_queue_size"`
+	Durable      bool           `json:"durable"`
+	DataPath     string         `json:"data_path,omitempty"`
+	DiskBytes    int64          `json:"disk_bytes"`
+	MaxDiskBytes int64          `json:"max_disk_bytes"`
+
+	Publishers []PublisherCount `json:"publishers,omitempty"`
+
+	// messages dropped as they already transited this cluster, see ErrHopLoop
+	LoopDropCount uint64 `json:"loop_drop_count"`
 
 	E2eProcessingLatency *quantile.Result `json:"e2e_processing_latency"`
 }
 
 func NewTopicStats(t *Topic, channels []ChannelStats) TopicStats {
+	memQueueSize, _ := t.MemQueueSize()
+	maxDiskBytes, _ := t.DiskQuota()
 	return TopicStats{
 		TopicName:    t.name,
 		Channels:     channels,
@@ -29,6 +42,15 @@ func NewTopicStats(t *Topic, channels []ChannelStats) TopicStats {
 		MessageCount: atomic.LoadUint64(&t.messageCount),
 		MessageBytes: atomic.LoadUint64(&t.messageBytes),
 		Paused:       t.IsPaused(),
+		MemQueueSize: memQueueSize,
+		Durable:      t.IsDurable(),
+		DataPath:     t.dataPath,
+		DiskBytes:    backendDiskBytes(t.backend),
+		MaxDiskBytes: maxDiskBytes,
+
+		Publishers: t.TopPublishers(t.ctx.nsqd.getOpts().PublisherStatsTopN),
+
+		LoopDropCount: atomic.LoadUint64(&t.loopDropCount),
 
 		E2eProcessingLatency: t.AggregateChannelE2eProcessingLatency().Result(),
 	}
@@ -38,16 +60,39 @@ type ChannelStats struct {
 	ChannelName   string        `json:"channel_name"`
 	Depth         int64         `json:"depth"`
 	BackendDepth  int64         `json:"backend_depth"`
+	DiskBytes     int64         `json:"disk_bytes"`
 	InFlightCount int           `json:"in_flight_count"`
 	DeferredCount int           `json:"deferred_count"`
 	MessageCount  uint64        `json:"message_count"`
 	RequeueCount  uint64        `json:"requeue_count"`
 	TimeoutCount  uint64        `json:"timeout_count"`
+	DropCount     uint64        `json:"overflow_drop_count"`
 	ClientCount   int           `json:"client_count"`
+	MaxClients    int           `json:"max_clients"`
+	RejectedCount uint64        `json:"rejected_client_count"`
+	DeadCount     uint64        `json:"dead_client_count"`
+	Quarantined   uint64        `json:"quarantined_count"`
+	Exclusive     bool          `json:"exclusive"`
+	KeyRouting    bool          `json:"key_routing"`
+	SampleRate    int32         `json:"sample_rate"`
+	SampledOut    uint64        `json:"sampled_out_count"`
+	BufferSize    int64         `json:"buffer_size,omitempty"`
+	Alarm         bool          `json:"alarm"`
+	AuditLog      bool          `json:"audit_log"`
 	Clients       []ClientStats `json:"clients"`
 	Paused        bool          `json:"paused"`
+	PausedUntil   string        `json:"paused_until,omitempty"`
+
+	// messages sent to clients, those of them sent before, and the fraction of
+	// the deliveries of the last minute that were redeliveries
+	DeliveryCount   uint64  `json:"delivery_count"`
+	RedeliveryCount uint64  `json:"redelivery_count"`
+	RedeliveryRate  float64 `json:"redelivery_rate"`
 
 	E2eProcessingLatency *quantile.Result `json:"e2e_processing_latency"`
+	ProcessingLatency    *quantile.Result `json:"processing_latency"`
+	// event to FIN time of messages with event timestamps
+	EventLag *quantile.Result `json:"event_lag"`
 }
 
 func NewChannelStats(c *Channel, clients []ClientStats, clientCount int) ChannelStats {
@@ -57,21 +102,49 @@ func NewChannelStats(c *Channel, clients []ClientStats, clientCount int) Channel
 	c.deferredMutex.Lock()
 	deferred := len(c.deferredMessages)
 	c.deferredMutex.Unlock()
+	var bufferSize int64
+	if c.ephemeral {
+		bufferSize = int64(cap(c.memoryMsgChan))
+	}
+	var pausedUntil string
+	if t := c.PausedUntil(); !t.IsZero() {
+		pausedUntil = t.Format(time.RFC3339)
+	}
 
 	return ChannelStats{
 		ChannelName:   c.name,
 		Depth:         c.Depth(),
 		BackendDepth:  c.backend.Depth(),
+		DiskBytes:     backendDiskBytes(c.backend),
 		InFlightCount: inflight,
 		DeferredCount: deferred,
 		MessageCount:  atomic.LoadUint64(&c.messageCount),
 		RequeueCount:  atomic.LoadUint64(&c.requeueCount),
 		TimeoutCount:  atomic.LoadUint64(&c.timeoutCount),
+		DropCount:     atomic.LoadUint64(&c.overflowDropCount),
 		ClientCount:   clientCount,
+		MaxClients:    c.MaxClients(),
+		RejectedCount: atomic.LoadUint64(&c.rejectedClientCount),
+		DeadCount:     atomic.LoadUint64(&c.deadClientCount),
+		Quarantined:   atomic.LoadUint64(&c.quarantinedCount),
+		Exclusive:     c.IsExclusive(),
+		KeyRouting:    c.IsKeyRouted(),
+		SampleRate:    c.SampleRate(),
+		SampledOut:    atomic.LoadUint64(&c.sampledOutCount),
+		BufferSize:    bufferSize,
+		Alarm:         c.IsAlarmRaised(),
+		AuditLog:      c.IsAuditLogged(),
 		Clients:       clients,
 		Paused:        c.IsPaused(),
+		PausedUntil:   pausedUntil,
+
+		DeliveryCount:   atomic.LoadUint64(&c.deliveryCount),
+		RedeliveryCount: atomic.LoadUint64(&c.redeliveryCount),
+		RedeliveryRate:  c.redeliveryRate.rate(time.Now()),
 
 		E2eProcessingLatency: c.e2eProcessingLatencyStream.Result(),
+		ProcessingLatency:    c.processingLatencyStream.Result(),
+		EventLag:             c.eventLagStream.Result(),
 	}
 }
 
@@ -99,8 +172,14 @@ type ClientStats struct {
 	Authed          bool   `json:"authed,omitempty"`
 	AuthIdentity    string `json:"auth_identity,omitempty"`
 	AuthIdentityURL string `json:"auth_identity_url,omitempty"`
+	// a subscriber to an exclusive channel that isn't sent messages
+	Standby bool `json:"standby,omitempty"`
 
 	PubCounts []PubCount `json:"pub_counts,omitempty"`
+	// negotiated in IDENTIFY
+	Features []string `json:"features,omitempty"`
+
+	ProcessingLatency *quantile.Result `json:"processing_latency,omitempty"`
 
 	TLS                           bool   `json:"tls"`
 	CipherSuite                   string `json:"tls_cipher_suite"`
@@ -171,8 +250,10 @@ func (n *NSQD) GetStats(topic string, channel string, includeClients bool) []Top
 			c.RLock()
 			if includeClients {
 				clients = make([]ClientStats, 0, len(c.clients))
-				for _, client := range c.clients {
-					clients = append(clients, client.Stats())
+				for id, client := range c.clients {
+					stats := client.Stats()
+					stats.Standby = !c.isActiveClient(id)
+					clients = append(clients, stats)
 				}
 			}
 			clientCount = len(c.clients)
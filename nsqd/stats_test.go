@@ -10,7 +10,9 @@ import (
 	"time"
 
 	"github.com/golang/snappy"
+	"github.com/nsqio/go-nsq"
 	"github.com/nsqio/nsq/internal/http_api"
+	"github.com/nsqio/nsq/internal/quantile"
 	"github.com/nsqio/nsq/internal/test"
 )
 
@@ -157,3 +159,132 @@ func TestStatsChannelLocking(t *testing.T) {
 	test.Equal(t, 1, len(stats[0].Channels))
 	test.Equal(t, 25, stats[0].Channels[0].InFlightCount)
 }
+
+func TestStatsProcessingLatency(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.ProcessingLatencyPercentiles = []float64{0.5, 0.99}
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_stats_processing_latency" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+
+	resp, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	_, data, _ := nsq.UnpackResponse(resp)
+	msg, err := decodeMessage(data)
+	test.Nil(t, err)
+	time.Sleep(50 * time.Millisecond)
+	_, err = nsq.Finish(nsq.MessageID(msg.ID)).WriteTo(conn)
+	test.Nil(t, err)
+
+	// FIN is asynchronous
+	var stats []TopicStats
+	for i := 0; i < 100; i++ {
+		stats = nsqd.GetStats(topicName, "ch", true)
+		if stats[0].Channels[0].ProcessingLatency.Count == 1 &&
+			stats[0].Channels[0].Clients[0].ProcessingLatency.Count == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, latency := range []*quantile.Result{
+		stats[0].Channels[0].ProcessingLatency,
+		stats[0].Channels[0].Clients[0].ProcessingLatency,
+	} {
+		test.Equal(t, 1, latency.Count)
+		test.Equal(t, 2, len(latency.Percentiles))
+		test.Equal(t, true, latency.Percentiles[0]["value"] >= float64(50*time.Millisecond))
+	}
+}
+
+func TestStatsPublishers(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.PublisherStatsTopN = 1
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_stats_publishers" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	for i := 0; i < 2; i++ {
+		_, err = nsq.Publish(topicName, []byte("test body")).WriteTo(conn)
+		test.Nil(t, err)
+		readValidate(t, conn, frameTypeResponse, "OK")
+	}
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	endpoint := fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName)
+	err = client.POSTV1WithBody(endpoint, []byte("test body"))
+	test.Nil(t, err)
+
+	// publishers without an auth identity or certificate are counted by host
+	var d struct {
+		Topics []TopicStats `json:"topics"`
+	}
+	endpoint = fmt.Sprintf("http://%s/stats?format=json&topic=%s", httpAddr, topicName)
+	err = client.GETV1(endpoint, &d)
+	test.Nil(t, err)
+	test.Equal(t, []PublisherCount{{"127.0.0.1", 3}}, d.Topics[0].Publishers)
+
+	topic := nsqd.GetTopic(topicName)
+	topic.countPublished("billing", 5)
+	test.Equal(t, []PublisherCount{{"billing", 5}}, topic.TopPublishers(1))
+	test.Equal(t, []PublisherCount{{"billing", 5}, {"127.0.0.1", 3}}, topic.TopPublishers(10))
+
+	test.Equal(t, "billing", publisherName("billing", "billing.example.com", "10.0.0.1:4567"))
+	test.Equal(t, "billing.example.com", publisherName("", "billing.example.com", "10.0.0.1:4567"))
+	test.Equal(t, "10.0.0.1", publisherName("", "", "10.0.0.1:4567"))
+}
+
+func TestTimeoutStats(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MsgTimeout = 50 * time.Millisecond
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_timeout_stats" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	var channels []*Channel
+	for i := 0; i < 20; i++ {
+		channel := topic.GetChannel("ch" + strconv.Itoa(i))
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+		channels = append(channels, channel)
+	}
+
+	var d struct {
+		Timeouts TimeoutStats `json:"timeouts"`
+	}
+	endpoint := fmt.Sprintf("http://%s/stats?format=json", httpAddr)
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	for i := 0; i < 100 && d.Timeouts.ExpiredCount < 20; i++ {
+		time.Sleep(10 * time.Millisecond)
+		err := client.GETV1(endpoint, &d)
+		test.Nil(t, err)
+	}
+	test.Equal(t, uint64(20), d.Timeouts.ExpiredCount)
+	test.Equal(t, opts.QueueScanWorkerPoolMax, d.Timeouts.MaxWorkers)
+	test.Equal(t, true, d.Timeouts.Workers >= 1)
+	for _, channel := range channels {
+		test.Equal(t, int64(1), channel.Depth())
+	}
+}
@@ -1,7 +1,11 @@
 package nsqd
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"math"
 	"net"
 	"time"
@@ -26,9 +30,26 @@ func (s Uint64Slice) Less(i, j int) bool {
 
 func (n *NSQD) statsdLoop() {
 	var lastMemStats memStats
+	var lastTimeoutStats TimeoutStats
 	var lastStats []TopicStats
-	interval := n.getOpts().StatsdInterval
+	opts := n.getOpts()
+	interval := opts.StatsdInterval
 	ticker := time.NewTicker(interval)
+
+	// over TCP or TLS a persistent connection buffers stats that fail to send
+	var transport *statsd.Transport
+	if opts.StatsdProtocol != "udp" {
+		tlsConfig, err := buildStatsdTLSConfig(opts)
+		if err == nil {
+			transport, err = statsd.NewTransport(opts.StatsdProtocol, opts.StatsdAddress,
+				tlsConfig, opts.HTTPClientConnectTimeout, opts.StatsdBufferSize)
+		}
+		if err != nil {
+			n.logf(LOG_ERROR, "failed to create statsd transport - %s", err)
+			goto exit
+		}
+	}
+
 	for {
 		select {
 		case <-n.exitChan:
@@ -36,14 +57,23 @@ func (n *NSQD) statsdLoop() {
 		case <-ticker.C:
 			addr := n.getOpts().StatsdAddress
 			prefix := n.getOpts().StatsdPrefix
-			conn, err := net.DialTimeout("udp", addr, time.Second)
-			if err != nil {
-				n.logf(LOG_ERROR, "failed to create UDP socket to statsd(%s)", addr)
-				continue
+			var client *statsd.Client
+			var conn net.Conn
+			var sw *writers.SpreadWriter
+			var bw *writers.BoundaryBufferedWriter
+			if transport != nil {
+				client = statsd.NewClient(transport, prefix)
+			} else {
+				var err error
+				conn, err = net.DialTimeout("udp", addr, time.Second)
+				if err != nil {
+					n.logf(LOG_ERROR, "failed to create UDP socket to statsd(%s)", addr)
+					continue
+				}
+				sw = writers.NewSpreadWriter(conn, interval-time.Second, n.exitChan)
+				bw = writers.NewBoundaryBufferedWriter(sw, n.getOpts().StatsdUDPPacketSize)
+				client = statsd.NewClient(bw, prefix)
 			}
-			sw := writers.NewSpreadWriter(conn, interval-time.Second, n.exitChan)
-			bw := writers.NewBoundaryBufferedWriter(sw, n.getOpts().StatsdUDPPacketSize)
-			client := statsd.NewClient(bw, prefix)
 
 			n.logf(LOG_INFO, "STATSD: pushing stats to %s", addr)
 
@@ -65,6 +95,10 @@ func (n *NSQD) statsdLoop() {
 				stat = fmt.Sprintf("topic.%s.message_bytes", topic.TopicName)
 				client.Incr(stat, int64(diff))
 
+				diff = topic.LoopDropCount - lastTopic.LoopDropCount
+				stat = fmt.Sprintf("topic.%s.loop_drop_count", topic.TopicName)
+				client.Incr(stat, int64(diff))
+
 				stat = fmt.Sprintf("topic.%s.depth", topic.TopicName)
 				client.Gauge(stat, topic.Depth)
 
@@ -112,9 +146,37 @@ func (n *NSQD) statsdLoop() {
 					stat = fmt.Sprintf("topic.%s.channel.%s.timeout_count", topic.TopicName, channel.ChannelName)
 					client.Incr(stat, int64(diff))
 
+					diff = channel.DropCount - lastChannel.DropCount
+					stat = fmt.Sprintf("topic.%s.channel.%s.overflow_drop_count", topic.TopicName, channel.ChannelName)
+					client.Incr(stat, int64(diff))
+
 					stat = fmt.Sprintf("topic.%s.channel.%s.clients", topic.TopicName, channel.ChannelName)
 					client.Gauge(stat, int64(channel.ClientCount))
 
+					diff = channel.RejectedCount - lastChannel.RejectedCount
+					stat = fmt.Sprintf("topic.%s.channel.%s.rejected_client_count", topic.TopicName, channel.ChannelName)
+					client.Incr(stat, int64(diff))
+
+					diff = channel.DeadCount - lastChannel.DeadCount
+					stat = fmt.Sprintf("topic.%s.channel.%s.dead_client_count", topic.TopicName, channel.ChannelName)
+					client.Incr(stat, int64(diff))
+
+					diff = channel.Quarantined - lastChannel.Quarantined
+					stat = fmt.Sprintf("topic.%s.channel.%s.quarantined_count", topic.TopicName, channel.ChannelName)
+					client.Incr(stat, int64(diff))
+
+					diff = channel.SampledOut - lastChannel.SampledOut
+					stat = fmt.Sprintf("topic.%s.channel.%s.sampled_out_count", topic.TopicName, channel.ChannelName)
+					client.Incr(stat, int64(diff))
+
+					diff = channel.DeliveryCount - lastChannel.DeliveryCount
+					stat = fmt.Sprintf("topic.%s.channel.%s.delivery_count", topic.TopicName, channel.ChannelName)
+					client.Incr(stat, int64(diff))
+
+					diff = channel.RedeliveryCount - lastChannel.RedeliveryCount
+					stat = fmt.Sprintf("topic.%s.channel.%s.redelivery_count", topic.TopicName, channel.ChannelName)
+					client.Incr(stat, int64(diff))
+
 					for _, item := range channel.E2eProcessingLatency.Percentiles {
 						stat = fmt.Sprintf("topic.%s.channel.%s.e2e_processing_latency_%.0f", topic.TopicName, channel.ChannelName, item["quantile"]*100.0)
 						client.Gauge(stat, int64(item["value"]))
@@ -123,6 +185,12 @@ func (n *NSQD) statsdLoop() {
 			}
 			lastStats = stats
 
+			ts := n.timeoutPool.stats()
+			client.Gauge("timeouts.workers", int64(ts.Workers))
+			client.Incr("timeouts.expired_count", int64(ts.ExpiredCount-lastTimeoutStats.ExpiredCount))
+			client.Gauge("timeouts.last_processing_usec", ts.LastProcessingUsec)
+			lastTimeoutStats = ts
+
 			if n.getOpts().StatsdMemStats {
 				ms := getMemStats()
 
@@ -139,17 +207,46 @@ func (n *NSQD) statsdLoop() {
 				lastMemStats = ms
 			}
 
-			bw.Flush()
-			sw.Flush()
-			conn.Close()
+			if transport != nil {
+				client.Incr("statsd.dropped_count", int64(transport.Dropped()))
+				err := transport.Flush()
+				if err != nil {
+					n.logf(LOG_WARN, "failed to push stats to statsd(%s), %d bytes buffered to retry - %s",
+						addr, transport.Buffered(), err)
+				}
+			} else {
+				bw.Flush()
+				sw.Flush()
+				conn.Close()
+			}
 		}
 	}
 
 exit:
 	ticker.Stop()
+	if transport != nil {
+		transport.Close()
+	}
 	n.logf(LOG_INFO, "STATSD: closing")
 }
 
+// buildStatsdTLSConfig returns the config to verify statsd with over TLS (nil
+// to use the system roots)
+func buildStatsdTLSConfig(opts *Options) (*tls.Config, error) {
+	if opts.StatsdTLSRootCAFile == "" {
+		return nil, nil
+	}
+	caCertFile, err := ioutil.ReadFile(opts.StatsdTLSRootCAFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsCertPool := x509.NewCertPool()
+	if !tlsCertPool.AppendCertsFromPEM(caCertFile) {
+		return nil, errors.New("failed to append certificate to pool")
+	}
+	return &tls.Config{RootCAs: tlsCertPool}, nil
+}
+
 func percentile(perc float64, arr []uint64, length int) uint64 {
 	if length == 0 {
 		return 0
@@ -0,0 +1,18 @@
+// +build !windows
+
+package nsqd
+
+import (
+	"os"
+)
+
+// syncDir fsyncs the directory dir so that renames within it are durable
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	f.Close()
+	return err
+}
@@ -0,0 +1,132 @@
+package nsqd
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// channelsPerTimeoutWorker is how many channels with expired timeouts per
+	// tick a worker of the timeout pool is added for
+	channelsPerTimeoutWorker = 4
+	// timeoutPoolDecay weighs the moving average of the channels with expired
+	// timeouts per tick, the pool shrinks as it goes down
+	timeoutPoolDecay = 0.9
+)
+
+type timeoutWork struct {
+	c    *Channel
+	msgs []*Message
+	done *sync.WaitGroup
+}
+
+// timeoutPool processes the expired timeouts of channels concurrently (see
+// NSQD.processTimeouts). It's sized to the number of channels with expired
+// timeouts per tick, up to --queue-scan-worker-pool-max: it grows at once to
+// keep up with a burst and shrinks by a worker per tick (with expired timeouts)
+// while the moving average of that number calls for fewer.
+type timeoutPool struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	expiredCount   uint64
+	processingTime int64
+	size           int32
+
+	max     int
+	average float64
+	workCh  chan timeoutWork
+	closeCh chan int
+
+	waitGroup sync.WaitGroup
+}
+
+func newTimeoutPool(max int) *timeoutPool {
+	return &timeoutPool{
+		max:     max,
+		workCh:  make(chan timeoutWork),
+		closeCh: make(chan int),
+	}
+}
+
+// process hands the expired timeouts of each channel to a worker, returning once
+// they're all processed. It's called from a single goroutine.
+func (p *timeoutPool) process(channels []*Channel, msgs map[*Channel][]*Message) {
+	start := time.Now()
+	p.resize(len(channels))
+
+	var done sync.WaitGroup
+	done.Add(len(channels))
+	for _, c := range channels {
+		p.workCh <- timeoutWork{c, msgs[c], &done}
+		atomic.AddUint64(&p.expiredCount, uint64(len(msgs[c])))
+	}
+	done.Wait()
+
+	atomic.StoreInt64(&p.processingTime, int64(time.Since(start)))
+}
+
+// resize adjusts the number of workers for the number of channels with expired
+// timeouts this tick
+func (p *timeoutPool) resize(numChannels int) {
+	p.average = timeoutPoolDecay*p.average + (1-timeoutPoolDecay)*float64(numChannels)
+
+	size := int(atomic.LoadInt32(&p.size))
+	ideal := int(math.Ceil(math.Max(float64(numChannels), p.average) / channelsPerTimeoutWorker))
+	if ideal < 1 {
+		ideal = 1
+	} else if ideal > p.max {
+		ideal = p.max
+	}
+
+	switch {
+	case ideal > size:
+		for ; size < ideal; size++ {
+			p.waitGroup.Add(1)
+			go p.worker()
+		}
+	case ideal < size:
+		p.closeCh <- 1
+		size--
+	}
+	atomic.StoreInt32(&p.size, int32(size))
+}
+
+func (p *timeoutPool) worker() {
+	defer p.waitGroup.Done()
+	for {
+		select {
+		case w := <-p.workCh:
+			w.c.processTimeouts(w.msgs)
+			w.done.Done()
+		case <-p.closeCh:
+			return
+		}
+	}
+}
+
+// Close stops the workers, it must not be called while process is
+func (p *timeoutPool) Close() {
+	close(p.closeCh)
+	p.waitGroup.Wait()
+}
+
+// TimeoutStats are the stats of the processing of expired in-flight and
+// deferred timeouts
+type TimeoutStats struct {
+	Workers    int `json:"workers"`
+	MaxWorkers int `json:"max_workers"`
+	// timeouts processed since startup
+	ExpiredCount uint64 `json:"expired_count"`
+	// how long processing the timeouts that expired on the last tick took
+	LastProcessingUsec int64 `json:"last_processing_usec"`
+}
+
+func (p *timeoutPool) stats() TimeoutStats {
+	return TimeoutStats{
+		Workers:            int(atomic.LoadInt32(&p.size)),
+		MaxWorkers:         p.max,
+		ExpiredCount:       atomic.LoadUint64(&p.expiredCount),
+		LastProcessingUsec: atomic.LoadInt64(&p.processingTime) / int64(time.Microsecond),
+	}
+}
@@ -0,0 +1,29 @@
+package nsqd
+
+import (
+	"testing"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestTimeoutPoolResize(t *testing.T) {
+	p := newTimeoutPool(4)
+	defer p.Close()
+
+	p.resize(1)
+	test.Equal(t, 1, p.stats().Workers)
+
+	// grows at once, up to the max
+	p.resize(10)
+	test.Equal(t, 3, p.stats().Workers)
+	p.resize(40)
+	test.Equal(t, 4, p.stats().Workers)
+
+	// shrinks a worker at a time as the average goes down
+	p.resize(1)
+	test.Equal(t, 3, p.stats().Workers)
+	for i := 0; i < 100; i++ {
+		p.resize(1)
+	}
+	test.Equal(t, 1, p.stats().Workers)
+}
@@ -3,12 +3,14 @@ package nsqd
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/nsqio/go-diskqueue"
+	"github.com/nsqio/nsq/internal/diskqueue"
 	"github.com/nsqio/nsq/internal/lg"
 	"github.com/nsqio/nsq/internal/quantile"
 	"github.com/nsqio/nsq/internal/util"
@@ -18,19 +20,26 @@ type Topic struct {
 	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
 	messageCount uint64
 	messageBytes uint64
+	lastActive   int64 // UnixNano of the last publish or channel deletion
+	// messages dropped as they already transited this cluster, see ErrHopLoop
+	loopDropCount uint64
 
 	sync.RWMutex
 
 	name              string
+	dataPath          string
 	channelMap        map[string]*Channel
+	channels          atomic.Value // []*Channel, see updateChannels
 	backend           BackendQueue
 	memoryMsgChan     chan *Message
+	memQueueSize      int64
+	memQueueSizeSet   bool
 	startChan         chan int
 	exitChan          chan int
 	channelUpdateChan chan int
 	waitGroup         util.WaitGroupWrapper
 	exitFlag          int32
-	idFactory         *guidFactory
+	idFactory         idGenerator
 
 	ephemeral      bool
 	deleteCallback func(*Topic)
@@ -39,28 +48,85 @@ type Topic struct {
 	paused    int32
 	pauseChan chan int
 
+	durable     int32
+	syncEvery   int64
+	syncTimeout time.Duration
+	compression string
+
+	maxDiskBytes    int64
+	diskQuotaPolicy string
+	truncateMutex   sync.Mutex
+
+	channelOverflow     string
+	channelMaxDepth     int64
+	channelMaxDiskBytes int64
+
+	publishers      []string
+	publisherCounts publisherCounts
+
+	idleTimeout time.Duration
+
+	// messages are held until then, see --topic-warmup
+	warmupUntil time.Time
+
+	// in-memory buffer of new #ephemeral channels (0 is the nsqd default)
+	ephemeralBufferSize int64
+
+	migration atomic.Value // *topicMigration, see Migrate
+	drain     atomic.Value // *topicDrain, see DrainAndDelete
+
+	// copies of the delivered messages with --retention, see SeekChannel
+	retention *retentionLog
+	seekChan  chan *seekRequest
+
 	ctx *context
 }
 
+const (
+	// DiskQuotaBackpressure rejects publishes that would be written to disk while
+	// a topic is over its quota
+	DiskQuotaBackpressure = "backpressure"
+	// DiskQuotaTruncate discards the oldest messages on disk of the topic (or its
+	// most backlogged channel) to make room
+	DiskQuotaTruncate = "truncate"
+)
+
+const (
+	// ChannelOverflowNone lets channels grow without limit
+	ChannelOverflowNone = "none"
+	// ChannelOverflowDropOldest discards the oldest messages of a channel that is
+	// over its limits to make room for new ones
+	ChannelOverflowDropOldest = "drop-oldest"
+)
+
+// ErrDiskQuotaExceeded is returned when publishing to a topic that is over its
+// disk quota
+var ErrDiskQuotaExceeded = errors.New("disk quota exceeded")
+
 // Topic constructor
-func NewTopic(topicName string, ctx *context, deleteCallback func(*Topic)) *Topic {
+func NewTopic(topicName string, ctx *context, dataPath string, deleteCallback func(*Topic)) *Topic {
 	t := &Topic{
 		name:              topicName,
+		dataPath:          dataPath,
 		channelMap:        make(map[string]*Channel),
 		memoryMsgChan:     nil,
 		startChan:         make(chan int, 1),
 		exitChan:          make(chan int),
-		channelUpdateChan: make(chan int),
+		channelUpdateChan: make(chan int, 1),
+		seekChan:          make(chan *seekRequest),
 		ctx:               ctx,
 		paused:            0,
 		pauseChan:         make(chan int),
 		deleteCallback:    deleteCallback,
-		idFactory:         NewGUIDFactory(ctx.nsqd.getOpts().ID),
-	}
-	// create mem-queue only if size > 0 (do not use unbuffered chan)
-	if ctx.nsqd.getOpts().MemQueueSize > 0 {
-		t.memoryMsgChan = make(chan *Message, ctx.nsqd.getOpts().MemQueueSize)
+		diskQuotaPolicy:   DiskQuotaBackpressure,
+		channelOverflow:   ChannelOverflowNone,
+		idFactory:         ctx.nsqd.msgIDPolicy.newGenerator(ctx.nsqd.getOpts().ID),
 	}
+	t.memQueueSize = ctx.nsqd.getOpts().MemQueueSize
+	t.memoryMsgChan = newMemoryMsgChan(t.memQueueSize)
+	t.channels.Store([]*Channel{})
+	t.migration.Store((*topicMigration)(nil))
+	t.drain.Store((*topicDrain)(nil))
 	if strings.HasSuffix(topicName, "#ephemeral") {
 		t.ephemeral = true
 		t.backend = newDummyBackendQueue()
@@ -70,17 +136,29 @@ func NewTopic(topicName string, ctx *context, deleteCallback func(*Topic)) *Topi
 			lg.Logf(opts.Logger, opts.LogLevel, lg.LogLevel(level), f, args...)
 		}
 		t.backend = diskqueue.New(
-			topicName,
-			ctx.nsqd.getOpts().DataPath,
+			getTopicBackendName(topicName),
+			dataPath,
 			ctx.nsqd.getOpts().MaxBytesPerFile,
 			int32(minValidMsgLength),
-			int32(ctx.nsqd.getOpts().MaxMsgSize)+minValidMsgLength,
+			int32(ctx.nsqd.getOpts().MaxMsgSize)+maxMsgOverhead,
 			ctx.nsqd.getOpts().SyncEvery,
 			ctx.nsqd.getOpts().SyncTimeout,
 			dqLogf,
 		)
+		setBackendSyncPolicy(t.backend, t.diskqueueSyncPolicy())
+		setBackendCompression(t.backend, t.diskqueueCompression())
+
+		if ctx.nsqd.getOpts().Retention > 0 {
+			var err error
+			t.retention, err = newRetentionLog(ctx, dataPath, getTopicBackendName(topicName))
+			if err != nil {
+				ctx.nsqd.logf(LOG_ERROR, "TOPIC(%s): failed to open retention log - %s", t.name, err)
+			}
+		}
 	}
 
+	t.touch()
+
 	t.waitGroup.Wrap(t.messagePump)
 
 	t.ctx.nsqd.Notify(t)
@@ -104,36 +182,97 @@ func (t *Topic) Exiting() bool {
 // to return a pointer to a Channel object (potentially new)
 // for the given Topic
 func (t *Topic) GetChannel(channelName string) *Channel {
+	return t.GetChannelFrom(channelName, 0)
+}
+
+// GetChannelFrom is GetChannel, with a new channel only put the messages
+// published at or after start (unix nanoseconds, see ParseChannelStart)
+// instead of also those the topic has buffered. Messages it skips that the
+// topic buffered for lack of channels are discarded.
+func (t *Topic) GetChannelFrom(channelName string, start int64) *Channel {
 	t.Lock()
-	channel, isNew := t.getOrCreateChannel(channelName)
+	channel, isNew := t.getOrCreateChannel(channelName, start)
 	t.Unlock()
 
 	if isNew {
-		// update messagePump state
-		select {
-		case t.channelUpdateChan <- 1:
-		case <-t.exitChan:
-		}
+		t.notifyChannelUpdate()
 	}
 
 	return channel
 }
 
+// updateChannels replaces the slice of channels that messagePump fans messages out
+// to (copy-on-write so that it can read it without locking the topic for every
+// message). The caller must hold the topic lock after changing channelMap.
+func (t *Topic) updateChannels() {
+	channels := make([]*Channel, 0, len(t.channelMap))
+	for _, c := range t.channelMap {
+		channels = append(channels, c)
+	}
+	t.channels.Store(channels)
+}
+
+func (t *Topic) loadChannels() []*Channel {
+	return t.channels.Load().([]*Channel)
+}
+
+// notifyChannelUpdate has messagePump update its state without waiting for it
+// (e.g. while it blocks on a channel)
+func (t *Topic) notifyChannelUpdate() {
+	select {
+	case t.channelUpdateChan <- 1:
+	default:
+	}
+}
+
 // this expects the caller to handle locking
-func (t *Topic) getOrCreateChannel(channelName string) (*Channel, bool) {
+func (t *Topic) getOrCreateChannel(channelName string, start int64) (*Channel, bool) {
 	channel, ok := t.channelMap[channelName]
 	if !ok {
 		deleteCallback := func(c *Channel) {
 			t.DeleteExistingChannel(c.name)
 		}
-		channel = NewChannel(t.name, channelName, t.ctx, deleteCallback)
+		memQueueSize := t.memQueueSize
+		if strings.HasSuffix(channelName, "#ephemeral") {
+			memQueueSize = t.effectiveEphemeralBufferSize()
+		}
+		channel = NewChannel(t.name, channelName, t.ctx, t.dataPath, memQueueSize, deleteCallback)
+		if t.IsDurable() {
+			atomic.StoreInt32(&channel.durable, 1)
+		}
+		setBackendSyncPolicy(channel.backend, t.diskqueueSyncPolicy())
+		setBackendCompression(channel.backend, t.diskqueueCompression())
+		channel.setOverflow(t.channelOverflow, t.channelMaxDepth, t.channelMaxDiskBytes)
+		channel.startTimestamp = start
 		t.channelMap[channelName] = channel
+		t.updateChannels()
 		t.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): new channel(%s)", t.name, channel.name)
 		return channel, true
 	}
 	return channel, false
 }
 
+// ParseChannelStart parses where a new channel starts from, "head" (all the
+// messages the topic has buffered, the default), "tail" (only messages
+// published from now) or a unix timestamp in seconds (messages published from
+// then), as unix nanoseconds for GetChannelFrom
+func ParseChannelStart(s string, now time.Time) (int64, error) {
+	switch s {
+	case "", "head":
+		return 0, nil
+	case "tail":
+		return now.UnixNano(), nil
+	}
+	ts, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || ts <= 0 {
+		return 0, fmt.Errorf("invalid start %q - must be head, tail or a unix timestamp", s)
+	}
+	if ts > now.Unix() {
+		return 0, fmt.Errorf("invalid start %q - must not be in the future", s)
+	}
+	return time.Unix(ts, 0).UnixNano(), nil
+}
+
 func (t *Topic) GetExistingChannel(channelName string) (*Channel, error) {
 	t.RLock()
 	defer t.RUnlock()
@@ -153,6 +292,7 @@ func (t *Topic) DeleteExistingChannel(channelName string) error {
 		return errors.New("channel does not exist")
 	}
 	delete(t.channelMap, channelName)
+	t.updateChannels()
 	// not defered so that we can continue while the channel async closes
 	numChannels := len(t.channelMap)
 	t.Unlock()
@@ -163,11 +303,8 @@ func (t *Topic) DeleteExistingChannel(channelName string) error {
 	// (so that we dont leave any messages around)
 	channel.Delete()
 
-	// update messagePump state
-	select {
-	case t.channelUpdateChan <- 1:
-	case <-t.exitChan:
-	}
+	t.notifyChannelUpdate()
+	t.touch()
 
 	if numChannels == 0 && t.ephemeral == true {
 		go t.deleter.Do(func() { t.deleteCallback(t) })
@@ -183,12 +320,18 @@ func (t *Topic) PutMessage(m *Message) error {
 	if atomic.LoadInt32(&t.exitFlag) == 1 {
 		return errors.New("exiting")
 	}
+	if t.draining() {
+		return ErrTopicDraining
+	}
+	// m must not be referenced after put
+	messageBytes := len(m.Body)
 	err := t.put(m)
 	if err != nil {
 		return err
 	}
 	atomic.AddUint64(&t.messageCount, 1)
-	atomic.AddUint64(&t.messageBytes, uint64(len(m.Body)))
+	atomic.AddUint64(&t.messageBytes, uint64(messageBytes))
+	t.touch()
 	return nil
 }
 
@@ -199,30 +342,59 @@ func (t *Topic) PutMessages(msgs []*Message) error {
 	if atomic.LoadInt32(&t.exitFlag) == 1 {
 		return errors.New("exiting")
 	}
+	if t.draining() {
+		return ErrTopicDraining
+	}
 
 	messageTotalBytes := 0
 
 	for i, m := range msgs {
+		// m must not be referenced after put
+		messageBytes := len(m.Body)
 		err := t.put(m)
 		if err != nil {
 			atomic.AddUint64(&t.messageCount, uint64(i))
 			atomic.AddUint64(&t.messageBytes, uint64(messageTotalBytes))
 			return err
 		}
-		messageTotalBytes += len(m.Body)
+		messageTotalBytes += messageBytes
 	}
 
 	atomic.AddUint64(&t.messageBytes, uint64(messageTotalBytes))
 	atomic.AddUint64(&t.messageCount, uint64(len(msgs)))
+	t.touch()
 	return nil
 }
 
 func (t *Topic) put(m *Message) error {
+	if t.IsDurable() {
+		err := t.checkDiskQuota()
+		if err != nil {
+			return err
+		}
+		b := bufferPoolGet()
+		err = writeMessageToBackendSync(b, m, t.backend, t.ctx.nsqd.getOpts().BackendMsgEnvelope)
+		bufferPoolPut(b)
+		t.ctx.nsqd.SetHealth(err)
+		if err != nil {
+			t.ctx.nsqd.logf(LOG_ERROR,
+				"TOPIC(%s) ERROR: failed to write message to backend - %s",
+				t.name, err)
+			return err
+		}
+		releaseMessage(m)
+		return nil
+	}
+
 	select {
 	case t.memoryMsgChan <- m:
 	default:
+		err := t.checkDiskQuota()
+		if err != nil {
+			return err
+		}
 		b := bufferPoolGet()
-		err := writeMessageToBackend(b, m, t.backend)
+		err = writeMessageToBackend(b, m, t.backend, t.ctx.nsqd.getOpts().BackendMsgEnvelope)
 		bufferPoolPut(b)
 		t.ctx.nsqd.SetHealth(err)
 		if err != nil {
@@ -231,23 +403,546 @@ func (t *Topic) put(m *Message) error {
 				t.name, err)
 			return err
 		}
+		releaseMessage(m)
 	}
 	return nil
 }
 
 func (t *Topic) Depth() int64 {
-	return int64(len(t.memoryMsgChan)) + t.backend.Depth()
+	t.RLock()
+	memoryDepth := len(t.memoryMsgChan)
+	t.RUnlock()
+	return int64(memoryDepth) + t.backend.Depth()
+}
+
+// MemQueueSize returns the number of messages this topic (and channels created for
+// it) keeps in memory and whether that overrides --mem-queue-size
+func (t *Topic) MemQueueSize() (int64, bool) {
+	t.RLock()
+	defer t.RUnlock()
+	return t.memQueueSize, t.memQueueSizeSet
+}
+
+// SetMemQueueSize overrides --mem-queue-size for this topic (a negative size reverts
+// to --mem-queue-size). Messages in memory that no longer fit are written to the
+// backend. Existing channels keep their in-memory queue until nsqd restarts,
+// channels created afterwards use the new size.
+func (t *Topic) SetMemQueueSize(size int64) error {
+	isSet := size >= 0
+	if !isSet {
+		size = t.ctx.nsqd.getOpts().MemQueueSize
+	}
+
+	t.Lock()
+	if atomic.LoadInt32(&t.exitFlag) == 1 {
+		t.Unlock()
+		return errors.New("exiting")
+	}
+	t.memQueueSizeSet = isSet
+	if size == t.memQueueSize {
+		t.Unlock()
+		return nil
+	}
+	t.memQueueSize = size
+	oldMsgChan := t.memoryMsgChan
+	t.memoryMsgChan = newMemoryMsgChan(size)
+	for {
+		var msg *Message
+		select {
+		case msg = <-oldMsgChan:
+		default:
+			goto done
+		}
+		select {
+		case t.memoryMsgChan <- msg:
+			continue
+		default:
+		}
+		b := bufferPoolGet()
+		err := writeMessageToBackend(b, msg, t.backend, t.ctx.nsqd.getOpts().BackendMsgEnvelope)
+		bufferPoolPut(b)
+		t.ctx.nsqd.SetHealth(err)
+		if err != nil {
+			t.ctx.nsqd.logf(LOG_ERROR,
+				"TOPIC(%s) ERROR: failed to write message to backend - %s",
+				t.name, err)
+		}
+	}
+done:
+	t.Unlock()
+
+	t.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): mem-queue-size set to %d", t.name, size)
+
+	// have messagePump switch to the new in-memory queue
+	t.notifyChannelUpdate()
+	return nil
+}
+
+// IsDurable returns whether messages published to this topic are only acknowledged
+// once they are fsynced to disk
+func (t *Topic) IsDurable() bool {
+	return atomic.LoadInt32(&t.durable) == 1
+}
+
+// SetDurable enables (or disables) write-through mode, in which the topic and its
+// channels bypass their in-memory queues and PUB is acknowledged only after the
+// message is fsynced to the diskqueue.
+//
+// Messages that are in flight or deferred are still only held in memory.
+func (t *Topic) SetDurable(durable bool) error {
+	if durable && t.ephemeral {
+		return errors.New("ephemeral topics cannot be durable")
+	}
+
+	var v int32
+	if durable {
+		v = 1
+	}
+
+	t.Lock()
+	if atomic.SwapInt32(&t.durable, v) == v {
+		t.Unlock()
+		return nil
+	}
+	if durable {
+		// from now on all messages bypass memory, move what's already there to disk
+		drainMemoryMsgChan(t.memoryMsgChan, t.backend, t.ctx.nsqd.getOpts().BackendMsgEnvelope, func(err error) {
+			t.ctx.nsqd.logf(LOG_ERROR,
+				"TOPIC(%s) ERROR: failed to write message to backend - %s",
+				t.name, err)
+		})
+	}
+	channels := make([]*Channel, 0, len(t.channelMap))
+	for _, c := range t.channelMap {
+		channels = append(channels, c)
+	}
+	t.Unlock()
+
+	for _, c := range channels {
+		c.setDurable(durable)
+	}
+
+	t.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): durable set to %t", t.name, durable)
+	return nil
+}
+
+// SyncPolicy returns the topic's overrides of --sync-every and --sync-timeout
+// (0 if not overridden)
+func (t *Topic) SyncPolicy() (int64, time.Duration) {
+	t.RLock()
+	defer t.RUnlock()
+	return t.syncEvery, t.syncTimeout
+}
+
+// SetSyncPolicy overrides --sync-every and --sync-timeout for the diskqueues of the
+// topic and its channels (0 reverts to the nsqd option). A syncEvery of 1 fsyncs
+// after every write.
+func (t *Topic) SetSyncPolicy(syncEvery int64, syncTimeout time.Duration) error {
+	if syncEvery < 0 || syncTimeout < 0 {
+		return errors.New("sync policy must be >= 0")
+	}
+
+	t.Lock()
+	t.syncEvery = syncEvery
+	t.syncTimeout = syncTimeout
+	p := t.diskqueueSyncPolicy()
+	backends := []BackendQueue{t.backend}
+	for _, c := range t.channelMap {
+		backends = append(backends, c.backend)
+	}
+	t.Unlock()
+
+	for _, bq := range backends {
+		setBackendSyncPolicy(bq, p)
+	}
+
+	t.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): sync-every set to %d, sync-timeout set to %s",
+		t.name, p.Every, p.Timeout)
+	return nil
+}
+
+// diskqueueSyncPolicy expects the caller to handle locking
+func (t *Topic) diskqueueSyncPolicy() diskqueue.SyncPolicy {
+	opts := t.ctx.nsqd.getOpts()
+	p := diskqueue.SyncPolicy{
+		Every:   opts.SyncEvery,
+		Timeout: opts.SyncTimeout,
+		Group:   t.ctx.nsqd.groupCommitter,
+	}
+	if t.syncEvery > 0 {
+		p.Every = t.syncEvery
+	}
+	if t.syncTimeout > 0 {
+		p.Timeout = t.syncTimeout
+	}
+	return p
+}
+
+// Compression returns the topic's override of --disk-compression (empty if not
+// overridden)
+func (t *Topic) Compression() string {
+	t.RLock()
+	defer t.RUnlock()
+	return t.compression
+}
+
+// SetCompression overrides --disk-compression for the diskqueues of the topic and
+// its channels (empty reverts to the nsqd option). Their files are compressed
+// once full, trading CPU for disk space on deep backlogs, and files already
+// compressed stay readable whatever the codec.
+func (t *Topic) SetCompression(compression string) error {
+	if compression != "" && !diskqueue.ValidCompression(compression) {
+		return fmt.Errorf("compression must be %s or %s", diskqueue.CompressionNone, diskqueue.CompressionZstd)
+	}
+
+	t.Lock()
+	t.compression = compression
+	codec := t.diskqueueCompression()
+	backends := []BackendQueue{t.backend}
+	for _, c := range t.channelMap {
+		backends = append(backends, c.backend)
+	}
+	t.Unlock()
+
+	for _, bq := range backends {
+		setBackendCompression(bq, codec)
+	}
+
+	t.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): compression set to %s", t.name, codec)
+	return nil
+}
+
+// diskqueueCompression expects the caller to handle locking
+func (t *Topic) diskqueueCompression() string {
+	if t.compression != "" {
+		return t.compression
+	}
+	return t.ctx.nsqd.getOpts().DiskCompression
+}
+
+// DiskBytes returns the number of bytes on disk used by the topic and its channels
+func (t *Topic) DiskBytes() int64 {
+	t.RLock()
+	defer t.RUnlock()
+	return t.diskBytes()
+}
+
+// diskBytes expects the caller to handle locking
+func (t *Topic) diskBytes() int64 {
+	total := backendDiskBytes(t.backend)
+	for _, c := range t.channelMap {
+		total += backendDiskBytes(c.backend)
+	}
+	return total
+}
+
+// DiskQuota returns the maximum number of bytes on disk for the topic and its
+// channels (0 if unlimited) and what happens when it is exceeded
+func (t *Topic) DiskQuota() (int64, string) {
+	t.RLock()
+	defer t.RUnlock()
+	return t.maxDiskBytes, t.diskQuotaPolicy
+}
+
+// SetDiskQuota limits the bytes on disk used by the topic and its channels to
+// maxBytes (0 is unlimited). The quota is enforced when a publish would be written
+// to disk, with a granularity of --max-bytes-per-file.
+func (t *Topic) SetDiskQuota(maxBytes int64, policy string) error {
+	if maxBytes < 0 {
+		return errors.New("max disk bytes must be >= 0")
+	}
+	switch policy {
+	case DiskQuotaBackpressure, DiskQuotaTruncate:
+	default:
+		return fmt.Errorf("invalid disk quota policy %q", policy)
+	}
+
+	t.Lock()
+	t.maxDiskBytes = maxBytes
+	t.diskQuotaPolicy = policy
+	t.Unlock()
+
+	t.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): max-disk-bytes set to %d (%s)", t.name, maxBytes, policy)
+	return nil
+}
+
+// ChannelOverflow returns the overflow policy of the topic's channels and the
+// depth and bytes on disk (0 if unlimited) at which it applies
+func (t *Topic) ChannelOverflow() (string, int64, int64) {
+	t.RLock()
+	defer t.RUnlock()
+	return t.channelOverflow, t.channelMaxDepth, t.channelMaxDiskBytes
+}
+
+// SetChannelOverflow changes what happens when a message is put to a channel of
+// the topic whose depth (or bytes on disk) is at the limit. With
+// ChannelOverflowDropOldest the oldest queued messages are discarded, for topics
+// where only recent data matters. Disk usage is limited with a granularity of
+// --max-bytes-per-file.
+func (t *Topic) SetChannelOverflow(policy string, maxDepth int64, maxDiskBytes int64) error {
+	if maxDepth < 0 || maxDiskBytes < 0 {
+		return errors.New("channel limits must be >= 0")
+	}
+	switch policy {
+	case ChannelOverflowNone:
+	case ChannelOverflowDropOldest:
+		if maxDepth == 0 && maxDiskBytes == 0 {
+			return errors.New("drop-oldest requires a max depth or max disk bytes")
+		}
+	default:
+		return fmt.Errorf("invalid channel overflow policy %q", policy)
+	}
+
+	t.Lock()
+	t.channelOverflow = policy
+	t.channelMaxDepth = maxDepth
+	t.channelMaxDiskBytes = maxDiskBytes
+	channels := make([]*Channel, 0, len(t.channelMap))
+	for _, c := range t.channelMap {
+		channels = append(channels, c)
+	}
+	t.Unlock()
+
+	for _, c := range channels {
+		c.setOverflow(policy, maxDepth, maxDiskBytes)
+	}
+
+	t.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): channel overflow set to %s (max depth %d, max disk bytes %d)",
+		t.name, policy, maxDepth, maxDiskBytes)
+	return nil
+}
+
+// Publishers returns the auth identities and TLS certificate common names
+// allowed to publish to the topic (any when empty)
+func (t *Topic) Publishers() []string {
+	t.RLock()
+	defer t.RUnlock()
+	return t.publishers
+}
+
+// SetPublishers limits publishing to the topic to clients authenticated as one
+// of publishers, by auth identity or TLS certificate common name. An empty list
+// allows any client.
+func (t *Topic) SetPublishers(publishers []string) error {
+	for _, p := range publishers {
+		if p == "" {
+			return errors.New("publisher must not be empty")
+		}
+	}
+	if len(publishers) == 0 {
+		publishers = nil
+	}
+
+	t.Lock()
+	t.publishers = publishers
+	t.Unlock()
+
+	t.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): publishers set to %v", t.name, publishers)
+	return nil
+}
+
+// IsPublisherAllowed returns whether a client known by names (its auth identity
+// and TLS certificate common name, either of which may be empty) may publish to
+// the topic
+func (t *Topic) IsPublisherAllowed(names ...string) bool {
+	t.RLock()
+	defer t.RUnlock()
+	if len(t.publishers) == 0 {
+		return true
+	}
+	for _, p := range t.publishers {
+		for _, name := range names {
+			if name == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// EphemeralBufferSize returns the topic's override of --ephemeral-buffer-size
+// (0 if not overridden)
+func (t *Topic) EphemeralBufferSize() int64 {
+	t.RLock()
+	defer t.RUnlock()
+	return t.ephemeralBufferSize
+}
+
+// SetEphemeralBufferSize overrides --ephemeral-buffer-size for the topic (0
+// reverts to the nsqd option), the number of messages #ephemeral channels keep
+// in memory for their clients before dropping new ones. Existing channels keep
+// their buffer, channels created afterwards use the new size.
+func (t *Topic) SetEphemeralBufferSize(size int64) error {
+	if size < 0 {
+		return errors.New("ephemeral buffer size must be >= 0")
+	}
+	t.Lock()
+	t.ephemeralBufferSize = size
+	t.Unlock()
+
+	t.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): ephemeral-buffer-size set to %d", t.name, size)
+	return nil
+}
+
+// effectiveEphemeralBufferSize is the buffer size of new #ephemeral channels,
+// which defaults to the topic's mem-queue-size. The caller must hold the topic
+// lock.
+func (t *Topic) effectiveEphemeralBufferSize() int64 {
+	if t.ephemeralBufferSize > 0 {
+		return t.ephemeralBufferSize
+	}
+	if size := t.ctx.nsqd.getOpts().EphemeralBufferSize; size > 0 {
+		return size
+	}
+	return t.memQueueSize
+}
+
+// IdleTimeout returns the topic's override of --topic-idle-timeout (0 if not
+// overridden, negative if the topic is never deleted for being idle)
+func (t *Topic) IdleTimeout() time.Duration {
+	t.RLock()
+	defer t.RUnlock()
+	return t.idleTimeout
+}
+
+// SetIdleTimeout overrides --topic-idle-timeout for the topic (0 reverts to the
+// nsqd option, a negative timeout never deletes the topic for being idle)
+func (t *Topic) SetIdleTimeout(timeout time.Duration) {
+	t.Lock()
+	t.idleTimeout = timeout
+	t.Unlock()
+
+	t.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): idle-timeout set to %s", t.name, timeout)
+}
+
+// warmUp holds the messages of the new topic for d (unless it's ephemeral, as
+// those beyond its memory queue would be dropped), it must be called before
+// Start
+func (t *Topic) warmUp(d time.Duration) {
+	if d <= 0 || t.ephemeral {
+		return
+	}
+	t.warmupUntil = time.Now().Add(d)
+	t.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): holding messages for %s warm-up", t.name, d)
+}
+
+// touch records activity that keeps the topic from being idle
+func (t *Topic) touch() {
+	atomic.StoreInt64(&t.lastActive, time.Now().UnixNano())
+}
+
+// isIdle returns whether the topic has had no channels, queued messages or
+// publishes for its idle timeout
+func (t *Topic) isIdle(now time.Time) bool {
+	if t.ephemeral {
+		return false
+	}
+	timeout := t.IdleTimeout()
+	if timeout == 0 {
+		timeout = t.ctx.nsqd.getOpts().TopicIdleTimeout
+	}
+	if timeout <= 0 {
+		return false
+	}
+	if now.Sub(time.Unix(0, atomic.LoadInt64(&t.lastActive))) < timeout {
+		return false
+	}
+	t.RLock()
+	numChannels := len(t.channelMap)
+	t.RUnlock()
+	return numChannels == 0 && t.Depth() == 0
+}
+
+// checkDiskQuota expects the caller to handle locking
+func (t *Topic) checkDiskQuota() error {
+	if t.maxDiskBytes <= 0 || t.diskBytes() < t.maxDiskBytes {
+		return nil
+	}
+	if t.diskQuotaPolicy != DiskQuotaTruncate {
+		return ErrDiskQuotaExceeded
+	}
+
+	t.truncateMutex.Lock()
+	defer t.truncateMutex.Unlock()
+	for t.diskBytes() >= t.maxDiskBytes {
+		// drop the oldest file of whichever queue is the most backlogged
+		var largest BackendQueue
+		var largestBytes int64
+		backends := []BackendQueue{t.backend}
+		for _, c := range t.channelMap {
+			backends = append(backends, c.backend)
+		}
+		for _, bq := range backends {
+			if n := backendDiskBytes(bq); n > largestBytes {
+				largest, largestBytes = bq, n
+			}
+		}
+		if largest == nil {
+			break
+		}
+		discarded, err := largest.(diskUsageBackendQueue).DiscardOldestFile()
+		if err != nil || discarded == 0 {
+			// only the files being written to are left
+			break
+		}
+		t.ctx.nsqd.logf(LOG_WARN,
+			"TOPIC(%s): over disk quota (%d bytes), discarded %d oldest messages",
+			t.name, t.maxDiskBytes, discarded)
+	}
+	return nil
+}
+
+// drainMemoryMsgChan writes all messages in memoryMsgChan to backend (in envelope,
+// see Message.writeTo), fsyncing each
+func drainMemoryMsgChan(memoryMsgChan chan *Message, backend BackendQueue, envelope int, onError func(error)) {
+	b := bufferPoolGet()
+	defer bufferPoolPut(b)
+	for {
+		select {
+		case msg := <-memoryMsgChan:
+			err := writeMessageToBackendSync(b, msg, backend, envelope)
+			if err != nil {
+				onError(err)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// newMemoryMsgChan creates an in-memory queue only if size > 0 (do not use unbuffered chan)
+func newMemoryMsgChan(size int64) chan *Message {
+	if size <= 0 {
+		return nil
+	}
+	return make(chan *Message, size)
 }
 
 // messagePump selects over the in-memory and backend queue and
 // writes messages to every channel for this topic
 func (t *Topic) messagePump() {
+	setProfilingLabels("topic", t.name)
+
 	var msg *Message
 	var buf []byte
 	var err error
-	var chans []*Channel
 	var memoryMsgChan chan *Message
 	var backendChan chan []byte
+	var warmupChan <-chan time.Time
+
+	// messages are read while there are channels to put them in (or they're
+	// mirrored), the topic isn't paused and its warm-up is over
+	updateChans := func() {
+		t.RLock()
+		if (len(t.channelMap) == 0 && !t.mirroring()) || t.IsPaused() || warmupChan != nil {
+			memoryMsgChan = nil
+			backendChan = nil
+		} else {
+			memoryMsgChan = t.memoryMsgChan
+			backendChan = t.backend.ReadChan()
+		}
+		t.RUnlock()
+	}
 
 	// do not pass messages before Start(), but avoid blocking Pause() or GetChannel()
 	for {
@@ -256,21 +951,19 @@ func (t *Topic) messagePump() {
 			continue
 		case <-t.pauseChan:
 			continue
+		case req := <-t.seekChan:
+			t.seek(req)
+			continue
 		case <-t.exitChan:
 			goto exit
 		case <-t.startChan:
 		}
 		break
 	}
-	t.RLock()
-	for _, c := range t.channelMap {
-		chans = append(chans, c)
-	}
-	t.RUnlock()
-	if len(chans) > 0 && !t.IsPaused() {
-		memoryMsgChan = t.memoryMsgChan
-		backendChan = t.backend.ReadChan()
+	if d := t.warmupUntil.Sub(time.Now()); d > 0 {
+		warmupChan = time.After(d)
 	}
+	updateChans()
 
 	// main message loop
 	for {
@@ -283,53 +976,61 @@ func (t *Topic) messagePump() {
 				continue
 			}
 		case <-t.channelUpdateChan:
-			chans = chans[:0]
-			t.RLock()
-			for _, c := range t.channelMap {
-				chans = append(chans, c)
-			}
-			t.RUnlock()
-			if len(chans) == 0 || t.IsPaused() {
-				memoryMsgChan = nil
-				backendChan = nil
-			} else {
-				memoryMsgChan = t.memoryMsgChan
-				backendChan = t.backend.ReadChan()
-			}
+			updateChans()
 			continue
 		case <-t.pauseChan:
-			if len(chans) == 0 || t.IsPaused() {
-				memoryMsgChan = nil
-				backendChan = nil
-			} else {
-				memoryMsgChan = t.memoryMsgChan
-				backendChan = t.backend.ReadChan()
-			}
+			updateChans()
+			continue
+		case req := <-t.seekChan:
+			t.seek(req)
+			continue
+		case <-warmupChan:
+			t.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): warm-up over, delivering messages", t.name)
+			warmupChan = nil
+			updateChans()
 			continue
 		case <-t.exitChan:
 			goto exit
 		}
 
+		// while migrating, messages are forwarded instead of delivered
+		if m := t.getMigration(); m != nil && m.mirror(msg) {
+			continue
+		}
+
+		if t.retention != nil {
+			err := t.retention.write(msg)
+			if err != nil {
+				t.ctx.nsqd.logf(LOG_ERROR, "TOPIC(%s) ERROR: failed to retain msg(%s) - %s", t.name, msg.ID, err)
+			}
+		}
+
+		// channels added or deleted from now on are taken into account for the
+		// next message
+		chans := t.loadChannels()
 		for i, channel := range chans {
+			if !channel.receives(msg) {
+				continue
+			}
 			chanMsg := msg
 			// copy the message because each channel
 			// needs a unique instance but...
-			// fastpath to avoid copy if its the first channel
-			// (the topic already created the first copy)
-			if i > 0 {
-				chanMsg = NewMessage(msg.ID, msg.Body)
-				chanMsg.Timestamp = msg.Timestamp
-				chanMsg.deferred = msg.deferred
+			// fastpath to avoid copy if its the last channel
+			// (a channel can release its instance once it has it)
+			if i < len(chans)-1 {
+				chanMsg = msg.copy()
 			}
 			if chanMsg.deferred != 0 {
 				channel.PutMessageDeferred(chanMsg, chanMsg.deferred)
 				continue
 			}
+			// the channel may release the message once it has it
+			id := chanMsg.ID
 			err := channel.PutMessage(chanMsg)
-			if err != nil {
+			if err != nil && !channel.Exiting() {
 				t.ctx.nsqd.logf(LOG_ERROR,
 					"TOPIC(%s) ERROR: failed to put msg(%s) to channel(%s) - %s",
-					t.name, msg.ID, channel.name, err)
+					t.name, id, channel.name, err)
 			}
 		}
 	}
@@ -363,6 +1064,11 @@ func (t *Topic) exit(deleted bool) error {
 		t.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): closing", t.name)
 	}
 
+	// stop forwarding before messagePump() exits, which it could otherwise block
+	if m := t.getMigration(); m != nil {
+		m.stop()
+	}
+
 	close(t.exitChan)
 
 	// synchronize the close of messagePump()
@@ -374,8 +1080,16 @@ func (t *Topic) exit(deleted bool) error {
 			delete(t.channelMap, channel.name)
 			channel.Delete()
 		}
+		t.updateChannels()
 		t.Unlock()
 
+		if t.retention != nil {
+			err := t.retention.delete()
+			if err != nil {
+				t.ctx.nsqd.logf(LOG_ERROR, "TOPIC(%s): failed to delete retention log - %s", t.name, err)
+			}
+		}
+
 		// empty the queue (deletes the backend files, too)
 		t.Empty()
 		return t.backend.Delete()
@@ -390,15 +1104,25 @@ func (t *Topic) exit(deleted bool) error {
 		}
 	}
 
+	if t.retention != nil {
+		err := t.retention.close()
+		if err != nil {
+			t.ctx.nsqd.logf(LOG_ERROR, "TOPIC(%s): failed to close retention log - %s", t.name, err)
+		}
+	}
+
 	// write anything leftover to disk
 	t.flush()
 	return t.backend.Close()
 }
 
 func (t *Topic) Empty() error {
+	t.RLock()
+	memoryMsgChan := t.memoryMsgChan
+	t.RUnlock()
 	for {
 		select {
-		case <-t.memoryMsgChan:
+		case <-memoryMsgChan:
 		default:
 			goto finish
 		}
@@ -411,16 +1135,20 @@ finish:
 func (t *Topic) flush() error {
 	var msgBuf bytes.Buffer
 
-	if len(t.memoryMsgChan) > 0 {
+	t.RLock()
+	memoryMsgChan := t.memoryMsgChan
+	t.RUnlock()
+
+	if len(memoryMsgChan) > 0 {
 		t.ctx.nsqd.logf(LOG_INFO,
 			"TOPIC(%s): flushing %d memory messages to backend",
-			t.name, len(t.memoryMsgChan))
+			t.name, len(memoryMsgChan))
 	}
 
 	for {
 		select {
-		case msg := <-t.memoryMsgChan:
-			err := writeMessageToBackend(&msgBuf, msg, t.backend)
+		case msg := <-memoryMsgChan:
+			err := writeMessageToBackend(&msgBuf, msg, t.backend, t.ctx.nsqd.getOpts().BackendMsgEnvelope)
 			if err != nil {
 				t.ctx.nsqd.logf(LOG_ERROR,
 					"ERROR: failed to write message to backend - %s", err)
@@ -485,10 +1213,10 @@ func (t *Topic) IsPaused() bool {
 
 func (t *Topic) GenerateID() MessageID {
 retry:
-	id, err := t.idFactory.NewGUID()
+	id, err := t.idFactory.NewID()
 	if err != nil {
 		time.Sleep(time.Millisecond)
 		goto retry
 	}
-	return id.Hex()
+	return id
 }
@@ -8,6 +8,9 @@ import (
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -195,6 +198,304 @@ func TestPause(t *testing.T) {
 	test.Equal(t, int64(1), channel.Depth())
 }
 
+func TestTopicWarmup(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.TopicWarmup = 100 * time.Millisecond
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_topic_warmup" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel1 := topic.GetChannel("ch1")
+	err := topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+	test.Nil(t, err)
+
+	// a channel created during the warm-up gets the messages published before
+	time.Sleep(15 * time.Millisecond)
+	test.Equal(t, int64(1), topic.Depth())
+	test.Equal(t, int64(0), channel1.Depth())
+	channel2 := topic.GetChannel("ch2")
+
+	time.Sleep(opts.TopicWarmup)
+	test.Equal(t, int64(0), topic.Depth())
+	test.Equal(t, int64(1), channel1.Depth())
+	test.Equal(t, int64(1), channel2.Depth())
+
+	// ephemeral topics aren't held
+	topic = nsqd.GetTopic(topicName + "#ephemeral")
+	channel := topic.GetChannel("ch")
+	err = topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+	test.Nil(t, err)
+	time.Sleep(15 * time.Millisecond)
+	test.Equal(t, int64(1), channel.Depth())
+}
+
+func TestTopicCompression(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	opts.MaxBytesPerFile = 4096
+	opts.DiskCompression = "zstd"
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_topic_compression" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	body := func(i int) []byte {
+		return []byte(fmt.Sprintf("%05d %s", i, strings.Repeat("text message ", 40)))
+	}
+	for i := 0; i < 100; i++ {
+		err := topic.PutMessage(NewMessage(topic.GenerateID(), body(i)))
+		test.Nil(t, err)
+	}
+
+	// the full files of the channel's backlog are compressed
+	rawBytes := int64(100 * len(body(0)))
+	for i := 0; i < 100 && backendDiskBytes(channel.backend) > rawBytes/2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if diskBytes := backendDiskBytes(channel.backend); diskBytes > rawBytes/2 {
+		t.Fatalf("channel uses %d bytes on disk for %d bytes of messages", diskBytes, rawBytes)
+	}
+
+	for i := 0; i < 100; i++ {
+		msg, err := decodeMessage(<-channel.readBackend())
+		test.Nil(t, err)
+		test.Equal(t, body(i), msg.Body)
+	}
+
+	test.NotNil(t, topic.SetCompression("lz4"))
+}
+
+func TestTopicMemQueueSize(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 10
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_mem_queue_size")
+	for i := 0; i < 5; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		test.Nil(t, topic.PutMessage(msg))
+	}
+	test.Equal(t, 5, len(topic.memoryMsgChan))
+
+	// shrinking moves messages that no longer fit in memory to the backend
+	test.Nil(t, topic.SetMemQueueSize(2))
+	size, isSet := topic.MemQueueSize()
+	test.Equal(t, int64(2), size)
+	test.Equal(t, true, isSet)
+	test.Equal(t, 2, len(topic.memoryMsgChan))
+	test.Equal(t, int64(3), topic.backend.Depth())
+	test.Equal(t, int64(5), topic.Depth())
+
+	channel := topic.GetChannel("ch")
+	test.Equal(t, 2, cap(channel.memoryMsgChan))
+
+	test.Nil(t, topic.SetMemQueueSize(0))
+	test.Equal(t, true, topic.memoryMsgChan == nil)
+
+	test.Nil(t, topic.SetMemQueueSize(-1))
+	size, isSet = topic.MemQueueSize()
+	test.Equal(t, int64(10), size)
+	test.Equal(t, false, isSet)
+}
+
+func TestTopicDurable(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_durable")
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	test.Nil(t, topic.PutMessage(msg))
+	test.Equal(t, 1, len(topic.memoryMsgChan))
+
+	// enabling moves messages already in memory to disk
+	test.Nil(t, topic.SetDurable(true))
+	test.Equal(t, true, topic.IsDurable())
+	test.Equal(t, 0, len(topic.memoryMsgChan))
+	test.Equal(t, int64(1), topic.backend.Depth())
+
+	msg = NewMessage(topic.GenerateID(), []byte("test"))
+	test.Nil(t, topic.PutMessage(msg))
+	test.Equal(t, 0, len(topic.memoryMsgChan))
+	test.Equal(t, int64(2), topic.backend.Depth())
+
+	channel := topic.GetChannel("ch")
+	test.Equal(t, int32(1), atomic.LoadInt32(&channel.durable))
+
+	ephemeralTopic := nsqd.GetTopic("test_durable#ephemeral")
+	test.NotNil(t, ephemeralTopic.SetDurable(true))
+}
+
+func TestTopicDiskQuota(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	opts.MaxBytesPerFile = 100
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	// each message takes 34 bytes on disk, 3 per file
+	topic := nsqd.GetTopic("test_disk_quota")
+	test.Nil(t, topic.SetDiskQuota(204, DiskQuotaBackpressure))
+	for i := 0; i < 6; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		test.Nil(t, topic.PutMessage(msg))
+	}
+	test.Equal(t, int64(204), topic.DiskBytes())
+
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	test.Equal(t, ErrDiskQuotaExceeded, topic.PutMessage(msg))
+	test.Equal(t, int64(6), topic.Depth())
+
+	// the oldest file is dropped to make room
+	test.Nil(t, topic.SetDiskQuota(204, DiskQuotaTruncate))
+	test.Nil(t, topic.PutMessage(msg))
+	test.Equal(t, int64(4), topic.Depth())
+	test.Equal(t, int64(136), topic.DiskBytes())
+
+	test.NotNil(t, topic.SetDiskQuota(200, "abc"))
+}
+
+func TestTopicDurableGroupCommit(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.SyncGroupCommit = 5 * time.Millisecond
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	var topics []*Topic
+	for i := 0; i < 3; i++ {
+		topic := nsqd.GetTopic("test_group_commit" + strconv.Itoa(i))
+		test.Nil(t, topic.SetDurable(true))
+		topics = append(topics, topic)
+	}
+
+	var wg sync.WaitGroup
+	for _, topic := range topics {
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(topic *Topic) {
+				msg := NewMessage(topic.GenerateID(), []byte("test"))
+				test.Nil(t, topic.PutMessage(msg))
+				wg.Done()
+			}(topic)
+		}
+	}
+	wg.Wait()
+
+	for _, topic := range topics {
+		test.Equal(t, int64(10), topic.backend.Depth())
+	}
+}
+
+func TestTopicSeekChannel(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.Retention = time.Hour
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_seek_channel")
+	channel := topic.GetChannel("ch")
+
+	// old and new interleaved, some consumed before the seek
+	now := time.Now()
+	for i, age := range []time.Duration{3, 1, 3, 3, 1, 1} {
+		msg := NewMessage(topic.GenerateID(), []byte(strconv.Itoa(i)))
+		msg.Timestamp = now.Add(-age * time.Hour).UnixNano()
+		test.Nil(t, topic.PutMessage(msg))
+	}
+	for i := 0; i < 100 && channel.Depth() < 6; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, int64(6), channel.Depth())
+	<-channel.memoryMsgChan
+
+	discarded, err := topic.SeekChannel(channel, now.Add(-2*time.Hour))
+	test.Nil(t, err)
+	test.Equal(t, int64(5), discarded)
+
+	// the retained messages published since are requeued in order
+	var bodies []string
+	for len(bodies) < 3 {
+		select {
+		case msg := <-channel.memoryMsgChan:
+			bodies = append(bodies, string(msg.Body))
+		case <-time.After(time.Second):
+			t.Fatalf("only read %v", bodies)
+		}
+	}
+	test.Equal(t, []string{"1", "4", "5"}, bodies)
+}
+
+func TestTopicSeekChannelRetentionDisabled(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_seek_channel_disabled")
+	channel := topic.GetChannel("ch")
+	_, err := topic.SeekChannel(channel, time.Now())
+	test.Equal(t, ErrRetentionDisabled, err)
+}
+
+func TestTopicChannelChurn(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 2000
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_channel_churn")
+	channel := topic.GetChannel("keep")
+
+	// channels come and go while publishing without losing messages
+	// for the others
+	exitChan := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-exitChan:
+				return
+			default:
+			}
+			name := "churn" + strconv.Itoa(i%4)
+			topic.GetChannel(name)
+			topic.DeleteExistingChannel(name)
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		test.Nil(t, topic.PutMessage(msg))
+	}
+	close(exitChan)
+	wg.Wait()
+
+	for channel.Depth() != 1000 {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func BenchmarkTopicPut(b *testing.B) {
 	b.StopTimer()
 	topicName := "bench_topic_put" + strconv.Itoa(b.N)
@@ -239,3 +540,48 @@ func BenchmarkTopicToChannelPut(b *testing.B) {
 		runtime.Gosched()
 	}
 }
+
+func BenchmarkTopicToChannelPutChannelChurn(b *testing.B) {
+	b.StopTimer()
+	topicName := "bench_topic_channel_churn" + strconv.Itoa(b.N)
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(b)
+	opts.MemQueueSize = int64(b.N)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("bench")
+
+	exitChan := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		for i := 0; ; i++ {
+			select {
+			case <-exitChan:
+				return
+			case <-ticker.C:
+			}
+			name := "churn" + strconv.Itoa(i%4)
+			topic.GetChannel(name)
+			topic.DeleteExistingChannel(name)
+		}
+	}()
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("aaaaaaaaaaaaaaaaaaaaaaaaaaa"))
+		topic.PutMessage(msg)
+	}
+	for channel.Depth() != int64(b.N) {
+		runtime.Gosched()
+	}
+
+	b.StopTimer()
+	close(exitChan)
+	wg.Wait()
+}
@@ -0,0 +1,126 @@
+package nsqlookupd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+// declarations are the channels declared with /channel/declare, which nsqd
+// create along with their topic (nsqd asks nsqlookupd for the channels of a
+// topic when it creates one) so that consumers connecting later don't miss the
+// messages published before. Unlike channels registered by nsqd (or added with
+// /channel/create) they don't need the topic to exist, they're kept when it is
+// deleted, and they persist across restarts in --declarations-file (if set).
+type declarations struct {
+	sync.RWMutex
+	fileName string
+	channels map[string][]string // sorted channel names by topic name
+}
+
+func newDeclarations(fileName string) (*declarations, error) {
+	d := &declarations{
+		fileName: fileName,
+		channels: make(map[string][]string),
+	}
+	if fileName == "" {
+		return d, nil
+	}
+
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &d.channels)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s - %s", fileName, err)
+	}
+	for _, channels := range d.channels {
+		sort.Strings(channels)
+	}
+	return d, nil
+}
+
+// Channels returns the channels declared for a topic, sorted
+func (d *declarations) Channels(topicName string) []string {
+	d.RLock()
+	defer d.RUnlock()
+	return append([]string{}, d.channels[topicName]...)
+}
+
+// All returns the channels declared for each topic
+func (d *declarations) All() map[string][]string {
+	d.RLock()
+	defer d.RUnlock()
+	all := make(map[string][]string, len(d.channels))
+	for topicName, channels := range d.channels {
+		all[topicName] = append([]string{}, channels...)
+	}
+	return all
+}
+
+// Add declares a channel, returning whether it wasn't already
+func (d *declarations) Add(topicName string, channelName string) (bool, error) {
+	d.Lock()
+	defer d.Unlock()
+	channels := d.channels[topicName]
+	i := sort.SearchStrings(channels, channelName)
+	if i < len(channels) && channels[i] == channelName {
+		return false, nil
+	}
+	channels = append(channels, "")
+	copy(channels[i+1:], channels[i:])
+	channels[i] = channelName
+	d.channels[topicName] = channels
+	return true, d.persist()
+}
+
+// Remove undeclares a channel, returning whether it was declared
+func (d *declarations) Remove(topicName string, channelName string) (bool, error) {
+	d.Lock()
+	defer d.Unlock()
+	channels := d.channels[topicName]
+	i := sort.SearchStrings(channels, channelName)
+	if i == len(channels) || channels[i] != channelName {
+		return false, nil
+	}
+	channels = append(channels[:i], channels[i+1:]...)
+	if len(channels) == 0 {
+		delete(d.channels, topicName)
+	} else {
+		d.channels[topicName] = channels
+	}
+	return true, d.persist()
+}
+
+// persist atomically replaces --declarations-file, it expects the caller to
+// hold d's lock
+func (d *declarations) persist() error {
+	if d.fileName == "" {
+		return nil
+	}
+	data, err := json.Marshal(d.channels)
+	if err != nil {
+		return err
+	}
+	tmpFileName := d.fileName + ".tmp"
+	f, err := os.OpenFile(tmpFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, d.fileName)
+}
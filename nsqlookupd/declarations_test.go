@@ -0,0 +1,41 @@
+package nsqlookupd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestDeclarationsFile(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(dataPath)
+	fileName := path.Join(dataPath, "declarations.json")
+
+	d, err := newDeclarations(fileName)
+	test.Nil(t, err)
+	for _, channelName := range []string{"b", "a", "c"} {
+		added, err := d.Add("topic", channelName)
+		test.Nil(t, err)
+		test.Equal(t, true, added)
+	}
+	added, err := d.Add("topic", "a")
+	test.Nil(t, err)
+	test.Equal(t, false, added)
+	removed, err := d.Remove("topic", "b")
+	test.Nil(t, err)
+	test.Equal(t, true, removed)
+
+	d, err = newDeclarations(fileName)
+	test.Nil(t, err)
+	test.Equal(t, map[string][]string{"topic": {"a", "c"}}, d.All())
+
+	test.Nil(t, ioutil.WriteFile(fileName, []byte("{"), 0600))
+	_, err = newDeclarations(fileName)
+	test.NotNil(t, err)
+}
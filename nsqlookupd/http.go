@@ -1,9 +1,11 @@
 package nsqlookupd
 
 import (
-	"fmt"
+	"net"
 	"net/http"
 	"net/http/pprof"
+	"strconv"
+	"strings"
 	"sync/atomic"
 
 	"github.com/julienschmidt/httprouter"
@@ -20,43 +22,63 @@ type httpServer struct {
 func newHTTPServer(ctx *Context) *httpServer {
 	log := http_api.Log(ctx.nsqlookupd.logf)
 
-	router := httprouter.New()
+	router := http_api.NewRouter()
 	router.HandleMethodNotAllowed = true
 	router.PanicHandler = http_api.LogPanicHandler(ctx.nsqlookupd.logf)
 	router.NotFound = http_api.LogNotFoundHandler(ctx.nsqlookupd.logf)
 	router.MethodNotAllowed = http_api.LogMethodNotAllowedHandler(ctx.nsqlookupd.logf)
 	s := &httpServer{
 		ctx:    ctx,
-		router: router,
+		router: http_api.CORS(ctx.nsqlookupd.opts.HTTPAllowOrigins, router),
 	}
 
-	router.Handle("GET", "/ping", http_api.Decorate(s.pingHandler, log, http_api.PlainText))
-	router.Handle("GET", "/info", http_api.Decorate(s.doInfo, log, http_api.V1))
+	global := http_api.NewRateLimiter(ctx.nsqlookupd.opts.HTTPRateLimit)
+	queryLimit := http_api.RateLimit(http_api.NewRateLimiter(ctx.nsqlookupd.opts.HTTPRateLimitQuery), global)
+	adminLimiter := http_api.NewRateLimiter(ctx.nsqlookupd.opts.HTTPRateLimitAdmin)
+	adminLimit := http_api.RateLimit(adminLimiter, global)
+
+	topicParam := http_api.Query("topic", "string", true, "topic name")
+	channelParam := http_api.Query("channel", "string", true, "channel name")
+
+	// not rate limited, so health checks keep passing while clients are throttled
+	router.Route("GET", "/ping", "health check", http_api.Decorate(s.pingHandler, log, http_api.PlainText))
+	router.Route("GET", "/info", "version information", http_api.Decorate(s.doInfo, queryLimit, log, http_api.V1))
+	router.Route("GET", "/stats", "counts of the registration database", http_api.Decorate(s.doStats, queryLimit, log, http_api.V1))
+	router.Route("GET", "/api/spec", "OpenAPI specification", http_api.Decorate(router.SpecHandler("nsqlookupd", version.Binary), queryLimit, log, http_api.V1))
 
 	// v1 negotiate
-	router.Handle("GET", "/debug", http_api.Decorate(s.doDebug, log, http_api.V1))
-	router.Handle("GET", "/lookup", http_api.Decorate(s.doLookup, log, http_api.V1))
-	router.Handle("GET", "/topics", http_api.Decorate(s.doTopics, log, http_api.V1))
-	router.Handle("GET", "/channels", http_api.Decorate(s.doChannels, log, http_api.V1))
-	router.Handle("GET", "/nodes", http_api.Decorate(s.doNodes, log, http_api.V1))
+	router.Route("GET", "/debug", "dump of the registration database", http_api.Decorate(s.doDebug, queryLimit, log, http_api.V1, http_api.Compress))
+	router.Route("GET", "/lookup", "producers and channels of a topic", http_api.Decorate(s.doLookup, queryLimit, log, http_api.V1, http_api.Compress), topicParam,
+		http_api.Query("order", "string", false, "load: the least loaded producers first (by depth, then clients, then publish rate)"))
+	router.Route("GET", "/topics", "all known topics", http_api.Decorate(s.doTopics, queryLimit, log, http_api.V1, http_api.Compress),
+		http_api.Query("namespace", "string", false, "filter to the topics of a namespace"))
+	router.Route("GET", "/namespaces", "all known namespaces and their topics", http_api.Decorate(s.doNamespaces, queryLimit, log, http_api.V1, http_api.Compress))
+	router.Route("GET", "/channels", "all known channels of a topic", http_api.Decorate(s.doChannels, queryLimit, log, http_api.V1, http_api.Compress), topicParam)
+	router.Route("GET", "/nodes", "all known nsqd", http_api.Decorate(s.doNodes, queryLimit, log, http_api.V1, http_api.Compress))
 
 	// only v1
-	router.Handle("POST", "/topic/create", http_api.Decorate(s.doCreateTopic, log, http_api.V1))
-	router.Handle("POST", "/topic/delete", http_api.Decorate(s.doDeleteTopic, log, http_api.V1))
-	router.Handle("POST", "/channel/create", http_api.Decorate(s.doCreateChannel, log, http_api.V1))
-	router.Handle("POST", "/channel/delete", http_api.Decorate(s.doDeleteChannel, log, http_api.V1))
-	router.Handle("POST", "/topic/tombstone", http_api.Decorate(s.doTombstoneTopicProducer, log, http_api.V1))
+	router.Route("POST", "/topic/create", "add a topic", http_api.Decorate(s.doCreateTopic, adminLimit, log, http_api.V1), topicParam)
+	router.Route("POST", "/topic/delete", "delete a topic", http_api.Decorate(s.doDeleteTopic, adminLimit, log, http_api.V1), topicParam)
+	router.Route("POST", "/channel/create", "add a channel", http_api.Decorate(s.doCreateChannel, adminLimit, log, http_api.V1), topicParam, channelParam)
+	router.Route("POST", "/channel/delete", "delete a channel", http_api.Decorate(s.doDeleteChannel, adminLimit, log, http_api.V1), topicParam, channelParam)
+	router.Route("GET", "/declarations", "channels declared for each topic", http_api.Decorate(s.doDeclarations, queryLimit, log, http_api.V1))
+	router.Route("POST", "/channel/declare", "declare a channel, which every nsqd creates along with its topic (that need not exist yet)", http_api.Decorate(s.doDeclareChannel, adminLimit, log, http_api.V1), topicParam, channelParam)
+	router.Route("POST", "/channel/undeclare", "undeclare a channel (existing channels are kept)", http_api.Decorate(s.doDeclareChannel, adminLimit, log, http_api.V1), topicParam, channelParam)
+	router.Route("POST", "/topic/tombstone", "tombstone a producer of a topic", http_api.Decorate(s.doTombstoneTopicProducer, adminLimit, log, http_api.V1),
+		topicParam,
+		http_api.Query("node", "string", true, "<broadcast_address>:<http_port> of the producer"))
 
 	// debug
-	router.HandlerFunc("GET", "/debug/pprof", pprof.Index)
-	router.HandlerFunc("GET", "/debug/pprof/cmdline", pprof.Cmdline)
-	router.HandlerFunc("GET", "/debug/pprof/symbol", pprof.Symbol)
-	router.HandlerFunc("POST", "/debug/pprof/symbol", pprof.Symbol)
-	router.HandlerFunc("GET", "/debug/pprof/profile", pprof.Profile)
-	router.Handler("GET", "/debug/pprof/heap", pprof.Handler("heap"))
-	router.Handler("GET", "/debug/pprof/goroutine", pprof.Handler("goroutine"))
-	router.Handler("GET", "/debug/pprof/block", pprof.Handler("block"))
-	router.Handler("GET", "/debug/pprof/threadcreate", pprof.Handler("threadcreate"))
+	router.RouteHandler("GET", "/debug/pprof", "pprof index", http_api.RateLimitHandler(http.HandlerFunc(pprof.Index), adminLimiter, global))
+	router.RouteHandler("GET", "/debug/pprof/cmdline", "pprof command line", http_api.RateLimitHandler(http.HandlerFunc(pprof.Cmdline), adminLimiter, global))
+	router.RouteHandler("GET", "/debug/pprof/symbol", "pprof symbol lookup", http_api.RateLimitHandler(http.HandlerFunc(pprof.Symbol), adminLimiter, global))
+	router.RouteHandler("POST", "/debug/pprof/symbol", "pprof symbol lookup", http_api.RateLimitHandler(http.HandlerFunc(pprof.Symbol), adminLimiter, global))
+	router.RouteHandler("GET", "/debug/pprof/profile", "pprof CPU profile", http_api.RateLimitHandler(http.HandlerFunc(pprof.Profile), adminLimiter, global),
+		http_api.Query("seconds", "integer", false, "profile duration"))
+	router.RouteHandler("GET", "/debug/pprof/heap", "pprof heap profile", http_api.RateLimitHandler(pprof.Handler("heap"), adminLimiter, global))
+	router.RouteHandler("GET", "/debug/pprof/goroutine", "pprof goroutine profile", http_api.RateLimitHandler(pprof.Handler("goroutine"), adminLimiter, global))
+	router.RouteHandler("GET", "/debug/pprof/block", "pprof block profile", http_api.RateLimitHandler(pprof.Handler("block"), adminLimiter, global))
+	router.RouteHandler("GET", "/debug/pprof/threadcreate", "pprof thread creation profile", http_api.RateLimitHandler(pprof.Handler("threadcreate"), adminLimiter, global))
 
 	return s
 }
@@ -77,13 +99,44 @@ func (s *httpServer) doInfo(w http.ResponseWriter, req *http.Request, ps httprou
 	}, nil
 }
 
+func (s *httpServer) doStats(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	return s.ctx.nsqlookupd.DB.Stats(), nil
+}
+
 func (s *httpServer) doTopics(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
 	topics := s.ctx.nsqlookupd.DB.FindRegistrations("topic", "*", "").Keys()
+	if namespace, _ := reqParams.Get("namespace"); namespace != "" {
+		namespaceTopics := make([]string, 0)
+		for _, topicName := range topics {
+			if ns, _ := protocol.SplitNamespace(topicName); ns == namespace {
+				namespaceTopics = append(namespaceTopics, topicName)
+			}
+		}
+		topics = namespaceTopics
+	}
 	return map[string]interface{}{
 		"topics": topics,
 	}, nil
 }
 
+func (s *httpServer) doNamespaces(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	namespaces := make(map[string][]string)
+	for _, topicName := range s.ctx.nsqlookupd.DB.FindRegistrations("topic", "*", "").Keys() {
+		namespace, _ := protocol.SplitNamespace(topicName)
+		if namespace != "" {
+			namespaces[namespace] = append(namespaces[namespace], topicName)
+		}
+	}
+	return map[string]interface{}{
+		"namespaces": namespaces,
+	}, nil
+}
+
 func (s *httpServer) doChannels(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	reqParams, err := http_api.NewReqParams(req)
 	if err != nil {
@@ -95,12 +148,28 @@ func (s *httpServer) doChannels(w http.ResponseWriter, req *http.Request, ps htt
 		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
 	}
 
-	channels := s.ctx.nsqlookupd.DB.FindRegistrations("channel", topicName, "*").SubKeys()
+	channels := s.topicChannels(topicName)
 	return map[string]interface{}{
 		"channels": channels,
 	}, nil
 }
 
+// topicChannels returns the channels of a topic registered by nsqd (or added
+// with /channel/create) and those declared
+func (s *httpServer) topicChannels(topicName string) []string {
+	channels := s.ctx.nsqlookupd.DB.FindRegistrations("channel", topicName, "*").SubKeys()
+	registered := make(map[string]bool, len(channels))
+	for _, channelName := range channels {
+		registered[channelName] = true
+	}
+	for _, channelName := range s.ctx.nsqlookupd.declarations.Channels(topicName) {
+		if !registered[channelName] {
+			channels = append(channels, channelName)
+		}
+	}
+	return channels
+}
+
 func (s *httpServer) doLookup(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	reqParams, err := http_api.NewReqParams(req)
 	if err != nil {
@@ -112,18 +181,35 @@ func (s *httpServer) doLookup(w http.ResponseWriter, req *http.Request, ps httpr
 		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
 	}
 
+	order, _ := reqParams.Get("order")
+	if order != "" && order != "load" {
+		return nil, http_api.Err{400, "INVALID_ARG_ORDER"}
+	}
+
 	registration := s.ctx.nsqlookupd.DB.FindRegistrations("topic", topicName, "")
 	if len(registration) == 0 {
 		return nil, http_api.Err{404, "TOPIC_NOT_FOUND"}
 	}
 
-	channels := s.ctx.nsqlookupd.DB.FindRegistrations("channel", topicName, "*").SubKeys()
+	channels := s.topicChannels(topicName)
 	producers := s.ctx.nsqlookupd.DB.FindProducers("topic", topicName, "")
 	producers = producers.FilterByActive(s.ctx.nsqlookupd.opts.InactiveProducerTimeout,
 		s.ctx.nsqlookupd.opts.TombstoneLifetime)
+	if order == "load" {
+		producers.SortByLoad()
+	}
+
+	type lookupProducer struct {
+		*PeerInfo
+		Load *PeerLoad `json:"load,omitempty"`
+	}
+	lookupProducers := make([]lookupProducer, len(producers))
+	for i, p := range producers {
+		lookupProducers[i] = lookupProducer{p.peerInfo, p.peerInfo.Load()}
+	}
 	return map[string]interface{}{
 		"channels":  channels,
-		"producers": producers.PeerInfo(),
+		"producers": lookupProducers,
 	}, nil
 }
 
@@ -194,8 +280,8 @@ func (s *httpServer) doTombstoneTopicProducer(w http.ResponseWriter, req *http.R
 	s.ctx.nsqlookupd.logf(LOG_INFO, "DB: setting tombstone for producer@%s of topic(%s)", node, topicName)
 	producers := s.ctx.nsqlookupd.DB.FindProducers("topic", topicName, "")
 	for _, p := range producers {
-		thisNode := fmt.Sprintf("%s:%d", p.peerInfo.BroadcastAddress, p.peerInfo.HTTPPort)
-		if thisNode == node {
+		thisNode := net.JoinHostPort(p.peerInfo.BroadcastAddress, strconv.Itoa(p.peerInfo.HTTPPort))
+		if thisNode == node || p.HTTPAddress() == node {
 			p.Tombstone()
 		}
 	}
@@ -249,6 +335,52 @@ func (s *httpServer) doDeleteChannel(w http.ResponseWriter, req *http.Request, p
 	return nil, nil
 }
 
+func (s *httpServer) doDeclarations(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	return map[string]interface{}{
+		"declarations": s.ctx.nsqlookupd.declarations.All(),
+	}, nil
+}
+
+func (s *httpServer) doDeclareChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	topicName, channelName, err := http_api.GetTopicChannelArgs(reqParams)
+	if err != nil {
+		return nil, http_api.Err{400, err.Error()}
+	}
+
+	declarations := s.ctx.nsqlookupd.declarations
+	if strings.Contains(req.URL.Path, "undeclare") {
+		removed, err := declarations.Remove(topicName, channelName)
+		if !removed {
+			return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+		}
+		if err != nil {
+			s.ctx.nsqlookupd.logf(LOG_ERROR, "failed to persist declarations - %s", err)
+			return nil, http_api.Err{500, "INTERNAL_ERROR"}
+		}
+		s.ctx.nsqlookupd.logf(LOG_INFO, "DB: undeclared channel(%s) in topic(%s)", channelName, topicName)
+		return nil, nil
+	}
+
+	// nsqd don't create #ephemeral channels without a consumer
+	if strings.HasSuffix(channelName, "#ephemeral") {
+		return nil, http_api.Err{400, "INVALID_ARG_CHANNEL"}
+	}
+	added, err := declarations.Add(topicName, channelName)
+	if err != nil {
+		s.ctx.nsqlookupd.logf(LOG_ERROR, "failed to persist declarations - %s", err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	if added {
+		s.ctx.nsqlookupd.logf(LOG_INFO, "DB: declared channel(%s) in topic(%s)", channelName, topicName)
+	}
+	return nil, nil
+}
+
 type node struct {
 	RemoteAddress    string   `json:"remote_address"`
 	Hostname         string   `json:"hostname"`
@@ -258,6 +390,10 @@ type node struct {
 	Version          string   `json:"version"`
 	Tombstones       []bool   `json:"tombstones"`
 	Topics           []string `json:"topics"`
+
+	BroadcastTCPAddress   string `json:"broadcast_tcp_address,omitempty"`
+	BroadcastHTTPAddress  string `json:"broadcast_http_address,omitempty"`
+	BroadcastHTTPSAddress string `json:"broadcast_https_address,omitempty"`
 }
 
 func (s *httpServer) doNodes(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
@@ -295,6 +431,10 @@ func (s *httpServer) doNodes(w http.ResponseWriter, req *http.Request, ps httpro
 			Version:          p.peerInfo.Version,
 			Tombstones:       tombstones,
 			Topics:           topics,
+
+			BroadcastTCPAddress:   p.peerInfo.BroadcastTCPAddress,
+			BroadcastHTTPAddress:  p.peerInfo.BroadcastHTTPAddress,
+			BroadcastHTTPSAddress: p.peerInfo.BroadcastHTTPSAddress,
 		}
 	}
 
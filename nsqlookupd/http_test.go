@@ -24,7 +24,9 @@ type ChannelsDoc struct {
 }
 
 type ErrMessage struct {
+	Code    string `json:"code"`
 	Message string `json:"message"`
+	Detail  string `json:"detail"`
 }
 
 func bootstrapNSQCluster(t *testing.T) (string, []*nsqd.NSQD, *NSQLookupd) {
@@ -147,7 +149,7 @@ func TestCreateTopic(t *testing.T) {
 	t.Logf("%s", body)
 	err = json.Unmarshal(body, &em)
 	test.Nil(t, err)
-	test.Equal(t, "MISSING_ARG_TOPIC", em.Message)
+	test.Equal(t, "MISSING_ARG_TOPIC", em.Code)
 
 	topicName := "sampletopicA" + strconv.Itoa(int(time.Now().Unix())) + "$"
 	url = fmt.Sprintf("http://%s/topic/create?topic=%s", nsqlookupd1.RealHTTPAddr(), topicName)
@@ -163,7 +165,7 @@ func TestCreateTopic(t *testing.T) {
 	t.Logf("%s", body)
 	err = json.Unmarshal(body, &em)
 	test.Nil(t, err)
-	test.Equal(t, "INVALID_ARG_TOPIC", em.Message)
+	test.Equal(t, "INVALID_ARG_TOPIC", em.Code)
 
 	topicName = "sampletopicA" + strconv.Itoa(int(time.Now().Unix()))
 	url = fmt.Sprintf("http://%s/topic/create?topic=%s", nsqlookupd1.RealHTTPAddr(), topicName)
@@ -179,6 +181,47 @@ func TestCreateTopic(t *testing.T) {
 	test.Equal(t, []byte(""), body)
 }
 
+func TestNamespaces(t *testing.T) {
+	dataPath, nsqds, nsqlookupd1 := bootstrapNSQCluster(t)
+	defer os.RemoveAll(dataPath)
+	defer nsqds[0].Exit()
+	defer nsqlookupd1.Exit()
+
+	makeTopic(nsqlookupd1, "tenantA/orders")
+	makeTopic(nsqlookupd1, "tenantA/payments")
+	makeTopic(nsqlookupd1, "tenantB/orders")
+	makeTopic(nsqlookupd1, "orders")
+
+	client := http.Client{}
+	url := fmt.Sprintf("http://%s/topics?namespace=tenantB", nsqlookupd1.RealHTTPAddr())
+	resp, err := client.Get(url)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	td := struct {
+		Topics []string `json:"topics"`
+	}{}
+	err = json.Unmarshal(body, &td)
+	test.Nil(t, err)
+	test.Equal(t, []string{"tenantB/orders"}, td.Topics)
+
+	url = fmt.Sprintf("http://%s/namespaces", nsqlookupd1.RealHTTPAddr())
+	resp, err = client.Get(url)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	nd := struct {
+		Namespaces map[string][]string `json:"namespaces"`
+	}{}
+	err = json.Unmarshal(body, &nd)
+	test.Nil(t, err)
+	test.Equal(t, 2, len(nd.Namespaces))
+	test.Equal(t, 2, len(nd.Namespaces["tenantA"]))
+	test.Equal(t, []string{"tenantB/orders"}, nd.Namespaces["tenantB"])
+}
+
 func TestDeleteTopic(t *testing.T) {
 	dataPath, nsqds, nsqlookupd1 := bootstrapNSQCluster(t)
 	defer os.RemoveAll(dataPath)
@@ -200,7 +243,7 @@ func TestDeleteTopic(t *testing.T) {
 	t.Logf("%s", body)
 	err = json.Unmarshal(body, &em)
 	test.Nil(t, err)
-	test.Equal(t, "MISSING_ARG_TOPIC", em.Message)
+	test.Equal(t, "MISSING_ARG_TOPIC", em.Code)
 
 	topicName := "sampletopicA" + strconv.Itoa(int(time.Now().Unix()))
 	makeTopic(nsqlookupd1, topicName)
@@ -256,7 +299,7 @@ func TestGetChannels(t *testing.T) {
 	t.Logf("%s", body)
 	err = json.Unmarshal(body, &em)
 	test.Nil(t, err)
-	test.Equal(t, "MISSING_ARG_TOPIC", em.Message)
+	test.Equal(t, "MISSING_ARG_TOPIC", em.Code)
 
 	ch := ChannelsDoc{}
 	topicName := "sampletopicA" + strconv.Itoa(int(time.Now().Unix()))
@@ -319,7 +362,7 @@ func TestCreateChannel(t *testing.T) {
 	t.Logf("%s", body)
 	err = json.Unmarshal(body, &em)
 	test.Nil(t, err)
-	test.Equal(t, "MISSING_ARG_TOPIC", em.Message)
+	test.Equal(t, "MISSING_ARG_TOPIC", em.Code)
 
 	topicName := "sampletopicB" + strconv.Itoa(int(time.Now().Unix())) + "$"
 	url = fmt.Sprintf("http://%s/channel/create?topic=%s", nsqlookupd1.RealHTTPAddr(), topicName)
@@ -335,7 +378,7 @@ func TestCreateChannel(t *testing.T) {
 	t.Logf("%s", body)
 	err = json.Unmarshal(body, &em)
 	test.Nil(t, err)
-	test.Equal(t, "INVALID_ARG_TOPIC", em.Message)
+	test.Equal(t, "INVALID_ARG_TOPIC", em.Code)
 
 	topicName = "sampletopicB" + strconv.Itoa(int(time.Now().Unix()))
 	url = fmt.Sprintf("http://%s/channel/create?topic=%s", nsqlookupd1.RealHTTPAddr(), topicName)
@@ -351,7 +394,7 @@ func TestCreateChannel(t *testing.T) {
 	t.Logf("%s", body)
 	err = json.Unmarshal(body, &em)
 	test.Nil(t, err)
-	test.Equal(t, "MISSING_ARG_CHANNEL", em.Message)
+	test.Equal(t, "MISSING_ARG_CHANNEL", em.Code)
 
 	channelName := "foobar" + strconv.Itoa(int(time.Now().Unix())) + "$"
 	url = fmt.Sprintf("http://%s/channel/create?topic=%s&channel=%s", nsqlookupd1.RealHTTPAddr(), topicName, channelName)
@@ -367,7 +410,7 @@ func TestCreateChannel(t *testing.T) {
 	t.Logf("%s", body)
 	err = json.Unmarshal(body, &em)
 	test.Nil(t, err)
-	test.Equal(t, "INVALID_ARG_CHANNEL", em.Message)
+	test.Equal(t, "INVALID_ARG_CHANNEL", em.Code)
 
 	channelName = "foobar" + strconv.Itoa(int(time.Now().Unix()))
 	url = fmt.Sprintf("http://%s/channel/create?topic=%s&channel=%s", nsqlookupd1.RealHTTPAddr(), topicName, channelName)
@@ -404,7 +447,7 @@ func TestDeleteChannel(t *testing.T) {
 	t.Logf("%s", body)
 	err = json.Unmarshal(body, &em)
 	test.Nil(t, err)
-	test.Equal(t, "MISSING_ARG_TOPIC", em.Message)
+	test.Equal(t, "MISSING_ARG_TOPIC", em.Code)
 
 	topicName := "sampletopicB" + strconv.Itoa(int(time.Now().Unix())) + "$"
 	url = fmt.Sprintf("http://%s/channel/delete?topic=%s", nsqlookupd1.RealHTTPAddr(), topicName)
@@ -420,7 +463,7 @@ func TestDeleteChannel(t *testing.T) {
 	t.Logf("%s", body)
 	err = json.Unmarshal(body, &em)
 	test.Nil(t, err)
-	test.Equal(t, "INVALID_ARG_TOPIC", em.Message)
+	test.Equal(t, "INVALID_ARG_TOPIC", em.Code)
 
 	topicName = "sampletopicB" + strconv.Itoa(int(time.Now().Unix()))
 	url = fmt.Sprintf("http://%s/channel/delete?topic=%s", nsqlookupd1.RealHTTPAddr(), topicName)
@@ -436,7 +479,7 @@ func TestDeleteChannel(t *testing.T) {
 	t.Logf("%s", body)
 	err = json.Unmarshal(body, &em)
 	test.Nil(t, err)
-	test.Equal(t, "MISSING_ARG_CHANNEL", em.Message)
+	test.Equal(t, "MISSING_ARG_CHANNEL", em.Code)
 
 	channelName := "foobar" + strconv.Itoa(int(time.Now().Unix())) + "$"
 	url = fmt.Sprintf("http://%s/channel/delete?topic=%s&channel=%s", nsqlookupd1.RealHTTPAddr(), topicName, channelName)
@@ -452,7 +495,7 @@ func TestDeleteChannel(t *testing.T) {
 	t.Logf("%s", body)
 	err = json.Unmarshal(body, &em)
 	test.Nil(t, err)
-	test.Equal(t, "INVALID_ARG_CHANNEL", em.Message)
+	test.Equal(t, "INVALID_ARG_CHANNEL", em.Code)
 
 	channelName = "foobar" + strconv.Itoa(int(time.Now().Unix()))
 	url = fmt.Sprintf("http://%s/channel/delete?topic=%s&channel=%s", nsqlookupd1.RealHTTPAddr(), topicName, channelName)
@@ -468,7 +511,7 @@ func TestDeleteChannel(t *testing.T) {
 	t.Logf("%s", body)
 	err = json.Unmarshal(body, &em)
 	test.Nil(t, err)
-	test.Equal(t, "CHANNEL_NOT_FOUND", em.Message)
+	test.Equal(t, "CHANNEL_NOT_FOUND", em.Code)
 
 	makeChannel(nsqlookupd1, topicName, channelName)
 
@@ -482,3 +525,77 @@ func TestDeleteChannel(t *testing.T) {
 	t.Logf("%s", body)
 	test.Equal(t, []byte(""), body)
 }
+
+func TestDeclareChannel(t *testing.T) {
+	dataPath, nsqds, nsqlookupd1 := bootstrapNSQCluster(t)
+	defer os.RemoveAll(dataPath)
+	defer nsqds[0].Exit()
+	defer nsqlookupd1.Exit()
+
+	client := http.Client{}
+	post := func(uri string, topicName string, channelName string) int {
+		url := fmt.Sprintf("http://%s/%s?topic=%s&channel=%s", nsqlookupd1.RealHTTPAddr(), uri, topicName, channelName)
+		req, _ := http.NewRequest("POST", url, nil)
+		resp, err := client.Do(req)
+		test.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	topicName := "sampletopicD" + strconv.Itoa(int(time.Now().Unix()))
+	test.Equal(t, 400, post("channel/declare", topicName, "tap%23ephemeral"))
+	test.Equal(t, 404, post("channel/undeclare", topicName, "ch"))
+	test.Equal(t, 200, post("channel/declare", topicName, "ch"))
+	test.Equal(t, 200, post("channel/declare", topicName, "ch"))
+
+	// declared channels are listed even though the topic doesn't exist
+	url := fmt.Sprintf("http://%s/channels?topic=%s", nsqlookupd1.RealHTTPAddr(), topicName)
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Add("Accept", "application/vnd.nsq; version=1.0")
+	resp, err := client.Do(req)
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	ch := ChannelsDoc{}
+	test.Nil(t, json.Unmarshal(body, &ch))
+	test.Equal(t, []interface{}{"ch"}, ch.Channels)
+
+	// so nsqd creates them along with the topic
+	topic := nsqds[0].GetTopic(topicName)
+	_, err = topic.GetExistingChannel("ch")
+	test.Nil(t, err)
+
+	// and they outlive the topic
+	test.Equal(t, 200, post("topic/delete", topicName, ""))
+	test.Equal(t, []string{"ch"}, nsqlookupd1.declarations.Channels(topicName))
+
+	test.Equal(t, 200, post("channel/undeclare", topicName, "ch"))
+	test.Equal(t, 0, len(nsqlookupd1.declarations.Channels(topicName)))
+}
+
+func TestHTTPRateLimit(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.HTTPRateLimit = 1
+	_, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	url := fmt.Sprintf("http://%s/debug/pprof/cmdline", httpAddr)
+	resp, err := http.Get(url)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	resp, err = http.Get(url)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 429, resp.StatusCode)
+
+	// /ping is exempt
+	for i := 0; i < 2; i++ {
+		resp, err = http.Get(fmt.Sprintf("http://%s/ping", httpAddr))
+		test.Nil(t, err)
+		resp.Body.Close()
+		test.Equal(t, 200, resp.StatusCode)
+	}
+}
@@ -9,11 +9,13 @@ import (
 	"log"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/nsqio/nsq/internal/protocol"
+	"github.com/nsqio/nsq/internal/util"
 	"github.com/nsqio/nsq/internal/version"
 )
 
@@ -25,13 +27,20 @@ func (p *LookupProtocolV1) IOLoop(conn net.Conn) error {
 	var err error
 	var line string
 
+	opts := p.ctx.nsqlookupd.opts
 	client := NewClientV1(conn)
 	reader := bufio.NewReader(client)
 	for {
+		if opts.TCPReadTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(opts.TCPReadTimeout))
+		}
 		line, err = reader.ReadString('\n')
 		if err != nil {
 			break
 		}
+		if opts.TCPWriteTimeout > 0 {
+			conn.SetWriteDeadline(time.Now().Add(opts.TCPWriteTimeout))
+		}
 
 		line = strings.TrimSpace(line)
 		params := strings.Split(line, " ")
@@ -90,6 +99,8 @@ func (p *LookupProtocolV1) Exec(client *ClientV1, reader *bufio.Reader, params [
 		return p.REGISTER(client, reader, params[1:])
 	case "UNREGISTER":
 		return p.UNREGISTER(client, reader, params[1:])
+	case "UPDATE":
+		return p.UPDATE(client, reader, params[1:])
 	}
 	return nil, protocol.NewFatalClientErr(nil, "E_INVALID", fmt.Sprintf("invalid command %s", params[0]))
 }
@@ -198,16 +209,9 @@ func (p *LookupProtocolV1) IDENTIFY(client *ClientV1, reader *bufio.Reader, para
 		return nil, protocol.NewFatalClientErr(err, "E_INVALID", "cannot IDENTIFY again")
 	}
 
-	var bodyLen int32
-	err = binary.Read(reader, binary.BigEndian, &bodyLen)
+	body, err := readBody("IDENTIFY", reader)
 	if err != nil {
-		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "IDENTIFY failed to read body size")
-	}
-
-	body := make([]byte, bodyLen)
-	_, err = io.ReadFull(reader, body)
-	if err != nil {
-		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "IDENTIFY failed to read body")
+		return nil, err
 	}
 
 	// body is a json structure with producer information
@@ -219,9 +223,9 @@ func (p *LookupProtocolV1) IDENTIFY(client *ClientV1, reader *bufio.Reader, para
 
 	peerInfo.RemoteAddress = client.RemoteAddr().String()
 
-	// require all fields
-	if peerInfo.BroadcastAddress == "" || peerInfo.TCPPort == 0 || peerInfo.HTTPPort == 0 || peerInfo.Version == "" {
-		return nil, protocol.NewFatalClientErr(nil, "E_BAD_BODY", "IDENTIFY missing fields")
+	err = checkPeerInfo("IDENTIFY", &peerInfo)
+	if err != nil {
+		return nil, err
 	}
 
 	atomic.StoreInt64(&peerInfo.lastUpdate, time.Now().UnixNano())
@@ -254,6 +258,97 @@ func (p *LookupProtocolV1) IDENTIFY(client *ClientV1, reader *bufio.Reader, para
 	return response, nil
 }
 
+// UPDATE replaces the peer info of an identified client, e.g. with a new
+// broadcast address, in all its registrations at once so that it's never missing
+// from lookups as it would be reconnecting. Fields missing from the body are
+// left unchanged.
+func (p *LookupProtocolV1) UPDATE(client *ClientV1, reader *bufio.Reader, params []string) ([]byte, error) {
+	// read the body first so that the client isn't reset by closing the
+	// connection with it unread
+	body, err := readBody("UPDATE", reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if client.peerInfo == nil {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "client must IDENTIFY")
+	}
+
+	// the registered peer info is read without locks, so it's replaced rather
+	// than modified
+	peerInfo := *client.peerInfo
+	err = json.Unmarshal(body, &peerInfo)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "UPDATE failed to decode JSON body")
+	}
+	peerInfo.id = client.peerInfo.id
+	peerInfo.RemoteAddress = client.peerInfo.RemoteAddress
+
+	err = checkPeerInfo("UPDATE", &peerInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	atomic.StoreInt64(&peerInfo.lastUpdate, time.Now().UnixNano())
+
+	p.ctx.nsqlookupd.logf(LOG_INFO, "CLIENT(%s): UPDATE Address:%s TCP:%d HTTP:%d Version:%s",
+		client, peerInfo.BroadcastAddress, peerInfo.TCPPort, peerInfo.HTTPPort, peerInfo.Version)
+
+	client.peerInfo = &peerInfo
+	n := p.ctx.nsqlookupd.DB.UpdatePeerInfo(client.peerInfo)
+	p.ctx.nsqlookupd.logf(LOG_INFO, "DB: client(%s) UPDATE %d registrations", client, n)
+
+	return []byte("OK"), nil
+}
+
+// checkPeerInfo requires all fields, and addresses that can be joined with
+// ports (IPv6 addresses without brackets) or parsed (those with ports)
+func checkPeerInfo(command string, peerInfo *PeerInfo) error {
+	if peerInfo.BroadcastAddress == "" || peerInfo.TCPPort == 0 || peerInfo.HTTPPort == 0 || peerInfo.Version == "" {
+		return protocol.NewFatalClientErr(nil, "E_BAD_BODY", command+" missing fields")
+	}
+	if !util.IsValidHost(peerInfo.BroadcastAddress) {
+		return protocol.NewFatalClientErr(nil, "E_BAD_BODY", command+" invalid broadcast_address")
+	}
+	for _, a := range []struct {
+		name string
+		addr string
+	}{
+		{"broadcast_tcp_address", peerInfo.BroadcastTCPAddress},
+		{"broadcast_http_address", peerInfo.BroadcastHTTPAddress},
+		{"broadcast_https_address", peerInfo.BroadcastHTTPSAddress},
+	} {
+		if a.addr == "" {
+			continue
+		}
+		host, _, err := net.SplitHostPort(a.addr)
+		if err != nil || !util.IsValidHost(host) {
+			return protocol.NewFatalClientErr(err, "E_BAD_BODY", command+" invalid "+a.name)
+		}
+	}
+	return nil
+}
+
+func readBody(command string, reader *bufio.Reader) ([]byte, error) {
+	var bodyLen int32
+	err := binary.Read(reader, binary.BigEndian, &bodyLen)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", command+" failed to read body size")
+	}
+
+	if bodyLen < 0 {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_BODY",
+			fmt.Sprintf("%s invalid body size %d", command, bodyLen))
+	}
+
+	body := make([]byte, bodyLen)
+	_, err = io.ReadFull(reader, body)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", command+" failed to read body")
+	}
+	return body, nil
+}
+
 func (p *LookupProtocolV1) PING(client *ClientV1, params []string) ([]byte, error) {
 	if client.peerInfo != nil {
 		// we could get a PING before other commands on the same client connection
@@ -262,6 +357,38 @@ func (p *LookupProtocolV1) PING(client *ClientV1, params []string) ([]byte, erro
 		p.ctx.nsqlookupd.logf(LOG_INFO, "CLIENT(%s): pinged (last ping %s)", client.peerInfo.id,
 			now.Sub(cur))
 		atomic.StoreInt64(&client.peerInfo.lastUpdate, now.UnixNano())
+		if load, ok := parseLoad(params[1:]); ok {
+			client.peerInfo.load.Store(load)
+		}
 	}
 	return []byte("OK"), nil
 }
+
+// parseLoad parses the load nsqd reports with PING as <name>=<value> params,
+// which are all optional (unknown and invalid ones are ignored)
+func parseLoad(params []string) (*PeerLoad, bool) {
+	var load PeerLoad
+	var ok bool
+	for _, param := range params {
+		i := strings.IndexByte(param, '=')
+		if i < 0 {
+			continue
+		}
+		name, value := param[:i], param[i+1:]
+		var err error
+		switch name {
+		case "depth":
+			load.Depth, err = strconv.ParseInt(value, 10, 64)
+		case "clients":
+			load.Clients, err = strconv.Atoi(value)
+		case "publish_rate":
+			load.PublishRate, err = strconv.ParseFloat(value, 64)
+		default:
+			continue
+		}
+		if err == nil {
+			ok = true
+		}
+	}
+	return &load, ok
+}
@@ -1,11 +1,14 @@
 package nsqlookupd
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"runtime"
 	"sync"
+	"time"
 
 	"github.com/nsqio/nsq/internal/http_api"
 	"github.com/nsqio/nsq/internal/protocol"
@@ -21,6 +24,10 @@ type NSQLookupd struct {
 	tcpServer    *tcpServer
 	waitGroup    util.WaitGroupWrapper
 	DB           *RegistrationDB
+
+	declarations *declarations
+
+	exitChan chan int
 }
 
 func New(opts *Options) (*NSQLookupd, error) {
@@ -30,17 +37,28 @@ func New(opts *Options) (*NSQLookupd, error) {
 		opts.Logger = log.New(os.Stderr, opts.LogPrefix, log.Ldate|log.Ltime|log.Lmicroseconds)
 	}
 	l := &NSQLookupd{
-		opts: opts,
-		DB:   NewRegistrationDB(),
+		opts:     opts,
+		DB:       NewRegistrationDB(),
+		exitChan: make(chan int),
+	}
+
+	err = ValidateOptions(opts)
+	if err != nil {
+		return nil, err
 	}
 
 	l.logf(LOG_INFO, version.String("nsqlookupd"))
 
-	l.tcpListener, err = net.Listen("tcp", opts.TCPAddress)
+	l.declarations, err = newDeclarations(opts.DeclarationsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load declarations - %s", err)
+	}
+
+	l.tcpListener, err = util.Listen(opts.BindFamily, opts.TCPAddress)
 	if err != nil {
 		return nil, fmt.Errorf("listen (%s) failed - %s", opts.TCPAddress, err)
 	}
-	l.httpListener, err = net.Listen("tcp", opts.HTTPAddress)
+	l.httpListener, err = util.Listen(opts.BindFamily, opts.HTTPAddress)
 	if err != nil {
 		return nil, fmt.Errorf("listen (%s) failed - %s", opts.TCPAddress, err)
 	}
@@ -48,6 +66,42 @@ func New(opts *Options) (*NSQLookupd, error) {
 	return l, nil
 }
 
+// ValidateOptions checks opts for problems that would prevent nsqlookupd from
+// starting (without binding listeners)
+func ValidateOptions(opts *Options) error {
+	err := util.ValidateBindFamily(opts.BindFamily)
+	if err != nil {
+		return err
+	}
+	_, err = util.ResolveBindAddr(opts.BindFamily, opts.TCPAddress)
+	if err != nil {
+		return fmt.Errorf("failed to parse --tcp-address (%s) - %s", opts.TCPAddress, err)
+	}
+	_, err = util.ResolveBindAddr(opts.BindFamily, opts.HTTPAddress)
+	if err != nil {
+		return fmt.Errorf("failed to parse --http-address (%s) - %s", opts.HTTPAddress, err)
+	}
+	if !util.IsValidHost(opts.BroadcastAddress) {
+		return fmt.Errorf("--broadcast-address (%s) must be a hostname or IP address (without brackets or port)", opts.BroadcastAddress)
+	}
+	if opts.InactiveProducerTimeout <= 0 {
+		return errors.New("--inactive-producer-timeout must be > 0")
+	}
+	if opts.TombstoneLifetime <= 0 {
+		return errors.New("--tombstone-lifetime must be > 0")
+	}
+	if opts.EmptyRegistrationLifetime != 0 && opts.EmptyRegistrationLifetime < time.Millisecond {
+		return errors.New("--empty-registration-lifetime must be 0 or >= 1ms")
+	}
+	if opts.TCPUserTimeout < 0 || opts.TCPReadTimeout < 0 || opts.TCPWriteTimeout < 0 {
+		return errors.New("--tcp-user-timeout, --tcp-read-timeout and --tcp-write-timeout must be >= 0")
+	}
+	if opts.TCPUserTimeout > 0 && runtime.GOOS != "linux" {
+		return errors.New("--tcp-user-timeout is only supported on Linux")
+	}
+	return nil
+}
+
 // Main starts an instance of nsqlookupd and returns an
 // error if there was a problem starting up.
 func (l *NSQLookupd) Main() error {
@@ -72,11 +126,32 @@ func (l *NSQLookupd) Main() error {
 	l.waitGroup.Wrap(func() {
 		exitFunc(http_api.Serve(l.httpListener, httpServer, "HTTP", l.logf))
 	})
+	if l.opts.EmptyRegistrationLifetime > 0 {
+		l.waitGroup.Wrap(l.compactLoop)
+	}
 
 	err := <-exitCh
 	return err
 }
 
+// compactLoop removes the registrations left without producers for
+// --empty-registration-lifetime, which would otherwise pile up as topics and
+// channels come and go
+func (l *NSQLookupd) compactLoop() {
+	ticker := time.NewTicker(l.opts.EmptyRegistrationLifetime / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if n := l.DB.Compact(l.opts.EmptyRegistrationLifetime); n > 0 {
+				l.logf(LOG_INFO, "DB: removed %d empty registrations", n)
+			}
+		case <-l.exitChan:
+			return
+		}
+	}
+}
+
 func (l *NSQLookupd) RealTCPAddr() *net.TCPAddr {
 	return l.tcpListener.Addr().(*net.TCPAddr)
 }
@@ -97,5 +172,6 @@ func (l *NSQLookupd) Exit() {
 	if l.httpListener != nil {
 		l.httpListener.Close()
 	}
+	close(l.exitChan)
 	l.waitGroup.Wait()
 }
@@ -2,7 +2,10 @@ package nsqlookupd
 
 import (
 	"fmt"
+	"io"
 	"net"
+	"net/url"
+	"strconv"
 	"testing"
 	"time"
 
@@ -147,6 +150,172 @@ func TestBasicLookupd(t *testing.T) {
 	test.Equal(t, 0, len(lr.Producers))
 }
 
+func TestUpdatePeerInfo(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	topicName := "update_peer_info"
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+
+	// must IDENTIFY first
+	update := &nsq.Command{Name: []byte("UPDATE"), Body: []byte(`{"broadcast_address":"new.address"}`)}
+	_, err := update.WriteTo(conn)
+	test.Nil(t, err)
+	v, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	test.Equal(t, []byte("E_INVALID client must IDENTIFY"), v)
+	conn.Close()
+
+	conn = mustConnectLookupd(t, tcpAddr)
+	_, err = conn.Write([]byte("UPDATE\n\xff\xff\xff\xff"))
+	test.Nil(t, err)
+	v, err = nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	test.Equal(t, []byte("E_BAD_BODY UPDATE invalid body size -1"), v)
+	conn.Close()
+
+	conn = mustConnectLookupd(t, tcpAddr)
+	identify(t, conn)
+	nsq.Register(topicName, "channel1").WriteTo(conn)
+	_, err = nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	nsqlookupd.DB.FindProducers("topic", topicName, "")[0].Tombstone()
+
+	_, err = update.WriteTo(conn)
+	test.Nil(t, err)
+	v, err = nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	test.Equal(t, []byte("OK"), v)
+
+	for _, r := range []Registration{{"client", "", ""}, {"topic", topicName, ""}, {"channel", topicName, "channel1"}} {
+		producers := nsqlookupd.DB.FindProducers(r.Category, r.Key, r.SubKey)
+		test.Equal(t, 1, len(producers))
+		test.Equal(t, "new.address", producers[0].peerInfo.BroadcastAddress)
+		// the rest is unchanged
+		test.Equal(t, TCPPort, producers[0].peerInfo.TCPPort)
+		test.Equal(t, HTTPPort, producers[0].peerInfo.HTTPPort)
+		test.Equal(t, NSQDVersion, producers[0].peerInfo.Version)
+	}
+	test.Equal(t, true, nsqlookupd.DB.FindProducers("topic", topicName, "")[0].tombstoned)
+	test.Equal(t, false, nsqlookupd.DB.FindProducers("channel", topicName, "channel1")[0].tombstoned)
+
+	// unregistering on close still finds its registrations
+	conn.Close()
+	for i := 0; i < 100 && len(nsqlookupd.DB.FindProducers("topic", topicName, "")) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, 0, len(nsqlookupd.DB.FindProducers("topic", topicName, "")))
+}
+
+func TestLookupOrderByLoad(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	topicName := "order_by_load"
+
+	for _, params := range [][]string{
+		{"depth=100", "clients=2", "publish_rate=10.50"},
+		{"depth=5", "clients=8", "publish_rate=1.00"},
+		// only understood params count
+		{"depth=x", "unknown=1"},
+	} {
+		conn := mustConnectLookupd(t, tcpAddr)
+		defer conn.Close()
+		identify(t, conn)
+		nsq.Register(topicName, "").WriteTo(conn)
+		_, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+
+		ping := nsq.Ping()
+		for _, param := range params {
+			ping.Params = append(ping.Params, []byte(param))
+		}
+		_, err = ping.WriteTo(conn)
+		test.Nil(t, err)
+		v, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		test.Equal(t, []byte("OK"), v)
+	}
+
+	var lr struct {
+		Producers []struct {
+			RemoteAddress string    `json:"remote_address"`
+			Load          *PeerLoad `json:"load"`
+		} `json:"producers"`
+	}
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	endpoint := fmt.Sprintf("http://%s/lookup?topic=%s&order=load", httpAddr, topicName)
+	err := client.GETV1(endpoint, &lr)
+	test.Nil(t, err)
+
+	test.Equal(t, 3, len(lr.Producers))
+	test.Equal(t, &PeerLoad{Depth: 5, Clients: 8, PublishRate: 1}, lr.Producers[0].Load)
+	test.Equal(t, &PeerLoad{Depth: 100, Clients: 2, PublishRate: 10.5}, lr.Producers[1].Load)
+	test.Equal(t, (*PeerLoad)(nil), lr.Producers[2].Load)
+
+	endpoint = fmt.Sprintf("http://%s/lookup?topic=%s&order=random", httpAddr, topicName)
+	err = client.GETV1(endpoint, &lr)
+	test.NotNil(t, err)
+}
+
+func TestIPv6(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.BindFamily = "tcp6"
+	opts.TCPAddress = "[::1]:0"
+	opts.HTTPAddress = "[::1]:0"
+	nsqlookupd, err := New(opts)
+	if err != nil {
+		t.Skipf("no IPv6 loopback - %s", err)
+	}
+	go nsqlookupd.Main()
+	defer nsqlookupd.Exit()
+
+	topicName := "ipv6"
+	broadcastAddress := "fd4a:622f:d2f2::1"
+
+	conn := mustConnectLookupd(t, nsqlookupd.RealTCPAddr())
+	defer conn.Close()
+
+	// brackets can't be joined with ports
+	ci := map[string]interface{}{
+		"tcp_port":          TCPPort,
+		"http_port":         HTTPPort,
+		"broadcast_address": "[" + broadcastAddress + "]",
+		"hostname":          HostAddr,
+		"version":           NSQDVersion,
+	}
+	cmd, _ := nsq.Identify(ci)
+	cmd.WriteTo(conn)
+	v, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	test.Equal(t, []byte("E_BAD_BODY IDENTIFY invalid broadcast_address"), v)
+	conn.Close()
+
+	conn = mustConnectLookupd(t, nsqlookupd.RealTCPAddr())
+	ci["broadcast_address"] = broadcastAddress
+	cmd, _ = nsq.Identify(ci)
+	cmd.WriteTo(conn)
+	_, err = nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	nsq.Register(topicName, "").WriteTo(conn)
+	_, err = nsq.ReadResponse(conn)
+	test.Nil(t, err)
+
+	node := net.JoinHostPort(broadcastAddress, strconv.Itoa(HTTPPort))
+	endpoint := fmt.Sprintf("http://%s/topic/tombstone?topic=%s&node=%s",
+		nsqlookupd.RealHTTPAddr(), topicName, url.QueryEscape(node))
+	err = http_api.NewClient(nil, ConnectTimeout, RequestTimeout).POSTV1(endpoint)
+	test.Nil(t, err)
+	test.Equal(t, true, nsqlookupd.DB.FindProducers("topic", topicName, "")[0].tombstoned)
+}
+
 func TestChannelUnregister(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -319,6 +488,45 @@ func TestInactiveNodes(t *testing.T) {
 	test.Equal(t, 0, len(producers))
 }
 
+func TestTCPReadTimeout(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.TCPReadTimeout = 100 * time.Millisecond
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	lookupdHTTPAddrs := []string{fmt.Sprintf("%s", httpAddr)}
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+
+	identify(t, conn)
+
+	nsq.Register("read_timeout", "channel1").WriteTo(conn)
+	_, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+
+	ci := clusterinfo.New(nil, http_api.NewClient(nil, ConnectTimeout, RequestTimeout))
+
+	producers, _ := ci.GetLookupdProducers(lookupdHTTPAddrs)
+	test.Equal(t, 1, len(producers))
+
+	// the connection is closed after sending nothing (not even a PING) for
+	// --tcp-read-timeout, unregistering the producer
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	test.Equal(t, io.EOF, err)
+
+	for i := 0; i < 100; i++ {
+		producers, _ = ci.GetLookupdProducers(lookupdHTTPAddrs)
+		if len(producers) == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, 0, len(producers))
+}
+
 func TestTombstonedNodes(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
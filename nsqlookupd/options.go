@@ -16,9 +16,30 @@ type Options struct {
 	TCPAddress       string `flag:"tcp-address"`
 	HTTPAddress      string `flag:"http-address"`
 	BroadcastAddress string `flag:"broadcast-address"`
+	BindFamily       string `flag:"bind-family"`
+
+	HTTPAllowOrigins []string `flag:"http-allow-origins" cfg:"http_allow_origins"`
+
+	// tuning of TCP connections of nsqd peers, which ping every 15s (0 read and
+	// write timeouts never time out)
+	TCPKeepAlive    time.Duration `flag:"tcp-keepalive"`
+	TCPUserTimeout  time.Duration `flag:"tcp-user-timeout"`
+	TCPNoDelay      bool          `flag:"tcp-nodelay"`
+	TCPReadTimeout  time.Duration `flag:"tcp-read-timeout"`
+	TCPWriteTimeout time.Duration `flag:"tcp-write-timeout"`
+
+	// HTTP API rate limits (requests per second, 0 is unlimited)
+	HTTPRateLimit      float64 `flag:"http-rate-limit"`
+	HTTPRateLimitQuery float64 `flag:"http-rate-limit-query"`
+	HTTPRateLimitAdmin float64 `flag:"http-rate-limit-admin"`
 
 	InactiveProducerTimeout time.Duration `flag:"inactive-producer-timeout"`
 	TombstoneLifetime       time.Duration `flag:"tombstone-lifetime"`
+	// how long a registration stays without producers before it's removed (0 never)
+	EmptyRegistrationLifetime time.Duration `flag:"empty-registration-lifetime"`
+
+	// file the channels declared with /channel/declare persist in ("" in memory)
+	DeclarationsFile string `flag:"declarations-file"`
 }
 
 func NewOptions() *Options {
@@ -33,8 +54,13 @@ func NewOptions() *Options {
 		TCPAddress:       "0.0.0.0:4160",
 		HTTPAddress:      "0.0.0.0:4161",
 		BroadcastAddress: hostname,
+		BindFamily:       "tcp",
+		HTTPAllowOrigins: make([]string, 0),
+		TCPNoDelay:       true,
 
 		InactiveProducerTimeout: 300 * time.Second,
 		TombstoneLifetime:       45 * time.Second,
+
+		EmptyRegistrationLifetime: 5 * time.Minute,
 	}
 }
@@ -2,6 +2,9 @@ package nsqlookupd
 
 import (
 	"fmt"
+	"net"
+	"sort"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -10,6 +13,24 @@ import (
 type RegistrationDB struct {
 	sync.RWMutex
 	registrationMap map[Registration]ProducerMap
+
+	// when the registrations left without producers by RemoveProducer were
+	// emptied, for Compact (those added empty with AddRegistration are kept)
+	emptySince     map[Registration]time.Time
+	compactedCount uint64
+}
+
+// RegistrationStats are the counts of the registration database
+type RegistrationStats struct {
+	Registrations int `json:"registrations"`
+	Topics        int `json:"topics"`
+	Channels      int `json:"channels"`
+	// producers of each registration, summed
+	Producers int `json:"producers"`
+	// registrations left without producers, awaiting compaction
+	EmptyRegistrations int `json:"empty_registrations"`
+	// empty registrations removed by Compact since startup
+	CompactedCount uint64 `json:"compacted_count"`
 }
 
 type Registration struct {
@@ -21,6 +42,7 @@ type Registrations []Registration
 
 type PeerInfo struct {
 	lastUpdate       int64
+	load             atomic.Value // *PeerLoad
 	id               string
 	RemoteAddress    string `json:"remote_address"`
 	Hostname         string `json:"hostname"`
@@ -28,6 +50,43 @@ type PeerInfo struct {
 	TCPPort          int    `json:"tcp_port"`
 	HTTPPort         int    `json:"http_port"`
 	Version          string `json:"version"`
+
+	// <addr>:<port> of each listener, when the nsqd advertises them (for the
+	// TCP and HTTP ones, taking precedence over BroadcastAddress and the ports)
+	BroadcastTCPAddress   string `json:"broadcast_tcp_address,omitempty"`
+	BroadcastHTTPAddress  string `json:"broadcast_http_address,omitempty"`
+	BroadcastHTTPSAddress string `json:"broadcast_https_address,omitempty"`
+}
+
+// PeerLoad is the load an nsqd reports with its heartbeats
+type PeerLoad struct {
+	// messages queued in topics and channels
+	Depth   int64 `json:"depth"`
+	Clients int   `json:"clients"`
+	// messages published per second since the previous heartbeat
+	PublishRate float64 `json:"publish_rate"`
+}
+
+// Load returns the load the peer last reported, nil if it never did
+func (p *PeerInfo) Load() *PeerLoad {
+	load, _ := p.load.Load().(*PeerLoad)
+	return load
+}
+
+// less orders loads from the least: fewer messages queued, then fewer clients,
+// then fewer published (unreported loads last)
+func (l *PeerLoad) less(o *PeerLoad) bool {
+	switch {
+	case o == nil:
+		return l != nil
+	case l == nil:
+		return false
+	case l.Depth != o.Depth:
+		return l.Depth < o.Depth
+	case l.Clients != o.Clients:
+		return l.Clients < o.Clients
+	}
+	return l.PublishRate < o.PublishRate
 }
 
 type Producer struct {
@@ -43,6 +102,14 @@ func (p *Producer) String() string {
 	return fmt.Sprintf("%s [%d, %d]", p.peerInfo.BroadcastAddress, p.peerInfo.TCPPort, p.peerInfo.HTTPPort)
 }
 
+// HTTPAddress returns the <addr>:<port> the producer's HTTP listener is reached at
+func (p *Producer) HTTPAddress() string {
+	if p.peerInfo.BroadcastHTTPAddress != "" {
+		return p.peerInfo.BroadcastHTTPAddress
+	}
+	return net.JoinHostPort(p.peerInfo.BroadcastAddress, strconv.Itoa(p.peerInfo.HTTPPort))
+}
+
 func (p *Producer) Tombstone() {
 	p.tombstoned = true
 	p.tombstonedAt = time.Now()
@@ -55,6 +122,7 @@ func (p *Producer) IsTombstoned(lifetime time.Duration) bool {
 func NewRegistrationDB() *RegistrationDB {
 	return &RegistrationDB{
 		registrationMap: make(map[Registration]ProducerMap),
+		emptySince:      make(map[Registration]time.Time),
 	}
 }
 
@@ -66,6 +134,7 @@ func (r *RegistrationDB) AddRegistration(k Registration) {
 	if !ok {
 		r.registrationMap[k] = make(map[string]*Producer)
 	}
+	delete(r.emptySince, k)
 }
 
 // add a producer to a registration
@@ -76,6 +145,7 @@ func (r *RegistrationDB) AddProducer(k Registration, p *Producer) bool {
 	if !ok {
 		r.registrationMap[k] = make(map[string]*Producer)
 	}
+	delete(r.emptySince, k)
 	producers := r.registrationMap[k]
 	_, found := producers[p.peerInfo.id]
 	if found == false {
@@ -97,16 +167,85 @@ func (r *RegistrationDB) RemoveProducer(k Registration, id string) (bool, int) {
 		removed = true
 	}
 
-	// Note: this leaves keys in the DB even if they have empty lists
+	// Note: this leaves keys in the DB even if they have empty lists, Compact
+	// removes them once they've stayed empty for a while
 	delete(producers, id)
+	if removed && len(producers) == 0 {
+		r.emptySince[k] = time.Now()
+	}
 	return removed, len(producers)
 }
 
+// UpdatePeerInfo replaces the producers of the peer of peerInfo's id in all
+// registrations with producers of peerInfo (keeping their tombstones), returning
+// in how many registrations
+func (r *RegistrationDB) UpdatePeerInfo(peerInfo *PeerInfo) int {
+	r.Lock()
+	defer r.Unlock()
+	n := 0
+	for _, producers := range r.registrationMap {
+		p, ok := producers[peerInfo.id]
+		if !ok {
+			continue
+		}
+		producers[peerInfo.id] = &Producer{
+			peerInfo:     peerInfo,
+			tombstoned:   p.tombstoned,
+			tombstonedAt: p.tombstonedAt,
+		}
+		n++
+	}
+	return n
+}
+
 // remove a Registration and all it's producers
 func (r *RegistrationDB) RemoveRegistration(k Registration) {
 	r.Lock()
 	defer r.Unlock()
 	delete(r.registrationMap, k)
+	delete(r.emptySince, k)
+}
+
+// Compact removes the registrations that have had no producers for lifetime
+// since their last one was removed, returning how many it removed
+func (r *RegistrationDB) Compact(lifetime time.Duration) int {
+	r.Lock()
+	defer r.Unlock()
+	now := time.Now()
+	removed := 0
+	for k, since := range r.emptySince {
+		if now.Sub(since) < lifetime {
+			continue
+		}
+		delete(r.emptySince, k)
+		if len(r.registrationMap[k]) == 0 {
+			delete(r.registrationMap, k)
+			removed++
+		}
+	}
+	r.compactedCount += uint64(removed)
+	return removed
+}
+
+// Stats returns the counts of registrations and producers
+func (r *RegistrationDB) Stats() RegistrationStats {
+	r.RLock()
+	defer r.RUnlock()
+	stats := RegistrationStats{
+		Registrations:      len(r.registrationMap),
+		EmptyRegistrations: len(r.emptySince),
+		CompactedCount:     r.compactedCount,
+	}
+	for k, producers := range r.registrationMap {
+		switch k.Category {
+		case "topic":
+			stats.Topics++
+		case "channel":
+			stats.Channels++
+		}
+		stats.Producers += len(producers)
+	}
+	return stats
 }
 
 func (r *RegistrationDB) needFilter(key string, subkey string) bool {
@@ -222,6 +361,17 @@ func (pp Producers) FilterByActive(inactivityTimeout time.Duration, tombstoneLif
 	return results
 }
 
+// SortByLoad orders the producers from the least loaded (see PeerLoad)
+func (pp Producers) SortByLoad() {
+	loads := make(map[*Producer]*PeerLoad, len(pp))
+	for _, p := range pp {
+		loads[p] = p.peerInfo.Load()
+	}
+	sort.SliceStable(pp, func(i, j int) bool {
+		return loads[pp[i]].less(loads[pp[j]])
+	})
+}
+
 func (pp Producers) PeerInfo() []*PeerInfo {
 	results := []*PeerInfo{}
 	for _, p := range pp {
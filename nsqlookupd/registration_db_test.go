@@ -12,9 +12,12 @@ import (
 func TestRegistrationDB(t *testing.T) {
 	sec30 := 30 * time.Second
 	beginningOfTime := time.Unix(1348797047, 0)
-	pi1 := &PeerInfo{beginningOfTime.UnixNano(), "1", "remote_addr:1", "host", "b_addr", 1, 2, "v1"}
-	pi2 := &PeerInfo{beginningOfTime.UnixNano(), "2", "remote_addr:2", "host", "b_addr", 2, 3, "v1"}
-	pi3 := &PeerInfo{beginningOfTime.UnixNano(), "3", "remote_addr:3", "host", "b_addr", 3, 4, "v1"}
+	pi1 := &PeerInfo{lastUpdate: beginningOfTime.UnixNano(), id: "1", RemoteAddress: "remote_addr:1", Hostname: "host",
+		BroadcastAddress: "b_addr", TCPPort: 1, HTTPPort: 2, Version: "v1"}
+	pi2 := &PeerInfo{lastUpdate: beginningOfTime.UnixNano(), id: "2", RemoteAddress: "remote_addr:2", Hostname: "host",
+		BroadcastAddress: "b_addr", TCPPort: 2, HTTPPort: 3, Version: "v1"}
+	pi3 := &PeerInfo{lastUpdate: beginningOfTime.UnixNano(), id: "3", RemoteAddress: "remote_addr:3", Hostname: "host",
+		BroadcastAddress: "b_addr", TCPPort: 3, HTTPPort: 4, Version: "v1"}
 	p1 := &Producer{pi1, false, beginningOfTime}
 	p2 := &Producer{pi2, false, beginningOfTime}
 	p3 := &Producer{pi3, false, beginningOfTime}
@@ -99,6 +102,40 @@ func TestRegistrationDB(t *testing.T) {
 	test.Equal(t, 0, len(k))
 }
 
+func TestRegistrationDBCompact(t *testing.T) {
+	pi := &PeerInfo{id: "1"}
+	db := NewRegistrationDB()
+
+	db.AddProducer(Registration{"topic", "a", ""}, &Producer{peerInfo: pi})
+	db.AddProducer(Registration{"channel", "a", "c"}, &Producer{peerInfo: pi})
+	db.AddProducer(Registration{"topic", "b", ""}, &Producer{peerInfo: pi})
+	// created empty, never compacted
+	db.AddRegistration(Registration{"topic", "created", ""})
+
+	db.RemoveProducer(Registration{"topic", "a", ""}, pi.id)
+	db.RemoveProducer(Registration{"channel", "a", "c"}, pi.id)
+	stats := db.Stats()
+	test.Equal(t, 4, stats.Registrations)
+	test.Equal(t, 3, stats.Topics)
+	test.Equal(t, 1, stats.Channels)
+	test.Equal(t, 1, stats.Producers)
+	test.Equal(t, 2, stats.EmptyRegistrations)
+
+	test.Equal(t, 0, db.Compact(time.Minute))
+
+	// registered again before it's compacted
+	db.AddProducer(Registration{"channel", "a", "c"}, &Producer{peerInfo: pi})
+
+	test.Equal(t, 1, db.Compact(0))
+	test.Equal(t, 0, len(db.FindRegistrations("topic", "a", "")))
+	test.Equal(t, 1, len(db.FindRegistrations("channel", "a", "c")))
+	test.Equal(t, 1, len(db.FindRegistrations("topic", "created", "")))
+	stats = db.Stats()
+	test.Equal(t, 3, stats.Registrations)
+	test.Equal(t, 0, stats.EmptyRegistrations)
+	test.Equal(t, uint64(1), stats.CompactedCount)
+}
+
 func fillRegDB(registrations int, producers int) *RegistrationDB {
 	regDB := NewRegistrationDB()
 	for i := 0; i < registrations; i++ {
@@ -145,6 +182,32 @@ func benchmarkDoLookup(b *testing.B, registrations int, producers int) {
 	}
 }
 
+// benchmarkDoLookupChurn looks up topics after churned topics (registered and
+// unregistered) outnumbered them 4 to 1, with their empty registrations left in
+// place or compacted
+func benchmarkDoLookupChurn(b *testing.B, registrations int, producers int, compact bool) {
+	regDB := fillRegDB(registrations, producers)
+	p := &Producer{peerInfo: &PeerInfo{id: "churn"}}
+	for i := 0; i < 4*registrations; i++ {
+		regT := Registration{"topic", "churn" + strconv.Itoa(i), ""}
+		regC := Registration{"channel", "churn" + strconv.Itoa(i), "c"}
+		regDB.AddProducer(regT, p)
+		regDB.AddProducer(regC, p)
+		regDB.RemoveProducer(regC, p.peerInfo.id)
+		regDB.RemoveProducer(regT, p.peerInfo.id)
+	}
+	if compact {
+		regDB.Compact(0)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		topic := "t" + strconv.Itoa(rand.Intn(registrations))
+		_ = regDB.FindRegistrations("topic", topic, "")
+		_ = regDB.FindRegistrations("channel", topic, "*").SubKeys()
+		_ = regDB.FindProducers("topic", topic, "")
+	}
+}
+
 func BenchmarkLookupRegistrations8x8(b *testing.B) {
 	benchmarkLookupRegistrations(b, 8, 8)
 }
@@ -216,3 +279,11 @@ func BenchmarkDoLookup512x512(b *testing.B) {
 func BenchmarkDoLookup512x2048(b *testing.B) {
 	benchmarkDoLookup(b, 512, 2048)
 }
+
+func BenchmarkDoLookupChurn512x64(b *testing.B) {
+	benchmarkDoLookupChurn(b, 512, 64, false)
+}
+
+func BenchmarkDoLookupChurnCompacted512x64(b *testing.B) {
+	benchmarkDoLookupChurn(b, 512, 64, true)
+}
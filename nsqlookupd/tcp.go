@@ -16,11 +16,21 @@ type tcpServer struct {
 func (p *tcpServer) Handle(clientConn net.Conn) {
 	p.ctx.nsqlookupd.logf(LOG_INFO, "TCP: new client(%s)", clientConn.RemoteAddr())
 
+	opts := p.ctx.nsqlookupd.opts
+	err := protocol.TCPOptions{
+		KeepAlive:   opts.TCPKeepAlive,
+		UserTimeout: opts.TCPUserTimeout,
+		NoDelay:     opts.TCPNoDelay,
+	}.Tune(clientConn)
+	if err != nil {
+		p.ctx.nsqlookupd.logf(LOG_WARN, "failed to tune TCP connection of client(%s) - %s", clientConn.RemoteAddr(), err)
+	}
+
 	// The client should initialize itself by sending a 4 byte sequence indicating
 	// the version of the protocol that it intends to communicate, this will allow us
 	// to gracefully upgrade the protocol away from text/line oriented to whatever...
 	buf := make([]byte, 4)
-	_, err := io.ReadFull(clientConn, buf)
+	_, err = io.ReadFull(clientConn, buf)
 	if err != nil {
 		p.ctx.nsqlookupd.logf(LOG_ERROR, "failed to read protocol version - %s", err)
 		clientConn.Close()
@@ -3,6 +3,8 @@ set -e
 
 GOMAXPROCS=1 go test -timeout 90s $(go list ./... | grep -v /vendor/)
 GOMAXPROCS=4 go test -timeout 90s -race $(go list ./... | grep -v /vendor/)
+# resilience tests, with fault injection
+GOMAXPROCS=4 go test -timeout 90s -tags faults ./internal/faults/ ./nsqd/
 
 # no tests, but a build is something
 for dir in apps/*/ bench/*/; do